@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bootstrap/internal/audit"
+	"bootstrap/internal/config"
+	"log"
+)
+
+// auditedCommands are the commands changing the state of a volume or exposing it.
+var auditedCommands = map[string]bool{
+	"authorize":               true,
+	"deauthorize":             true,
+	"mount":                   true,
+	"unmount":                 true,
+	"add-persistent-mount":    true,
+	"remove-persistent-mount": true,
+	"freeze":                  true,
+	"thaw":                    true,
+	"release-snapshot":        true,
+	"add-key":                 true,
+	"remove-key":              true,
+	"enroll-fido2":            true,
+	"reencrypt":               true,
+	"export-escrow":           true,
+	"recover":                 true,
+	"reconcile":               true,
+	"accept-header":           true,
+	"serve-nbd":               true,
+	"panic":                   true,
+}
+
+var (
+	auditLog   *audit.Logger
+	auditEvent *audit.Event // Event of the running command, recorded once when it finishes
+)
+
+// startAudit opens the audit log and starts the event of an audited command. Privileged
+// operations must not run unaudited, so failing to open the log is fatal.
+func startAudit(cfg *config.AppConfig) {
+	if !auditedCommands[cfg.Cmd.CommandName] && cfg.Cmd.CommandName != "daemon" {
+		return
+	}
+
+	logger, err := audit.Open(cfg.Audit)
+	if err != nil {
+		fatalf("Failed to open audit log: %v", err)
+	}
+	auditLog = logger
+	if auditedCommands[cfg.Cmd.CommandName] {
+		auditEvent = audit.NewEvent(cfg.Cmd.CommandName, cfg.LUKS.VolumePath, cfg.LUKS.MapperName)
+		auditEvent.Tenant = cfg.LUKS.Tenant
+	}
+}
+
+// finishAudit records the outcome of the running command, an empty failure meaning success.
+func finishAudit(failure string) {
+	if auditEvent == nil {
+		return
+	}
+	auditEvent.Outcome = audit.OutcomeSuccess
+	if failure != "" {
+		auditEvent.Outcome = audit.OutcomeFailure
+		auditEvent.Error = failure
+	}
+	if err := auditLog.Record(auditEvent); err != nil {
+		log.Printf("Failed to record audit event: %v", err)
+	}
+	auditEvent = nil
+}
+
+// recordAuditEvent records an event outside the command lifecycle: actions the daemon
+// took on its own, alerts it raised, or sessions of a long-running export.
+func recordAuditEvent(cfg *config.AppConfig, command, outcome, detail string) {
+	e := audit.NewEvent(command, cfg.LUKS.VolumePath, cfg.LUKS.MapperName)
+	e.Tenant = cfg.LUKS.Tenant
+	e.Outcome = outcome
+	e.Detail = detail
+	if err := auditLog.Record(e); err != nil {
+		log.Printf("Failed to record audit event: %v", err)
+	}
+	notifyDaemonEvent(cfg, command, outcome, detail)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bootstrap/internal/backup"
+	"bootstrap/internal/config"
+	"bootstrap/internal/luks"
+	"bootstrap/internal/secrets"
+	"bootstrap/internal/state"
+	"bootstrap/internal/trace"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// tarOptions preserve ownership, ACLs and extended attributes of the volume's files.
+var tarOptions = []string{"--gzip", "--numeric-owner", "--xattrs", "--acls"}
+
+// backupVolume streams an encrypted tarball of a consistent view of the mounted volume
+// to a file or URL and records its manifest.
+func backupVolume(ctx context.Context, cfg *config.AppConfig) {
+	if cfg.Cmd.Backup == "" || cfg.Cmd.BackupKey == "" {
+		fatalf("Error: --target and --backup-key must be specified")
+	}
+	key, err := backupKey(cfg, true)
+	if err != nil {
+		fatalf("Failed to read backup key: %v", err)
+	}
+	defer secrets.Wipe(key)
+
+	loadKey(ctx, cfg)
+	dir, mode, release, err := luks.BackupView(ctx, &cfg.LUKS)
+	if err != nil {
+		fatalf("Failed to take a consistent view of the volume: %v", err)
+	}
+	manifest := &backup.Manifest{
+		MapperName: cfg.LUKS.MapperName,
+		Created:    time.Now().UTC(),
+		Target:     cfg.Cmd.Backup,
+		Format:     backup.Format,
+		KeyID:      backup.KeyID(key),
+		Consistent: mode,
+	}
+	manifest.UUID, _ = luks.VolumeUUID(ctx, &cfg.LUKS)
+
+	fmt.Printf("Backing up %s (%s) to %s\n", cfg.LUKS.MountPoint, mode, cfg.Cmd.Backup)
+	sink, err := backup.Create(cfg.Cmd.Backup)
+	if err != nil {
+		release()
+		fatalf("Failed to create backup: %v", err)
+	}
+	err = writeBackup(sink, key, dir)
+	release()
+	if closeErr := sink.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		if !backup.IsURL(cfg.Cmd.Backup) {
+			os.Remove(cfg.Cmd.Backup)
+		}
+		fatalf("Failed to write backup: %v", err)
+	}
+
+	manifest.Bytes = sink.Bytes()
+	manifest.SHA256 = sink.SHA256()
+	if err := backup.SaveManifest(filepath.Join(state.Dir, "backups"), manifest); err != nil {
+		log.Printf("Failed to record backup manifest: %v", err)
+	}
+	printResult(fmt.Sprintf("Backup written to %s (%d MiB), encrypted with key %s", manifest.Target, manifest.Bytes>>20, manifest.KeyID), manifest)
+}
+
+// writeBackup encrypts a tarball of dir into sink.
+func writeBackup(sink *backup.Sink, key []byte, dir string) error {
+	encrypted, err := backup.NewWriter(sink, key)
+	if err != nil {
+		return err
+	}
+	args := append([]string{"--create", "--one-file-system"}, tarOptions...)
+	tar := trace.Command("tar", append(args, "-C", dir, ".")...)
+	tar.Stdout = encrypted
+	tar.Stderr = os.Stderr
+	if err := tar.Run(); err != nil {
+		return fmt.Errorf("tar failed: %w", err)
+	}
+	return encrypted.Close()
+}
+
+// restoreVolume extracts a backup onto the empty filesystem of a newly authorized and
+// mounted volume.
+func restoreVolume(cfg *config.AppConfig) {
+	if cfg.Cmd.Backup == "" || cfg.Cmd.BackupKey == "" {
+		fatalf("Error: --source and --backup-key must be specified")
+	}
+	key, err := backupKey(cfg, false)
+	if err != nil {
+		fatalf("Failed to read backup key: %v", err)
+	}
+	defer secrets.Wipe(key)
+	if err := luks.CheckRestoreTarget(&cfg.LUKS); err != nil {
+		fatalf("Failed to restore: %v", err)
+	}
+
+	source, err := backup.Open(cfg.Cmd.Backup)
+	if err != nil {
+		fatalf("Failed to open backup: %v", err)
+	}
+	defer source.Close()
+	decrypted, err := backup.NewReader(source, key)
+	if err != nil {
+		fatalf("Failed to read backup: %v", err)
+	}
+
+	fmt.Printf("Restoring %s to %s\n", cfg.Cmd.Backup, cfg.LUKS.MountPoint)
+	args := append([]string{"--extract", "--same-permissions"}, tarOptions...)
+	tar := trace.Command("tar", append(args, "-C", cfg.LUKS.MountPoint)...)
+	tar.Stdin = decrypted
+	tar.Stdout = os.Stderr
+	tar.Stderr = os.Stderr
+	if err := tar.Run(); err != nil {
+		fatalf("Failed to restore backup, %s holds a partial restore: %v", cfg.LUKS.MountPoint, err)
+	}
+	printResult("Backup restored to "+cfg.LUKS.MountPoint, summarize(cfg))
+}
+
+// backupKey reads the key of --backup-key. backup generates it when the file does not
+// exist yet, it must then be kept off the device to restore after losing it.
+func backupKey(cfg *config.AppConfig, generate bool) ([]byte, error) {
+	path := cfg.Cmd.BackupKey
+	if _, err := os.Stat(path); generate && errors.Is(err, os.ErrNotExist) {
+		key := make([]byte, backup.KeySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err := writeKeyToFile(path, key, cfg.LUKS.KeyfileOwner); err != nil {
+			return nil, err
+		}
+		fmt.Printf("Generated backup key %s, store a copy off the device: %s\n", backup.KeyID(key), path)
+		return key, nil
+	}
+	key, err := readKeyFromFile(path, cfg.Cmd.InsecureKeyfile)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != backup.KeySize {
+		secrets.Wipe(key)
+		return nil, fmt.Errorf("backup key %s must hold %d bytes", path, backup.KeySize)
+	}
+	return key, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bootstrap/internal/config"
+	"bootstrap/internal/luks"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+)
+
+// benchmark measures the candidate ciphers and PBKDF settings on this hardware and
+// prints the luks settings to configure, so low-power boards get a cipher they can
+// sustain and a keyslot they can unlock in time.
+func benchmark(ctx context.Context, cmd config.Command) {
+	if cmd.UnlockTime <= 0 {
+		fatalf("--unlock-time must be positive")
+	}
+	fmt.Printf("Benchmarking, this takes about %s...\n", 10*cmd.UnlockTime)
+	result, err := luks.Benchmark(ctx, os.TempDir(), cmd.UnlockTime)
+	if err != nil {
+		fatalf("Benchmark failed: %v", err)
+	}
+
+	ct := newTable()
+	ct.AppendHeader(table.Row{"Cipher", "Key", "Encryption", "Decryption"})
+	for _, c := range result.Ciphers {
+		ct.AppendRow(table.Row{c.Cipher, fmt.Sprintf("%db", c.KeySize), throughput(c.EncryptMiB), throughput(c.DecryptMiB)})
+	}
+	render(ct)
+
+	pt := newTable()
+	pt.AppendHeader(table.Row{"PBKDF", "Memory", "Unlock"})
+	for _, p := range result.PBKDFs {
+		memory := "-"
+		if p.Memory > 0 {
+			memory = fmt.Sprintf("%d MiB", p.Memory>>10)
+		}
+		unlock := p.Unlock.Round(time.Millisecond).String()
+		if p.Error != "" {
+			unlock = p.Error
+		}
+		pt.AppendRow(table.Row{p.PBKDF, memory, unlock})
+	}
+	pt.AppendFooter(table.Row{"Target", "", result.UnlockTime})
+	render(pt)
+
+	s := result.Suggested
+	var b strings.Builder
+	fmt.Fprintf(&b, "Suggested settings:\nluks:\n  cipher: %s\n  keySize: %d\n  pbkdf: %s\n", s.Cipher, s.KeySize, s.PBKDF)
+	if s.PBKDFMemory > 0 {
+		fmt.Fprintf(&b, "  pbkdfMemory: %d\n", s.PBKDFMemory)
+	}
+	printResult(strings.TrimSuffix(b.String(), "\n"), result)
+}
+
+// throughput formats a cipher throughput, n/a when the kernel lacks the cipher.
+func throughput(mib float64) string {
+	if mib == 0 {
+		return "n/a"
+	}
+	return fmt.Sprintf("%.1f MiB/s", mib)
+}
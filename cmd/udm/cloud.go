@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bootstrap/internal/cloudinit"
+	"bootstrap/internal/config"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// provisionCloud provisions the volume described by the user-data of a cloud VM: the
+// configuration is installed where the other commands find it, then the volume is
+// authorized with the bootstrap token of the user-data on first boot and mounted on
+// later boots.
+func provisionCloud(cmd config.Command) {
+	if !cloudinit.ValidSource(cmd.UserDataSource) {
+		fatalf("Error: --source must be auto, cloud-init, ec2 or openstack")
+	}
+	userData, err := cloudinit.Fetch(cmd.UserDataSource)
+	if err != nil {
+		fatalf("Failed to read user-data: %v", err)
+	}
+	provision, err := cloudinit.Parse(userData)
+	if err != nil {
+		fatalf("Failed to read udm section of user-data: %v", err)
+	}
+
+	path := cmd.Config
+	if path == "" {
+		path = config.DefaultConfigPath()
+	}
+	cfg, err := installCloudConfig(path, provision.Config)
+	if err != nil {
+		fatalf("Failed to install configuration: %v", err)
+	}
+
+	if provision.Bootstrap != nil {
+		token, err := os.CreateTemp("/run", "udm-bootstrap-*.yml")
+		if err != nil {
+			fatalf("Failed to write bootstrap token: %v", err)
+		}
+		defer os.Remove(token.Name())
+		_, err = token.Write(provision.Bootstrap)
+		if closeErr := token.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			fatalf("Failed to write bootstrap token: %v", err)
+		}
+		cmd.Bootstrap = token.Name()
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		fatalf("Failed to locate udm: %v", err)
+	}
+	p := &provisioner{executable: executable, cmd: cmd, reuseToken: cmd.ReuseToken}
+	result := provisionResult{Config: path, MapperName: cfg.LUKS.MapperName}
+	p.provisionVolume(cfg, &result)
+	if !result.Success {
+		exitWithResult(1, fmt.Sprintf("Failed to %s %s: %s", result.Action, cfg.LUKS.MapperName, result.Error), result)
+	}
+	printResult(result.Message, result)
+}
+
+// installCloudConfig validates the configuration of the user-data and atomically
+// replaces path with it.
+func installCloudConfig(path string, data []byte) (*config.AppConfig, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return nil, err
+	}
+	cfg, err := config.LoadConfig(tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	return cfg, os.Rename(tmp, path)
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bootstrap/internal/audit"
+	"bootstrap/internal/config"
+	"bootstrap/internal/holders"
+	"bootstrap/internal/lock"
+	"bootstrap/internal/luks"
+	"bootstrap/internal/metrics"
+	"bootstrap/internal/schedule"
+	"bootstrap/internal/state"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	leaseReapInterval   = 10 * time.Second // How often the daemon looks for expired leases
+	headerCheckInterval = 5 * time.Minute  // Header check schedule unless configured
+	usageCheckInterval  = time.Minute      // How often the daemon checks filesystem usage
+	usbKeyCheckInterval = 2 * time.Second  // How often the daemon checks the USB key is present
+)
+
+// daemonTask is a task the daemon runs on a schedule under the volume lock.
+type daemonTask struct {
+	name     string
+	schedule schedule.Schedule
+	run      func(ctx context.Context, cfg *config.AppConfig) error
+}
+
+// maintenanceTasks maps the configurable schedule tasks to their implementation.
+var maintenanceTasks = map[string]func(ctx context.Context, cfg *config.AppConfig) error{
+	config.TaskFstrim:       trimFilesystem,
+	config.TaskHeaderCheck:  checkHeader,
+	config.TaskHealthReport: healthReport,
+}
+
+// daemonTasks returns the lease check and the configured maintenance tasks. The header
+// check runs every few minutes unless scheduled explicitly.
+func daemonTasks(cfg *config.AppConfig) []daemonTask {
+	tasks := []daemonTask{{name: "lease check", schedule: schedule.Every(leaseReapInterval), run: reapLeases}}
+
+	headerChecked := false
+	for _, entry := range cfg.Schedule {
+		// Validated when the configuration was loaded
+		sched, _ := schedule.Parse(entry.When)
+		tasks = append(tasks, daemonTask{name: entry.Task, schedule: sched, run: maintenanceTasks[entry.Task]})
+		headerChecked = headerChecked || entry.Task == config.TaskHeaderCheck
+	}
+	if !headerChecked {
+		tasks = append(tasks, daemonTask{name: config.TaskHeaderCheck, schedule: schedule.Every(headerCheckInterval), run: checkHeader})
+	}
+	if cfg.LUKS.EnvFile != "" {
+		tasks = append(tasks, daemonTask{name: "environment file", schedule: schedule.Every(leaseReapInterval), run: syncEnvFile})
+	}
+	usage := &usageWatch{level: luks.UsageOK}
+	tasks = append(tasks, daemonTask{name: "usage check", schedule: schedule.Every(usageCheckInterval), run: usage.check})
+	if cfg.LUKS.AutoLock != "" {
+		// Validated when the configuration was loaded
+		timeout, _ := time.ParseDuration(cfg.LUKS.AutoLock)
+		idle := &idleWatch{timeout: timeout}
+		tasks = append(tasks, daemonTask{name: "auto-lock", schedule: schedule.Every(leaseReapInterval), run: idle.check})
+	}
+	if cfg.LUKS.USBKey.LockOnRemoval {
+		tasks = append(tasks, daemonTask{name: "USB key check", schedule: schedule.Every(usbKeyCheckInterval), run: lockOnUSBKeyRemoval})
+	}
+	return tasks
+}
+
+// runDaemon runs in the foreground until SIGINT or SIGTERM, unmounting the volume once
+// every holder's lease expired so it does not stay unlocked after an orchestrator crash,
+// alerting when the LUKS header is changed outside udm and running the scheduled
+// maintenance tasks. Changes of the configuration are applied without restart.
+func runDaemon(ctx context.Context, cfg *config.AppConfig) {
+	log.Printf("udm daemon started for %s", cfg.LUKS.MapperName)
+
+	// Stopping kills the external commands of tasks in progress
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// A reload replaces the configuration rather than changing it, goroutines load the
+	// current one for every run
+	var live atomic.Pointer[config.AppConfig]
+	live.Store(cfg)
+
+	tasks := daemonTasks(cfg)
+
+	if cfg.Metrics.Listen != "" {
+		server, err := metrics.Serve(cfg.Metrics.Listen, func() []metrics.Metric { return collectMetrics(ctx, live.Load()) })
+		if err != nil {
+			fatalf("Failed to serve metrics: %v", err)
+		}
+		defer server.Close()
+		log.Printf("Serving metrics on %s/metrics", cfg.Metrics.Listen)
+	}
+
+	if cfg.DBus.Enabled {
+		conn, err := serveDBus(cfg, nil)
+		if err != nil {
+			fatalf("Failed to serve D-Bus interface: %v", err)
+		}
+		defer conn.Close()
+		log.Printf("Serving %s on D-Bus", dbusName)
+	}
+
+	done := make(chan struct{})
+	if notifier != nil {
+		go flushOutbox(done)
+	}
+	var wg sync.WaitGroup
+	for _, task := range tasks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				timer := time.NewTimer(time.Until(task.schedule.Next(time.Now())))
+				select {
+				case <-timer.C:
+					if err := runLocked(ctx, live.Load(), task.run); err != nil {
+						log.Printf("%s failed: %v", task.name, err)
+					}
+				case <-done:
+					timer.Stop()
+					return
+				}
+			}
+		}()
+	}
+
+	// The configuration is reloaded when a file changes or on SIGHUP
+	reload := make(chan struct{}, 1)
+	if err := watchFiles(cfg.Cmd.ConfigFiles, reload); err != nil {
+		log.Printf("Not watching the configuration, reload it with SIGHUP: %v", err)
+	}
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	// An intrusion detection system wipes the volume with SIGUSR2, without the lock
+	tamper := make(chan os.Signal, 1)
+	if cfg.LUKS.Panic.Signal && len(tamperSignals) > 0 {
+		signal.Notify(tamper, tamperSignals...)
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	for {
+		select {
+		case <-tamper:
+			panicOnSignal(ctx, live.Load())
+			continue
+		case <-reload:
+			time.Sleep(reloadSettle)
+			select {
+			case <-reload:
+			default:
+			}
+		case <-hangup:
+		case sig := <-stop:
+			log.Printf("udm daemon stopping on %s", sig)
+			cancel()
+			close(done)
+			wg.Wait()
+			printResult("Daemon stopped", nil)
+			return
+		}
+		if err := runLocked(ctx, live.Load(), func(ctx context.Context, cfg *config.AppConfig) error {
+			next, err := reloadConfig(cfg)
+			if err == nil {
+				live.Store(next)
+			}
+			return err
+		}); err != nil {
+			log.Printf("Configuration not reloaded: %v", err)
+		}
+	}
+}
+
+// runLocked runs fn under the volume lock, waiting for a command in progress to finish.
+// Canceling ctx kills the external commands fn runs.
+func runLocked(ctx context.Context, cfg *config.AppConfig, fn func(ctx context.Context, cfg *config.AppConfig) error) error {
+	volumeLock, err := lock.Acquire(cfg.LUKS.MapperName, leaseReapInterval)
+	if err != nil {
+		return err
+	}
+	defer volumeLock.Release()
+	return fn(ctx, cfg)
+}
+
+// reapLeases drops expired holders and unmounts the volume if none remain.
+func reapLeases(ctx context.Context, cfg *config.AppConfig) error {
+	held, err := holders.Load(cfg.LUKS.MapperName)
+	if err != nil {
+		return err
+	}
+	expired := held.Reap(time.Now())
+	if len(expired) == 0 {
+		return nil
+	}
+
+	ids := make([]string, 0, len(expired))
+	for _, h := range expired {
+		ids = append(ids, h.ID)
+	}
+	log.Printf("Leases expired: %s", strings.Join(ids, ", "))
+
+	if len(held.Holders) == 0 && volumeMounted(cfg) {
+		log.Printf("No holders left, unmounting %s", cfg.LUKS.MountPoint)
+		detail := "leases expired: " + strings.Join(ids, ", ")
+		if err := closeVolume(ctx, cfg, "lease-expired"); err != nil {
+			recordAuditEvent(cfg, "unmount", audit.OutcomeFailure, detail+": "+err.Error())
+			return err
+		}
+		recordAuditEvent(cfg, "unmount", audit.OutcomeSuccess, detail)
+	}
+	return held.Save()
+}
+
+// idleWatch closes the volume once it saw no I/O for timeout, limiting how long
+// decrypted data stays reachable on an unattended or stolen device. Volumes held by a
+// consumer are left to their leases. The volume stays closed until the next udm mount,
+// volumes reopened on first access are automount volumes locked by idleTimeout.
+type idleWatch struct {
+	timeout    time.Duration
+	count      uint64
+	lastActive time.Time
+}
+
+func (w *idleWatch) check(ctx context.Context, cfg *config.AppConfig) error {
+	if !volumeMounted(cfg) {
+		w.lastActive = time.Time{}
+		return nil
+	}
+	count, err := luks.IOCount(cfg.LUKS.MapperName)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if w.lastActive.IsZero() || count != w.count {
+		w.count = count
+		w.lastActive = now
+		return nil
+	}
+	if now.Sub(w.lastActive) < w.timeout {
+		return nil
+	}
+
+	held, err := holders.Load(cfg.LUKS.MapperName)
+	if err != nil {
+		return err
+	}
+	if len(held.Holders) > 0 {
+		return nil
+	}
+	log.Printf("No I/O on %s for %s, locking the volume until the next udm mount", cfg.LUKS.MountPoint, w.timeout)
+	detail := fmt.Sprintf("idle for %s", w.timeout)
+	if err := closeVolume(ctx, cfg, "idle-timeout"); err != nil {
+		recordAuditEvent(cfg, "unmount", audit.OutcomeFailure, detail+": "+err.Error())
+		return err
+	}
+	recordAuditEvent(cfg, "unmount", audit.OutcomeSuccess, detail)
+	w.lastActive = time.Time{}
+	return nil
+}
+
+// lockOnUSBKeyRemoval unmounts and closes the volume once the stick holding its key is
+// withdrawn, whoever holds it, so walking away with the stick locks the data.
+func lockOnUSBKeyRemoval(ctx context.Context, cfg *config.AppConfig) error {
+	if !volumeMounted(cfg) || luks.USBKeyDevice(cfg.LUKS.USBKey) != "" {
+		return nil
+	}
+	log.Printf("USB key of %s withdrawn, locking the volume", cfg.LUKS.MapperName)
+	if err := closeVolume(ctx, cfg, "usb-key-removed"); err != nil {
+		recordAuditEvent(cfg, "unmount", audit.OutcomeFailure, "USB key withdrawn: "+err.Error())
+		return err
+	}
+	recordAuditEvent(cfg, "unmount", audit.OutcomeSuccess, "USB key withdrawn")
+
+	held, err := holders.Load(cfg.LUKS.MapperName)
+	if err != nil {
+		return err
+	}
+	held.Holders = nil
+	return held.Save()
+}
+
+// usageWatch alerts when the filesystem usage crosses luks.usage.warn or critical, once
+// per level reached, and grows the volume by luks.usage.growBy while it is above warn.
+type usageWatch struct {
+	level string
+	maxed bool // Growth stopped at luks.usage.maxSize
+}
+
+func (w *usageWatch) check(ctx context.Context, cfg *config.AppConfig) error {
+	if !volumeMounted(cfg) {
+		return nil
+	}
+	used, free, err := filesystemUsage(cfg.LUKS.MountPoint)
+	if err != nil {
+		return err
+	}
+	level := cfg.LUKS.Usage.Level(used)
+	if level != w.level {
+		detail := fmt.Sprintf("filesystem %.1f%% full, %d MiB free", used, free>>20)
+		if level == luks.UsageOK {
+			log.Printf("%s usage back below %.0f%%: %s", cfg.LUKS.MountPoint, cfg.LUKS.Usage.Warn, detail)
+		} else {
+			log.Printf("ALERT: %s usage %s: %s", cfg.LUKS.MountPoint, level, detail)
+			recordAuditEvent(cfg, "usage-"+level, audit.OutcomeAlert, detail)
+		}
+		w.level = level
+	}
+
+	if level == luks.UsageOK || cfg.LUKS.Usage.GrowBy == 0 {
+		return nil
+	}
+	if w.maxed {
+		return nil
+	}
+	size, err := luks.GrowLUKSVolume(ctx, &cfg.LUKS)
+	if errors.Is(err, luks.ErrMaxSize) {
+		log.Printf("ALERT: %s cannot grow further: %v", cfg.LUKS.VolumePath, err)
+		w.maxed = true
+		return nil
+	}
+	if err != nil {
+		recordAuditEvent(cfg, "grow", audit.OutcomeFailure, err.Error())
+		return err
+	}
+	log.Printf("Grew %s to %d MB", cfg.LUKS.VolumePath, size)
+	recordAuditEvent(cfg, "grow", audit.OutcomeSuccess, fmt.Sprintf("grown to %d MB at %.1f%% usage", size, used))
+	return nil
+}
+
+// syncEnvFile keeps the environment file in line with mounts done outside udm.
+func syncEnvFile(ctx context.Context, cfg *config.AppConfig) error {
+	return luks.SyncEnvFile(ctx, &cfg.LUKS)
+}
+
+// checkHeader compares the LUKS header against the fingerprint recorded by the last udm
+// operation and alerts, once per distinct header, when keyslots or tokens were changed
+// by something else.
+func checkHeader(ctx context.Context, cfg *config.AppConfig) error {
+	volume, err := state.Load(cfg.LUKS.MapperName)
+	if err != nil {
+		return err
+	}
+	hash, dump, err := luks.HeaderFingerprint(ctx, &cfg.LUKS)
+	if err != nil {
+		return err
+	}
+
+	if volume.HeaderHash == "" {
+		log.Printf("No header fingerprint recorded for %s, recording the current header", cfg.LUKS.VolumePath)
+		return recordHeader(ctx, cfg)
+	}
+	if hash == volume.HeaderHash || hash == volume.HeaderAlerted {
+		return nil
+	}
+
+	log.Printf("ALERT: LUKS header of %s changed outside udm (recorded %s at %s, now %s), run udm accept-header once reviewed",
+		cfg.LUKS.VolumePath, volume.HeaderHash[:12], volume.HeaderRecorded.Format(time.RFC3339), hash[:12])
+	diff := luks.DiffDump(volume.HeaderDump, dump)
+	for _, line := range diff {
+		log.Printf("ALERT: header diff: %s", line)
+	}
+	recordAuditEvent(cfg, "header-check", audit.OutcomeAlert,
+		fmt.Sprintf("header changed outside udm, recorded %s now %s\n%s", volume.HeaderHash, hash, strings.Join(diff, "\n")))
+	volume.HeaderAlerted = hash
+	return volume.Save()
+}
+
+// recordHeader records the current LUKS header as the expected one, after udm itself
+// changed keyslots or tokens.
+func recordHeader(ctx context.Context, cfg *config.AppConfig) error {
+	volume, err := state.Load(cfg.LUKS.MapperName)
+	if err != nil {
+		return err
+	}
+	hash, dump, err := luks.HeaderFingerprint(ctx, &cfg.LUKS)
+	if err != nil {
+		return err
+	}
+	volume.HeaderHash = hash
+	volume.HeaderDump = dump
+	volume.HeaderRecorded = time.Now()
+	volume.HeaderAlerted = ""
+	if err := volume.Save(); err != nil {
+		return fmt.Errorf("failed to record header fingerprint: %w", err)
+	}
+	return nil
+}
+
+// trimFilesystem discards unused blocks of the mounted volume.
+func trimFilesystem(ctx context.Context, cfg *config.AppConfig) error {
+	if !volumeMounted(cfg) {
+		return nil
+	}
+	output, err := luks.TrimFilesystem(&cfg.LUKS)
+	if err != nil {
+		return err
+	}
+	log.Printf("fstrim: %s", output)
+	return nil
+}
+
+// healthReport logs whether the volume is mounted and how full its filesystem is.
+func healthReport(ctx context.Context, cfg *config.AppConfig) error {
+	if !volumeMounted(cfg) {
+		log.Printf("health: %s is not mounted", cfg.LUKS.MapperName)
+		return nil
+	}
+
+	used, free, err := filesystemUsage(cfg.LUKS.MountPoint)
+	if err != nil {
+		return err
+	}
+	log.Printf("health: %s mounted at %s, %.1f%% used, %d MiB free", cfg.LUKS.MapperName, cfg.LUKS.MountPoint, used, free>>20)
+	return nil
+}
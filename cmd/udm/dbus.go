@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bootstrap/internal/config"
+	"bootstrap/internal/dbus"
+	"bootstrap/internal/trace"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// D-Bus service of the daemon.
+const (
+	dbusName      = "org.bootstrap.UDM1"
+	dbusPath      = dbus.ObjectPath("/org/bootstrap/UDM1")
+	dbusInterface = "org.bootstrap.UDM1"
+	dbusHolder    = "dbus" // Holder of volumes mounted over D-Bus
+)
+
+// polkit actions authorizing D-Bus callers, see scripts/org.bootstrap.UDM1.policy.
+const (
+	actionMount   = "org.bootstrap.udm1.mount"
+	actionUnmount = "org.bootstrap.udm1.unmount"
+	actionStatus  = "org.bootstrap.udm1.status"
+	actionPanic   = "org.bootstrap.udm1.panic"
+)
+
+const dbusIntrospection = `<!DOCTYPE node PUBLIC "-//freedesktop//DTD D-BUS Object Introspection 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/introspect.dtd">
+<node>
+  <interface name="org.bootstrap.UDM1">
+    <method name="Mount"><arg name="flags" type="as" direction="in"/><arg name="message" type="s" direction="out"/></method>
+    <method name="Unmount"><arg name="flags" type="as" direction="in"/><arg name="message" type="s" direction="out"/></method>
+    <method name="Status"><arg name="flags" type="as" direction="in"/><arg name="status" type="s" direction="out"/></method>
+    <method name="Panic"><arg name="message" type="s" direction="out"/></method>
+  </interface>
+  <interface name="org.freedesktop.DBus.Introspectable">
+    <method name="Introspect"><arg name="data" type="s" direction="out"/></method>
+  </interface>
+</node>
+`
+
+// serveDBus owns org.bootstrap.UDM1 on the bus, so desktop tooling and unprivileged udm
+// can mount, unmount and query the volume, or wipe it on tamper, as a polkit-authorized
+// user. Each call runs udm like provision-all does, so it is locked and audited as if
+// run from a shell.
+// track, when set, is called as each call starts and the function it returns as it ends.
+func serveDBus(cfg *config.AppConfig, track func() func()) (*dbus.Conn, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate udm: %w", err)
+	}
+	conn, err := dbus.Connect(cfg.DBus)
+	if err != nil {
+		return nil, err
+	}
+	s := &dbusService{cfg: cfg, conn: conn, executable: executable, track: track}
+	go func() {
+		if err := conn.Serve(s.handle); err != nil {
+			log.Printf("D-Bus connection closed: %v", err)
+		}
+	}()
+	if err := conn.Hello(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := conn.RequestName(dbusName); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+type dbusService struct {
+	cfg        *config.AppConfig
+	conn       *dbus.Conn
+	executable string
+	track      func() func()
+}
+
+func (s *dbusService) handle(call *dbus.Message) ([]any, error) {
+	if s.track != nil {
+		defer s.track()()
+	}
+	if call.Path != dbusPath {
+		return nil, &dbus.Error{Name: "org.freedesktop.DBus.Error.UnknownObject", Message: "no object " + string(call.Path)}
+	}
+	switch call.Interface + "." + call.Member {
+	case "org.freedesktop.DBus.Introspectable.Introspect":
+		return []any{dbusIntrospection}, nil
+	case dbusInterface + ".Mount":
+		return s.run(call, actionMount, "mount", "--holder="+dbusHolder)
+	case dbusInterface + ".Unmount":
+		return s.run(call, actionUnmount, "unmount", "--holder="+dbusHolder)
+	case dbusInterface + ".Status":
+		return s.run(call, actionStatus, "status")
+	case dbusInterface + ".Panic":
+		return s.run(call, actionPanic, "panic", "--yes")
+	}
+	return nil, &dbus.Error{Name: "org.freedesktop.DBus.Error.UnknownMethod", Message: "no method " + call.Interface + "." + call.Member}
+}
+
+// forwardedFlags are the flags of the calling udm the service passes on to each command,
+// a "=" suffix taking a value. Anything else is rejected, the command runs as root.
+var forwardedFlags = map[string][]string{
+	"mount":   {"--config=", "--holder=", "--lease=", "--read-only"},
+	"unmount": {"--config=", "--holder="},
+	"status":  {"--config="},
+}
+
+// run checks the caller against the polkit action and runs the udm command, returning
+// its message, or its JSON data for status.
+func (s *dbusService) run(call *dbus.Message, action, command string, args ...string) ([]any, error) {
+	if err := s.authorize(call, action); err != nil {
+		log.Printf("D-Bus %s by %s denied: %v", command, call.Sender, err)
+		return nil, err
+	}
+	forwarded, err := checkForwarded(call, command)
+	if err != nil {
+		log.Printf("D-Bus %s by %s rejected: %v", command, call.Sender, err)
+		return nil, &dbus.Error{Name: "org.freedesktop.DBus.Error.InvalidArgs", Message: err.Error()}
+	}
+	log.Printf("D-Bus %s requested by %s", command, call.Sender)
+
+	// A layered configuration is found again by the child's own search
+	args = append([]string{command, "--output=json"}, args...)
+	if len(s.cfg.Cmd.ConfigFiles) == 1 {
+		args = append(args, "--config="+s.cfg.Cmd.Config)
+	}
+	if s.cfg.Cmd.Keyfile != "" {
+		args = append(args, "--keyfile="+s.cfg.Cmd.Keyfile)
+	}
+	// Last, the flags of the caller win
+	args = append(args, forwarded...)
+	result, err := runChild(s.executable, args)
+	if err != nil {
+		return nil, err
+	}
+	if !result.Success {
+		return nil, &dbus.Error{Name: dbusInterface + ".Error.Failed", Message: result.Error}
+	}
+	if command == "status" {
+		data, err := json.Marshal(result.Data)
+		if err != nil {
+			return nil, err
+		}
+		return []any{string(data)}, nil
+	}
+	return []any{result.Message}, nil
+}
+
+// checkForwarded returns the flags passed in the call, the optional first argument. They
+// must be forwardedFlags of the command, and a configuration must be an absolute path
+// only root can write, or the caller could make the service run hooks of its choosing.
+func checkForwarded(call *dbus.Message, command string) ([]string, error) {
+	if len(call.Body) == 0 {
+		return nil, nil
+	}
+	flags, ok := call.Body[0].([]string)
+	if !ok {
+		return nil, fmt.Errorf("flags must be an array of strings")
+	}
+	for _, flag := range flags {
+		allowed := false
+		for _, name := range forwardedFlags[command] {
+			if flag == name || (strings.HasSuffix(name, "=") && strings.HasPrefix(flag, name)) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return nil, fmt.Errorf("flag %q is not accepted for %s", flag, command)
+		}
+		if path, ok := strings.CutPrefix(flag, "--config="); ok {
+			if err := checkRootOwned(path); err != nil {
+				return nil, fmt.Errorf("configuration %s: %w", path, err)
+			}
+		}
+	}
+	return flags, nil
+}
+
+// checkRootOwned reports an error unless path is absolute, owned by root and writable by
+// nobody else.
+func checkRootOwned(path string) error {
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("must be an absolute path")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if uid, ok := fileOwner(info); !ok || uid != 0 || info.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("must be owned and only writable by root")
+	}
+	return nil
+}
+
+// authorize asks polkit whether the calling process may perform action. root is
+// always allowed.
+func (s *dbusService) authorize(call *dbus.Message, action string) error {
+	uid, err := s.conn.CallerUID(call.Sender)
+	if err != nil {
+		return fmt.Errorf("failed to identify caller: %w", err)
+	}
+	if uid == 0 {
+		return nil
+	}
+	pid, err := s.conn.CallerPID(call.Sender)
+	if err != nil {
+		return fmt.Errorf("failed to identify caller: %w", err)
+	}
+	start, err := processStartTime(pid)
+	if err != nil {
+		return fmt.Errorf("failed to identify caller: %w", err)
+	}
+
+	// pid, start time and uid identify the process even if its pid is reused
+	subject := fmt.Sprintf("%d,%s,%d", pid, start, uid)
+	cmd := trace.Command("pkcheck", "--action-id", action, "--process", subject, "--allow-user-interaction")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return &dbus.Error{Name: dbusInterface + ".Error.NotAuthorized",
+			Message: fmt.Sprintf("not authorized for %s: %s", action, strings.TrimSpace(string(output)))}
+	}
+	return nil
+}
+
+// processStartTime returns the start time of pid in clock ticks, field 22 of its stat.
+func processStartTime(pid uint32) (string, error) {
+	stat, err := os.ReadFile(filepath.Join("/proc", strconv.FormatUint(uint64(pid), 10), "stat"))
+	if err != nil {
+		return "", err
+	}
+	// Fields after the parenthesized command name start with the state, field 3
+	s := string(stat)
+	fields := strings.Fields(s[strings.LastIndex(s, ")")+1:])
+	if len(fields) < 20 {
+		return "", fmt.Errorf("malformed stat of process %d", pid)
+	}
+	return fields[19], nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bootstrap/internal/config"
+	"bootstrap/internal/luks"
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+)
+
+// Health states of healthcheck, its exit code is the index.
+const (
+	healthy  = "healthy"
+	degraded = "degraded"
+	failed   = "failed"
+)
+
+// healthIssue is one reason the volume is not healthy.
+type healthIssue struct {
+	Check    string `json:"check"`
+	Severity string `json:"severity"` // degraded or failed
+	Message  string `json:"message"`
+}
+
+// healthResult is the result data of healthcheck.
+type healthResult struct {
+	Status string        `json:"status"`
+	Issues []healthIssue `json:"issues"`
+}
+
+func (r *healthResult) add(check, severity, format string, args ...any) {
+	r.Issues = append(r.Issues, healthIssue{Check: check, Severity: severity, Message: fmt.Sprintf(format, args...)})
+	if severity == failed || r.Status == healthy {
+		r.Status = severity
+	}
+}
+
+// healthcheck checks the volume without unlocking it and exits 0 when healthy, 1 when
+// degraded and 2 when failed, for systemd ExecStartPre and watchdogs.
+func healthcheck(ctx context.Context, cfg *config.AppConfig) {
+	result := healthResult{Status: healthy, Issues: []healthIssue{}}
+	checkHealth(ctx, cfg, &result)
+
+	t := newTable()
+	t.AppendHeader(table.Row{"Check", "Severity", "Issue"})
+	for _, issue := range result.Issues {
+		t.AppendRow(table.Row{issue.Check, issue.Severity, issue.Message})
+	}
+	if len(result.Issues) > 0 {
+		render(t)
+	}
+
+	message := fmt.Sprintf("Volume is %s: %s", result.Status, cfg.LUKS.VolumePath)
+	switch result.Status {
+	case degraded:
+		exitWithResult(1, message, result)
+	case failed:
+		exitWithResult(2, message, result)
+	}
+	printResult(message, result)
+}
+
+func checkHealth(ctx context.Context, cfg *config.AppConfig, result *healthResult) {
+	if _, err := os.Stat(cfg.LUKS.VolumePath); err != nil {
+		result.add("volume", failed, "volume %s does not exist", cfg.LUKS.VolumePath)
+		return
+	}
+
+	if cfg.LUKS.UseTPM && !luks.TPMAvailable(ctx) {
+		result.add("tpm", failed, "TPM %s is not available", luks.TPMDevice())
+	} else if cfg.LUKS.UseTPM && !cfg.LUKS.Split.Enabled() && !luks.NVIndexDefined(ctx, cfg.LUKS.KeyNVIndex()) {
+		result.add("tpm", failed, "TPM NV index %s holding the key is not defined", cfg.LUKS.KeyNVIndex())
+	}
+
+	if keyfile := cfg.Cmd.Keyfile; keyfile != "" && keyfile != config.KeyfileStdio && cfg.Cmd.KeyFD == 0 {
+		checkKeyfileHealth(cfg, keyfile, result)
+	}
+
+	crypttab, err := luks.CrypttabEntry(&cfg.LUKS)
+	if err != nil {
+		result.add("persistent mount", degraded, "failed to read /etc/crypttab: %v", err)
+	} else if crypttab != "" {
+		if fstab, err := luks.FstabEntry(&cfg.LUKS); err != nil || fstab == "" {
+			result.add("persistent mount", degraded, "crypttab entry present but the fstab entry is missing")
+		}
+	}
+
+	if _, err := os.Stat("/dev/mapper/" + cfg.LUKS.MapperName); err != nil {
+		result.add("mapper", degraded, "volume is not unlocked")
+		return
+	}
+	if !volumeMounted(cfg) {
+		result.add("mount", degraded, "mapper %s is open but not mounted", cfg.LUKS.MapperName)
+		return
+	}
+
+	used, free, err := filesystemUsage(cfg.LUKS.MountPoint)
+	switch {
+	case err != nil:
+		result.add("filesystem", failed, "%v", err)
+	case cfg.LUKS.Usage.Level(used) == luks.UsageCritical:
+		result.add("filesystem", failed, "filesystem %.1f%% full, %d MiB free", used, free>>20)
+	case cfg.LUKS.Usage.Level(used) == luks.UsageWarn:
+		result.add("filesystem", degraded, "filesystem %.1f%% full, %d MiB free", used, free>>20)
+	}
+}
+
+// checkKeyfileHealth reports a keyfile other users can access or not owned by
+// luks.keyfileOwner, correcting both with --fix-permissions.
+func checkKeyfileHealth(cfg *config.AppConfig, keyfile string, result *healthResult) {
+	info, err := os.Stat(keyfile)
+	if err != nil {
+		result.add("keyfile", failed, "keyfile %s is not readable: %v", keyfile, err)
+		return
+	}
+	modeErr := luks.CheckKeyfileMode(info)
+	ownerErr := luks.CheckKeyfileOwner(keyfile, cfg.LUKS.KeyfileOwner)
+	if modeErr == nil && ownerErr == nil {
+		return
+	}
+
+	if cfg.Cmd.FixPermissions {
+		if err := luks.SecureKeyfile(keyfile, cfg.LUKS.KeyfileOwner); err != nil {
+			result.add("keyfile", degraded, "%v", err)
+		} else {
+			fmt.Printf("Restricted keyfile %s to mode %04o\n", keyfile, luks.KeyfileMode)
+		}
+		return
+	}
+	if modeErr != nil {
+		result.add("keyfile", degraded, "keyfile %s: %v", keyfile, modeErr)
+	}
+	if ownerErr != nil {
+		result.add("keyfile", degraded, "%v", ownerErr)
+	}
+}
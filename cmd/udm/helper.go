@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bootstrap/internal/config"
+	"bootstrap/internal/dbus"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// helperIdleTimeout is how long the helper serves without calls before it exits; the
+// system bus starts it again on the next call.
+const helperIdleTimeout = time.Minute
+
+// delegatedMethods maps the commands an unprivileged udm delegates to the D-Bus service
+// to its methods. Only these run as root on behalf of users, each authorized by polkit.
+var delegatedMethods = map[string]string{
+	"mount":   "Mount",
+	"unmount": "Unmount",
+	"status":  "Status",
+}
+
+// delegate runs a command through org.bootstrap.UDM1 on the system bus, so the CLI itself
+// needs no privileges. The bus activates udm helper when no daemon owns the name, and the
+// command runs with the flags of delegatedArgs.
+func delegate(method string, cmd config.Command) {
+	conn, err := dbus.Connect(dbus.Config{})
+	if err != nil {
+		fatalf("Failed to reach the udm helper: %v", err)
+	}
+	defer conn.Close()
+	go conn.Serve(func(call *dbus.Message) ([]any, error) {
+		return nil, &dbus.Error{Name: "org.freedesktop.DBus.Error.UnknownMethod", Message: "udm client serves no methods"}
+	})
+	if err := conn.Hello(); err != nil {
+		fatalf("Failed to reach the udm helper: %v", err)
+	}
+
+	args, err := delegatedArgs(cmd)
+	if err != nil {
+		fatalf("Failed to forward the command line: %v", err)
+	}
+	reply, err := conn.Call(dbusName, dbusPath, dbusInterface, method, args)
+	if err != nil {
+		fatalf("udm helper: %v", err)
+	}
+	if len(reply) == 0 {
+		fatalf("udm helper: empty reply to %s", method)
+	}
+	text, _ := reply[0].(string)
+	if method != "Status" {
+		printResult(text, nil)
+		return
+	}
+
+	var status any
+	if err := json.Unmarshal([]byte(text), &status); err != nil {
+		fatalf("udm helper: malformed status: %v", err)
+	}
+	pretty, _ := json.MarshalIndent(status, "", "  ")
+	printResult(string(pretty), status)
+}
+
+// delegatedArgs re-serializes the flags of cmd the service accepts, see forwardedFlags. A
+// single configuration is passed by absolute path, the service runs in another directory;
+// a layered one is found again by the search of the service.
+func delegatedArgs(cmd config.Command) ([]string, error) {
+	args := []string{}
+	if len(cmd.ConfigFiles) == 1 {
+		path, err := filepath.Abs(cmd.Config)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "--config="+path)
+	}
+	if cmd.Holder != "" {
+		args = append(args, "--holder="+cmd.Holder)
+	}
+	if cmd.Lease > 0 {
+		args = append(args, "--lease="+cmd.Lease.String())
+	}
+	if cmd.ReadOnly {
+		args = append(args, "--read-only")
+	}
+	return args, nil
+}
+
+// helperActivity tracks the calls in progress and when the last one finished.
+type helperActivity struct {
+	mu     sync.Mutex
+	active int
+	last   time.Time
+}
+
+// begin records a call starting and returns the function recording its end.
+func (a *helperActivity) begin() func() {
+	a.mu.Lock()
+	a.active++
+	a.mu.Unlock()
+	return func() {
+		a.mu.Lock()
+		a.active--
+		a.last = time.Now()
+		a.mu.Unlock()
+	}
+}
+
+// idle reports whether no call is in progress and none finished within timeout.
+func (a *helperActivity) idle(timeout time.Duration) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.active == 0 && time.Since(a.last) >= timeout
+}
+
+// runHelper serves the D-Bus interface for unprivileged udm processes until it has been
+// idle for helperIdleTimeout. It is started by D-Bus activation, see
+// scripts/org.bootstrap.UDM1.service, and runs no background tasks of the daemon.
+func runHelper(cfg *config.AppConfig) {
+	activity := &helperActivity{last: time.Now()}
+	conn, err := serveDBus(cfg, activity.begin)
+	if err != nil {
+		fatalf("Failed to serve D-Bus interface: %v", err)
+	}
+	defer conn.Close()
+	log.Printf("udm helper serving %s for %s", dbusName, cfg.LUKS.MapperName)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	ticker := time.NewTicker(helperIdleTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case sig := <-stop:
+			printResult(fmt.Sprintf("Helper stopped on %s", sig), nil)
+			return
+		case <-ticker.C:
+			if activity.idle(helperIdleTimeout) {
+				printResult(fmt.Sprintf("Helper idle for %s, exiting", helperIdleTimeout), nil)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bootstrap/internal/config"
+	"bootstrap/internal/hooks"
+	"bootstrap/internal/luks"
+	"context"
+)
+
+// hookVolume returns the context of the volume passed to hooks run by command.
+func hookVolume(cfg *config.AppConfig, command string) hooks.Volume {
+	return hooks.Volume{
+		Command:    command,
+		MapperName: cfg.LUKS.MapperName,
+		MountPoint: cfg.LUKS.MountPoint,
+		VolumePath: cfg.LUKS.VolumePath,
+	}
+}
+
+// runPreHooks runs the hooks before a phase of the running command, aborting it if one fails.
+func runPreHooks(cfg *config.AppConfig, phase string) {
+	if err := cfg.Hooks.Run(phase, hookVolume(cfg, cfg.Cmd.CommandName)); err != nil {
+		fatalf("Aborted by hook: %v", err)
+	}
+}
+
+// runPostHooks runs the hooks after a phase of the running command.
+func runPostHooks(cfg *config.AppConfig, phase string) {
+	cfg.Hooks.RunPost(phase, hookVolume(cfg, cfg.Cmd.CommandName))
+}
+
+// closeVolume unmounts and closes the volume on behalf of the daemon, running the
+// unmount hooks with event as UDM_COMMAND.
+func closeVolume(ctx context.Context, cfg *config.AppConfig, event string) error {
+	volume := hookVolume(cfg, event)
+	if err := cfg.Hooks.Run(hooks.PreUnmount, volume); err != nil {
+		return err
+	}
+	if err := luks.UnmountAndCloseLUKSVolume(ctx, &cfg.LUKS); err != nil {
+		return err
+	}
+	cfg.Hooks.RunPost(hooks.PostUnmount, volume)
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bootstrap/internal/config"
+	"bootstrap/internal/lock"
+	"bootstrap/internal/state"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// ledgerLock serializes access to the token ledger shared by all volumes.
+const ledgerLock = "token-ledger"
+
+// tokenClaim is the ledger entry authorize recorded for its volume, released again if
+// the volume is abandoned.
+type tokenClaim struct {
+	cmd     config.Command
+	tokenID string
+	volume  string
+}
+
+// claimToken records that the bootstrap token authorizes volume, failing if it already
+// authorized this device unless --reuse-token was passed. The check and the record are
+// one step under the ledger lock, so concurrent authorizes cannot both pass the check.
+// The claim is nil if the volume was recorded already.
+func claimToken(cmd config.Command, tokenID, volume string) (*tokenClaim, error) {
+	l, err := lock.Acquire(ledgerLock, cmd.WaitLock)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Release()
+
+	ledger, err := state.LoadLedger()
+	if err != nil {
+		return nil, err
+	}
+	if use, used := ledger.Used(tokenID); used {
+		if !cmd.ReuseToken {
+			return nil, fmt.Errorf("bootstrap token %s was already used on %s for %s, pass --reuse-token to authorize again",
+				tokenID, use.Consumed.Format(time.RFC3339), strings.Join(use.Volumes, ", "))
+		}
+		fmt.Printf("Warning: reusing bootstrap token %s, already used on %s\n", tokenID, use.Consumed.Format(time.RFC3339))
+	}
+	if !ledger.Consume(tokenID, volume, time.Now().UTC()) {
+		return nil, nil
+	}
+	if err := ledger.Save(); err != nil {
+		return nil, fmt.Errorf("failed to record bootstrap token use: %w", err)
+	}
+	return &tokenClaim{cmd: cmd, tokenID: tokenID, volume: volume}, nil
+}
+
+// release forgets the claim of a volume that was not created after all. Failures are
+// logged, the token then stays consumed.
+func (c *tokenClaim) release() {
+	if c == nil {
+		return
+	}
+	l, err := lock.Acquire(ledgerLock, c.cmd.WaitLock)
+	if err != nil {
+		log.Printf("Failed to release bootstrap token: %v", err)
+		return
+	}
+	defer l.Release()
+
+	ledger, err := state.LoadLedger()
+	if err != nil {
+		log.Printf("Failed to release bootstrap token: %v", err)
+		return
+	}
+	ledger.Release(c.tokenID, c.volume)
+	if err := ledger.Save(); err != nil {
+		log.Printf("Failed to release bootstrap token: %v", err)
+	}
+}
@@ -1,152 +1,1191 @@
 package main
 
 import (
+	"bootstrap/internal/attest"
+	"bootstrap/internal/audit"
 	"bootstrap/internal/config"
+	"bootstrap/internal/holders"
+	"bootstrap/internal/hooks"
+	"bootstrap/internal/identity"
+	"bootstrap/internal/lock"
 	"bootstrap/internal/luks"
+	"bootstrap/internal/nbd"
+	"bootstrap/internal/secrets"
+	"bootstrap/internal/state"
+	"bootstrap/internal/support"
+	"bootstrap/internal/trace"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/jedib0t/go-pretty/v6/table"
 )
 
-func printHelp() {
-	fmt.Println("Usage: bootstrap [COMMAND] [OPTIONS]")
-	fmt.Println("\nCommands:")
-	fmt.Println("  --authorize --bootstrap=file --config=config.yml --keyfile=key.bin")
-	fmt.Println("                                  Authorize with a required bootstrap file and output keyfile")
-	fmt.Println("  --deauthorize --config=config.yml")
-	fmt.Println("                                  Deauthorize with the specified config")
-	fmt.Println("  --mount --config=config.yml --keyfile=key.bin")
-	fmt.Println("                                  Mount a keyfile with the specified config")
-	fmt.Println("  --unmount --config=config.yml")
-	fmt.Println("                                  Unmount a configuration")
-	fmt.Println("  --addPersistentMount --config=config.yml --keyfile=key.bin")
-	fmt.Println("                                  Add a persistent mount with the specified config and keyfile")
-	fmt.Println("  --removePersistentMount --config=config.yml")
-	fmt.Println("                                  Remove a persistent mount with the specified config")
-	fmt.Println("\nOptions:")
-	fmt.Println("  --config=config.yml             Path to the configuration file (required for all commands)")
-	fmt.Println("  --keyfile=key.bin               Path to the keyfile (output for --authorize, input for other commands)")
-	fmt.Println("\nRun 'configapp --help' to display this help message.")
-}
 func main() {
+	defer secrets.DestroyAll()
+	ctx := context.Background()
+
 	// Parse command line flags
 	cmd := config.ParseCommandLine()
+	commandName = cmd.CommandName
+	trace.Enable(cmd.Verbose)
+	if err := setOutputMode(cmd.Output); err != nil {
+		log.Fatalf("Invalid option: %v", err)
+	}
+	if cmd.CommandName == "authorize" && cmd.Keyfile == config.KeyfileStdio {
+		reserveStdoutForKey()
+	}
+
+	switch cmd.CommandName {
+	case "help":
+		config.PrintHelp(resultOut, cmd.Topic)
+		return
+	case "completion":
+		if err := config.PrintCompletion(resultOut, cmd.Topic); err != nil {
+			fatalf("Failed to generate completion: %v", err)
+		}
+		return
+	case "provision-all":
+		provisionAll(cmd)
+		return
+	case "migrate":
+		migrate(ctx, cmd)
+		return
+	case "provision-cloud":
+		provisionCloud(cmd)
+		return
+	case "list":
+		listVolumes(cmd)
+		return
+	case "init":
+		initConfig(ctx, cmd)
+		return
+	case "validate-config":
+		validateConfig(cmd)
+		return
+	case "benchmark":
+		benchmark(ctx, cmd)
+		return
+	case "selftest":
+		selfTest(ctx, cmd)
+		return
+	}
+
+	// Unprivileged users run these commands through the privileged helper
+	if method, ok := delegatedMethods[cmd.CommandName]; ok && os.Geteuid() != 0 {
+		delegate(method, cmd)
+		return
+	}
 
 	// Read and parse the settings file
-	cfg, err := config.LoadConfig(cmd.Config)
+	cfg, err := config.LoadConfigFiles(cmd.ConfigFiles)
 	if err != nil {
-		log.Fatalf("Failed to load configuration: %v", err)
+		fatalf("Failed to load configuration: %v", err)
 	}
 
 	printLUKSConfig(cfg)
 	cfg.Cmd = cmd
+	if err := applyConfig(cfg); err != nil {
+		fatalf("Failed to apply configuration: %v", err)
+	}
+
+	switch {
+	case cfg.Cmd.Quiet:
+		luks.SetProgressMode(luks.ProgressQuiet)
+	case cfg.Cmd.JSONProgress:
+		luks.SetProgressMode(luks.ProgressJSON)
+	}
+
+	// Under LoadCredential= the key is passed as a credential rather than a keyfile
+	if cfg.Cmd.Keyfile == "" && cfg.Cmd.CommandName != "authorize" && !cfg.LUKS.USBKey.Enabled() {
+		cfg.Cmd.Keyfile = luks.CredentialPath(cfg.LUKS.Credential)
+	}
+
+	scopeTenant(cfg)
+	startAudit(cfg)
+	defer auditLog.Close()
+	startTelemetry(cfg)
+	defer finishTelemetry("")
+	startWebhooks(cfg)
+
+	// Serialize all commands operating on the same volume, the daemon locks per pass, the
+	// commands run by the helper lock themselves, check-key does not touch the volume and
+	// panic must not wait for a command in progress
+	if cfg.Cmd.CommandName != "daemon" && cfg.Cmd.CommandName != "helper" && cfg.Cmd.CommandName != "check-key" && cfg.Cmd.CommandName != "panic" {
+		volumeLock, err := lock.Acquire(cfg.LUKS.MapperName, cfg.Cmd.WaitLock)
+		if err != nil {
+			fatalf("Failed to acquire volume lock: %v", err)
+		}
+		defer volumeLock.Release()
+	}
+	assignNVIndex(ctx, cfg)
 
 	switch cfg.Cmd.CommandName {
 	case "authorize":
-		if !cfg.LUKS.UseTPM && len(cfg.Cmd.Keyfile) == 0 {
-			log.Fatalf("Error: --keyfile must be specified when TPM is not used")
+		if !cfg.LUKS.UseTPM && !cfg.LUKS.Ephemeral && !cfg.LUKS.Vault.Enabled() && len(cfg.Cmd.Keyfile) == 0 {
+			fatalf("Error: --keyfile must be specified when TPM is not used")
 		}
-		authorize(cfg)
+		authorize(ctx, cfg)
 	case "deauthorize":
-		deauthorize(cfg)
+		deauthorize(ctx, cfg)
 	case "mount":
-		mount(cfg)
+		mount(ctx, cfg)
 	case "unmount":
-		unmount(cfg)
-	case "addPersistentMount":
-		addPersistentMount(cfg)
-	case "removePersistentMount":
-		removePersistentMount(cfg)
-	case "help":
-		printHelp()
+		unmount(ctx, cfg)
+	case "add-persistent-mount":
+		addPersistentMount(ctx, cfg)
+	case "remove-persistent-mount":
+		removePersistentMount(ctx, cfg)
+	case "add-hotplug-mount":
+		addHotplugMount(ctx, cfg)
+	case "remove-hotplug-mount":
+		removeHotplugMount(cfg)
+	case "verify":
+		verify(ctx, cfg)
+	case "which-key":
+		whichKey(ctx, cfg)
+	case "freeze":
+		freeze(ctx, cfg)
+	case "thaw":
+		thaw(ctx, cfg)
+	case "release-snapshot":
+		releaseSnapshot(ctx, cfg)
+	case "backup":
+		backupVolume(ctx, cfg)
+	case "restore":
+		restoreVolume(cfg)
+	case "add-key":
+		addKey(ctx, cfg)
+	case "remove-key":
+		removeKey(ctx, cfg)
+	case "check-key":
+		checkKey(cfg)
+	case "enroll-fido2":
+		enrollFIDO2(ctx, cfg)
+	case "reencrypt":
+		reencrypt(ctx, cfg)
+	case "healthcheck":
+		healthcheck(ctx, cfg)
+	case "export-escrow":
+		exportEscrow(ctx, cfg)
+	case "recover":
+		recoverKey(ctx, cfg)
+	case "reset-lockout":
+		resetLockout(cfg)
+	case "panic":
+		panicVolume(ctx, cfg)
+	case "list-keys":
+		listKeys(ctx, cfg)
+	case "status":
+		status(ctx, cfg)
+	case "holders":
+		listHolders(cfg)
+	case "renew":
+		renew(cfg)
+	case "daemon":
+		runDaemon(ctx, cfg)
+	case "helper":
+		runHelper(cfg)
+	case "accept-header":
+		acceptHeader(ctx, cfg)
+	case "serve-nbd":
+		serveNBD(cfg)
+	case "reconcile":
+		reconcile(ctx, cfg)
+	case "check":
+		checkState(ctx, cfg)
+	case "support-bundle":
+		supportBundle(cfg)
 	default:
-		printHelp()
-		os.Exit(1)
+		config.PrintHelp(os.Stderr, "")
+		exitWithResult(1, "no command specified", nil)
 	}
 }
 
+// applyConfig installs the process-wide settings of the configuration: tracing, retry
+// policies, the TPM device, the attestation gate and the password policy. The daemon
+// applies them again when its configuration is reloaded.
+func applyConfig(cfg *config.AppConfig) error {
+	trace.Enable(cfg.Cmd.Verbose || (cfg.Verbose != nil && *cfg.Verbose))
+	luks.SetRetry(cfg.Retry)
+	luks.SetTimeouts(cfg.Timeouts)
+	if cfg.Cmd.TPMDevice != "" {
+		cfg.TPM.Device = cfg.Cmd.TPMDevice
+		if err := cfg.TPM.Validate(); err != nil {
+			return fmt.Errorf("invalid --tpm-device: %w", err)
+		}
+	}
+	luks.SetTPM(cfg.TPM)
+	var gate func() error
+	if cfg.Attestation.Enabled() {
+		gate = func() error {
+			log.Printf("Attesting the boot state to %s before releasing the key", cfg.Attestation.URL)
+			return attest.Verify(cfg.Attestation, machineID())
+		}
+	}
+	luks.SetKeyReleaseGate(gate)
+	policy, err := luks.NewPasswordPolicy(&cfg.LUKS)
+	if err != nil {
+		return fmt.Errorf("failed to load password policy: %w", err)
+	}
+	luks.SetPasswordPolicy(policy)
+	luks.SetKeySource(cfg.LUKS.KeySource)
+	return nil
+}
+
+// validateConfig reports every issue of the configuration file with its line.
+func validateConfig(cmd config.Command) {
+	if _, err := config.LoadConfigFiles(cmd.ConfigFiles); err != nil {
+		var invalid *config.ValidationError
+		if !errors.As(err, &invalid) {
+			fatalf("Failed to load configuration: %v", err)
+		}
+		t := newTable()
+		t.AppendHeader(table.Row{"Line", "Key", "Issue"})
+		for _, issue := range invalid.Issues {
+			line := ""
+			if issue.Line > 0 {
+				line = fmt.Sprint(issue.Line)
+			}
+			if issue.File != "" {
+				line = issue.File + ":" + line
+			}
+			t.AppendRow(table.Row{line, issue.Key, issue.Message})
+		}
+		render(t)
+		exitWithResult(1, fmt.Sprintf("%d issue(s) in %s", len(invalid.Issues), strings.Join(cmd.ConfigFiles, ", ")), invalid.Issues)
+	}
+	printResult("Configuration is valid: "+strings.Join(cmd.ConfigFiles, ", "), nil)
+}
+
 // Authorize and setup the LUKS volume
-func authorize(cfg *config.AppConfig) {
+func authorize(ctx context.Context, cfg *config.AppConfig) {
 	fmt.Println("Authorizing with config:", cfg.Cmd.Config)
 
 	// Read and parse the bootstrap token file
-	readBootstrapToken(cfg.Cmd.Bootstrap)
+	token := readBootstrapToken(cfg.Cmd.Bootstrap)
+	auditEvent.TokenID = token.Bootstrap.TokenId
+	if err := token.Enforce(cfg, time.Now()); err != nil {
+		fatalf("Bootstrap token does not permit this volume: %v", err)
+	}
+	claim, err := claimToken(cfg.Cmd, token.Bootstrap.TokenId, cfg.LUKS.MapperName)
+	if err != nil {
+		fatalf("Bootstrap token rejected: %v", err)
+	}
 
 	// Setup LUKS volume
-	if err := luks.SetupLUKSVolume(&cfg.LUKS); err != nil {
-		log.Fatalf("Failed to setup LUKS volume: %v", err)
+	runPreHooks(cfg, hooks.PreAuthorize)
+	if err := luks.SetupLUKSVolume(ctx, &cfg.LUKS); err != nil {
+		claim.release()
+		fatalf("Failed to setup LUKS volume: %v", err)
 	}
 
-	if !cfg.LUKS.UseTPM {
-		writeKeyToFile(cfg.Cmd.Keyfile, cfg.LUKS.Password)
-		fmt.Println("LUKS volume created, generated keyfile:", cfg.Cmd.Keyfile)
+	// The key is kept before anything else is enrolled, a failure of the optional
+	// protectors must not leave a volume whose key was never stored
+	var message string
+	if cfg.LUKS.Split.Enabled() {
+		share, err := luks.StoreKeyShares(ctx, &cfg.LUKS, cfg.Cmd.Keyfile != "")
+		if err != nil {
+			abandonVolume(ctx, cfg, claim, "Failed to store key shares: %v", err)
+		}
+		if share != nil {
+			if err := writeKeyfile(ctx, cfg, share); err != nil {
+				abandonVolume(ctx, cfg, claim, "Failed to write keyfile share: %v", err)
+			}
+		}
+		message = fmt.Sprint("LUKS volume created, key split into shares with threshold ", cfg.LUKS.Split.Threshold)
+	} else if cfg.LUKS.Ephemeral {
+		message = "Ephemeral LUKS volume created, its key is discarded when it is closed"
+	} else if cfg.LUKS.Vault.Wrapped() {
+		message = "LUKS volume created, key wrapped with Vault transit key " + cfg.LUKS.Vault.Transit
+	} else if cfg.LUKS.Vault.Enabled() {
+		message = "LUKS volume created, key stored in Vault at " + cfg.LUKS.Vault.KV
+	} else if !cfg.LUKS.UseTPM {
+		if err := writeKeyfile(ctx, cfg, cfg.LUKS.Password); err != nil {
+			abandonVolume(ctx, cfg, claim, "Failed to write keyfile: %v", err)
+		}
+		message = "LUKS volume created, generated keyfile: " + cfg.Cmd.Keyfile
+		if cfg.Cmd.Keyfile == config.KeyfileStdio {
+			message = "LUKS volume created, key written to stdout"
+		}
 	} else {
-		fmt.Println("LUKS volume created, using TPM for key storage NVIndex =", luks.DefaultNVIndex)
+		message = "LUKS volume created, using TPM for key storage NVIndex = " + cfg.LUKS.KeyNVIndex()
 	}
+
+	updateState(cfg, func(volume *state.Volume) {
+		volume.KeyCreated = time.Now()
+		volume.LastMounted = time.Now()
+		volume.UnlockFailures = 0
+		volume.FailedUnlocks = 0
+	})
+	registerVolume(ctx, cfg)
+
+	var recovery string
+	if cfg.LUKS.Recovery.Enabled {
+		passphrase, err := luks.AddRecoveryPassphrase(ctx, &cfg.LUKS)
+		if err != nil {
+			abandonVolume(ctx, cfg, claim, "Failed to add recovery passphrase: %v", err)
+		}
+		recovery = passphrase
+		if recovery == "" {
+			log.Printf("Recovery passphrase written to escrow: %s", cfg.LUKS.Recovery.EscrowPath)
+		}
+	}
+
+	if cfg.LUKS.AllowPassphrase {
+		if err := luks.EnrollPassphrase(ctx, &cfg.LUKS); err != nil {
+			abandonVolume(ctx, cfg, claim, "Failed to enroll passphrase: %v", err)
+		}
+	}
+
+	if err := recordHeader(ctx, cfg); err != nil {
+		log.Printf("Failed to record header fingerprint: %v", err)
+	}
+
+	var issued *identity.Result
+	if cfg.Identity.Enabled() {
+		commonName := token.Bootstrap.DeviceId
+		if commonName == "" {
+			commonName, _ = os.Hostname()
+		}
+		result, err := identity.Enroll(cfg.Identity, cfg.LUKS.MountPoint, commonName, token.Bootstrap.TokenId)
+		if err != nil {
+			abandonVolume(ctx, cfg, claim, "Failed to enroll device identity: %v", err)
+		}
+		issued = result
+		message += "\nDevice certificate issued for " + result.Subject + ": " + result.Certificate
+	}
+
+	if cfg.Report.Enabled() {
+		if err := publishReport(ctx, cfg, token, issued); err != nil {
+			abandonVolume(ctx, cfg, claim, "Failed to publish provisioning report: %v", err)
+		}
+	}
+
+	runPostHooks(cfg, hooks.PostAuthorize)
+
+	// The recovery passphrase is shown once and never stored by udm
+	if recovery != "" {
+		message += "\nRecovery passphrase (store it safely, it is not shown again): " + recovery
+	}
+	printResult(message, authorizeResult{volumeSummary: summarize(cfg), RecoveryPassphrase: recovery, Identity: issued})
+}
+
+// abandonVolume removes the volume authorize just formatted when its key could not be
+// kept or a later step failed, with the key shares already stored and its registry
+// entry, so no half-provisioned volume is left behind, releases the claim on the
+// bootstrap token so authorize can be run again, and exits with the error.
+func abandonVolume(ctx context.Context, cfg *config.AppConfig, claim *tokenClaim, format string, args ...any) {
+	log.Printf(format, args...)
+	fmt.Println("Removing the new volume ...")
+	if err := luks.RemoveLUKSVolume(ctx, &cfg.LUKS); err != nil {
+		log.Printf("Failed to remove LUKS volume: %v", err)
+	}
+	if path := cfg.LUKS.Split.EscrowPath; path != "" {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove escrow share: %v", err)
+		}
+	}
+	if volume, err := state.Load(cfg.LUKS.MapperName); err == nil {
+		volume.Remove()
+	}
+	updateRegistry(cfg, func(registry *state.Registry) { registry.Delete(cfg.LUKS.MapperName) })
+	claim.release()
+	fatalf(format, args...)
 }
 
-func deauthorize(cfg *config.AppConfig) {
+func deauthorize(ctx context.Context, cfg *config.AppConfig) {
 	fmt.Println("Deauthorizing with config:", cfg.Cmd.Config)
 
+	// Files still open on the volume are likely unsaved work of a running application
+	if volumeMounted(cfg) && !cfg.Cmd.Force {
+		if procs, err := luks.ProcessesUsing(cfg.LUKS.MountPoint); err != nil {
+			log.Printf("Failed to check for processes using %s: %v", cfg.LUKS.MountPoint, err)
+		} else if len(procs) > 0 {
+			names := make([]string, len(procs))
+			for i, p := range procs {
+				names[i] = p.String()
+			}
+			fatalf("Error: %s is in use by %s, stop them or deauthorize with --force", cfg.LUKS.MountPoint, strings.Join(names, ", "))
+		}
+	}
+	if !cfg.Cmd.Yes {
+		if err := confirmVolumeName(cfg); err != nil {
+			fatalf("Error: %v, volume left untouched", err)
+		}
+	}
+
 	// Remove LUKS volume
-	if err := luks.RemoveLUKSVolume(&cfg.LUKS); err != nil {
+	runPreHooks(cfg, hooks.PreDeauthorize)
+	if err := luks.RemoveLUKSVolume(ctx, &cfg.LUKS); err != nil {
 		log.Printf("Error cleaning up LUKS volume: %v", err)
 	}
+	if volume, err := state.Load(cfg.LUKS.MapperName); err == nil {
+		volume.Remove()
+	}
+	updateRegistry(cfg, func(registry *state.Registry) { registry.Delete(cfg.LUKS.MapperName) })
+	runPostHooks(cfg, hooks.PostDeauthorize)
+	printResult("Deauthorized: "+cfg.LUKS.VolumePath, summarize(cfg))
+	secrets.DestroyAll()
 	os.Exit(0)
 }
 
-func mount(cfg *config.AppConfig) {
+// confirmVolumeName asks on the terminal to type the mapper name before the volume and
+// its key are destroyed, so a deauthorize run against the wrong configuration stops.
+func confirmVolumeName(cfg *config.AppConfig) error {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("no terminal to confirm on, pass --yes to deauthorize without confirmation")
+	}
+	defer tty.Close()
+
+	fmt.Fprintf(tty, "This destroys %s and its key, the data cannot be recovered.\nType the volume name (%s) to continue: ", cfg.LUKS.VolumePath, cfg.LUKS.MapperName)
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil && line == "" {
+		return fmt.Errorf("no confirmation: %w", err)
+	}
+	if strings.TrimSpace(line) != cfg.LUKS.MapperName {
+		return fmt.Errorf("%q does not match the volume name %s", strings.TrimSpace(line), cfg.LUKS.MapperName)
+	}
+	return nil
+}
+
+func mount(ctx context.Context, cfg *config.AppConfig) {
 	fmt.Println("Mounting with config:", cfg.Cmd.Config, "and keyfile:", cfg.Cmd.Keyfile)
 
-	if !cfg.LUKS.UseTPM {
-		// Read the keyfile
-		key, err := readKeyFromFile(cfg.Cmd.Keyfile)
+	held, err := holders.Load(cfg.LUKS.MapperName)
+	if err != nil {
+		fatalf("Failed to load holders: %v", err)
+	}
+
+	// Another consumer already mounted the volume, just take a reference
+	if volumeMounted(cfg) {
+		held.Acquire(holderID(cfg), cfg.Cmd.Lease, time.Now())
+		if err := held.Save(); err != nil {
+			fatalf("Failed to record holder: %v", err)
+		}
+		printResult(fmt.Sprintf("LUKS already mounted: %s, holders: %s", cfg.LUKS.MountPoint, strings.Join(held.IDs(), ", ")), summarize(cfg))
+		return
+	}
+
+	if cfg.LUKS.Plain() {
+		// Mapped again with a new random key, whatever the volume held is gone
+		runPreHooks(cfg, hooks.PreMount)
+		endPhase := phase("open")
+		err := luks.SetupLUKSVolume(ctx, &cfg.LUKS)
+		endPhase(err)
+		if err != nil {
+			fatalf("Failed to set up %s volume: %v", cfg.LUKS.Profile, err)
+		}
+	} else {
+		openVolume(ctx, cfg)
+
+		// Mount LUKS Volume
+		endPhase := phase("mount")
+		err := luks.MountLUKSVolume(ctx, &cfg.LUKS)
+		endPhase(err)
 		if err != nil {
-			log.Fatalf("Failed to read key from file: %v", err)
+			fatalf("Failed to mount LUKS volume: %v", err)
 		}
-		cfg.LUKS.Password = key
 	}
-	// Open LUKS Volume
-	if err := luks.OpenLUKSVolume(&cfg.LUKS); err != nil {
-		log.Fatalf("Failed to open LUKS volume: %v", err)
+	updateState(cfg, func(volume *state.Volume) { volume.LastMounted = time.Now() })
+	registerVolume(ctx, cfg)
+
+	// Holders of a previous mount are stale once the volume was unmounted
+	held.Holders = nil
+	held.Acquire(holderID(cfg), cfg.Cmd.Lease, time.Now())
+	if err := held.Save(); err != nil {
+		fatalf("Failed to record holder: %v", err)
+	}
+	runPostHooks(cfg, hooks.PostMount)
+
+	message := "Mounted LUKS successfully: " + cfg.LUKS.MountPoint
+	if cfg.LUKS.ReadOnly {
+		message += " (read-only)"
 	}
+	printResult(message, summarize(cfg))
+}
 
-	// Mount LUKS Volume
-	if err := luks.MountLUKSVolume(&cfg.LUKS); err != nil {
-		log.Fatalf("Failed to mount LUKS volume: %v", err)
+// openVolume loads the key and opens the volume for mount, counting unlocks failed by a
+// wrong key for the lockout. Other failures, such as a busy device, do not lock it out.
+func openVolume(ctx context.Context, cfg *config.AppConfig) {
+	if cfg.LUKS.Ephemeral {
+		fatalf("Failed to open LUKS volume: %v", luks.ErrEphemeral)
+	}
+	if err := checkLockout(cfg); err != nil {
+		fatalf("Failed to open LUKS volume: %v", err)
+	}
+	cfg.LUKS.ReadOnly = cfg.LUKS.ReadOnly || cfg.Cmd.ReadOnly
+	endPhase := phase("wait device")
+	err := luks.WaitForDevice(&cfg.LUKS)
+	endPhase(err)
+	if err != nil {
+		fatalf("Failed to open LUKS volume: %v", err)
 	}
+	endPhase = phase("load key")
+	loadKey(ctx, cfg)
+	endPhase(nil)
 
-	fmt.Println("Mouned LUKS successfully:", cfg.LUKS.MountPoint)
+	// Open LUKS Volume
+	runPreHooks(cfg, hooks.PreMount)
+	endPhase = phase("open")
+	err = luks.OpenLUKSVolume(ctx, &cfg.LUKS)
+	endPhase(err)
+	if err != nil {
+		updateState(cfg, func(volume *state.Volume) {
+			volume.UnlockFailures++
+			if errors.Is(err, luks.ErrWrongKey) {
+				volume.FailedUnlocks++
+				volume.LastUnlockFailure = time.Now()
+			}
+		})
+		fatalf("Failed to open LUKS volume: %v", err)
+	}
+	updateState(cfg, func(volume *state.Volume) { volume.FailedUnlocks = 0 })
 }
 
-func unmount(cfg *config.AppConfig) {
+func unmount(ctx context.Context, cfg *config.AppConfig) {
 	fmt.Println("Unmounting with config:", cfg.Cmd.Config)
 
+	held, err := holders.Load(cfg.LUKS.MapperName)
+	if err != nil {
+		fatalf("Failed to load holders: %v", err)
+	}
+
+	// Only the last consumer releasing the volume unmounts it
+	if len(held.Holders) > 0 {
+		remaining, err := held.Release(holderID(cfg))
+		if err != nil {
+			fatalf("Failed to release volume: %v", err)
+		}
+		if remaining > 0 {
+			if err := held.Save(); err != nil {
+				fatalf("Failed to record holder: %v", err)
+			}
+			printResult("Released, volume still held by: "+strings.Join(held.IDs(), ", "), summarize(cfg))
+			return
+		}
+	}
+
 	// Unmount LUKS volume
-	if err := luks.UnmountAndCloseLUKSVolume(&cfg.LUKS); err != nil {
-		log.Fatalf("Error cleaning up LUKS volume: %v", err)
+	cfg.LUKS.KillUsers = cfg.Cmd.KillUsers
+	runPreHooks(cfg, hooks.PreUnmount)
+	if err := luks.UnmountAndCloseLUKSVolume(ctx, &cfg.LUKS); err != nil {
+		var inUse *luks.InUseError
+		if errors.As(err, &inUse) {
+			exitWithResult(1, err.Error(), inUse.Processes)
+		}
+		fatalf("Error cleaning up LUKS volume: %v", err)
 	}
+	if err := held.Save(); err != nil {
+		fatalf("Failed to record holder: %v", err)
+	}
+	runPostHooks(cfg, hooks.PostUnmount)
+	printResult("Unmounted: "+cfg.LUKS.MountPoint, summarize(cfg))
+}
+
+func listHolders(cfg *config.AppConfig) {
+	held, err := holders.Load(cfg.LUKS.MapperName)
+	if err != nil {
+		fatalf("Failed to load holders: %v", err)
+	}
+
+	t := newTable()
+	t.AppendHeader(table.Row{"Holder", "Since", "Lease Expires"})
+	for _, h := range held.Holders {
+		expires := "never"
+		if !h.Expires.IsZero() {
+			expires = h.Expires.Format(time.RFC3339)
+		}
+		t.AppendRow(table.Row{h.ID, h.Since.Format(time.RFC3339), expires})
+	}
+	render(t)
+	printResult("", held.Holders)
+}
+
+func renew(cfg *config.AppConfig) {
+	if cfg.Cmd.Lease <= 0 {
+		fatalf("Error: --lease must be specified")
+	}
+
+	held, err := holders.Load(cfg.LUKS.MapperName)
+	if err != nil {
+		fatalf("Failed to load holders: %v", err)
+	}
+	h, err := held.Renew(holderID(cfg), cfg.Cmd.Lease, time.Now())
+	if err != nil {
+		fatalf("Failed to renew lease: %v", err)
+	}
+	if err := held.Save(); err != nil {
+		fatalf("Failed to record holder: %v", err)
+	}
+	printResult("Lease renewed until "+h.Expires.Format(time.RFC3339), h)
+}
+
+func reconcile(ctx context.Context, cfg *config.AppConfig) {
+	drifts, err := luks.Reconcile(ctx, &cfg.LUKS, !cfg.Cmd.DryRun)
+	if err != nil {
+		fatalf("Failed to reconcile: %v", err)
+	}
+
+	t := newTable()
+	t.AppendHeader(table.Row{"Item", "Desired", "Actual", "Action"})
+	manual := 0
+	for _, d := range drifts {
+		action := "manual action required"
+		switch {
+		case d.Fixed:
+			action = "corrected"
+		case d.Error != "":
+			action = "correction failed: " + d.Error
+		case d.Safe && cfg.Cmd.DryRun:
+			action = "would be corrected"
+		}
+		if !d.Fixed && !(d.Safe && cfg.Cmd.DryRun) {
+			manual++
+		}
+		t.AppendRow(table.Row{d.Item, d.Desired, d.Actual, action})
+	}
+	if len(drifts) > 0 {
+		render(t)
+	}
+
+	if manual > 0 {
+		exitWithResult(1, fmt.Sprintf("%d difference(s) need manual action", manual), drifts)
+	}
+	printResult(fmt.Sprintf("Reconciled, %d difference(s)", len(drifts)), drifts)
+}
+
+// checkResult is the result data of check.
+type checkResult struct {
+	InSync  bool          `json:"inSync"`
+	Changes []luks.Change `json:"changes"`
 }
 
-func addPersistentMount(cfg *config.AppConfig) {
+// checkState reports the changes needed to bring the system to the state of the
+// configuration and exits 0 when in sync, 2 when changes are needed and 1 on errors,
+// the convention of configuration management check modes.
+func checkState(ctx context.Context, cfg *config.AppConfig) {
+	keyfile := cfg.Cmd.Keyfile
+	if keyfile == config.KeyfileStdio || cfg.Cmd.KeyFD > 0 {
+		keyfile = ""
+	}
+	changes, err := luks.CheckState(ctx, &cfg.LUKS, keyfile, cfg.Cmd.Persistent)
+	if err != nil {
+		fatalf("Failed to check state: %v", err)
+	}
+	result := checkResult{InSync: len(changes) == 0, Changes: changes}
+
+	t := newTable()
+	t.AppendHeader(table.Row{"Item", "Desired", "Actual", "Action"})
+	for _, c := range changes {
+		t.AppendRow(table.Row{c.Item, c.Desired, c.Actual, c.Action})
+	}
+	if len(changes) > 0 {
+		render(t)
+		exitWithResult(2, fmt.Sprintf("%d change(s) needed: %s", len(changes), cfg.LUKS.MapperName), result)
+	}
+	printResult("In sync: "+cfg.LUKS.MapperName, result)
+}
+
+func acceptHeader(ctx context.Context, cfg *config.AppConfig) {
+	if err := recordHeader(ctx, cfg); err != nil {
+		fatalf("Failed to accept header: %v", err)
+	}
+	printResult("Current LUKS header recorded as expected: "+cfg.LUKS.VolumePath, nil)
+}
+
+func serveNBD(cfg *config.AppConfig) {
+	opts := cfg.Cmd.NBD
+	if !cfg.Cmd.ReadOnly {
+		fatalf("Error: serve-nbd only supports read-only exports, specify --read-only")
+	}
+	if opts.TLSCert == "" || opts.TLSKey == "" || opts.TLSCA == "" {
+		fatalf("Error: --tls-cert, --tls-key and --tls-ca must be specified")
+	}
+	device := "/dev/mapper/" + cfg.LUKS.MapperName
+	if _, err := os.Stat(device); err != nil {
+		fatalf("Error: volume is not open, mount it first: %v", err)
+	}
+
+	tlsConfig, err := nbd.LoadTLSConfig(opts.TLSCert, opts.TLSKey, opts.TLSCA)
+	if err != nil {
+		fatalf("Failed to configure TLS: %v", err)
+	}
+	listener, err := net.Listen("tcp", opts.Listen)
+	if err != nil {
+		fatalf("Failed to listen: %v", err)
+	}
+
+	deadline := time.Now().Add(opts.Duration)
+	server := &nbd.Server{
+		Device: device,
+		Export: cfg.LUKS.MapperName,
+		TLS:    tlsConfig,
+		Logf: func(format string, args ...any) {
+			message := fmt.Sprintf(format, args...)
+			log.Printf("nbd: %s", message)
+			recordAuditEvent(cfg, "serve-nbd-session", audit.OutcomeSuccess, message)
+		},
+	}
+	log.Printf("nbd: serving %s read-only on %s until %s", device, listener.Addr(), deadline.Format(time.RFC3339))
+	recordAuditEvent(cfg, "serve-nbd-start", audit.OutcomeSuccess,
+		fmt.Sprintf("listening on %s until %s", listener.Addr(), deadline.Format(time.RFC3339)))
+	if err := server.Serve(listener, deadline); err != nil {
+		fatalf("NBD server failed: %v", err)
+	}
+	printResult("NBD export closed: "+cfg.LUKS.MapperName, nil)
+}
+
+func supportBundle(cfg *config.AppConfig) {
+	path := cfg.Cmd.BundleFile
+	if path == "" {
+		path = fmt.Sprintf("udm-support-%s-%s.tar.gz", cfg.LUKS.MapperName, time.Now().Format("20060102-150405"))
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		fatalf("Failed to create support bundle: %v", err)
+	}
+	defer file.Close()
+	if err := support.WriteBundle(file, cfg); err != nil {
+		os.Remove(path)
+		fatalf("Failed to write support bundle: %v", err)
+	}
+	printResult("Support bundle written: "+path, map[string]string{"file": path})
+}
+
+// holderID returns the consumer id of this invocation.
+func holderID(cfg *config.AppConfig) string {
+	if cfg.Cmd.Holder != "" {
+		return cfg.Cmd.Holder
+	}
+	return holders.DefaultHolder
+}
+
+// volumeMounted reports whether the volume is open and mounted at its mount point.
+func volumeMounted(cfg *config.AppConfig) bool {
+	if _, err := os.Stat("/dev/mapper/" + cfg.LUKS.MapperName); err != nil {
+		return false
+	}
+	mounted, err := luks.IsLUKSMounted(&cfg.LUKS)
+	return err == nil && mounted
+}
+
+func addPersistentMount(ctx context.Context, cfg *config.AppConfig) {
 	fmt.Println("Adding persistent mount with config:", cfg.Cmd.Config, "and keyfile:", cfg.Cmd.Keyfile)
+	// Swap and tmp profiles get a new random key from crypttab at every boot
+	if cfg.LUKS.Ephemeral && cfg.LUKS.Profile == luks.ProfileData {
+		fatalf("Error: ephemeral volumes cannot be mounted persistently")
+	}
+	if cfg.Cmd.Keyfile == config.KeyfileStdio || cfg.Cmd.KeyFD > 0 {
+		fatalf("Error: crypttab needs a keyfile path, the key cannot be passed through a stream")
+	}
 
 	// Add Persistent Mount
-	if err := luks.AddPersistentMount(&cfg.LUKS, cfg.Cmd.Keyfile); err != nil {
-		log.Fatalf("Failed to configure persistent mount: %v", err)
+	if err := luks.AddPersistentMount(ctx, &cfg.LUKS, cfg.Cmd.Keyfile); err != nil {
+		fatalf("Failed to configure persistent mount: %v", err)
+	}
+	registerVolume(ctx, cfg)
+	printResult("Persistent mount configured: "+cfg.LUKS.MountPoint, summarize(cfg))
+}
+
+// hotplugHolder holds the volume mounted by the hotplug unit.
+const hotplugHolder = "hotplug"
+
+func addHotplugMount(ctx context.Context, cfg *config.AppConfig) {
+	fmt.Println("Adding hotplug mount with config:", cfg.Cmd.Config, "and keyfile:", cfg.Cmd.Keyfile)
+	if cfg.LUKS.Ephemeral {
+		fatalf("Error: ephemeral volumes cannot be mounted on hotplug")
+	}
+	if cfg.Cmd.Keyfile == config.KeyfileStdio || cfg.Cmd.KeyFD > 0 {
+		fatalf("Error: the hotplug unit needs a keyfile path, the key cannot be passed through a stream")
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		fatalf("Failed to locate udm: %v", err)
+	}
+
+	// Layered configurations are found again by the search, a single one is passed on
+	var common []string
+	if len(cfg.Cmd.ConfigFiles) == 1 {
+		path, _ := filepath.Abs(cfg.Cmd.Config)
+		common = append(common, "--config="+path)
+	}
+	mountArgs := append([]string{executable, "mount", "--holder=" + hotplugHolder}, common...)
+	if cfg.Cmd.Keyfile != "" {
+		path, _ := filepath.Abs(cfg.Cmd.Keyfile)
+		mountArgs = append(mountArgs, "--keyfile="+path)
+	}
+	unmountArgs := append([]string{executable, "unmount", "--holder=" + hotplugHolder}, common...)
+
+	if err := luks.AddHotplugMount(ctx, &cfg.LUKS, mountArgs, unmountArgs); err != nil {
+		fatalf("Failed to configure hotplug mount: %v", err)
+	}
+	printResult("Hotplug mount configured: "+cfg.LUKS.MountPoint, summarize(cfg))
+}
+
+func removeHotplugMount(cfg *config.AppConfig) {
+	fmt.Println("Removing hotplug mount with config:", cfg.Cmd.Config)
+	if err := luks.RemoveHotplugMount(&cfg.LUKS); err != nil {
+		fatalf("Failed to remove hotplug mount: %v", err)
 	}
+	printResult("Hotplug mount removed: "+cfg.LUKS.MountPoint, summarize(cfg))
 }
 
-func removePersistentMount(cfg *config.AppConfig) {
+func removePersistentMount(ctx context.Context, cfg *config.AppConfig) {
 	fmt.Println("Removing persistent mount with config:", cfg.Cmd.Config)
 
 	// Remove Persistent Mount
 	if err := luks.RemovePersistentMount(&cfg.LUKS); err != nil {
-		log.Fatalf("Failed to remove persistent mount: %v", err)
+		fatalf("Failed to remove persistent mount: %v", err)
+	}
+	registerVolume(ctx, cfg)
+	printResult("Persistent mount removed: "+cfg.LUKS.MountPoint, summarize(cfg))
+}
+
+func verify(ctx context.Context, cfg *config.AppConfig) {
+	fmt.Println("Verifying with config:", cfg.Cmd.Config)
+
+	// The random key of a plain volume is not stored anywhere
+	if !cfg.LUKS.Plain() {
+		loadKey(ctx, cfg)
+	}
+
+	result, err := luks.VerifyLUKSVolume(ctx, &cfg.LUKS)
+	if err != nil {
+		fatalf("Failed to verify LUKS volume: %v", err)
+	}
+	printVerifyResult(result)
+
+	if !result.Healthy() {
+		exitWithResult(1, "Volume is unhealthy: "+cfg.LUKS.VolumePath, result)
+	}
+	printResult("Volume is healthy: "+cfg.LUKS.VolumePath, result)
+}
+
+func whichKey(ctx context.Context, cfg *config.AppConfig) {
+	path := luks.ExplainUnlockPath(ctx, &cfg.LUKS, cfg.Cmd.Keyfile)
+
+	t := newTable()
+	t.AppendHeader(table.Row{"Protector", "Source", "Status"})
+	for _, step := range path.Steps {
+		t.AppendRow(table.Row{step.Protector, step.Source, step.Status})
+	}
+	t.AppendSeparator()
+	t.AppendRows([]table.Row{
+		{"LUKS2 header binding", path.HeaderBinding, ""},
+		{"crypttab entry", path.CrypttabEntry, ""},
+		{"Boot unlock", path.BootUnlock, ""},
+	})
+	render(t)
+	printResult("", path)
+}
+
+func freeze(ctx context.Context, cfg *config.AppConfig) {
+	if !cfg.Cmd.Snapshot {
+		if err := luks.FreezeFilesystem(ctx, &cfg.LUKS); err != nil {
+			fatalf("Failed to freeze: %v", err)
+		}
+		printResult("Filesystem frozen, run udm thaw to resume writes: "+cfg.LUKS.MountPoint, summarize(cfg))
+		return
+	}
+
+	loadKey(ctx, cfg)
+	snap, err := luks.CreateSnapshot(ctx, &cfg.LUKS)
+	if err != nil {
+		fatalf("Failed to create snapshot: %v", err)
+	}
+	printResult("Read-only snapshot mounted: "+snap.MountPoint, snap)
+}
+
+func thaw(ctx context.Context, cfg *config.AppConfig) {
+	if err := luks.ThawFilesystem(ctx, &cfg.LUKS); err != nil {
+		fatalf("Failed to thaw: %v", err)
+	}
+	printResult("Filesystem thawed: "+cfg.LUKS.MountPoint, summarize(cfg))
+}
+
+func releaseSnapshot(ctx context.Context, cfg *config.AppConfig) {
+	if err := luks.ReleaseSnapshot(ctx, &cfg.LUKS); err != nil {
+		fatalf("Failed to release snapshot: %v", err)
+	}
+	printResult("Snapshot released", nil)
+}
+
+func addKey(ctx context.Context, cfg *config.AppConfig) {
+	if cfg.Cmd.NewKeyfile == "" {
+		fatalf("Error: --new-keyfile must be specified")
+	}
+	newKey, err := readKeyFromFile(cfg.Cmd.NewKeyfile, cfg.Cmd.InsecureKeyfile)
+	if err != nil {
+		fatalf("Failed to read new key: %v", err)
+	}
+	if err := luks.CheckKeyMaterial(newKey); err != nil {
+		fatalf("New key rejected: %v", err)
+	}
+
+	loadKey(ctx, cfg)
+	if err := luks.AddKeyslot(ctx, &cfg.LUKS, newKey, cfg.Cmd.Slot); err != nil {
+		fatalf("Failed to add key: %v", err)
+	}
+	if err := recordHeader(ctx, cfg); err != nil {
+		log.Printf("Failed to record header fingerprint: %v", err)
+	}
+	printResult("Key added from: "+cfg.Cmd.NewKeyfile, nil)
+}
+
+func reencrypt(ctx context.Context, cfg *config.AppConfig) {
+	current, err := luks.CurrentEncryption(ctx, &cfg.LUKS)
+	if err != nil {
+		fatalf("Failed to read encryption: %v", err)
+	}
+	if !current.NeedsReencryption(&cfg.LUKS) {
+		printResult(fmt.Sprintf("Volume already uses %s with a %d bit key", current.Cipher, current.KeySize), current)
+		return
+	}
+
+	loadKey(ctx, cfg)
+	if err := luks.ReencryptLUKSVolume(ctx, &cfg.LUKS); err != nil {
+		fatalf("Failed to re-encrypt volume: %v", err)
+	}
+	if err := recordHeader(ctx, cfg); err != nil {
+		log.Printf("Failed to record header fingerprint: %v", err)
+	}
+	migrated, err := luks.CurrentEncryption(ctx, &cfg.LUKS)
+	if err != nil {
+		fatalf("Failed to read encryption: %v", err)
+	}
+	printResult(fmt.Sprintf("Volume re-encrypted from %s to %s", current.Cipher, migrated.Cipher), migrated)
+}
+
+func removeKey(ctx context.Context, cfg *config.AppConfig) {
+	if cfg.Cmd.Slot < 0 {
+		fatalf("Error: --slot must be specified")
+	}
+
+	loadKey(ctx, cfg)
+	if err := luks.RemoveKeyslot(ctx, &cfg.LUKS, cfg.Cmd.Slot); err != nil {
+		fatalf("Failed to remove key: %v", err)
+	}
+	if err := recordHeader(ctx, cfg); err != nil {
+		log.Printf("Failed to record header fingerprint: %v", err)
+	}
+	printResult(fmt.Sprint("Removed keyslot: ", cfg.Cmd.Slot), map[string]int{"slot": cfg.Cmd.Slot})
+}
+
+// checkKey measures a key or passphrase from --keyfile, or stdin, against the password
+// policy. A trailing newline is not counted, so passphrases can be piped with echo.
+func checkKey(cfg *config.AppConfig) {
+	keyfile := cfg.Cmd.Keyfile
+	if keyfile == "" {
+		keyfile = config.KeyfileStdio
+	}
+	key, err := readKeyFromFile(keyfile, cfg.Cmd.InsecureKeyfile)
+	if err != nil {
+		fatalf("Failed to read key: %v", err)
+	}
+	if trimmed := bytes.TrimRight(key, "\r\n"); len(trimmed) > 0 {
+		key = trimmed
+	}
+
+	policy, err := luks.NewPasswordPolicy(&cfg.LUKS)
+	if err != nil {
+		fatalf("Failed to load password policy: %v", err)
+	}
+	strength := policy.Measure(key)
+
+	t := newTable()
+	t.AppendHeader(table.Row{"Property", "Value"})
+	t.AppendRows([]table.Row{
+		{"Kind", strength.Kind},
+		{"Estimated entropy", fmt.Sprintf("%.0f bits", strength.Entropy)},
+		{"Required entropy", fmt.Sprintf("%d bits", strength.Required)},
+	})
+	if strength.Kind == "passphrase" {
+		t.AppendRows([]table.Row{
+			{"Character classes", fmt.Sprintf("%d of %d, policy requires %d", strength.Classes, luks.MaxCharClasses, cfg.LUKS.MinCharClasses)},
+			{"On deny-list", strength.Denied},
+		})
+	}
+	render(t)
+	if strength.Problem != "" {
+		exitWithResult(1, "Key rejected: "+strength.Problem, strength)
+	}
+	printResult("Key meets the password policy", strength)
+}
+
+func enrollFIDO2(ctx context.Context, cfg *config.AppConfig) {
+	if !cfg.LUKS.FIDO2.Enabled {
+		fatalf("Error: luks.fido2 is not enabled in the configuration")
+	}
+
+	loadKey(ctx, cfg)
+	if err := luks.EnrollFIDO2(ctx, &cfg.LUKS); err != nil {
+		fatalf("Failed to enroll FIDO2 token: %v", err)
+	}
+	if err := recordHeader(ctx, cfg); err != nil {
+		log.Printf("Failed to record header fingerprint: %v", err)
+	}
+	printResult("FIDO2 token enrolled: "+cfg.LUKS.FIDO2.Device, nil)
+}
+
+// exportEscrow writes the volume key wrapped for the organization, to be kept offline
+// for recovery after the machine key is lost.
+func exportEscrow(ctx context.Context, cfg *config.AppConfig) {
+	if !cfg.LUKS.Escrow.Enabled() {
+		fatalf("Error: luks.escrow.publicKey must be configured")
+	}
+	path := cfg.Cmd.EscrowFile
+	if path == "" {
+		path = cfg.LUKS.Escrow.Path
+	}
+
+	loadKey(ctx, cfg)
+	blob, err := luks.ExportEscrow(ctx, &cfg.LUKS)
+	if err != nil {
+		fatalf("Failed to export escrow: %v", err)
+	}
+	data, err := json.MarshalIndent(blob, "", "  ")
+	if err != nil {
+		fatalf("Failed to encode escrow blob: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		fatalf("Failed to create escrow directory: %v", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0600); err != nil {
+		fatalf("Failed to write escrow blob: %v", err)
+	}
+	printResult("Escrow blob written: "+path, map[string]string{"file": path, "recipient": blob.Recipient})
+}
+
+// recoverKey enrolls a new machine key with the volume key the security team unwrapped
+// from the escrow blob, e.g. after the TPM was replaced.
+func recoverKey(ctx context.Context, cfg *config.AppConfig) {
+	if cfg.Cmd.VolumeKey == "" {
+		fatalf("Error: --volume-key must be specified")
+	}
+	if !cfg.LUKS.UseTPM && !cfg.LUKS.Vault.Enabled() && cfg.Cmd.Keyfile == "" {
+		fatalf("Error: --keyfile must be specified when TPM is not used")
+	}
+	volumeKey, err := readKeyFromFile(cfg.Cmd.VolumeKey, cfg.Cmd.InsecureKeyfile)
+	if err != nil {
+		fatalf("Failed to read volume key: %v", err)
+	}
+	defer secrets.Wipe(volumeKey)
+
+	if err := luks.RecoverWithVolumeKey(ctx, &cfg.LUKS, volumeKey); err != nil {
+		fatalf("Failed to recover volume: %v", err)
 	}
+	message := "New key enrolled and stored in the TPM NVIndex = " + cfg.LUKS.KeyNVIndex()
+	if cfg.LUKS.Vault.Enabled() {
+		message = "New key enrolled and stored in Vault"
+	} else if !cfg.LUKS.UseTPM {
+		if err := writeKeyfile(ctx, cfg, cfg.LUKS.Password); err != nil {
+			fatalf("Failed to write keyfile: %v", err)
+		}
+		message = "New key enrolled, generated keyfile: " + cfg.Cmd.Keyfile
+	}
+	if err := recordHeader(ctx, cfg); err != nil {
+		log.Printf("Failed to record header fingerprint: %v", err)
+	}
+	updateState(cfg, func(volume *state.Volume) { volume.FailedUnlocks = 0 })
+	printResult(message+"\nRemove the keyslot of the lost key with remove-key", summarize(cfg))
+}
+
+// checkLockout fails while luks.lockout delays or refuses unlocking after failed attempts.
+func checkLockout(cfg *config.AppConfig) error {
+	if !cfg.LUKS.Lockout.Enabled() {
+		return nil
+	}
+	volume, err := state.Load(cfg.LUKS.MapperName)
+	if err != nil {
+		return err
+	}
+	return cfg.LUKS.Lockout.CheckLockout(volume.FailedUnlocks, volume.LastUnlockFailure, time.Now())
+}
+
+// resetLockout clears the failed unlock attempts, after an administrator made sure they
+// were not an attack.
+func resetLockout(cfg *config.AppConfig) {
+	volume, err := state.Load(cfg.LUKS.MapperName)
+	if err != nil {
+		fatalf("Failed to load volume state: %v", err)
+	}
+	failures := volume.FailedUnlocks
+	volume.FailedUnlocks = 0
+	volume.LastUnlockFailure = time.Time{}
+	if err := volume.Save(); err != nil {
+		fatalf("Failed to save volume state: %v", err)
+	}
+	printResult(fmt.Sprintf("Cleared %d failed unlock attempts: %s", failures, cfg.LUKS.MapperName), nil)
+}
+
+func listKeys(ctx context.Context, cfg *config.AppConfig) {
+	slots, err := luks.ListKeyslots(ctx, &cfg.LUKS)
+	if err != nil {
+		fatalf("Failed to list keys: %v", err)
+	}
+
+	t := newTable()
+	t.AppendHeader(table.Row{"Slot", "Type", "Tokens"})
+	for _, slot := range slots {
+		t.AppendRow(table.Row{slot.Slot, slot.Type, strings.Join(slot.Tokens, ", ")})
+	}
+	render(t)
+	printResult("", slots)
+}
+
+// loadKey reads the key the volume is opened with into the LUKS configuration. Keys held
+// by the TPM alone are retrieved when the volume is opened instead.
+func loadKey(ctx context.Context, cfg *config.AppConfig) {
+	if cfg.LUKS.Split.Enabled() {
+		var share []byte
+		if cfg.Cmd.Keyfile != "" || cfg.LUKS.USBKey.Enabled() {
+			keyData, err := readKeyfile(ctx, cfg)
+			if err != nil {
+				log.Printf("Keyfile share unavailable: %v", err)
+			}
+			share = keyData
+		}
+		if err := luks.RecoverSplitKey(ctx, &cfg.LUKS, share); err != nil {
+			fatalf("Failed to recover split key: %v", err)
+		}
+		return
+	}
+
+	// Keys held by the TPM or Vault are retrieved on open, a FIDO2 token unlocks without
+	// a keyfile
+	if cfg.LUKS.UseTPM || cfg.LUKS.Vault.Enabled() || (cfg.LUKS.FIDO2.Enabled && cfg.Cmd.Keyfile == "") {
+		return
+	}
+
+	// Read the keyfile, an operator can unlock with the enrolled passphrase without it
+	key, err := readKeyfile(ctx, cfg)
+	if err != nil {
+		if !cfg.LUKS.AllowPassphrase {
+			fatalf("Failed to read key from file: %v", err)
+		}
+		log.Printf("Keyfile unavailable, asking for the passphrase: %v", err)
+		if cfg.LUKS.Password, err = luks.AskPassphrase(&cfg.LUKS, fmt.Sprintf("Passphrase for %s:", cfg.LUKS.MapperName)); err != nil {
+			fatalf("Failed to read passphrase: %v", err)
+		}
+		return
+	}
+	if err := luks.CheckKeyStrength(key, cfg.LUKS.MinKeyEntropy); err != nil {
+		fatalf("Keyfile rejected: %v", err)
+	}
+	cfg.LUKS.Password = key
 }
 
 func readBootstrapToken(filePath string) (token *config.BootstrapToken) {
@@ -154,33 +1193,160 @@ func readBootstrapToken(filePath string) (token *config.BootstrapToken) {
 	// Load bootstrap from file
 	token, err := config.LoadBootstrap(filePath)
 	if err != nil {
-		log.Fatalf("Failed to load bootstrap file: %v", err)
+		fatalf("Failed to load bootstrap file: %v", err)
 	}
 
 	// Validate
 	if err := token.Validate(); err != nil {
-		log.Fatalf("Invalid configuration: %v", err)
+		fatalf("Invalid configuration: %v", err)
 	}
 
 	printBootstrapToken(token)
 	return token
 }
 
-// writeKeyToFile writes the Key field from the LUKS structure to the specified binary file.
-func writeKeyToFile(keyfile string, password []byte) error {
+// writeKeyfile writes key to the configured keyfile, wrapped according to luks.keyfileWrap.
+func writeKeyfile(ctx context.Context, cfg *config.AppConfig, key []byte) error {
+	if cfg.LUKS.HardwareBinding.Enabled() {
+		bound, err := luks.BindToHardware(ctx, &cfg.LUKS, key)
+		if err != nil {
+			return err
+		}
+		key = bound
+	}
+
+	switch cfg.LUKS.KeyfileWrap {
+	case luks.KeyfileWrapNone:
+		return writeKeyToFile(cfg.Cmd.Keyfile, key, cfg.LUKS.KeyfileOwner)
+	case luks.KeyfileWrapSystemdCreds:
+		credential, err := luks.EncryptCredential(cfg.LUKS.Credential, key)
+		if err != nil {
+			return err
+		}
+		return writeKeyToFile(cfg.Cmd.Keyfile, credential, cfg.LUKS.KeyfileOwner)
+	}
+
+	var passphrase []byte
+	if cfg.LUKS.KeyfileWrap == luks.KeyfileWrapPassphrase {
+		var err error
+		if passphrase, err = keyfilePassphrase(cfg); err != nil {
+			return err
+		}
+		if err := luks.CheckKeyMaterial(passphrase); err != nil {
+			return err
+		}
+	}
+
+	wrapped, err := luks.WrapKey(ctx, cfg.LUKS.KeyfileWrap, key, passphrase, cfg.LUKS.NVAuth)
+	if err != nil {
+		return fmt.Errorf("failed to wrap keyfile: %w", err)
+	}
+	return writeKeyToFile(cfg.Cmd.Keyfile, wrapped, cfg.LUKS.KeyfileOwner)
+}
+
+// readKeyfile reads the configured keyfile, transparently unwrapping wrapped keyfiles and
+// unbinding them from the hardware. Without --keyfile the key is read from the stick of
+// luks.usbKey.
+func readKeyfile(ctx context.Context, cfg *config.AppConfig) ([]byte, error) {
+	var key []byte
+	var err error
+	if cfg.LUKS.USBKey.Enabled() && cfg.Cmd.Keyfile == "" {
+		err = luks.WithUSBKey(ctx, &cfg.LUKS, func(keyfile string) error {
+			var err error
+			key, err = readKeyfileAt(ctx, cfg, keyfile)
+			return err
+		})
+	} else {
+		key, err = readKeyfileAt(ctx, cfg, cfg.Cmd.Keyfile)
+	}
+	if err != nil || !cfg.LUKS.HardwareBinding.Enabled() {
+		return key, err
+	}
+	return luks.BindToHardware(ctx, &cfg.LUKS, key)
+}
+
+// readKeyfileAt reads and unwraps the keyfile at path.
+func readKeyfileAt(ctx context.Context, cfg *config.AppConfig, path string) ([]byte, error) {
+	data, err := readKeyFromFile(path, cfg.Cmd.InsecureKeyfile)
+	if err != nil {
+		return nil, err
+	}
+
+	var key []byte
+	switch {
+	case cfg.LUKS.KeyfileWrap == luks.KeyfileWrapSystemdCreds && path != luks.CredentialPath(cfg.LUKS.Credential):
+		// systemd already decrypted credentials loaded by the unit
+		key, err = luks.DecryptCredential(cfg.LUKS.Credential, data)
+	case luks.IsWrappedKey(data):
+		key, err = luks.UnwrapKey(ctx, data, func() ([]byte, error) { return keyfilePassphrase(cfg) }, cfg.LUKS.NVAuth)
+	default:
+		return data, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	buf, err := secrets.FromBytes(key)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// keyfilePassphrase returns the passphrase wrapping the keyfile, from --passphrase-file
+// or the UDM_KEYFILE_PASSPHRASE environment variable.
+func keyfilePassphrase(cfg *config.AppConfig) ([]byte, error) {
+	if cfg.Cmd.PassphraseFile != "" {
+		data, err := os.ReadFile(cfg.Cmd.PassphraseFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read passphrase file: %w", err)
+		}
+		buf, err := secrets.FromBytes(bytes.TrimRight(data, "\r\n"))
+		secrets.Wipe(data)
+		if err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	if env := os.Getenv("UDM_KEYFILE_PASSPHRASE"); env != "" {
+		buf, err := secrets.FromBytes([]byte(env))
+		if err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("keyfile passphrase required, use --passphrase-file or UDM_KEYFILE_PASSPHRASE")
+}
+
+// writeKeyToFile writes the Key field from the LUKS structure to the specified binary
+// file, readable by owner only.
+func writeKeyToFile(keyfile string, password []byte, owner string) error {
 
 	// Validate that the Key field is not empty
 	if len(password) == 0 {
 		return fmt.Errorf("key field in LUKS structure is empty")
 	}
 
-	// Open the file for writing
-	file, err := os.Create(keyfile)
+	if keyfile == config.KeyfileStdio {
+		if _, err := keyOut.Write(password); err != nil {
+			return fmt.Errorf("failed to write key to stdout: %w", err)
+		}
+		return nil
+	}
+
+	// Open the file for writing, /dev/fd/N for --key-fd
+	file, err := os.OpenFile(keyfile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, luks.KeyfileMode)
 	if err != nil {
 		return fmt.Errorf("failed to create file: %w", err)
 	}
 	defer file.Close()
 
+	// An existing file keeps its mode, restrict it before the key is written
+	if info, err := file.Stat(); err == nil && info.Mode().IsRegular() {
+		if err := luks.SecureKeyfile(keyfile, owner); err != nil {
+			return err
+		}
+	}
+
 	// Write the Key field to the file
 	_, err = file.Write(password)
 	if err != nil {
@@ -191,13 +1357,27 @@ func writeKeyToFile(keyfile string, password []byte) error {
 }
 
 // readKeyFromFile reads the contents of a key file and validates it using a password.
-func readKeyFromFile(keyfile string) ([]byte, error) {
-	// Open the key file for reading
-	file, err := os.Open(keyfile)
+// Keyfiles other users can access are refused unless insecure is set.
+func readKeyFromFile(keyfile string, insecure bool) ([]byte, error) {
+	// Open the key file for reading, stdin for --keyfile=-
+	file := os.Stdin
+	if keyfile != config.KeyfileStdio {
+		var err error
+		if file, err = os.Open(keyfile); err != nil {
+			return nil, fmt.Errorf("failed to open key file: %w", err)
+		}
+		defer file.Close()
+	}
+	info, err := file.Stat()
 	if err != nil {
-		return nil, fmt.Errorf("failed to open key file: %w", err)
+		return nil, fmt.Errorf("failed to stat key file: %w", err)
+	}
+	if err := luks.CheckKeyfileMode(info); err != nil {
+		if !insecure {
+			return nil, fmt.Errorf("%w, or pass --insecure-keyfile", err)
+		}
+		fmt.Printf("Warning: %v\n", err)
 	}
-	defer file.Close()
 
 	// Read the entire file content
 	keyData, err := io.ReadAll(file)
@@ -210,33 +1390,54 @@ func readKeyFromFile(keyfile string) ([]byte, error) {
 		return nil, fmt.Errorf("key file is empty")
 	}
 
-	return keyData, nil
+	// Keep the key in locked memory, wiping the copy read from the file
+	buf, err := secrets.FromBytes(keyData)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
 func printLUKSConfig(cfg *config.AppConfig) {
 
-	t := table.NewWriter()
-	t.SetOutputMirror(os.Stdout)
+	t := newTable()
 	t.AppendHeader(table.Row{"Property", "Value"})
 	t.AppendRows([]table.Row{
 		{"Volume Path", cfg.LUKS.VolumePath},
 		{"Mapper Name", cfg.LUKS.MapperName},
 		{"Mount Point", cfg.LUKS.MountPoint},
-		{"Password Length", cfg.LUKS.PasswordLength},
+		{"Key Bytes", cfg.LUKS.KeyBytes},
 		{"Size", cfg.LUKS.Size},
 		{"Use TPM", cfg.LUKS.UseTPM},
 	})
-	t.Render()
+	render(t)
 }
 
 func printBootstrapToken(token *config.BootstrapToken) {
 
-	t := table.NewWriter()
-	t.SetOutputMirror(os.Stdout)
+	t := newTable()
 	t.AppendHeader(table.Row{"Property", "Value"})
 	t.AppendRows([]table.Row{
 		{"Token ID", token.Bootstrap.TokenId},
 		{"Version", token.Bootstrap.Version},
 	})
-	t.Render()
+	if !token.Bootstrap.Expires.IsZero() {
+		t.AppendRow(table.Row{"Expires", token.Bootstrap.Expires.Format(time.RFC3339)})
+	}
+	if token.Bootstrap.DeviceId != "" {
+		t.AppendRow(table.Row{"Device ID", token.Bootstrap.DeviceId})
+	}
+	render(t)
+}
+
+func printVerifyResult(result *luks.VerifyResult) {
+
+	t := newTable()
+	t.AppendHeader(table.Row{"Check", "Healthy", "Detail"})
+	t.AppendRows([]table.Row{
+		{"Header", result.Header.Healthy, result.Header.Detail},
+		{"Key", result.Key.Healthy, result.Key.Detail},
+		{"Filesystem", result.Filesystem.Healthy, result.Filesystem.Detail},
+	})
+	render(t)
 }
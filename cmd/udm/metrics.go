@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bootstrap/internal/config"
+	"bootstrap/internal/holders"
+	"bootstrap/internal/luks"
+	"bootstrap/internal/metrics"
+	"bootstrap/internal/state"
+	"context"
+	"log"
+	"time"
+)
+
+// updateState applies fn to the persistent state of the volume, logging failures since
+// state bookkeeping must not fail the command.
+func updateState(cfg *config.AppConfig, fn func(volume *state.Volume)) {
+	volume, err := state.Load(cfg.LUKS.MapperName)
+	if err != nil {
+		log.Printf("Failed to load volume state: %v", err)
+		return
+	}
+	fn(volume)
+	if err := volume.Save(); err != nil {
+		log.Printf("Failed to save volume state: %v", err)
+	}
+}
+
+// collectMetrics returns the current metrics of the volume.
+func collectMetrics(ctx context.Context, cfg *config.AppConfig) []metrics.Metric {
+	labels := map[string]string{"mapper": cfg.LUKS.MapperName}
+	gauge := func(name, help string, value float64) metrics.Metric {
+		return metrics.Metric{Name: name, Help: help, Type: metrics.Gauge, Labels: labels, Value: value}
+	}
+	boolValue := func(b bool) float64 {
+		if b {
+			return 1
+		}
+		return 0
+	}
+
+	mounted := volumeMounted(cfg)
+	result := []metrics.Metric{
+		gauge("udm_volume_mounted", "Whether the volume is mounted.", boolValue(mounted)),
+		gauge("udm_tpm_available", "Whether a TPM 2.0 device is present.", boolValue(luks.TPMAvailable(ctx))),
+	}
+	if mounted {
+		if used, free, err := filesystemUsage(cfg.LUKS.MountPoint); err == nil {
+			result = append(result,
+				gauge("udm_filesystem_used_ratio", "Fraction of the filesystem in use.", used/100),
+				gauge("udm_filesystem_free_bytes", "Bytes available on the filesystem.", float64(free)),
+				gauge("udm_filesystem_usage_alert", "1 above luks.usage.warn, 2 above luks.usage.critical.", usageAlert(cfg, used)))
+		}
+	}
+	if held, err := holders.Load(cfg.LUKS.MapperName); err == nil {
+		result = append(result, gauge("udm_volume_holders", "Consumers holding the mounted volume.", float64(len(held.Holders))))
+	}
+
+	volume, err := state.Load(cfg.LUKS.MapperName)
+	if err != nil {
+		log.Printf("Failed to load volume state: %v", err)
+		return result
+	}
+	if !volume.LastMounted.IsZero() {
+		result = append(result, gauge("udm_volume_last_mount_timestamp_seconds", "Time of the last successful mount.",
+			float64(volume.LastMounted.Unix())))
+	}
+	if !volume.KeyCreated.IsZero() {
+		result = append(result, gauge("udm_key_age_seconds", "Time since the machine key was generated.",
+			time.Since(volume.KeyCreated).Seconds()))
+	}
+	result = append(result, metrics.Metric{Name: "udm_unlock_failures_total", Help: "Failed unlock attempts.",
+		Type: metrics.Counter, Labels: labels, Value: float64(volume.UnlockFailures)})
+	return result
+}
+
+// usageAlert returns the usage level as a metric value.
+func usageAlert(cfg *config.AppConfig, used float64) float64 {
+	switch cfg.LUKS.Usage.Level(used) {
+	case luks.UsageCritical:
+		return 2
+	case luks.UsageWarn:
+		return 1
+	}
+	return 0
+}
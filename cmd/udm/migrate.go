@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bootstrap/internal/config"
+	"bootstrap/internal/luks"
+	"bootstrap/internal/trace"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// migrateResult is the outcome of migrate.
+type migrateResult struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Files int    `json:"files"`
+	Bytes int64  `json:"bytes"`
+}
+
+// migrate copies the data of one volume to a newly provisioned one, verifies it and
+// deauthorizes the source. Like provision-all, each volume operation runs in its own
+// udm process so it is locked and audited as usual.
+func migrate(ctx context.Context, cmd config.Command) {
+	if cmd.FromConfig == "" || cmd.ToConfig == "" || cmd.Bootstrap == "" {
+		fatalf("Error: --from-config, --to-config and --bootstrap must be specified")
+	}
+	from, err := config.LoadConfig(cmd.FromConfig)
+	if err != nil {
+		fatalf("Failed to load source configuration: %v", err)
+	}
+	to, err := config.LoadConfig(cmd.ToConfig)
+	if err != nil {
+		fatalf("Failed to load target configuration: %v", err)
+	}
+	if from.LUKS.MapperName == to.LUKS.MapperName || from.LUKS.VolumePath == to.LUKS.VolumePath {
+		fatalf("Error: source and target must be different volumes")
+	}
+	if from.LUKS.Ephemeral || to.LUKS.Ephemeral {
+		fatalf("Error: ephemeral volumes cannot be migrated")
+	}
+	if _, err := os.Stat(from.LUKS.VolumePath); err != nil {
+		fatalf("Source volume %s does not exist", from.LUKS.VolumePath)
+	}
+	if _, err := os.Stat(to.LUKS.VolumePath); err == nil {
+		fatalf("Target volume %s already exists, migrate provisions a new one", to.LUKS.VolumePath)
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		fatalf("Failed to locate udm: %v", err)
+	}
+
+	if mounted, _ := luks.IsLUKSMounted(&from.LUKS); !mounted {
+		args := []string{"mount", "--config=" + cmd.FromConfig, "--output=json"}
+		if cmd.FromKeyfile != "" {
+			args = append(args, "--keyfile="+cmd.FromKeyfile)
+		}
+		runStep(executable, args)
+	}
+
+	args := []string{"authorize", "--config=" + cmd.ToConfig, "--bootstrap=" + cmd.Bootstrap, "--output=json"}
+	if cmd.Keyfile != "" {
+		args = append(args, "--keyfile="+cmd.Keyfile)
+	}
+	if cmd.ReuseToken {
+		args = append(args, "--reuse-token")
+	}
+	runStep(executable, args)
+
+	// Nothing may change the source between the copy and its verification
+	source, target := from.LUKS.MountPoint, to.LUKS.MountPoint
+	if err := luks.Remount(ctx, source, "ro"); err != nil {
+		fatalf("Failed to remount source read-only: %v", err)
+	}
+	fmt.Printf("Copying %s to %s\n", source, target)
+	rsync := trace.Command("rsync", "-aHAX", "--numeric-ids", "--delete", "--info=progress2", source+"/", target+"/")
+	rsync.Stdout = os.Stderr
+	rsync.Stderr = os.Stderr
+	if err := rsync.Run(); err != nil {
+		luks.Remount(ctx, source, "rw")
+		fatalf("Failed to copy data, both volumes left in place: %v", err)
+	}
+
+	fmt.Println("Verifying checksums ...")
+	result := migrateResult{From: cmd.FromConfig, To: cmd.ToConfig}
+	files, size, err := compareTrees(source, target)
+	if err != nil {
+		luks.Remount(ctx, source, "rw")
+		fatalf("Verification failed, both volumes left in place: %v", err)
+	}
+	result.Files, result.Bytes = files, size
+
+	runStep(executable, []string{"deauthorize", "--config=" + cmd.FromConfig, "--yes", "--output=json"})
+	printResult(fmt.Sprintf("Migrated %d file(s) from %s to %s", files, from.LUKS.MapperName, to.LUKS.MapperName), result)
+}
+
+// runStep runs a udm command for migrate, exiting if it fails.
+func runStep(executable string, args []string) {
+	fmt.Println("Running udm", args[0], args[1])
+	result, err := runChild(executable, args)
+	if err != nil {
+		fatalf("Failed to run udm %s: %v", args[0], err)
+	}
+	if !result.Success {
+		fatalf("udm %s failed: %s", args[0], result.Error)
+	}
+}
+
+// compareTrees checks that every file, directory and symlink under source exists
+// under target with the same content, returning the number of regular files and
+// their total size.
+func compareTrees(source, target string) (int, int64, error) {
+	var files int
+	var size int64
+	err := filepath.WalkDir(source, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(source, path)
+		if err != nil {
+			return err
+		}
+		other := filepath.Join(target, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		otherInfo, err := os.Lstat(other)
+		if err != nil {
+			return fmt.Errorf("%s missing from target", rel)
+		}
+		if info.Mode().Type() != otherInfo.Mode().Type() {
+			return fmt.Errorf("%s has a different type on the target", rel)
+		}
+
+		switch {
+		case info.Mode().IsRegular():
+			sum, err := fileDigest(path)
+			if err != nil {
+				return err
+			}
+			otherSum, err := fileDigest(other)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(sum, otherSum) {
+				return fmt.Errorf("%s differs on the target", rel)
+			}
+			files++
+			size += info.Size()
+		case info.Mode()&fs.ModeSymlink != 0:
+			link, _ := os.Readlink(path)
+			otherLink, _ := os.Readlink(other)
+			if link != otherLink {
+				return fmt.Errorf("symlink %s differs on the target", rel)
+			}
+		}
+		return nil
+	})
+	return files, size, err
+}
+
+// fileDigest returns the SHA-256 of a file.
+func fileDigest(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return h.Sum(nil), nil
+}
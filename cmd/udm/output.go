@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bootstrap/internal/config"
+	"bootstrap/internal/identity"
+	"bootstrap/internal/secrets"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+)
+
+const (
+	outputTable = "table" // Human readable messages and tables
+	outputJSON  = "json"  // A single JSON document on stdout
+	outputQuiet = "quiet" // Nothing on stdout, the exit code reports the outcome
+)
+
+var (
+	outputMode  = outputTable
+	commandName = ""
+
+	// resultOut is the real stdout; in json and quiet mode os.Stdout is redirected so
+	// informational output from every package stays off the result stream.
+	resultOut = os.Stdout
+
+	// keyOut receives the key written by authorize --keyfile=-
+	keyOut = os.Stdout
+)
+
+// commandResult is the JSON document emitted by every command in json mode.
+type commandResult struct {
+	Command string `json:"command"`
+	Success bool   `json:"success"`
+	Message string `json:"message,omitempty"`
+	Error   string `json:"error,omitempty"`
+	Data    any    `json:"data,omitempty"`
+}
+
+// volumeSummary is the result data of commands that operate on the whole volume.
+type volumeSummary struct {
+	VolumePath string `json:"volumePath"`
+	MapperName string `json:"mapperName"`
+	MountPoint string `json:"mountPoint"`
+	KeyBytes   int    `json:"keyBytes"`
+	UseTPM     bool   `json:"useTPM"`
+	Keyfile    string `json:"keyfile,omitempty"`
+}
+
+// authorizeResult is the result data of authorize.
+type authorizeResult struct {
+	volumeSummary
+	RecoveryPassphrase string           `json:"recoveryPassphrase,omitempty"`
+	Identity           *identity.Result `json:"identity,omitempty"`
+}
+
+func summarize(cfg *config.AppConfig) volumeSummary {
+	return volumeSummary{
+		VolumePath: cfg.LUKS.VolumePath,
+		MapperName: cfg.LUKS.MapperName,
+		MountPoint: cfg.LUKS.MountPoint,
+		KeyBytes:   cfg.LUKS.KeyBytes,
+		UseTPM:     cfg.LUKS.UseTPM,
+		Keyfile:    cfg.Cmd.Keyfile,
+	}
+}
+
+// setOutputMode selects the output mode and redirects informational output away from
+// stdout when the result stream must stay machine-readable.
+func setOutputMode(mode string) error {
+	switch mode {
+	case outputTable:
+	case outputJSON:
+		os.Stdout = os.Stderr
+	case outputQuiet:
+		devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		os.Stdout = devNull
+	default:
+		return fmt.Errorf("--output must be table, json or quiet, got %q", mode)
+	}
+	outputMode = mode
+	return nil
+}
+
+// reserveStdoutForKey moves the result and informational output to stderr, leaving
+// stdout to the key written by authorize --keyfile=-.
+func reserveStdoutForKey() {
+	keyOut = resultOut
+	resultOut = os.Stderr
+	if outputMode != outputQuiet {
+		os.Stdout = os.Stderr
+	}
+}
+
+// newTable returns a table writer for the result stream.
+func newTable() table.Writer {
+	t := table.NewWriter()
+	t.SetOutputMirror(resultOut)
+	return t
+}
+
+// render renders t in table mode only.
+func render(t table.Writer) {
+	if outputMode == outputTable {
+		t.Render()
+	}
+}
+
+// printResult reports a successful command: the message in table mode, or the message
+// and data as a JSON document in json mode.
+func printResult(message string, data any) {
+	finishAudit("")
+	finishTelemetry("")
+	finishWebhooks("")
+	switch outputMode {
+	case outputTable:
+		if message != "" {
+			fmt.Fprintln(resultOut, message)
+		}
+	case outputJSON:
+		writeResult(commandResult{Command: commandName, Success: true, Message: message, Data: data})
+	}
+}
+
+// exitWithResult reports a command that ran but found a failure condition, such as an
+// unhealthy volume, and exits with code.
+func exitWithResult(code int, message string, data any) {
+	finishAudit(message)
+	finishTelemetry(message)
+	finishWebhooks(message)
+	switch outputMode {
+	case outputTable:
+		fmt.Fprintln(resultOut, message)
+	case outputJSON:
+		writeResult(commandResult{Command: commandName, Success: false, Error: message, Data: data})
+	}
+	secrets.DestroyAll()
+	os.Exit(code)
+}
+
+// fatalf reports an error in the selected output mode and exits.
+func fatalf(format string, args ...any) {
+	message := fmt.Sprintf(format, args...)
+	finishAudit(message)
+	finishTelemetry(message)
+	finishWebhooks(message)
+	if outputMode == outputJSON {
+		writeResult(commandResult{Command: commandName, Success: false, Error: message})
+	}
+	// log.Fatal skips deferred calls, wipe the keys first
+	secrets.DestroyAll()
+	log.Fatal(message)
+}
+
+func writeResult(result commandResult) {
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		log.Fatalf("Failed to encode result: %v", err)
+	}
+	fmt.Fprintln(resultOut, string(data))
+}
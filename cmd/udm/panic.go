@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bootstrap/internal/audit"
+	"bootstrap/internal/config"
+	"bootstrap/internal/holders"
+	"bootstrap/internal/luks"
+	"bootstrap/internal/secrets"
+	"context"
+	"log"
+)
+
+// panicVolume destroys the keys of the volume on request of an intrusion detection
+// system. It does not take the volume lock, a command holding it must not delay the wipe.
+func panicVolume(ctx context.Context, cfg *config.AppConfig) {
+	if !cfg.Cmd.Yes {
+		fatalf("Error: panic destroys the data of %s, confirm with --yes", cfg.LUKS.VolumePath)
+	}
+	if err := wipeVolume(ctx, cfg, cfg.Cmd.Discard || cfg.LUKS.Panic.Discard); err != nil {
+		fatalf("Panic incomplete, the volume may still be recoverable: %v", err)
+	}
+	printResult("Keys destroyed, data unrecoverable: "+cfg.LUKS.VolumePath, summarize(cfg))
+}
+
+// wipeVolume erases the keys and detaches the volume, then drops the holders of the
+// gone mount. The keys held in memory by this process are wiped as well.
+func wipeVolume(ctx context.Context, cfg *config.AppConfig, discard bool) error {
+	log.Printf("Panic: destroying the keys of %s", cfg.LUKS.MapperName)
+	err := luks.PanicErase(ctx, &cfg.LUKS, discard)
+	secrets.DestroyAll()
+	if held, loadErr := holders.Load(cfg.LUKS.MapperName); loadErr == nil {
+		held.Holders = nil
+		if saveErr := held.Save(); saveErr != nil {
+			log.Printf("Failed to clear holders: %v", saveErr)
+		}
+	}
+	return err
+}
+
+// panicOnSignal wipes the volume from the daemon on SIGUSR2, when luks.panic.signal
+// allows it.
+func panicOnSignal(ctx context.Context, cfg *config.AppConfig) {
+	if err := wipeVolume(ctx, cfg, cfg.LUKS.Panic.Discard); err != nil {
+		log.Printf("Panic incomplete, the volume may still be recoverable: %v", err)
+		recordAuditEvent(cfg, "panic", audit.OutcomeFailure, "SIGUSR2: "+err.Error())
+		return
+	}
+	recordAuditEvent(cfg, "panic", audit.OutcomeSuccess, "SIGUSR2")
+}
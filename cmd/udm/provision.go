@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bootstrap/internal/config"
+	"bootstrap/internal/luks"
+	"bootstrap/internal/trace"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+)
+
+// provisionResult is the outcome of provisioning one volume with provision-all.
+type provisionResult struct {
+	Config     string `json:"config"`
+	MapperName string `json:"mapperName,omitempty"`
+	Action     string `json:"action,omitempty"` // authorize or mount
+	Success    bool   `json:"success"`
+	Message    string `json:"message,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// provisionAll authorizes every volume of the configs in a directory that does not
+// exist yet and mounts the others, for fleet kickstart scripts. Each volume is handled
+// by its own udm process so one failure does not stop the others. Up to --jobs volumes
+// are provisioned concurrently, each after the volumes it depends on.
+func provisionAll(cmd config.Command) {
+	configs, err := volumeConfigs(cmd.ConfigDir)
+	if err != nil {
+		fatalf("Failed to read config directory: %v", err)
+	}
+	if len(configs) == 0 {
+		fatalf("No volume configs found in %s", cmd.ConfigDir)
+	}
+	if cmd.Jobs < 1 {
+		fatalf("Error: --jobs must be at least 1")
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		fatalf("Failed to locate udm: %v", err)
+	}
+
+	jobs := make([]*volumeJob, len(configs))
+	for i, path := range configs {
+		jobs[i] = &volumeJob{result: provisionResult{Config: path}, done: make(chan struct{})}
+		if jobs[i].cfg, err = config.LoadConfig(path); err != nil {
+			jobs[i].result.Error = err.Error()
+		} else {
+			jobs[i].result.MapperName = jobs[i].cfg.LUKS.MapperName
+		}
+	}
+	checkNVIndices(jobs)
+	resolveDependencies(jobs)
+
+	p := &provisioner{executable: executable, cmd: cmd, reuseToken: cmd.ReuseToken}
+	slots := make(chan struct{}, cmd.Jobs)
+	var wg sync.WaitGroup
+	for _, job := range jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(job.done)
+			if job.result.Error != "" {
+				return
+			}
+			for _, dep := range job.deps {
+				<-dep.done
+				if !dep.result.Success {
+					job.result.Error = fmt.Sprintf("dependency %s failed", dep.result.MapperName)
+					return
+				}
+			}
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			p.provisionVolume(job.cfg, &job.result)
+		}()
+	}
+	wg.Wait()
+
+	results := make([]provisionResult, len(jobs))
+	failed := 0
+	for i, job := range jobs {
+		results[i] = job.result
+		if !job.result.Success {
+			failed++
+		}
+	}
+
+	t := newTable()
+	t.AppendHeader(table.Row{"Config", "Mapper", "Action", "Result"})
+	for _, r := range results {
+		outcome := r.Message
+		if !r.Success {
+			outcome = "FAILED: " + r.Error
+		}
+		t.AppendRow(table.Row{r.Config, r.MapperName, r.Action, outcome})
+	}
+	render(t)
+
+	if failed > 0 {
+		exitWithResult(1, fmt.Sprintf("%d of %d volume(s) failed", failed, len(results)), results)
+	}
+	printResult(fmt.Sprintf("Provisioned %d volume(s)", len(results)), results)
+}
+
+// volumeJob is a volume of provision-all. done is closed once it has been provisioned
+// or has failed.
+type volumeJob struct {
+	cfg    *config.AppConfig
+	deps   []*volumeJob
+	done   chan struct{}
+	result provisionResult
+}
+
+// checkNVIndices fails TPM volumes whose NV index block is taken by another volume of
+// the directory, before any of them is authorized.
+func checkNVIndices(jobs []*volumeJob) {
+	byIndex := map[string]*volumeJob{}
+	for _, job := range jobs {
+		if job.result.Error != "" || !job.cfg.LUKS.UseTPM {
+			continue
+		}
+		index := luks.VolumeNVIndex(job.cfg.LUKS.MapperName)
+		if other, ok := byIndex[index]; ok {
+			job.result.Error = fmt.Sprintf("TPM NV index %s is also used by %s, rename one of the volumes", index, other.result.MapperName)
+			continue
+		}
+		byIndex[index] = job
+	}
+}
+
+// resolveDependencies links every volume to the volumes it must wait for: those named
+// in luks.dependsOn and those whose mount point holds its volumePath. Volumes with an
+// unknown dependency or in a dependency cycle fail.
+func resolveDependencies(jobs []*volumeJob) {
+	byMapper := map[string]*volumeJob{}
+	for _, job := range jobs {
+		if job.cfg != nil {
+			byMapper[job.cfg.LUKS.MapperName] = job
+		}
+	}
+
+	for _, job := range jobs {
+		if job.cfg == nil {
+			continue
+		}
+		for _, name := range job.cfg.LUKS.DependsOn {
+			dep, ok := byMapper[name]
+			if !ok {
+				job.result.Error = fmt.Sprintf("depends on %s, which has no config in the directory", name)
+				break
+			}
+			job.deps = append(job.deps, dep)
+		}
+		for _, other := range jobs {
+			if other != job && other.cfg != nil && !slices.Contains(job.deps, other) &&
+				strings.HasPrefix(job.cfg.LUKS.VolumePath, filepath.Clean(other.cfg.LUKS.MountPoint)+"/") {
+				job.deps = append(job.deps, other)
+			}
+		}
+	}
+
+	// Volumes left after repeatedly removing those without pending dependencies are in
+	// or behind a cycle, and would wait forever
+	pending := map[*volumeJob]int{}
+	dependents := map[*volumeJob][]*volumeJob{}
+	var ready []*volumeJob
+	for _, job := range jobs {
+		pending[job] = len(job.deps)
+		for _, dep := range job.deps {
+			dependents[dep] = append(dependents[dep], job)
+		}
+		if len(job.deps) == 0 {
+			ready = append(ready, job)
+		}
+	}
+	for len(ready) > 0 {
+		job := ready[0]
+		ready = ready[1:]
+		delete(pending, job)
+		for _, dependent := range dependents[job] {
+			if pending[dependent]--; pending[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+	for job := range pending {
+		job.deps = nil
+		if job.result.Error == "" {
+			job.result.Error = "dependency cycle through luks.dependsOn or nested mount points"
+		}
+	}
+}
+
+// volumeConfigs returns the YAML files of dir in lexical order.
+func volumeConfigs(dir string) ([]string, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	var configs []string
+	for _, pattern := range []string{"*.yml", "*.yaml"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, matches...)
+	}
+	sort.Strings(configs)
+	return configs, nil
+}
+
+// provisioner runs the udm processes of provision-all.
+type provisioner struct {
+	executable string
+	cmd        config.Command
+
+	// Volumes are authorized one at a time, they share the bootstrap token and the TPM
+	authorizeMu sync.Mutex
+	reuseToken  bool // Guarded by authorizeMu
+}
+
+// provisionVolume runs udm authorize for a volume that does not exist yet, or udm
+// mount for an existing one, and collects its JSON result.
+func (p *provisioner) provisionVolume(cfg *config.AppConfig, result *provisionResult) {
+	cmd := p.cmd
+	path := result.Config
+	keyfile := filepath.Join(cmd.KeyfileDir, cfg.LUKS.MapperName+".key")
+	args := []string{"--config=" + path, "--keyfile=" + keyfile, "--output=json"}
+	if cmd.PassphraseFile != "" {
+		args = append(args, "--passphrase-file="+cmd.PassphraseFile)
+	}
+	if cmd.Quiet {
+		args = append(args, "--quiet")
+	}
+	if cmd.WaitLock > 0 {
+		args = append(args, "--wait-lock="+cmd.WaitLock.String())
+	}
+	if cmd.TPMDevice != "" {
+		args = append(args, "--tpm-device="+cmd.TPMDevice)
+	}
+
+	if _, err := os.Stat(cfg.LUKS.VolumePath); os.IsNotExist(err) {
+		result.Action = "authorize"
+		if cmd.Bootstrap == "" {
+			result.Error = "volume does not exist and no --bootstrap was given"
+			return
+		}
+		if err := os.MkdirAll(cmd.KeyfileDir, 0700); err != nil {
+			result.Error = fmt.Sprintf("failed to create keyfile directory: %v", err)
+			return
+		}
+		p.authorizeMu.Lock()
+		defer p.authorizeMu.Unlock()
+		args = append([]string{"authorize", "--bootstrap=" + cmd.Bootstrap}, args...)
+		if p.reuseToken {
+			args = append(args, "--reuse-token")
+		}
+	} else {
+		result.Action = "mount"
+		args = append([]string{"mount"}, args...)
+	}
+
+	fmt.Printf("Provisioning %s: udm %s\n", path, result.Action)
+	childResult, err := runChild(p.executable, args)
+	if err != nil {
+		result.Error = err.Error()
+		return
+	}
+	result.Success = childResult.Success
+	result.Message = childResult.Message
+	result.Error = childResult.Error
+	if result.Success && result.Action == "authorize" {
+		// The token is consumed by this run, the remaining volumes may use it too
+		p.reuseToken = true
+	}
+}
+
+// runChild runs udm with args, which must include --output=json, and returns its
+// result. Progress and logs of the child go to stderr.
+func runChild(executable string, args []string) (commandResult, error) {
+	var stdout bytes.Buffer
+	child := trace.Command(executable, args...)
+	child.Stdout = &stdout
+	child.Stderr = os.Stderr
+	runErr := child.Run()
+
+	var result commandResult
+	if err := json.Unmarshal(stdout.Bytes(), &result); err != nil {
+		return result, fmt.Errorf("no result from udm %s: %v", args[0], runErr)
+	}
+	if runErr != nil {
+		result.Success = false
+	}
+	return result, nil
+}
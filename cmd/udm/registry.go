@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bootstrap/internal/config"
+	"bootstrap/internal/lock"
+	"bootstrap/internal/luks"
+	"bootstrap/internal/state"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+)
+
+// registryLock serializes access to the volume registry shared by all volumes. It is
+// kept next to the registry, lock.Dir is per tenant.
+const registryLock = "volume-registry"
+
+// updateRegistry applies fn to the volume registry, logging failures since the registry
+// only informs list and must not fail the command.
+func updateRegistry(cfg *config.AppConfig, fn func(registry *state.Registry)) {
+	l, err := lock.AcquireIn(state.RegistryDir, registryLock, cfg.Cmd.WaitLock)
+	if err != nil {
+		log.Printf("Failed to update volume registry: %v", err)
+		return
+	}
+	defer l.Release()
+
+	registry, err := state.LoadRegistry()
+	if err != nil {
+		log.Printf("Failed to update volume registry: %v", err)
+		return
+	}
+	fn(registry)
+	if err := registry.Save(); err != nil {
+		log.Printf("Failed to update volume registry: %v", err)
+	}
+}
+
+// registerVolume records the current state of the volume in the registry.
+func registerVolume(ctx context.Context, cfg *config.AppConfig) {
+	managed := &state.Managed{
+		MapperName: cfg.LUKS.MapperName,
+		Tenant:     cfg.LUKS.Tenant,
+		Config:     cfg.Cmd.Config,
+		VolumePath: cfg.LUKS.VolumePath,
+		MountPoint: cfg.LUKS.MountPoint,
+		Backend:    volumeBackend(cfg),
+		KeyBackend: strings.Join(keyProtectors(cfg), "+"),
+	}
+	if cfg.LUKS.Ephemeral {
+		managed.KeyBackend = "ephemeral"
+	}
+	if abs, err := filepath.Abs(cfg.Cmd.Config); err == nil {
+		managed.Config = abs
+	}
+	managed.UUID, _ = luks.VolumeUUID(ctx, &cfg.LUKS)
+	if entry, err := luks.CrypttabEntry(&cfg.LUKS); err == nil {
+		managed.Persistent = entry != ""
+	}
+	updateRegistry(cfg, func(registry *state.Registry) { registry.Put(managed, time.Now().UTC()) })
+}
+
+// volumeBackend returns the kind of storage backing the volume.
+func volumeBackend(cfg *config.AppConfig) string {
+	if cfg.LUKS.LVM.Enabled() {
+		return state.BackendLVM
+	}
+	if info, err := os.Stat(cfg.LUKS.VolumePath); err == nil && info.Mode().IsRegular() {
+		return state.BackendImage
+	}
+	return state.BackendDevice
+}
+
+// listedVolume is a registered volume with its live state.
+type listedVolume struct {
+	*state.Managed
+	Open bool `json:"open"`
+}
+
+// listVolumes shows the volumes provisioned on the device, without a configuration,
+// only those of cmd.Tenant if set.
+func listVolumes(cmd config.Command) {
+	registry, err := state.LoadRegistry()
+	if err != nil {
+		fatalf("Failed to load volume registry: %v", err)
+	}
+
+	var volumes []listedVolume
+	t := newTable()
+	t.AppendHeader(table.Row{"Mapper", "Tenant", "Volume", "Backend", "Key", "Persistent", "Open", "Mount Point", "LUKS UUID"})
+	for _, v := range registry.List() {
+		if cmd.Tenant != "" && v.Tenant != cmd.Tenant {
+			continue
+		}
+		_, err := os.Stat("/dev/mapper/" + v.MapperName)
+		listed := listedVolume{Managed: v, Open: err == nil}
+		volumes = append(volumes, listed)
+		t.AppendRow(table.Row{v.MapperName, orNone(v.Tenant), v.VolumePath, v.Backend, v.KeyBackend, v.Persistent, listed.Open, v.MountPoint, orNone(v.UUID)})
+	}
+	render(t)
+	printResult(fmt.Sprintf("%d managed volume(s)", len(volumes)), volumes)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bootstrap/internal/audit"
+	"bootstrap/internal/config"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// reloadSettle is how long the daemon waits after a configuration change before
+// reloading, so an editor writing the file in several steps triggers a single reload.
+const reloadSettle = 500 * time.Millisecond
+
+// settingChange compares a setting of the running and the reloaded configuration.
+type settingChange struct {
+	key     string
+	running any
+	next    any
+}
+
+// reprovisionSettings are fixed when the volume is authorized, changing them requires
+// deauthorizing and authorizing the volume again.
+func reprovisionSettings(running, next *config.AppConfig) []settingChange {
+	r, n := &running.LUKS, &next.LUKS
+	return []settingChange{
+		{"luks.volumePath", r.VolumePath, n.VolumePath},
+		{"luks.mapperName", r.MapperName, n.MapperName},
+		{"luks.size", r.Size, n.Size},
+		{"luks.keyBytes", r.KeyBytes, n.KeyBytes},
+		{"luks.useTPM", r.UseTPM, n.UseTPM},
+		{"luks.split", r.Split, n.Split},
+		{"luks.ephemeral", r.Ephemeral, n.Ephemeral},
+		{"luks.profile", r.Profile, n.Profile},
+		{"luks.cipher", r.Cipher, n.Cipher},
+		{"luks.keySize", r.KeySize, n.KeySize},
+		{"luks.integrity", r.Integrity, n.Integrity},
+		{"luks.nvAuth", r.NVAuth, n.NVAuth},
+		{"luks.lvm", r.LVM, n.LVM},
+		{"luks.tenant", r.Tenant, n.Tenant},
+	}
+}
+
+// restartSettings are read when the daemon starts, changes are kept for the next start.
+func restartSettings(running, next *config.AppConfig) []settingChange {
+	return []settingChange{
+		{"luks.mountPoint", running.LUKS.MountPoint, next.LUKS.MountPoint},
+		{"luks.autoLock", running.LUKS.AutoLock, next.LUKS.AutoLock},
+		{"luks.envFile", running.LUKS.EnvFile, next.LUKS.EnvFile},
+		{"luks.usbKey.lockOnRemoval", running.LUKS.USBKey.LockOnRemoval, next.LUKS.USBKey.LockOnRemoval},
+		{"luks.panic.signal", running.LUKS.Panic.Signal, next.LUKS.Panic.Signal},
+		{"schedule", running.Schedule, next.Schedule},
+		{"audit", running.Audit, next.Audit},
+		{"metrics", running.Metrics, next.Metrics},
+		{"dbus", running.DBus, next.DBus},
+		{"webhooks", running.Webhooks, next.Webhooks},
+	}
+}
+
+// changedKeys returns the keys of the settings that differ.
+func changedKeys(settings []settingChange) []string {
+	var keys []string
+	for _, s := range settings {
+		if !reflect.DeepEqual(s.running, s.next) {
+			keys = append(keys, s.key)
+		}
+	}
+	return keys
+}
+
+// reloadConfig loads the configuration files again and applies the changes that are
+// safe while the volume is in use, such as mount options, hooks, logging and usage
+// thresholds. A change of a setting fixed at authorize refuses the whole reload, and
+// settings read at daemon start keep their running value until the next start. cfg is
+// left unchanged, goroutines may still read it; the caller switches to the returned one.
+func reloadConfig(cfg *config.AppConfig) (*config.AppConfig, error) {
+	next, err := config.LoadConfigFiles(cfg.Cmd.ConfigFiles)
+	if err != nil {
+		recordAuditEvent(cfg, "reload", audit.OutcomeFailure, err.Error())
+		return nil, err
+	}
+	next.Cmd = cfg.Cmd
+
+	if refused := changedKeys(reprovisionSettings(cfg, next)); len(refused) > 0 {
+		detail := fmt.Sprintf("changing %s requires deauthorizing and authorizing the volume again", strings.Join(refused, ", "))
+		recordAuditEvent(cfg, "reload", audit.OutcomeFailure, detail)
+		return nil, fmt.Errorf("configuration not reloaded: %s", detail)
+	}
+	if deferred := changedKeys(restartSettings(cfg, next)); len(deferred) > 0 {
+		log.Printf("Warning: changes of %s take effect when the daemon restarts", strings.Join(deferred, ", "))
+		next.LUKS.MountPoint = cfg.LUKS.MountPoint
+		next.LUKS.AutoLock = cfg.LUKS.AutoLock
+		next.LUKS.EnvFile = cfg.LUKS.EnvFile
+		next.LUKS.Panic.Signal = cfg.LUKS.Panic.Signal
+		next.Schedule = cfg.Schedule
+		next.Audit = cfg.Audit
+		next.Metrics = cfg.Metrics
+		next.DBus = cfg.DBus
+	}
+
+	// State of the running daemon rather than configuration
+	next.LUKS.Password = cfg.LUKS.Password
+	next.LUKS.KillUsers = cfg.LUKS.KillUsers
+	next.LUKS.NVIndex = cfg.LUKS.NVIndex
+	if err := applyConfig(next); err != nil {
+		applyConfig(cfg)
+		recordAuditEvent(cfg, "reload", audit.OutcomeFailure, err.Error())
+		return nil, err
+	}
+	log.Printf("Configuration reloaded from %s", strings.Join(next.Cmd.ConfigFiles, ", "))
+	recordAuditEvent(next, "reload", audit.OutcomeSuccess, "")
+	return next, nil
+}
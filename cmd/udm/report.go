@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bootstrap/internal/config"
+	"bootstrap/internal/identity"
+	"bootstrap/internal/luks"
+	"bootstrap/internal/report"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// publishReport signs the provisioning report of the authorized volume and delivers it
+// to the configured path and endpoint.
+func publishReport(ctx context.Context, cfg *config.AppConfig, token *config.BootstrapToken, issued *identity.Result) error {
+	uuid, err := luks.VolumeUUID(ctx, &cfg.LUKS)
+	if err != nil {
+		return err
+	}
+	digest, _, err := luks.HeaderFingerprint(ctx, &cfg.LUKS)
+	if err != nil {
+		return err
+	}
+
+	r := &report.Report{
+		TokenID:      token.Bootstrap.TokenId,
+		VolumePath:   cfg.LUKS.VolumePath,
+		MapperName:   cfg.LUKS.MapperName,
+		VolumeUUID:   uuid,
+		HeaderDigest: digest,
+		KeyBackend:   keyBackend(cfg),
+		Cipher:       cfg.LUKS.Cipher,
+		Provisioned:  time.Now().UTC(),
+	}
+	r.Host.Hostname, _ = os.Hostname()
+	r.Host.MachineID = machineID()
+	if issued != nil {
+		r.Host.DeviceCertificate = issued.Subject
+	}
+
+	signed, err := report.Sign(r, cfg.Report.SigningKey)
+	if err != nil {
+		return err
+	}
+	if err := report.Publish(cfg.Report, signed); err != nil {
+		return err
+	}
+	fmt.Println("Provisioning report published")
+	return nil
+}
+
+// keyBackend names where the volume key is kept.
+func keyBackend(cfg *config.AppConfig) string {
+	switch {
+	case cfg.LUKS.Ephemeral:
+		return "ephemeral"
+	case cfg.LUKS.Split.Enabled():
+		return "split"
+	case cfg.LUKS.UseTPM:
+		return "tpm"
+	case cfg.LUKS.Vault.Wrapped():
+		return "vault-transit"
+	case cfg.LUKS.Vault.Enabled():
+		return "vault-kv"
+	case cfg.LUKS.FIDO2.Enabled && cfg.Cmd.Keyfile == "":
+		return "fido2"
+	case cfg.LUKS.KeyfileWrap != luks.KeyfileWrapNone:
+		return "keyfile+" + cfg.LUKS.KeyfileWrap
+	}
+	return "keyfile"
+}
+
+// machineID returns the systemd machine id of the host, "" when unknown.
+func machineID() string {
+	id, err := os.ReadFile("/etc/machine-id")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(id))
+}
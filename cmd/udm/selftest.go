@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bootstrap/internal/config"
+	"bootstrap/internal/lock"
+	"bootstrap/internal/luks"
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+)
+
+// selfTest runs the volume lifecycle on a throwaway volume and reports each stage, so
+// installers can validate the host before provisioning real volumes. It exits 1 when a
+// stage failed.
+func selfTest(ctx context.Context, cmd config.Command) {
+	if cmd.TPMDevice != "" {
+		luks.SetTPM(luks.TPM{Device: cmd.TPMDevice})
+	}
+	l, err := lock.Acquire(luks.SelfTestMapperName, cmd.WaitLock)
+	if err != nil {
+		fatalf("Failed to acquire self-test lock: %v", err)
+	}
+	defer l.Release()
+
+	dir, err := os.MkdirTemp("", "udm-selftest-*")
+	if err != nil {
+		fatalf("Failed to create self-test directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	results := luks.SelfTest(ctx, dir, cmd.UseTPM)
+
+	t := newTable()
+	t.AppendHeader(table.Row{"Stage", "Result", "Duration", "Detail"})
+	failed := 0
+	for _, r := range results {
+		duration := "-"
+		if r.Status != luks.StageSkipped {
+			duration = r.Duration.Round(time.Millisecond).String()
+		}
+		t.AppendRow(table.Row{r.Stage, r.Status, duration, r.Detail})
+		if r.Status == luks.StageFailed {
+			failed++
+		}
+	}
+	render(t)
+	if failed > 0 {
+		os.RemoveAll(dir) // Skipped by the exit
+		exitWithResult(1, "Self-test failed, the host is not ready for provisioning", results)
+	}
+	printResult(fmt.Sprintf("Self-test passed, %d stages", len(results)), results)
+}
@@ -0,0 +1,33 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// filesystemUsage returns the used percentage and free bytes of the mounted filesystem.
+func filesystemUsage(mountPoint string) (float64, uint64, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(mountPoint, &fs); err != nil {
+		return 0, 0, fmt.Errorf("failed to stat filesystem: %w", err)
+	}
+	total := fs.Blocks * uint64(fs.Bsize)
+	free := fs.Bavail * uint64(fs.Bsize)
+	used := 0.0
+	if total > 0 {
+		used = 100 * float64(total-free) / float64(total)
+	}
+	return used, free, nil
+}
+
+// fileOwner returns the user id owning the file.
+func fileOwner(info os.FileInfo) (uint32, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return st.Uid, true
+}
@@ -0,0 +1,16 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"bootstrap/internal/platform"
+	"os"
+)
+
+func filesystemUsage(mountPoint string) (float64, uint64, error) {
+	return 0, 0, platform.ErrUnsupportedPlatform
+}
+
+func fileOwner(info os.FileInfo) (uint32, bool) {
+	return 0, false
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bootstrap/internal/config"
+	"bootstrap/internal/features"
+	"bootstrap/internal/holders"
+	"bootstrap/internal/luks"
+	"bootstrap/internal/state"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+)
+
+// statusResult is the result data of status.
+type statusResult struct {
+	volumeSummary
+	Tenant          string           `json:"tenant,omitempty"`
+	Profile         string           `json:"profile"`
+	Exists          bool             `json:"exists"`
+	UUID            string           `json:"uuid,omitempty"` // LUKS UUID, as referenced by crypttab
+	Open            bool             `json:"open"`
+	LoopDevice      string           `json:"loopDevice,omitempty"` // Loop device of image files
+	Mounted         bool             `json:"mounted"`
+	Usage           *usageStatus     `json:"usage,omitempty"` // Filesystem usage while mounted
+	Holders         []string         `json:"holders"`
+	PersistentMount string           `json:"persistentMount,omitempty"` // crypttab entry
+	HeaderRecorded  *time.Time       `json:"headerRecorded,omitempty"`
+	FailedUnlocks   int              `json:"failedUnlocks"` // Consecutive failed unlocks
+	LockedOut       bool             `json:"lockedOut"`     // Refused by luks.lockout until reset
+	CryptBackend    string           `json:"cryptBackend"`  // cli or libcryptsetup, selected at build time
+	FeatureVersion  int              `json:"featureVersion"`
+	Features        []features.State `json:"features"`
+}
+
+// usageStatus is the filesystem usage of a mounted volume.
+type usageStatus struct {
+	UsedPercent float64 `json:"usedPercent"`
+	FreeBytes   uint64  `json:"freeBytes"`
+	Level       string  `json:"level"` // ok, warn or critical against luks.usage
+}
+
+// status reports the state of the volume and the effective feature flags, without
+// unlocking anything.
+func status(ctx context.Context, cfg *config.AppConfig) {
+	if cfg.Cmd.Tenant != "" && cfg.Cmd.Tenant != cfg.LUKS.Tenant {
+		fatalf("Volume %s does not belong to tenant %s", cfg.LUKS.MapperName, cfg.Cmd.Tenant)
+	}
+	result := statusResult{
+		volumeSummary:  summarize(cfg),
+		FeatureVersion: features.Version,
+		Features:       cfg.Features.Effective(),
+		CryptBackend:   luks.CryptBackend(),
+		Tenant:         cfg.LUKS.Tenant,
+		Profile:        cfg.LUKS.Profile,
+	}
+
+	if _, err := os.Stat(cfg.LUKS.VolumePath); err == nil {
+		result.Exists = true
+		if uuid, err := luks.VolumeUUID(ctx, &cfg.LUKS); err == nil {
+			result.UUID = uuid
+		}
+	}
+	if _, err := os.Stat("/dev/mapper/" + cfg.LUKS.MapperName); err == nil {
+		result.Open = true
+		result.Mounted = volumeMounted(cfg)
+	}
+	if result.Mounted {
+		if used, free, err := filesystemUsage(cfg.LUKS.MountPoint); err == nil {
+			result.Usage = &usageStatus{UsedPercent: used, FreeBytes: free, Level: cfg.LUKS.Usage.Level(used)}
+		}
+	}
+	if devices, err := luks.LoopDevices(cfg.LUKS.VolumePath); err == nil {
+		result.LoopDevice = strings.Join(devices, ", ")
+	}
+	if held, err := holders.Load(cfg.LUKS.MapperName); err == nil {
+		result.Holders = held.IDs()
+	}
+	if entry, err := luks.CrypttabEntry(&cfg.LUKS); err == nil {
+		result.PersistentMount = entry
+	}
+	if volume, err := state.Load(cfg.LUKS.MapperName); err == nil {
+		if !volume.HeaderRecorded.IsZero() {
+			result.HeaderRecorded = &volume.HeaderRecorded
+		}
+		result.FailedUnlocks = volume.FailedUnlocks
+		result.LockedOut = errors.Is(cfg.LUKS.Lockout.CheckLockout(volume.FailedUnlocks, volume.LastUnlockFailure, time.Now()), luks.ErrLockedOut)
+	}
+
+	t := newTable()
+	t.AppendRows([]table.Row{
+		{"Volume", cfg.LUKS.VolumePath},
+		{"Tenant", orNone(result.Tenant)},
+		{"Profile", result.Profile},
+		{"Exists", result.Exists},
+		{"LUKS UUID", orNone(result.UUID)},
+		{"Open", result.Open},
+		{"Loop Device", orNone(result.LoopDevice)},
+		{"Mounted", result.Mounted},
+		{"Mount Point", cfg.LUKS.MountPoint},
+		{"Holders", orNone(strings.Join(result.Holders, ", "))},
+		{"Persistent Mount", orNone(result.PersistentMount)},
+		{"Crypt Backend", result.CryptBackend},
+	})
+	if result.Usage != nil {
+		t.AppendRow(table.Row{"Usage", fmt.Sprintf("%.1f%% used, %d MiB free (%s)", result.Usage.UsedPercent, result.Usage.FreeBytes>>20, result.Usage.Level)})
+	}
+	if result.HeaderRecorded != nil {
+		t.AppendRow(table.Row{"Header Recorded", result.HeaderRecorded.Format(time.RFC3339)})
+	}
+	if result.FailedUnlocks > 0 {
+		failed := fmt.Sprint(result.FailedUnlocks)
+		if result.LockedOut {
+			failed += " (locked out, run udm reset-lockout)"
+		}
+		t.AppendRow(table.Row{"Failed Unlocks", failed})
+	}
+	render(t)
+
+	ft := newTable()
+	ft.AppendHeader(table.Row{"Feature", "Enabled", "Source", "Since"})
+	for _, f := range result.Features {
+		enabled := fmt.Sprint(f.Enabled)
+		if !f.Available {
+			enabled += " (unavailable)"
+		}
+		ft.AppendRow(table.Row{f.Name, enabled, f.Source, f.Since})
+	}
+	ft.AppendFooter(table.Row{"Feature Set Version", features.Version})
+	render(ft)
+
+	printResult("", result)
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package main
+
+import "os"
+
+// tamperSignals is empty where SIGUSR2 does not exist, run udm panic instead.
+var tamperSignals []os.Signal
@@ -0,0 +1,11 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// tamperSignals wipe the volume in the daemon when luks.panic.signal is set.
+var tamperSignals = []os.Signal{syscall.SIGUSR2}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bootstrap/internal/config"
+	"bootstrap/internal/luks"
+	"bootstrap/internal/telemetry"
+	"bootstrap/internal/trace"
+	"errors"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// tracedCommands are the provisioning flows exported as spans when telemetry is enabled.
+var tracedCommands = map[string]bool{
+	"authorize": true,
+	"mount":     true,
+	"unmount":   true,
+}
+
+var (
+	tracer      *telemetry.Tracer
+	commandSpan *telemetry.Span // Root span of the running command
+)
+
+// startTelemetry starts the root span of a traced command. Each external command it runs
+// becomes a child span of the innermost phase, each progress step a phase.
+func startTelemetry(cfg *config.AppConfig) {
+	if !cfg.Telemetry.Enabled() || !tracedCommands[cfg.Cmd.CommandName] {
+		return
+	}
+	hostname, _ := os.Hostname()
+	tracer = telemetry.New(cfg.Telemetry,
+		telemetry.String("host.name", hostname),
+		telemetry.String("host.id", machineID()))
+	commandSpan = tracer.Start("udm "+cfg.Cmd.CommandName,
+		telemetry.String("udm.mapper", cfg.LUKS.MapperName),
+		telemetry.String("udm.volume", cfg.LUKS.VolumePath),
+		telemetry.String("udm.tenant", cfg.LUKS.Tenant))
+
+	trace.SetObserver(func(args []string, start, end time.Time, err error) {
+		exitCode := 0
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			exitCode = exitErr.ExitCode()
+		}
+		tracer.Record(filepath.Base(args[0]), start, end, err,
+			telemetry.String("process.command_line", trace.FormatArgs(args)),
+			telemetry.Int("process.exit_code", exitCode))
+	})
+	luks.SetStepHook(func(step string) func(err error) {
+		return tracer.Start(step).End
+	})
+}
+
+// phase traces a phase of the running command that is not a progress step, the
+// returned function ends it.
+func phase(name string) func(err error) {
+	if tracer == nil {
+		return func(error) {}
+	}
+	return tracer.Start(name).End
+}
+
+// finishTelemetry ends the spans of the command, an empty failure meaning success, and
+// exports them. A collector that cannot be reached is only logged.
+func finishTelemetry(failure string) {
+	if commandSpan == nil {
+		return
+	}
+	var err error
+	if failure != "" {
+		err = errors.New(failure)
+	}
+	tracer.EndAll(err)
+	commandSpan = nil
+	trace.SetObserver(nil)
+	luks.SetStepHook(nil)
+	if err := tracer.Flush(); err != nil {
+		log.Printf("Failed to export telemetry: %v", err)
+	}
+}
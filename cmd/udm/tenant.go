@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bootstrap/internal/config"
+	"bootstrap/internal/lock"
+	"bootstrap/internal/luks"
+	"bootstrap/internal/state"
+	"bootstrap/internal/tenant"
+	"context"
+	"path/filepath"
+)
+
+// scopeTenant enforces the tenant policy for the volume and isolates the state and lock
+// directories of tenant volumes.
+func scopeTenant(cfg *config.AppConfig) {
+	policies, err := tenant.Load()
+	if err != nil {
+		fatalf("Failed to load tenant policy: %v", err)
+	}
+	operator, err := tenant.Operator()
+	if err != nil {
+		fatalf("Failed to identify operator: %v", err)
+	}
+	if err := policies.Check(cfg.LUKS.Tenant, cfg.LUKS.VolumePath, keyProtectors(cfg), operator); err != nil {
+		fatalf("Tenant policy violation: %v", err)
+	}
+
+	if cfg.LUKS.Tenant != "" {
+		state.Dir = filepath.Join(state.DefaultDir, "tenants", cfg.LUKS.Tenant)
+		lock.Dir = filepath.Join(lock.DefaultDir, "tenants", cfg.LUKS.Tenant)
+	}
+}
+
+// keyProtectors returns the key protectors the volume is configured with.
+func keyProtectors(cfg *config.AppConfig) []string {
+	var protectors []string
+	switch {
+	case cfg.LUKS.Split.Enabled():
+		protectors = append(protectors, tenant.ProtectorSplit)
+	case cfg.LUKS.UseTPM:
+		protectors = append(protectors, tenant.ProtectorTPM)
+	case cfg.LUKS.Vault.Enabled():
+		protectors = append(protectors, tenant.ProtectorVault)
+	default:
+		protectors = append(protectors, tenant.ProtectorKeyfile)
+	}
+	if cfg.LUKS.FIDO2.Enabled {
+		protectors = append(protectors, tenant.ProtectorFIDO2)
+	}
+	if cfg.LUKS.Recovery.Enabled {
+		protectors = append(protectors, tenant.ProtectorRecovery)
+	}
+	return protectors
+}
+
+// assignNVIndex selects the NV index holding the key of a TPM volume. authorize gives
+// a new volume a block of its own and records it before any key is stored, later
+// commands read it back. Volumes without a recorded index were authorized when all
+// volumes shared the index of their configuration and keep it, authorizing one again
+// fails until it is deauthorized.
+func assignNVIndex(ctx context.Context, cfg *config.AppConfig) {
+	if !cfg.LUKS.UseTPM {
+		return
+	}
+	volume, err := state.Load(cfg.LUKS.MapperName)
+	if err != nil {
+		fatalf("Failed to load volume state: %v", err)
+	}
+	if cfg.Cmd.CommandName == "authorize" {
+		if _, err := luks.VolumeUUID(ctx, &cfg.LUKS); err != nil {
+			volume.NVIndex = luks.VolumeNVIndex(cfg.LUKS.MapperName)
+			if err := volume.Save(); err != nil {
+				fatalf("Failed to record NV index: %v", err)
+			}
+		}
+	}
+	if volume.NVIndex != "" {
+		cfg.LUKS.NVIndex = volume.NVIndex
+	}
+}
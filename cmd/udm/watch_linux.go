@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// watchFiles signals changed whenever one of the files is written, replaced, created or
+// removed. The directories are watched, since editors and configuration management
+// usually replace a file by renaming a new one over it.
+func watchFiles(paths []string, changed chan<- struct{}) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("inotify: %w", err)
+	}
+
+	watched := map[int32]map[string]bool{}
+	for _, path := range paths {
+		dir, name := filepath.Split(filepath.Clean(path))
+		if dir == "" {
+			dir = "."
+		}
+		const mask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM
+		wd, err := syscall.InotifyAddWatch(fd, dir, mask)
+		if err != nil {
+			syscall.Close(fd)
+			return fmt.Errorf("failed to watch %s: %w", dir, err)
+		}
+		if watched[int32(wd)] == nil {
+			watched[int32(wd)] = map[string]bool{}
+		}
+		watched[int32(wd)][name] = true
+	}
+
+	go func() {
+		defer syscall.Close(fd)
+		buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for {
+			n, err := syscall.Read(fd, buf)
+			if err != nil || n <= 0 {
+				return
+			}
+			for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+				event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+				nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+				offset += syscall.SizeofInotifyEvent + int(event.Len)
+
+				name := string(nameBytes)
+				for i, c := range nameBytes {
+					if c == 0 {
+						name = string(nameBytes[:i])
+						break
+					}
+				}
+				if watched[event.Wd][name] {
+					select {
+					case changed <- struct{}{}:
+					default:
+					}
+				}
+			}
+		}
+	}()
+	return nil
+}
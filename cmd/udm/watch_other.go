@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "bootstrap/internal/platform"
+
+func watchFiles(paths []string, changed chan<- struct{}) error {
+	return platform.ErrUnsupportedPlatform
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bootstrap/internal/audit"
+	"bootstrap/internal/config"
+	"bootstrap/internal/state"
+	"bootstrap/internal/webhook"
+	"log"
+	"path/filepath"
+	"time"
+)
+
+// webhookEvents maps the commands notified to webhooks to their event.
+var webhookEvents = map[string]string{
+	"authorize":  webhook.EventAuthorize,
+	"mount":      webhook.EventMount,
+	"unmount":    webhook.EventUnmount,
+	"add-key":    webhook.EventKeyRotation,
+	"remove-key": webhook.EventKeyRotation,
+	"reencrypt":  webhook.EventKeyRotation,
+	"recover":    webhook.EventKeyRotation,
+	"panic":      webhook.EventPanic,
+}
+
+// outboxFlushInterval is how often the daemon retries undelivered events.
+const outboxFlushInterval = time.Minute
+
+var (
+	notifier     *webhook.Notifier
+	webhookEvent *webhook.Event           // Event of the running command, sent once when it finishes
+	outboxQueued = make(chan struct{}, 1) // Wakes flushOutbox for events the daemon queued
+)
+
+// startWebhooks starts the event of a notified command when webhooks are configured.
+func startWebhooks(cfg *config.AppConfig) {
+	if len(cfg.Webhooks) == 0 {
+		return
+	}
+	notifier = webhook.New(cfg.Webhooks, filepath.Join(state.Dir, "outbox"))
+	if event, ok := webhookEvents[cfg.Cmd.CommandName]; ok {
+		webhookEvent = webhook.NewEvent(event, cfg.LUKS.VolumePath, cfg.LUKS.MapperName)
+		webhookEvent.Tenant = cfg.LUKS.Tenant
+	}
+}
+
+// finishWebhooks sends the outcome of the running command, an empty failure meaning
+// success. An unreachable endpoint is only logged, the event stays in the outbox until
+// the daemon flushes it.
+func finishWebhooks(failure string) {
+	if webhookEvent == nil {
+		return
+	}
+	e := webhookEvent
+	webhookEvent = nil
+	if failure != "" {
+		e.Outcome = webhook.OutcomeFailure
+		e.Error = failure
+	}
+	if err := notifier.Notify(e); err != nil {
+		log.Printf("Failed to notify webhooks, queued for retry: %v", err)
+	}
+}
+
+// notifyDaemonEvent queues an unmount or panic the daemon performed on its own and wakes
+// flushOutbox to send it, the daemon loop never waits on an endpoint.
+func notifyDaemonEvent(cfg *config.AppConfig, command, outcome, detail string) {
+	event, ok := webhookEvents[command]
+	if notifier == nil || !ok {
+		return
+	}
+	e := webhook.NewEvent(event, cfg.LUKS.VolumePath, cfg.LUKS.MapperName)
+	e.Tenant = cfg.LUKS.Tenant
+	e.Detail = detail
+	if outcome == audit.OutcomeFailure {
+		e.Outcome = webhook.OutcomeFailure
+	}
+	if err := notifier.Queue(e); err != nil {
+		log.Printf("Failed to notify webhooks: %v", err)
+		return
+	}
+	select {
+	case outboxQueued <- struct{}{}:
+	default: // A flush is already pending
+	}
+}
+
+// flushOutbox sends queued events until done is closed. It is the only sender of the
+// outbox, commands just add to it.
+func flushOutbox(done <-chan struct{}) {
+	ticker := time.NewTicker(outboxFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-outboxQueued:
+		case <-done:
+			return
+		}
+		if pending, err := notifier.Flush(); err != nil {
+			log.Printf("Failed to flush webhook outbox: %v", err)
+		} else if pending > 0 {
+			log.Printf("%d webhook events still undelivered", pending)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bootstrap/internal/config"
+	"bootstrap/internal/luks"
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// wizardConfig is the configuration written by init, rendered with the answers.
+const wizardConfig = `# Written by udm init, see scripts/config.yml for all options
+luks:
+  volumePath: %q
+  mapperName: %q
+  mountPoint: %q
+  keyBytes: 32
+  size: %d
+  useTPM: %t
+  user: %q
+  group: %q
+%s`
+
+// wizard asks questions on a terminal, offering a default for each.
+type wizard struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+// ask repeats question until check accepts the answer, an empty answer selects def.
+func (w *wizard) ask(question, def string, check func(string) error) string {
+	for {
+		fmt.Fprintf(w.out, "%s [%s]: ", question, def)
+		line, err := w.in.ReadString('\n')
+		if err != nil && line == "" {
+			fatalf("No answer to %q: %v", question, err)
+		}
+		answer := strings.TrimSpace(line)
+		if answer == "" {
+			answer = def
+		}
+		if check == nil {
+			return answer
+		}
+		if err := check(answer); err != nil {
+			fmt.Fprintln(w.out, "  ", err)
+			continue
+		}
+		return answer
+	}
+}
+
+// oneOf accepts one of choices.
+func oneOf(choices ...string) func(string) error {
+	return func(answer string) error {
+		for _, c := range choices {
+			if answer == c {
+				return nil
+			}
+		}
+		return fmt.Errorf("answer one of: %s", strings.Join(choices, ", "))
+	}
+}
+
+func absolutePath(answer string) error {
+	if !filepath.IsAbs(answer) {
+		return fmt.Errorf("enter an absolute path")
+	}
+	return nil
+}
+
+// initConfig asks for the backing storage, size, key storage, mount point and owner of
+// the volume and writes a configuration that passes validation, for technicians who
+// do not edit YAML.
+func initConfig(ctx context.Context, cmd config.Command) {
+	w := &wizard{in: bufio.NewReader(os.Stdin), out: os.Stdout}
+
+	if _, err := os.Stat(cmd.Config); err == nil {
+		if w.ask(cmd.Config+" exists, overwrite it?", "no", oneOf("yes", "no")) != "yes" {
+			exitWithResult(1, "configuration left unchanged: "+cmd.Config, nil)
+		}
+	}
+
+	mapper := w.ask("Volume name", "udm-luks", func(answer string) error {
+		if !luks.ValidLVMName(answer) {
+			return fmt.Errorf("use letters, digits, '-' and '_'")
+		}
+		return nil
+	})
+
+	var volumePath, lvm string
+	if w.ask("Back the volume with an image file or an LVM logical volume?", "image", oneOf("image", "lvm")) == "lvm" {
+		group := w.ask("Volume group", "vg0", func(answer string) error {
+			if !luks.ValidLVMName(answer) {
+				return fmt.Errorf("not a valid volume group name")
+			}
+			return nil
+		})
+		lvm = fmt.Sprintf("  lvm:\n    volumeGroup: %q\n    name: %q\n", group, mapper)
+		volumePath = luks.LVM{VolumeGroup: group, Name: mapper}.DevicePath()
+	} else {
+		volumePath = w.ask("Image file", "/var/luks/"+mapper+".img", absolutePath)
+	}
+
+	size, _ := strconv.Atoi(w.ask("Size in MB", "32", func(answer string) error {
+		if n, err := strconv.Atoi(answer); err != nil || n <= 0 {
+			return fmt.Errorf("enter a positive number of megabytes")
+		}
+		return nil
+	}))
+
+	keyStorage := "keyfile"
+	if luks.TPMAvailable(ctx) {
+		keyStorage = "tpm"
+	}
+	useTPM := w.ask("Store the key in the TPM or a keyfile?", keyStorage, oneOf("tpm", "keyfile")) == "tpm"
+
+	mountPoint := w.ask("Mount point", "/mnt/"+mapper, absolutePath)
+	owner := w.ask("Owner of the mounted filesystem", "root", func(answer string) error {
+		if _, err := user.Lookup(answer); err != nil {
+			return fmt.Errorf("no such user")
+		}
+		return nil
+	})
+	group := w.ask("Group of the mounted filesystem", owner, func(answer string) error {
+		if _, err := user.LookupGroup(answer); err != nil {
+			return fmt.Errorf("no such group")
+		}
+		return nil
+	})
+
+	content := fmt.Sprintf(wizardConfig, volumePath, mapper, mountPoint, size, useTPM, owner, group, lvm)
+
+	// Validate before replacing the configuration
+	if err := os.MkdirAll(filepath.Dir(cmd.Config), 0755); err != nil {
+		fatalf("Failed to create %s: %v", filepath.Dir(cmd.Config), err)
+	}
+	tmp := cmd.Config + ".tmp"
+	if err := os.WriteFile(tmp, []byte(content), 0644); err != nil {
+		fatalf("Failed to write configuration: %v", err)
+	}
+	if _, err := config.LoadConfig(tmp); err != nil {
+		os.Remove(tmp)
+		fatalf("Generated configuration is invalid: %v", err)
+	}
+	if err := os.Rename(tmp, cmd.Config); err != nil {
+		os.Remove(tmp)
+		fatalf("Failed to write configuration: %v", err)
+	}
+
+	next := "udm authorize --config=" + cmd.Config + " --bootstrap=bootstrap.yml"
+	if !useTPM {
+		next += " --keyfile=/etc/udm/keys/" + mapper + ".key"
+	}
+	printResult("Configuration written: "+cmd.Config+"\nNext: "+next, nil)
+}
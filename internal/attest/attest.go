@@ -0,0 +1,209 @@
+// Package attest proves the boot state of the device to a remote attestation service
+// before the volume key is released from the TPM: the service issues a nonce, the TPM
+// quotes the selected PCRs over it with an attestation key, and the service verifies
+// the quote against its policy for the device.
+package attest
+
+import (
+	"bootstrap/internal/trace"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultPCRs     = "sha256:0,1,2,3,4,5,6,7" // Firmware, boot loader and Secure Boot state
+	DefaultAKHandle = "0x81010003"             // Persistent handle of the attestation key
+)
+
+// Config configures the attestation required before the key is read from the TPM.
+type Config struct {
+	URL      string `yaml:"url"`      // Attestation service base URL, e.g. https://attest.example.com/v1
+	PCRs     string `yaml:"pcrs"`     // PCR selection quoted
+	CACert   string `yaml:"caCert"`   // CA bundle verifying the service, system roots when empty
+	AKHandle string `yaml:"akHandle"` // Persistent handle of the attestation key
+}
+
+// Enabled reports whether attestation is required.
+func (c Config) Enabled() bool {
+	return c.URL != ""
+}
+
+// Quote is a TPM quote of the PCRs over the nonce of the service.
+type Quote struct {
+	AKPublic  string `json:"akPublic"`  // PEM public key of the attestation key
+	Message   []byte `json:"message"`   // TPMS_ATTEST structure
+	Signature []byte `json:"signature"` // TPMT_SIGNATURE over the message
+	PCRValues []byte `json:"pcrValues"` // PCR values, as written by tpm2_quote -o
+}
+
+// quoter produces quotes, the TPM outside of tests.
+type quoter interface {
+	quote(pcrs string, nonce []byte) (*Quote, error)
+}
+
+type challenge struct {
+	DeviceID string `json:"deviceId"`
+}
+
+type challengeResponse struct {
+	Nonce string `json:"nonce"` // hex
+}
+
+type verifyRequest struct {
+	DeviceID string `json:"deviceId"`
+	Nonce    string `json:"nonce"`
+	PCRs     string `json:"pcrs"`
+	Quote
+}
+
+type verifyResponse struct {
+	Verified bool   `json:"verified"`
+	Reason   string `json:"reason,omitempty"` // Why the quote was rejected
+}
+
+// Verify attests the device identified by deviceID to the service and returns an error
+// unless the service accepts the quote.
+func Verify(cfg Config, deviceID string) error {
+	handle := cfg.AKHandle
+	if handle == "" {
+		handle = DefaultAKHandle
+	}
+	return verify(cfg, deviceID, &tpmQuoter{handle: handle})
+}
+
+func verify(cfg Config, deviceID string, q quoter) error {
+	client, err := newClient(cfg.CACert)
+	if err != nil {
+		return err
+	}
+	base := strings.TrimRight(cfg.URL, "/")
+
+	var nonce challengeResponse
+	if err := post(client, base+"/challenge", challenge{DeviceID: deviceID}, &nonce); err != nil {
+		return err
+	}
+	raw, err := hex.DecodeString(nonce.Nonce)
+	if err != nil || len(raw) < 16 {
+		return fmt.Errorf("attestation service returned an invalid nonce %q", nonce.Nonce)
+	}
+
+	pcrs := cfg.PCRs
+	if pcrs == "" {
+		pcrs = DefaultPCRs
+	}
+	quote, err := q.quote(pcrs, raw)
+	if err != nil {
+		return err
+	}
+
+	var result verifyResponse
+	if err := post(client, base+"/verify", verifyRequest{DeviceID: deviceID, Nonce: nonce.Nonce, PCRs: pcrs, Quote: *quote}, &result); err != nil {
+		return err
+	}
+	if !result.Verified {
+		return fmt.Errorf("attestation rejected: %s", result.Reason)
+	}
+	return nil
+}
+
+// post sends request as JSON and decodes the JSON response into response.
+func post(client *http.Client, url string, request, response any) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("attestation request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("failed to read attestation response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("attestation service returned %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	if err := json.Unmarshal(data, response); err != nil {
+		return fmt.Errorf("failed to decode attestation response: %w", err)
+	}
+	return nil
+}
+
+func newClient(caCert string) (*http.Client, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caCert != "" {
+		data, err := os.ReadFile(caCert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read attestation CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates in %s", caCert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return &http.Client{Timeout: 30 * time.Second, Transport: &http.Transport{TLSClientConfig: tlsConfig}}, nil
+}
+
+// tpmQuoter quotes with a restricted signing key under the endorsement hierarchy,
+// created and persisted at handle on first use so the service can pin it.
+type tpmQuoter struct {
+	handle string
+}
+
+func (q *tpmQuoter) quote(pcrs string, nonce []byte) (*Quote, error) {
+	tmp, err := os.MkdirTemp("", "udm-attest-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+	path := func(name string) string { return filepath.Join(tmp, name) }
+
+	if trace.Command("tpm2_readpublic", "-c", q.handle).Run() != nil {
+		steps := [][]string{
+			{"tpm2_createek", "-c", path("ek.ctx"), "-G", "rsa", "-u", path("ek.pub")},
+			{"tpm2_createak", "-C", path("ek.ctx"), "-c", path("ak.ctx"), "-G", "rsa", "-g", "sha256", "-s", "rsassa", "-u", path("ak.pub"), "-n", path("ak.name")},
+			{"tpm2_evictcontrol", "-C", "o", "-c", path("ak.ctx"), q.handle},
+		}
+		for _, step := range steps {
+			if output, err := trace.Command(step[0], step[1:]...).CombinedOutput(); err != nil {
+				return nil, fmt.Errorf("%s failed: %s", step[0], strings.TrimSpace(string(output)))
+			}
+		}
+	}
+
+	steps := [][]string{
+		{"tpm2_readpublic", "-c", q.handle, "-f", "pem", "-o", path("ak.pem")},
+		{"tpm2_quote", "-c", q.handle, "-l", pcrs, "-q", hex.EncodeToString(nonce), "-g", "sha256",
+			"-m", path("quote.msg"), "-s", path("quote.sig"), "-o", path("quote.pcrs")},
+	}
+	for _, step := range steps {
+		if output, err := trace.Command(step[0], step[1:]...).CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("%s failed: %s", step[0], strings.TrimSpace(string(output)))
+		}
+	}
+
+	quote := &Quote{}
+	for name, dst := range map[string]*[]byte{"quote.msg": &quote.Message, "quote.sig": &quote.Signature, "quote.pcrs": &quote.PCRValues} {
+		if *dst, err = os.ReadFile(path(name)); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", name, err)
+		}
+	}
+	akPEM, err := os.ReadFile(path("ak.pem"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read attestation key: %w", err)
+	}
+	quote.AKPublic = string(akPEM)
+	return quote, nil
+}
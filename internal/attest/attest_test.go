@@ -0,0 +1,58 @@
+package attest
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type fakeQuoter struct {
+	nonce []byte
+}
+
+func (q *fakeQuoter) quote(pcrs string, nonce []byte) (*Quote, error) {
+	q.nonce = nonce
+	return &Quote{AKPublic: "-----BEGIN PUBLIC KEY-----", Message: []byte("attest"), Signature: []byte("sig"), PCRValues: []byte("pcrs")}, nil
+}
+
+func TestVerify(t *testing.T) {
+	const nonce = "00112233445566778899aabbccddeeff"
+	accept := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/challenge":
+			json.NewEncoder(w).Encode(challengeResponse{Nonce: nonce})
+		case "/v1/verify":
+			var req verifyRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if req.DeviceID != "device-1" || req.Nonce != nonce || req.PCRs != DefaultPCRs || !bytes.Equal(req.Message, []byte("attest")) {
+				http.Error(w, "unexpected request", http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(verifyResponse{Verified: accept, Reason: "PCR 7 does not match the policy"})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	cfg := Config{URL: server.URL + "/v1/"}
+	q := &fakeQuoter{}
+	if err := verify(cfg, "device-1", q); err != nil {
+		t.Fatalf("verify() error = %v, want nil", err)
+	}
+	if len(q.nonce) != 16 {
+		t.Errorf("quoted nonce of %d bytes, want 16", len(q.nonce))
+	}
+
+	accept = false
+	if err := verify(cfg, "device-1", q); err == nil || !strings.Contains(err.Error(), "PCR 7") {
+		t.Fatalf("verify() error = %v, want the rejection reason", err)
+	}
+}
@@ -0,0 +1,137 @@
+// Package audit records privileged operations on encrypted volumes to an append-only
+// log file or syslog, one JSON document per event.
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const DefaultPath = "/var/log/udm/audit.log"
+
+// appendOnlyAttr controls whether new log files get the append-only attribute.
+var appendOnlyAttr = true
+
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+	OutcomeAlert   = "alert" // Detected by udm rather than requested, e.g. header tampering
+)
+
+// Config selects where audit events are written.
+type Config struct {
+	Path   string `yaml:"path"`   // Append-only log file, defaults to DefaultPath
+	Syslog bool   `yaml:"syslog"` // Write to syslog (authpriv) instead of a file
+}
+
+// Event is one audited operation.
+type Event struct {
+	Time     time.Time `json:"time"`
+	Command  string    `json:"command"`
+	User     string    `json:"user"`
+	UID      int       `json:"uid"`
+	SudoUser string    `json:"sudoUser,omitempty"`
+	TokenID  string    `json:"tokenId,omitempty"`
+	Tenant   string    `json:"tenant,omitempty"`
+	Device   string    `json:"device"`
+	Mapper   string    `json:"mapper,omitempty"`
+	Outcome  string    `json:"outcome"`
+	Error    string    `json:"error,omitempty"`
+	Detail   string    `json:"detail,omitempty"`
+}
+
+// NewEvent returns an event for command on device, attributed to the invoking user.
+func NewEvent(command, device, mapper string) *Event {
+	e := &Event{Command: command, Device: device, Mapper: mapper, UID: os.Getuid(), SudoUser: os.Getenv("SUDO_USER")}
+	e.User = strconv.Itoa(e.UID)
+	if u, err := user.LookupId(e.User); err == nil {
+		e.User = u.Username
+	}
+	return e
+}
+
+// Logger writes audit events.
+type Logger struct {
+	mu     sync.Mutex
+	file   *os.File
+	syslog syslogWriter
+}
+
+// syslogWriter is the part of syslog.Writer the logger uses.
+type syslogWriter interface {
+	Notice(m string) error
+	Warning(m string) error
+	Close() error
+}
+
+// Open opens the audit destination of cfg.
+func Open(cfg Config) (*Logger, error) {
+	if cfg.Syslog {
+		w, err := openSyslog()
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to syslog: %w", err)
+		}
+		return &Logger{syslog: w}, nil
+	}
+
+	path := cfg.Path
+	if path == "" {
+		path = DefaultPath
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create audit log directory: %w", err)
+	}
+	_, statErr := os.Stat(path)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	if os.IsNotExist(statErr) && appendOnlyAttr {
+		setAppendOnly(file)
+	}
+	return &Logger{file: file}, nil
+}
+
+// Record writes e, stamping it with the current time.
+func (l *Logger) Record(e *Event) error {
+	if l == nil {
+		return nil
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit event: %w", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.syslog != nil {
+		if e.Outcome == OutcomeSuccess {
+			return l.syslog.Notice(string(data))
+		}
+		return l.syslog.Warning(string(data))
+	}
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	return l.file.Sync()
+}
+
+// Close closes the audit destination.
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	if l.syslog != nil {
+		return l.syslog.Close()
+	}
+	return l.file.Close()
+}
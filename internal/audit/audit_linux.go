@@ -0,0 +1,24 @@
+package audit
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// setAppendOnly sets the filesystem append-only attribute (chattr +a) on a new log, so
+// even root must clear it before entries can be rewritten. Filesystems without
+// attribute support keep the plain O_APPEND file.
+func setAppendOnly(file *os.File) {
+	const (
+		fsIocGetFlags = 0x80086601
+		fsIocSetFlags = 0x40086602
+		fsAppendFl    = 0x00000020
+	)
+	var flags int
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), fsIocGetFlags, uintptr(unsafe.Pointer(&flags))); errno != 0 {
+		return
+	}
+	flags |= fsAppendFl
+	syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), fsIocSetFlags, uintptr(unsafe.Pointer(&flags)))
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package audit
+
+import "os"
+
+// setAppendOnly is a no-op, the append-only attribute is specific to Linux filesystems.
+func setAppendOnly(file *os.File) {}
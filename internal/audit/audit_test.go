@@ -0,0 +1,44 @@
+package audit
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecordAppends(t *testing.T) {
+	// The attribute would keep the test from cleaning up its temporary directory
+	appendOnlyAttr = false
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	for _, outcome := range []string{OutcomeSuccess, OutcomeFailure} {
+		logger, err := Open(Config{Path: path})
+		if err != nil {
+			t.Fatalf("Open() error = %v, want nil", err)
+		}
+		e := NewEvent("mount", "/var/luks/udm-luks.img", "udm-luks")
+		e.Outcome = outcome
+		if err := logger.Record(e); err != nil {
+			t.Fatalf("Record() error = %v, want nil", err)
+		}
+		logger.Close()
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("audit log has %d entries, want 2:\n%s", len(lines), data)
+	}
+	var e Event
+	if err := json.Unmarshal([]byte(lines[1]), &e); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if e.Command != "mount" || e.Outcome != OutcomeFailure || e.User == "" || e.Time.IsZero() {
+		t.Fatalf("second entry = %+v, want a failed mount by a named user", e)
+	}
+}
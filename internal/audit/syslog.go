@@ -0,0 +1,9 @@
+//go:build !windows && !plan9
+
+package audit
+
+import "log/syslog"
+
+func openSyslog() (syslogWriter, error) {
+	return syslog.New(syslog.LOG_AUTHPRIV|syslog.LOG_NOTICE, "udm-audit")
+}
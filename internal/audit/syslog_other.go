@@ -0,0 +1,9 @@
+//go:build windows || plan9
+
+package audit
+
+import "bootstrap/internal/platform"
+
+func openSyslog() (syslogWriter, error) {
+	return nil, platform.ErrUnsupportedPlatform
+}
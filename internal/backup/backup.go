@@ -0,0 +1,143 @@
+// Package backup encrypts tarballs of a volume's filesystem for storage off the device,
+// and records a manifest of every backup taken.
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Format of the backups, a gzipped tarball encrypted as described at streamMagic.
+const Format = "tar.gz+aes256gcm-stream"
+
+// Manifest describes a backup. It is kept in the state directory, and next to backups
+// written to a file.
+type Manifest struct {
+	MapperName string    `json:"mapperName"`
+	UUID       string    `json:"uuid,omitempty"` // LUKS UUID of the backed up volume
+	Created    time.Time `json:"created"`
+	Target     string    `json:"target"` // Path or URL the backup was written to
+	Format     string    `json:"format"`
+	KeyID      string    `json:"keyID"`      // Fingerprint of the backup key, see KeyID
+	Consistent string    `json:"consistent"` // How writes were excluded: snapshot or read-only
+	Bytes      int64     `json:"bytes"`      // Size of the encrypted backup
+	SHA256     string    `json:"sha256"`     // Of the encrypted backup
+}
+
+// IsURL reports whether target is an HTTP(S) URL rather than a path.
+func IsURL(target string) bool {
+	return strings.HasPrefix(target, "https://") || strings.HasPrefix(target, "http://")
+}
+
+// Sink is the destination of a backup, counting and hashing what is written.
+type Sink struct {
+	w     io.Writer
+	close func() error
+	hash  hash.Hash
+	bytes int64
+}
+
+func (s *Sink) Write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	s.hash.Write(p[:n])
+	s.bytes += int64(n)
+	return n, err
+}
+
+// Close completes the backup, e.g. the upload.
+func (s *Sink) Close() error {
+	return s.close()
+}
+
+// Bytes returns the number of bytes written.
+func (s *Sink) Bytes() int64 {
+	return s.bytes
+}
+
+// SHA256 returns the hash of the bytes written.
+func (s *Sink) SHA256() string {
+	return hex.EncodeToString(s.hash.Sum(nil))
+}
+
+// Create opens target for writing a backup: a new file, or an HTTP PUT streaming the
+// backup to a URL, e.g. a presigned object storage URL.
+func Create(target string) (*Sink, error) {
+	if !IsURL(target) {
+		file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create backup file: %w", err)
+		}
+		return &Sink{w: file, close: file.Close, hash: sha256.New()}, nil
+	}
+
+	reader, writer := io.Pipe()
+	req, err := http.NewRequest(http.MethodPut, target, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	done := make(chan error, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				err = fmt.Errorf("upload rejected: %s", resp.Status)
+			}
+		}
+		reader.CloseWithError(err)
+		done <- err
+	}()
+	closeUpload := func() error {
+		writer.Close()
+		return <-done
+	}
+	return &Sink{w: writer, close: closeUpload, hash: sha256.New()}, nil
+}
+
+// Open opens a backup written by Create for reading.
+func Open(source string) (io.ReadCloser, error) {
+	if !IsURL(source) {
+		return os.Open(source)
+	}
+	resp, err := http.Get(source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download backup: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to download backup: %s", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// SaveManifest writes the manifest to dir, and next to backups written to a file.
+func SaveManifest(dir string, m *Manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if !IsURL(m.Target) {
+		if err := os.WriteFile(m.Target+".manifest.json", data, 0600); err != nil {
+			return fmt.Errorf("failed to write manifest: %w", err)
+		}
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create manifest directory: %w", err)
+	}
+	name := fmt.Sprintf("%s-%s.json", m.MapperName, m.Created.UTC().Format("20060102T150405Z"))
+	if err := os.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// KeySize is the length of backup keys in bytes.
+const KeySize = 32
+
+// streamMagic prefixes an encrypted backup:
+// magic | key ID | nonce prefix | chunk...
+//
+// Each chunk holds up to chunkSize bytes of plaintext sealed with AES-256-GCM, the nonce
+// being the prefix, the chunk counter and a flag marking the last chunk, so reordered,
+// dropped or truncated chunks fail to decrypt.
+var streamMagic = []byte("UDMBAK01")
+
+const (
+	chunkSize   = 64 << 10
+	keyIDSize   = 8
+	prefixSize  = 7
+	counterSize = 4
+)
+
+// KeyID returns the fingerprint of a backup key, recorded in backups and manifests so
+// restore can tell a wrong key from a corrupt backup.
+func KeyID(key []byte) string {
+	sum := sha256.Sum256(append([]byte("udm-backup-key"), key...))
+	return hex.EncodeToString(sum[:keyIDSize])
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("backup key must be %d bytes, got %d", KeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce of chunk counter.
+func chunkNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 0, prefixSize+counterSize+1)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, counter)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+// Writer encrypts a backup stream. Close seals the last chunk, without it the backup is
+// rejected as truncated.
+type Writer struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	closed  bool
+}
+
+// NewWriter writes the header of an encrypted backup to w.
+func NewWriter(w io.Writer, key []byte) (*Writer, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, prefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	id, _ := hex.DecodeString(KeyID(key))
+	header := append(append(append([]byte{}, streamMagic...), id...), prefix...)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w, aead: aead, prefix: prefix, buf: make([]byte, 0, chunkSize)}, nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write to closed backup stream")
+	}
+	n := len(p)
+	for len(p) > 0 {
+		// A full chunk is only sealed once more data follows, the last one is sealed by Close
+		if len(w.buf) == chunkSize {
+			if err := w.seal(false); err != nil {
+				return n - len(p), err
+			}
+		}
+		take := min(chunkSize-len(w.buf), len(p))
+		w.buf = append(w.buf, p[:take]...)
+		p = p[take:]
+	}
+	return n, nil
+}
+
+func (w *Writer) seal(last bool) error {
+	sealed := w.aead.Seal(nil, chunkNonce(w.prefix, w.counter, last), w.buf, nil)
+	w.counter++
+	w.buf = w.buf[:0]
+	_, err := w.w.Write(sealed)
+	return err
+}
+
+// Close seals the last chunk. It does not close the underlying writer.
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.seal(true)
+}
+
+// Reader decrypts a backup stream written by Writer.
+type Reader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	done    bool
+}
+
+// NewReader reads the header of an encrypted backup from r and checks it was encrypted
+// with key.
+func NewReader(r io.Reader, key []byte) (*Reader, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, len(streamMagic)+keyIDSize+prefixSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("failed to read backup header: %w", err)
+	}
+	if !bytes.HasPrefix(header, streamMagic) {
+		return nil, fmt.Errorf("not a udm backup")
+	}
+	id := hex.EncodeToString(header[len(streamMagic) : len(streamMagic)+keyIDSize])
+	if id != KeyID(key) {
+		return nil, fmt.Errorf("backup was encrypted with key %s, not with key %s", id, KeyID(key))
+	}
+	return &Reader{r: r, aead: aead, prefix: header[len(streamMagic)+keyIDSize:]}, nil
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// open decrypts the next chunk. A full chunk may be the last one, a short one must be.
+func (r *Reader) open() error {
+	sealed := make([]byte, chunkSize+r.aead.Overhead())
+	n, err := io.ReadFull(r.r, sealed)
+	switch {
+	case err == io.EOF:
+		return fmt.Errorf("backup is truncated")
+	case err != nil && err != io.ErrUnexpectedEOF:
+		return err
+	}
+	sealed = sealed[:n]
+	if n == len(sealed) && err == nil {
+		if plain, err := r.aead.Open(nil, chunkNonce(r.prefix, r.counter, false), sealed, nil); err == nil {
+			r.counter++
+			r.buf = plain
+			return nil
+		}
+	}
+	plain, openErr := r.aead.Open(nil, chunkNonce(r.prefix, r.counter, true), sealed, nil)
+	if openErr != nil {
+		return fmt.Errorf("backup chunk %d is corrupt or truncated", r.counter)
+	}
+	if extra, _ := r.r.Read(make([]byte, 1)); extra > 0 {
+		return fmt.Errorf("backup has data after its last chunk")
+	}
+	r.done = true
+	r.buf = plain
+	return nil
+}
@@ -0,0 +1,59 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestStreamRoundTrip(t *testing.T) {
+	key := make([]byte, KeySize)
+	rand.Read(key)
+	for _, size := range []int{0, 100, chunkSize, 3*chunkSize + 17} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+
+		var encrypted bytes.Buffer
+		w, err := NewWriter(&encrypted, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(plain)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := NewReader(bytes.NewReader(encrypted.Bytes()), key)
+		if err != nil {
+			t.Fatalf("NewReader() error = %v", err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Errorf("size %d: round trip returned %d bytes, %v", size, len(got), err)
+		}
+
+		// Dropping the last chunk must not go unnoticed
+		if size > chunkSize {
+			truncated := encrypted.Bytes()[:encrypted.Len()-(size%chunkSize)-16]
+			r, _ := NewReader(bytes.NewReader(truncated), key)
+			if _, err := io.ReadAll(r); err == nil {
+				t.Errorf("size %d: expected a truncated backup to be rejected", size)
+			}
+		}
+	}
+}
+
+func TestStreamWrongKey(t *testing.T) {
+	key, other := make([]byte, KeySize), make([]byte, KeySize)
+	rand.Read(key)
+	rand.Read(other)
+	var encrypted bytes.Buffer
+	w, _ := NewWriter(&encrypted, key)
+	w.Write([]byte("data"))
+	w.Close()
+	if _, err := NewReader(&encrypted, other); err == nil || !strings.Contains(err.Error(), KeyID(key)) {
+		t.Errorf("expected the key mismatch to be reported, got %v", err)
+	}
+}
@@ -0,0 +1,203 @@
+// Package cloudinit reads the bootstrap token and volume configuration of a cloud VM from
+// its user-data, as stored by cloud-init or served by the EC2 and OpenStack metadata
+// services, so the VM can provision its volume on first boot without local files.
+package cloudinit
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Sources of the user-data.
+const (
+	SourceAuto      = "auto"       // The first of cloud-init, ec2 and openstack with user-data
+	SourceCloudInit = "cloud-init" // The user-data stored by cloud-init
+	SourceEC2       = "ec2"        // EC2 instance metadata service (IMDSv2)
+	SourceOpenStack = "openstack"  // OpenStack metadata service
+)
+
+var (
+	// UserDataPath is where cloud-init stores the raw user-data of the instance.
+	UserDataPath = "/var/lib/cloud/instance/user-data.txt"
+
+	// MetadataURL is the link-local address of the EC2 and OpenStack metadata services.
+	MetadataURL = "http://169.254.169.254"
+)
+
+// ErrNoUserData is returned when the source has no user-data.
+var ErrNoUserData = errors.New("no user-data")
+
+const metadataTimeout = 10 * time.Second
+
+// Provision is the udm section of the user-data, a #cloud-config document with a
+// top-level udm key:
+//
+//	#cloud-config
+//	udm:
+//	  bootstrap:
+//	    bootstrap: { token-id: ..., version: ... }
+//	  config:
+//	    luks: { ... }
+//
+// Both are kept as YAML, so they are parsed and validated like local files.
+type Provision struct {
+	Bootstrap []byte // Bootstrap token document
+	Config    []byte // Volume configuration document
+}
+
+// ValidSource reports whether source is a supported user-data source.
+func ValidSource(source string) bool {
+	switch source {
+	case SourceAuto, SourceCloudInit, SourceEC2, SourceOpenStack:
+		return true
+	}
+	return false
+}
+
+// Fetch returns the raw user-data of source. In auto mode the sources are tried in
+// turn, the metadata services only without user-data stored by cloud-init.
+func Fetch(source string) ([]byte, error) {
+	switch source {
+	case SourceCloudInit:
+		data, err := os.ReadFile(UserDataPath)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("%w at %s", ErrNoUserData, UserDataPath)
+		}
+		return data, err
+	case SourceEC2:
+		return fetchEC2()
+	case SourceOpenStack:
+		return fetchURL(MetadataURL+"/openstack/latest/user_data", nil)
+	case SourceAuto:
+		var errs []error
+		for _, s := range []string{SourceCloudInit, SourceEC2, SourceOpenStack} {
+			data, err := Fetch(s)
+			if err == nil {
+				return data, nil
+			}
+			errs = append(errs, fmt.Errorf("%s: %w", s, err))
+		}
+		return nil, errors.Join(errs...)
+	}
+	return nil, fmt.Errorf("unknown user-data source %q", source)
+}
+
+// fetchEC2 reads the user-data with an IMDSv2 session token.
+func fetchEC2() ([]byte, error) {
+	client := &http.Client{Timeout: metadataTimeout}
+	req, err := http.NewRequest(http.MethodPut, MetadataURL+"/latest/api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("metadata service unreachable: %w", err)
+	}
+	token, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get metadata session token: %s", resp.Status)
+	}
+	return fetchURL(MetadataURL+"/latest/user-data", map[string]string{"X-aws-ec2-metadata-token": string(token)})
+}
+
+// fetchURL returns the body of a metadata service resource.
+func fetchURL(url string, header map[string]string) ([]byte, error) {
+	client := &http.Client{Timeout: metadataTimeout}
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("metadata service unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNoUserData
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// Parse extracts the udm section of user-data, either a #cloud-config document or a
+// MIME multipart archive with a text/cloud-config part.
+func Parse(userData []byte) (*Provision, error) {
+	cloudConfig, err := cloudConfigPart(userData)
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		UDM struct {
+			Bootstrap yaml.Node `yaml:"bootstrap"`
+			Config    yaml.Node `yaml:"config"`
+		} `yaml:"udm"`
+	}
+	if err := yaml.Unmarshal(cloudConfig, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse cloud-config: %w", err)
+	}
+	if doc.UDM.Config.Kind == 0 {
+		return nil, fmt.Errorf("cloud-config has no udm.config section")
+	}
+
+	p := &Provision{}
+	if p.Config, err = yaml.Marshal(&doc.UDM.Config); err != nil {
+		return nil, fmt.Errorf("failed to encode udm.config: %w", err)
+	}
+	if doc.UDM.Bootstrap.Kind != 0 {
+		if p.Bootstrap, err = yaml.Marshal(&doc.UDM.Bootstrap); err != nil {
+			return nil, fmt.Errorf("failed to encode udm.bootstrap: %w", err)
+		}
+	}
+	return p, nil
+}
+
+// cloudConfigPart returns the #cloud-config document of the user-data.
+func cloudConfigPart(userData []byte) ([]byte, error) {
+	if bytes.HasPrefix(userData, []byte("#cloud-config")) {
+		return userData, nil
+	}
+	if !bytes.HasPrefix(bytes.TrimSpace(userData), []byte("Content-Type:")) &&
+		!bytes.HasPrefix(bytes.TrimSpace(userData), []byte("MIME-Version:")) {
+		return nil, fmt.Errorf("user-data is neither #cloud-config nor MIME multipart")
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(bytes.TrimSpace(userData)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse MIME user-data: %w", err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return nil, fmt.Errorf("user-data is not MIME multipart")
+	}
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, fmt.Errorf("MIME user-data has no text/cloud-config part")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read MIME user-data: %w", err)
+		}
+		if partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type")); partType == "text/cloud-config" {
+			return io.ReadAll(part)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package cloudinit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const userData = `#cloud-config
+packages: [cryptsetup]
+udm:
+  bootstrap:
+    bootstrap:
+      token-id: "abcd1234"
+      version: "1.0"
+  config:
+    luks:
+      mapperName: "udm-luks"
+`
+
+func TestParse(t *testing.T) {
+	p, err := Parse([]byte(userData))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if !strings.Contains(string(p.Bootstrap), `token-id: "abcd1234"`) || !strings.Contains(string(p.Config), `mapperName: "udm-luks"`) {
+		t.Errorf("Parse() = bootstrap %q, config %q", p.Bootstrap, p.Config)
+	}
+
+	if _, err := Parse([]byte("#cloud-config\npackages: [cryptsetup]\n")); err == nil {
+		t.Errorf("expected user-data without a udm section to be rejected")
+	}
+	if _, err := Parse([]byte("#!/bin/sh\necho hi\n")); err == nil {
+		t.Errorf("expected a user-data script to be rejected")
+	}
+}
+
+func TestParseMultipart(t *testing.T) {
+	multipart := "Content-Type: multipart/mixed; boundary=\"XYZ\"\nMIME-Version: 1.0\n\n" +
+		"--XYZ\nContent-Type: text/x-shellscript\n\n#!/bin/sh\necho hi\n" +
+		"--XYZ\nContent-Type: text/cloud-config\n\n" + userData +
+		"--XYZ--\n"
+	p, err := Parse([]byte(multipart))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if !strings.Contains(string(p.Config), `mapperName: "udm-luks"`) {
+		t.Errorf("Parse() config = %q", p.Config)
+	}
+}
+
+func TestFetchEC2(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPut && r.URL.Path == "/latest/api/token":
+			w.Write([]byte("session"))
+		case r.URL.Path == "/latest/user-data" && r.Header.Get("X-aws-ec2-metadata-token") == "session":
+			w.Write([]byte(userData))
+		default:
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+	defer func(url string) { MetadataURL = url }(MetadataURL)
+	MetadataURL = server.URL
+
+	data, err := Fetch(SourceEC2)
+	if err != nil || string(data) != userData {
+		t.Errorf("Fetch(ec2) = %q, %v", data, err)
+	}
+	if _, err := Fetch(SourceOpenStack); err == nil {
+		t.Errorf("expected missing OpenStack user-data to fail")
+	}
+}
@@ -0,0 +1,52 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// machineIDPath identifies the device a bootstrap token may be bound to.
+var machineIDPath = "/etc/machine-id"
+
+// Enforce checks the configuration against the claims of the bootstrap token, so a
+// device cannot provision more than the authority granted it.
+func (token *BootstrapToken) Enforce(cfg *AppConfig, now time.Time) error {
+	claims := token.Bootstrap
+	if !claims.Expires.IsZero() && now.After(claims.Expires) {
+		return fmt.Errorf("bootstrap token expired at %s", claims.Expires.Format(time.RFC3339))
+	}
+
+	if claims.DeviceId != "" {
+		data, err := os.ReadFile(machineIDPath)
+		if err != nil {
+			return fmt.Errorf("failed to read device id: %w", err)
+		}
+		if strings.TrimSpace(string(data)) != claims.DeviceId {
+			return fmt.Errorf("bootstrap token was issued for device %s", claims.DeviceId)
+		}
+	}
+
+	policy := claims.Policy
+	if policy.MinSize > 0 && cfg.LUKS.Size < policy.MinSize {
+		return fmt.Errorf("luks.size (%d MB) is below the %d MB allowed by the bootstrap token", cfg.LUKS.Size, policy.MinSize)
+	}
+	if policy.MaxSize > 0 && cfg.LUKS.Size > policy.MaxSize {
+		return fmt.Errorf("luks.size (%d MB) exceeds the %d MB allowed by the bootstrap token", cfg.LUKS.Size, policy.MaxSize)
+	}
+	if len(policy.MountPoints) > 0 {
+		allowed := false
+		for _, pattern := range policy.MountPoints {
+			if ok, _ := filepath.Match(pattern, filepath.Clean(cfg.LUKS.MountPoint)); ok {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("luks.mountPoint (%s) is not allowed by the bootstrap token", cfg.LUKS.MountPoint)
+		}
+	}
+	return nil
+}
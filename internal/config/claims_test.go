@@ -0,0 +1,46 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEnforceClaims(t *testing.T) {
+	machineIDPath = filepath.Join(t.TempDir(), "machine-id")
+	if err := os.WriteFile(machineIDPath, []byte("device-1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var token BootstrapToken
+	token.Bootstrap.Expires = now.Add(time.Hour)
+	token.Bootstrap.DeviceId = "device-1"
+	token.Bootstrap.Policy = Claims{MinSize: 8, MaxSize: 32, MountPoints: []string{"/mnt/udm-*"}}
+
+	cfg := &AppConfig{}
+	cfg.LUKS.Size = 16
+	cfg.LUKS.MountPoint = "/mnt/udm-data"
+	if err := token.Enforce(cfg, now); err != nil {
+		t.Fatalf("Enforce() error = %v, want nil", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*AppConfig, *BootstrapToken)
+	}{
+		{"expired", func(c *AppConfig, tk *BootstrapToken) { tk.Bootstrap.Expires = now.Add(-time.Hour) }},
+		{"other device", func(c *AppConfig, tk *BootstrapToken) { tk.Bootstrap.DeviceId = "device-2" }},
+		{"too large", func(c *AppConfig, tk *BootstrapToken) { c.LUKS.Size = 64 }},
+		{"too small", func(c *AppConfig, tk *BootstrapToken) { c.LUKS.Size = 4 }},
+		{"mount point", func(c *AppConfig, tk *BootstrapToken) { c.LUKS.MountPoint = "/srv/data" }},
+	}
+	for _, tt := range tests {
+		c, tk := *cfg, token
+		tt.modify(&c, &tk)
+		if err := tk.Enforce(&c, now); err == nil {
+			t.Errorf("%s: Enforce() error = nil, want a violation", tt.name)
+		}
+	}
+}
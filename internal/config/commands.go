@@ -0,0 +1,399 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// commandSpec describes a subcommand and its flags.
+type commandSpec struct {
+	name    string // Subcommand, e.g. "add-key"
+	alias   string // Deprecated boolean flag selecting the command, e.g. "addKey"
+	args    string // Synopsis of the command specific arguments
+	summary string
+	flags   func(fs *flag.FlagSet, cmd *Command) // Registers the command specific flags
+}
+
+// commands is the command table, in the order they are listed by help.
+var commands = []commandSpec{
+	{name: "authorize", alias: "authorize", args: "--bootstrap=file --keyfile=key.bin",
+		summary: "Authorize with a required bootstrap file and output keyfile",
+		flags: func(fs *flag.FlagSet, cmd *Command) {
+			fs.StringVar(&cmd.Bootstrap, "bootstrap", "", "Path to bootstrap YAML")
+			reuseTokenFlag(fs, cmd)
+		}},
+	{name: "deauthorize", alias: "deauthorize", args: "[--yes] [--force]",
+		summary: "Remove the volume, its TPM key and persistent mount, after typing the volume name",
+		flags: func(fs *flag.FlagSet, cmd *Command) {
+			fs.BoolVar(&cmd.Yes, "yes", false, "Skip typing the volume name, e.g. in automation")
+			fs.BoolVar(&cmd.Force, "force", false, "Deauthorize even though processes have files open on the mounted volume")
+		}},
+	{name: "mount", alias: "mount", args: "[--holder=id] [--lease=5m] [--read-only] --keyfile=key.bin",
+		summary: "Mount the volume, or take a reference if it is already mounted",
+		flags: func(fs *flag.FlagSet, cmd *Command) {
+			holderFlag(fs, cmd)
+			leaseFlag(fs, cmd)
+			fs.BoolVar(&cmd.ReadOnly, "read-only", false, "Open the mapper and mount the filesystem read-only, e.g. for forensic inspection")
+		}},
+	{name: "unmount", alias: "unmount", args: "[--holder=id]",
+		summary: "Release a reference, unmounting when the last holder releases",
+		flags:   unmountFlags},
+	{name: "add-persistent-mount", alias: "addPersistentMount", args: "--keyfile=key.bin",
+		summary: "Add a persistent mount through crypttab and fstab"},
+	{name: "remove-persistent-mount", alias: "removePersistentMount",
+		summary: "Remove the persistent mount"},
+	{name: "add-hotplug-mount", args: "--keyfile=key.bin",
+		summary: "Install a udev rule mounting the volume whenever its block device appears"},
+	{name: "remove-hotplug-mount",
+		summary: "Remove the udev rule of add-hotplug-mount"},
+	{name: "verify", alias: "verify", args: "--keyfile=key.bin",
+		summary: "Verify the key, header and filesystem of the volume"},
+	{name: "which-key", alias: "which-key", args: "--keyfile=key.bin",
+		summary: "Explain how the volume would be unlocked, without unlocking it"},
+	{name: "freeze", alias: "freeze", args: "[--snapshot] --keyfile=key.bin",
+		summary: "Freeze the filesystem, or take a read-only snapshot while mounted",
+		flags: func(fs *flag.FlagSet, cmd *Command) {
+			fs.BoolVar(&cmd.Snapshot, "snapshot", false, "Take a read-only reflink or LVM snapshot, frozen only while it is taken")
+		}},
+	{name: "thaw", alias: "thaw",
+		summary: "Thaw a frozen filesystem"},
+	{name: "release-snapshot", alias: "releaseSnapshot",
+		summary: "Unmount and delete the volume snapshot"},
+	{name: "backup", args: "--target=path|url --backup-key=backup.key --keyfile=key.bin",
+		summary: "Stream an encrypted tarball of a consistent snapshot of the mounted volume and record its manifest",
+		flags: func(fs *flag.FlagSet, cmd *Command) {
+			fs.StringVar(&cmd.Backup, "target", "", "File or http(s) URL the backup is written to with PUT")
+			backupKeyFlag(fs, cmd)
+		}},
+	{name: "restore", args: "--source=path|url --backup-key=backup.key",
+		summary: "Extract a backup onto the empty filesystem of a newly authorized, mounted volume",
+		flags: func(fs *flag.FlagSet, cmd *Command) {
+			fs.StringVar(&cmd.Backup, "source", "", "File or http(s) URL of the backup")
+			backupKeyFlag(fs, cmd)
+		}},
+	{name: "add-key", alias: "addKey", args: "--new-keyfile=recovery.txt [--slot=1] --keyfile=key.bin",
+		summary: "Add a key to a keyslot, authorized by the machine key",
+		flags: func(fs *flag.FlagSet, cmd *Command) {
+			fs.StringVar(&cmd.NewKeyfile, "new-keyfile", "", "Path to the key to add")
+			slotFlag(fs, cmd)
+		}},
+	{name: "remove-key", alias: "removeKey", args: "--slot=1 --keyfile=key.bin",
+		summary: "Remove a keyslot, authorized by the machine key",
+		flags:   slotFlag},
+	{name: "check-key", args: "[--keyfile=passphrase.txt]",
+		summary: "Measure a key or passphrase against the password policy before enrolling it"},
+	{name: "enroll-fido2", args: "--keyfile=key.bin",
+		summary: "Bind a keyslot to the FIDO2 token configured in luks.fido2"},
+	{name: "reencrypt", alias: "reencrypt", args: "--keyfile=key.bin",
+		summary: "Migrate the volume to the configured cipher and key size, resuming an interrupted run"},
+	{name: "benchmark", alias: "benchmark", args: "[--unlock-time=2s]",
+		summary: "Measure cipher throughput and keyslot unlock times on this hardware and suggest luks settings",
+		flags: func(fs *flag.FlagSet, cmd *Command) {
+			fs.DurationVar(&cmd.UnlockTime, "unlock-time", 2*time.Second, "Unlock time the PBKDF iterations are tuned to")
+		}},
+	{name: "selftest", alias: "selftest", args: "[--tpm]",
+		summary: "Run authorize, mount, a write/read check, unmount and deauthorize on a throwaway volume to validate the host",
+		flags: func(fs *flag.FlagSet, cmd *Command) {
+			fs.BoolVar(&cmd.UseTPM, "tpm", false, "Also keep the key in a temporary TPM NV index")
+		}},
+	{name: "export-escrow", alias: "exportEscrow", args: "[--file=escrow.json] --keyfile=key.bin",
+		summary: "Write the volume key wrapped with the organization key in luks.escrow.publicKey",
+		flags: func(fs *flag.FlagSet, cmd *Command) {
+			fs.StringVar(&cmd.EscrowFile, "file", "", "Path of the escrow blob (default luks.escrow.path)")
+		}},
+	{name: "recover", alias: "recover", args: "--volume-key=volume.key [--keyfile=key.bin]",
+		summary: "Enroll a new machine key with the volume key unwrapped from an escrow blob",
+		flags: func(fs *flag.FlagSet, cmd *Command) {
+			fs.StringVar(&cmd.VolumeKey, "volume-key", "", "Raw volume key unwrapped by the security team")
+		}},
+	{name: "reset-lockout",
+		summary: "Clear the failed unlock attempts counted by luks.lockout, allowing mount again"},
+	{name: "panic", args: "--yes [--discard]",
+		summary: "Erase the keyslots and TPM key and detach the volume at once, making the data unrecoverable",
+		flags: func(fs *flag.FlagSet, cmd *Command) {
+			fs.BoolVar(&cmd.Yes, "yes", false, "Confirm the data is to be destroyed (required)")
+			fs.BoolVar(&cmd.Discard, "discard", false, "Also discard the blocks of the backing storage")
+		}},
+	{name: "list-keys", alias: "listKeys",
+		summary: "List used keyslots and their tokens"},
+	{name: "renew", alias: "renew", args: "--holder=id --lease=5m",
+		summary: "Renew a mount lease before it expires",
+		flags: func(fs *flag.FlagSet, cmd *Command) {
+			holderFlag(fs, cmd)
+			leaseFlag(fs, cmd)
+		}},
+	{name: "healthcheck", alias: "healthcheck", args: "[--fix-permissions] [--keyfile=key.bin]",
+		summary: "Check the volume, exiting 0 when healthy, 1 when degraded and 2 when failed",
+		flags: func(fs *flag.FlagSet, cmd *Command) {
+			fs.BoolVar(&cmd.FixPermissions, "fix-permissions", false, "Restrict the keyfile to mode 0600 and luks.keyfileOwner")
+		}},
+	{name: "list", alias: "list", args: "[--tenant=name]",
+		summary: "List the volumes provisioned on this device, without a configuration",
+		flags:   tenantFlag},
+	{name: "status", args: "[--tenant=name]",
+		summary: "Show the volume state and the effective feature flags",
+		flags:   tenantFlag},
+	{name: "holders", alias: "holders",
+		summary: "List the consumers holding the mounted volume"},
+	{name: "daemon", alias: "daemon",
+		summary: "Run in the foreground, expiring leases, watching the header and running scheduled tasks"},
+	{name: "helper",
+		summary: "Serve mount, unmount and status over D-Bus for unprivileged udm until idle, started by D-Bus activation"},
+	{name: "accept-header", alias: "accept-header",
+		summary: "Record the current LUKS header as expected after reviewing a change alert"},
+	{name: "serve-nbd", alias: "serve-nbd", args: "--read-only --tls-cert=server.pem --tls-key=server.key --tls-ca=ca.pem",
+		summary: "Export the opened volume to TLS-authenticated NBD clients for remote imaging",
+		flags: func(fs *flag.FlagSet, cmd *Command) {
+			fs.BoolVar(&cmd.ReadOnly, "read-only", false, "Export read-only (required)")
+			fs.StringVar(&cmd.NBD.Listen, "listen", ":10809", "Address to listen on")
+			fs.StringVar(&cmd.NBD.TLSCert, "tls-cert", "", "Server certificate")
+			fs.StringVar(&cmd.NBD.TLSKey, "tls-key", "", "Server private key")
+			fs.StringVar(&cmd.NBD.TLSCA, "tls-ca", "", "CA that client certificates must be signed by")
+			fs.DurationVar(&cmd.NBD.Duration, "duration", time.Hour, "How long to serve before closing all sessions")
+		}},
+	{name: "reconcile", args: "[--dry-run]",
+		summary: "Correct safe drift between the configuration and the system, report the rest",
+		flags: func(fs *flag.FlagSet, cmd *Command) {
+			fs.BoolVar(&cmd.DryRun, "dry-run", false, "Only report differences")
+		}},
+	{name: "check", args: "[--persistent] [--keyfile=key.bin]",
+		summary: "Report the changes authorize and mount would make, exit 0 when in sync and 2 when changes are needed",
+		flags: func(fs *flag.FlagSet, cmd *Command) {
+			fs.BoolVar(&cmd.Persistent, "persistent", false, "Also expect the crypttab and fstab entries of add-persistent-mount")
+		}},
+	{name: "provision-all", args: "[--config-dir=/etc/udm/conf.d] [--keyfile-dir=/etc/udm/keys] [--jobs=4] --bootstrap=file",
+		summary: "Authorize or mount the volume of every config in a directory",
+		flags: func(fs *flag.FlagSet, cmd *Command) {
+			fs.StringVar(&cmd.ConfigDir, "config-dir", "/etc/udm/conf.d", "Directory of volume configs (*.yml, *.yaml)")
+			fs.StringVar(&cmd.KeyfileDir, "keyfile-dir", "/etc/udm/keys", "Directory of the keyfiles, named <mapperName>.key")
+			fs.StringVar(&cmd.Bootstrap, "bootstrap", "", "Path to bootstrap YAML, for volumes to authorize")
+			fs.IntVar(&cmd.Jobs, "jobs", 4, "Volumes to mount concurrently, after the volumes they depend on")
+			reuseTokenFlag(fs, cmd)
+		}},
+	{name: "provision-cloud", args: "[--source=auto] [--keyfile-dir=/etc/udm/keys]",
+		summary: "Install the configuration and bootstrap token of the cloud user-data, then authorize or mount the volume",
+		flags: func(fs *flag.FlagSet, cmd *Command) {
+			fs.StringVar(&cmd.UserDataSource, "source", "auto", "User-data source: auto, cloud-init, ec2 or openstack")
+			fs.StringVar(&cmd.KeyfileDir, "keyfile-dir", "/etc/udm/keys", "Directory of the keyfile, named <mapperName>.key")
+			reuseTokenFlag(fs, cmd)
+		}},
+	{name: "migrate", alias: "migrate", args: "--from-config=a.yml --to-config=b.yml --bootstrap=file --keyfile=key.bin",
+		summary: "Provision a new volume, copy and verify the data of another, then deauthorize it",
+		flags: func(fs *flag.FlagSet, cmd *Command) {
+			fs.StringVar(&cmd.FromConfig, "from-config", "", "Config of the source volume")
+			fs.StringVar(&cmd.ToConfig, "to-config", "", "Config of the target volume, provisioned by migrate")
+			fs.StringVar(&cmd.FromKeyfile, "from-keyfile", "", "Keyfile of the source volume, if it is not mounted")
+			fs.StringVar(&cmd.Bootstrap, "bootstrap", "", "Path to bootstrap YAML authorizing the target volume")
+			reuseTokenFlag(fs, cmd)
+		}},
+	{name: "support-bundle", args: "[--file=bundle.tar.gz]",
+		summary: "Collect redacted logs, configuration and diagnostics into a tarball",
+		flags: func(fs *flag.FlagSet, cmd *Command) {
+			fs.StringVar(&cmd.BundleFile, "file", "", "Path of the tarball (default udm-support-<mapper>-<time>.tar.gz)")
+		}},
+	{name: "init", alias: "init", args: "[--config=config.yml]",
+		summary: "Ask a few questions and write a validated configuration"},
+	{name: "validate-config", alias: "validate-config",
+		summary: "Check the configuration for unknown keys, type mismatches and conflicting options"},
+	{name: "completion", args: "bash|zsh",
+		summary: "Print a shell completion script"},
+	{name: "help", args: "[command]",
+		summary: "Show help for udm or a command"},
+}
+
+func holderFlag(fs *flag.FlagSet, cmd *Command) {
+	fs.StringVar(&cmd.Holder, "holder", "", "Consumer id for reference counting")
+}
+
+func reuseTokenFlag(fs *flag.FlagSet, cmd *Command) {
+	fs.BoolVar(&cmd.ReuseToken, "reuse-token", false, "Allow a bootstrap token already used on this device")
+}
+
+func backupKeyFlag(fs *flag.FlagSet, cmd *Command) {
+	fs.StringVar(&cmd.BackupKey, "backup-key", "", "File holding the 32-byte key encrypting the backup")
+}
+
+func unmountFlags(fs *flag.FlagSet, cmd *Command) {
+	holderFlag(fs, cmd)
+	fs.BoolVar(&cmd.KillUsers, "kill-users", false, "Terminate processes using the mount point instead of failing")
+}
+
+func leaseFlag(fs *flag.FlagSet, cmd *Command) {
+	fs.DurationVar(&cmd.Lease, "lease", 0, "Lease TTL, the holder must renew before it expires")
+}
+
+func tenantFlag(fs *flag.FlagSet, cmd *Command) {
+	fs.StringVar(&cmd.Tenant, "tenant", "", "Only show volumes of this tenant")
+}
+
+func slotFlag(fs *flag.FlagSet, cmd *Command) {
+	fs.IntVar(&cmd.Slot, "slot", -1, "Keyslot")
+}
+
+// commonFlags registers the flags shared by every command.
+func commonFlags(fs *flag.FlagSet, cmd *Command) {
+	fs.StringVar(&cmd.Config, "config", "", "Path to config YAML (default layered from /etc/udm, /run/udm and $XDG_CONFIG_HOME/udm)")
+	fs.StringVar(&cmd.Keyfile, "keyfile", "", "Path to the keyfile (output for authorize, input for other commands), - for stdin or stdout")
+	fs.IntVar(&cmd.KeyFD, "key-fd", 0, "Inherited file descriptor to use as the keyfile, e.g. 3")
+	fs.BoolVar(&cmd.InsecureKeyfile, "insecure-keyfile", false, "Read keyfiles other users can access, with a warning")
+	fs.BoolVar(&cmd.Quiet, "quiet", false, "Suppress progress output of long-running operations")
+	fs.BoolVar(&cmd.JSONProgress, "json-progress", false, "Emit progress as JSON events on stderr")
+	fs.StringVar(&cmd.PassphraseFile, "passphrase-file", "", "Passphrase wrapping the keyfile (or set UDM_KEYFILE_PASSPHRASE)")
+	fs.StringVar(&cmd.Output, "output", "table", "Result format: table, json or quiet")
+	fs.DurationVar(&cmd.WaitLock, "wait-lock", 0, "How long to wait for another instance to release the volume lock")
+	fs.StringVar(&cmd.TPMDevice, "tpm-device", "", "TPM device node or TCTI, overriding tpm.device (e.g. /dev/tpm0)")
+	fs.BoolVar(&cmd.Verbose, "verbose", false, "Log every external command with its duration and exit code, secrets redacted")
+	fs.BoolVar(&cmd.Verbose, "trace", false, "Same as --verbose")
+}
+
+func findCommand(name string) *commandSpec {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+// newFlagSet returns the flag set of spec, bound to cmd.
+func newFlagSet(spec *commandSpec, cmd *Command) *flag.FlagSet {
+	fs := flag.NewFlagSet("udm "+spec.name, flag.ExitOnError)
+	commonFlags(fs, cmd)
+	if spec.flags != nil {
+		spec.flags(fs, cmd)
+	}
+	fs.Usage = func() { printCommandHelp(fs.Output(), spec, fs) }
+	return fs
+}
+
+// parseSubcommand parses "udm <command> [flags] [args]".
+func parseSubcommand(args []string) (Command, error) {
+	var cmd Command
+	spec := findCommand(args[0])
+	if spec == nil {
+		return cmd, fmt.Errorf("unknown command %q, run 'udm help' for a list of commands", args[0])
+	}
+	cmd.CommandName = spec.name
+	fs := newFlagSet(spec, &cmd)
+	fs.Parse(args[1:])
+	cmd.Topic = fs.Arg(0)
+	return cmd, nil
+}
+
+// parseLegacyFlags parses the deprecated "udm --mount [flags]" form, where the command is
+// selected by a boolean flag and every command's flags are accepted.
+func parseLegacyFlags(args []string) Command {
+	var cmd Command
+	fs := flag.NewFlagSet("udm", flag.ExitOnError)
+	fs.Usage = func() { PrintHelp(fs.Output(), "") }
+	commonFlags(fs, &cmd)
+
+	selected := make(map[string]*bool)
+	for i := range commands {
+		spec := &commands[i]
+		if spec.alias == "" {
+			continue
+		}
+		selected[spec.name] = fs.Bool(spec.alias, false, "Deprecated: use 'udm "+spec.name+"'")
+
+		// Commands share some flags, which are bound to the same field
+		own := flag.NewFlagSet(spec.name, flag.ContinueOnError)
+		if spec.flags != nil {
+			spec.flags(own, &cmd)
+		}
+		own.VisitAll(func(f *flag.Flag) {
+			if fs.Lookup(f.Name) == nil {
+				fs.Var(f.Value, f.Name, f.Usage)
+			}
+		})
+	}
+	fs.Parse(args)
+
+	cmd.CommandName = "help"
+	for _, spec := range commands {
+		if set := selected[spec.name]; set != nil && *set {
+			cmd.CommandName = spec.name
+			fmt.Fprintf(os.Stderr, "Warning: --%s is deprecated, use 'udm %s'\n", spec.alias, spec.name)
+			break
+		}
+	}
+	return cmd
+}
+
+// PrintHelp prints the command list, or the help of a single command.
+func PrintHelp(w io.Writer, topic string) {
+	if topic != "" {
+		spec := findCommand(topic)
+		if spec == nil {
+			fmt.Fprintf(w, "Unknown command %q\n\n", topic)
+		} else {
+			var cmd Command
+			printCommandHelp(w, spec, newFlagSet(spec, &cmd))
+			return
+		}
+	}
+
+	fmt.Fprintln(w, "Usage: udm <command> [options]")
+	fmt.Fprintln(w, "\nCommands:")
+	for _, spec := range commands {
+		fmt.Fprintf(w, "  %-25s %s\n", spec.name, spec.summary)
+	}
+	fmt.Fprintln(w, "\nOptions accepted by every command:")
+	fs := flag.NewFlagSet("udm", flag.ContinueOnError)
+	fs.SetOutput(w)
+	var cmd Command
+	commonFlags(fs, &cmd)
+	fs.PrintDefaults()
+	fmt.Fprintln(w, "\nRun 'udm help <command>' or 'udm <command> -h' for the options of a command.")
+	fmt.Fprintln(w, "The former 'udm --<command>' form is deprecated but still accepted.")
+}
+
+func printCommandHelp(w io.Writer, spec *commandSpec, fs *flag.FlagSet) {
+	fmt.Fprintf(w, "Usage: udm %s [options] %s\n\n%s\n\nOptions:\n", spec.name, spec.args, spec.summary)
+	fs.SetOutput(w)
+	fs.PrintDefaults()
+}
+
+// PrintCompletion prints a completion script for shell, generated from the command table.
+func PrintCompletion(w io.Writer, shell string) error {
+	if shell != "bash" && shell != "zsh" {
+		return fmt.Errorf("unsupported shell %q, want bash or zsh", shell)
+	}
+
+	var names []string
+	var cases strings.Builder
+	for _, spec := range commands {
+		names = append(names, spec.name)
+
+		var cmd Command
+		var flags []string
+		newFlagSet(&spec, &cmd).VisitAll(func(f *flag.Flag) {
+			flags = append(flags, "--"+f.Name)
+		})
+		sort.Strings(flags)
+		fmt.Fprintf(&cases, "        %s) opts=%q ;;\n", spec.name, strings.Join(flags, " "))
+	}
+
+	if shell == "zsh" {
+		fmt.Fprintln(w, "autoload -U +X bashcompinit && bashcompinit")
+	}
+	fmt.Fprintf(w, `_udm() {
+    local cur=${COMP_WORDS[COMP_CWORD]} opts
+    if [ "$COMP_CWORD" -eq 1 ]; then
+        COMPREPLY=($(compgen -W %q -- "$cur"))
+        return
+    fi
+    case "${COMP_WORDS[1]}" in
+%s        *) opts="" ;;
+    esac
+    COMPREPLY=($(compgen -W "$opts" -- "$cur"))
+}
+complete -o default -F _udm udm
+`, strings.Join(names, " "), cases.String())
+	return nil
+}
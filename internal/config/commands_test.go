@@ -0,0 +1,68 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSubcommand(t *testing.T) {
+	cmd, err := parseSubcommand([]string{"mount", "--config=c.yml", "--holder=docker", "--lease=5m"})
+	if err != nil {
+		t.Fatalf("parseSubcommand() error = %v, want nil", err)
+	}
+	if cmd.CommandName != "mount" || cmd.Config != "c.yml" || cmd.Holder != "docker" || cmd.Lease != 5*time.Minute {
+		t.Fatalf("parseSubcommand() = %+v, want mount with holder and lease", cmd)
+	}
+
+	cmd, err = parseSubcommand([]string{"mount", "--read-only"})
+	if err != nil || !cmd.ReadOnly {
+		t.Fatalf("parseSubcommand(mount --read-only) = %+v, %v, want read-only mount", cmd, err)
+	}
+
+	cmd, err = parseSubcommand([]string{"list", "--tenant=acme"})
+	if err != nil || cmd.Tenant != "acme" {
+		t.Fatalf("parseSubcommand(list --tenant) = %+v, %v, want list scoped to acme", cmd, err)
+	}
+
+	cmd, err = parseSubcommand([]string{"panic", "--yes", "--discard"})
+	if err != nil || cmd.CommandName != "panic" || !cmd.Yes || !cmd.Discard {
+		t.Fatalf("parseSubcommand(panic) = %+v, %v, want confirmed panic with discard", cmd, err)
+	}
+
+	cmd, err = parseSubcommand([]string{"deauthorize", "--yes", "--force"})
+	if err != nil || !cmd.Yes || !cmd.Force {
+		t.Fatalf("parseSubcommand(deauthorize) = %+v, %v, want confirmed and forced deauthorize", cmd, err)
+	}
+
+	if _, err := parseSubcommand([]string{"mountt"}); err == nil {
+		t.Fatalf("parseSubcommand(unknown) error = nil, want error")
+	}
+}
+
+func TestParseLegacyFlags(t *testing.T) {
+	cmd := parseLegacyFlags([]string{"--removeKey", "--slot=2", "--config=c.yml"})
+	if cmd.CommandName != "remove-key" || cmd.Slot != 2 || cmd.Config != "c.yml" {
+		t.Fatalf("parseLegacyFlags() = %+v, want remove-key on slot 2", cmd)
+	}
+
+	// --read-only is registered by mount first, serve-nbd must see it too
+	cmd = parseLegacyFlags([]string{"--serve-nbd", "--read-only"})
+	if cmd.CommandName != "serve-nbd" || !cmd.ReadOnly {
+		t.Fatalf("parseLegacyFlags(--serve-nbd --read-only) = %+v, want read-only serve-nbd", cmd)
+	}
+
+	if cmd := parseLegacyFlags(nil); cmd.CommandName != "help" {
+		t.Fatalf("parseLegacyFlags(nil) command = %q, want help", cmd.CommandName)
+	}
+}
+
+func TestPrintCompletion(t *testing.T) {
+	var out strings.Builder
+	if err := PrintCompletion(&out, "bash"); err != nil {
+		t.Fatalf("PrintCompletion() error = %v, want nil", err)
+	}
+	if !strings.Contains(out.String(), `add-key) opts="--config --insecure-keyfile --json-progress --key-fd --keyfile --new-keyfile`) {
+		t.Fatalf("PrintCompletion() does not complete add-key flags:\n%s", out.String())
+	}
+}
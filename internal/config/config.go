@@ -1,25 +1,141 @@
 package config
 
 import (
+	"bootstrap/internal/attest"
+	"bootstrap/internal/audit"
+	"bootstrap/internal/dbus"
+	"bootstrap/internal/features"
+	"bootstrap/internal/hooks"
+	"bootstrap/internal/identity"
 	"bootstrap/internal/luks"
+	"bootstrap/internal/metrics"
+	"bootstrap/internal/report"
+	"bootstrap/internal/telemetry"
+	"bootstrap/internal/webhook"
+	"time"
 )
 
 type Command struct {
-	CommandName string // Command to execute
-	Config      string // Path to config YAML
-	Bootstrap   string // Path to bootstrap YAML
-	Keyfile     string // Path to keyfile
+	CommandName string   // Command to execute
+	Config      string   // Path to config YAML, the first layer when searched
+	ConfigFiles []string // Configuration layers, later ones overriding earlier keys
+	Bootstrap   string   // Path to bootstrap YAML
+	ReuseToken  bool     // Authorize with a bootstrap token already used on this device
+	Keyfile     string   // Path to keyfile, KeyfileStdio for stdin or stdout
+	KeyFD       int      // Inherited file descriptor used as the keyfile
+
+	InsecureKeyfile bool // Read keyfiles other users can access
+	FixPermissions  bool // healthcheck restricts the keyfile permissions and owner
+
+	PassphraseFile string // Path to the passphrase wrapping the keyfile
+	Snapshot       bool   // Take a read-only snapshot while frozen
+	NewKeyfile     string // Path to the key added by --addKey
+	Slot           int    // Keyslot for --addKey and --removeKey, -1 for any
+	Holder         string // Consumer id holding the volume across --mount and --unmount
+	KillUsers      bool   // Terminate processes using the mount point before unmounting
+	ReadOnly       bool   // mount opens and mounts the volume read-only, in addition to luks.readOnly; serve-nbd requires it
+
+	Lease time.Duration // Mount lease TTL, zero holds the volume until unmounted
+	NBD   NBDOptions    // Options of serve-nbd
+
+	Topic      string        // Positional argument of help (command) and completion (shell)
+	BundleFile string        // Output of support-bundle
+	EscrowFile string        // Output of export-escrow, overriding luks.escrow.path
+	VolumeKey  string        // Volume key unwrapped from an escrow blob, for recover
+	Backup     string        // Target of backup or source of restore, a path or http(s) URL
+	BackupKey  string        // Key encrypting backups, generated by backup when missing
+	UnlockTime time.Duration // Unlock time benchmark tunes the PBKDFs to
+	UseTPM     bool          // selftest keeps the key in a temporary TPM NV index
+	DryRun     bool          // Report what reconcile would change without changing it
+	Persistent bool          // check also expects the persistent mount of add-persistent-mount
+	Tenant     string        // Scopes list and status to the volumes of a tenant
+	ConfigDir  string        // Directory of volume configs for provision-all
+	KeyfileDir string        // Directory of the per-volume keyfiles of provision-all
+	Jobs       int           // Volumes provision-all mounts concurrently
+
+	UserDataSource string // Where provision-cloud reads the user-data: auto, cloud-init, ec2 or openstack
+
+	Yes     bool // Confirms a destructive command run without a prompt
+	Force   bool // deauthorize removes a mounted volume that processes still use
+	Discard bool // panic also discards the backing storage, in addition to luks.panic.discard
+
+	FromConfig  string // Config of the volume migrate copies from
+	ToConfig    string // Config of the volume migrate provisions and copies to
+	FromKeyfile string // Keyfile of the source volume, if migrate has to mount it
+
+	Quiet        bool          // Suppress progress output
+	JSONProgress bool          // Emit progress as JSON events
+	WaitLock     time.Duration // How long to wait for another instance to release the volume lock
+	TPMDevice    string        // Overrides tpm.device
+	Verbose      bool          // Log external commands, overriding verbose
+
+	Output string // Result format: table, json or quiet
+}
+
+// KeyfileStdio as --keyfile reads the key from stdin, or writes it to stdout for
+// authorize, so it never touches the disk.
+const KeyfileStdio = "-"
+
+// NBDOptions configures the --serve-nbd export.
+type NBDOptions struct {
+	Listen   string        // Listen address
+	TLSCert  string        // Server certificate
+	TLSKey   string        // Server private key
+	TLSCA    string        // CA that client certificates must be signed by
+	Duration time.Duration // Serving time limit
 }
 
 type BootstrapToken struct {
 	Bootstrap struct {
 		TokenId string `yaml:"token-id"`
 		Version string `yaml:"version"`
+
+		// Claims constraining what the device may provision, enforced by authorize
+		Expires  time.Time `yaml:"expires"`   // Token is rejected after this time
+		DeviceId string    `yaml:"device-id"` // Must match /etc/machine-id
+		Policy   Claims    `yaml:"policy"`
 	} `yaml:"bootstrap"`
 }
 
+// Claims are the provisioning limits a central authority grants a device.
+type Claims struct {
+	MinSize     int      `yaml:"min-size"`     // Smallest volume in MB
+	MaxSize     int      `yaml:"max-size"`     // Largest volume in MB
+	MountPoints []string `yaml:"mount-points"` // Allowed mount points, shell patterns
+}
+
 type AppConfig struct {
 	Cmd     Command   // Command to execute
-	Verbose *bool     // Verbose logging
-	LUKS    luks.LUKS `yaml:"luks"` // LUKS configuration
+	Verbose *bool     `yaml:"verbose"` // Log external commands, like --verbose
+	LUKS    luks.LUKS `yaml:"luks"`    // LUKS configuration
+
+	Schedule []ScheduledTask `yaml:"schedule"` // Maintenance tasks run by the daemon
+	Audit    audit.Config    `yaml:"audit"`    // Audit log of privileged operations
+	Features features.Set    `yaml:"features"` // Flags enabling new behaviors progressively
+	Metrics  metrics.Config  `yaml:"metrics"`  // Prometheus endpoint of the daemon
+
+	Identity identity.Config `yaml:"identity"` // Device certificate enrolled during authorize
+	Retry    luks.Retry      `yaml:"retry"`    // Retries of transiently failing external commands
+	Timeouts luks.Timeouts   `yaml:"timeouts"` // Time limits of external commands
+	Report   report.Config   `yaml:"report"`   // Signed provisioning report written after authorize
+	TPM      luks.TPM        `yaml:"tpm"`      // TPM device or simulator used by tpm2-tools
+	DBus     dbus.Config     `yaml:"dbus"`     // D-Bus service of the daemon
+
+	Attestation attest.Config    `yaml:"attestation"` // Remote attestation required before the key is read from the TPM
+	Hooks       hooks.Config     `yaml:"hooks"`       // Executables run before and after each lifecycle phase
+	Telemetry   telemetry.Config `yaml:"telemetry"`   // OTLP collector receiving spans of authorize, mount and unmount
+	Webhooks    []webhook.Config `yaml:"webhooks"`    // Endpoints notified of lifecycle events
+}
+
+// Maintenance tasks the daemon can schedule.
+const (
+	TaskFstrim       = "fstrim"       // Discard unused blocks of the mounted filesystem
+	TaskHeaderCheck  = "headerCheck"  // Compare the LUKS header against the recorded one
+	TaskHealthReport = "healthReport" // Log mount state and filesystem usage
+)
+
+// ScheduledTask runs a maintenance task on a cron-like schedule.
+type ScheduledTask struct {
+	Task string `yaml:"task"` // One of the Task constants
+	When string `yaml:"when"` // Cron expression, @daily etc. or "@every 1h"
 }
@@ -1,64 +1,73 @@
 package config
 
 import (
-	"flag"
+	"bootstrap/internal/attest"
+	"bootstrap/internal/luks"
+	"bootstrap/internal/schedule"
+	"bytes"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
+var tenantName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// ParseCommandLine parses "udm <command> [options]", or the deprecated "udm --<command>
+// [options]" form.
 func ParseCommandLine() Command {
+	args := os.Args[1:]
+
 	var cmd Command
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		var err error
+		if cmd, err = parseSubcommand(args); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(2)
+		}
+	} else {
+		cmd = parseLegacyFlags(args)
+	}
 
-	// Define flags
-	authorize := flag.Bool("authorize", false, "Authorize with a bootstrap file and configuration")
-	bootstrap := flag.String("bootstrap", "", "Path to bootstrap YAML (required for --authorize)")
-	config := flag.String("config", "", "Path to config YAML")
-	deauthorize := flag.Bool("deauthorize", false, "Deauthorize")
-	mount := flag.Bool("mount", false, "Mount a keyfile")
-	unmount := flag.Bool("unmount", false, "Unmount a configuration")
-	addPersistentMount := flag.Bool("addPersistentMount", false, "Add a persistent mount")
-	removePersistentMount := flag.Bool("removePersistentMount", false, "Remove a persistent mount")
-	keyfile := flag.String("keyfile", "", "Path to keyfile")
-
-	// Parse flags
-	flag.Parse()
-
-	// If no --config is provided, try loading config.yml from the current directory
-	if *config == "" {
-		defaultConfigPath := filepath.Join(getCurrentDirectory(), "config.yml")
-		if _, err := os.Stat(defaultConfigPath); os.IsNotExist(err) {
-			fmt.Println("Error: --config is required and no default config.yml found in the current directory")
-			os.Exit(1)
-		}
-		*config = defaultConfigPath
-	}
-
-	// Determine command based
-	switch {
-	case *authorize:
-		cmd.CommandName = "authorize"
-		cmd.Bootstrap = *bootstrap
-	case *deauthorize:
-		cmd.CommandName = "deauthorize"
-	case *mount:
-		cmd.CommandName = "mount"
-	case *unmount:
-		cmd.CommandName = "unmount"
-	case *addPersistentMount:
-		cmd.CommandName = "addPersistentMount"
-	case *removePersistentMount:
-		cmd.CommandName = "removePersistentMount"
-	default:
-		cmd.CommandName = "help"
+	if cmd.KeyFD > 0 {
+		if cmd.Keyfile != "" {
+			fmt.Fprintln(os.Stderr, "Error: --keyfile and --key-fd cannot be combined")
+			os.Exit(2)
+		}
+		cmd.Keyfile = fmt.Sprintf("/dev/fd/%d", cmd.KeyFD)
 	}
 
-	// Assign common flag values to the command structure
-	cmd.Config = *config
-	cmd.Keyfile = *keyfile
+	// help, completion, benchmark, selftest and list need no configuration, provision-all, migrate
+	// and provision-cloud read their own
+	switch cmd.CommandName {
+	case "help", "completion", "benchmark", "selftest", "list", "provision-all", "migrate", "provision-cloud":
+		return cmd
+	case "init":
+		// init writes the configuration, by default where the other commands look for it
+		if cmd.Config == "" {
+			cmd.Config = DefaultConfigPath()
+		}
+		return cmd
+	}
 
+	// Without --config, layer the configuration found in the search directories
+	if cmd.Config != "" {
+		cmd.ConfigFiles = []string{cmd.Config}
+		return cmd
+	}
+	cmd.ConfigFiles = SearchConfig()
+	if len(cmd.ConfigFiles) == 0 {
+		fmt.Printf("Error: --config is required, no config.yml or config.d/*.yml found in %s\n", strings.Join(configDirs(), ", "))
+		os.Exit(1)
+	}
+	cmd.Config = cmd.ConfigFiles[0]
 	return cmd
 }
 
@@ -102,44 +111,175 @@ func (cfg *BootstrapToken) Validate() error {
 	return nil
 }
 
+// LoadConfig reads and validates a single configuration file.
 func LoadConfig(filePath string) (*AppConfig, error) {
-	fmt.Printf("Reading settings from file: %s\n", filePath)
+	return LoadConfigFiles([]string{filePath})
+}
 
-	// Parse the YML file
+// LoadConfigFiles reads configuration layers, later files overriding the keys of
+// earlier ones, and validates the result. Issues name their file when there are
+// several layers.
+func LoadConfigFiles(paths []string) (*AppConfig, error) {
 	var cfg AppConfig
+	var merged *yaml.Node
+	var issues []Issue
+	s := &schema{lines: map[string]int{}, files: map[string]string{}}
 
-	// Open the YML file
-	file, err := os.Open(filePath)
-	if err != nil {
-		return &cfg, fmt.Errorf("failed to open file: %w", err)
+	for _, filePath := range paths {
+		fmt.Printf("Reading settings from file: %s\n", filePath)
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			return &cfg, fmt.Errorf("failed to open file: %w", err)
+		}
+		var doc yaml.Node
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return &cfg, fmt.Errorf("failed to parse YAML file %s: %w", filePath, err)
+		}
+		file := ""
+		if len(paths) > 1 {
+			file = filePath
+		}
+
+		// Unknown keys and type mismatches are reported together, with their lines
+		layer := checkSchema(&doc)
+		fileIssues := layer.issues
+		var scratch AppConfig
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&scratch); err != nil && err != io.EOF {
+			typeErr, ok := err.(*yaml.TypeError)
+			if !ok {
+				return &cfg, fmt.Errorf("failed to parse YAML file %s: %w", filePath, err)
+			}
+			fileIssues = append(fileIssues, typeIssues(typeErr)...)
+		}
+		sort.SliceStable(fileIssues, func(i, j int) bool { return fileIssues[i].Line < fileIssues[j].Line })
+		for i := range fileIssues {
+			fileIssues[i].File = file
+		}
+		issues = append(issues, fileIssues...)
+		s.override(layer, file)
+
+		if len(doc.Content) == 0 {
+			continue
+		}
+		if merged == nil {
+			merged = doc.Content[0]
+		} else {
+			mergeNode(merged, doc.Content[0])
+		}
+	}
+	if len(issues) > 0 {
+		return nil, fmt.Errorf("invalid configuration: %w", &ValidationError{Issues: issues})
+	}
+	if merged != nil {
+		if err := merged.Decode(&cfg); err != nil {
+			return &cfg, fmt.Errorf("failed to parse YAML file: %w", err)
+		}
 	}
-	defer file.Close()
 
-	decoder := yaml.NewDecoder(file)
-	if err := decoder.Decode(&cfg); err != nil {
-		return &cfg, fmt.Errorf("failed to parse YAML file: %w", err)
+	// Device-specific values are resolved before they are validated
+	if err := cfg.expandTemplates(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", &ValidationError{Issues: []Issue{s.validateIssue(err)}})
 	}
 
 	// Validate
 	if err := cfg.Validate(); err != nil {
-		return nil, fmt.Errorf("invalid configuration: %v", err)
+		return nil, fmt.Errorf("invalid configuration: %w", &ValidationError{Issues: []Issue{s.validateIssue(err)}})
 	}
 	return &cfg, nil
 }
 
 func (cfg *AppConfig) Validate() error {
 
+	// Tenants name their volumes independently, so names derived from the mapper name
+	// below are scoped by the prefixed name
+	if tenant := cfg.LUKS.Tenant; tenant != "" {
+		if !tenantName.MatchString(tenant) {
+			return fmt.Errorf("luks.tenant (%s) must be lowercase letters, digits and dashes", tenant)
+		}
+		if cfg.LUKS.MapperName != "" && !strings.HasPrefix(cfg.LUKS.MapperName, tenant+"-") {
+			cfg.LUKS.MapperName = tenant + "-" + cfg.LUKS.MapperName
+		}
+	}
+	if lvm := &cfg.LUKS.LVM; lvm.Enabled() {
+		if lvm.Name == "" {
+			lvm.Name = cfg.LUKS.MapperName
+		}
+		if !luks.ValidLVMName(lvm.VolumeGroup) || !luks.ValidLVMName(lvm.Name) {
+			return fmt.Errorf("luks.lvm volume group (%s) and name (%s) must be valid LVM names", lvm.VolumeGroup, lvm.Name)
+		}
+		if cfg.LUKS.VolumePath == "" {
+			cfg.LUKS.VolumePath = lvm.DevicePath()
+		} else if cfg.LUKS.VolumePath != lvm.DevicePath() {
+			return fmt.Errorf("luks.volumePath (%s) must be %s or omitted with luks.lvm", cfg.LUKS.VolumePath, lvm.DevicePath())
+		}
+	}
+	switch cfg.LUKS.Profile {
+	case "":
+		cfg.LUKS.Profile = luks.ProfileData
+	case luks.ProfileData:
+	case luks.ProfileSwap, luks.ProfileTmp:
+		// A new random key maps the volume every time, nothing persists it
+		cfg.LUKS.Ephemeral = true
+		if cfg.LUKS.KeyBytes == 0 {
+			cfg.LUKS.KeyBytes = luks.MinKeyBytes // Unused, plain dm-crypt keys are luks.keySize bits
+		}
+		if cfg.LUKS.MountPoint == "" {
+			cfg.LUKS.MountPoint = "/tmp"
+			if cfg.LUKS.Profile == luks.ProfileSwap {
+				cfg.LUKS.MountPoint = luks.SwapMountPoint
+			}
+		}
+		switch {
+		case cfg.LUKS.Profile == luks.ProfileSwap && cfg.LUKS.MountPoint != luks.SwapMountPoint:
+			return fmt.Errorf("luks.mountPoint (%s) must be %s or omitted with luks.profile swap", cfg.LUKS.MountPoint, luks.SwapMountPoint)
+		case cfg.LUKS.Integrity != "":
+			return fmt.Errorf("luks.profile %s cannot be combined with luks.integrity", cfg.LUKS.Profile)
+		case cfg.LUKS.Private.Enabled():
+			return fmt.Errorf("luks.profile %s cannot be combined with luks.private", cfg.LUKS.Profile)
+		case cfg.LUKS.ReadOnly:
+			return fmt.Errorf("luks.profile %s cannot be combined with luks.readOnly", cfg.LUKS.Profile)
+		case len(cfg.LUKS.BindMounts) > 0:
+			return fmt.Errorf("luks.profile %s cannot be combined with luks.bindMounts", cfg.LUKS.Profile)
+		case strings.HasPrefix(cfg.LUKS.VolumePath, "/dev/") && !cfg.LUKS.LVM.Enabled() && !luks.StableDevicePath(cfg.LUKS.VolumePath):
+			// Without a header nothing tells the device apart, a renumbered disk would be
+			// overwritten with random data at the next boot
+			return fmt.Errorf("luks.volumePath (%s) of luks.profile %s must be a stable device path under %s", cfg.LUKS.VolumePath, cfg.LUKS.Profile, strings.Join(luks.StableDeviceDirs, ", "))
+		}
+		if cfg.LUKS.Profile == luks.ProfileTmp {
+			// Like a tmpfs /tmp, nobody gains devices or privileges through it
+			for _, opt := range []string{"nodev", "nosuid"} {
+				if !slices.Contains(cfg.LUKS.MountOptions, opt) {
+					cfg.LUKS.MountOptions = append(cfg.LUKS.MountOptions, opt)
+				}
+			}
+		}
+	default:
+		return fmt.Errorf("luks.profile (%s) must be %s, %s or %s", cfg.LUKS.Profile, luks.ProfileData, luks.ProfileSwap, luks.ProfileTmp)
+	}
 	if cfg.LUKS.VolumePath == "" {
-		return fmt.Errorf("luks.volume-path is required")
+		return fmt.Errorf("luks.volumePath is required")
 	}
 	if cfg.LUKS.MapperName == "" {
-		return fmt.Errorf("luks.mapper-name is required")
+		return fmt.Errorf("luks.mapperName is required")
 	}
 	if cfg.LUKS.MountPoint == "" {
-		return fmt.Errorf("luks.mount-point is required")
+		return fmt.Errorf("luks.mountPoint is required")
+	}
+	if cfg.LUKS.KeyBytes == 0 && cfg.LUKS.PasswordLength != 0 {
+		// Configs written before luks.keyBytes existed keep their key length so
+		// existing volumes can still be opened; new keys must meet the minimum.
+		fmt.Printf("Warning: luks.passwordLength is deprecated, migrating to luks.keyBytes: %d\n", cfg.LUKS.PasswordLength)
+		cfg.LUKS.KeyBytes = cfg.LUKS.PasswordLength
+	} else if cfg.LUKS.KeyBytes != 0 && cfg.LUKS.KeyBytes < luks.MinKeyBytes {
+		return fmt.Errorf("luks.keyBytes (%d) must be at least %d bytes", cfg.LUKS.KeyBytes, luks.MinKeyBytes)
 	}
-	if cfg.LUKS.PasswordLength == 0 {
-		return fmt.Errorf("luks.password-length is required")
+	if cfg.LUKS.KeyBytes == 0 {
+		return fmt.Errorf("luks.keyBytes is required")
+	}
+	if cfg.LUKS.KeyBytes > luks.MaxKeyBytes {
+		return fmt.Errorf("luks.keyBytes (%d) must be at most %d bytes", cfg.LUKS.KeyBytes, luks.MaxKeyBytes)
 	}
 	if cfg.LUKS.Size == 0 {
 		return fmt.Errorf("luks.size (MB) is required")
@@ -150,10 +290,372 @@ func (cfg *AppConfig) Validate() error {
 	if cfg.LUKS.Group == "" {
 		cfg.LUKS.Group = "root" // default value
 	}
+	if cfg.LUKS.TPMToken && !cfg.LUKS.UseTPM {
+		return fmt.Errorf("luks.tpmToken requires luks.useTPM")
+	}
+	if cfg.LUKS.Keyscript {
+		switch {
+		case !cfg.LUKS.UseTPM:
+			return fmt.Errorf("luks.keyscript requires luks.useTPM")
+		case cfg.LUKS.TPMToken:
+			return fmt.Errorf("luks.keyscript cannot be combined with luks.tpmToken")
+		}
+	}
+	if cfg.LUKS.Split.Enabled() {
+		if cfg.LUKS.Split.Threshold < 2 || cfg.LUKS.Split.Threshold > 3 {
+			return fmt.Errorf("luks.split.threshold (%d) must be 2 or 3", cfg.LUKS.Split.Threshold)
+		}
+		if cfg.LUKS.TPMToken {
+			return fmt.Errorf("luks.split cannot be combined with luks.tpmToken")
+		}
+	}
+	if cfg.LUKS.IdleTimeout != "" && !cfg.LUKS.Automount {
+		return fmt.Errorf("luks.idleTimeout requires luks.automount")
+	}
+	if cfg.LUKS.Automount && cfg.LUKS.IdleTimeout == "" {
+		cfg.LUKS.IdleTimeout = luks.DefaultIdleTimeout
+	}
+	if cfg.LUKS.Usage.Warn == 0 {
+		cfg.LUKS.Usage.Warn = luks.DefaultUsageWarn
+	}
+	if cfg.LUKS.Usage.Critical == 0 {
+		cfg.LUKS.Usage.Critical = max(luks.DefaultUsageCritical, cfg.LUKS.Usage.Warn)
+	}
+	if cfg.LUKS.Usage.Warn < 0 || cfg.LUKS.Usage.Warn > cfg.LUKS.Usage.Critical || cfg.LUKS.Usage.Critical > 100 {
+		return fmt.Errorf("luks.usage.warn (%.0f) and critical (%.0f) must be percentages with warn not above critical", cfg.LUKS.Usage.Warn, cfg.LUKS.Usage.Critical)
+	}
+	if cfg.LUKS.Usage.GrowBy < 0 || cfg.LUKS.Usage.MaxSize < 0 {
+		return fmt.Errorf("luks.usage.growBy and maxSize must not be negative")
+	}
+	if cfg.LUKS.Usage.GrowBy > 0 && cfg.LUKS.Ephemeral {
+		return fmt.Errorf("luks.usage.growBy cannot be combined with luks.ephemeral")
+	}
+	if cfg.LUKS.AutoLock != "" {
+		if d, err := time.ParseDuration(cfg.LUKS.AutoLock); err != nil || d <= 0 {
+			return fmt.Errorf("luks.autoLock (%s) must be a positive duration, e.g. 30m", cfg.LUKS.AutoLock)
+		}
+		if cfg.LUKS.Automount {
+			return fmt.Errorf("luks.autoLock cannot be combined with luks.automount, use luks.idleTimeout")
+		}
+	}
+	switch cfg.LUKS.KeyfileWrap {
+	case "":
+		cfg.LUKS.KeyfileWrap = luks.KeyfileWrapNone
+	case luks.KeyfileWrapNone, luks.KeyfileWrapPassphrase, luks.KeyfileWrapTPM, luks.KeyfileWrapSystemdCreds:
+	default:
+		return fmt.Errorf("luks.keyfileWrap (%s) must be none, passphrase, tpm or systemd-creds", cfg.LUKS.KeyfileWrap)
+	}
+	if cfg.LUKS.Credential == "" {
+		cfg.LUKS.Credential = cfg.LUKS.MapperName
+	}
+	if cfg.LUKS.UseTPM && !cfg.LUKS.Split.Enabled() && cfg.LUKS.KeyfileWrap != luks.KeyfileWrapNone {
+		// The key lives in the TPM, authorize writes no keyfile to wrap
+		return fmt.Errorf("luks.keyfileWrap (%s) cannot be combined with luks.useTPM", cfg.LUKS.KeyfileWrap)
+	}
+	switch cfg.LUKS.Erase {
+	case "":
+		cfg.LUKS.Erase = luks.EraseHeader
+	case luks.EraseHeader, luks.EraseDiscard, luks.EraseOverwrite:
+	default:
+		return fmt.Errorf("luks.erase (%s) must be header, discard or overwrite", cfg.LUKS.Erase)
+	}
+	if cfg.LUKS.Ephemeral {
+		// Nothing may persist the key or reopen the volume
+		switch {
+		case cfg.LUKS.UseTPM:
+			return fmt.Errorf("luks.ephemeral cannot be combined with luks.useTPM")
+		case cfg.LUKS.Split.Enabled():
+			return fmt.Errorf("luks.ephemeral cannot be combined with luks.split")
+		case cfg.LUKS.Recovery.Enabled:
+			return fmt.Errorf("luks.ephemeral cannot be combined with luks.recovery")
+		case cfg.LUKS.AllowPassphrase:
+			return fmt.Errorf("luks.ephemeral cannot be combined with luks.allowPassphrase")
+		case cfg.LUKS.FIDO2.Enabled:
+			return fmt.Errorf("luks.ephemeral cannot be combined with luks.fido2")
+		case cfg.LUKS.Automount:
+			return fmt.Errorf("luks.ephemeral cannot be combined with luks.automount")
+		case cfg.LUKS.KeyfileWrap != luks.KeyfileWrapNone:
+			return fmt.Errorf("luks.ephemeral cannot be combined with luks.keyfileWrap (%s)", cfg.LUKS.KeyfileWrap)
+		}
+	}
+	if err := cfg.LUKS.Lockout.Validate(); err != nil {
+		return err
+	}
+	if err := cfg.LUKS.USBKey.Validate(); err != nil {
+		return err
+	}
+	if err := cfg.LUKS.Private.Validate(); err != nil {
+		return err
+	}
+	if cfg.LUKS.Private.Enabled() && cfg.LUKS.Automount {
+		return fmt.Errorf("luks.private cannot be combined with luks.automount")
+	}
+	if cfg.LUKS.Quiesce.Timeout != "" {
+		if _, err := time.ParseDuration(cfg.LUKS.Quiesce.Timeout); err != nil {
+			return fmt.Errorf("luks.quiesce.timeout (%s) is not a valid duration: %v", cfg.LUKS.Quiesce.Timeout, err)
+		}
+	}
+	if cfg.LUKS.Recovery.Enabled {
+		if cfg.LUKS.Recovery.Groups == 0 {
+			cfg.LUKS.Recovery.Groups = luks.DefaultRecoveryGroups
+		}
+		if cfg.LUKS.Recovery.Groups < 6 {
+			return fmt.Errorf("luks.recovery.groups (%d) must be at least 6", cfg.LUKS.Recovery.Groups)
+		}
+	}
+	if cfg.LUKS.Escrow.Enabled() {
+		if !filepath.IsAbs(cfg.LUKS.Escrow.PublicKey) {
+			return fmt.Errorf("luks.escrow.publicKey (%s) must be an absolute path", cfg.LUKS.Escrow.PublicKey)
+		}
+		if cfg.LUKS.Escrow.Path == "" {
+			cfg.LUKS.Escrow.Path = filepath.Join(luks.DefaultEscrowDir, cfg.LUKS.MapperName+".json")
+		}
+	}
+	switch cfg.LUKS.Integrity {
+	case "", luks.IntegrityHMACSHA256, luks.IntegrityHMACSHA512, luks.IntegrityAEAD, luks.IntegrityPoly1305:
+	default:
+		return fmt.Errorf("luks.integrity (%s) must be %s, %s, %s or %s", cfg.LUKS.Integrity,
+			luks.IntegrityHMACSHA256, luks.IntegrityHMACSHA512, luks.IntegrityAEAD, luks.IntegrityPoly1305)
+	}
+	if cfg.LUKS.Cipher == "" {
+		cfg.LUKS.Cipher = luks.IntegrityCipher(cfg.LUKS.Integrity)
+	}
+	if cfg.LUKS.Cipher == "" {
+		cfg.LUKS.Cipher = luks.DefaultCipher()
+	}
+	if required := luks.IntegrityCipher(cfg.LUKS.Integrity); required != "" && cfg.LUKS.Cipher != required {
+		return fmt.Errorf("luks.integrity %s requires luks.cipher %s", cfg.LUKS.Integrity, required)
+	}
+	if cfg.LUKS.Integrity != "" && strings.HasSuffix(cfg.LUKS.Cipher, "-random") && luks.IntegrityCipher(cfg.LUKS.Integrity) == "" {
+		return fmt.Errorf("luks.cipher %s is an AEAD cipher, use luks.integrity %s or %s", cfg.LUKS.Cipher, luks.IntegrityAEAD, luks.IntegrityPoly1305)
+	}
+	if cfg.LUKS.Integrity != "" && cfg.LUKS.Usage.GrowBy > 0 {
+		return fmt.Errorf("luks.integrity cannot be combined with luks.usage.growBy")
+	}
+	if cfg.LUKS.KeySize == 0 {
+		cfg.LUKS.KeySize = luks.DefaultKeySize(cfg.LUKS.Cipher, cfg.LUKS.Integrity)
+	}
+	if cfg.LUKS.KeySize < 0 || cfg.LUKS.KeySize%8 != 0 {
+		return fmt.Errorf("luks.keySize (%d bits) must be a positive multiple of 8", cfg.LUKS.KeySize)
+	}
+	if cfg.LUKS.PBKDF == "" {
+		cfg.LUKS.PBKDF = luks.PBKDFArgon2id
+	}
+	switch cfg.LUKS.PBKDF {
+	case luks.PBKDFArgon2id, luks.PBKDFArgon2i:
+		if cfg.LUKS.PBKDFMemory == 0 {
+			cfg.LUKS.PBKDFMemory = luks.DefaultPBKDFMemory()
+		}
+		if cfg.LUKS.PBKDFMemory < luks.MinPBKDFMemory || cfg.LUKS.PBKDFMemory > luks.MaxPBKDFMemory {
+			return fmt.Errorf("luks.pbkdfMemory (%d KiB) must be between %d and %d", cfg.LUKS.PBKDFMemory, luks.MinPBKDFMemory, luks.MaxPBKDFMemory)
+		}
+	case luks.PBKDFPBKDF2:
+		if cfg.LUKS.PBKDFMemory != 0 {
+			return fmt.Errorf("luks.pbkdfMemory cannot be used with pbkdf2")
+		}
+	default:
+		return fmt.Errorf("luks.pbkdf (%s) must be argon2id, argon2i or pbkdf2", cfg.LUKS.PBKDF)
+	}
+	if cfg.LUKS.PBKDFIterations < 0 {
+		return fmt.Errorf("luks.pbkdfIterations (%d) must not be negative", cfg.LUKS.PBKDFIterations)
+	}
+	for i, task := range cfg.Schedule {
+		switch task.Task {
+		case TaskFstrim, TaskHeaderCheck, TaskHealthReport:
+		default:
+			return fmt.Errorf("schedule[%d].task (%s) must be %s, %s or %s", i, task.Task, TaskFstrim, TaskHeaderCheck, TaskHealthReport)
+		}
+		if _, err := schedule.Parse(task.When); err != nil {
+			return fmt.Errorf("schedule[%d].when: %v", i, err)
+		}
+	}
+	if cfg.LUKS.TPMPCRs == "" {
+		cfg.LUKS.TPMPCRs = luks.DefaultTPMPCRs
+	}
+	switch cfg.LUKS.NVAuth.Mode {
+	case "":
+		cfg.LUKS.NVAuth.Mode = luks.NVAuthNone
+	case luks.NVAuthNone:
+	case luks.NVAuthPassword:
+		if cfg.LUKS.NVAuth.SecretFile == "" {
+			return fmt.Errorf("luks.nvAuth.secretFile is required with nvAuth mode password")
+		}
+	case luks.NVAuthPCR:
+		if cfg.LUKS.NVAuth.PCRs == "" {
+			cfg.LUKS.NVAuth.PCRs = "sha256:" + strings.ReplaceAll(cfg.LUKS.TPMPCRs, "+", ",")
+		}
+	default:
+		return fmt.Errorf("luks.nvAuth.mode (%s) must be none, password or pcr", cfg.LUKS.NVAuth.Mode)
+	}
+	if cfg.TPM.Version == luks.TPMVersion12 {
+		switch {
+		case cfg.LUKS.NVAuth.Mode != luks.NVAuthNone:
+			return fmt.Errorf("luks.nvAuth requires TPM 2.0, bind TPM 1.2 keys with tpm.sealPCRs")
+		case cfg.LUKS.TPMToken:
+			return fmt.Errorf("luks.tpmToken requires TPM 2.0")
+		}
+	} else if cfg.LUKS.UseTPM {
+		if cfg.LUKS.NVAuth.Mode == luks.NVAuthNone {
+			fmt.Println("Warning: luks.nvAuth.mode is none, any local user can read the key from the TPM")
+		}
+		// systemd-cryptsetup unlocks at boot through the token unless the keyscript is
+		// asked for, split keys need the keyscript to combine the shares
+		if !cfg.LUKS.Keyscript && !cfg.LUKS.Split.Enabled() {
+			cfg.LUKS.TPMToken = true
+		}
+	}
+	if cfg.LUKS.FIDO2.Enabled {
+		if cfg.LUKS.FIDO2.Device == "" {
+			cfg.LUKS.FIDO2.Device = luks.DefaultFIDO2Device
+		}
+		if cfg.LUKS.Split.Enabled() {
+			return fmt.Errorf("luks.fido2 cannot be combined with luks.split")
+		}
+	}
+	if err := cfg.LUKS.WaitDevice.Validate(); err != nil {
+		return err
+	}
+	if err := cfg.LUKS.KeyCache.Validate(); err != nil {
+		return err
+	}
+	if err := cfg.LUKS.HardwareBinding.Validate(); err != nil {
+		return err
+	}
+	if cfg.LUKS.HardwareBinding.Enabled() && ((cfg.LUKS.UseTPM && !cfg.LUKS.Split.Enabled()) || cfg.LUKS.Vault.Enabled() || cfg.LUKS.Ephemeral) {
+		return fmt.Errorf("luks.hardwareBinding binds the keyfile, it cannot be combined with a key kept in the TPM or Vault, or an ephemeral key")
+	}
+	if cfg.LUKS.KeyCache.Enabled() && (!cfg.LUKS.UseTPM || cfg.LUKS.Split.Enabled()) && !cfg.LUKS.Vault.Enabled() {
+		return fmt.Errorf("luks.keyCache requires luks.useTPM without luks.split, or luks.vault")
+	}
+	if err := cfg.LUKS.Vault.Validate(); err != nil {
+		return err
+	}
+	if cfg.LUKS.Vault.Enabled() {
+		// Vault is the only store of the key
+		switch {
+		case cfg.LUKS.UseTPM:
+			return fmt.Errorf("luks.vault cannot be combined with luks.useTPM")
+		case cfg.LUKS.Split.Enabled():
+			return fmt.Errorf("luks.vault cannot be combined with luks.split")
+		case cfg.LUKS.Ephemeral:
+			return fmt.Errorf("luks.vault cannot be combined with luks.ephemeral")
+		case cfg.LUKS.Automount:
+			return fmt.Errorf("luks.vault cannot be combined with luks.automount")
+		}
+	}
+	if cfg.LUKS.EnvFile != "" && !filepath.IsAbs(cfg.LUKS.EnvFile) {
+		return fmt.Errorf("luks.envFile (%s) must be an absolute path", cfg.LUKS.EnvFile)
+	}
+	for _, opt := range cfg.LUKS.MountOptions {
+		if opt == "" || strings.ContainsAny(opt, ", \t") {
+			return fmt.Errorf("luks.mountOptions entry %q must be a single mount option", opt)
+		}
+		if strings.HasPrefix(opt, "context=") {
+			return fmt.Errorf("luks.mountOptions entry %q must be set as luks.mac.selinuxContext", opt)
+		}
+	}
+	if err := cfg.LUKS.MAC.Validate(cfg.LUKS.MountPoint); err != nil {
+		return err
+	}
+	if err := luks.ValidateBindMounts(cfg.LUKS.BindMounts, cfg.LUKS.MountPoint); err != nil {
+		return err
+	}
+	if len(cfg.LUKS.BindMounts) > 0 && (cfg.LUKS.Private.Enabled() || cfg.LUKS.Automount) {
+		return fmt.Errorf("luks.bindMounts are made by udm mount and cannot be combined with luks.private or luks.automount")
+	}
+	if cfg.Identity.Enabled() && !strings.HasPrefix(cfg.Identity.ESTServer, "https://") {
+		return fmt.Errorf("identity.estServer (%s) must be an https URL", cfg.Identity.ESTServer)
+	}
+	if cfg.Attestation.Enabled() {
+		if !strings.HasPrefix(cfg.Attestation.URL, "https://") {
+			return fmt.Errorf("attestation.url (%s) must be an https URL", cfg.Attestation.URL)
+		}
+		if !cfg.LUKS.UseTPM && cfg.LUKS.KeyfileWrap != luks.KeyfileWrapTPM {
+			return fmt.Errorf("attestation requires luks.useTPM or luks.keyfileWrap tpm")
+		}
+		// The attestation is checked by udm only, the TPM itself must refuse the key
+		// to anyone reading the NV index past udm in a boot state that was not attested
+		switch {
+		case cfg.TPM.Version == luks.TPMVersion12 && len(cfg.TPM.SealPCRs) == 0:
+			return fmt.Errorf("attestation requires tpm.sealPCRs with TPM 1.2")
+		case cfg.TPM.Version != luks.TPMVersion12 && cfg.LUKS.NVAuth.Mode != luks.NVAuthPCR:
+			return fmt.Errorf("attestation requires luks.nvAuth.mode pcr")
+		}
+		if cfg.Attestation.PCRs == "" {
+			cfg.Attestation.PCRs = attest.DefaultPCRs
+		}
+		if cfg.Attestation.AKHandle == "" {
+			cfg.Attestation.AKHandle = attest.DefaultAKHandle
+		}
+	}
+	if cfg.Report.Enabled() && cfg.Report.SigningKey == "" {
+		return fmt.Errorf("report.signingKey is required to sign the provisioning report")
+	}
+	if cfg.Report.URL != "" && !strings.HasPrefix(cfg.Report.URL, "https://") && !strings.HasPrefix(cfg.Report.URL, "http://") {
+		return fmt.Errorf("report.url (%s) must be an http or https URL", cfg.Report.URL)
+	}
+	if err := cfg.Retry.Validate(); err != nil {
+		return err
+	}
+	if err := cfg.Timeouts.Validate(); err != nil {
+		return err
+	}
+	if err := cfg.TPM.Validate(); err != nil {
+		return err
+	}
+	if err := cfg.Hooks.Validate(); err != nil {
+		return err
+	}
+	if err := cfg.Telemetry.Validate(); err != nil {
+		return err
+	}
+	for i, hook := range cfg.Webhooks {
+		if err := hook.Validate(i); err != nil {
+			return err
+		}
+	}
+	if cfg.DBus.Address != "" && !strings.HasPrefix(cfg.DBus.Address, "unix:path=") {
+		return fmt.Errorf("dbus.address (%s) must be a unix:path= address", cfg.DBus.Address)
+	}
+	for _, warning := range cfg.Features.Check() {
+		fmt.Println("Warning:", warning)
+	}
+	cfg.LUKS.Features = cfg.Features
+	for _, dep := range cfg.LUKS.DependsOn {
+		if dep == "" || dep == cfg.LUKS.MapperName {
+			return fmt.Errorf("luks.dependsOn entry %q must name the mapper of another volume", dep)
+		}
+	}
+	if owner, group, found := strings.Cut(cfg.LUKS.KeyfileOwner, ":"); cfg.LUKS.KeyfileOwner != "" && (owner == "" || (found && group == "")) {
+		return fmt.Errorf("luks.keyfileOwner (%s) must be user or user:group", cfg.LUKS.KeyfileOwner)
+	}
+	if cfg.LUKS.MinCharClasses < 0 || cfg.LUKS.MinCharClasses > luks.MaxCharClasses {
+		return fmt.Errorf("luks.minCharClasses (%d) must be between 0 and %d", cfg.LUKS.MinCharClasses, luks.MaxCharClasses)
+	}
+	if cfg.LUKS.DenyList != "" && !filepath.IsAbs(cfg.LUKS.DenyList) {
+		return fmt.Errorf("luks.denyList (%s) must be an absolute path", cfg.LUKS.DenyList)
+	}
+	if cfg.LUKS.KeySource == "" {
+		cfg.LUKS.KeySource = luks.KeySourceMixed
+	} else if !luks.ValidKeySource(cfg.LUKS.KeySource) {
+		return fmt.Errorf("luks.keySource (%s) must be mixed, tpmOnly or osOnly", cfg.LUKS.KeySource)
+	}
+	if cfg.LUKS.MinKeyEntropy == 0 {
+		cfg.LUKS.MinKeyEntropy = luks.DefaultMinKeyEntropy
+	}
+	if cfg.LUKS.MinPassphraseEntropy == 0 {
+		cfg.LUKS.MinPassphraseEntropy = luks.DefaultMinPassphraseEntropy
+	}
 	return nil
 }
 
 // Helper function to get the current directory of the executable
+// DefaultConfigPath is where init writes the configuration, the system layer read
+// without --config.
+func DefaultConfigPath() string {
+	return "/etc/udm/config.yml"
+}
+
 func getCurrentDirectory() string {
 	execPath, err := os.Executable()
 	if err != nil {
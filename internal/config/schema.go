@@ -0,0 +1,245 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Issue is a problem found in a configuration file.
+type Issue struct {
+	File    string `json:"file,omitempty"` // Set when the configuration has several layers
+	Line    int    `json:"line,omitempty"` // 0 when the key is missing from the file
+	Key     string `json:"key,omitempty"`
+	Message string `json:"message"`
+}
+
+func (i Issue) String() string {
+	var s string
+	if i.File != "" {
+		s = i.File + " "
+	}
+	if i.Line > 0 {
+		s += fmt.Sprintf("line %d: ", i.Line)
+	}
+	if i.Key != "" {
+		s += i.Key + ": "
+	}
+	return s + i.Message
+}
+
+// ValidationError lists the issues of a configuration file.
+type ValidationError struct {
+	Issues []Issue
+}
+
+func (e *ValidationError) Error() string {
+	lines := make([]string, len(e.Issues))
+	for i, issue := range e.Issues {
+		lines[i] = issue.String()
+	}
+	return strings.Join(lines, "; ")
+}
+
+// schema indexes the keys of a configuration file by their dotted path, so problems
+// found after decoding can be reported with the line they are on.
+type schema struct {
+	lines  map[string]int
+	files  map[string]string // File of each key, for layered configurations
+	issues []Issue
+}
+
+// checkSchema walks the document against the configuration types, reporting keys the
+// types do not know with the closest known key as a suggestion. Typos otherwise decode
+// silently into zero values.
+func checkSchema(doc *yaml.Node) *schema {
+	s := &schema{lines: map[string]int{}}
+	if doc.Kind == yaml.DocumentNode && len(doc.Content) > 0 {
+		s.walk(doc.Content[0], reflect.TypeOf(AppConfig{}), "")
+	}
+	return s
+}
+
+func (s *schema) walk(node *yaml.Node, t reflect.Type, path string) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t.Kind() == reflect.Struct && node.Kind == yaml.MappingNode:
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			keyPath := joinKey(path, key.Value)
+			field, ok := fields[key.Value]
+			if !ok {
+				message := "unknown key"
+				if suggestion := closestKey(key.Value, fields); suggestion != "" {
+					message += ", did you mean " + suggestion + "?"
+				}
+				s.issues = append(s.issues, Issue{Line: key.Line, Key: keyPath, Message: message})
+				continue
+			}
+			s.lines[keyPath] = key.Line
+			s.walk(value, field, keyPath)
+		}
+	case t.Kind() == reflect.Map && node.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			keyPath := joinKey(path, node.Content[i].Value)
+			s.lines[keyPath] = node.Content[i].Line
+			s.walk(node.Content[i+1], t.Elem(), keyPath)
+		}
+	case t.Kind() == reflect.Slice && node.Kind == yaml.SequenceNode:
+		for i, item := range node.Content {
+			s.walk(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))
+		}
+	}
+}
+
+// override indexes the keys of a later configuration layer over those of earlier ones.
+func (s *schema) override(layer *schema, file string) {
+	for key, line := range layer.lines {
+		s.lines[key] = line
+		s.files[key] = file
+	}
+}
+
+// locate returns the file and line of the longest known key prefixing key, 0 when
+// none is known.
+func (s *schema) locate(key string) (string, int) {
+	for ; key != ""; key = key[:max(strings.LastIndexAny(key, ".["), 0)] {
+		if line, ok := s.lines[key]; ok {
+			return s.files[key], line
+		}
+	}
+	return "", 0
+}
+
+func joinKey(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// yamlFields maps the YAML keys of a struct to the field types, the way yaml.v3 names them.
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+// closestKey returns the known key closest to key, or "" when none is similar.
+func closestKey(key string, fields map[string]reflect.Type) string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	best, bestDistance := "", 3 // Suggest only up to two edits away
+	for _, name := range names {
+		if strings.EqualFold(name, key) {
+			return name
+		}
+		if d := editDistance(strings.ToLower(name), strings.ToLower(key)); d < bestDistance {
+			best, bestDistance = name, d
+		}
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance of a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+var typeErrorLine = regexp.MustCompile(`^line (\d+): (.*)$`)
+
+// typeIssues converts the type mismatches of a yaml.TypeError into issues. Unknown
+// fields are skipped, checkSchema reports them with suggestions.
+func typeIssues(err *yaml.TypeError) []Issue {
+	var issues []Issue
+	for _, e := range err.Errors {
+		if strings.Contains(e, "not found in type") {
+			continue
+		}
+		issue := Issue{Message: e}
+		if m := typeErrorLine.FindStringSubmatch(e); m != nil {
+			issue.Line, _ = strconv.Atoi(m[1])
+			issue.Message = m[2]
+		}
+		issues = append(issues, issue)
+	}
+	return issues
+}
+
+var validateKey = regexp.MustCompile(`^[a-z][A-Za-z0-9]*(\.[A-Za-z0-9]+)+`)
+
+// validateIssue locates the key a Validate error message starts with.
+func (s *schema) validateIssue(err error) Issue {
+	message := err.Error()
+	file, line := s.locate(validateKey.FindString(message))
+	return Issue{File: file, Line: line, Message: message}
+}
+
+// mergeNode overlays the mapping src onto dst: keys of src replace those of dst, except
+// mappings present in both, which are merged. Sequences are replaced as a whole.
+func mergeNode(dst, src *yaml.Node) {
+	if dst.Kind != yaml.MappingNode || src.Kind != yaml.MappingNode {
+		*dst = *src
+		return
+	}
+	for i := 0; i+1 < len(src.Content); i += 2 {
+		key, value := src.Content[i], src.Content[i+1]
+		found := false
+		for j := 0; j+1 < len(dst.Content); j += 2 {
+			if dst.Content[j].Value != key.Value {
+				continue
+			}
+			if dst.Content[j+1].Kind == yaml.MappingNode && value.Kind == yaml.MappingNode {
+				mergeNode(dst.Content[j+1], value)
+			} else {
+				dst.Content[j], dst.Content[j+1] = key, value
+			}
+			found = true
+			break
+		}
+		if !found {
+			dst.Content = append(dst.Content, key, value)
+		}
+	}
+}
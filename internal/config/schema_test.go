@@ -0,0 +1,214 @@
+package config
+
+import (
+	"bootstrap/internal/luks"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigReportsIssues(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	os.WriteFile(path, []byte(`luks:
+  volumePath: "/var/luks/test.img"
+  mapername: "test"
+  mountPoint: "/mnt/test"
+  size: large
+  fido2:
+    enabled: true
+    presense: true
+`), 0644)
+
+	_, err := LoadConfig(path)
+	var invalid *ValidationError
+	if !errors.As(err, &invalid) {
+		t.Fatalf("expected a ValidationError, got %v", err)
+	}
+	want := []Issue{
+		{Line: 3, Key: "luks.mapername", Message: "unknown key, did you mean mapperName?"},
+		{Line: 5, Message: "cannot unmarshal !!str `large` into int"},
+		{Line: 8, Key: "luks.fido2.presense", Message: "unknown key, did you mean presence?"},
+	}
+	if len(invalid.Issues) != len(want) {
+		t.Fatalf("expected %d issues, got %v", len(want), invalid.Issues)
+	}
+	for i, issue := range invalid.Issues {
+		if issue != want[i] {
+			t.Errorf("issue %d: expected %+v, got %+v", i, want[i], issue)
+		}
+	}
+}
+
+func TestLoadConfigLocatesConflicts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	os.WriteFile(path, []byte(`luks:
+  volumePath: "/var/luks/test.img"
+  mapperName: "test"
+  mountPoint: "/mnt/test"
+  keyBytes: 32
+  size: 32
+  useTPM: true
+  keyfileWrap: passphrase
+`), 0644)
+
+	_, err := LoadConfig(path)
+	var invalid *ValidationError
+	if !errors.As(err, &invalid) || len(invalid.Issues) != 1 || invalid.Issues[0].Line != 8 {
+		t.Fatalf("expected the keyfileWrap conflict on line 8, got %v", err)
+	}
+}
+
+func TestIntegrityDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	os.WriteFile(path, []byte(`luks:
+  volumePath: "/var/luks/test.img"
+  mapperName: "test"
+  mountPoint: "/mnt/test"
+  keyBytes: 32
+  size: 32
+  cipher: "aes-xts-plain64"
+  integrity: "hmac-sha256"
+`), 0644)
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v, want nil", err)
+	}
+	if cfg.LUKS.KeySize != 768 {
+		t.Errorf("KeySize = %d, want 768 bits including the HMAC key", cfg.LUKS.KeySize)
+	}
+
+	os.WriteFile(path, []byte(`luks:
+  volumePath: "/var/luks/test.img"
+  mapperName: "test"
+  mountPoint: "/mnt/test"
+  keyBytes: 32
+  size: 32
+  cipher: "aes-xts-plain64"
+  integrity: "aead"
+`), 0644)
+	if _, err := LoadConfig(path); err == nil {
+		t.Errorf("LoadConfig() of integrity aead with an XTS cipher error = nil, want an error")
+	}
+}
+
+func TestTenantPrefix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	os.WriteFile(path, []byte(`luks:
+  volumePath: "/var/luks/acme-data.img"
+  mapperName: "data"
+  mountPoint: "/mnt/acme/data"
+  keyBytes: 32
+  size: 32
+  useTPM: true
+  tenant: "acme"
+`), 0644)
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v, want nil", err)
+	}
+	if cfg.LUKS.MapperName != "acme-data" {
+		t.Errorf("MapperName = %q, want acme-data", cfg.LUKS.MapperName)
+	}
+
+	// Validating again, e.g. on reload, must not prefix twice
+	if err := cfg.Validate(); err != nil || cfg.LUKS.MapperName != "acme-data" {
+		t.Errorf("Validate() again = %v, MapperName = %q, want acme-data", err, cfg.LUKS.MapperName)
+	}
+}
+
+func TestProfileDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	os.WriteFile(path, []byte(`luks:
+  volumePath: "/dev/disk/by-partlabel/swap"
+  mapperName: "swap"
+  size: 64
+  profile: "swap"
+`), 0644)
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v, want nil", err)
+	}
+	if !cfg.LUKS.Ephemeral || cfg.LUKS.MountPoint != luks.SwapMountPoint {
+		t.Errorf("Ephemeral = %v, MountPoint = %q, want true, %s", cfg.LUKS.Ephemeral, cfg.LUKS.MountPoint, luks.SwapMountPoint)
+	}
+
+	os.WriteFile(path, []byte(`luks:
+  volumePath: "/dev/disk/by-id/nvme-eui.0025385b71b0a1c2-part4"
+  mapperName: "tmp"
+  size: 64
+  profile: "tmp"
+`), 0644)
+	if cfg, err = LoadConfig(path); err != nil {
+		t.Fatalf("LoadConfig() error = %v, want nil", err)
+	}
+	if cfg.LUKS.MountPoint != "/tmp" || strings.Join(cfg.LUKS.MountOptions, ",") != "nodev,nosuid" {
+		t.Errorf("MountPoint = %q, MountOptions = %v, want /tmp, [nodev nosuid]", cfg.LUKS.MountPoint, cfg.LUKS.MountOptions)
+	}
+
+	os.WriteFile(path, []byte(`luks:
+  volumePath: "/dev/sda4"
+  mapperName: "tmp"
+  size: 64
+  profile: "tmp"
+  useTPM: true
+`), 0644)
+	if _, err := LoadConfig(path); err == nil {
+		t.Errorf("LoadConfig() of profile tmp with useTPM error = nil, want an error")
+	}
+
+	// Kernel device names change when disks are renumbered
+	os.WriteFile(path, []byte(`luks:
+  volumePath: "/dev/sda3"
+  mapperName: "swap"
+  size: 64
+  profile: "swap"
+`), 0644)
+	if _, err := LoadConfig(path); err == nil {
+		t.Errorf("LoadConfig() of profile swap on /dev/sda3 error = nil, want an error")
+	}
+}
+
+func TestTPMTokenDefault(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	os.WriteFile(path, []byte(`luks:
+  volumePath: "/var/luks/test.img"
+  mapperName: "test"
+  mountPoint: "/mnt/test"
+  keyBytes: 32
+  size: 32
+  useTPM: true
+`), 0644)
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v, want nil", err)
+	}
+	if !cfg.LUKS.TPMToken {
+		t.Errorf("TPMToken = false, want the systemd-tpm2 token by default with useTPM")
+	}
+
+	os.WriteFile(path, []byte(`luks:
+  volumePath: "/var/luks/test.img"
+  mapperName: "test"
+  mountPoint: "/mnt/test"
+  keyBytes: 32
+  size: 32
+  useTPM: true
+  keyscript: true
+`), 0644)
+	if cfg, err = LoadConfig(path); err != nil {
+		t.Fatalf("LoadConfig() error = %v, want nil", err)
+	}
+	if cfg.LUKS.TPMToken {
+		t.Errorf("TPMToken = true with keyscript, want false")
+	}
+	// Validating again, e.g. on reload, must keep the keyscript
+	if err := cfg.Validate(); err != nil || cfg.LUKS.TPMToken {
+		t.Errorf("Validate() again = %v, TPMToken = %v, want nil, false", err, cfg.LUKS.TPMToken)
+	}
+}
@@ -0,0 +1,45 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Without --config the configuration is layered from these directories, each
+// contributing config.yml and then the drop-ins of config.d/*.yml in lexical order.
+// Later layers override the keys of earlier ones, so images ship defaults in /etc/udm
+// that operators override with drop-ins. config.yml next to the executable, the only
+// location read by earlier versions, is the lowest layer.
+var configDirs = func() []string {
+	dirs := []string{getCurrentDirectory(), "/etc/udm", "/run/udm"}
+	if xdg := os.Getenv("XDG_CONFIG_HOME"); xdg != "" {
+		dirs = append(dirs, filepath.Join(xdg, "udm"))
+	} else if home, err := os.UserHomeDir(); err == nil {
+		dirs = append(dirs, filepath.Join(home, ".config", "udm"))
+	}
+	return dirs
+}
+
+// SearchConfig returns the existing configuration layers in the order they apply.
+func SearchConfig() []string {
+	var files []string
+	seen := map[string]bool{}
+	for _, dir := range configDirs() {
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		if info, err := os.Stat(filepath.Join(dir, "config.yml")); err == nil && info.Mode().IsRegular() {
+			files = append(files, filepath.Join(dir, "config.yml"))
+		}
+		var dropins []string
+		for _, pattern := range []string{"*.yml", "*.yaml"} {
+			matches, _ := filepath.Glob(filepath.Join(dir, "config.d", pattern))
+			dropins = append(dropins, matches...)
+		}
+		sort.Strings(dropins)
+		files = append(files, dropins...)
+	}
+	return files
+}
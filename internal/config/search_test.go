@@ -0,0 +1,54 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLayeredConfig(t *testing.T) {
+	etc, run := t.TempDir(), t.TempDir()
+	defer func(dirs func() []string) { configDirs = dirs }(configDirs)
+	configDirs = func() []string { return []string{etc, run} }
+
+	os.WriteFile(filepath.Join(etc, "config.yml"), []byte(`luks:
+  volumePath: "/var/luks/test.img"
+  mapperName: "test"
+  mountPoint: "/mnt/test"
+  keyBytes: 32
+  size: 32
+  mountOptions: ["nodev"]
+`), 0644)
+	os.MkdirAll(filepath.Join(etc, "config.d"), 0755)
+	os.WriteFile(filepath.Join(etc, "config.d", "10-size.yml"), []byte("luks:\n  size: 64\n"), 0644)
+	os.MkdirAll(filepath.Join(run, "config.d"), 0755)
+	os.WriteFile(filepath.Join(run, "config.d", "site.yml"), []byte("luks:\n  mountOptions: [\"nosuid\"]\n"), 0644)
+
+	files := SearchConfig()
+	want := []string{
+		filepath.Join(etc, "config.yml"),
+		filepath.Join(etc, "config.d", "10-size.yml"),
+		filepath.Join(run, "config.d", "site.yml"),
+	}
+	if !reflect.DeepEqual(files, want) {
+		t.Fatalf("SearchConfig() = %v, want %v", files, want)
+	}
+
+	cfg, err := LoadConfigFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.LUKS.Size != 64 || cfg.LUKS.MapperName != "test" || !reflect.DeepEqual(cfg.LUKS.MountOptions, []string{"nosuid"}) {
+		t.Errorf("merged luks = size %d, mapper %s, options %v", cfg.LUKS.Size, cfg.LUKS.MapperName, cfg.LUKS.MountOptions)
+	}
+
+	// Conflicts are located in the layer that set the key
+	os.WriteFile(filepath.Join(run, "config.d", "site.yml"), []byte("luks:\n  useTPM: true\n  keyfileWrap: passphrase\n"), 0644)
+	_, err = LoadConfigFiles(files)
+	var invalid *ValidationError
+	if !errors.As(err, &invalid) || invalid.Issues[0].File != want[2] || invalid.Issues[0].Line != 3 {
+		t.Fatalf("expected the keyfileWrap conflict in %s line 3, got %v", want[2], err)
+	}
+}
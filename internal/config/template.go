@@ -0,0 +1,93 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// templateVars are the variables resolved from the device rather than the environment.
+var templateVars = map[string]func() (string, error){
+	"hostname": os.Hostname,
+	"machine-id": func() (string, error) {
+		data, err := os.ReadFile(machineIDPath)
+		if err != nil {
+			return "", fmt.Errorf("failed to read device id: %w", err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	},
+}
+
+// expandTemplates substitutes ${VAR}, ${hostname} and ${machine-id} in the values naming
+// the volume and its Vault secret, so one configuration shipped across a fleet resolves to device-specific
+// paths. Other values are taken literally, hooks in particular may reference shell
+// variables of their own.
+func (cfg *AppConfig) expandTemplates() error {
+	fields := []struct {
+		key   string
+		value *string
+	}{
+		{"luks.volumePath", &cfg.LUKS.VolumePath},
+		{"luks.mapperName", &cfg.LUKS.MapperName},
+		{"luks.mountPoint", &cfg.LUKS.MountPoint},
+		{"luks.vault.kv", &cfg.LUKS.Vault.KV},
+	}
+	for _, f := range fields {
+		expanded, err := expandTemplate(*f.value, lookupTemplateVar)
+		if err != nil {
+			return fmt.Errorf("%s (%s): %w", f.key, *f.value, err)
+		}
+		*f.value = expanded
+	}
+	return nil
+}
+
+// lookupTemplateVar resolves a device variable or an environment variable, which must
+// be set: an empty path component would silently merge the volumes of several devices.
+func lookupTemplateVar(name string) (string, error) {
+	if resolve, ok := templateVars[name]; ok {
+		return resolve()
+	}
+	value, ok := os.LookupEnv(name)
+	if !ok || value == "" {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return value, nil
+}
+
+// expandTemplate replaces each ${name} in s with its value, $$ escapes a dollar sign.
+func expandTemplate(s string, lookup func(name string) (string, error)) (string, error) {
+	if !strings.Contains(s, "$") {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' {
+			b.WriteByte(s[i])
+			continue
+		}
+		switch {
+		case strings.HasPrefix(s[i:], "$$"):
+			b.WriteByte('$')
+			i++
+		case strings.HasPrefix(s[i:], "${"):
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated ${ at offset %d", i)
+			}
+			name := s[i+2 : i+end]
+			if name == "" {
+				return "", fmt.Errorf("empty ${} at offset %d", i)
+			}
+			value, err := lookup(name)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(value)
+			i += end
+		default:
+			return "", fmt.Errorf("$ at offset %d must start ${name} or be escaped as $$", i)
+		}
+	}
+	return b.String(), nil
+}
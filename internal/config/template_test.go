@@ -0,0 +1,36 @@
+package config
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestExpandTemplate(t *testing.T) {
+	lookup := func(name string) (string, error) {
+		switch name {
+		case "hostname":
+			return "edge-7", nil
+		case "SITE":
+			return "berlin", nil
+		}
+		return "", fmt.Errorf("%s is not set", name)
+	}
+	tests := []struct {
+		in, want string
+		wantErr  bool
+	}{
+		{in: "/var/luks/udm.img", want: "/var/luks/udm.img"},
+		{in: "/var/luks/${SITE}/${hostname}.img", want: "/var/luks/berlin/edge-7.img"},
+		{in: "udm-$${hostname}", want: "udm-${hostname}"},
+		{in: "/mnt/${UNSET}", wantErr: true},
+		{in: "/mnt/${hostname", wantErr: true},
+		{in: "/mnt/${}", wantErr: true},
+		{in: "/mnt/$HOME", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := expandTemplate(tt.in, lookup)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("expandTemplate(%q) = %q, %v, want %q, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+// Package dbus is a minimal D-Bus client, enough to own a name on the system bus and
+// serve method calls with string arguments. It speaks the wire protocol directly over
+// the bus socket.
+package dbus
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultSystemBus is the system bus socket used unless DBUS_SYSTEM_BUS_ADDRESS is set.
+const DefaultSystemBus = "unix:path=/run/dbus/system_bus_socket"
+
+const (
+	busName      = "org.freedesktop.DBus"
+	busPath      = ObjectPath("/org/freedesktop/DBus")
+	busInterface = "org.freedesktop.DBus"
+)
+
+// Config enables the D-Bus service of the daemon.
+type Config struct {
+	Enabled bool   `yaml:"enabled"` // Own org.bootstrap.UDM1 while udm daemon runs
+	Address string `yaml:"address"` // Bus address, defaults to the system bus
+}
+
+// requestNameDoNotQueue fails RequestName instead of waiting for the current owner.
+const requestNameDoNotQueue = 4
+
+// Handler serves a method call, returning the reply body or an error.
+type Handler func(call *Message) ([]any, error)
+
+// Error is a D-Bus error reply.
+type Error struct {
+	Name    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Name + ": " + e.Message
+}
+
+// Conn is a connection to a message bus.
+type Conn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	name   string
+
+	writeMu sync.Mutex
+	serial  uint32
+
+	mu      sync.Mutex
+	pending map[uint32]chan *Message
+	closed  error
+}
+
+// Connect connects to the configured bus, or the system bus.
+func Connect(cfg Config) (*Conn, error) {
+	address := cfg.Address
+	if address == "" {
+		address = os.Getenv("DBUS_SYSTEM_BUS_ADDRESS")
+	}
+	if address == "" {
+		address = DefaultSystemBus
+	}
+	return Dial(address)
+}
+
+// Dial connects to the bus at a unix:path= address and authenticates as the current
+// user.
+func Dial(address string) (*Conn, error) {
+	path, ok := strings.CutPrefix(address, "unix:path=")
+	if !ok {
+		return nil, fmt.Errorf("unsupported bus address %s", address)
+	}
+	if i := strings.IndexByte(path, ','); i >= 0 {
+		path = path[:i]
+	}
+	nc, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", path, err)
+	}
+	c := &Conn{conn: nc, reader: bufio.NewReader(nc), pending: map[uint32]chan *Message{}}
+	if err := c.auth(); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// auth runs the EXTERNAL SASL exchange, identifying by the peer credentials.
+func (c *Conn) auth() error {
+	uid := hex.EncodeToString([]byte(strconv.Itoa(os.Getuid())))
+	if _, err := c.conn.Write([]byte("\x00AUTH EXTERNAL " + uid + "\r\n")); err != nil {
+		return fmt.Errorf("failed to authenticate: %w", err)
+	}
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("failed to authenticate: %w", err)
+	}
+	if !strings.HasPrefix(line, "OK ") {
+		return fmt.Errorf("bus rejected authentication: %s", strings.TrimSpace(line))
+	}
+	if _, err := c.conn.Write([]byte("BEGIN\r\n")); err != nil {
+		return fmt.Errorf("failed to authenticate: %w", err)
+	}
+	return nil
+}
+
+// Serve reads messages until the connection closes, passing method calls to handle
+// in their own goroutine and replying with its result. Hello must be called from
+// another goroutine once Serve runs.
+func (c *Conn) Serve(handle Handler) error {
+	for {
+		m, err := ReadMessage(c.reader)
+		if err != nil {
+			c.mu.Lock()
+			c.closed = err
+			for serial, ch := range c.pending {
+				close(ch)
+				delete(c.pending, serial)
+			}
+			c.mu.Unlock()
+			return err
+		}
+
+		switch m.Type {
+		case TypeMethodReturn, TypeError:
+			c.mu.Lock()
+			ch, ok := c.pending[m.ReplySerial]
+			delete(c.pending, m.ReplySerial)
+			c.mu.Unlock()
+			if ok {
+				ch <- m
+			}
+		case TypeMethodCall:
+			go c.dispatch(m, handle)
+		}
+	}
+}
+
+func (c *Conn) dispatch(call *Message, handle Handler) {
+	body, err := handle(call)
+	if call.Flags&FlagNoReplyExpected != 0 {
+		return
+	}
+	reply := &Message{Type: TypeMethodReturn, ReplySerial: call.Serial, Destination: call.Sender, Body: body}
+	if err != nil {
+		var dbusErr *Error
+		if !errors.As(err, &dbusErr) {
+			dbusErr = &Error{Name: "org.freedesktop.DBus.Error.Failed", Message: err.Error()}
+		}
+		reply = &Message{Type: TypeError, ReplySerial: call.Serial, Destination: call.Sender,
+			ErrorName: dbusErr.Name, Body: []any{dbusErr.Message}}
+	}
+	if err := c.send(reply, nil); err != nil {
+		log.Printf("Failed to reply to %s: %v", call.Sender, err)
+	}
+}
+
+// send assigns the next serial to m and writes it, calling register with the serial
+// first so a reply arriving before send returns is not missed.
+func (c *Conn) send(m *Message, register func(serial uint32) error) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.serial++
+	m.Serial = c.serial
+	if register != nil {
+		if err := register(m.Serial); err != nil {
+			return err
+		}
+	}
+	data, err := m.Marshal()
+	if err != nil {
+		return err
+	}
+	_, err = c.conn.Write(data)
+	return err
+}
+
+// Call invokes a method and waits for its reply. Serve must be running.
+func (c *Conn) Call(destination string, path ObjectPath, iface, member string, args ...any) ([]any, error) {
+	ch := make(chan *Message, 1)
+	m := &Message{Type: TypeMethodCall, Destination: destination, Path: path, Interface: iface, Member: member, Body: args}
+	err := c.send(m, func(serial uint32) error {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.closed != nil {
+			return c.closed
+		}
+		c.pending[serial] = ch
+		return nil
+	})
+	if err != nil {
+		c.mu.Lock()
+		delete(c.pending, m.Serial)
+		c.mu.Unlock()
+		return nil, err
+	}
+
+	reply, ok := <-ch
+	if !ok {
+		return nil, errors.New("connection to the bus closed")
+	}
+	if reply.Type == TypeError {
+		e := &Error{Name: reply.ErrorName}
+		if len(reply.Body) > 0 {
+			e.Message, _ = reply.Body[0].(string)
+		}
+		return nil, e
+	}
+	return reply.Body, nil
+}
+
+// Hello registers the connection with the bus, which must be done before any other call.
+func (c *Conn) Hello() error {
+	body, err := c.Call(busName, busPath, busInterface, "Hello")
+	if err != nil {
+		return fmt.Errorf("failed to register with the bus: %w", err)
+	}
+	if len(body) > 0 {
+		c.name, _ = body[0].(string)
+	}
+	return nil
+}
+
+// RequestName takes ownership of a well-known name, failing if another connection
+// owns it.
+func (c *Conn) RequestName(name string) error {
+	body, err := c.Call(busName, busPath, busInterface, "RequestName", name, uint32(requestNameDoNotQueue))
+	if err != nil {
+		return fmt.Errorf("failed to request %s: %w", name, err)
+	}
+	if len(body) != 1 || body[0] != uint32(1) {
+		return fmt.Errorf("%s is owned by another connection", name)
+	}
+	return nil
+}
+
+// CallerPID returns the process id of the connection that sent a message.
+func (c *Conn) CallerPID(sender string) (uint32, error) {
+	return c.callerUint32("GetConnectionUnixProcessID", sender)
+}
+
+// CallerUID returns the user id of the connection that sent a message.
+func (c *Conn) CallerUID(sender string) (uint32, error) {
+	return c.callerUint32("GetConnectionUnixUser", sender)
+}
+
+func (c *Conn) callerUint32(member, sender string) (uint32, error) {
+	body, err := c.Call(busName, busPath, busInterface, member, sender)
+	if err != nil {
+		return 0, err
+	}
+	if len(body) != 1 {
+		return 0, fmt.Errorf("unexpected %s reply", member)
+	}
+	v, ok := body[0].(uint32)
+	if !ok {
+		return 0, fmt.Errorf("unexpected %s reply", member)
+	}
+	return v, nil
+}
+
+// Close closes the connection.
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,433 @@
+package dbus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Message types.
+const (
+	TypeMethodCall   = 1
+	TypeMethodReturn = 2
+	TypeError        = 3
+	TypeSignal       = 4
+)
+
+// FlagNoReplyExpected marks method calls whose caller does not wait for a reply.
+const FlagNoReplyExpected = 0x1
+
+// Header field codes.
+const (
+	fieldPath        = 1
+	fieldInterface   = 2
+	fieldMember      = 3
+	fieldErrorName   = 4
+	fieldReplySerial = 5
+	fieldDestination = 6
+	fieldSender      = 7
+	fieldSignature   = 8
+)
+
+// maxMessageSize bounds messages read from the bus.
+const maxMessageSize = 1 << 24
+
+// ObjectPath is a D-Bus object path, marshaled with signature o.
+type ObjectPath string
+
+// Signature is a D-Bus type signature, marshaled with signature g.
+type Signature string
+
+// Variant is a value marshaled with its signature, signature v.
+type Variant struct {
+	Signature Signature
+	Value     any
+}
+
+// Message is a D-Bus message. Body values are string, ObjectPath, Signature, bool,
+// byte, int32, uint32, []string or Variant.
+type Message struct {
+	Type        byte
+	Flags       byte
+	Serial      uint32
+	Path        ObjectPath
+	Interface   string
+	Member      string
+	ErrorName   string
+	ReplySerial uint32
+	Destination string
+	Sender      string
+	Signature   Signature
+	Body        []any
+}
+
+// encoder marshals values with D-Bus alignment, relative to the start of buf.
+type encoder struct {
+	buf   bytes.Buffer
+	order binary.ByteOrder
+}
+
+func (e *encoder) align(n int) {
+	for e.buf.Len()%n != 0 {
+		e.buf.WriteByte(0)
+	}
+}
+
+func (e *encoder) uint32(v uint32) {
+	e.align(4)
+	var b [4]byte
+	e.order.PutUint32(b[:], v)
+	e.buf.Write(b[:])
+}
+
+func (e *encoder) string(s string) {
+	e.uint32(uint32(len(s)))
+	e.buf.WriteString(s)
+	e.buf.WriteByte(0)
+}
+
+func (e *encoder) signature(s Signature) {
+	e.buf.WriteByte(byte(len(s)))
+	e.buf.WriteString(string(s))
+	e.buf.WriteByte(0)
+}
+
+func (e *encoder) value(v any) error {
+	switch v := v.(type) {
+	case string:
+		e.string(v)
+	case ObjectPath:
+		e.string(string(v))
+	case Signature:
+		e.signature(v)
+	case byte:
+		e.buf.WriteByte(v)
+	case bool:
+		if v {
+			e.uint32(1)
+		} else {
+			e.uint32(0)
+		}
+	case int32:
+		e.uint32(uint32(v))
+	case uint32:
+		e.uint32(v)
+	case []string:
+		e.uint32(0)
+		start := e.buf.Len()
+		for _, s := range v {
+			e.string(s)
+		}
+		e.order.PutUint32(e.buf.Bytes()[start-4:], uint32(e.buf.Len()-start))
+	case Variant:
+		e.signature(v.Signature)
+		return e.value(v.Value)
+	default:
+		return fmt.Errorf("cannot marshal %T", v)
+	}
+	return nil
+}
+
+// signatureOf returns the D-Bus signature of body values.
+func signatureOf(values []any) (Signature, error) {
+	var sig string
+	for _, v := range values {
+		switch v.(type) {
+		case string:
+			sig += "s"
+		case ObjectPath:
+			sig += "o"
+		case Signature:
+			sig += "g"
+		case byte:
+			sig += "y"
+		case bool:
+			sig += "b"
+		case int32:
+			sig += "i"
+		case uint32:
+			sig += "u"
+		case []string:
+			sig += "as"
+		case Variant:
+			sig += "v"
+		default:
+			return "", fmt.Errorf("cannot marshal %T", v)
+		}
+	}
+	return Signature(sig), nil
+}
+
+// Marshal encodes the message in little-endian byte order.
+func (m *Message) Marshal() ([]byte, error) {
+	sig, err := signatureOf(m.Body)
+	if err != nil {
+		return nil, err
+	}
+	m.Signature = sig
+
+	body := &encoder{order: binary.LittleEndian}
+	for _, v := range m.Body {
+		if err := body.value(v); err != nil {
+			return nil, err
+		}
+	}
+
+	type field struct {
+		code  byte
+		value Variant
+	}
+	var fields []field
+	add := func(code byte, sig Signature, value any, set bool) {
+		if set {
+			fields = append(fields, field{code, Variant{sig, value}})
+		}
+	}
+	add(fieldPath, "o", m.Path, m.Path != "")
+	add(fieldInterface, "s", m.Interface, m.Interface != "")
+	add(fieldMember, "s", m.Member, m.Member != "")
+	add(fieldErrorName, "s", m.ErrorName, m.ErrorName != "")
+	add(fieldReplySerial, "u", m.ReplySerial, m.ReplySerial != 0)
+	add(fieldDestination, "s", m.Destination, m.Destination != "")
+	add(fieldSender, "s", m.Sender, m.Sender != "")
+	add(fieldSignature, "g", m.Signature, m.Signature != "")
+
+	e := &encoder{order: binary.LittleEndian}
+	e.buf.Write([]byte{'l', m.Type, m.Flags, 1})
+	e.uint32(uint32(body.buf.Len()))
+	e.uint32(m.Serial)
+	e.uint32(0)
+	start := e.buf.Len()
+	for _, f := range fields {
+		e.align(8)
+		e.buf.WriteByte(f.code)
+		if err := e.value(f.value); err != nil {
+			return nil, err
+		}
+	}
+	binary.LittleEndian.PutUint32(e.buf.Bytes()[12:], uint32(e.buf.Len()-start))
+	e.align(8)
+	e.buf.Write(body.buf.Bytes())
+	return e.buf.Bytes(), nil
+}
+
+// decoder unmarshals values from data, aligned relative to its start.
+type decoder struct {
+	data  []byte
+	pos   int
+	order binary.ByteOrder
+}
+
+var errTruncated = errors.New("truncated message")
+
+func (d *decoder) align(n int) error {
+	for d.pos%n != 0 {
+		d.pos++
+	}
+	if d.pos > len(d.data) {
+		return errTruncated
+	}
+	return nil
+}
+
+func (d *decoder) byte() (byte, error) {
+	if d.pos >= len(d.data) {
+		return 0, errTruncated
+	}
+	b := d.data[d.pos]
+	d.pos++
+	return b, nil
+}
+
+func (d *decoder) uint32() (uint32, error) {
+	if err := d.align(4); err != nil {
+		return 0, err
+	}
+	if d.pos+4 > len(d.data) {
+		return 0, errTruncated
+	}
+	v := d.order.Uint32(d.data[d.pos:])
+	d.pos += 4
+	return v, nil
+}
+
+func (d *decoder) string() (string, error) {
+	n, err := d.uint32()
+	if err != nil {
+		return "", err
+	}
+	if d.pos+int(n)+1 > len(d.data) {
+		return "", errTruncated
+	}
+	s := string(d.data[d.pos : d.pos+int(n)])
+	d.pos += int(n) + 1
+	return s, nil
+}
+
+func (d *decoder) signature() (Signature, error) {
+	n, err := d.byte()
+	if err != nil {
+		return "", err
+	}
+	if d.pos+int(n)+1 > len(d.data) {
+		return "", errTruncated
+	}
+	s := Signature(d.data[d.pos : d.pos+int(n)])
+	d.pos += int(n) + 1
+	return s, nil
+}
+
+// values decodes the values of sig, which may contain basic types, arrays of strings
+// and variants.
+func (d *decoder) values(sig Signature) ([]any, error) {
+	var values []any
+	for i := 0; i < len(sig); i++ {
+		var v any
+		var err error
+		switch sig[i] {
+		case 's':
+			v, err = d.string()
+		case 'o':
+			var s string
+			s, err = d.string()
+			v = ObjectPath(s)
+		case 'g':
+			v, err = d.signature()
+		case 'y':
+			v, err = d.byte()
+		case 'b':
+			var u uint32
+			u, err = d.uint32()
+			v = u != 0
+		case 'i':
+			var u uint32
+			u, err = d.uint32()
+			v = int32(u)
+		case 'u':
+			v, err = d.uint32()
+		case 'v':
+			v, err = d.variant()
+		case 'a':
+			if i+1 >= len(sig) || sig[i+1] != 's' {
+				return nil, fmt.Errorf("unsupported signature %s", sig)
+			}
+			i++
+			v, err = d.strings()
+		default:
+			return nil, fmt.Errorf("unsupported signature %s", sig)
+		}
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+func (d *decoder) variant() (Variant, error) {
+	sig, err := d.signature()
+	if err != nil {
+		return Variant{}, err
+	}
+	values, err := d.values(sig)
+	if err != nil {
+		return Variant{}, err
+	}
+	if len(values) != 1 {
+		return Variant{}, fmt.Errorf("variant of %d values", len(values))
+	}
+	return Variant{sig, values[0]}, nil
+}
+
+func (d *decoder) strings() ([]string, error) {
+	n, err := d.uint32()
+	if err != nil {
+		return nil, err
+	}
+	end := d.pos + int(n)
+	if end > len(d.data) {
+		return nil, errTruncated
+	}
+	list := []string{}
+	for d.pos < end {
+		s, err := d.string()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, s)
+	}
+	return list, nil
+}
+
+// ReadMessage reads one message from r.
+func ReadMessage(r io.Reader) (*Message, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+	var order binary.ByteOrder
+	switch fixed[0] {
+	case 'l':
+		order = binary.LittleEndian
+	case 'B':
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("invalid byte order %q", fixed[0])
+	}
+	bodyLen := order.Uint32(fixed[4:])
+	fieldsLen := order.Uint32(fixed[12:])
+	headerLen := 16 + uint64(fieldsLen)
+	padded := (headerLen + 7) &^ 7
+	if padded+uint64(bodyLen) > maxMessageSize {
+		return nil, fmt.Errorf("message of %d bytes exceeds the limit", padded+uint64(bodyLen))
+	}
+	data := make([]byte, padded+uint64(bodyLen))
+	copy(data, fixed)
+	if _, err := io.ReadFull(r, data[16:]); err != nil {
+		return nil, err
+	}
+
+	m := &Message{Type: fixed[1], Flags: fixed[2], Serial: order.Uint32(fixed[8:])}
+	d := &decoder{data: data[:headerLen], pos: 16, order: order}
+	for d.pos < int(headerLen) {
+		if err := d.align(8); err != nil {
+			return nil, err
+		}
+		code, err := d.byte()
+		if err != nil {
+			return nil, err
+		}
+		field, err := d.variant()
+		if err != nil {
+			return nil, err
+		}
+		switch code {
+		case fieldPath:
+			m.Path, _ = field.Value.(ObjectPath)
+		case fieldInterface:
+			m.Interface, _ = field.Value.(string)
+		case fieldMember:
+			m.Member, _ = field.Value.(string)
+		case fieldErrorName:
+			m.ErrorName, _ = field.Value.(string)
+		case fieldReplySerial:
+			m.ReplySerial, _ = field.Value.(uint32)
+		case fieldDestination:
+			m.Destination, _ = field.Value.(string)
+		case fieldSender:
+			m.Sender, _ = field.Value.(string)
+		case fieldSignature:
+			m.Signature, _ = field.Value.(Signature)
+		}
+	}
+
+	body := &decoder{data: data[padded:], order: order}
+	values, err := body.values(m.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s body: %w", m.Signature, err)
+	}
+	m.Body = values
+	return m, nil
+}
@@ -0,0 +1,36 @@
+package dbus
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	m := &Message{
+		Type:        TypeMethodCall,
+		Serial:      7,
+		Path:        "/org/bootstrap/UDM1",
+		Interface:   "org.bootstrap.UDM1",
+		Member:      "Mount",
+		Destination: "org.bootstrap.UDM1",
+		Body:        []any{"data", uint32(3), true, []string{"a", "bc"}, Variant{"s", "x"}},
+	}
+	data, err := m.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Serial != 7 || got.Path != m.Path || got.Interface != m.Interface || got.Member != m.Member || got.Destination != m.Destination {
+		t.Errorf("header = %+v, want %+v", got, m)
+	}
+	if got.Signature != "subasv" {
+		t.Errorf("signature = %q, want subasv", got.Signature)
+	}
+	if !reflect.DeepEqual(got.Body, m.Body) {
+		t.Errorf("body = %#v, want %#v", got.Body, m.Body)
+	}
+}
@@ -0,0 +1,101 @@
+// Package features gates new behaviors behind flags set in the configuration, so fleets
+// can enable them progressively per device group. Flags unknown to this build, e.g.
+// from a configuration written for a newer udm, are ignored with a warning.
+package features
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Version is the feature set version of this build, increased whenever a feature is added.
+const Version = 1
+
+const (
+	LUKS2Tokens  = "luks2Tokens"  // Record the TPM binding as a LUKS2 token in the header
+	SystemdUnits = "systemdUnits" // Install systemd drop-ins for persistent mounts
+	GoTPMBackend = "goTpmBackend" // Talk to the TPM natively instead of through tpm2-tools
+)
+
+// Feature describes a flag known to this build.
+type Feature struct {
+	Name      string
+	Since     int  // Feature set version that introduced the flag
+	Default   bool // Enabled unless configured otherwise
+	Available bool // Implemented by this build, unavailable flags cannot be enabled
+}
+
+// Known lists the flags of this build.
+var Known = []Feature{
+	{Name: LUKS2Tokens, Since: 1, Default: true, Available: true},
+	{Name: SystemdUnits, Since: 1, Default: true, Available: true},
+	{Name: GoTPMBackend, Since: 1, Default: false, Available: false},
+}
+
+// Set is the features block of the configuration, flag name to enabled.
+type Set map[string]bool
+
+// State is the effective state of a flag, as reported by status and the support bundle.
+type State struct {
+	Name      string `json:"name"`
+	Enabled   bool   `json:"enabled"`
+	Source    string `json:"source"` // default or config
+	Since     int    `json:"since"`
+	Available bool   `json:"available"`
+}
+
+func lookup(name string) *Feature {
+	for i := range Known {
+		if Known[i].Name == name {
+			return &Known[i]
+		}
+	}
+	return nil
+}
+
+// Enabled reports whether the flag is in effect.
+func (s Set) Enabled(name string) bool {
+	feature := lookup(name)
+	if feature == nil || !feature.Available {
+		return false
+	}
+	if enabled, ok := s[name]; ok {
+		return enabled
+	}
+	return feature.Default
+}
+
+// Effective returns the state of every flag known to this build.
+func (s Set) Effective() []State {
+	states := make([]State, 0, len(Known))
+	for _, feature := range Known {
+		state := State{Name: feature.Name, Enabled: s.Enabled(feature.Name), Source: "default",
+			Since: feature.Since, Available: feature.Available}
+		if _, ok := s[feature.Name]; ok {
+			state.Source = "config"
+		}
+		states = append(states, state)
+	}
+	return states
+}
+
+// Check returns warnings for flags this build does not know or cannot enable.
+func (s Set) Check() []string {
+	names := make([]string, 0, len(s))
+	for name := range s {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var warnings []string
+	for _, name := range names {
+		feature := lookup(name)
+		switch {
+		case feature == nil:
+			warnings = append(warnings, fmt.Sprintf("feature %s is unknown to this build (feature set version %d), ignored", name, Version))
+		case s[name] && !feature.Available:
+			warnings = append(warnings, fmt.Sprintf("feature %s is not available in this build, ignored", name))
+		}
+	}
+	return warnings
+}
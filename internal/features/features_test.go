@@ -0,0 +1,20 @@
+package features
+
+import "testing"
+
+func TestEnabled(t *testing.T) {
+	set := Set{SystemdUnits: false, GoTPMBackend: true, "fromTheFuture": true}
+
+	if !set.Enabled(LUKS2Tokens) {
+		t.Errorf("Enabled(%s) = false, want the default true", LUKS2Tokens)
+	}
+	if set.Enabled(SystemdUnits) {
+		t.Errorf("Enabled(%s) = true, want false as configured", SystemdUnits)
+	}
+	if set.Enabled(GoTPMBackend) {
+		t.Errorf("Enabled(%s) = true, want false as it is not available", GoTPMBackend)
+	}
+	if warnings := set.Check(); len(warnings) != 2 {
+		t.Errorf("Check() = %v, want warnings for the unknown and the unavailable flag", warnings)
+	}
+}
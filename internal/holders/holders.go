@@ -0,0 +1,143 @@
+// Package holders reference counts the consumers of a mounted volume, so a volume shared
+// by several clients is only unmounted when the last of them releases it.
+package holders
+
+import (
+	"bootstrap/internal/lock"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DefaultHolder identifies mounts made from the command line without --holder.
+const DefaultHolder = "cli"
+
+// Holder is a consumer of a mounted volume.
+type Holder struct {
+	ID      string    `json:"id"`
+	Since   time.Time `json:"since"`
+	Expires time.Time `json:"expires,omitempty"` // Zero when the hold does not expire
+}
+
+// Expired reports whether the hold has expired at now.
+func (h Holder) Expired(now time.Time) bool {
+	return !h.Expires.IsZero() && now.After(h.Expires)
+}
+
+// Table is the holder table of one volume. Callers serialize access with the volume lock.
+type Table struct {
+	path    string
+	Holders []Holder `json:"holders"`
+}
+
+// Load reads the holder table of the named volume, returning an empty table if the
+// volume has no holders.
+func Load(name string) (*Table, error) {
+	t := &Table{path: filepath.Join(lock.Dir, name+".holders")}
+	data, err := os.ReadFile(t.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read holders file: %w", err)
+	}
+	if err := json.Unmarshal(data, t); err != nil {
+		return nil, fmt.Errorf("failed to parse holders file %s: %w", t.path, err)
+	}
+	return t, nil
+}
+
+// Save writes the table back, removing the file once the last holder is gone.
+func (t *Table) Save() error {
+	if len(t.Holders) == 0 {
+		if err := os.Remove(t.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove holders file: %w", err)
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(t.path), 0700); err != nil {
+		return fmt.Errorf("failed to create holders directory: %w", err)
+	}
+	data, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode holders: %w", err)
+	}
+	tmp := t.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write holders file: %w", err)
+	}
+	return os.Rename(tmp, t.path)
+}
+
+// Acquire adds a hold for id, or refreshes it if id already holds the volume. A zero ttl
+// holds the volume until it is released.
+func (t *Table) Acquire(id string, ttl time.Duration, now time.Time) Holder {
+	var expires time.Time
+	if ttl > 0 {
+		expires = now.Add(ttl)
+	}
+
+	for i := range t.Holders {
+		if t.Holders[i].ID == id {
+			t.Holders[i].Expires = expires
+			return t.Holders[i]
+		}
+	}
+	h := Holder{ID: id, Since: now, Expires: expires}
+	t.Holders = append(t.Holders, h)
+	return h
+}
+
+// Release drops the hold of id and returns the number of holders left.
+func (t *Table) Release(id string) (remaining int, err error) {
+	for i := range t.Holders {
+		if t.Holders[i].ID == id {
+			t.Holders = append(t.Holders[:i], t.Holders[i+1:]...)
+			return len(t.Holders), nil
+		}
+	}
+	return len(t.Holders), fmt.Errorf("%s does not hold the volume", id)
+}
+
+// Renew extends the lease of id to expire ttl after now.
+func (t *Table) Renew(id string, ttl time.Duration, now time.Time) (Holder, error) {
+	for i := range t.Holders {
+		if t.Holders[i].ID != id {
+			continue
+		}
+		if t.Holders[i].Expired(now) {
+			return Holder{}, fmt.Errorf("lease of %s expired at %s", id, t.Holders[i].Expires.Format(time.RFC3339))
+		}
+		t.Holders[i].Expires = now.Add(ttl)
+		return t.Holders[i], nil
+	}
+	return Holder{}, fmt.Errorf("%s does not hold the volume", id)
+}
+
+// Reap drops the holders whose lease expired at now and returns them.
+func (t *Table) Reap(now time.Time) []Holder {
+	var expired []Holder
+	live := t.Holders[:0]
+	for _, h := range t.Holders {
+		if h.Expired(now) {
+			expired = append(expired, h)
+		} else {
+			live = append(live, h)
+		}
+	}
+	t.Holders = live
+	return expired
+}
+
+// IDs returns the ids of the current holders.
+func (t *Table) IDs() []string {
+	ids := make([]string, 0, len(t.Holders))
+	for _, h := range t.Holders {
+		ids = append(ids, h.ID)
+	}
+	return ids
+}
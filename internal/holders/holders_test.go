@@ -0,0 +1,66 @@
+package holders
+
+import (
+	"bootstrap/internal/lock"
+	"testing"
+	"time"
+)
+
+func TestAcquireRelease(t *testing.T) {
+	lock.Dir = t.TempDir()
+	now := time.Now()
+
+	held, err := Load("udm-test")
+	if err != nil {
+		t.Fatalf("Load() error = %v, want nil", err)
+	}
+	held.Acquire("docker", 0, now)
+	held.Acquire("cli", time.Minute, now)
+	held.Acquire("docker", 0, now) // Repeated mounts hold a single reference
+	if err := held.Save(); err != nil {
+		t.Fatalf("Save() error = %v, want nil", err)
+	}
+
+	held, err = Load("udm-test")
+	if err != nil {
+		t.Fatalf("Load() error = %v, want nil", err)
+	}
+	if len(held.Holders) != 2 {
+		t.Fatalf("Load() holders = %v, want 2", held.IDs())
+	}
+
+	if remaining, err := held.Release("docker"); err != nil || remaining != 1 {
+		t.Fatalf("Release(docker) = %d, %v, want 1, nil", remaining, err)
+	}
+	if _, err := held.Release("docker"); err == nil {
+		t.Fatalf("Release(docker) twice error = nil, want error")
+	}
+	if remaining, err := held.Release("cli"); err != nil || remaining != 0 {
+		t.Fatalf("Release(cli) = %d, %v, want 0, nil", remaining, err)
+	}
+}
+
+func TestLeaseExpiry(t *testing.T) {
+	now := time.Now()
+	held := &Table{}
+	held.Acquire("orchestrator", time.Minute, now)
+	held.Acquire("cli", 0, now)
+
+	if _, err := held.Renew("orchestrator", time.Minute, now.Add(30*time.Second)); err != nil {
+		t.Fatalf("Renew() error = %v, want nil", err)
+	}
+	if expired := held.Reap(now.Add(time.Minute)); len(expired) != 0 {
+		t.Fatalf("Reap() after renew = %v, want none", expired)
+	}
+
+	expired := held.Reap(now.Add(2 * time.Minute))
+	if len(expired) != 1 || expired[0].ID != "orchestrator" {
+		t.Fatalf("Reap() = %v, want orchestrator", expired)
+	}
+	if _, err := held.Renew("orchestrator", time.Minute, now.Add(2*time.Minute)); err == nil {
+		t.Fatalf("Renew() after reap error = nil, want error")
+	}
+	if ids := held.IDs(); len(ids) != 1 || ids[0] != "cli" {
+		t.Fatalf("IDs() = %v, want [cli]", ids)
+	}
+}
@@ -0,0 +1,149 @@
+// Package hooks runs user-specified executables before and after each lifecycle phase
+// of the volume, e.g. to stop a database before unmount or to notify a monitoring
+// agent once the volume is mounted.
+package hooks
+
+import (
+	"bootstrap/internal/trace"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const DefaultTimeout = 60 * time.Second
+
+// Phases hooks run around. A hook runs with the phase as its only argument, e.g.
+// "preMount", so one script may serve several phases.
+const (
+	PreAuthorize    = "preAuthorize"
+	PostAuthorize   = "postAuthorize"
+	PreMount        = "preMount"
+	PostMount       = "postMount"
+	PreUnmount      = "preUnmount"
+	PostUnmount     = "postUnmount"
+	PreDeauthorize  = "preDeauthorize"
+	PostDeauthorize = "postDeauthorize"
+)
+
+// Config lists the executables run for each phase, in order. A failing pre hook aborts
+// the phase, a failing post hook is only logged since the phase already happened.
+type Config struct {
+	PreAuthorize    []string `yaml:"preAuthorize"`
+	PostAuthorize   []string `yaml:"postAuthorize"`
+	PreMount        []string `yaml:"preMount"`
+	PostMount       []string `yaml:"postMount"`
+	PreUnmount      []string `yaml:"preUnmount"`
+	PostUnmount     []string `yaml:"postUnmount"`
+	PreDeauthorize  []string `yaml:"preDeauthorize"`
+	PostDeauthorize []string `yaml:"postDeauthorize"`
+	Timeout         string   `yaml:"timeout"` // How long each hook may run, e.g. "60s"
+}
+
+// Volume is the context passed to hooks as UDM_* environment variables.
+type Volume struct {
+	Command    string // udm command or daemon event running the phase
+	MapperName string
+	MountPoint string
+	VolumePath string
+}
+
+func (c Config) phases() map[string][]string {
+	return map[string][]string{
+		PreAuthorize:    c.PreAuthorize,
+		PostAuthorize:   c.PostAuthorize,
+		PreMount:        c.PreMount,
+		PostMount:       c.PostMount,
+		PreUnmount:      c.PreUnmount,
+		PostUnmount:     c.PostUnmount,
+		PreDeauthorize:  c.PreDeauthorize,
+		PostDeauthorize: c.PostDeauthorize,
+	}
+}
+
+// Validate checks the hook paths and the timeout.
+func (c Config) Validate() error {
+	for phase, paths := range c.phases() {
+		for _, path := range paths {
+			if !filepath.IsAbs(path) {
+				return fmt.Errorf("hooks.%s entry %q must be an absolute path", phase, path)
+			}
+		}
+	}
+	if c.Timeout != "" {
+		if d, err := time.ParseDuration(c.Timeout); err != nil || d <= 0 {
+			return fmt.Errorf("hooks.timeout (%s) must be a positive duration, e.g. \"60s\"", c.Timeout)
+		}
+	}
+	return nil
+}
+
+// timeout returns the configured time limit of a hook.
+func (c Config) timeout() time.Duration {
+	if d, err := time.ParseDuration(c.Timeout); err == nil && d > 0 {
+		return d
+	}
+	return DefaultTimeout
+}
+
+// Run runs the hooks of phase in order. It stops at the first failing hook and returns
+// its error, which callers abort on for pre hooks.
+func (c Config) Run(phase string, volume Volume) error {
+	for _, path := range c.phases()[phase] {
+		log.Printf("Running %s hook: %s", phase, path)
+		if err := c.run(path, phase, volume); err != nil {
+			return fmt.Errorf("%s hook %s: %w", phase, path, err)
+		}
+	}
+	return nil
+}
+
+// RunPost runs the hooks of a post phase, logging a failure instead of returning it.
+func (c Config) RunPost(phase string, volume Volume) {
+	if err := c.Run(phase, volume); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+}
+
+// run runs the hook in a process group of its own, killed as a whole on timeout. A
+// child the hook leaves running in the background may keep its output open, Wait stops
+// reading it shortly after the hook itself exited.
+func (c Config) run(path, phase string, volume Volume) error {
+	timeout := c.timeout()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := trace.CommandContext(ctx, path, phase)
+	cmd.Env = append(os.Environ(), volume.env(phase)...)
+	var output strings.Builder
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	err := cmd.Run()
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, exec.ErrWaitDelay):
+		log.Printf("%s hook %s left a process running in the background", phase, path)
+		return nil
+	case errors.Is(err, context.DeadlineExceeded):
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+	return fmt.Errorf("%s: %s", err, strings.TrimSpace(output.String()))
+}
+
+// env returns the UDM_* variables describing the volume to a hook.
+func (v Volume) env(phase string) []string {
+	return []string{
+		"UDM_HOOK=" + phase,
+		"UDM_COMMAND=" + v.Command,
+		"UDM_MAPPER=" + v.MapperName,
+		"UDM_MOUNT_POINT=" + v.MountPoint,
+		"UDM_VOLUME_PATH=" + v.VolumePath,
+		"UDM_DEVICE=/dev/mapper/" + v.MapperName,
+	}
+}
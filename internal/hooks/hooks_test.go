@@ -0,0 +1,90 @@
+package hooks
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeHook(t *testing.T, dir, name, script string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	ok := writeHook(t, dir, "ok", `echo "$1 $UDM_COMMAND $UDM_MAPPER $UDM_DEVICE" >> `+out+"\n")
+	fail := writeHook(t, dir, "fail", "echo refused; exit 3\n")
+
+	cfg := Config{PreMount: []string{ok, ok}, PreUnmount: []string{fail, ok}}
+	volume := Volume{Command: "mount", MapperName: "data"}
+	if err := cfg.Run(PreMount, volume); err != nil {
+		t.Fatalf("Run(PreMount) = %v", err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Repeat("preMount mount data /dev/mapper/data\n", 2)
+	if string(data) != want {
+		t.Errorf("hook output = %q, want %q", data, want)
+	}
+
+	// The first failing hook stops the phase
+	err = cfg.Run(PreUnmount, volume)
+	if err == nil || !strings.Contains(err.Error(), "refused") {
+		t.Errorf("Run(PreUnmount) = %v, want the output of the failing hook", err)
+	}
+	if data, _ := os.ReadFile(out); string(data) != want {
+		t.Errorf("hook after a failing one ran")
+	}
+
+	// Phases without hooks do nothing
+	if err := cfg.Run(PostMount, volume); err != nil {
+		t.Errorf("Run(PostMount) = %v", err)
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	slow := writeHook(t, t.TempDir(), "slow", "exec sleep 5\n")
+	cfg := Config{PostMount: []string{slow}, Timeout: "100ms"}
+	if err := cfg.Run(PostMount, Volume{}); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("Run = %v, want a timeout", err)
+	}
+}
+
+func TestRunBackgroundChild(t *testing.T) {
+	// The child inherits the output of the hook and outlives it
+	daemonizing := writeHook(t, t.TempDir(), "daemonizing", "sleep 5 &\necho started\n")
+	cfg := Config{PostMount: []string{daemonizing}, Timeout: "10s"}
+	start := time.Now()
+	if err := cfg.Run(PostMount, Volume{}); err != nil {
+		t.Errorf("Run = %v, want nil", err)
+	}
+	if elapsed := time.Since(start); elapsed > 4*time.Second {
+		t.Errorf("Run returned after %s, want it not to wait for the background child", elapsed)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, c := range []struct {
+		cfg Config
+		ok  bool
+	}{
+		{Config{PreMount: []string{"/usr/local/bin/hook"}, Timeout: "30s"}, true},
+		{Config{PostDeauthorize: []string{"hook"}}, false},
+		{Config{Timeout: "soon"}, false},
+		{Config{Timeout: "-1s"}, false},
+	} {
+		if err := c.cfg.Validate(); (err == nil) != c.ok {
+			t.Errorf("Validate(%+v) = %v, want ok %v", c.cfg, err, c.ok)
+		}
+	}
+}
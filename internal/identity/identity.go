@@ -0,0 +1,318 @@
+// Package identity enrolls the device with a certificate authority over EST (RFC 7030):
+// it generates a keypair, TPM-backed when configured, submits a CSR to the simpleenroll
+// endpoint and stores the issued certificate.
+package identity
+
+import (
+	"bootstrap/internal/trace"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultDir       = "identity"   // Directory on the volume holding the identity
+	DefaultKeyHandle = "0x81010002" // Persistent handle of a TPM-backed key
+)
+
+// Config configures device enrollment during authorize.
+type Config struct {
+	ESTServer    string `yaml:"estServer"`    // EST base URL, e.g. https://est.example.com/.well-known/est
+	CACert       string `yaml:"caCert"`       // CA bundle verifying the EST server, system roots when empty
+	PasswordFile string `yaml:"passwordFile"` // HTTP basic auth password, the user is the bootstrap token id
+	UseTPM       bool   `yaml:"useTPM"`       // Generate the key in the TPM instead of on the volume
+	KeyHandle    string `yaml:"keyHandle"`    // Persistent handle of the TPM-backed key
+	Dir          string `yaml:"dir"`          // Directory on the volume, relative to the mount point
+}
+
+// Enabled reports whether enrollment is configured.
+func (c Config) Enabled() bool {
+	return c.ESTServer != ""
+}
+
+// Result describes the issued identity.
+type Result struct {
+	Subject     string    `json:"subject"`
+	Serial      string    `json:"serial"`
+	NotAfter    time.Time `json:"notAfter"`
+	Certificate string    `json:"certificate"` // Path of the certificate on the volume
+}
+
+// signer creates the key and a DER CSR for commonName.
+type signer interface {
+	csr(commonName string) ([]byte, error)
+	store(dir string) error // Persist the key, or a reference to it
+}
+
+// Enroll generates a key, has the EST server issue a certificate for commonName and
+// stores key and certificate in cfg.Dir below mountPoint. user authenticates the
+// request together with the configured password.
+func Enroll(cfg Config, mountPoint, commonName, user string) (*Result, error) {
+	dir := cfg.Dir
+	if dir == "" {
+		dir = DefaultDir
+	}
+	dir = filepath.Join(mountPoint, dir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create identity directory: %w", err)
+	}
+
+	var key signer = &softwareKey{}
+	if cfg.UseTPM {
+		handle := cfg.KeyHandle
+		if handle == "" {
+			handle = DefaultKeyHandle
+		}
+		key = &tpmKey{handle: handle}
+	}
+	csr, err := key.csr(commonName)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := newClient(cfg.CACert)
+	if err != nil {
+		return nil, err
+	}
+	var password string
+	if cfg.PasswordFile != "" {
+		data, err := os.ReadFile(cfg.PasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read EST password: %w", err)
+		}
+		password = strings.TrimSpace(string(data))
+	}
+	certs, err := simpleEnroll(client, cfg.ESTServer, csr, user, password)
+	if err != nil {
+		return nil, err
+	}
+	if certs, err = leafFirst(certs, csr); err != nil {
+		return nil, err
+	}
+
+	if err := key.store(dir); err != nil {
+		return nil, err
+	}
+	var chain bytes.Buffer
+	for _, cert := range certs {
+		pem.Encode(&chain, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	certPath := filepath.Join(dir, "device.crt")
+	if err := os.WriteFile(certPath, chain.Bytes(), 0644); err != nil {
+		return nil, fmt.Errorf("failed to store certificate: %w", err)
+	}
+
+	return &Result{
+		Subject:     certs[0].Subject.String(),
+		Serial:      certs[0].SerialNumber.String(),
+		NotAfter:    certs[0].NotAfter,
+		Certificate: certPath,
+	}, nil
+}
+
+func newClient(caCert string) (*http.Client, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caCert != "" {
+		data, err := os.ReadFile(caCert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read EST CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates in %s", caCert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return &http.Client{Timeout: 60 * time.Second, Transport: &http.Transport{TLSClientConfig: tlsConfig}}, nil
+}
+
+// simpleEnroll posts the CSR to <server>/simpleenroll and returns the certificates of the
+// response, the issued one and any chain certificates in no particular order.
+func simpleEnroll(client *http.Client, server string, csr []byte, user, password string) ([]*x509.Certificate, error) {
+	body := base64.StdEncoding.EncodeToString(csr)
+	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(server, "/")+"/simpleenroll", strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/pkcs10")
+	req.Header.Set("Content-Transfer-Encoding", "base64")
+	if user != "" || password != "" {
+		req.SetBasicAuth(user, password)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("EST request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read EST response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("EST server returned %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(data)), ""))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode EST response: %w", err)
+	}
+	certs, err := parseCertsOnly(der)
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("EST response contains no certificate")
+	}
+	return certs, nil
+}
+
+// leafFirst orders certs with the certificate issued for the key of csr first, followed
+// by the chain. A certs-only response is a set, the leaf need not come first.
+func leafFirst(certs []*x509.Certificate, csr []byte) ([]*x509.Certificate, error) {
+	req, err := x509.ParseCertificateRequest(csr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CSR: %w", err)
+	}
+	key, ok := req.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok {
+		return nil, fmt.Errorf("unsupported CSR key type %T", req.PublicKey)
+	}
+	for i, cert := range certs {
+		if key.Equal(cert.PublicKey) {
+			ordered := append([]*x509.Certificate{cert}, certs[:i]...)
+			return append(ordered, certs[i+1:]...), nil
+		}
+	}
+	return nil, fmt.Errorf("EST response contains no certificate for the device key")
+}
+
+// PKCS#7 certs-only structures, the degenerate SignedData returned by EST.
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,tag:0"`
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue
+	ContentInfo      asn1.RawValue
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      asn1.RawValue
+}
+
+var oidSignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+
+// parseCertsOnly extracts the certificates of a PKCS#7 certs-only message.
+func parseCertsOnly(der []byte) ([]*x509.Certificate, error) {
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(der, &ci); err != nil {
+		return nil, fmt.Errorf("failed to parse PKCS#7: %w", err)
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		return nil, fmt.Errorf("unexpected PKCS#7 content type %s", ci.ContentType)
+	}
+	var sd signedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, fmt.Errorf("failed to parse PKCS#7 signed data: %w", err)
+	}
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse issued certificates: %w", err)
+	}
+	return certs, nil
+}
+
+// softwareKey is an ECDSA P-256 key stored on the encrypted volume.
+type softwareKey struct {
+	key *ecdsa.PrivateKey
+}
+
+func (k *softwareKey) csr(commonName string) ([]byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	k.key = key
+	template := &x509.CertificateRequest{Subject: pkix.Name{CommonName: commonName}}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CSR: %w", err)
+	}
+	return csr, nil
+}
+
+func (k *softwareKey) store(dir string) error {
+	der, err := x509.MarshalECPrivateKey(k.key)
+	if err != nil {
+		return fmt.Errorf("failed to encode key: %w", err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(filepath.Join(dir, "device.key"), data, 0600); err != nil {
+		return fmt.Errorf("failed to store key: %w", err)
+	}
+	return nil
+}
+
+// tpmKey is an ECC signing key that never leaves the TPM, persisted at handle. The CSR
+// is signed through the OpenSSL tpm2 provider.
+type tpmKey struct {
+	handle string
+}
+
+func (k *tpmKey) csr(commonName string) ([]byte, error) {
+	tmp, err := os.MkdirTemp("", "udm-identity-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+	path := func(name string) string { return filepath.Join(tmp, name) }
+
+	// Replace a key left by an earlier enrollment
+	trace.Command("tpm2_evictcontrol", "-C", "o", "-c", k.handle).Run()
+
+	steps := [][]string{
+		{"tpm2_createprimary", "-C", "o", "-G", "ecc", "-c", path("primary.ctx")},
+		{"tpm2_create", "-C", path("primary.ctx"), "-G", "ecc256:ecdsa", "-u", path("key.pub"), "-r", path("key.priv")},
+		{"tpm2_load", "-C", path("primary.ctx"), "-u", path("key.pub"), "-r", path("key.priv"), "-c", path("key.ctx")},
+		{"tpm2_evictcontrol", "-C", "o", "-c", path("key.ctx"), k.handle},
+	}
+	for _, step := range steps {
+		if output, err := trace.Command(step[0], step[1:]...).CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("%s failed: %s", step[0], strings.TrimSpace(string(output)))
+		}
+	}
+
+	cmd := trace.Command("openssl", "req", "-new", "-provider", "tpm2", "-provider", "default",
+		"-key", "handle:"+k.handle, "-subj", "/CN="+commonName, "-outform", "DER")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	csr, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CSR with the TPM key: %s", strings.TrimSpace(stderr.String()))
+	}
+	return csr, nil
+}
+
+func (k *tpmKey) store(dir string) error {
+	if err := os.WriteFile(filepath.Join(dir, "device.key.handle"), []byte(k.handle+"\n"), 0600); err != nil {
+		return fmt.Errorf("failed to store key handle: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package identity
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// certsOnly builds the degenerate PKCS#7 SignedData an EST server returns.
+func certsOnly(t *testing.T, certs ...[]byte) []byte {
+	t.Helper()
+	var raw []byte
+	for _, cert := range certs {
+		raw = append(raw, cert...)
+	}
+	emptySet := asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true}
+	data, err := asn1.Marshal(struct {
+		Version          int
+		DigestAlgorithms asn1.RawValue
+		ContentInfo      struct{ ContentType asn1.ObjectIdentifier }
+		Certificates     asn1.RawValue
+		SignerInfos      asn1.RawValue
+	}{
+		Version:          1,
+		DigestAlgorithms: emptySet,
+		ContentInfo:      struct{ ContentType asn1.ObjectIdentifier }{asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: raw},
+		SignerInfos:      emptySet,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := asn1.Marshal(contentInfo{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{FullBytes: append([]byte{0xa0, 0x82, byte(len(data) >> 8), byte(len(data))}, data...)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestEnroll(t *testing.T) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, _ := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	ca, _ := x509.ParseCertificate(caDER)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/.well-known/est/simpleenroll" {
+			http.NotFound(w, r)
+			return
+		}
+		if user, password, _ := r.BasicAuth(); user != "token-1" || password != "secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		der, err := base64.StdEncoding.DecodeString(string(body))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil || csr.CheckSignature() != nil {
+			http.Error(w, "bad CSR", http.StatusBadRequest)
+			return
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(42),
+			Subject:      csr.Subject,
+			NotBefore:    time.Now(),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		cert, _ := x509.CreateCertificate(rand.Reader, template, ca, csr.PublicKey, caKey)
+		w.Header().Set("Content-Type", "application/pkcs7-mime; smime-type=certs-only")
+		// The set of a certs-only response is not ordered, the CA may come first
+		w.Write([]byte(base64.StdEncoding.EncodeToString(certsOnly(t, caDER, cert))))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "server-ca.pem")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644)
+	passwordFile := filepath.Join(dir, "password")
+	os.WriteFile(passwordFile, []byte("secret\n"), 0600)
+
+	cfg := Config{ESTServer: server.URL + "/.well-known/est", CACert: caFile, PasswordFile: passwordFile}
+	mountPoint := filepath.Join(dir, "mnt")
+	result, err := Enroll(cfg, mountPoint, "device-1", "token-1")
+	if err != nil {
+		t.Fatalf("Enroll failed: %v", err)
+	}
+	if result.Subject != "CN=device-1" || result.Serial != "42" {
+		t.Errorf("unexpected certificate %s serial %s", result.Subject, result.Serial)
+	}
+
+	data, err := os.ReadFile(filepath.Join(mountPoint, DefaultDir, "device.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, rest := pem.Decode(data)
+	if block == nil || len(rest) == 0 {
+		t.Fatalf("expected certificate followed by the CA chain")
+	}
+	if leaf, err := x509.ParseCertificate(block.Bytes); err != nil || leaf.SerialNumber.Int64() != 42 {
+		t.Errorf("device.crt does not start with the issued certificate")
+	}
+	info, err := os.Stat(filepath.Join(mountPoint, DefaultDir, "device.key"))
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("device key missing or not private: %v", err)
+	}
+
+	if _, err := Enroll(Config{ESTServer: cfg.ESTServer, CACert: caFile}, mountPoint, "device-1", "token-1"); err == nil {
+		t.Errorf("expected unauthenticated enrollment to fail")
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !linux && !darwin
+
+package lock
+
+import (
+	"bootstrap/internal/platform"
+	"errors"
+	"os"
+)
+
+var errWouldBlock = errors.New("lock would block")
+
+func tryLock(file *os.File) error {
+	return platform.ErrUnsupportedPlatform
+}
+
+func unlock(file *os.File) error {
+	return platform.ErrUnsupportedPlatform
+}
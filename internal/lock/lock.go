@@ -0,0 +1,91 @@
+// Package lock provides per-volume advisory locks so concurrent invocations cannot
+// race on crypttab edits and mapper setup.
+package lock
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultDir = "/run/bootstrap-udm"
+
+// pollInterval is how often a waiting Acquire retries the lock.
+const pollInterval = 100 * time.Millisecond
+
+// ErrLocked is returned when another instance holds the lock past the wait timeout.
+var ErrLocked = errors.New("lock is held by another instance")
+
+// Dir is the directory lock files are created in.
+var Dir = DefaultDir
+
+// Lock is an exclusive flock on a per-volume lock file.
+type Lock struct {
+	file *os.File
+}
+
+// Acquire takes the exclusive lock for name, retrying for up to wait before giving up.
+func Acquire(name string, wait time.Duration) (*Lock, error) {
+	return AcquireIn(Dir, name, wait)
+}
+
+// AcquireIn is Acquire with the lock file in dir, for locks shared beyond the volumes
+// of Dir.
+func AcquireIn(dir, name string, wait time.Duration) (*Lock, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create lock directory %s: %w", dir, err)
+	}
+
+	path := filepath.Join(dir, name+".lock")
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file %s: %w", path, err)
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		err := tryLock(file)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, errWouldBlock) {
+			file.Close()
+			return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+		}
+		if time.Now().After(deadline) {
+			holder := readHolder(file)
+			file.Close()
+			return nil, fmt.Errorf("%w: %s is locked by pid %s, retry later or use --wait-lock", ErrLocked, name, holder)
+		}
+		time.Sleep(pollInterval)
+	}
+
+	// Record our pid so a blocked instance can report who holds the lock
+	if err := file.Truncate(0); err == nil {
+		file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return &Lock{file: file}, nil
+}
+
+// Release drops the lock. Locks are also released when the process exits.
+func (l *Lock) Release() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	defer l.file.Close()
+	return unlock(l.file)
+}
+
+// readHolder returns the pid recorded in the lock file, or "unknown".
+func readHolder(file *os.File) string {
+	buf := make([]byte, 32)
+	n, _ := file.ReadAt(buf, 0)
+	if pid := strings.TrimSpace(string(buf[:n])); pid != "" {
+		return pid
+	}
+	return "unknown"
+}
@@ -0,0 +1,30 @@
+package lock
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAcquireContended(t *testing.T) {
+	Dir = t.TempDir()
+
+	first, err := Acquire("udm-test", 0)
+	if err != nil {
+		t.Fatalf("Acquire() error = %v, want nil", err)
+	}
+
+	if _, err := Acquire("udm-test", 200*time.Millisecond); !errors.Is(err, ErrLocked) {
+		t.Fatalf("Acquire() while held error = %v, want ErrLocked", err)
+	}
+
+	if err := first.Release(); err != nil {
+		t.Fatalf("Release() error = %v, want nil", err)
+	}
+
+	second, err := Acquire("udm-test", 0)
+	if err != nil {
+		t.Fatalf("Acquire() after release error = %v, want nil", err)
+	}
+	second.Release()
+}
@@ -0,0 +1,74 @@
+package luks
+
+import (
+	"bootstrap/internal/trace"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const DefaultIdleTimeout = "10min"
+
+// automountDropIn is the drop-in that stops (re-locks) the cryptsetup unit once the
+// automounted filesystem no longer needs it.
+const automountDropIn = `[Unit]
+StopWhenUnneeded=yes
+`
+
+// automountFstabOptions returns the fstab options for on-demand mounting.
+func automountFstabOptions(cfg *LUKS) string {
+	opts := "noauto,x-systemd.automount"
+	if cfg.IdleTimeout != "" {
+		opts += ",x-systemd.idle-timeout=" + cfg.IdleTimeout
+	}
+	return opts
+}
+
+// cryptsetupDropInDir returns the drop-in directory of the systemd-cryptsetup unit for the mapper.
+func cryptsetupDropInDir(mapperName string) (string, error) {
+	output, err := trace.Command("systemd-escape", mapperName).Output()
+	if err != nil {
+		return "", fmt.Errorf("systemd-escape failed: %w", err)
+	}
+	unit := fmt.Sprintf("systemd-cryptsetup@%s.service", strings.TrimSpace(string(output)))
+	return filepath.Join("/etc/systemd/system", unit+".d"), nil
+}
+
+// installAutomountDropIn makes the cryptsetup unit stop when the automount idles out,
+// so the volume is locked again until the next access.
+func installAutomountDropIn(cfg *LUKS) error {
+	dir, err := cryptsetupDropInDir(cfg.MapperName)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create drop-in directory: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "udm-automount.conf"), []byte(automountDropIn), 0644); err != nil {
+		return fmt.Errorf("failed to write drop-in: %w", err)
+	}
+	return reloadSystemd()
+}
+
+// removeAutomountDropIn removes the drop-in installed by installAutomountDropIn.
+func removeAutomountDropIn(cfg *LUKS) error {
+	dir, err := cryptsetupDropInDir(cfg.MapperName)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(dir, "udm-automount.conf")); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove drop-in: %w", err)
+	}
+	os.Remove(dir) // only succeeds when no other drop-ins remain
+	return reloadSystemd()
+}
+
+// reloadSystemd makes systemd pick up changed units, fstab and crypttab.
+func reloadSystemd() error {
+	cmd := trace.Command("systemctl", "daemon-reload")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("systemctl daemon-reload failed: %s", string(output))
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package luks
+
+import (
+	"bootstrap/internal/trace"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Crypt backends selected at build time.
+const (
+	BackendCLI           = "cli"           // cryptsetup command line, the default
+	BackendLibcryptsetup = "libcryptsetup" // libcryptsetup through cgo, built with -tags libcryptsetup
+)
+
+// cryptBackend formats, opens and closes volumes. The CLI backend depends on cryptsetup's
+// exit codes and output, which differ between versions and locales; the libcryptsetup
+// backend reports errno values instead.
+type cryptBackend interface {
+	name() string
+	format(ctx context.Context, cfg *LUKS, path string, password []byte) error
+	open(ctx context.Context, device, mapperName string, password []byte, readOnly, discards bool) error
+	close(ctx context.Context, mapperName string) error
+	uuid(ctx context.Context, path string) (string, error)
+}
+
+// ErrWrongKey is returned by open when no keyslot accepts the key, as opposed to failures
+// of the device or the tools. Only these count as failed unlocks for luks.lockout.
+var ErrWrongKey = errors.New("no key available with this passphrase")
+
+// cryptsetupWrongKey is the exit code of cryptsetup when no keyslot accepts the key.
+const cryptsetupWrongKey = 2
+
+// isWrongKey reports whether cryptsetup failed because no keyslot accepted the key.
+func isWrongKey(err error) bool {
+	var exitErr *exec.ExitError
+	return errors.As(err, &exitErr) && exitErr.ExitCode() == cryptsetupWrongKey
+}
+
+// backend is replaced by the libcryptsetup backend when it is compiled in.
+var backend cryptBackend = cliBackend{}
+
+// CryptBackend names the backend formatting and opening volumes.
+func CryptBackend() string {
+	return backend.name()
+}
+
+// cliBackend runs the cryptsetup command line.
+type cliBackend struct{}
+
+func (cliBackend) name() string {
+	return BackendCLI
+}
+
+// format formats the file as a LUKS volume, reporting the output of cryptsetup as
+// progress of the create step. Formatting is not bounded by a timeout, wiping the
+// integrity tags takes as long as the device is large, it is only killed with ctx.
+func (cliBackend) format(ctx context.Context, cfg *LUKS, path string, password []byte) error {
+	// The key is read from stdin, it never touches the storage
+	args := append([]string{"luksFormat", "--type=luks2", "--batch-mode"}, cfg.formatArgs()...)
+	args = append(args, cfg.integrityArgs()...)
+	args = append(args, "--key-file=-", path)
+	cmd := trace.CommandContext(ctx, "cryptsetup", args...)
+	cmd.Stdin = createPasswordInput(password, false)
+
+	output, err := runStreaming(stepCreate, cmd)
+	if err != nil {
+		return fmt.Errorf("failed to format LUKS volume: %s, error: %w", output, err)
+	}
+	return nil
+}
+
+func (cliBackend) open(ctx context.Context, device, mapperName string, password []byte, readOnly, discards bool) error {
+	args := []string{"luksOpen", device, mapperName}
+	if readOnly {
+		args = append(args, "--readonly")
+	}
+	if discards {
+		args = append(args, "--allow-discards")
+	}
+	output, err := runRetried(ctx, OpCryptsetup, func() *trace.Cmd {
+		cmd := trace.Command("cryptsetup", args...)
+		cmd.Stdin = createPasswordInput(password, true)
+		return cmd
+	})
+	if isWrongKey(err) {
+		return fmt.Errorf("failed to open LUKS volume: %w", ErrWrongKey)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open LUKS volume: %s", output)
+	}
+	return nil
+}
+
+func (cliBackend) close(ctx context.Context, mapperName string) error {
+	output, err := runRetried(ctx, OpCryptsetup, func() *trace.Cmd { return trace.Command("cryptsetup", "luksClose", mapperName) })
+	if err != nil {
+		return fmt.Errorf("failed to close LUKS volume: %s", output)
+	}
+	return nil
+}
+
+func (cliBackend) uuid(ctx context.Context, path string) (string, error) {
+	output, err := outputRetried(ctx, OpCryptsetup, func() *trace.Cmd { return trace.Command("cryptsetup", "luksUUID", path) })
+	if err != nil {
+		return "", fmt.Errorf("failed to read LUKS UUID: %w", err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
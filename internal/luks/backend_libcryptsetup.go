@@ -0,0 +1,168 @@
+//go:build libcryptsetup && linux && cgo
+
+package luks
+
+/*
+#cgo pkg-config: libcryptsetup
+#include <errno.h>
+#include <stdlib.h>
+#include <string.h>
+#include <libcryptsetup.h>
+*/
+import "C"
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+func init() {
+	backend = libBackend{}
+}
+
+// libBackend calls libcryptsetup directly, so outcomes are errno values rather than
+// messages. Integrity-protected volumes are formatted by the CLI, which also wipes the
+// device to initialize the integrity tags.
+type libBackend struct{}
+
+func (libBackend) name() string {
+	return BackendLibcryptsetup
+}
+
+// cryptError describes a negative errno returned by libcryptsetup.
+func cryptError(op string, r C.int) error {
+	return fmt.Errorf("%s failed: %w", op, syscall.Errno(-r))
+}
+
+// passphrase points libcryptsetup at the key without copying it to the C heap, where it
+// could not be wiped.
+func passphrase(password []byte) (*C.char, C.size_t) {
+	if len(password) == 0 {
+		return nil, 0
+	}
+	return (*C.char)(unsafe.Pointer(&password[0])), C.size_t(len(password))
+}
+
+func (libBackend) format(ctx context.Context, cfg *LUKS, path string, password []byte) error {
+	if cfg.Integrity != "" {
+		return cliBackend{}.format(ctx, cfg, path, password)
+	}
+	cPath := C.CString(path)
+	defer C.free(unsafe.Pointer(cPath))
+	var cd *C.struct_crypt_device
+	if r := C.crypt_init(&cd, cPath); r < 0 {
+		return fmt.Errorf("failed to format LUKS volume: %w", cryptError("crypt_init", r))
+	}
+	defer C.crypt_free(cd)
+
+	if cfg.PBKDF != "" {
+		pbkdf := (*C.struct_crypt_pbkdf_type)(C.calloc(1, C.sizeof_struct_crypt_pbkdf_type))
+		defer C.free(unsafe.Pointer(pbkdf))
+		cType := C.CString(cfg.PBKDF)
+		defer C.free(unsafe.Pointer(cType))
+		cHash := C.CString("sha256")
+		defer C.free(unsafe.Pointer(cHash))
+		pbkdf._type = cType
+		pbkdf.hash = cHash
+		pbkdf.time_ms = 2000
+		if cfg.PBKDF != PBKDFPBKDF2 {
+			pbkdf.max_memory_kb = C.uint32_t(cfg.PBKDFMemory)
+			pbkdf.parallel_threads = C.uint32_t(min(8, runtime.NumCPU()))
+		}
+		if cfg.PBKDFIterations > 0 {
+			pbkdf.iterations = C.uint32_t(cfg.PBKDFIterations)
+			pbkdf.flags = C.CRYPT_PBKDF_NO_BENCHMARK
+		}
+		if r := C.crypt_set_pbkdf_type(cd, pbkdf); r < 0 {
+			return fmt.Errorf("failed to format LUKS volume: %w", cryptError("crypt_set_pbkdf_type", r))
+		}
+	}
+
+	// aes-xts-plain64 is cipher aes in mode xts-plain64
+	cipher, mode, _ := strings.Cut(cfg.Cipher, "-")
+	cCipher := C.CString(cipher)
+	defer C.free(unsafe.Pointer(cCipher))
+	cMode := C.CString(mode)
+	defer C.free(unsafe.Pointer(cMode))
+	cLUKS2 := C.CString("LUKS2")
+	defer C.free(unsafe.Pointer(cLUKS2))
+	keyBytes := cfg.KeySize / 8
+	if r := C.crypt_format(cd, cLUKS2, cCipher, cMode, nil, nil, C.size_t(keyBytes), nil); r < 0 {
+		return fmt.Errorf("failed to format LUKS volume: %w", cryptError("crypt_format", r))
+	}
+
+	pass, passLen := passphrase(password)
+	if r := C.crypt_keyslot_add_by_volume_key(cd, C.CRYPT_ANY_SLOT, nil, 0, pass, passLen); r < 0 {
+		return fmt.Errorf("failed to format LUKS volume: %w", cryptError("crypt_keyslot_add_by_volume_key", r))
+	}
+	return nil
+}
+
+func (libBackend) open(ctx context.Context, device, mapperName string, password []byte, readOnly, discards bool) error {
+	cDevice := C.CString(device)
+	defer C.free(unsafe.Pointer(cDevice))
+	cName := C.CString(mapperName)
+	defer C.free(unsafe.Pointer(cName))
+
+	var cd *C.struct_crypt_device
+	if r := C.crypt_init(&cd, cDevice); r < 0 {
+		return fmt.Errorf("failed to open LUKS volume: %w", cryptError("crypt_init", r))
+	}
+	defer C.crypt_free(cd)
+	if r := C.crypt_load(cd, nil, nil); r < 0 {
+		return fmt.Errorf("failed to open LUKS volume: %w", cryptError("crypt_load", r))
+	}
+	var flags C.uint32_t
+	if readOnly {
+		flags |= C.CRYPT_ACTIVATE_READONLY
+	}
+	if discards {
+		flags |= C.CRYPT_ACTIVATE_ALLOW_DISCARDS
+	}
+	pass, passLen := passphrase(password)
+	if r := C.crypt_activate_by_passphrase(cd, cName, C.CRYPT_ANY_SLOT, pass, passLen, flags); r < 0 {
+		if r == -C.EPERM {
+			return fmt.Errorf("failed to open LUKS volume: %w", ErrWrongKey)
+		}
+		return fmt.Errorf("failed to open LUKS volume: %w", cryptError("crypt_activate_by_passphrase", r))
+	}
+	return nil
+}
+
+func (libBackend) close(ctx context.Context, mapperName string) error {
+	cName := C.CString(mapperName)
+	defer C.free(unsafe.Pointer(cName))
+
+	var cd *C.struct_crypt_device
+	if r := C.crypt_init_by_name(&cd, cName); r < 0 {
+		return fmt.Errorf("failed to close LUKS volume: %w", cryptError("crypt_init_by_name", r))
+	}
+	defer C.crypt_free(cd)
+	if r := C.crypt_deactivate(cd, cName); r < 0 {
+		return fmt.Errorf("failed to close LUKS volume: %w", cryptError("crypt_deactivate", r))
+	}
+	return nil
+}
+
+func (libBackend) uuid(ctx context.Context, path string) (string, error) {
+	cPath := C.CString(path)
+	defer C.free(unsafe.Pointer(cPath))
+
+	var cd *C.struct_crypt_device
+	if r := C.crypt_init(&cd, cPath); r < 0 {
+		return "", fmt.Errorf("failed to read LUKS UUID: %w", cryptError("crypt_init", r))
+	}
+	defer C.crypt_free(cd)
+	if r := C.crypt_load(cd, nil, nil); r < 0 {
+		return "", fmt.Errorf("failed to read LUKS UUID: %w", cryptError("crypt_load", r))
+	}
+	uuid := C.crypt_get_uuid(cd)
+	if uuid == nil {
+		return "", fmt.Errorf("failed to read LUKS UUID: no UUID in header")
+	}
+	return C.GoString(uuid), nil
+}
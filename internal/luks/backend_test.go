@@ -0,0 +1,26 @@
+//go:build !libcryptsetup
+
+package luks
+
+import (
+	"bootstrap/internal/trace"
+	"testing"
+)
+
+func TestCryptBackendDefault(t *testing.T) {
+	if got := CryptBackend(); got != BackendCLI {
+		t.Fatalf("CryptBackend() = %s, want %s without the libcryptsetup build tag", got, BackendCLI)
+	}
+}
+
+func TestIsWrongKey(t *testing.T) {
+	for code, want := range map[string]bool{"2": true, "1": false, "5": false} {
+		err := trace.Command("sh", "-c", "exit "+code).Run()
+		if got := isWrongKey(err); got != want {
+			t.Errorf("isWrongKey(exit %s) = %v, want %v", code, got, want)
+		}
+	}
+	if isWrongKey(nil) {
+		t.Error("isWrongKey(nil) = true, want false")
+	}
+}
@@ -0,0 +1,75 @@
+package luks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+)
+
+// How a backup excludes concurrent writes.
+const (
+	BackupSnapshot = "snapshot"  // Read from a snapshot, the application keeps writing
+	BackupReadOnly = "read-only" // The filesystem is remounted read-only while it is read
+)
+
+// BackupView returns a directory with a consistent view of the mounted filesystem and
+// releases it when done. Volumes CreateSnapshot can snapshot only pause writes for a
+// moment; other volumes are remounted read-only for the whole backup.
+func BackupView(ctx context.Context, cfg *LUKS) (dir, mode string, release func(), err error) {
+	if cfg.Private.Enabled() {
+		return "", "", nil, fmt.Errorf("volume is mounted privately by %s and cannot be backed up", cfg.Private.Unit)
+	}
+	mounted, err := IsLUKSMounted(cfg)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("failed to check if LUKS volume is mounted: %w", err)
+	}
+	if !mounted {
+		return "", "", nil, fmt.Errorf("LUKS volume is not mounted")
+	}
+
+	snap, err := CreateSnapshot(ctx, cfg)
+	if err == nil {
+		return snap.MountPoint, BackupSnapshot, func() {
+			if err := ReleaseSnapshot(ctx, cfg); err != nil {
+				log.Printf("Failed to release snapshot: %v", err)
+			}
+		}, nil
+	}
+	if !errors.Is(err, ErrSnapshotUnsupported) {
+		return "", "", nil, err
+	}
+	log.Printf("No snapshot, remounting read-only for the backup: %v", err)
+
+	if err := Remount(ctx, cfg.MountPoint, "ro"); err != nil {
+		return "", "", nil, fmt.Errorf("failed to remount read-only: %v", err)
+	}
+	return cfg.MountPoint, BackupReadOnly, func() {
+		if err := Remount(ctx, cfg.MountPoint, "rw"); err != nil {
+			log.Printf("Failed to remount %s read-write: %v", cfg.MountPoint, err)
+		}
+	}, nil
+}
+
+// CheckRestoreTarget fails unless the volume is mounted and its filesystem is empty, so
+// a restore never mixes with existing data.
+func CheckRestoreTarget(cfg *LUKS) error {
+	mounted, err := IsLUKSMounted(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to check if LUKS volume is mounted: %w", err)
+	}
+	if !mounted || cfg.Private.Enabled() {
+		return fmt.Errorf("LUKS volume is not mounted here, authorize or mount it first")
+	}
+	entries, err := os.ReadDir(cfg.MountPoint)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Name() != "lost+found" {
+			return fmt.Errorf("%s is not empty, restore onto a newly authorized volume", cfg.MountPoint)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package luks
+
+import (
+	"bootstrap/internal/trace"
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// benchmarkImageSize is the size of the scratch volume of the unlock trials, enough for
+// a LUKS2 header and a few sectors of data.
+const benchmarkImageSize = 32 << 20
+
+// benchmarkCiphers are the candidate ciphers and master key sizes in bits.
+var benchmarkCiphers = []struct {
+	cipher  string
+	keySize int
+}{
+	{cipherAESXTS, DefaultKeySize(cipherAESXTS, "")},
+	{cipherAdiantum, DefaultKeySize(cipherAdiantum, "")},
+}
+
+// CipherBenchmark is the in-memory throughput of a cipher measured by cryptsetup benchmark.
+type CipherBenchmark struct {
+	Cipher     string  `json:"cipher"`
+	KeySize    int     `json:"keySize"`
+	EncryptMiB float64 `json:"encryptMiBs"` // MiB/s, 0 when the kernel lacks the cipher
+	DecryptMiB float64 `json:"decryptMiBs"`
+}
+
+// PBKDFBenchmark is the unlock time of a keyslot formatted with the PBKDF settings on a
+// scratch volume.
+type PBKDFBenchmark struct {
+	PBKDF  string        `json:"pbkdf"`
+	Memory int           `json:"memory,omitempty"` // Argon2 memory cost in KiB
+	Unlock time.Duration `json:"unlock"`
+	Error  string        `json:"error,omitempty"`
+}
+
+// BenchmarkSuggestion are the luks settings suggested for this hardware.
+type BenchmarkSuggestion struct {
+	Cipher      string `json:"cipher"`
+	KeySize     int    `json:"keySize"`
+	PBKDF       string `json:"pbkdf"`
+	PBKDFMemory int    `json:"pbkdfMemory,omitempty"`
+}
+
+// BenchmarkResult are the measurements and the settings suggested from them.
+type BenchmarkResult struct {
+	Ciphers    []CipherBenchmark   `json:"ciphers"`
+	PBKDFs     []PBKDFBenchmark    `json:"pbkdfs"`
+	UnlockTime time.Duration       `json:"unlockTime"` // Target the PBKDFs were tuned to
+	Suggested  BenchmarkSuggestion `json:"suggested"`
+}
+
+// Benchmark measures the candidate ciphers with cryptsetup benchmark and the unlock time
+// of Argon2id keyslots of decreasing memory cost, and PBKDF2, on a scratch volume in
+// dir. cryptsetup tunes the iterations of each keyslot to unlockTime, which low-power
+// boards cannot reach with a large memory cost.
+func Benchmark(ctx context.Context, dir string, unlockTime time.Duration) (*BenchmarkResult, error) {
+	result := &BenchmarkResult{UnlockTime: unlockTime}
+	for _, candidate := range benchmarkCiphers {
+		output, err := trace.Command("cryptsetup", "benchmark",
+			"--cipher="+candidate.cipher, "--key-size="+strconv.Itoa(candidate.keySize)).CombinedOutput()
+		if err != nil {
+			return nil, fmt.Errorf("cryptsetup benchmark failed: %s", strings.TrimSpace(string(output)))
+		}
+		bench := CipherBenchmark{Cipher: candidate.cipher, KeySize: candidate.keySize}
+		if parsed := parseCipherBenchmark(string(output)); len(parsed) > 0 {
+			bench.EncryptMiB, bench.DecryptMiB = parsed[0].EncryptMiB, parsed[0].DecryptMiB
+		}
+		result.Ciphers = append(result.Ciphers, bench)
+	}
+
+	image, err := os.CreateTemp(dir, "udm-benchmark-*.img")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create scratch volume: %w", err)
+	}
+	image.Close()
+	defer os.Remove(image.Name())
+	if err := os.Truncate(image.Name(), benchmarkImageSize); err != nil {
+		return nil, fmt.Errorf("failed to size scratch volume: %w", err)
+	}
+	password, err := GenerateLUKSKey(ctx, MinKeyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate password: %w", err)
+	}
+	defer clear(password)
+
+	for _, memory := range benchmarkMemoryCosts() {
+		result.PBKDFs = append(result.PBKDFs, unlockTrial(image.Name(), password, &LUKS{PBKDF: PBKDFArgon2id, PBKDFMemory: memory}, unlockTime))
+	}
+	result.PBKDFs = append(result.PBKDFs, unlockTrial(image.Name(), password, &LUKS{PBKDF: PBKDFPBKDF2}, unlockTime))
+
+	result.Suggested = suggestSettings(result.Ciphers, result.PBKDFs, unlockTime)
+	return result, nil
+}
+
+// benchmarkMemoryCosts returns the Argon2 memory costs tried, from the default for this
+// machine down to MinPBKDFMemory.
+func benchmarkMemoryCosts() []int {
+	var costs []int
+	for memory := DefaultPBKDFMemory(); memory >= MinPBKDFMemory; memory /= 4 {
+		costs = append(costs, memory)
+	}
+	if len(costs) == 0 || costs[len(costs)-1] != MinPBKDFMemory {
+		costs = append(costs, MinPBKDFMemory)
+	}
+	return costs
+}
+
+// unlockTrial formats the scratch volume with the PBKDF of cfg and times a passphrase
+// check, which runs the PBKDF without opening the volume.
+func unlockTrial(image string, password []byte, cfg *LUKS, unlockTime time.Duration) PBKDFBenchmark {
+	bench := PBKDFBenchmark{PBKDF: cfg.PBKDF, Memory: cfg.PBKDFMemory}
+	err := withTempKeyFile(password, func(keyFile string) error {
+		args := append([]string{"luksFormat", "--batch-mode", "--type=luks2",
+			"--iter-time=" + strconv.FormatInt(unlockTime.Milliseconds(), 10)}, cfg.pbkdfArgs()...)
+		args = append(args, image, keyFile)
+		if output, err := trace.Command("cryptsetup", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("luksFormat failed: %s", strings.TrimSpace(string(output)))
+		}
+		start := time.Now()
+		if output, err := trace.Command("cryptsetup", "open", "--test-passphrase", "--key-file="+keyFile, image).CombinedOutput(); err != nil {
+			return fmt.Errorf("unlock failed: %s", strings.TrimSpace(string(output)))
+		}
+		bench.Unlock = time.Since(start)
+		return nil
+	})
+	if err != nil {
+		bench.Error = err.Error()
+	}
+	return bench
+}
+
+// cipherBenchmarkLine matches a cipher line of cryptsetup benchmark, e.g.
+// "        aes-xts        512b      2200.1 MiB/s      2210.5 MiB/s".
+var cipherBenchmarkLine = regexp.MustCompile(`^\s*(\S+)\s+(\d+)b\s+(N/A|[\d.]+ [KMG]iB/s)\s+(N/A|[\d.]+ [KMG]iB/s)\s*$`)
+
+// parseCipherBenchmark returns the cipher lines of cryptsetup benchmark output.
+func parseCipherBenchmark(output string) []CipherBenchmark {
+	var results []CipherBenchmark
+	for _, line := range strings.Split(output, "\n") {
+		m := cipherBenchmarkLine.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		keySize, _ := strconv.Atoi(m[2])
+		results = append(results, CipherBenchmark{
+			Cipher:     m[1],
+			KeySize:    keySize,
+			EncryptMiB: parseThroughput(m[3]),
+			DecryptMiB: parseThroughput(m[4]),
+		})
+	}
+	return results
+}
+
+// parseThroughput converts a throughput like "1.2 GiB/s" to MiB/s, 0 for N/A.
+func parseThroughput(s string) float64 {
+	value, unit, ok := strings.Cut(s, " ")
+	if !ok {
+		return 0
+	}
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0
+	}
+	switch unit {
+	case "KiB/s":
+		return v / 1024
+	case "GiB/s":
+		return v * 1024
+	}
+	return v
+}
+
+// suggestSettings picks the cipher with the best throughput in its slower direction and
+// the largest Argon2 memory cost unlocking within half again the target. PBKDF2 is only
+// suggested when no Argon2 setting is fast enough, e.g. on boards with very little RAM.
+func suggestSettings(ciphers []CipherBenchmark, pbkdfs []PBKDFBenchmark, unlockTime time.Duration) BenchmarkSuggestion {
+	suggestion := BenchmarkSuggestion{Cipher: DefaultCipher(), PBKDF: PBKDFArgon2id, PBKDFMemory: MinPBKDFMemory}
+	suggestion.KeySize = DefaultKeySize(suggestion.Cipher, "")
+
+	best := 0.0
+	for _, c := range ciphers {
+		speed := min(c.EncryptMiB, c.DecryptMiB)
+		if speed > best {
+			best, suggestion.Cipher, suggestion.KeySize = speed, c.Cipher, c.KeySize
+		}
+	}
+
+	limit := unlockTime * 3 / 2
+	argon := slices.DeleteFunc(slices.Clone(pbkdfs), func(p PBKDFBenchmark) bool {
+		return p.PBKDF != PBKDFArgon2id || p.Error != "" || p.Unlock > limit
+	})
+	if len(argon) > 0 {
+		suggestion.PBKDFMemory = slices.MaxFunc(argon, func(a, b PBKDFBenchmark) int { return a.Memory - b.Memory }).Memory
+		return suggestion
+	}
+	for _, p := range pbkdfs {
+		if p.PBKDF == PBKDFPBKDF2 && p.Error == "" && p.Unlock <= limit {
+			return BenchmarkSuggestion{Cipher: suggestion.Cipher, KeySize: suggestion.KeySize, PBKDF: PBKDFPBKDF2}
+		}
+	}
+	return suggestion
+}
@@ -0,0 +1,56 @@
+package luks
+
+import (
+	"testing"
+	"time"
+)
+
+const benchmarkOutput = `# Tests are approximate using memory only (no storage IO).
+#            Algorithm |       Key |      Encryption |      Decryption
+        aes-xts        512b        85.3 MiB/s        86.1 MiB/s
+xchacha12,aes-adiantum        256b       1.1 GiB/s       1.2 GiB/s
+    serpent-xts        512b           N/A           N/A
+`
+
+func TestParseCipherBenchmark(t *testing.T) {
+	got := parseCipherBenchmark(benchmarkOutput)
+	want := []CipherBenchmark{
+		{Cipher: "aes-xts", KeySize: 512, EncryptMiB: 85.3, DecryptMiB: 86.1},
+		{Cipher: "xchacha12,aes-adiantum", KeySize: 256, EncryptMiB: 1.1 * 1024, DecryptMiB: 1.2 * 1024},
+		{Cipher: "serpent-xts", KeySize: 512},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("parseCipherBenchmark() = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("line %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestSuggestSettings(t *testing.T) {
+	ciphers := []CipherBenchmark{
+		{Cipher: cipherAESXTS, KeySize: 512, EncryptMiB: 85, DecryptMiB: 86},
+		{Cipher: cipherAdiantum, KeySize: 256, EncryptMiB: 1100, DecryptMiB: 1200},
+	}
+	pbkdfs := []PBKDFBenchmark{
+		{PBKDF: PBKDFArgon2id, Memory: 1 << 20, Unlock: 9 * time.Second},
+		{PBKDF: PBKDFArgon2id, Memory: 256 << 10, Unlock: 2500 * time.Millisecond},
+		{PBKDF: PBKDFArgon2id, Memory: MinPBKDFMemory, Unlock: 2 * time.Second},
+		{PBKDF: PBKDFPBKDF2, Unlock: 2 * time.Second},
+	}
+	got := suggestSettings(ciphers, pbkdfs, 2*time.Second)
+	want := BenchmarkSuggestion{Cipher: cipherAdiantum, KeySize: 256, PBKDF: PBKDFArgon2id, PBKDFMemory: 256 << 10}
+	if got != want {
+		t.Errorf("suggestSettings() = %+v, want %+v", got, want)
+	}
+
+	// Without an Argon2 setting unlocking in time, PBKDF2 is suggested
+	for i := range pbkdfs[:3] {
+		pbkdfs[i].Error = "unlock failed: out of memory"
+	}
+	if got := suggestSettings(ciphers, pbkdfs, 2*time.Second); got.PBKDF != PBKDFPBKDF2 || got.PBKDFMemory != 0 {
+		t.Errorf("suggestSettings() = %+v, want pbkdf2", got)
+	}
+}
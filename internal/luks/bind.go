@@ -0,0 +1,159 @@
+package luks
+
+import (
+	"bootstrap/internal/trace"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// BindMount exposes a subdirectory of the volume at an application path, created with
+// its own owner and mode so each application only reaches its own data.
+type BindMount struct {
+	Source   string `yaml:"source"`   // Subdirectory of the volume, relative to the mount point, e.g. "myapp"
+	Target   string `yaml:"target"`   // Path the subdirectory is mounted on, e.g. "/var/lib/myapp"
+	User     string `yaml:"user"`     // Owner of the subdirectory, luks.user by default
+	Group    string `yaml:"group"`    // Group of the subdirectory, luks.group by default
+	Mode     string `yaml:"mode"`     // Octal permissions of the subdirectory, default "0750"
+	ReadOnly bool   `yaml:"readOnly"` // Mount the subdirectory read-only at the target
+}
+
+// defaultBindMode keeps subdirectories private to their owner and group.
+const defaultBindMode = "0750"
+
+// perm returns the permissions of the subdirectory.
+func (b BindMount) perm() os.FileMode {
+	mode := b.Mode
+	if mode == "" {
+		mode = defaultBindMode
+	}
+	// Validated when the configuration was loaded
+	perm, _ := strconv.ParseUint(mode, 8, 32)
+
+	// os.FileMode carries the special bits apart from the Unix mode bits
+	m := os.FileMode(perm & 0777)
+	if perm&04000 != 0 {
+		m |= os.ModeSetuid
+	}
+	if perm&02000 != 0 {
+		m |= os.ModeSetgid
+	}
+	if perm&01000 != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+// ValidateBindMounts checks each source stays within the volume and each target is an
+// absolute path outside of it, mounted once.
+func ValidateBindMounts(binds []BindMount, mountPoint string) error {
+	targets := make(map[string]bool)
+	for _, b := range binds {
+		if b.Source == "" || filepath.IsAbs(b.Source) || filepath.Clean(b.Source) != b.Source || b.Source == ".." || strings.HasPrefix(b.Source, "../") {
+			return fmt.Errorf("luks.bindMounts source (%s) must be a clean path relative to the mount point", b.Source)
+		}
+		if !filepath.IsAbs(b.Target) || filepath.Clean(b.Target) != b.Target {
+			return fmt.Errorf("luks.bindMounts target (%s) must be a clean absolute path", b.Target)
+		}
+		if b.Target == mountPoint || strings.HasPrefix(b.Target, mountPoint+"/") || strings.HasPrefix(mountPoint, b.Target+"/") {
+			return fmt.Errorf("luks.bindMounts target (%s) must not contain or lie within the mount point %s", b.Target, mountPoint)
+		}
+		if targets[b.Target] {
+			return fmt.Errorf("luks.bindMounts target (%s) is mounted twice", b.Target)
+		}
+		targets[b.Target] = true
+		if b.Mode != "" {
+			if perm, err := strconv.ParseUint(b.Mode, 8, 32); err != nil || perm > 07777 {
+				return fmt.Errorf("luks.bindMounts mode (%s) of %s must be octal permissions, e.g. 0750", b.Mode, b.Source)
+			}
+		}
+	}
+	return nil
+}
+
+// mountBinds creates the subdirectories of the mounted volume with their owner and mode
+// and bind-mounts them on their targets. A failure unmounts the binds already made.
+func mountBinds(ctx context.Context, cfg *LUKS) error {
+	for i, b := range cfg.BindMounts {
+		if err := mountBind(ctx, cfg, b); err != nil {
+			unmountBinds(ctx, cfg.BindMounts[:i])
+			return fmt.Errorf("failed to bind-mount %s on %s: %w", b.Source, b.Target, err)
+		}
+	}
+	return nil
+}
+
+func mountBind(ctx context.Context, cfg *LUKS, b BindMount) error {
+	dir := filepath.Join(cfg.MountPoint, b.Source)
+	// A read-only volume must already hold the subdirectory
+	if !cfg.ReadOnly {
+		if err := os.MkdirAll(dir, b.perm()); err != nil {
+			return err
+		}
+	}
+	// Users of the volume could replace the subdirectory with a symlink to any path
+	root, err := filepath.EvalSymlinks(cfg.MountPoint)
+	if err != nil {
+		return err
+	}
+	if resolved, err := filepath.EvalSymlinks(dir); err != nil || resolved != filepath.Join(root, b.Source) {
+		return fmt.Errorf("%s must be a directory of the volume, not a symlink", dir)
+	}
+	if !cfg.ReadOnly {
+		if err := setOwnerAndMode(cfg, b, dir); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(b.Target, 0755); err != nil {
+		return err
+	}
+	if output, err := runRetried(ctx, OpMount, func() *trace.Cmd { return trace.Command("mount", "--bind", dir, b.Target) }); err != nil {
+		return fmt.Errorf("mount failed: %s", output)
+	}
+	if b.ReadOnly || cfg.ReadOnly {
+		// The read-only flag of a bind mount only applies on remount
+		if err := Remount(ctx, b.Target, "bind,ro"); err != nil {
+			runRetried(ctx, OpMount, func() *trace.Cmd { return trace.Command("umount", b.Target) })
+			return fmt.Errorf("read-only remount failed: %v", err)
+		}
+	}
+	return nil
+}
+
+// setOwnerAndMode applies the owner and mode of the bind mount to its subdirectory.
+func setOwnerAndMode(cfg *LUKS, b BindMount, dir string) error {
+	user, group := b.User, b.Group
+	if user == "" {
+		user = cfg.User
+	}
+	if group == "" {
+		group = cfg.Group
+	}
+	if output, err := trace.Command("chown", user+":"+group, dir).CombinedOutput(); err != nil {
+		return fmt.Errorf("chown failed: %s", strings.TrimSpace(string(output)))
+	}
+	// MkdirAll applies the umask, and existing directories keep their mode otherwise
+	return os.Chmod(dir, b.perm())
+}
+
+// unmountBinds unmounts the bind mounts in reverse order before the volume is unmounted,
+// lazily when still in use: the users of the filesystem were already checked through
+// the mount point.
+func unmountBinds(ctx context.Context, binds []BindMount) {
+	for i := len(binds) - 1; i >= 0; i-- {
+		target := binds[i].Target
+		if err := trace.Command("mountpoint", "-q", target).Run(); err != nil {
+			continue
+		}
+		if _, err := runRetried(ctx, OpMount, func() *trace.Cmd { return trace.Command("umount", target) }); err != nil {
+			if output, err := runRetried(ctx, OpMount, func() *trace.Cmd { return trace.Command("umount", "-l", target) }); err != nil {
+				log.Printf("Failed to unmount %s: %s", target, strings.TrimSpace(string(output)))
+			}
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package luks
+
+import (
+	"os"
+	"testing"
+)
+
+func TestValidateBindMounts(t *testing.T) {
+	tests := []struct {
+		name    string
+		binds   []BindMount
+		wantErr bool
+	}{
+		{name: "valid", binds: []BindMount{{Source: "myapp", Target: "/var/lib/myapp", Mode: "0700"}, {Source: "logs/myapp", Target: "/var/log/myapp"}}},
+		{name: "absolute source", binds: []BindMount{{Source: "/myapp", Target: "/var/lib/myapp"}}, wantErr: true},
+		{name: "escaping source", binds: []BindMount{{Source: "../etc", Target: "/var/lib/myapp"}}, wantErr: true},
+		{name: "relative target", binds: []BindMount{{Source: "myapp", Target: "var/lib/myapp"}}, wantErr: true},
+		{name: "target in volume", binds: []BindMount{{Source: "myapp", Target: "/mnt/udm-luks/app"}}, wantErr: true},
+		{name: "target above volume", binds: []BindMount{{Source: "myapp", Target: "/mnt"}}, wantErr: true},
+		{name: "duplicate target", binds: []BindMount{{Source: "a", Target: "/srv/app"}, {Source: "b", Target: "/srv/app"}}, wantErr: true},
+		{name: "bad mode", binds: []BindMount{{Source: "myapp", Target: "/var/lib/myapp", Mode: "rwx"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateBindMounts(tt.binds, "/mnt/udm-luks"); (err != nil) != tt.wantErr {
+				t.Fatalf("ValidateBindMounts() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBindMountPerm(t *testing.T) {
+	if perm := (BindMount{}).perm(); perm != 0750 {
+		t.Fatalf("perm() = %v, want default 0750", perm)
+	}
+	if perm := (BindMount{Mode: "2770"}).perm(); perm != os.ModeSetgid|0770 {
+		t.Fatalf("perm() = %v, want setgid 0770", perm)
+	}
+}
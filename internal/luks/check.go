@@ -0,0 +1,138 @@
+package luks
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// Commands bringing a change in sync, reported by CheckState.
+const (
+	ActionAuthorize  = "authorize"
+	ActionMount      = "mount"
+	ActionPersistent = "add-persistent-mount"
+	ActionReconcile  = "reconcile"
+	ActionManual     = "manual"
+)
+
+// Change is a difference between the state the configuration describes and the system,
+// with the udm command that would remove it.
+type Change struct {
+	Item    string `json:"item"`
+	Desired string `json:"desired"`
+	Actual  string `json:"actual"`
+	Action  string `json:"action"`
+}
+
+// CheckState compares the state authorize and mount, and add-persistent-mount when
+// persistent is set, would leave the system in against the actual state, without
+// changing anything or reading the key. keyfile is checked to exist when the key is
+// kept in one.
+func CheckState(ctx context.Context, cfg *LUKS, keyfile string, persistent bool) ([]Change, error) {
+	changes := []Change{}
+	if _, err := os.Stat(cfg.VolumePath); err != nil {
+		changes = append(changes, Change{Item: "volume", Desired: "present", Actual: "missing", Action: ActionAuthorize})
+		if persistent {
+			changes = append(changes, persistentChanges(cfg)...)
+		}
+		return changes, nil
+	}
+	// Plain volumes have no header and no stored key, mount maps them with a new key
+	if !cfg.Plain() {
+		if _, err := VolumeUUID(ctx, cfg); err != nil {
+			changes = append(changes, Change{Item: "volume", Desired: "LUKS volume", Actual: "no LUKS header", Action: ActionManual})
+			return changes, nil
+		}
+		changes = append(changes, keyChanges(ctx, cfg, keyfile)...)
+	}
+
+	// Automounted volumes are mounted on access, private ones in the namespace of a service
+	device := "/dev/mapper/" + cfg.MapperName
+	if !cfg.Automount && !cfg.Private.Enabled() {
+		desired := "mounted at " + cfg.MountPoint
+		if cfg.ReadOnly {
+			desired += " read-only"
+		}
+		if _, err := os.Stat(device); err != nil {
+			changes = append(changes, Change{Item: "mount", Desired: desired, Actual: "closed", Action: ActionMount})
+		} else if cfg.Profile == ProfileSwap {
+			// Swap is not mounted anywhere, lsblk shows it as [SWAP]
+			if active, err := IsLUKSMounted(cfg); err != nil {
+				return nil, err
+			} else if !active {
+				changes = append(changes, Change{Item: "swap", Desired: "active", Actual: "open, not active", Action: ActionMount})
+			}
+		} else if mountPoint, _, err := findMount(device); err != nil {
+			return nil, err
+		} else if mountPoint == "" {
+			changes = append(changes, Change{Item: "mount", Desired: desired, Actual: "open, not mounted", Action: ActionMount})
+		}
+	}
+	if persistent {
+		changes = append(changes, persistentChanges(cfg)...)
+	}
+
+	drifts, err := detectDrift(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range drifts {
+		action := ActionManual
+		if d.Safe {
+			action = ActionReconcile
+		}
+		changes = append(changes, Change{Item: d.Item, Desired: d.Desired, Actual: d.Actual, Action: action})
+	}
+	return changes, nil
+}
+
+// keyChanges checks the stores of the key are populated. Keys in a Vault KV secret are
+// not checked, that would read them.
+func keyChanges(ctx context.Context, cfg *LUKS, keyfile string) []Change {
+	var changes []Change
+	missing := func(item, desired string) {
+		changes = append(changes, Change{Item: item, Desired: desired, Actual: "missing", Action: ActionManual})
+	}
+	nvIndex := fmt.Sprintf("TPM NV index %s", cfg.KeyNVIndex())
+	switch {
+	case cfg.Ephemeral:
+	case cfg.Split.Enabled():
+		if cfg.UseTPM && !NVIndexDefined(ctx, cfg.KeyNVIndex()) {
+			missing("tpm share", nvIndex)
+		}
+		if cfg.Split.EscrowPath != "" && !fileExists(cfg.Split.EscrowPath) {
+			missing("escrow share", cfg.Split.EscrowPath)
+		}
+	case cfg.UseTPM:
+		if !NVIndexDefined(ctx, cfg.KeyNVIndex()) {
+			missing("tpm key", nvIndex)
+		}
+	case cfg.Vault.Wrapped():
+		if path := vaultWrappedPath(cfg); !fileExists(path) {
+			missing("vault wrapped key", path)
+		}
+	case keyfile != "":
+		if !fileExists(keyfile) {
+			missing("keyfile", keyfile)
+		}
+	}
+	return changes
+}
+
+// persistentChanges checks the crypttab and fstab entries of the volume exist, their
+// content is compared by detectDrift.
+func persistentChanges(cfg *LUKS) []Change {
+	var changes []Change
+	if entry, err := CrypttabEntry(cfg); err == nil && entry == "" {
+		changes = append(changes, Change{Item: "crypttab entry", Desired: "present", Actual: "missing", Action: ActionPersistent})
+	}
+	if entry, err := FstabEntry(cfg); err == nil && entry == "" {
+		changes = append(changes, Change{Item: "fstab entry", Desired: "present", Actual: "missing", Action: ActionPersistent})
+	}
+	return changes
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
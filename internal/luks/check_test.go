@@ -0,0 +1,35 @@
+package luks
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCheckStateMissingVolume(t *testing.T) {
+	cfg := &LUKS{VolumePath: filepath.Join(t.TempDir(), "udm-luks.img"), MapperName: "udm-luks", MountPoint: "/mnt/udm-luks"}
+	changes, err := CheckState(context.Background(), cfg, "", false)
+	if err != nil {
+		t.Fatalf("CheckState() error = %v", err)
+	}
+	want := []Change{{Item: "volume", Desired: "present", Actual: "missing", Action: ActionAuthorize}}
+	if !reflect.DeepEqual(changes, want) {
+		t.Fatalf("CheckState() = %+v, want %+v", changes, want)
+	}
+}
+
+func TestKeyChanges(t *testing.T) {
+	dir := t.TempDir()
+	keyfile := filepath.Join(dir, "udm-luks.key")
+	changes := keyChanges(context.Background(), &LUKS{MapperName: "udm-luks"}, keyfile)
+	if len(changes) != 1 || changes[0].Item != "keyfile" || changes[0].Action != ActionManual {
+		t.Fatalf("keyChanges(missing keyfile) = %+v, want the keyfile reported", changes)
+	}
+	if changes := keyChanges(context.Background(), &LUKS{MapperName: "udm-luks", Ephemeral: true}, keyfile); len(changes) != 0 {
+		t.Fatalf("keyChanges(ephemeral) = %+v, want none", changes)
+	}
+	if changes := keyChanges(context.Background(), &LUKS{MapperName: "udm-luks"}, ""); len(changes) != 0 {
+		t.Fatalf("keyChanges(no keyfile) = %+v, want none", changes)
+	}
+}
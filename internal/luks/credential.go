@@ -0,0 +1,57 @@
+package luks
+
+import (
+	"bootstrap/internal/trace"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// KeyfileWrapSystemdCreds writes the keyfile as a systemd-creds encrypted credential,
+// for LoadCredentialEncrypted= in the unit mounting the volume.
+const KeyfileWrapSystemdCreds = "systemd-creds"
+
+// CredentialPath returns the path of the credential named name passed to the running
+// service through LoadCredential= or LoadCredentialEncrypted=, or "" outside such a
+// service.
+func CredentialPath(name string) string {
+	dir := os.Getenv("CREDENTIALS_DIRECTORY")
+	if dir == "" || name == "" {
+		return ""
+	}
+	path := filepath.Join(dir, name)
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+// EncryptCredential encrypts key as the systemd credential name, bound to the host key
+// and the TPM when available.
+func EncryptCredential(name string, key []byte) ([]byte, error) {
+	cmd := trace.Command("systemd-creds", "encrypt", "--name="+name, "-", "-")
+	cmd.Stdin = bytes.NewReader(key)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("systemd-creds encrypt failed: %s", strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
+
+// DecryptCredential decrypts a credential written by EncryptCredential, for use outside
+// the unit that loads it.
+func DecryptCredential(name string, credential []byte) ([]byte, error) {
+	cmd := trace.Command("systemd-creds", "decrypt", "--name="+name, "-", "-")
+	cmd.Stdin = bytes.NewReader(credential)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("systemd-creds decrypt failed: %s", strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
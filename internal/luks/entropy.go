@@ -0,0 +1,155 @@
+package luks
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"unicode"
+)
+
+const (
+	DefaultMinKeyEntropy        = 64 // Minimum estimated bits for binary key material
+	DefaultMinPassphraseEntropy = 50 // Minimum estimated bits for human passphrases
+)
+
+// ErrWeakKey is returned when key material or a passphrase does not meet the entropy policy.
+var ErrWeakKey = errors.New("key material does not meet the entropy policy")
+
+// commonPasswords is a small deny-list used by the passphrase estimator. Matches are
+// scored as a single dictionary guess rather than per character.
+var commonPasswords = []string{
+	"password", "passw0rd", "admin", "root", "letmein", "welcome", "qwerty",
+	"azerty", "123456", "12345678", "abc123", "iloveyou", "monkey", "dragon",
+	"master", "secret", "login", "changeme", "default", "bootstrap", "luks",
+}
+
+// leetReplacer undoes common character substitutions before dictionary matching.
+var leetReplacer = strings.NewReplacer("0", "o", "1", "i", "3", "e", "4", "a", "5", "s", "@", "a", "$", "s", "7", "t")
+
+// EstimateKeyEntropy estimates the entropy in bits of binary key material from its
+// byte distribution (Shannon entropy per byte multiplied by the key length).
+func EstimateKeyEntropy(key []byte) float64 {
+	if len(key) == 0 {
+		return 0
+	}
+
+	var counts [256]int
+	for _, b := range key {
+		counts[b]++
+	}
+
+	n := float64(len(key))
+	perByte := 0.0
+	for _, c := range counts {
+		if c == 0 {
+			continue
+		}
+		p := float64(c) / n
+		perByte -= p * math.Log2(p)
+	}
+	return perByte * n
+}
+
+// EstimatePassphraseEntropy estimates the entropy in bits of a human passphrase, in the
+// spirit of zxcvbn: dictionary words, repeats and sequences are scored as cheap guesses,
+// everything else by the size of the character pool in use.
+func EstimatePassphraseEntropy(passphrase string) float64 {
+	runes := []rune(passphrase)
+	if len(runes) == 0 {
+		return 0
+	}
+
+	// Mark characters covered by a dictionary word
+	covered := make([]bool, len(runes))
+	words := 0
+	normalized := []rune(leetReplacer.Replace(strings.ToLower(passphrase)))
+	if len(normalized) == len(runes) {
+		for _, word := range commonPasswords {
+			w := []rune(word)
+			for i := 0; i+len(w) <= len(normalized); i++ {
+				if string(normalized[i:i+len(w)]) == word && !covered[i] {
+					for j := i; j < i+len(w); j++ {
+						covered[j] = true
+					}
+					words++
+				}
+			}
+		}
+	}
+
+	perChar := math.Log2(float64(charsetPool(runes)))
+	bits := float64(words) * (math.Log2(float64(len(commonPasswords))) + 1)
+	for i, r := range runes {
+		switch {
+		case covered[i]:
+			continue
+		case i > 0 && r == runes[i-1]:
+			bits += 1 // repeated character
+		case i > 0 && (r == runes[i-1]+1 || r == runes[i-1]-1):
+			bits += 2 // ascending or descending sequence
+		default:
+			bits += perChar
+		}
+	}
+	return bits
+}
+
+// charsetPool returns the size of the character pool an attacker would have to search.
+func charsetPool(runes []rune) int {
+	set := classifyChars(runes)
+	pool := 0
+	if set.lower {
+		pool += 26
+	}
+	if set.upper {
+		pool += 26
+	}
+	if set.digit {
+		pool += 10
+	}
+	if set.symbol || set.space {
+		pool += 33
+	}
+	if set.other {
+		pool += 100
+	}
+	return pool
+}
+
+// charSet records which kinds of characters a passphrase uses.
+type charSet struct {
+	lower, upper, digit, symbol, space, other bool
+}
+
+// classifyChars sorts the characters of a passphrase into the kinds of charSet, shared by
+// the entropy estimate and the character class policy. Characters outside printable
+// ASCII are other.
+func classifyChars(runes []rune) charSet {
+	var set charSet
+	for _, r := range runes {
+		switch {
+		case r >= 'a' && r <= 'z':
+			set.lower = true
+		case r >= 'A' && r <= 'Z':
+			set.upper = true
+		case r >= '0' && r <= '9':
+			set.digit = true
+		case unicode.IsSpace(r):
+			set.space = true
+		case r < unicode.MaxASCII && unicode.IsPrint(r):
+			set.symbol = true
+		default:
+			set.other = true
+		}
+	}
+	return set
+}
+
+// CheckKeyStrength rejects binary key material whose estimated entropy is below minBits.
+func CheckKeyStrength(key []byte, minBits int) error {
+	if bits := EstimateKeyEntropy(key); bits < float64(minBits) {
+		return fmt.Errorf("%w: key has an estimated %.0f bits of entropy, policy requires %d", ErrWeakKey, bits, minBits)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package luks
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckKeyStrength(t *testing.T) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatalf("rand.Read() error = %v", err)
+	}
+	if err := CheckKeyStrength(key, DefaultMinKeyEntropy); err != nil {
+		t.Fatalf("CheckKeyStrength(random) error = %v, want nil", err)
+	}
+
+	weak := make([]byte, 32) // all zero bytes
+	if err := CheckKeyStrength(weak, DefaultMinKeyEntropy); !errors.Is(err, ErrWeakKey) {
+		t.Fatalf("CheckKeyStrength(zeros) error = %v, want ErrWeakKey", err)
+	}
+}
+
+func TestCheckPassphraseEntropy(t *testing.T) {
+	policy := PasswordPolicy{MinPassphraseEntropy: DefaultMinPassphraseEntropy}
+	weak := []string{"password123", "P@ssw0rd!", "aaaaaaaaaaaaaaaa", "abcdefghijklmnop"}
+	for _, p := range weak {
+		if err := policy.Check([]byte(p)); !errors.Is(err, ErrWeakKey) {
+			t.Errorf("Check(%q) error = %v, want ErrWeakKey", p, err)
+		}
+	}
+
+	strong := "tXq7-Lm2v-Rk9w-Hz4p"
+	if err := policy.Check([]byte(strong)); err != nil {
+		t.Errorf("Check(%q) error = %v, want nil", strong, err)
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	dir := t.TempDir()
+	denyList := filepath.Join(dir, "denied.txt")
+	os.WriteFile(denyList, []byte("# site specific\nCorrect-Horse-Battery-Staple\n"), 0600)
+	policy, err := NewPasswordPolicy(&LUKS{MinPassphraseEntropy: 40, MinCharClasses: 3, DenyList: denyList})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s := policy.Measure([]byte("c0rrect-horse-battery-staple")); !s.Denied {
+		t.Errorf("Measure(variant of denied) = %+v, want denied", s)
+	}
+	if s := policy.Measure([]byte("tundra gravel orchid")); s.Problem == "" || s.Classes != 1 {
+		t.Errorf("Measure(one class) = %+v, want rejected with 1 class", s)
+	}
+	if err := policy.Check([]byte("Tundra7-gravel-Orchid")); err != nil {
+		t.Errorf("Check(strong) error = %v, want nil", err)
+	}
+
+	SetPasswordPolicy(policy)
+	defer SetPasswordPolicy(PasswordPolicy{MinKeyEntropy: DefaultMinKeyEntropy, MinPassphraseEntropy: DefaultMinPassphraseEntropy})
+	password, err := GeneratePassword(context.Background(), 4)
+	if err != nil {
+		t.Fatalf("GeneratePassword() error = %v, want nil", err)
+	}
+	if charClasses(password) < 3 {
+		t.Errorf("GeneratePassword() = %q, want 3 character classes", password)
+	}
+	if _, err := GeneratePassword(context.Background(), 1); err == nil {
+		t.Error("GeneratePassword(1) error = nil, want too few bits for the policy")
+	}
+}
@@ -0,0 +1,91 @@
+package luks
+
+import (
+	"bootstrap/internal/trace"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// VolumeUUID returns the UUID of the LUKS header.
+func VolumeUUID(ctx context.Context, cfg *LUKS) (string, error) {
+	return backend.uuid(ctx, cfg.VolumePath)
+}
+
+// envFileContent renders the EnvironmentFile describing the mounted volume. Values are
+// quoted so systemd and shells read them alike.
+func envFileContent(ctx context.Context, cfg *LUKS) string {
+	device := "/dev/mapper/" + cfg.MapperName
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "UDM_MAPPER=%q\n", cfg.MapperName)
+	fmt.Fprintf(&b, "UDM_VOLUME=%q\n", cfg.VolumePath)
+	fmt.Fprintf(&b, "UDM_DEVICE=%q\n", device)
+	fmt.Fprintf(&b, "UDM_MOUNT_POINT=%q\n", cfg.MountPoint)
+	if uuid, err := VolumeUUID(ctx, cfg); err == nil {
+		fmt.Fprintf(&b, "UDM_LUKS_UUID=%q\n", uuid)
+	}
+	if output, err := outputRetried(ctx, OpCryptsetup, func() *trace.Cmd {
+		return trace.Command("blkid", "-p", "-s", "UUID", "-o", "value", device)
+	}); err == nil {
+		fmt.Fprintf(&b, "UDM_FS_UUID=%q\n", strings.TrimSpace(string(output)))
+	}
+	fmt.Fprintf(&b, "UDM_MOUNTED=%q\n", "1")
+	return b.String()
+}
+
+// WriteEnvFile renders the EnvironmentFile of the mounted volume, if one is configured.
+// The file is replaced atomically and only when its content changed, so services
+// watching it are not restarted needlessly.
+func WriteEnvFile(ctx context.Context, cfg *LUKS) error {
+	if cfg.EnvFile == "" {
+		return nil
+	}
+	content := []byte(envFileContent(ctx, cfg))
+	if current, err := os.ReadFile(cfg.EnvFile); err == nil && bytes.Equal(current, content) {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cfg.EnvFile), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(cfg.EnvFile), err)
+	}
+	tmp := cfg.EnvFile + ".tmp"
+	if err := os.WriteFile(tmp, content, 0644); err != nil {
+		return fmt.Errorf("failed to write environment file: %w", err)
+	}
+	if err := os.Rename(tmp, cfg.EnvFile); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write environment file: %w", err)
+	}
+	return nil
+}
+
+// RemoveEnvFile removes the EnvironmentFile once the volume is unmounted.
+func RemoveEnvFile(cfg *LUKS) error {
+	if cfg.EnvFile == "" {
+		return nil
+	}
+	if err := os.Remove(cfg.EnvFile); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove environment file: %w", err)
+	}
+	return nil
+}
+
+// SyncEnvFile brings the EnvironmentFile in line with the mount state, for volumes
+// mounted or unmounted outside of udm, e.g. by systemd automount.
+func SyncEnvFile(ctx context.Context, cfg *LUKS) error {
+	if cfg.EnvFile == "" {
+		return nil
+	}
+	mounted, err := IsLUKSMounted(cfg)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		return WriteEnvFile(ctx, cfg)
+	}
+	return RemoveEnvFile(cfg)
+}
@@ -0,0 +1,41 @@
+package luks
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEnvFile(t *testing.T) {
+	cfg := &LUKS{
+		VolumePath: "/var/luks/test.img",
+		MapperName: "test-luks",
+		MountPoint: "/mnt/test luks",
+		EnvFile:    filepath.Join(t.TempDir(), "run", "test-luks.env"),
+	}
+
+	if err := WriteEnvFile(context.Background(), cfg); err != nil {
+		t.Fatalf("WriteEnvFile() error = %v, want nil", err)
+	}
+	data, err := os.ReadFile(cfg.EnvFile)
+	if err != nil {
+		t.Fatalf("environment file not written: %v", err)
+	}
+	for _, line := range []string{`UDM_MAPPER="test-luks"`, `UDM_MOUNT_POINT="/mnt/test luks"`, `UDM_DEVICE="/dev/mapper/test-luks"`} {
+		if !strings.Contains(string(data), line+"\n") {
+			t.Errorf("environment file is missing %s:\n%s", line, data)
+		}
+	}
+
+	if err := RemoveEnvFile(cfg); err != nil {
+		t.Fatalf("RemoveEnvFile() error = %v, want nil", err)
+	}
+	if _, err := os.Stat(cfg.EnvFile); !os.IsNotExist(err) {
+		t.Fatalf("environment file still present after RemoveEnvFile()")
+	}
+	if err := RemoveEnvFile(cfg); err != nil {
+		t.Fatalf("RemoveEnvFile() of a missing file error = %v, want nil", err)
+	}
+}
@@ -0,0 +1,33 @@
+package luks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+)
+
+// ErrEphemeral is returned when reopening an ephemeral volume, whose key is gone.
+var ErrEphemeral = errors.New("ephemeral volumes cannot be reopened, authorize provisions a new one")
+
+// discardEphemeral erases a closed ephemeral volume as configured by luks.erase and
+// removes its backing storage. The key was never persisted, so erasing only makes the
+// loss of the data explicit and lets the next authorize start over.
+func discardEphemeral(ctx context.Context, cfg *LUKS) error {
+	if err := secureErase(ctx, cfg); err != nil {
+		return err
+	}
+
+	if cfg.LVM.Enabled() {
+		if err := removeLogicalVolume(ctx, cfg.LVM); err != nil {
+			return fmt.Errorf("failed to remove logical volume: %w", err)
+		}
+	} else if err := os.Remove(cfg.VolumePath); err != nil {
+		return fmt.Errorf("failed to remove LUKS image file: %w", err)
+	}
+	if err := os.Remove(cfg.MountPoint); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove mount directory: %v", err)
+	}
+	return nil
+}
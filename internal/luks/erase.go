@@ -0,0 +1,84 @@
+package luks
+
+import (
+	"bootstrap/internal/trace"
+	"context"
+	"fmt"
+	"os"
+)
+
+// Erase levels applied to the backing storage before a volume is removed.
+//
+// EraseHeader destroys the keyslots: the ciphertext remains but cannot be decrypted
+// without the volume key, unless it leaked (a memory dump of the open volume) or a
+// header backup exists elsewhere. EraseDiscard also discards the blocks, so SSDs and
+// thin LVM release them; flash may keep them until garbage collection and image files
+// only release them on filesystems supporting hole punching. EraseOverwrite also
+// overwrites the storage once with random data; on SSDs with wear leveling and on
+// copy-on-write filesystems (btrfs, zfs) earlier copies of blocks may survive.
+const (
+	EraseHeader    = "header"
+	EraseDiscard   = "discard"
+	EraseOverwrite = "overwrite"
+)
+
+// stepErase names the progress step of overwriting the storage.
+const stepErase = "Overwriting LUKS volume"
+
+// eraseKeyslots wipes every keyslot of the LUKS header.
+func eraseKeyslots(ctx context.Context, volumePath string) error {
+	fmt.Println("Erasing keyslots ...")
+	output, err := runRetried(ctx, OpCryptsetup, func() *trace.Cmd {
+		return trace.Command("cryptsetup", "erase", "--batch-mode", volumePath)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to erase keyslots: %s", output)
+	}
+	return nil
+}
+
+// discardBlocks discards the blocks of a device, or punches a hole over an image file.
+func discardBlocks(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+	fmt.Println("Discarding blocks ...")
+	cmd := trace.Command("blkdiscard", "--force", path)
+	if info.Mode().IsRegular() {
+		cmd = trace.Command("fallocate", "--punch-hole", "--keep-size", "--offset", "0", "--length", fmt.Sprint(info.Size()), path)
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to discard blocks: %s", output)
+	}
+	return nil
+}
+
+// secureErase erases the closed volume according to cfg.Erase before its storage is
+// removed.
+func secureErase(ctx context.Context, cfg *LUKS) error {
+	// Plain volumes have no header, their key was never stored
+	if !cfg.Plain() {
+		if err := eraseKeyslots(ctx, cfg.VolumePath); err != nil {
+			return err
+		}
+	}
+
+	switch cfg.Erase {
+	case EraseDiscard:
+		if err := discardBlocks(cfg.VolumePath); err != nil {
+			return err
+		}
+	case EraseOverwrite:
+		if err := progress.step(stepErase, func() error {
+			output, err := runStreaming(stepErase, trace.Command("shred", "--verbose", "--iterations=1", cfg.VolumePath))
+			if err != nil {
+				return fmt.Errorf("failed to overwrite: %s", output)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,268 @@
+package luks
+
+import (
+	"bootstrap/internal/trace"
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Algorithms wrapping the volume key in an escrow blob.
+const (
+	EscrowRSAOAEP = "rsa-oaep-sha256" // RSA-OAEP with SHA-256
+	EscrowECDH    = "ecdh-aes256gcm"  // Ephemeral ECDH, then AES-256-GCM, see escrowAEAD
+)
+
+const (
+	DefaultEscrowDir = "/var/lib/udm/escrow" // Blobs are written to <dir>/<mapperName>.json by default
+	escrowKDFLabel   = "udm-escrow-v1"
+)
+
+// Escrow configures the export of the volume key for offline recovery by the
+// organization, e.g. after the TPM holding the machine key was replaced.
+type Escrow struct {
+	PublicKey string `yaml:"publicKey"` // PEM RSA or EC public key of the organization
+	Path      string `yaml:"path"`      // Where export-escrow writes the blob
+}
+
+// Enabled reports whether an escrow key is configured.
+func (e Escrow) Enabled() bool {
+	return e.PublicKey != ""
+}
+
+// EscrowBlob is the volume key wrapped for the organization. Only the holder of the
+// private key can unwrap it, udm never can.
+type EscrowBlob struct {
+	Version      int       `json:"version"`
+	VolumePath   string    `json:"volumePath"`
+	MapperName   string    `json:"mapperName"`
+	UUID         string    `json:"uuid"` // LUKS UUID of the volume
+	Created      time.Time `json:"created"`
+	Recipient    string    `json:"recipient"`              // SHA-256 of the DER public key wrapping the key
+	Algorithm    string    `json:"algorithm"`              // EscrowRSAOAEP or EscrowECDH
+	EphemeralKey []byte    `json:"ephemeralKey,omitempty"` // Uncompressed ephemeral ECDH public key
+	Nonce        []byte    `json:"nonce,omitempty"`        // AES-GCM nonce
+	WrappedKey   []byte    `json:"wrappedKey"`
+}
+
+// ExportEscrow dumps the volume key, authorized by the machine key, and wraps it with
+// the escrow public key. The volume key survives rotation of the keyslots, so the blob
+// stays valid until the volume is re-encrypted.
+func ExportEscrow(ctx context.Context, cfg *LUKS) (*EscrowBlob, error) {
+	publicKey, err := loadEscrowKey(cfg.Escrow.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := resolveKey(ctx, cfg); err != nil {
+		return nil, err
+	}
+	uuid, err := VolumeUUID(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := outputRetried(ctx, OpCryptsetup, func() *trace.Cmd {
+		cmd := trace.Command("cryptsetup", "luksDump", "--dump-volume-key", "--batch-mode", "--key-file=-", cfg.VolumePath)
+		cmd.Stdin = createPasswordInput(cfg.Password, false)
+		return cmd
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to dump volume key: %w", err)
+	}
+	volumeKey, err := parseVolumeKeyDump(string(output))
+	if err != nil {
+		return nil, err
+	}
+	defer clear(volumeKey)
+
+	blob, err := wrapEscrowKey(publicKey, volumeKey)
+	if err != nil {
+		return nil, err
+	}
+	blob.VolumePath = cfg.VolumePath
+	blob.MapperName = cfg.MapperName
+	blob.UUID = uuid
+	blob.Created = time.Now().UTC()
+	return blob, nil
+}
+
+// RecoverWithVolumeKey enrolls a new machine key in a free keyslot, authorized by the
+// volume key unwrapped from an escrow blob, and stores it like authorize does: in the
+// TPM with luks.useTPM, in Vault with luks.vault, otherwise in cfg.Password for the
+// caller to write the keyfile.
+// Keyslots of the lost key are left for the operator to remove.
+func RecoverWithVolumeKey(ctx context.Context, cfg *LUKS, volumeKey []byte) error {
+	if cfg.Split.Enabled() {
+		return fmt.Errorf("recovery is not supported in split-key mode")
+	}
+	password, err := GenerateLUKSKey(ctx, cfg.KeyBytes)
+	if err != nil {
+		return fmt.Errorf("failed to generate password: %w", err)
+	}
+
+	err = withTempKeyFile(volumeKey, func(volumeKeyFile string) error {
+		return withTempKeyFile(password, func(added string) error {
+			args := append([]string{"luksAddKey", "--volume-key-file=" + volumeKeyFile}, cfg.pbkdfArgs()...)
+			args = append(args, cfg.VolumePath, added)
+			if output, err := runRetried(ctx, OpCryptsetup, func() *trace.Cmd { return trace.Command("cryptsetup", args...) }); err != nil {
+				return fmt.Errorf("failed to enroll new key: %s", strings.TrimSpace(string(output)))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	if cfg.UseTPM {
+		// A replaced TPM holds no key, the old NV index only exists on the same TPM
+		if err := removePasswordFromTPM(ctx, cfg.KeyNVIndex(), cfg.nvKeySize()); err != nil {
+			fmt.Println("No previous key in the TPM:", err)
+		}
+		if err := storePasswordInTPM(ctx, password, cfg.KeyNVIndex(), cfg.NVAuth); err != nil {
+			return fmt.Errorf("failed to store new key in TPM: %w", err)
+		}
+	}
+	if cfg.Vault.Enabled() {
+		if err := storeInVault(cfg, password); err != nil {
+			return fmt.Errorf("failed to store new key in Vault: %w", err)
+		}
+	}
+	if err := ForgetCachedKey(cfg); err != nil {
+		fmt.Println("Previously cached key not revoked:", err)
+	}
+	cfg.Password = password
+	return nil
+}
+
+// loadEscrowKey reads the PEM public key of the organization.
+func loadEscrowKey(path string) (any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read escrow public key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block in escrow public key %s", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse escrow public key: %w", err)
+	}
+	return key, nil
+}
+
+// wrapEscrowKey encrypts the volume key to the public key.
+func wrapEscrowKey(publicKey any, volumeKey []byte) (*EscrowBlob, error) {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	recipient := sha256.Sum256(der)
+	blob := &EscrowBlob{Version: 1, Recipient: hex.EncodeToString(recipient[:])}
+
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		blob.Algorithm = EscrowRSAOAEP
+		blob.WrappedKey, err = rsa.EncryptOAEP(sha256.New(), rand.Reader, key, volumeKey, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to wrap volume key: %w", err)
+		}
+	case *ecdsa.PublicKey:
+		recipientKey, err := key.ECDH()
+		if err != nil {
+			return nil, fmt.Errorf("unsupported escrow key curve: %w", err)
+		}
+		if err := wrapECDH(blob, recipientKey, volumeKey); err != nil {
+			return nil, err
+		}
+	case *ecdh.PublicKey:
+		if err := wrapECDH(blob, key, volumeKey); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("escrow public key must be RSA or EC, not %T", publicKey)
+	}
+	return blob, nil
+}
+
+func wrapECDH(blob *EscrowBlob, recipient *ecdh.PublicKey, volumeKey []byte) error {
+	ephemeral, err := recipient.Curve().GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate ephemeral key: %w", err)
+	}
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return fmt.Errorf("ECDH failed: %w", err)
+	}
+	aead, err := escrowAEAD(shared, ephemeral.PublicKey().Bytes())
+	clear(shared)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	blob.Algorithm = EscrowECDH
+	blob.EphemeralKey = ephemeral.PublicKey().Bytes()
+	blob.Nonce = nonce
+	blob.WrappedKey = aead.Seal(nil, nonce, volumeKey, []byte(blob.Recipient))
+	return nil
+}
+
+// escrowAEAD derives the AES-256-GCM key of an ECDH escrow blob as SHA-256 of the shared
+// secret, the ephemeral public key and escrowKDFLabel. The recipient fingerprint is the
+// associated data of the sealed key.
+func escrowAEAD(shared, ephemeral []byte) (cipher.AEAD, error) {
+	h := sha256.New()
+	h.Write(shared)
+	h.Write(ephemeral)
+	h.Write([]byte(escrowKDFLabel))
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// parseVolumeKeyDump extracts the volume key from luksDump --dump-volume-key output,
+// printed as hex bytes over several lines after "MK dump:" (or "Volume key:").
+func parseVolumeKeyDump(dump string) ([]byte, error) {
+	var hexKey strings.Builder
+	inKey := false
+	scanner := bufio.NewScanner(strings.NewReader(dump))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if key, value, ok := strings.Cut(line, ":"); ok && (key == "MK dump" || key == "Volume key") {
+			inKey = true
+			line = value
+		} else if inKey && (line == "" || !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "\t")) {
+			break
+		}
+		if inKey {
+			hexKey.WriteString(strings.ReplaceAll(strings.TrimSpace(line), " ", ""))
+		}
+	}
+	if hexKey.Len() == 0 {
+		return nil, fmt.Errorf("no volume key in luksDump output")
+	}
+	key, err := hex.DecodeString(hexKey.String())
+	if err != nil {
+		return nil, fmt.Errorf("malformed volume key in luksDump output: %w", err)
+	}
+	return key, nil
+}
@@ -0,0 +1,90 @@
+package luks
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"testing"
+)
+
+var testVolumeKey = bytes.Repeat([]byte{0xa5, 0x3c}, 32)
+
+func TestWrapEscrowKeyRSA(t *testing.T) {
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := wrapEscrowKey(&private.PublicKey, testVolumeKey)
+	if err != nil {
+		t.Fatalf("wrapEscrowKey() error = %v", err)
+	}
+	if blob.Algorithm != EscrowRSAOAEP {
+		t.Fatalf("Algorithm = %s, want %s", blob.Algorithm, EscrowRSAOAEP)
+	}
+	key, err := rsa.DecryptOAEP(sha256.New(), nil, private, blob.WrappedKey, nil)
+	if err != nil || !bytes.Equal(key, testVolumeKey) {
+		t.Fatalf("unwrapped key = %x, %v, want %x", key, err, testVolumeKey)
+	}
+}
+
+func TestWrapEscrowKeyECDH(t *testing.T) {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := wrapEscrowKey(&private.PublicKey, testVolumeKey)
+	if err != nil {
+		t.Fatalf("wrapEscrowKey() error = %v", err)
+	}
+	if blob.Algorithm != EscrowECDH {
+		t.Fatalf("Algorithm = %s, want %s", blob.Algorithm, EscrowECDH)
+	}
+
+	// Unwrap the way the security team does with the private key
+	recipient, err := private.ECDH()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ephemeral, err := ecdh.P256().NewPublicKey(blob.EphemeralKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, err := recipient.ECDH(ephemeral)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := escrowAEAD(shared, blob.EphemeralKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := aead.Open(nil, blob.Nonce, blob.WrappedKey, []byte(blob.Recipient))
+	if err != nil || !bytes.Equal(key, testVolumeKey) {
+		t.Fatalf("unwrapped key = %x, %v, want %x", key, err, testVolumeKey)
+	}
+}
+
+func TestParseVolumeKeyDump(t *testing.T) {
+	dump := "LUKS header information for /var/lib/udm/udm-luks.img\n" +
+		"Cipher name:   \taes\n" +
+		"MK bits:       \t128\n" +
+		"MK dump:\t00 11 22 33 44 55 66 77 88 99 aa bb cc dd ee ff \n"
+	key, err := parseVolumeKeyDump(dump)
+	want := []byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	if err != nil || !bytes.Equal(key, want) {
+		t.Fatalf("parseVolumeKeyDump() = %x, %v, want %x", key, err, want)
+	}
+
+	// Longer keys continue on indented lines
+	dump = "Volume key:\t00 11 22 33\n\t\t44 55 66 77\nUUID: x\n"
+	if key, err := parseVolumeKeyDump(dump); err != nil || len(key) != 8 {
+		t.Fatalf("parseVolumeKeyDump() = %x, %v, want 8 bytes", key, err)
+	}
+
+	if _, err := parseVolumeKeyDump("Cipher name: aes\n"); err == nil {
+		t.Fatal("parseVolumeKeyDump() accepted a dump without key")
+	}
+}
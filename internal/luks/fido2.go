@@ -0,0 +1,92 @@
+package luks
+
+import (
+	"bootstrap/internal/trace"
+	"context"
+	"fmt"
+	"os"
+)
+
+const (
+	DefaultFIDO2Device = "auto"
+	FIDO2TokenType     = "systemd-fido2" // LUKS2 token type written by systemd-cryptenroll
+)
+
+// FIDO2 binds a keyslot to a FIDO2 hardware token (e.g. a YubiKey) supporting the
+// hmac-secret extension, for hosts without a TPM.
+type FIDO2 struct {
+	Enabled  bool   `yaml:"enabled"`  // Enroll a FIDO2 token keyslot during authorize
+	Device   string `yaml:"device"`   // hidraw device of the token, or "auto"
+	PIN      bool   `yaml:"pin"`      // Require the token PIN to unlock
+	Presence bool   `yaml:"presence"` // Require touching the token to unlock
+}
+
+// yesNo formats a boolean as a systemd option value.
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// EnrollFIDO2 adds a keyslot bound to the FIDO2 token together with a systemd-fido2
+// token, authorized by the machine key. The token PIN and touch are requested on the
+// terminal by systemd-cryptenroll.
+func EnrollFIDO2(ctx context.Context, cfg *LUKS) error {
+	if err := resolveKey(ctx, cfg); err != nil {
+		return err
+	}
+
+	return withTempKeyFile(cfg.Password, func(keyFile string) error {
+		// Waits for the PIN and a touch of the token, it is only killed with ctx
+		cmd := trace.CommandContext(ctx, "systemd-cryptenroll",
+			"--unlock-key-file="+keyFile,
+			"--fido2-device="+cfg.FIDO2.Device,
+			"--fido2-with-client-pin="+yesNo(cfg.FIDO2.PIN),
+			"--fido2-with-user-presence="+yesNo(cfg.FIDO2.Presence),
+			cfg.VolumePath)
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("systemd-cryptenroll error: %w", err)
+		}
+		return nil
+	})
+}
+
+// openWithFIDO2 opens the volume through its systemd-fido2 token, prompting on the
+// terminal for the PIN and touch as configured.
+func openWithFIDO2(ctx context.Context, cfg *LUKS) error {
+	if cfg.FIDO2.PIN {
+		fmt.Fprintln(os.Stderr, "Enter the FIDO2 token PIN when prompted")
+	}
+	if cfg.FIDO2.Presence {
+		fmt.Fprintln(os.Stderr, "Touch the FIDO2 token when it blinks")
+	}
+
+	args := []string{"open", "--token-only", "--token-type=" + FIDO2TokenType}
+	if cfg.ReadOnly {
+		args = append(args, "--readonly")
+	}
+	if cfg.allowDiscards() {
+		args = append(args, "--allow-discards")
+	}
+	return openDevice(ctx, cfg.VolumePath, func(device string) error {
+		cmd := trace.CommandContext(ctx, "cryptsetup", append(args, device, cfg.MapperName)...)
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); isWrongKey(err) {
+			return fmt.Errorf("failed to unlock with FIDO2 token: %w", ErrWrongKey)
+		} else if err != nil {
+			return fmt.Errorf("failed to unlock with FIDO2 token: %w", err)
+		}
+		return nil
+	})
+}
+
+// fido2CrypttabOpts returns the crypttab options unlocking the volume with the token at boot.
+func fido2CrypttabOpts(cfg *LUKS) string {
+	return "fido2-device=" + cfg.FIDO2.Device
+}
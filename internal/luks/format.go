@@ -0,0 +1,163 @@
+package luks
+
+import (
+	"bufio"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+const (
+	PBKDFArgon2id = "argon2id"
+	PBKDFArgon2i  = "argon2i"
+	PBKDFPBKDF2   = "pbkdf2"
+
+	cipherAESXTS   = "aes-xts-plain64"
+	cipherAdiantum = "xchacha12,aes-adiantum-plain64"
+	cipherAESGCM   = "aes-gcm-random"  // AEAD cipher of integrity aead
+	cipherChaCha20 = "chacha20-random" // Cipher authenticated by integrity poly1305
+
+	MinPBKDFMemory     = 32 * 1024       // KiB, smallest Argon2 memory cost worth using
+	MaxPBKDFMemory     = 4 * 1024 * 1024 // KiB, the cryptsetup limit
+	defaultPBKDFMemory = 2 * 1024 * 1024 // KiB, used when RAM allows it
+)
+
+// DefaultCipher returns aes-xts-plain64 on CPUs with AES instructions and Adiantum,
+// which is much faster in software, on those without.
+func DefaultCipher() string {
+	if cpuHasAES() {
+		return cipherAESXTS
+	}
+	return cipherAdiantum
+}
+
+// Integrity protections of luks.integrity, detecting tampering with the ciphertext on
+// read through dm-integrity.
+const (
+	IntegrityHMACSHA256 = "hmac-sha256" // HMAC over sectors encrypted with any non-AEAD cipher
+	IntegrityHMACSHA512 = "hmac-sha512"
+	IntegrityAEAD       = "aead"     // AES-GCM authenticated encryption
+	IntegrityPoly1305   = "poly1305" // ChaCha20-Poly1305 authenticated encryption
+)
+
+// IntegrityCipher returns the cipher an authenticated encryption integrity mode requires,
+// or "" when it works with any cipher without a random IV.
+func IntegrityCipher(integrity string) string {
+	switch integrity {
+	case IntegrityAEAD:
+		return cipherAESGCM
+	case IntegrityPoly1305:
+		return cipherChaCha20
+	}
+	return ""
+}
+
+// DefaultKeySize returns the master key size in bits for cipher, including the HMAC key
+// of integrity.
+func DefaultKeySize(cipher, integrity string) int {
+	size := 256
+	if strings.Contains(cipher, "xts") {
+		size = 512
+	}
+	switch integrity {
+	case IntegrityHMACSHA256:
+		size += 256
+	case IntegrityHMACSHA512:
+		size += 512
+	}
+	return size
+}
+
+// integrityArgs returns the luksFormat arguments adding dm-integrity. cryptsetup wipes
+// the device to initialize the integrity tags, so unwritten sectors read back valid.
+func (cfg *LUKS) integrityArgs() []string {
+	if cfg.Integrity == "" {
+		return nil
+	}
+	return []string{"--integrity=" + cfg.Integrity}
+}
+
+// DefaultPBKDFMemory returns the Argon2 memory cost in KiB: 2 GiB, capped at a quarter
+// of physical memory so unlocking does not OOM small devices.
+func DefaultPBKDFMemory() int {
+	total := memTotalKiB()
+	if total <= 0 {
+		return defaultPBKDFMemory
+	}
+	return max(min(defaultPBKDFMemory, total/4), MinPBKDFMemory)
+}
+
+// formatArgs returns the cipher and key size arguments of luksFormat.
+func (cfg *LUKS) formatArgs() []string {
+	args := []string{"--cipher=" + cfg.Cipher}
+	if cfg.KeySize > 0 {
+		args = append(args, "--key-size="+strconv.Itoa(cfg.KeySize))
+	}
+	return append(args, cfg.pbkdfArgs()...)
+}
+
+// pbkdfArgs returns the keyslot PBKDF arguments, shared by luksFormat and luksAddKey.
+// Without an iteration count cryptsetup benchmarks one for a ~2s unlock.
+func (cfg *LUKS) pbkdfArgs() []string {
+	if cfg.PBKDF == "" {
+		return nil
+	}
+	args := []string{"--pbkdf=" + cfg.PBKDF}
+	if cfg.PBKDF != PBKDFPBKDF2 {
+		args = append(args,
+			"--pbkdf-memory="+strconv.Itoa(cfg.PBKDFMemory),
+			"--pbkdf-parallel="+strconv.Itoa(min(8, runtime.NumCPU())))
+	}
+	if cfg.PBKDFIterations > 0 {
+		args = append(args, "--pbkdf-force-iterations="+strconv.Itoa(cfg.PBKDFIterations))
+	}
+	return args
+}
+
+// cpuHasAES reports whether /proc/cpuinfo lists AES instructions (x86 "aes" flag or
+// arm64 "aes" feature).
+func cpuHasAES() bool {
+	file, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return true
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		if key = strings.TrimSpace(key); key != "flags" && key != "Features" {
+			continue
+		}
+		for _, flag := range strings.Fields(value) {
+			if flag == "aes" {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// memTotalKiB returns the physical memory in KiB, or 0 if unknown.
+func memTotalKiB() int {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			total, _ := strconv.Atoi(fields[1])
+			return total
+		}
+	}
+	return 0
+}
@@ -0,0 +1,85 @@
+package luks
+
+import (
+	"bootstrap/internal/trace"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// HeaderFingerprint returns the SHA-256 of the binary LUKS header, covering keyslot
+// material, tokens and digests, together with the luksDump output used to describe
+// changes.
+func HeaderFingerprint(ctx context.Context, cfg *LUKS) (hash, dump string, err error) {
+	dir, err := os.MkdirTemp("", "luks-header-*")
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	backup := filepath.Join(dir, "header")
+	if output, err := runRetried(ctx, OpCryptsetup, func() *trace.Cmd {
+		return trace.Command("cryptsetup", "luksHeaderBackup", "--batch-mode", "--header-backup-file", backup, cfg.VolumePath)
+	}); err != nil {
+		return "", "", fmt.Errorf("failed to back up LUKS header: %s", output)
+	}
+
+	file, err := os.Open(backup)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read LUKS header backup: %w", err)
+	}
+	defer file.Close()
+	digest := sha256.New()
+	if _, err := io.Copy(digest, file); err != nil {
+		return "", "", fmt.Errorf("failed to hash LUKS header: %w", err)
+	}
+
+	output, err := runRetried(ctx, OpCryptsetup, func() *trace.Cmd { return trace.Command("cryptsetup", "luksDump", cfg.VolumePath) })
+	if err != nil {
+		return "", "", fmt.Errorf("failed to dump LUKS header: %s", output)
+	}
+	return hex.EncodeToString(digest.Sum(nil)), string(output), nil
+}
+
+// DiffDump returns the lines removed ("- ") and added ("+ ") between two luksDump outputs.
+func DiffDump(before, after string) []string {
+	a := strings.Split(strings.TrimRight(before, "\n"), "\n")
+	b := strings.Split(strings.TrimRight(after, "\n"), "\n")
+
+	// Longest common subsequence table, dumps are a few hundred lines at most
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var diff []string
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i++
+			j++
+		case j < len(b) && (i == len(a) || lcs[i][j+1] >= lcs[i+1][j]):
+			diff = append(diff, "+ "+b[j])
+			j++
+		default:
+			diff = append(diff, "- "+a[i])
+			i++
+		}
+	}
+	return diff
+}
@@ -0,0 +1,21 @@
+package luks
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffDump(t *testing.T) {
+	before := "Keyslots:\n  0: luks2\n\tPriority:   normal\nTokens:\n"
+	after := "Keyslots:\n  0: luks2\n\tPriority:   normal\n  1: luks2\n\tPriority:   normal\nTokens:\n  0: systemd-tpm2\n"
+
+	got := DiffDump(before, after)
+	want := []string{"+   1: luks2", "+ \tPriority:   normal", "+   0: systemd-tpm2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("DiffDump() = %q, want %q", got, want)
+	}
+
+	if got := DiffDump(after, after); len(got) != 0 {
+		t.Fatalf("DiffDump() of identical dumps = %q, want none", got)
+	}
+}
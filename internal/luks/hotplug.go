@@ -0,0 +1,157 @@
+package luks
+
+import (
+	"bootstrap/internal/trace"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// WaitDevice makes mount wait for a backing device that appears late, e.g. a slow SD card
+// or a USB enclosure, instead of failing at once.
+type WaitDevice struct {
+	Timeout string `yaml:"timeout"` // How long mount waits for luks.volumePath, e.g. "30s", disabled when empty
+}
+
+// Validate checks the timeout.
+func (w WaitDevice) Validate() error {
+	if w.Timeout == "" {
+		return nil
+	}
+	if timeout, err := time.ParseDuration(w.Timeout); err != nil || timeout <= 0 {
+		return fmt.Errorf("luks.waitDevice.timeout (%s) must be a positive duration, e.g. 30s", w.Timeout)
+	}
+	return nil
+}
+
+// devicePollInterval is how often WaitForDevice looks for the device.
+var devicePollInterval = 250 * time.Millisecond
+
+// WaitForDevice waits up to luks.waitDevice.timeout for the volume path to appear.
+func WaitForDevice(cfg *LUKS) error {
+	if _, err := os.Stat(cfg.VolumePath); err == nil || cfg.WaitDevice.Timeout == "" {
+		return nil
+	}
+	timeout, _ := time.ParseDuration(cfg.WaitDevice.Timeout) // Validated when the configuration was loaded
+	fmt.Printf("Waiting up to %s for %s ...\n", timeout, cfg.VolumePath)
+	deadline := time.Now().Add(timeout)
+	for {
+		time.Sleep(devicePollInterval)
+		if _, err := os.Stat(cfg.VolumePath); err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s did not appear within %s", cfg.VolumePath, timeout)
+		}
+	}
+}
+
+// UdevRulesDir holds the rules installed by AddHotplugMount.
+var UdevRulesDir = "/etc/udev/rules.d"
+
+// hotplugRulePath returns the udev rule of the mapper.
+func hotplugRulePath(mapperName string) string {
+	return filepath.Join(UdevRulesDir, fmt.Sprintf("90-udm-%s.rules", mapperName))
+}
+
+// hotplugUnitName returns the name of the unit mounting the volume of the mapper.
+func hotplugUnitName(mapperName string) (string, error) {
+	output, err := trace.Command("systemd-escape", mapperName).Output()
+	if err != nil {
+		return "", fmt.Errorf("systemd-escape failed: %w", err)
+	}
+	return fmt.Sprintf("udm-hotplug-%s.service", strings.TrimSpace(string(output))), nil
+}
+
+// hotplugRuleContent returns the udev rule pulling in the unit when the LUKS device with
+// the UUID appears. udev kills long-running RUN programs, so systemd runs the mount.
+func hotplugRuleContent(mapperName, uuid, unit string) string {
+	return fmt.Sprintf(`# Installed by udm add-hotplug-mount, mounts %s when its device appears
+ACTION=="add", SUBSYSTEM=="block", ENV{ID_FS_TYPE}=="crypto_LUKS", ENV{ID_FS_UUID}=="%s", TAG+="systemd", ENV{SYSTEMD_WANTS}+="%s"
+`, mapperName, uuid, unit)
+}
+
+// hotplugUnitContent returns the unit running mount while the device is present. Bound
+// to the device unit, it runs unmount when the device goes away.
+func hotplugUnitContent(mapperName, deviceUnit string, mount, unmount []string) string {
+	return fmt.Sprintf(`[Unit]
+Description=Mount udm volume %s when its device appears
+BindsTo=%s
+After=%s local-fs.target
+
+[Service]
+Type=oneshot
+RemainAfterExit=yes
+ExecStart=%s
+ExecStop=%s
+`, mapperName, deviceUnit, deviceUnit, strings.Join(mount, " "), strings.Join(unmount, " "))
+}
+
+// AddHotplugMount installs a udev rule and unit running the mount command whenever the
+// block device of the volume appears, and the unmount command when it is removed.
+func AddHotplugMount(ctx context.Context, cfg *LUKS, mount, unmount []string) error {
+	if isImageFile(cfg) {
+		return fmt.Errorf("hotplug mount needs a block device, %s is an image file", cfg.VolumePath)
+	}
+	uuid, err := VolumeUUID(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	unit, err := hotplugUnitName(cfg.MapperName)
+	if err != nil {
+		return err
+	}
+	output, err := trace.Command("systemd-escape", "--path", "--suffix=device", "/dev/disk/by-uuid/"+uuid).Output()
+	if err != nil {
+		return fmt.Errorf("systemd-escape failed: %w", err)
+	}
+	deviceUnit := strings.TrimSpace(string(output))
+
+	if err := os.WriteFile(filepath.Join("/etc/systemd/system", unit), []byte(hotplugUnitContent(cfg.MapperName, deviceUnit, mount, unmount)), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", unit, err)
+	}
+	if err := reloadSystemd(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(UdevRulesDir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", UdevRulesDir, err)
+	}
+	if err := os.WriteFile(hotplugRulePath(cfg.MapperName), []byte(hotplugRuleContent(cfg.MapperName, uuid, unit)), 0644); err != nil {
+		return fmt.Errorf("failed to write udev rule: %w", err)
+	}
+	return reloadUdev()
+}
+
+// RemoveHotplugMount removes the rule and unit installed by AddHotplugMount.
+func RemoveHotplugMount(cfg *LUKS) error {
+	if err := os.Remove(hotplugRulePath(cfg.MapperName)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove udev rule: %w", err)
+	}
+	if err := reloadUdev(); err != nil {
+		return err
+	}
+	unit, err := hotplugUnitName(cfg.MapperName)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join("/etc/systemd/system", unit)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove %s: %w", unit, err)
+	}
+	return reloadSystemd()
+}
+
+// HotplugMountInstalled reports whether the volume has a hotplug udev rule.
+func HotplugMountInstalled(cfg *LUKS) bool {
+	return fileExists(hotplugRulePath(cfg.MapperName))
+}
+
+// reloadUdev makes udev read the changed rules.
+func reloadUdev() error {
+	if output, err := trace.Command("udevadm", "control", "--reload").CombinedOutput(); err != nil {
+		return fmt.Errorf("udevadm control --reload failed: %s", strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package luks
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWaitForDevice(t *testing.T) {
+	interval := devicePollInterval
+	devicePollInterval = time.Millisecond
+	t.Cleanup(func() { devicePollInterval = interval })
+	device := filepath.Join(t.TempDir(), "sdb1")
+	cfg := &LUKS{VolumePath: device, WaitDevice: WaitDevice{Timeout: "2s"}}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		os.WriteFile(device, nil, 0600)
+	}()
+	if err := WaitForDevice(cfg); err != nil {
+		t.Fatalf("WaitForDevice() error = %v, want the device found", err)
+	}
+
+	cfg.VolumePath = filepath.Join(t.TempDir(), "sdc1")
+	cfg.WaitDevice.Timeout = "10ms"
+	if err := WaitForDevice(cfg); err == nil || !strings.Contains(err.Error(), "did not appear") {
+		t.Fatalf("WaitForDevice(missing) error = %v, want a timeout", err)
+	}
+	cfg.WaitDevice.Timeout = ""
+	if err := WaitForDevice(cfg); err != nil {
+		t.Fatalf("WaitForDevice(not waiting) error = %v, want nil", err)
+	}
+}
+
+func TestHotplugRule(t *testing.T) {
+	rule := hotplugRuleContent("data", "0b5c7a31-9d2e-4d5f-8a3b-1c2d3e4f5a6b", "udm-hotplug-data.service")
+	for _, want := range []string{`ACTION=="add"`, `ENV{ID_FS_UUID}=="0b5c7a31-9d2e-4d5f-8a3b-1c2d3e4f5a6b"`, `ENV{SYSTEMD_WANTS}+="udm-hotplug-data.service"`} {
+		if !strings.Contains(rule, want) {
+			t.Errorf("hotplugRuleContent() = %q, missing %s", rule, want)
+		}
+	}
+
+	unit := hotplugUnitContent("data", "dev-disk-by\\x2duuid-0b5c.device",
+		[]string{"/usr/bin/udm", "mount", "--holder=hotplug"}, []string{"/usr/bin/udm", "unmount", "--holder=hotplug"})
+	for _, want := range []string{"BindsTo=dev-disk-by\\x2duuid-0b5c.device", "ExecStart=/usr/bin/udm mount --holder=hotplug", "ExecStop=/usr/bin/udm unmount --holder=hotplug"} {
+		if !strings.Contains(unit, want) {
+			t.Errorf("hotplugUnitContent() = %q, missing %s", unit, want)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package luks
+
+import (
+	"bootstrap/internal/secrets"
+	"bootstrap/internal/trace"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Sources of the device-unique secret luks.hardwareBinding mixes into the key.
+const (
+	BindingTPM = "tpm" // HMAC key that never leaves the TPM 2.0
+	BindingCPU = "cpu" // Serial number of the CPU, reported by e.g. Raspberry Pi boards
+	BindingDMI = "dmi" // System UUID of the firmware, readable by root only
+)
+
+// HardwareBinding mixes a device-unique secret into the key kept in the keyfile, so a
+// copied image cannot be unlocked on other hardware even if the keyfile leaks. The
+// secret only has to stay off the copied storage, it is not hidden from root on the
+// device itself.
+type HardwareBinding struct {
+	Source string `yaml:"source"` // tpm, cpu or dmi, disabled when empty
+}
+
+// Enabled reports whether the keyfile is bound to the hardware.
+func (h HardwareBinding) Enabled() bool {
+	return h.Source != ""
+}
+
+// Validate checks the source.
+func (h HardwareBinding) Validate() error {
+	switch h.Source {
+	case "", BindingTPM, BindingCPU, BindingDMI:
+		return nil
+	}
+	return fmt.Errorf("luks.hardwareBinding.source (%s) must be %s, %s or %s", h.Source, BindingTPM, BindingCPU, BindingDMI)
+}
+
+// hwBindKeyHandle is the persistent handle of the HMAC key binding keyfiles to the TPM.
+const hwBindKeyHandle = "0x81010004"
+
+var (
+	dmiUUIDPath = "/sys/class/dmi/id/product_uuid"
+	cpuInfoPath = "/proc/cpuinfo"
+)
+
+// BindToHardware returns key XORed with a pad derived by HKDF-SHA256 from the device
+// secret and the mapper name. Binding is its own inverse: it is applied when the keyfile
+// is written and again when it is read, so the keyfile alone reveals nothing of the key.
+func BindToHardware(ctx context.Context, cfg *LUKS, key []byte) ([]byte, error) {
+	secret, err := deviceSecret(ctx, cfg.HardwareBinding.Source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s hardware secret: %w", cfg.HardwareBinding.Source, err)
+	}
+	defer secrets.Wipe(secret)
+
+	pad := hkdfSHA256(secret, nil, []byte("udm hardware binding "+cfg.MapperName), len(key))
+	defer secrets.Wipe(pad)
+	buf, err := secrets.New(len(key))
+	if err != nil {
+		return nil, err
+	}
+	bound := buf.Bytes()
+	for i := range key {
+		bound[i] = key[i] ^ pad[i]
+	}
+	return bound, nil
+}
+
+// deviceSecret reads the device-unique secret of the source.
+func deviceSecret(ctx context.Context, source string) ([]byte, error) {
+	switch source {
+	case BindingDMI:
+		data, err := os.ReadFile(dmiUUIDPath)
+		if err != nil {
+			return nil, err
+		}
+		if uuid := bytes.TrimSpace(data); len(uuid) > 0 {
+			return uuid, nil
+		}
+		return nil, fmt.Errorf("%s is empty", dmiUUIDPath)
+	case BindingCPU:
+		return cpuSerial()
+	case BindingTPM:
+		return tpmBindingSecret(ctx)
+	}
+	return nil, fmt.Errorf("unknown hardware binding source %q", source)
+}
+
+// cpuSerial returns the Serial line of /proc/cpuinfo, which x86 CPUs do not report.
+func cpuSerial() ([]byte, error) {
+	f, err := os.Open(cpuInfoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if ok && strings.TrimSpace(key) == "Serial" {
+			if serial := strings.TrimLeft(strings.TrimSpace(value), "0"); serial != "" {
+				return []byte(serial), nil
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("the CPU reports no serial number")
+}
+
+// tpmBindingSecret returns the HMAC of a fixed message under a key that is created in
+// the TPM and cannot be exported, so the secret can only be computed on this TPM. The
+// key is created on first use and persisted at hwBindKeyHandle.
+func tpmBindingSecret(ctx context.Context) ([]byte, error) {
+	if tpm1Selected() {
+		return nil, fmt.Errorf("not supported with a TPM 1.2")
+	}
+	if output, err := runRetried(ctx, OpTPM, func() *trace.Cmd {
+		return trace.Command("tpm2_readpublic", "-c", hwBindKeyHandle)
+	}); err != nil {
+		log.Printf("No TPM binding key at %s, creating it: %s", hwBindKeyHandle, strings.TrimSpace(string(output)))
+		if err := createBindingKey(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	output, err := outputRetried(ctx, OpTPM, func() *trace.Cmd {
+		cmd := trace.Command("tpm2_hmac", "-c", hwBindKeyHandle, "--hex")
+		cmd.Stdin = strings.NewReader("udm hardware binding")
+		return cmd
+	})
+	if err != nil {
+		return nil, fmt.Errorf("tpm2_hmac error: %w", err)
+	}
+	secret, err := hex.DecodeString(strings.TrimSpace(string(output)))
+	if err != nil || len(secret) == 0 {
+		return nil, fmt.Errorf("unexpected tpm2_hmac output")
+	}
+	return secret, nil
+}
+
+// createBindingKey creates the non-exportable HMAC key under the owner hierarchy and
+// persists it at hwBindKeyHandle.
+func createBindingKey(ctx context.Context) error {
+	dir, err := os.MkdirTemp("", "udm-hwbind-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	steps := [][]string{
+		{"tpm2_createprimary", "-C", "o", "-c", path("primary.ctx")},
+		{"tpm2_create", "-C", path("primary.ctx"), "-G", "hmac", "-a", "fixedtpm|fixedparent|sensitivedataorigin|userwithauth|sign",
+			"-u", path("key.pub"), "-r", path("key.priv")},
+		{"tpm2_load", "-C", path("primary.ctx"), "-u", path("key.pub"), "-r", path("key.priv"), "-c", path("key.ctx")},
+		{"tpm2_evictcontrol", "-C", "o", "-c", path("key.ctx"), hwBindKeyHandle},
+	}
+	for _, step := range steps {
+		if output, err := runRetried(ctx, OpTPM, func() *trace.Cmd { return trace.Command(step[0], step[1:]...) }); err != nil {
+			return fmt.Errorf("%s error: %s", step[0], strings.TrimSpace(string(output)))
+		}
+	}
+	return nil
+}
+
+// hkdfSHA256 derives length bytes from secret with HKDF-SHA256 (RFC 5869).
+func hkdfSHA256(secret, salt, info []byte, length int) []byte {
+	if salt == nil {
+		salt = make([]byte, sha256.Size)
+	}
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+	defer secrets.Wipe(prk)
+
+	var okm, block []byte
+	for counter := byte(1); len(okm) < length; counter++ {
+		expand := hmac.New(sha256.New, prk)
+		expand.Write(block)
+		expand.Write(info)
+		expand.Write([]byte{counter})
+		block = expand.Sum(nil)
+		okm = append(okm, block...)
+	}
+	return okm[:length]
+}
@@ -0,0 +1,64 @@
+package luks
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHKDFSHA256(t *testing.T) {
+	// RFC 5869, test case 1
+	secret := bytes.Repeat([]byte{0x0b}, 22)
+	salt, _ := hex.DecodeString("000102030405060708090a0b0c")
+	info, _ := hex.DecodeString("f0f1f2f3f4f5f6f7f8f9")
+	want := "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865"
+	if got := hex.EncodeToString(hkdfSHA256(secret, salt, info, 42)); got != want {
+		t.Fatalf("hkdfSHA256() = %s, want %s", got, want)
+	}
+}
+
+func TestBindToHardware(t *testing.T) {
+	dir := t.TempDir()
+	oldPath := dmiUUIDPath
+	dmiUUIDPath = filepath.Join(dir, "product_uuid")
+	t.Cleanup(func() { dmiUUIDPath = oldPath })
+	os.WriteFile(dmiUUIDPath, []byte("4c4c4544-0042-3510-8052-b4c04f4e3332\n"), 0400)
+
+	cfg := &LUKS{MapperName: "data", HardwareBinding: HardwareBinding{Source: BindingDMI}}
+	key := bytes.Repeat([]byte{0x5a}, MinKeyBytes)
+	bound, err := BindToHardware(context.Background(), cfg, key)
+	if err != nil {
+		t.Fatalf("BindToHardware() error = %v", err)
+	}
+	if bytes.Equal(bound, key) {
+		t.Fatal("BindToHardware() returned the key unchanged")
+	}
+	unbound, err := BindToHardware(context.Background(), cfg, bound)
+	if err != nil || !bytes.Equal(unbound, key) {
+		t.Fatalf("BindToHardware(bound) = %x, %v, want the key back", unbound, err)
+	}
+
+	// The keyfile copied to other hardware yields a different key
+	os.WriteFile(dmiUUIDPath, []byte("0b5c7a31-9d2e-4d5f-8a3b-1c2d3e4f5a6b\n"), 0400)
+	if other, err := BindToHardware(context.Background(), cfg, bound); err != nil || bytes.Equal(other, key) {
+		t.Fatalf("BindToHardware() on other hardware = %x, %v, want a different key", other, err)
+	}
+}
+
+func TestCPUSerial(t *testing.T) {
+	oldPath := cpuInfoPath
+	cpuInfoPath = filepath.Join(t.TempDir(), "cpuinfo")
+	t.Cleanup(func() { cpuInfoPath = oldPath })
+
+	os.WriteFile(cpuInfoPath, []byte("processor\t: 0\nHardware\t: BCM2835\nSerial\t\t: 00000000a1b2c3d4\nModel\t\t: Raspberry Pi 4\n"), 0444)
+	if serial, err := cpuSerial(); err != nil || string(serial) != "a1b2c3d4" {
+		t.Fatalf("cpuSerial() = %q, %v, want a1b2c3d4", serial, err)
+	}
+	os.WriteFile(cpuInfoPath, []byte("processor\t: 0\nmodel name\t: Intel(R) Xeon(R)\n"), 0444)
+	if _, err := cpuSerial(); err == nil {
+		t.Fatal("cpuSerial() without a Serial line succeeded")
+	}
+}
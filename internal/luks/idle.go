@@ -0,0 +1,41 @@
+package luks
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// IOCount returns the number of completed reads and writes of the open mapping, from
+// the block layer statistics. Reads served from the page cache do not reach the device
+// and are not counted.
+func IOCount(mapperName string) (uint64, error) {
+	target, err := filepath.EvalSymlinks("/dev/mapper/" + mapperName)
+	if err != nil {
+		return 0, fmt.Errorf("failed to resolve mapper device: %w", err)
+	}
+	data, err := os.ReadFile(filepath.Join("/sys/block", filepath.Base(target), "stat"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read device statistics: %w", err)
+	}
+	return parseBlockStat(string(data))
+}
+
+// parseBlockStat sums the completed reads and writes of a /sys/block/<dev>/stat line.
+func parseBlockStat(stat string) (uint64, error) {
+	fields := strings.Fields(stat)
+	if len(fields) < 5 {
+		return 0, fmt.Errorf("unexpected device statistics %q", strings.TrimSpace(stat))
+	}
+	reads, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid read count: %w", err)
+	}
+	writes, err := strconv.ParseUint(fields[4], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid write count: %w", err)
+	}
+	return reads + writes, nil
+}
@@ -0,0 +1,16 @@
+package luks
+
+import "testing"
+
+func TestParseBlockStat(t *testing.T) {
+	count, err := parseBlockStat("    1200        0    96000      310      45        0      360       20        0      400      330        0        0        0        0\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1245 {
+		t.Errorf("expected 1245 I/Os, got %d", count)
+	}
+	if _, err := parseBlockStat("12 0"); err == nil {
+		t.Errorf("expected short statistics to be rejected")
+	}
+}
@@ -0,0 +1,174 @@
+package luks
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// killGrace is how long terminated processes get to exit before they are killed.
+const killGrace = 5 * time.Second
+
+// Process is a process holding files under a mount point.
+type Process struct {
+	PID     int    `json:"pid"`
+	Command string `json:"command"`
+	User    string `json:"user"`
+}
+
+func (p Process) String() string {
+	return fmt.Sprintf("%d (%s, user %s)", p.PID, p.Command, p.User)
+}
+
+// InUseError is returned instead of unmounting a volume that processes still use.
+type InUseError struct {
+	MountPoint string
+	Processes  []Process
+}
+
+func (e *InUseError) Error() string {
+	names := make([]string, len(e.Processes))
+	for i, p := range e.Processes {
+		names[i] = p.String()
+	}
+	return fmt.Sprintf("%s is in use by %s, stop them or pass --kill-users", e.MountPoint, strings.Join(names, ", "))
+}
+
+// ProcessesUsing scans /proc for processes whose working directory, root, executable,
+// open files or memory mappings are under mountPoint.
+func ProcessesUsing(mountPoint string) ([]Process, error) {
+	mountPoint = filepath.Clean(mountPoint)
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list processes: %w", err)
+	}
+
+	var procs []Process
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		if usesPath(pid, mountPoint) {
+			procs = append(procs, describeProcess(pid))
+		}
+	}
+	sort.Slice(procs, func(i, j int) bool { return procs[i].PID < procs[j].PID })
+	return procs, nil
+}
+
+// usesPath reports whether pid references a file under mountPoint.
+func usesPath(pid int, mountPoint string) bool {
+	dir := filepath.Join("/proc", strconv.Itoa(pid))
+	under := func(path string) bool {
+		return path == mountPoint || strings.HasPrefix(path, mountPoint+"/")
+	}
+
+	for _, link := range []string{"cwd", "root", "exe"} {
+		if target, err := os.Readlink(filepath.Join(dir, link)); err == nil && under(target) {
+			return true
+		}
+	}
+	if fds, err := os.ReadDir(filepath.Join(dir, "fd")); err == nil {
+		for _, fd := range fds {
+			if target, err := os.Readlink(filepath.Join(dir, "fd", fd.Name())); err == nil && under(target) {
+				return true
+			}
+		}
+	}
+	if maps, err := os.Open(filepath.Join(dir, "maps")); err == nil {
+		defer maps.Close()
+		scanner := bufio.NewScanner(maps)
+		for scanner.Scan() {
+			// address perms offset dev inode path
+			if fields := strings.Fields(scanner.Text()); len(fields) >= 6 && under(fields[5]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// describeProcess returns the command and user of pid.
+func describeProcess(pid int) Process {
+	p := Process{PID: pid, Command: "unknown", User: "unknown"}
+	dir := filepath.Join("/proc", strconv.Itoa(pid))
+	if comm, err := os.ReadFile(filepath.Join(dir, "comm")); err == nil {
+		p.Command = strings.TrimSpace(string(comm))
+	}
+	if status, err := os.ReadFile(filepath.Join(dir, "status")); err == nil {
+		for _, line := range strings.Split(string(status), "\n") {
+			if fields := strings.Fields(line); len(fields) >= 2 && fields[0] == "Uid:" {
+				p.User = fields[1]
+				if u, err := user.LookupId(fields[1]); err == nil {
+					p.User = u.Username
+				}
+			}
+		}
+	}
+	return p
+}
+
+// checkInUse fails with an InUseError when processes use the mount point, or, with
+// killUsers, terminates them first.
+func checkInUse(mountPoint string, killUsers bool) error {
+	procs, err := ProcessesUsing(mountPoint)
+	if err != nil {
+		log.Printf("Failed to check for processes using %s: %v", mountPoint, err)
+		return nil
+	}
+	if len(procs) == 0 {
+		return nil
+	}
+	if !killUsers {
+		return &InUseError{MountPoint: mountPoint, Processes: procs}
+	}
+	return terminateProcesses(procs)
+}
+
+// terminateProcesses sends SIGTERM to procs and SIGKILL to those still running after
+// killGrace.
+func terminateProcesses(procs []Process) error {
+	for _, p := range procs {
+		fmt.Println("Terminating process", p)
+		if proc, err := os.FindProcess(p.PID); err == nil {
+			proc.Signal(syscall.SIGTERM)
+		}
+	}
+
+	deadline := time.Now().Add(killGrace)
+	for _, p := range procs {
+		for processRunning(p.PID) && time.Now().Before(deadline) {
+			time.Sleep(100 * time.Millisecond)
+		}
+		if processRunning(p.PID) {
+			log.Printf("Process %s ignored SIGTERM, killing it", p)
+			if proc, err := os.FindProcess(p.PID); err == nil {
+				proc.Signal(syscall.SIGKILL)
+			}
+		}
+	}
+	return nil
+}
+
+// processRunning reports whether pid still exists and is not a zombie.
+func processRunning(pid int) bool {
+	stat, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return false
+	}
+	// pid (comm) state ...
+	s := string(stat)
+	if i := strings.LastIndex(s, ")"); i >= 0 && i+2 < len(s) {
+		return s[i+2] != 'Z'
+	}
+	return true
+}
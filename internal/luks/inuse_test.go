@@ -0,0 +1,38 @@
+package luks
+
+import (
+	"errors"
+	"os/exec"
+	"testing"
+)
+
+func TestProcessesUsing(t *testing.T) {
+	dir := t.TempDir()
+	cmd := exec.Command("sleep", "30")
+	cmd.Dir = dir
+	if err := cmd.Start(); err != nil {
+		t.Skipf("cannot start sleep: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	procs, err := ProcessesUsing(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(procs) != 1 || procs[0].PID != cmd.Process.Pid || procs[0].Command != "sleep" {
+		t.Fatalf("ProcessesUsing = %v, want the sleep process", procs)
+	}
+
+	var inUse *InUseError
+	if err := checkInUse(dir, false); !errors.As(err, &inUse) {
+		t.Fatalf("checkInUse = %v, want InUseError", err)
+	}
+	if err := checkInUse(dir, true); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if procs, _ := ProcessesUsing(dir); len(procs) != 0 {
+		t.Errorf("processes still using %s: %v", dir, procs)
+	}
+}
@@ -0,0 +1,57 @@
+package luks
+
+import (
+	"bootstrap/internal/trace"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// KeyfileMode is the mode of keyfiles written by udm, readable by their owner only.
+const KeyfileMode os.FileMode = 0600
+
+// ErrInsecureKeyfile is returned for keyfiles other users can access.
+var ErrInsecureKeyfile = errors.New("keyfile is accessible by other users")
+
+// CheckKeyfileMode rejects a regular keyfile granting group or other users any access.
+// Pipes and devices, such as stdin and /dev/fd/N, are not checked.
+func CheckKeyfileMode(info os.FileInfo) error {
+	if !info.Mode().IsRegular() || info.Mode().Perm()&0077 == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w (mode %04o), restrict it with chmod 600", ErrInsecureKeyfile, info.Mode().Perm())
+}
+
+// CheckKeyfileOwner reports a keyfile not owned by owner, "user" or "user:group".
+func CheckKeyfileOwner(path, owner string) error {
+	if owner == "" {
+		return nil
+	}
+	actual, err := ownerOf(path)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(owner, ":") {
+		actual, _, _ = strings.Cut(actual, ":")
+	}
+	if actual != owner {
+		return fmt.Errorf("keyfile %s is owned by %s, expected %s", path, actual, owner)
+	}
+	return nil
+}
+
+// SecureKeyfile restricts a keyfile to KeyfileMode and, when owner is set, hands it to
+// owner.
+func SecureKeyfile(path, owner string) error {
+	if err := os.Chmod(path, KeyfileMode); err != nil {
+		return fmt.Errorf("failed to restrict keyfile permissions: %w", err)
+	}
+	if owner == "" {
+		return nil
+	}
+	if output, err := trace.Command("chown", owner, path).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to change keyfile owner: %s", strings.TrimSpace(string(output)))
+	}
+	return nil
+}
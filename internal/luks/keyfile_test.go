@@ -0,0 +1,35 @@
+package luks
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckKeyfileMode(t *testing.T) {
+	keyfile := filepath.Join(t.TempDir(), "key.bin")
+	if err := os.WriteFile(keyfile, []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(keyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckKeyfileMode(info); !errors.Is(err, ErrInsecureKeyfile) {
+		t.Fatalf("CheckKeyfileMode() of mode 0644 error = %v, want ErrInsecureKeyfile", err)
+	}
+
+	if err := SecureKeyfile(keyfile, ""); err != nil {
+		t.Fatalf("SecureKeyfile() error = %v, want nil", err)
+	}
+	if info, err = os.Stat(keyfile); err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != KeyfileMode {
+		t.Fatalf("SecureKeyfile() left mode %04o, want %04o", info.Mode().Perm(), KeyfileMode)
+	}
+	if err := CheckKeyfileMode(info); err != nil {
+		t.Fatalf("CheckKeyfileMode() of mode 0600 error = %v, want nil", err)
+	}
+}
@@ -0,0 +1,126 @@
+package luks
+
+import (
+	"bootstrap/internal/secrets"
+	"bootstrap/internal/trace"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kernel keyrings luks.keyCache can hold the key in.
+const (
+	KeyringUser    = "user"    // Keyring of the user, shared by all of its processes
+	KeyringSession = "session" // Session keyring, gone when the session ends
+)
+
+// DefaultKeyCacheTimeout is how long a cached key stays in the keyring.
+const DefaultKeyCacheTimeout = "5m"
+
+// KeyCache keeps the key retrieved from the TPM or Vault in a kernel keyring for a
+// while, so mounts within the window neither hit the TPM nor the network again. The key
+// only lives in kernel memory and expires with the timeout.
+type KeyCache struct {
+	Keyring string `yaml:"keyring"` // user or session, disabled when empty
+	Timeout string `yaml:"timeout"` // Lifetime of the cached key, e.g. "5m"
+}
+
+// Enabled reports whether retrieved keys are cached.
+func (k KeyCache) Enabled() bool {
+	return k.Keyring != ""
+}
+
+// Validate checks the keyring and fills in the default timeout.
+func (k *KeyCache) Validate() error {
+	if !k.Enabled() {
+		if k.Timeout != "" {
+			return fmt.Errorf("luks.keyCache requires keyring")
+		}
+		return nil
+	}
+	if k.Keyring != KeyringUser && k.Keyring != KeyringSession {
+		return fmt.Errorf("luks.keyCache.keyring (%s) must be %s or %s", k.Keyring, KeyringUser, KeyringSession)
+	}
+	if k.Timeout == "" {
+		k.Timeout = DefaultKeyCacheTimeout
+	}
+	if timeout, err := time.ParseDuration(k.Timeout); err != nil || timeout < time.Second {
+		return fmt.Errorf("luks.keyCache.timeout (%s) must be a duration of at least 1s", k.Timeout)
+	}
+	return nil
+}
+
+// keyring returns the keyctl name of the keyring.
+func (k KeyCache) keyring() string {
+	if k.Keyring == KeyringSession {
+		return "@s"
+	}
+	return "@u"
+}
+
+// keyDescription names the cached key of the volume in the keyring.
+func keyDescription(cfg *LUKS) string {
+	return "udm:" + cfg.MapperName
+}
+
+// cachedKey returns the key cached for the volume, nil when there is none.
+func cachedKey(cfg *LUKS) []byte {
+	if !cfg.KeyCache.Enabled() {
+		return nil
+	}
+	output, err := trace.Command("keyctl", "search", cfg.KeyCache.keyring(), "user", keyDescription(cfg)).Output()
+	if err != nil {
+		return nil
+	}
+	output, err = trace.Command("keyctl", "pipe", strings.TrimSpace(string(output))).Output()
+	defer secrets.Wipe(output)
+	if err != nil || len(output) == 0 {
+		return nil
+	}
+	buf, err := secrets.New(len(output))
+	if err != nil {
+		return nil
+	}
+	copy(buf.Bytes(), output)
+	return buf.Bytes()
+}
+
+// cacheKey adds the key to the keyring with the timeout, replacing a cached one.
+// Failing to cache only costs the next mount a retrieval, so errors are logged.
+func cacheKey(cfg *LUKS, password []byte) {
+	if !cfg.KeyCache.Enabled() {
+		return
+	}
+	cmd := trace.Command("keyctl", "padd", "user", keyDescription(cfg), cfg.KeyCache.keyring())
+	cmd.Stdin = createPasswordInput(password, false)
+	output, err := cmd.Output()
+	if err != nil {
+		log.Printf("Failed to cache key in the kernel keyring: %v", err)
+		return
+	}
+	id := strings.TrimSpace(string(output))
+	timeout, _ := time.ParseDuration(cfg.KeyCache.Timeout) // Validated when the configuration was loaded
+	if output, err := trace.Command("keyctl", "timeout", id, strconv.Itoa(int(timeout.Seconds()))).CombinedOutput(); err != nil {
+		// A key without expiry would outlive the window, drop it
+		log.Printf("Failed to set the timeout of the cached key: %s", strings.TrimSpace(string(output)))
+		trace.Command("keyctl", "revoke", id).Run()
+	}
+}
+
+// ForgetCachedKey revokes the cached key of the volume, e.g. when it is removed.
+func ForgetCachedKey(cfg *LUKS) error {
+	if !cfg.KeyCache.Enabled() {
+		return nil
+	}
+	output, err := trace.Command("keyctl", "search", cfg.KeyCache.keyring(), "user", keyDescription(cfg)).Output()
+	if err != nil {
+		return nil // Not cached
+	}
+	id := strings.TrimSpace(string(output))
+	if output, err := trace.Command("keyctl", "revoke", id).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to revoke cached key: %s", strings.TrimSpace(string(output)))
+	}
+	return nil
+}
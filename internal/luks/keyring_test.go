@@ -0,0 +1,34 @@
+package luks
+
+import "testing"
+
+func TestKeyCacheValidate(t *testing.T) {
+	k := KeyCache{Keyring: KeyringSession}
+	if err := k.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+	if k.Timeout != DefaultKeyCacheTimeout || k.keyring() != "@s" {
+		t.Fatalf("Validate() = %+v, want the default timeout on the session keyring", k)
+	}
+
+	for _, k := range []KeyCache{
+		{Keyring: "process"},
+		{Keyring: KeyringUser, Timeout: "500ms"},
+		{Keyring: KeyringUser, Timeout: "soon"},
+		{Timeout: "5m"},
+	} {
+		if err := k.Validate(); err == nil {
+			t.Errorf("Validate(%+v) error = nil, want error", k)
+		}
+	}
+}
+
+func TestCachedKeyDisabled(t *testing.T) {
+	cfg := &LUKS{MapperName: "udm-luks"}
+	if key := cachedKey(cfg); key != nil {
+		t.Fatalf("cachedKey() = %q without luks.keyCache, want nil", key)
+	}
+	if err := ForgetCachedKey(cfg); err != nil {
+		t.Fatalf("ForgetCachedKey() error = %v without luks.keyCache", err)
+	}
+}
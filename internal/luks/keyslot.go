@@ -0,0 +1,163 @@
+package luks
+
+import (
+	"bootstrap/internal/trace"
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Keyslot describes a used keyslot in the LUKS header.
+type Keyslot struct {
+	Slot   int      `json:"slot"`
+	Type   string   `json:"type"`
+	Tokens []string `json:"tokens,omitempty"`
+}
+
+var (
+	dumpSectionEntry = regexp.MustCompile(`^  (\d+): (\S+)`)
+	dumpTokenKeyslot = regexp.MustCompile(`^\s+Keyslot:\s+(\d+)`)
+	dumpLUKS1Slot    = regexp.MustCompile(`^Key Slot (\d+): ENABLED`)
+)
+
+// ListKeyslots returns the used keyslots of the volume and the tokens bound to them.
+func ListKeyslots(ctx context.Context, cfg *LUKS) ([]Keyslot, error) {
+	output, err := runRetried(ctx, OpCryptsetup, func() *trace.Cmd { return trace.Command("cryptsetup", "luksDump", cfg.VolumePath) })
+	if err != nil {
+		return nil, fmt.Errorf("failed to dump LUKS header: %s", output)
+	}
+	return parseKeyslots(string(output)), nil
+}
+
+// parseKeyslots extracts keyslots and their tokens from luksDump output (LUKS1 or LUKS2).
+func parseKeyslots(dump string) []Keyslot {
+	var slots []Keyslot
+	index := make(map[int]int)
+	section := ""
+	token := ""
+
+	scanner := bufio.NewScanner(strings.NewReader(dump))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line != "" && !unicode.IsSpace(rune(line[0])) {
+			section = strings.TrimSuffix(strings.TrimSpace(line), ":")
+		}
+
+		if m := dumpLUKS1Slot.FindStringSubmatch(line); m != nil {
+			slot, _ := strconv.Atoi(m[1])
+			index[slot] = len(slots)
+			slots = append(slots, Keyslot{Slot: slot, Type: "luks1"})
+			continue
+		}
+
+		switch section {
+		case "Keyslots":
+			if m := dumpSectionEntry.FindStringSubmatch(line); m != nil {
+				slot, _ := strconv.Atoi(m[1])
+				index[slot] = len(slots)
+				slots = append(slots, Keyslot{Slot: slot, Type: m[2]})
+			}
+		case "Tokens":
+			if m := dumpSectionEntry.FindStringSubmatch(line); m != nil {
+				token = m[2]
+			} else if m := dumpTokenKeyslot.FindStringSubmatch(line); m != nil && token != "" {
+				slot, _ := strconv.Atoi(m[1])
+				if i, ok := index[slot]; ok {
+					slots[i].Tokens = append(slots[i].Tokens, token)
+				}
+			}
+		}
+	}
+	return slots
+}
+
+// AddKeyslot enrolls newKey in the given keyslot (or the first free one when slot is
+// negative), authorizing with the machine key.
+func AddKeyslot(ctx context.Context, cfg *LUKS, newKey []byte, slot int) error {
+	if err := resolveKey(ctx, cfg); err != nil {
+		return err
+	}
+
+	return withTempKeyFile(cfg.Password, func(existing string) error {
+		return withTempKeyFile(newKey, func(added string) error {
+			args := append([]string{"luksAddKey", "--key-file=" + existing}, cfg.pbkdfArgs()...)
+			if slot >= 0 {
+				args = append(args, fmt.Sprintf("--key-slot=%d", slot))
+			}
+			args = append(args, cfg.VolumePath, added)
+
+			if output, err := runRetried(ctx, OpCryptsetup, func() *trace.Cmd { return trace.Command("cryptsetup", args...) }); err != nil {
+				return fmt.Errorf("failed to add key: %s", output)
+			}
+			return nil
+		})
+	})
+}
+
+// RemoveKeyslot wipes a keyslot, authorizing with the machine key. The slot holding the
+// machine key itself cannot be removed this way, which would lock us out.
+func RemoveKeyslot(ctx context.Context, cfg *LUKS, slot int) error {
+	if err := resolveKey(ctx, cfg); err != nil {
+		return err
+	}
+
+	slots, err := ListKeyslots(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	if len(slots) <= 1 {
+		return fmt.Errorf("refusing to remove the last keyslot")
+	}
+
+	return withTempKeyFile(cfg.Password, func(existing string) error {
+		// Only a slot rejecting the machine key may go, a test killed on timeout proves nothing
+		output, err := runRetried(ctx, OpCryptsetup, func() *trace.Cmd {
+			return trace.Command("cryptsetup", "open", "--test-passphrase",
+				fmt.Sprintf("--key-slot=%d", slot), "--key-file="+existing, cfg.VolumePath)
+		})
+		if err == nil {
+			return fmt.Errorf("keyslot %d holds the machine key, refusing to remove it", slot)
+		}
+		if !isWrongKey(err) {
+			return fmt.Errorf("failed to test keyslot %d: %s", slot, output)
+		}
+
+		output, err = runRetried(ctx, OpCryptsetup, func() *trace.Cmd {
+			return trace.Command("cryptsetup", "luksKillSlot", "--key-file="+existing, cfg.VolumePath, strconv.Itoa(slot))
+		})
+		if err != nil {
+			return fmt.Errorf("failed to remove keyslot %d: %s", slot, output)
+		}
+		return nil
+	})
+}
+
+// CheckKeyMaterial applies the passphrase policy to printable keys and the key policy
+// to binary ones.
+func CheckKeyMaterial(key []byte) error {
+	return currentPasswordPolicy().Check(key)
+}
+
+// withTempKeyFile writes key to a private temporary file for the duration of fn, for
+// cryptsetup commands that only take keys from files.
+func withTempKeyFile(key []byte, fn func(path string) error) error {
+	tmpFile, err := os.CreateTemp("", "luks-password-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(key); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to write password to temporary file: %w", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("failed to close temporary file: %w", err)
+	}
+	return fn(tmpFile.Name())
+}
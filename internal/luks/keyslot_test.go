@@ -0,0 +1,59 @@
+package luks
+
+import (
+	"reflect"
+	"testing"
+)
+
+const luks2Dump = `LUKS header information
+Version:       	2
+Epoch:         	5
+UUID:          	0b7a2a2e-6a3e-4f6b-8a53-2b3b1f2f9c11
+
+Data segments:
+  0: crypt
+	offset: 16777216 [bytes]
+	cipher: aes-xts-plain64
+
+Keyslots:
+  0: luks2
+	Key:        512 bits
+	Priority:   normal
+  1: luks2
+	Key:        512 bits
+	Priority:   normal
+Tokens:
+  0: udm-tpm2-nv
+	Keyslot:    0
+  1: systemd-tpm2
+	Keyslot:    1
+Digests:
+  0: pbkdf2
+`
+
+const luks1Dump = `LUKS header information for test.img
+
+Version:       	1
+Cipher name:   	aes
+Key Slot 0: ENABLED
+	Iterations:         	1000
+Key Slot 1: DISABLED
+Key Slot 2: ENABLED
+`
+
+func TestParseKeyslots(t *testing.T) {
+	got := parseKeyslots(luks2Dump)
+	want := []Keyslot{
+		{Slot: 0, Type: "luks2", Tokens: []string{"udm-tpm2-nv"}},
+		{Slot: 1, Type: "luks2", Tokens: []string{"systemd-tpm2"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("parseKeyslots(luks2) = %+v, want %+v", got, want)
+	}
+
+	got = parseKeyslots(luks1Dump)
+	want = []Keyslot{{Slot: 0, Type: "luks1"}, {Slot: 2, Type: "luks1"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("parseKeyslots(luks1) = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,112 @@
+package luks
+
+import (
+	"bootstrap/internal/secrets"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// Sources of generated keys, luks.keySource.
+const (
+	KeySourceMixed   = "mixed"   // TPM and OS random bytes XORed, OS only without a TPM
+	KeySourceTPMOnly = "tpmOnly" // TPM random bytes, refusing to generate without a TPM
+	KeySourceOSOnly  = "osOnly"  // crypto/rand, the TPM RNG is never used
+)
+
+var (
+	keySourceMu sync.Mutex
+	keySource   = KeySourceMixed
+)
+
+// ValidKeySource reports whether source is a supported luks.keySource.
+func ValidKeySource(source string) bool {
+	switch source {
+	case KeySourceMixed, KeySourceTPMOnly, KeySourceOSOnly:
+		return true
+	}
+	return false
+}
+
+// SetKeySource installs the source of the keys generated by GenerateLUKSKey.
+func SetKeySource(source string) {
+	keySourceMu.Lock()
+	defer keySourceMu.Unlock()
+	keySource = source
+}
+
+func currentKeySource() string {
+	keySourceMu.Lock()
+	defer keySourceMu.Unlock()
+	return keySource
+}
+
+// randomKey returns length random bytes in locked memory from the configured source.
+// In mixed mode the output is as strong as the better of both RNGs, so a weak or
+// backdoored TPM RNG cannot weaken the key on its own.
+func randomKey(ctx context.Context, length int) ([]byte, error) {
+	if length < MinKeyBytes {
+		return nil, fmt.Errorf("key length (%d bytes) is below the minimum of %d bytes, set luks.keyBytes to at least %d", length, MinKeyBytes, MinKeyBytes)
+	}
+	source := currentKeySource()
+
+	buf, err := secrets.New(length)
+	if err != nil {
+		return nil, err
+	}
+	key := buf.Bytes()
+	if source != KeySourceTPMOnly {
+		if _, err := rand.Read(key); err != nil {
+			buf.Destroy()
+			return nil, fmt.Errorf("failed to generate random key using crypto/rand: %w", err)
+		}
+		if source == KeySourceOSOnly {
+			return key, nil
+		}
+	}
+
+	tpmBytes, err := tpmRandom(ctx, length)
+	if err != nil {
+		if source == KeySourceTPMOnly {
+			buf.Destroy()
+			return nil, fmt.Errorf("luks.keySource is %s: %w", KeySourceTPMOnly, err)
+		}
+		log.Printf("No TPM random bytes to mix into the key, using crypto/rand only: %v", err)
+		return key, nil
+	}
+	defer secrets.Wipe(tpmBytes)
+	mixKey(key, tpmBytes)
+	return key, nil
+}
+
+// tpmRandom returns length random bytes of the TPM RNG.
+func tpmRandom(ctx context.Context, length int) ([]byte, error) {
+	if tpm1Selected() {
+		return nil, fmt.Errorf("the RNG of a TPM 1.2 is not used")
+	}
+	present, err := checkTPM2Availability(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !present {
+		return nil, fmt.Errorf("TPM 2.0 not available at %s", TPMDevice())
+	}
+	random, err := getRandomBytesFromTPM2(ctx, length)
+	if err != nil {
+		return nil, err
+	}
+	if len(random) != length {
+		secrets.Wipe(random)
+		return nil, fmt.Errorf("tpm2_getrandom returned %d bytes, expected %d", len(random), length)
+	}
+	return random, nil
+}
+
+// mixKey XORs src into key.
+func mixKey(key, src []byte) {
+	for i := range key {
+		key[i] ^= src[i]
+	}
+}
@@ -0,0 +1,36 @@
+package luks
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMixKey(t *testing.T) {
+	key := []byte{0x00, 0xff, 0x0f}
+	mixKey(key, []byte{0xff, 0xff, 0xf0})
+	if want := []byte{0xff, 0x00, 0xff}; !bytes.Equal(key, want) {
+		t.Errorf("mixKey() = %x, want %x", key, want)
+	}
+}
+
+func TestRandomKeySource(t *testing.T) {
+	defer os.Setenv(tctiEnv, os.Getenv(tctiEnv))
+	defer SetTPM(TPM{Device: TPMDevice()})
+	defer SetKeySource(KeySourceMixed)
+	SetTPM(TPM{Device: filepath.Join(t.TempDir(), "tpm0")})
+
+	SetKeySource(KeySourceTPMOnly)
+	if _, err := randomKey(context.Background(), MinKeyBytes); err == nil {
+		t.Error("randomKey() in tpmOnly mode succeeded without a TPM")
+	}
+	for _, source := range []string{KeySourceMixed, KeySourceOSOnly} {
+		SetKeySource(source)
+		key, err := randomKey(context.Background(), MinKeyBytes)
+		if err != nil || len(key) != MinKeyBytes {
+			t.Errorf("randomKey() in %s mode = %d bytes, %v, want %d bytes", source, len(key), err, MinKeyBytes)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package luks
+
+import (
+	"bootstrap/internal/trace"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	KeyfileWrapNone       = "none"       // Keyfile holds the raw key
+	KeyfileWrapPassphrase = "passphrase" // Keyfile is wrapped with an argon2id-derived key
+	KeyfileWrapTPM        = "tpm"        // Keyfile is wrapped with a TPM-resident key
+
+	WrapNVIndex = "0x1500030" // NV index holding the TPM-resident wrapping key
+)
+
+// Argon2id cost parameters for passphrase wrapping, recorded in every wrapped keyfile.
+const (
+	argon2Time        = 3
+	argon2MemoryLog2  = 16 // 2^16 KiB = 64 MiB
+	argon2Parallelism = 4
+)
+
+const (
+	wrapModePassphrase byte = 1
+	wrapModeTPM        byte = 2
+
+	wrapKeySize  = 32
+	wrapSaltSize = 16
+)
+
+// wrappedKeyMagic prefixes a wrapped keyfile:
+// magic | mode | time | memoryLog2 | parallelism | salt | nonce | ciphertext
+var wrappedKeyMagic = []byte("UDMWRAP1")
+
+// IsWrappedKey reports whether keyfile contents were produced by WrapKey.
+func IsWrappedKey(data []byte) bool {
+	return bytes.HasPrefix(data, wrappedKeyMagic)
+}
+
+// WrapKey encrypts key with AES-256-GCM for storage in a keyfile, using either a key
+// derived from passphrase or the TPM-resident wrapping key, whose NV index auth protects.
+func WrapKey(ctx context.Context, mode string, key, passphrase []byte, auth NVAuth) ([]byte, error) {
+	header := append([]byte{}, wrappedKeyMagic...)
+	salt := make([]byte, wrapSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	var wrapKey []byte
+	var err error
+	switch mode {
+	case KeyfileWrapPassphrase:
+		header = append(header, wrapModePassphrase, argon2Time, argon2MemoryLog2, argon2Parallelism)
+		wrapKey, err = deriveArgon2id(passphrase, salt, argon2Time, argon2MemoryLog2, argon2Parallelism)
+	case KeyfileWrapTPM:
+		header = append(header, wrapModeTPM, 0, 0, 0)
+		wrapKey, err = tpmWrappingKey(ctx, true, auth)
+	default:
+		return nil, fmt.Errorf("unknown keyfile wrap mode %q", mode)
+	}
+	if err != nil {
+		return nil, err
+	}
+	header = append(header, salt...)
+
+	aead, err := newWrapAEAD(wrapKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	out := append(append([]byte{}, header...), nonce...)
+	return aead.Seal(out, nonce, key, header), nil
+}
+
+// UnwrapKey decrypts a keyfile produced by WrapKey. passphrase is only called when the
+// keyfile was wrapped with a passphrase.
+func UnwrapKey(ctx context.Context, data []byte, passphrase func() ([]byte, error), auth NVAuth) ([]byte, error) {
+	headerLen := len(wrappedKeyMagic) + 4 + wrapSaltSize
+	if !IsWrappedKey(data) || len(data) < headerLen {
+		return nil, fmt.Errorf("keyfile is not a wrapped key")
+	}
+	header := data[:headerLen]
+	params := header[len(wrappedKeyMagic):]
+	salt := header[len(wrappedKeyMagic)+4:]
+
+	var wrapKey []byte
+	var err error
+	switch params[0] {
+	case wrapModePassphrase:
+		pass, perr := passphrase()
+		if perr != nil {
+			return nil, perr
+		}
+		wrapKey, err = deriveArgon2id(pass, salt, params[1], params[2], params[3])
+	case wrapModeTPM:
+		wrapKey, err = tpmWrappingKey(ctx, false, auth)
+	default:
+		return nil, fmt.Errorf("unknown keyfile wrap mode %d", params[0])
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newWrapAEAD(wrapKey)
+	if err != nil {
+		return nil, err
+	}
+	rest := data[headerLen:]
+	if len(rest) < aead.NonceSize() {
+		return nil, fmt.Errorf("wrapped keyfile is truncated")
+	}
+	key, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap keyfile, wrong passphrase or wrapping key: %w", err)
+	}
+	return key, nil
+}
+
+func newWrapAEAD(wrapKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(wrapKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// deriveArgon2id derives the wrapping key from a passphrase with the argon2 CLI.
+func deriveArgon2id(passphrase, salt []byte, time, memoryLog2, parallelism byte) ([]byte, error) {
+	cmd := trace.Command("argon2", hex.EncodeToString(salt), "-id",
+		"-t", strconv.Itoa(int(time)),
+		"-m", strconv.Itoa(int(memoryLog2)),
+		"-p", strconv.Itoa(int(parallelism)),
+		"-l", strconv.Itoa(wrapKeySize),
+		"-r")
+	cmd.Stdin = bytes.NewReader(passphrase)
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("argon2 key derivation failed: %w", err)
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(output)))
+	if err != nil || len(key) != wrapKeySize {
+		return nil, fmt.Errorf("unexpected argon2 output")
+	}
+	return key, nil
+}
+
+// tpmWrappingKey returns the TPM-resident wrapping key, creating it first if requested
+// and the NV index is not defined yet.
+func tpmWrappingKey(ctx context.Context, create bool, auth NVAuth) ([]byte, error) {
+	key, err := retrievePasswordFromTPM(ctx, WrapNVIndex, wrapKeySize, auth)
+	if err == nil {
+		return key, nil
+	}
+	if !create {
+		return nil, fmt.Errorf("failed to retrieve wrapping key from TPM: %w", err)
+	}
+
+	key = make([]byte, wrapKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate wrapping key: %w", err)
+	}
+	if err := storePasswordInTPM(ctx, key, WrapNVIndex, auth); err != nil {
+		return nil, fmt.Errorf("failed to store wrapping key in TPM: %w", err)
+	}
+	return key, nil
+}
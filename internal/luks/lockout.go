@@ -0,0 +1,86 @@
+package luks
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Default delays of luks.lockout.
+const (
+	DefaultLockoutBackoff    = "1s"
+	DefaultLockoutMaxBackoff = "5m"
+)
+
+// ErrLockedOut is returned once the failed unlock attempts reached luks.lockout.maxFailures.
+var ErrLockedOut = errors.New("volume locked out after repeated failed unlock attempts, run udm recover or udm reset-lockout")
+
+// Lockout slows down guessing keys on a stolen device: each consecutive failed unlock
+// doubles the delay before mount tries again, and after maxFailures mount refuses until
+// the volume is recovered or an administrator resets the counter. The counter is kept in
+// the state directory, so it only holds against attackers without root.
+type Lockout struct {
+	MaxFailures int    `yaml:"maxFailures"` // Failures after which mount refuses, 0 disables lockout
+	Backoff     string `yaml:"backoff"`     // Delay after the first failure, doubled by each further one, e.g. "1s"
+	MaxBackoff  string `yaml:"maxBackoff"`  // Upper bound of the delay, e.g. "5m"
+}
+
+// Enabled reports whether failed unlocks are rate limited.
+func (l Lockout) Enabled() bool {
+	return l.MaxFailures > 0
+}
+
+// Validate checks the policy and fills in the default delays.
+func (l *Lockout) Validate() error {
+	if l.MaxFailures < 0 {
+		return fmt.Errorf("luks.lockout.maxFailures (%d) cannot be negative", l.MaxFailures)
+	}
+	if !l.Enabled() {
+		if l.Backoff != "" || l.MaxBackoff != "" {
+			return fmt.Errorf("luks.lockout requires maxFailures")
+		}
+		return nil
+	}
+	if l.Backoff == "" {
+		l.Backoff = DefaultLockoutBackoff
+	}
+	if l.MaxBackoff == "" {
+		l.MaxBackoff = DefaultLockoutMaxBackoff
+	}
+	backoff, err := time.ParseDuration(l.Backoff)
+	if err != nil || backoff <= 0 {
+		return fmt.Errorf("luks.lockout.backoff (%s) must be a positive duration, e.g. 1s", l.Backoff)
+	}
+	maxBackoff, err := time.ParseDuration(l.MaxBackoff)
+	if err != nil || maxBackoff < backoff {
+		return fmt.Errorf("luks.lockout.maxBackoff (%s) must be a duration of at least the backoff", l.MaxBackoff)
+	}
+	return nil
+}
+
+// delay returns how long mount waits after the given number of consecutive failures.
+func (l Lockout) delay(failures int) time.Duration {
+	backoff, _ := time.ParseDuration(l.Backoff)
+	maxBackoff, _ := time.ParseDuration(l.MaxBackoff)
+	delay := backoff
+	for i := 1; i < failures && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxBackoff)
+}
+
+// CheckLockout returns an error if an unlock may not be attempted at now, after failures
+// consecutive failed unlocks, the last one at lastFailure.
+func (l Lockout) CheckLockout(failures int, lastFailure, now time.Time) error {
+	if !l.Enabled() || failures == 0 {
+		return nil
+	}
+	if failures >= l.MaxFailures {
+		return ErrLockedOut
+	}
+	if wait := lastFailure.Add(l.delay(failures)).Sub(now); wait > 0 {
+		return fmt.Errorf("%d failed unlock attempts, retry in %s (%d left before lockout)",
+			failures, wait.Round(100*time.Millisecond), l.MaxFailures-failures)
+	}
+	return nil
+}
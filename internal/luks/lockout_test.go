@@ -0,0 +1,51 @@
+package luks
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCheckLockout(t *testing.T) {
+	l := Lockout{MaxFailures: 5}
+	if err := l.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	tests := []struct {
+		failures    int
+		lastFailure time.Time
+		wantErr     bool
+	}{
+		{0, time.Time{}, false},
+		{1, now.Add(-500 * time.Millisecond), true},
+		{1, now.Add(-2 * time.Second), false},
+		{3, now.Add(-3 * time.Second), true}, // 4s after the third failure
+		{3, now.Add(-5 * time.Second), false},
+	}
+	for _, tt := range tests {
+		if err := l.CheckLockout(tt.failures, tt.lastFailure, now); (err != nil) != tt.wantErr {
+			t.Errorf("CheckLockout(%d, %s ago) = %v, wantErr %v", tt.failures, now.Sub(tt.lastFailure), err, tt.wantErr)
+		}
+	}
+	if err := l.CheckLockout(5, now.Add(-time.Hour), now); !errors.Is(err, ErrLockedOut) {
+		t.Errorf("expected lockout after maxFailures, got %v", err)
+	}
+	if err := (Lockout{}).CheckLockout(100, now, now); err != nil {
+		t.Errorf("a disabled lockout must not refuse, got %v", err)
+	}
+}
+
+func TestLockoutDelay(t *testing.T) {
+	l := Lockout{MaxFailures: 100, Backoff: "1s", MaxBackoff: "1m"}
+	if got := l.delay(3); got != 4*time.Second {
+		t.Errorf("delay(3) = %s, want 4s", got)
+	}
+	if got := l.delay(50); got != time.Minute {
+		t.Errorf("delay(50) = %s, want 1m", got)
+	}
+	l.MaxBackoff = "500ms"
+	if err := l.Validate(); err == nil {
+		t.Errorf("expected a maxBackoff below the backoff to be rejected")
+	}
+}
@@ -0,0 +1,97 @@
+package luks
+
+import (
+	"bootstrap/internal/trace"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// openDevice runs open with the block device of imagePath. Image files are attached to
+// a loop device explicitly rather than relying on cryptsetup's automatic loop setup,
+// which older versions do not reliably clean up. The loop device stays attached when
+// open succeeds, it is detached by CloseLUKSVolume.
+func openDevice(ctx context.Context, imagePath string, open func(device string) error) error {
+	info, err := os.Stat(imagePath)
+	if err != nil || !info.Mode().IsRegular() {
+		return open(imagePath)
+	}
+
+	device, err := attachLoop(ctx, imagePath)
+	if err != nil {
+		return err
+	}
+	if err := open(device); err != nil {
+		if err := detachLoop(ctx, device); err != nil {
+			log.Printf("Failed to detach %s: %v", device, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// attachLoop returns a loop device backed by imagePath, reusing a stale one left
+// attached to the image.
+func attachLoop(ctx context.Context, imagePath string) (string, error) {
+	if devices, err := LoopDevices(imagePath); err == nil {
+		for _, device := range devices {
+			if !loopInUse(device) {
+				return device, nil
+			}
+		}
+	}
+	output, err := runRetried(ctx, OpCryptsetup, func() *trace.Cmd { return trace.Command("losetup", "--find", "--show", imagePath) })
+	if err != nil {
+		return "", fmt.Errorf("failed to attach loop device: %s", strings.TrimSpace(string(output)))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// detachLoop detaches a loop device, ignoring devices already released.
+func detachLoop(ctx context.Context, device string) error {
+	output, err := runRetried(ctx, OpCryptsetup, func() *trace.Cmd { return trace.Command("losetup", "--detach", device) })
+	if err != nil && !strings.Contains(string(output), "No such device") {
+		return fmt.Errorf("losetup --detach failed: %s", strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// LoopDevices returns the loop devices backed by imagePath.
+func LoopDevices(imagePath string) ([]string, error) {
+	output, err := trace.Command("losetup", "--associated", imagePath).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list loop devices: %w", err)
+	}
+	var devices []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if device, _, ok := strings.Cut(line, ":"); ok {
+			devices = append(devices, device)
+		}
+	}
+	return devices, nil
+}
+
+// loopInUse reports whether a device-mapper target sits on the loop device.
+func loopInUse(device string) bool {
+	holders, err := os.ReadDir("/sys/block/" + strings.TrimPrefix(device, "/dev/") + "/holders")
+	return err != nil || len(holders) > 0
+}
+
+// backingLoop returns the loop device under an open mapping, or "" when the mapping
+// does not sit on a loop device.
+func backingLoop(mapperName string) string {
+	output, err := trace.Command("cryptsetup", "status", mapperName).Output()
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		if key, value, ok := strings.Cut(strings.TrimSpace(line), ":"); ok && key == "device" {
+			if device := strings.TrimSpace(value); strings.HasPrefix(device, "/dev/loop") {
+				return device
+			}
+		}
+	}
+	return ""
+}
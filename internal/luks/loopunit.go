@@ -0,0 +1,105 @@
+package luks
+
+import (
+	"bootstrap/internal/features"
+	"bootstrap/internal/trace"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// loopDropIn is the name of the cryptsetup unit drop-in pulling in the loop unit.
+const loopDropIn = "udm-loop.conf"
+
+// isImageFile reports whether the volume is an image file rather than a block device.
+func isImageFile(cfg *LUKS) bool {
+	info, err := os.Stat(cfg.VolumePath)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// crypttabSource returns the source device field of the crypttab entry. Volumes are
+// referenced by their LUKS UUID, which survives renumbered disks and reattached loop
+// devices. Image files without the loop unit fall back to the path, which
+// systemd-cryptsetup attaches to a loop device itself.
+func crypttabSource(cfg *LUKS, uuid string) string {
+	if uuid == "" || isImageFile(cfg) && !cfg.Features.Enabled(features.SystemdUnits) {
+		return cfg.VolumePath
+	}
+	return "UUID=" + uuid
+}
+
+// loopUnitName returns the name of the unit attaching the image of the mapper.
+func loopUnitName(mapperName string) (string, error) {
+	output, err := trace.Command("systemd-escape", mapperName).Output()
+	if err != nil {
+		return "", fmt.Errorf("systemd-escape failed: %w", err)
+	}
+	return fmt.Sprintf("udm-loop-%s.service", strings.TrimSpace(string(output))), nil
+}
+
+// loopUnitContent returns the unit attaching the image to a loop device before the
+// cryptsetup unit waits for its UUID. --nooverlap reuses a loop device already backed
+// by the image, e.g. one left by udm open.
+func loopUnitContent(cfg *LUKS) string {
+	return fmt.Sprintf(`[Unit]
+Description=Loop device of udm volume %s
+DefaultDependencies=no
+RequiresMountsFor=%s
+Conflicts=umount.target
+Before=umount.target cryptsetup.target
+
+[Service]
+Type=oneshot
+RemainAfterExit=yes
+ExecStart=/sbin/losetup --find --nooverlap %s
+`, cfg.MapperName, filepath.Dir(cfg.VolumePath), cfg.VolumePath)
+}
+
+// loopDropInContent returns the cryptsetup unit drop-in requiring the loop unit.
+func loopDropInContent(unit string) string {
+	return fmt.Sprintf("[Unit]\nWants=%s\nAfter=%s\n", unit, unit)
+}
+
+// installLoopUnit installs the loop unit of an image file and makes the cryptsetup unit
+// of the mapper pull it in.
+func installLoopUnit(cfg *LUKS) error {
+	unit, err := loopUnitName(cfg.MapperName)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join("/etc/systemd/system", unit), []byte(loopUnitContent(cfg)), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", unit, err)
+	}
+	dir, err := cryptsetupDropInDir(cfg.MapperName)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create drop-in directory: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, loopDropIn), []byte(loopDropInContent(unit)), 0644); err != nil {
+		return fmt.Errorf("failed to write drop-in: %w", err)
+	}
+	return reloadSystemd()
+}
+
+// removeLoopUnit removes the unit and drop-in installed by installLoopUnit.
+func removeLoopUnit(cfg *LUKS) error {
+	unit, err := loopUnitName(cfg.MapperName)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join("/etc/systemd/system", unit)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove %s: %w", unit, err)
+	}
+	dir, err := cryptsetupDropInDir(cfg.MapperName)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(dir, loopDropIn)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove drop-in: %w", err)
+	}
+	os.Remove(dir) // only succeeds when no other drop-ins remain
+	return reloadSystemd()
+}
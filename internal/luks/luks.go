@@ -1,228 +1,619 @@
 package luks
 
 import (
-	"bufio"
+	"bootstrap/internal/features"
+	"bootstrap/internal/secrets"
+	"bootstrap/internal/trace"
+	"bootstrap/internal/vault"
 	"bytes"
-	"crypto/rand"
+	"context"
 	"encoding/hex"
-	"errors"
 	"fmt"
+	"hash/fnv"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 )
 
 type LUKS struct {
 	VolumePath     string `yaml:"volumePath"`
 	MapperName     string `yaml:"mapperName"`
 	MountPoint     string `yaml:"mountPoint"`
-	PasswordLength int    `yaml:"passwordLength"`
+	PasswordLength int    `yaml:"passwordLength"` // Deprecated: use KeyBytes
+	KeyBytes       int    `yaml:"keyBytes"`       // Length of the generated key in bytes
+	KeySource      string `yaml:"keySource"`      // RNG of generated keys: mixed, tpmOnly or osOnly
 	Size           int    `yaml:"size"`
 	UseTPM         bool   `yaml:"useTPM"`
 	User           string `yaml:"user"`
 	Group          string `yaml:"group"`
-	Password       []byte `yaml:"-"`
+
+	// Entropy policy for generated and imported key material
+	MinKeyEntropy        int    `yaml:"minKeyEntropy"`        // Minimum estimated key entropy in bits
+	MinPassphraseEntropy int    `yaml:"minPassphraseEntropy"` // Minimum estimated passphrase entropy in bits
+	MinCharClasses       int    `yaml:"minCharClasses"`       // Character classes a passphrase must mix, up to 4
+	DenyList             string `yaml:"denyList"`             // File of rejected passphrases, one per line
+
+	// LUKS2 token integration for TPM-bound keys
+	TPMToken  bool   `yaml:"tpmToken"`  // Enroll a systemd-tpm2 token for native unlock at boot, the default with useTPM
+	TPMPCRs   string `yaml:"tpmPCRs"`   // PCRs the systemd-tpm2 token is bound to
+	Keyscript bool   `yaml:"keyscript"` // Unlock at boot with the udm keyscript instead of the token
+
+	Split SplitKey `yaml:"split"` // Split-key mode across keyfile, TPM and escrow
+
+	// On-demand persistent mount through systemd automount
+	Automount   bool   `yaml:"automount"`   // Unlock and mount lazily on first access
+	IdleTimeout string `yaml:"idleTimeout"` // Unmount and re-lock after being idle, e.g. "10min"
+
+	Usage Usage `yaml:"usage"` // Filesystem usage alerts and growth
+
+	AutoLock string `yaml:"autoLock"` // udm daemon closes the volume after no I/O for this long, e.g. "30m", until the next udm mount
+
+	Ephemeral bool `yaml:"ephemeral"` // Random key kept only in memory, the data is lost at close
+
+	Erase string `yaml:"erase"` // Erase level when the volume is removed: header, discard or overwrite
+
+	DependsOn []string `yaml:"dependsOn"` // Mapper names of volumes provision-all mounts first
+
+	KeyfileWrap  string `yaml:"keyfileWrap"`  // Keyfile encryption at rest: none, passphrase, tpm or systemd-creds
+	Credential   string `yaml:"credential"`   // systemd credential carrying the key, defaults to the mapper name
+	KeyfileOwner string `yaml:"keyfileOwner"` // "user" or "user:group" owning written keyfiles, the caller by default
+	USBKey       USBKey `yaml:"usbKey"`       // Keyfile on a removable stick, read by mount without --keyfile
+
+	BindMounts []BindMount `yaml:"bindMounts"` // Subdirectories exposed at application paths after mounting
+
+	Quiesce Quiesce `yaml:"quiesce"` // Applications to quiesce before unmount
+
+	Private PrivateMount `yaml:"private"` // Mount only in the namespace of one service
+
+	Recovery Recovery `yaml:"recovery"` // Recovery passphrase in a secondary keyslot
+	Escrow   Escrow   `yaml:"escrow"`   // Volume key export for recovery by the organization
+
+	AllowPassphrase bool `yaml:"allowPassphrase"` // Enroll an operator passphrase, asked by mount when the key is unavailable
+
+	Lockout Lockout `yaml:"lockout"` // Backoff and lockout after failed unlock attempts
+	Panic   Panic   `yaml:"panic"`   // Wipe-on-tamper trigger of udm panic and the daemon
+
+	// cryptsetup parameters, defaulted per platform
+	Cipher          string `yaml:"cipher"`          // e.g. aes-xts-plain64
+	KeySize         int    `yaml:"keySize"`         // Master key size in bits
+	PBKDF           string `yaml:"pbkdf"`           // argon2id, argon2i or pbkdf2
+	PBKDFMemory     int    `yaml:"pbkdfMemory"`     // Argon2 memory cost in KiB
+	PBKDFIterations int    `yaml:"pbkdfIterations"` // Fixed iterations (time cost), 0 to benchmark
+	Integrity       string `yaml:"integrity"`       // dm-integrity: hmac-sha256, hmac-sha512, aead or poly1305
+
+	Tenant  string `yaml:"tenant"` // Tenant owning the volume on shared hosts, prefixing its mapper name
+	NVIndex string `yaml:"-"`      // First NV index holding the key, DefaultNVIndex when empty
+
+	NVAuth NVAuth `yaml:"nvAuth"` // Protection of the NV indices holding keys
+
+	LVM LVM `yaml:"lvm"` // Logical volume backing the volume instead of an image file
+
+	FIDO2 FIDO2 `yaml:"fido2"` // FIDO2 hardware token keyslot
+
+	Vault vault.Config `yaml:"vault"` // Key stored in or wrapped by HashiCorp Vault
+
+	KeyCache KeyCache `yaml:"keyCache"` // Kernel keyring caching the key retrieved from the TPM or Vault
+
+	WaitDevice WaitDevice `yaml:"waitDevice"` // Waiting for a backing device that appears late
+
+	HardwareBinding HardwareBinding `yaml:"hardwareBinding"` // Device-unique secret mixed into the keyfile
+
+	Profile string `yaml:"profile"` // data, swap or tmp; swap and tmp are plain dm-crypt with a random key
+
+	EnvFile string `yaml:"envFile"` // EnvironmentFile for dependent services, written while mounted
+
+	Features features.Set `yaml:"-"` // Feature flags of the application configuration
+
+	MountOptions []string `yaml:"mountOptions"` // e.g. noexec, nodev, nosuid, discard, usrquota
+	ReadOnly     bool     `yaml:"readOnly"`     // Open the mapper and mount the filesystem read-only after authorize
+	MAC          MAC      `yaml:"mac"`          // SELinux labels and AppArmor path rules of the mount
+
+	Password  []byte `yaml:"-"`
+	KillUsers bool   `yaml:"-"` // Terminate processes using the mount point before unmounting
 } // `yaml:"luks"`
 
 const DefaultNVIndex = "0x1500016"
 
-// checkTPM2Availability determines if TPM 2.0 is available on the system.
-func checkTPM2Availability() (bool, error) {
-	const tpm2Device = "/dev/tpmrm0" // Device file for TPM 2.0
+// volumeNVBase is the first of the volumeNVBlocks blocks of maxNVChunks indices the keys
+// of volumes are spread over, clear of DefaultNVIndex, WrapNVIndex and selfTestNVIndex.
+const (
+	volumeNVBase   = 0x1520000
+	volumeNVBlocks = 4096
+)
 
-	if _, err := os.Stat(tpm2Device); err == nil {
-		return true, nil // TPM 2.0 is available
-	} else if errors.Is(err, os.ErrNotExist) {
-		return false, nil // TPM 2.0 is not available
-	} else {
-		return false, fmt.Errorf("error accessing TPM 2.0 device: %w", err)
+// VolumeNVIndex returns the first NV index holding the key of a new volume, a block of
+// its own selected by a hash of the mapper name. Volumes hashing to the block of another
+// volume are refused by authorize rather than overwriting its key.
+func VolumeNVIndex(mapperName string) string {
+	h := fnv.New32a()
+	h.Write([]byte(mapperName))
+	return fmt.Sprintf("0x%x", volumeNVBase+uint64(h.Sum32()%volumeNVBlocks)*maxNVChunks)
+}
+
+// KeyNVIndex returns the first NV index holding the key of the volume.
+func (cfg *LUKS) KeyNVIndex() string {
+	if cfg.NVIndex != "" {
+		return cfg.NVIndex
+	}
+	return DefaultNVIndex
+}
+
+// filesystemType is the filesystem created on new volumes.
+const filesystemType = "ext4"
+
+const (
+	MinKeyBytes = 32  // Minimum length of a newly generated key
+	MaxKeyBytes = 512 // Largest key, stored across up to maxNVChunks NV indices
+
+	nvChunkSize = 64 // Bytes stored per NV index
+	maxNVChunks = 9  // NV indices a key (or key share) may span
+)
+
+// TPMAvailable reports whether the TPM of tpm.version is present.
+func TPMAvailable(ctx context.Context) bool {
+	available, _ := checkTPM2Availability(ctx)
+	return available
+}
+
+// checkTPM2Availability determines if TPM 2.0, or the TPM 1.2 selected instead, is
+// available on the system.
+func checkTPM2Availability(ctx context.Context) (bool, error) {
+	if tpm1Selected() {
+		return tpm1Present(ctx)
 	}
+	return tpmPresent(ctx, TPMDevice())
 }
 
 // SetupLUKSVolume sets up and mounts a new LUKS volume
-func SetupLUKSVolume(cfg *LUKS) error {
+func SetupLUKSVolume(ctx context.Context, cfg *LUKS) error {
+	if err := host.supported(); err != nil {
+		return err
+	}
 
 	if cfg == nil {
 		return fmt.Errorf("LUKS configuration is nil")
 	}
+	if cfg.Plain() {
+		return setupPlainVolume(ctx, cfg)
+	}
 
 	if cfg.UseTPM {
-		isTPM2Available, err := checkTPM2Availability()
+		isTPM2Available, err := checkTPM2Availability(ctx)
 		if err != nil {
 			log.Printf("error checking TPM 2.0 availability: %v\n", err)
 		} else if !isTPM2Available {
-			return fmt.Errorf("TPM 2.0 not availabile on this system, reconfigure to use keyfile")
+			return fmt.Errorf("TPM 2.0 not availabile at %s, reconfigure tpm.device or use keyfile", TPMDevice())
 		}
 	}
 
+	// The new filesystem is created and populated read-write, luks.readOnly applies to the
+	// mounts that follow
+	readOnly := cfg.ReadOnly
+	cfg.ReadOnly = false
+	defer func() { cfg.ReadOnly = readOnly }()
+
 	// Generate high entropy password
-	password, err := GenerateLUKSKey(cfg.PasswordLength)
+	password, err := GenerateLUKSKey(ctx, cfg.KeyBytes)
 	if err != nil {
-		log.Fatalf("Failed to generate password: %v", err)
+		return fmt.Errorf("failed to generate password: %w", err)
 	}
 	cfg.Password = password
 
-	fmt.Println("Creating LUKS volume ...")
-	if err := CreateLUKSVolume(cfg.VolumePath, password, cfg.Size, cfg.UseTPM); err != nil {
-		log.Fatalf("Failed to create LUKS volume: %v", err)
+	// Every completed step is undone when a later one fails
+	tx := &transaction{}
+	defer tx.rollback()
+
+	// In split-key mode the TPM holds a key share, stored by StoreKeyShares
+	storeInTPM := cfg.UseTPM && !cfg.Split.Enabled()
+	if err := progress.step(stepCreate, func() error {
+		return createLUKSVolume(ctx, tx, cfg, cfg.VolumePath, password, cfg.Size, storeInTPM)
+	}); err != nil {
+		return fmt.Errorf("failed to create LUKS volume: %w", err)
+	}
+
+	if cfg.UseTPM {
+		if cfg.Features.Enabled(features.LUKS2Tokens) {
+			fmt.Println("Recording TPM binding in LUKS2 header ...")
+			if err := addNVToken(ctx, cfg.VolumePath, cfg.KeyNVIndex(), cfg.nvKeySize()); err != nil {
+				return fmt.Errorf("failed to record TPM binding: %w", err)
+			}
+		}
+		if cfg.TPMToken && !tpm1Selected() {
+			fmt.Println("Enrolling systemd-tpm2 token ...")
+			if err := enrollSystemdTPM2(ctx, cfg); err != nil {
+				return fmt.Errorf("failed to enroll systemd-tpm2 token: %w", err)
+			}
+		}
+	}
+
+	if cfg.FIDO2.Enabled {
+		fmt.Println("Enrolling FIDO2 token ...")
+		if err := EnrollFIDO2(ctx, cfg); err != nil {
+			return fmt.Errorf("failed to enroll FIDO2 token: %w", err)
+		}
 	}
 
-	fmt.Println("Opening LUKS volume ...")
-	if err := OpenLUKSVolume(cfg); err != nil {
-		log.Fatalf("Failed to open LUKS volume: %v", err)
+	if err := progress.step(stepOpen, func() error {
+		return OpenLUKSVolume(ctx, cfg)
+	}); err != nil {
+		return fmt.Errorf("failed to open LUKS volume: %w", err)
 	}
+	tx.onRollback("close mapper "+cfg.MapperName, func() error {
+		return CloseLUKSVolume(ctx, cfg.MapperName)
+	})
 
-	fmt.Println("Formatting LUKS volume ...")
-	if err := FormatLUKSVolume(cfg.MapperName); err != nil {
-		log.Fatalf("Failed to format LUKS volume: %v", err)
+	if err := progress.step(stepFormat, func() error {
+		return FormatLUKSVolume(ctx, cfg.MapperName)
+	}); err != nil {
+		return fmt.Errorf("failed to format LUKS volume: %w", err)
 	}
 
-	fmt.Println("Mounting LUKS volume ...")
-	if err := MountLUKSVolume(cfg); err != nil {
-		log.Fatalf("Failed to mount LUKS volume: %v", err)
+	if err := progress.step(stepMount, func() error {
+		return MountLUKSVolume(ctx, cfg)
+	}); err != nil {
+		return fmt.Errorf("failed to mount LUKS volume: %w", err)
 	}
 
+	tx.commit()
 	return nil
 }
 
-func UnmountAndCloseLUKSVolume(cfg *LUKS) error {
+func UnmountAndCloseLUKSVolume(ctx context.Context, cfg *LUKS) error {
 	if cfg == nil {
 		return fmt.Errorf("LUKS configuration is nil")
 	}
 
-	fmt.Println("Unmounting LUKS volume...")
-	if err := UnmountLUKSVolume(cfg.MountPoint); err != nil {
-		log.Printf("Failed to unmount LUKS volume: %v", err)
+	if cfg.Plain() {
+		// The data is gone with the key, the storage stays for crypttab and authorize
+		if err := deactivatePlain(ctx, cfg); err != nil {
+			return err
+		}
+		if err := RemoveEnvFile(cfg); err != nil {
+			log.Printf("Failed to remove environment file: %v", err)
+		}
+		return nil
+	}
+
+	if cfg.Private.Enabled() {
+		// The mount goes away with the namespace of the service
+		if err := releasePrivate(cfg, cfg.KillUsers); err != nil {
+			return err
+		}
+	} else if cfg.Quiesce.Enabled() {
+		// Applications have released the volume, so a failing unmount is a real error
+		if err := QuiesceApplications(cfg); err != nil {
+			return fmt.Errorf("failed to quiesce applications, volume left mounted: %w", err)
+		}
+		if err := checkInUse(cfg.MountPoint, cfg.KillUsers); err != nil {
+			return err
+		}
+		unmountBinds(ctx, cfg.BindMounts)
+		fmt.Println("Unmounting LUKS volume...")
+		if err := unmountStrict(ctx, cfg.MountPoint); err != nil {
+			return err
+		}
+	} else {
+		// Report who holds the volume rather than detaching it lazily under them
+		if err := checkInUse(cfg.MountPoint, cfg.KillUsers); err != nil {
+			return err
+		}
+		unmountBinds(ctx, cfg.BindMounts)
+		fmt.Println("Unmounting LUKS volume...")
+		if err := UnmountLUKSVolume(ctx, cfg.MountPoint); err != nil {
+			log.Printf("Failed to unmount LUKS volume: %v", err)
+		}
 	}
 
 	fmt.Println("Closing LUKS volume...")
-	if err := CloseLUKSVolume(cfg.MapperName); err != nil {
+	if err := CloseLUKSVolume(ctx, cfg.MapperName); err != nil {
 		log.Printf("Failed to close LUKS volume: %v", err)
 	}
 
+	if err := RemoveEnvFile(cfg); err != nil {
+		log.Printf("Failed to remove environment file: %v", err)
+	}
+	if cfg.Ephemeral {
+		return discardEphemeral(ctx, cfg)
+	}
 	return nil
 }
 
-// CreateLUKSVolume set up a new LUKS volume with the specified size and password
-func CreateLUKSVolume(filePath string, password []byte, sizeMB int, useTPM bool) error {
+// CreateLUKSVolume set up a new LUKS volume with the specified size and password, using
+// the default cryptsetup parameters
+func CreateLUKSVolume(ctx context.Context, filePath string, password []byte, sizeMB int, useTPM bool) error {
+	if err := host.supported(); err != nil {
+		return err
+	}
+	tx := &transaction{}
+	defer tx.rollback()
 
-	if sizeMB < 1 || sizeMB > 64 {
-		return fmt.Errorf("size must be between 1MB and 10MB")
+	if err := createLUKSVolume(ctx, tx, &LUKS{Cipher: cipherAESXTS, KeySize: 512, PBKDF: PBKDFArgon2id, PBKDFMemory: defaultPBKDFMemory},
+		filePath, password, sizeMB, useTPM); err != nil {
+		return err
 	}
+	tx.commit()
+	return nil
+}
+
+// createLUKSVolume creates and formats the volume with the cryptsetup parameters of cfg,
+// registering the undo of each step with tx.
+func createLUKSVolume(ctx context.Context, tx *transaction, cfg *LUKS, filePath string, password []byte, sizeMB int, useTPM bool) error {
+
+	if cfg.LVM.Enabled() {
+		if sizeMB < 1 {
+			return fmt.Errorf("size must be at least 1MB")
+		}
+		if err := createLogicalVolume(ctx, cfg.LVM, sizeMB); err != nil {
+			return fmt.Errorf("failed to create logical volume: %w", err)
+		}
+		tx.onRollback("remove logical volume "+filePath, func() error {
+			return removeLogicalVolume(ctx, cfg.LVM)
+		})
+	} else {
+		if sizeMB < 1 || sizeMB > 64 {
+			return fmt.Errorf("size must be between 1MB and 10MB")
+		}
 
-	// Create a sparse file of the specified size
-	if err := createSparseFile(filePath, sizeMB); err != nil {
-		return fmt.Errorf("failed to create sparse file: %w", err)
+		// Create a sparse file of the specified size
+		if err := createSparseFile(filePath, sizeMB); err != nil {
+			return fmt.Errorf("failed to create sparse file: %w", err)
+		}
+		tx.onRollback("remove "+filePath, func() error {
+			return os.Remove(filePath)
+		})
 	}
 
 	// Optionally store the password in the TPM
 	if useTPM {
 
-		// Remove the password from the TPM if it already exists
-		if err := removePasswordFromTPM(DefaultNVIndex); err != nil {
-			log.Printf("failed to remove existing password from TPM: %s", err)
+		if err := checkNVIndexFree(ctx, cfg.KeyNVIndex()); err != nil {
+			return err
 		}
 
-		if err := storePasswordInTPM(password, DefaultNVIndex); err != nil {
+		// Registered first, a partially stored key spans some of the NV indices
+		tx.onRollback("remove key from TPM NV index "+cfg.KeyNVIndex(), func() error {
+			return removePasswordFromTPM(ctx, cfg.KeyNVIndex(), len(password))
+		})
+		if err := storePasswordInTPM(ctx, password, cfg.KeyNVIndex(), cfg.NVAuth); err != nil {
 			return fmt.Errorf("failed to store password in TPM: %w", err)
 		}
 	}
 
-	// Format the file as a LUKS volume
-	if err := luksFormat(filePath, password); err != nil {
-		return fmt.Errorf("failed to format LUKS volume: %w", err)
+	if cfg.Vault.Enabled() {
+		if err := storeInVault(cfg, password); err != nil {
+			return err
+		}
+		tx.onRollback("remove key from Vault", func() error {
+			return removeFromVault(cfg)
+		})
 	}
 
-	return nil
+	// Format the file as a LUKS volume
+	return luksFormat(ctx, cfg, filePath, password)
 }
 
 // OpenLUKSVolume opens an existing LUKS volume
-func OpenLUKSVolume(cfg *LUKS) error {
+func OpenLUKSVolume(ctx context.Context, cfg *LUKS) error {
+	if err := host.supported(); err != nil {
+		return err
+	}
+	if cfg.Ephemeral && cfg.Password == nil {
+		return ErrEphemeral
+	}
 
 	mappedDevice := "/dev/mapper/" + cfg.MapperName
 
 	// Check if the mapping already exists
 	if _, err := os.Stat(mappedDevice); err == nil {
 		// If the device exists, close it first
-		cmd := exec.Command("cryptsetup", "luksClose", cfg.MapperName)
-		if output, err := cmd.CombinedOutput(); err != nil {
-			return fmt.Errorf("failed to close existing mapping: %s\n%s", err, string(output))
+		if err := CloseLUKSVolume(ctx, cfg.MapperName); err != nil {
+			return fmt.Errorf("failed to close existing mapping: %w", err)
 		}
 	}
 
-	if cfg.UseTPM {
+	// A key cached by an earlier mount spares the TPM or Vault
+	cached := false
+	if cfg.Password == nil && ((cfg.UseTPM && !cfg.Split.Enabled()) || cfg.Vault.Enabled()) {
+		if password := cachedKey(cfg); password != nil {
+			cfg.Password, cached = password, true
+		}
+	}
+
+	// The key in the keyring was released by the TPM, it passes the same gate
+	if cached && cfg.UseTPM {
+		if err := checkKeyReleaseGate(); err != nil {
+			secrets.Wipe(cfg.Password)
+			cfg.Password = nil
+			return err
+		}
+	}
+
+	if cfg.UseTPM && !cfg.Split.Enabled() && !cached {
 
 		// Retrieve the password from the TPM
-		password, err := retrievePasswordFromTPM(DefaultNVIndex, cfg.PasswordLength)
-		if err != nil {
-			return fmt.Errorf("failed to retrieve password from TPM: %w", err)
+		password, err := retrievePasswordFromTPM(ctx, cfg.KeyNVIndex(), cfg.KeyBytes, cfg.NVAuth)
+		if err == nil {
+			cacheKey(cfg, password)
+		} else {
+			if !cfg.AllowPassphrase {
+				return fmt.Errorf("failed to retrieve password from TPM: %w", err)
+			}
+			log.Printf("Key unavailable from the TPM, asking for the passphrase: %v", err)
+			if password, err = AskPassphrase(cfg, fmt.Sprintf("Passphrase for %s:", cfg.MapperName)); err != nil {
+				return err
+			}
+		}
+		cfg.Password = password
+	} else if cfg.Vault.Enabled() && cfg.Password == nil {
+		password, err := retrieveFromVault(cfg)
+		if err == nil {
+			cacheKey(cfg, password)
+		} else {
+			if !cfg.AllowPassphrase {
+				return err
+			}
+			log.Printf("Key unavailable from Vault, asking for the passphrase: %v", err)
+			if password, err = AskPassphrase(cfg, fmt.Sprintf("Passphrase for %s:", cfg.MapperName)); err != nil {
+				return err
+			}
 		}
 		cfg.Password = password
 	}
 
-	cmd := exec.Command("cryptsetup", "luksOpen", cfg.VolumePath, cfg.MapperName)
-	cmd.Stdin = createPasswordInput(cfg.Password, true)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("failed to open LUKS volume: %s", output)
+	// Without a key the volume is unlocked with the hardware token
+	if cfg.FIDO2.Enabled && len(cfg.Password) == 0 {
+		return openWithFIDO2(ctx, cfg)
 	}
-	return nil
+
+	err := openDevice(ctx, cfg.VolumePath, func(device string) error {
+		return backend.open(ctx, device, cfg.MapperName, cfg.Password, cfg.ReadOnly, cfg.allowDiscards())
+	})
+	if err != nil && cached {
+		// The key was replaced since it was cached, retrieve the current one
+		if forgetErr := ForgetCachedKey(cfg); forgetErr != nil {
+			return err
+		}
+		log.Printf("Cached key rejected, retrieving it again: %v", err)
+		cfg.Password = nil
+		return OpenLUKSVolume(ctx, cfg)
+	}
+	return err
 }
 
-// FormatLuksVolume formats an existing LUKS volume
-func FormatLUKSVolume(mapperName string) error {
+// FormatLuksVolume formats an existing LUKS volume. Like luksFormat, mkfs is not bounded
+// by a timeout and is only killed with ctx.
+func FormatLUKSVolume(ctx context.Context, mapperName string) error {
 	devicePath := "/dev/mapper/" + mapperName
-	cmd := exec.Command("mkfs.ext4", devicePath)
+	cmd := trace.CommandContext(ctx, "mkfs."+filesystemType, devicePath)
 
-	output, err := cmd.CombinedOutput()
+	output, err := runStreaming(stepFormat, cmd)
 	if err != nil {
-		return fmt.Errorf("failed to format LUKS volume: %s", output)
+		return fmt.Errorf("mkfs.%s failed: %s", filesystemType, strings.TrimSpace(string(output)))
 	}
 
 	return nil
 }
 
 // CleanupLUKSVolume unmounts and closes the LUKS volume and removes the mount point
-func RemoveLUKSVolume(cfg *LUKS) error {
-	fmt.Println("Unmounting LUKS volume...")
-	if err := UnmountLUKSVolume(cfg.MountPoint); err != nil {
-		log.Printf("failed to unmount LUKS volume: %s", err)
+func RemoveLUKSVolume(ctx context.Context, cfg *LUKS) error {
+	if err := host.supported(); err != nil {
+		return err
+	}
+	if cfg.Private.Enabled() {
+		if err := releasePrivate(cfg, true); err != nil {
+			log.Printf("failed to release private mount: %s", err)
+		}
+		if err := removePrivateDropIn(cfg); err != nil {
+			log.Printf("failed to remove private mount drop-in: %s", err)
+		}
+	} else if cfg.Plain() {
+		if err := deactivatePlain(ctx, cfg); err != nil {
+			log.Printf("failed to deactivate %s volume: %s", cfg.Profile, err)
+		}
+	} else {
+		unmountBinds(ctx, cfg.BindMounts)
+		fmt.Println("Unmounting LUKS volume...")
+		if err := UnmountLUKSVolume(ctx, cfg.MountPoint); err != nil {
+			log.Printf("failed to unmount LUKS volume: %s", err)
+		}
 	}
 
 	fmt.Println("Closing LUKS volume...")
-	if err := CloseLUKSVolume(cfg.MapperName); err != nil {
+	if err := CloseLUKSVolume(ctx, cfg.MapperName); err != nil {
 		log.Printf("failed to close LUKS volume: %s", err)
 	}
 
-	fmt.Println("Removing mount directory...")
-	if err := os.RemoveAll(cfg.MountPoint); err != nil {
-		log.Printf("failed to remove mount directory: %s", err)
+	// The mount point of swap and tmp volumes, e.g. /tmp, is not ours to remove
+	if !cfg.Plain() {
+		fmt.Println("Removing mount directory...")
+		if err := os.RemoveAll(cfg.MountPoint); err != nil {
+			log.Printf("failed to remove mount directory: %s", err)
+		}
+	}
+
+	// Loop devices leaked by earlier versions would keep the deleted image alive
+	if devices, err := LoopDevices(cfg.VolumePath); err == nil {
+		for _, device := range devices {
+			if err := detachLoop(ctx, device); err != nil {
+				log.Printf("failed to detach %s: %s", device, err)
+			}
+		}
 	}
 
-	fmt.Println("Removing LUKS image file ...")
-	if err := os.Remove(cfg.VolumePath); err != nil {
-		log.Printf("failed to remove LUKS image file: %s", err)
+	if err := secureErase(ctx, cfg); err != nil {
+		log.Printf("failed to erase LUKS volume, ciphertext is left on the storage: %s", err)
+	}
+
+	if cfg.LVM.Enabled() {
+		fmt.Println("Removing logical volume ...")
+		if err := removeLogicalVolume(ctx, cfg.LVM); err != nil {
+			log.Printf("failed to remove logical volume: %s", err)
+		}
+	} else {
+		fmt.Println("Removing LUKS image file ...")
+		if err := os.Remove(cfg.VolumePath); err != nil {
+			log.Printf("failed to remove LUKS image file: %s", err)
+		}
+	}
+	if HotplugMountInstalled(cfg) {
+		fmt.Println("Removing hotplug mount ...")
+		if err := RemoveHotplugMount(cfg); err != nil {
+			log.Printf("failed to remove hotplug mount: %s", err)
+		}
 	}
 	if cfg.UseTPM {
 		fmt.Println("Removing password from TPM ...")
-		if err := removePasswordFromTPM(DefaultNVIndex); err != nil {
+		if err := removePasswordFromTPM(ctx, cfg.KeyNVIndex(), cfg.nvKeySize()); err != nil {
 			log.Printf("failed to remove password from TPM: %s", err)
 		}
+		if err := removeKeyscriptConfig(cfg.KeyNVIndex()); err != nil {
+			log.Printf("failed to remove keyscript configuration: %s", err)
+		}
+	}
+	if err := ForgetCachedKey(cfg); err != nil {
+		log.Printf("failed to remove cached key: %s", err)
+	}
+	if cfg.Vault.Enabled() {
+		fmt.Println("Removing key from Vault ...")
+		if err := removeFromVault(cfg); err != nil {
+			log.Printf("failed to remove key from Vault: %s", err)
+		}
 	}
 	return nil
 }
 
 // MountLUKSVolume mounts the mapped LUKS volume to the specified mount point
-func MountLUKSVolume(cfg *LUKS) error { //mapperName, mountPoint, user, group string) error {
+func MountLUKSVolume(ctx context.Context, cfg *LUKS) error { //mapperName, mountPoint, user, group string) error {
+	if err := host.supported(); err != nil {
+		return err
+	}
+	if cfg.Private.Enabled() {
+		if err := mountPrivate(cfg); err != nil {
+			return err
+		}
+		if err := WriteEnvFile(ctx, cfg); err != nil {
+			log.Printf("Failed to write environment file: %v", err)
+		}
+		return nil
+	}
+
 	devicePath := "/dev/mapper/" + cfg.MapperName
 	if err := os.MkdirAll(cfg.MountPoint, 0755); err != nil {
 		return fmt.Errorf("failed to create mount point: %w", err)
 	}
+	if err := checkAppArmorPath(cfg); err != nil {
+		return err
+	}
 
-	cmd := exec.Command("mount", devicePath, cfg.MountPoint)
-	output, err := cmd.CombinedOutput()
+	args := []string{devicePath, cfg.MountPoint}
+	if options := mountOptions(cfg); len(options) > 0 {
+		args = append([]string{"-o", strings.Join(options, ",")}, args...)
+	}
+	output, err := runRetried(ctx, OpMount, func() *trace.Cmd { return trace.Command("mount", args...) })
 	if err != nil {
 		return fmt.Errorf("failed to mount LUKS volume: %s", output)
 	}
@@ -231,23 +622,34 @@ func MountLUKSVolume(cfg *LUKS) error { //mapperName, mountPoint, user, group st
 	if cfg.User == "" || cfg.Group == "" {
 		return fmt.Errorf(("user and group must be specified"))
 	}
-	cmd = exec.Command("chown", fmt.Sprintf("%s:%s", cfg.User, cfg.Group), cfg.MountPoint)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to change ownership of mount point: %s\n%s", err, string(output))
+	// A read-only filesystem keeps the owner and labels it was populated with
+	if !cfg.ReadOnly {
+		if output, err := runRetried(ctx, OpMount, func() *trace.Cmd {
+			return trace.Command("chown", fmt.Sprintf("%s:%s", cfg.User, cfg.Group), cfg.MountPoint)
+		}); err != nil {
+			return fmt.Errorf("failed to change ownership of mount point: %s\n%s", err, string(output))
+		}
+		if err := relabel(cfg); err != nil {
+			return err
+		}
+	}
+	if err := mountBinds(ctx, cfg); err != nil {
+		return err
 	}
 
+	if err := WriteEnvFile(ctx, cfg); err != nil {
+		log.Printf("Failed to write environment file: %v", err)
+	}
 	return nil
 }
 
 // unmountLUKSVolume unmounts the mapped LUKS volume
-func UnmountLUKSVolume(mountPoint string) error {
-	cmd := exec.Command("umount", mountPoint)
-	output, err := cmd.CombinedOutput()
+func UnmountLUKSVolume(ctx context.Context, mountPoint string) error {
+	_, err := runRetried(ctx, OpMount, func() *trace.Cmd { return trace.Command("umount", mountPoint) })
 	if err != nil {
 		// Retry with lazy unmount
 		fmt.Printf("Normal unmount failed: %s. Retrying with lazy unmount...\n", err)
-		cmd = exec.Command("umount", "-l", mountPoint)
-		output, err = cmd.CombinedOutput()
+		output, err := runRetried(ctx, OpMount, func() *trace.Cmd { return trace.Command("umount", "-l", mountPoint) })
 		if err != nil {
 			return fmt.Errorf("failed to unmount LUKS volume: %s\n%s", err, string(output))
 		}
@@ -255,12 +657,27 @@ func UnmountLUKSVolume(mountPoint string) error {
 	return nil
 }
 
-// CloseLUKSVolume closes the mapped LUKS volume
-func CloseLUKSVolume(mapperName string) error {
-	cmd := exec.Command("cryptsetup", "luksClose", mapperName)
-	output, err := cmd.CombinedOutput()
+// Remount changes the options of a mounted filesystem, e.g. to ro.
+func Remount(ctx context.Context, mountPoint, options string) error {
+	output, err := runRetried(ctx, OpMount, func() *trace.Cmd {
+		return trace.Command("mount", "-o", "remount,"+options, mountPoint)
+	})
 	if err != nil {
-		return fmt.Errorf("failed to close LUKS volume: %s", output)
+		return fmt.Errorf("%s", strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// CloseLUKSVolume closes the mapped LUKS volume and detaches the loop device under it
+func CloseLUKSVolume(ctx context.Context, mapperName string) error {
+	loop := backingLoop(mapperName)
+	if err := backend.close(ctx, mapperName); err != nil {
+		return err
+	}
+	if loop != "" {
+		if err := detachLoop(ctx, loop); err != nil {
+			log.Printf("Failed to detach %s: %v", loop, err)
+		}
 	}
 	return nil
 }
@@ -294,39 +711,8 @@ func createSparseFile(filePath string, sizeMB int) error {
 }
 
 // luksFormat formats the file as a LUKS volume
-func luksFormat(filePath string, password []byte) error {
-	// Create a temporary file to store the password
-	tmpFile, err := os.CreateTemp("", "luks-password-*")
-	if err != nil {
-		return fmt.Errorf("failed to create temporary file: %w", err)
-	}
-	defer os.Remove(tmpFile.Name()) // Ensure the file is removed after use
-
-	// Write the password to the temporary file
-	if _, err := tmpFile.Write(password); err != nil {
-		return fmt.Errorf("failed to write password to temporary file: %w", err)
-	}
-	if err := tmpFile.Close(); err != nil {
-		return fmt.Errorf("failed to close temporary file: %w", err)
-	}
-
-	cmd := exec.Command(
-		"cryptsetup",
-		"luksFormat",
-		"--type=luks2",
-		"--batch-mode",
-		"--pbkdf-memory=2097152",
-		"--pbkdf-parallel=8",
-		"--cipher=aes-xts-plain64",
-		"--key-file", tmpFile.Name(),
-		filePath,
-	)
-
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("failed to format LUKS volume: %s, error: %w", output, err)
-	}
-	return nil
+func luksFormat(ctx context.Context, cfg *LUKS, filePath string, password []byte) error {
+	return backend.format(ctx, cfg, filePath, password)
 }
 
 // createPasswordInput creates a pipe to provide the password as input.
@@ -335,106 +721,257 @@ func createPasswordInput(password []byte, addNewline bool) *os.File {
 
 	go func() {
 		defer w.Close()
+		// Written separately, appending would copy the key onto the heap
+		w.Write(password)
 		if addNewline {
-			w.Write(append(password, '\n'))
-		} else {
-			w.Write(password)
+			w.Write([]byte{'\n'})
 		}
 	}()
 
 	return r
 }
 
-// storePasswordInTPM stores the LUKS password securely in the TPM.
-func storePasswordInTPM(password []byte, nvIndex string) error {
+// storePasswordInTPM stores the LUKS password securely in the TPM. Passwords longer than
+// nvChunkSize bytes are spread over consecutive NV indices starting at nvIndex.
+func storePasswordInTPM(ctx context.Context, password []byte, nvIndex string, auth NVAuth) error {
+	if tpm1Selected() {
+		return sealToTPM1(ctx, password, nvIndex, auth)
+	}
 
 	// Validate password length
-	//passwordLength := len(password)
-	if len(password) < 1 || len(password) > 64 {
-		return fmt.Errorf("password length (%d bytes) must be between 1 and 64 bytes", len(password))
+	if len(password) < 1 || len(password) > nvChunkSize*maxNVChunks {
+		return fmt.Errorf("password length (%d bytes) must be between 1 and %d bytes", len(password), nvChunkSize*maxNVChunks)
 	}
 
-	// Define the NV index with the password length as the size
-	cmd := exec.Command("tpm2_nvdefine",
-		nvIndex,
-		fmt.Sprintf("--size=%d", len(password)),
-		"--attributes=ownerread|ownerwrite|authread|authwrite")
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("tpm2_nvdefine error: %s", string(output))
+	for i := 0; i*nvChunkSize < len(password); i++ {
+		chunk := password[i*nvChunkSize : min((i+1)*nvChunkSize, len(password))]
+		index, err := nvIndexAt(nvIndex, i)
+		if err != nil {
+			return err
+		}
+
+		// Define the NV index with the chunk length as the size
+		defineArgs, cleanup, err := auth.defineArgs(ctx, index)
+		if err != nil {
+			return err
+		}
+		output, err := runRetried(ctx, OpTPM, func() *trace.Cmd {
+			return trace.Command("tpm2_nvdefine", append([]string{index, fmt.Sprintf("--size=%d", len(chunk))}, defineArgs...)...)
+		})
+		cleanup()
+		if err != nil {
+			return fmt.Errorf("tpm2_nvdefine error for index %s: %s", index, string(output))
+		}
+
+		// Write the chunk to the NV index
+		accessArgs, cleanup, err := auth.accessArgs(index)
+		if err != nil {
+			return err
+		}
+		output, err = runRetried(ctx, OpTPM, func() *trace.Cmd {
+			cmd := trace.Command("tpm2_nvwrite", append([]string{index, "--input=-"}, accessArgs...)...) // Use stdin for the input
+			cmd.Stdin = createPasswordInput(chunk, false)
+			return cmd
+		})
+		cleanup()
+		if err != nil {
+			return fmt.Errorf("tpm2_nvwrite error for index %s: %s", index, string(output))
+		}
 	}
 
-	// Write the password to the NV index
-	cmd = exec.Command("tpm2_nvwrite",
-		nvIndex,
-		"--input=-") // Use stdin for the input
-	cmd.Stdin = createPasswordInput(password, false)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("tpm2_nvwrite error: %s", string(output))
+	return nil
+}
+
+// checkNVIndexFree fails if a key is stored at the NV index, which belongs to another
+// volume or was left behind by a volume that was not deauthorized.
+func checkNVIndexFree(ctx context.Context, nvIndex string) error {
+	stored := NVIndexDefined(ctx, nvIndex)
+	if tpm1Selected() {
+		stored = fileExists(tpm1BlobPath(nvIndex))
+	}
+	if stored {
+		return fmt.Errorf("TPM NV index %s already holds a key, deauthorize the volume using it or rename this volume", nvIndex)
 	}
+	return nil
+}
 
+// removePasswordFromTPM removes the key of size bytes from the specified NV index in the
+// TPM, including the continuation indices a key of that size spans and no others, so
+// the block of a neighbouring volume is never touched. Continuation indices a partially
+// stored key did not reach are skipped.
+func removePasswordFromTPM(ctx context.Context, nvIndex string, size int) error {
+	if tpm1Selected() {
+		return removeTPM1Blob(nvIndex)
+	}
+	for i := 0; i == 0 || i*nvChunkSize < size; i++ {
+		index, err := nvIndexAt(nvIndex, i)
+		if err != nil {
+			return err
+		}
+		if i > 0 && !NVIndexDefined(ctx, index) {
+			continue
+		}
+		if output, err := runRetried(ctx, OpTPM, func() *trace.Cmd { return trace.Command("tpm2_nvundefine", index) }); err != nil {
+			return fmt.Errorf("tpm2_nvundefine error for index %s: %s", index, string(output))
+		}
+	}
 	return nil
 }
 
-// removePasswordFromTPM removes the LUKS password from the specified NV index in the TPM.
-func removePasswordFromTPM(nvIndex string) error {
-	cmd := exec.Command("tpm2_nvundefine", nvIndex)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("tpm2_nvundefine error: %s", string(output))
+var (
+	gateMu         sync.Mutex
+	keyReleaseGate func() error
+)
+
+// SetKeyReleaseGate installs a check that must pass every time a key is read from the
+// TPM, such as a remote attestation of the boot state.
+func SetKeyReleaseGate(gate func() error) {
+	gateMu.Lock()
+	defer gateMu.Unlock()
+	keyReleaseGate = gate
+}
+
+// checkKeyReleaseGate runs the check installed by SetKeyReleaseGate, if any.
+func checkKeyReleaseGate() error {
+	gateMu.Lock()
+	gate := keyReleaseGate
+	gateMu.Unlock()
+	if gate != nil {
+		if err := gate(); err != nil {
+			return fmt.Errorf("key release denied: %w", err)
+		}
 	}
 	return nil
 }
 
 // retrievePasswordFromTPM retrieves the LUKS password from the TPM for the specified NV index and size.
-func retrievePasswordFromTPM(nvindex string, size int) ([]byte, error) {
+func retrievePasswordFromTPM(ctx context.Context, nvindex string, size int, auth NVAuth) ([]byte, error) {
+	if err := checkKeyReleaseGate(); err != nil {
+		return nil, err
+	}
 
-	// Construct the tpm2_nvread command with the provided NV index and size
-	cmd := exec.Command("tpm2_nvread", nvindex, fmt.Sprintf("--size=%d", size))
+	if tpm1Selected() {
+		return unsealFromTPM1(ctx, nvindex, size)
+	}
 
-	// Execute the command and capture the output
-	output, err := cmd.Output()
+	buf, err := secrets.New(size)
 	if err != nil {
-		return nil, fmt.Errorf("tpm2_nvread error for index %s: %w", nvindex, err)
+		return nil, err
+	}
+	password := buf.Bytes()
+	for i := 0; i*nvChunkSize < size; i++ {
+		chunkSize := min(nvChunkSize, size-i*nvChunkSize)
+		index, err := nvIndexAt(nvindex, i)
+		if err != nil {
+			buf.Destroy()
+			return nil, err
+		}
+
+		// Construct the tpm2_nvread command with the chunk's NV index and size
+		accessArgs, cleanup, err := auth.accessArgs(index)
+		if err != nil {
+			buf.Destroy()
+			return nil, err
+		}
+		// Execute the command and capture the output
+		output, err := outputRetried(ctx, OpTPM, func() *trace.Cmd {
+			return trace.Command("tpm2_nvread", append([]string{index, fmt.Sprintf("--size=%d", chunkSize)}, accessArgs...)...)
+		})
+		cleanup()
+		if err != nil {
+			buf.Destroy()
+			return nil, fmt.Errorf("tpm2_nvread error for index %s: %w", index, err)
+		}
+		n := copy(password[i*nvChunkSize:], output)
+		secrets.Wipe(output)
+		if n != chunkSize {
+			buf.Destroy()
+			return nil, fmt.Errorf("tpm2_nvread returned %d bytes for index %s, expected %d", n, index, chunkSize)
+		}
 	}
 
-	// Return the output as a string
-	return output, nil
+	return password, nil
 }
 
-// GenerateLUKSKey generates a random key of the specified length in bytes,
-// using tpm2_getrandom if available, otherwise falling back to crypto/rand.
-func GenerateLUKSKey(length int) ([]byte, error) {
-
-	if length <= 8 {
-		return nil, fmt.Errorf("key length must be greater than 0")
+// nvIndexAt returns the NV index i positions after base.
+func nvIndexAt(base string, i int) (string, error) {
+	value, err := strconv.ParseUint(base, 0, 32)
+	if err != nil {
+		return "", fmt.Errorf("invalid NV index %q: %w", base, err)
 	}
+	return fmt.Sprintf("0x%x", value+uint64(i)), nil
+}
 
-	// Check if tpm2_getrandom is available.
-	isTPMAvailable, err := checkTPM2Availability()
+// GenerateLUKSKey generates a random key of the specified length in bytes from the
+// configured key source, see randomKey. The key must meet the key entropy of the
+// password policy.
+func GenerateLUKSKey(ctx context.Context, length int) ([]byte, error) {
+	key, err := randomKey(ctx, length)
 	if err != nil {
-		log.Printf("Error when checking TPM device")
-	} else if isTPMAvailable {
-		key, err := getRandomBytesFromTPM2(length)
-		if err == nil {
-			return key, nil
-		}
-		fmt.Printf("Failed to use TPM: %v. Falling back to crypto/rand.\n", err)
+		return nil, err
 	}
-	// Fallback to crypto/rand.
-	key := make([]byte, length)
-	_, err = rand.Read(key)
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate random key using crypto/rand: %w", err)
+	if err := CheckKeyStrength(key, currentPasswordPolicy().MinKeyEntropy); err != nil {
+		secrets.Wipe(key)
+		return nil, fmt.Errorf("generated key rejected: %w", err)
 	}
 	return key, nil
 }
 
+// passwordAlphabet has 32 characters without look-alikes (0/O, 1/I/L, U), so each random
+// byte maps to a character without modulo bias and passwords survive being read aloud.
+const passwordAlphabet = "ABCDEFGHJKMNPQRSTVWXYZ0123456789"
+
+// GeneratePassword generates a human-typeable password of groups of five characters
+// separated by dashes, e.g. "7QK2M-XW9PA-...". Each character carries 5 bits of entropy.
+// Passwords the password policy rejects, e.g. for lacking a digit, are drawn again.
+func GeneratePassword(ctx context.Context, groups int) (string, error) {
+	if groups <= 0 {
+		return "", fmt.Errorf("password must have at least one group")
+	}
+	policy := currentPasswordPolicy()
+	if bits := groups * 5 * 5; bits < policy.MinPassphraseEntropy {
+		return "", fmt.Errorf("%d groups give %d bits of entropy, policy requires %d", groups, bits, policy.MinPassphraseEntropy)
+	}
+	// The alphabet mixes upper case letters and digits, the dashes count as symbols
+	classes := 2
+	if groups > 1 {
+		classes = 3
+	}
+	if policy.MinCharClasses > classes {
+		return "", fmt.Errorf("generated passwords mix %d character classes, policy requires %d", classes, policy.MinCharClasses)
+	}
+
+	for attempt := 0; attempt < maxGenerateAttempts; attempt++ {
+		random, err := randomKey(ctx, max(groups*5, MinKeyBytes))
+		if err != nil {
+			return "", err
+		}
+
+		var sb strings.Builder
+		for i := 0; i < groups*5; i++ {
+			if i > 0 && i%5 == 0 {
+				sb.WriteByte('-')
+			}
+			sb.WriteByte(passwordAlphabet[random[i]%32])
+		}
+		secrets.Wipe(random)
+		if policy.Check([]byte(sb.String())) == nil {
+			return sb.String(), nil
+		}
+	}
+	return "", fmt.Errorf("no generated password met the policy in %d attempts", maxGenerateAttempts)
+}
+
 // getRandomBytesFromTPM2 fetches the specified number of random bytes using tpm2_getrandom.
-func getRandomBytesFromTPM2(size int) ([]byte, error) {
+func getRandomBytesFromTPM2(ctx context.Context, size int) ([]byte, error) {
 
 	// Execute the tpm2_getrandom command to fetch `size` bytes in hex format.
-	cmd := exec.Command("tpm2_getrandom", fmt.Sprintf("%d", size), "--hex")
+	ctx, cancel := commandContext(ctx, OpTPM)
+	defer cancel()
+	cmd := trace.CommandContext(ctx, "tpm2_getrandom", fmt.Sprintf("%d", size), "--hex")
 	var out bytes.Buffer
 	cmd.Stdout = &out
+	defer func() { secrets.Wipe(out.Bytes()) }()
 	if err := cmd.Run(); err != nil {
 		return nil, fmt.Errorf("failed to execute tpm2_getrandom: %w", err)
 	}
@@ -449,21 +986,45 @@ func getRandomBytesFromTPM2(size int) ([]byte, error) {
 	return randomBytes, nil
 }
 
-func isLUKSMounted(cfg *LUKS) (bool, error) {
+func IsLUKSMounted(cfg *LUKS) (bool, error) {
 	devicePath := "/dev/mapper/" + cfg.MapperName
+	if cfg.Private.Enabled() {
+		// Mounted in the namespace of the service, invisible to lsblk here
+		_, err := os.Stat(devicePath)
+		return err == nil && unitActive(cfg.Private.Unit), nil
+	}
 
-	cmd := exec.Command("lsblk", "-o", "MOUNTPOINT", "--noheadings", devicePath)
+	cmd := trace.Command("lsblk", "-o", "MOUNTPOINT", "--noheadings", devicePath)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		return false, fmt.Errorf("failed to list mounted devices: %s, error: %v", output, err)
 	}
+	if cfg.Profile == ProfileSwap {
+		return strings.TrimSpace(string(output)) == "[SWAP]", nil
+	}
 	return strings.TrimSpace(string(output)) == cfg.MountPoint, nil
 }
 
 // AddPersistentMount sets up the necessary entries in /etc/fstab for persistent mount
-func AddPersistentMount(cfg *LUKS, keyFile string) error {
+func AddPersistentMount(ctx context.Context, cfg *LUKS, keyFile string) error {
+	if cfg.Plain() {
+		return addPlainPersistentMount(cfg)
+	}
 
-	isMounted, err := isLUKSMounted(cfg)
+	if cfg.Split.Enabled() {
+		return fmt.Errorf("persistent mount is not supported in split-key mode, shares must be combined by mount")
+	}
+	if cfg.Private.Enabled() {
+		return fmt.Errorf("persistent mount is not supported with luks.private, %s mounts the volume itself", cfg.Private.Unit)
+	}
+	if cfg.HardwareBinding.Enabled() && keyFile != "" {
+		return fmt.Errorf("persistent mount is not supported with luks.hardwareBinding, cryptsetup cannot unbind the keyfile")
+	}
+	if cfg.Vault.Enabled() && keyFile == "" {
+		return fmt.Errorf("persistent mount with luks.vault requires --keyfile, systemd-cryptsetup cannot read the key from Vault at boot")
+	}
+
+	isMounted, err := IsLUKSMounted(cfg)
 	if err != nil {
 		return fmt.Errorf("failed to check if LUKS volume is mounted: %v", err)
 	}
@@ -472,40 +1033,107 @@ func AddPersistentMount(cfg *LUKS, keyFile string) error {
 	}
 
 	// Update /etc/crypttab
-	var crypttabEntry string
-	if cfg.UseTPM {
-		crypttabEntry = fmt.Sprintf("%s %s none luks,keyscript=/usr/local/bin/tpm-luks-keyscript.sh\n",
-			cfg.MapperName, cfg.VolumePath)
-	} else {
-		crypttabEntry = fmt.Sprintf("%s %s %s luks\n", cfg.MapperName, cfg.VolumePath, keyFile)
+	crypttabKey := keyFile
+	crypttabOpts := []string{"luks"}
+	tpmToken := cfg.UseTPM && cfg.TPMToken
+	if tpmToken {
+		if enrolled, err := hasSystemdTPM2Token(ctx, cfg.VolumePath); err != nil {
+			return fmt.Errorf("failed to check for systemd-tpm2 token: %w", err)
+		} else if !enrolled {
+			fmt.Println("Warning: no systemd-tpm2 token in the LUKS2 header, unlocking at boot with the keyscript")
+			tpmToken = false
+		}
+	}
+	if tpmToken {
+		crypttabKey = "none"
+		crypttabOpts = append(crypttabOpts, tpm2CrypttabOpts)
+	} else if cfg.UseTPM {
+		// The keyscript receives the key field and reads the settings of the NV index in it
+		crypttabKey = cfg.KeyNVIndex()
+		crypttabOpts = append(crypttabOpts, "keyscript=/usr/local/bin/tpm-luks-keyscript.sh")
+		if err := cfg.NVAuth.writeKeyscriptConfig(cfg.KeyNVIndex(), cfg.nvKeySize()); err != nil {
+			return fmt.Errorf("failed to configure keyscript: %w", err)
+		}
+	} else if cfg.FIDO2.Enabled && keyFile == "" {
+		crypttabKey = "none"
+		crypttabOpts = append(crypttabOpts, fido2CrypttabOpts(cfg))
+	} else if keyFile == "" {
+		// systemd-cryptsetup asks for the passphrase at boot
+		crypttabKey = "none"
+	}
+	if cfg.Automount {
+		// Opened on first access through the fstab automount dependency
+		crypttabOpts = append(crypttabOpts, "noauto")
+	}
+	if cfg.ReadOnly {
+		crypttabOpts = append(crypttabOpts, "read-only")
+	}
+	if cfg.allowDiscards() {
+		crypttabOpts = append(crypttabOpts, "discard")
+	}
+	uuid, err := VolumeUUID(ctx, cfg)
+	if err != nil {
+		return err
 	}
+	source := crypttabSource(cfg, uuid)
+	crypttabEntry := fmt.Sprintf("%s %s %s %s", cfg.MapperName, source, crypttabKey, strings.Join(crypttabOpts, ","))
 
-	if err := appendToFile("/etc/crypttab", crypttabEntry); err != nil {
+	// Entries are replaced in place, so running it again only fixes what changed
+	if changed, err := setCrypttabEntry(crypttabPath, cfg, crypttabEntry); err != nil {
 		return fmt.Errorf("failed to update /etc/crypttab: %v", err)
+	} else if !changed {
+		fmt.Println("Entry already in /etc/crypttab")
+	}
+	if isImageFile(cfg) {
+		if !cfg.Features.Enabled(features.SystemdUnits) {
+			fmt.Printf("Warning: feature %s is disabled, /etc/crypttab references the image by path\n", features.SystemdUnits)
+		} else if err := installLoopUnit(cfg); err != nil {
+			return fmt.Errorf("failed to install loop unit: %w", err)
+		}
 	}
 
 	devicePath := "/dev/mapper/" + cfg.MapperName
-	filesystemUUID, err := getFilesystemUUID(devicePath)
+	filesystemUUID, err := getFilesystemUUID(ctx, devicePath)
 	fmt.Printf("Filesystem UUID, mappedDevice (%s): %s\n", devicePath, filesystemUUID)
 	if err != nil {
 		return fmt.Errorf("failed to retrieve filesystem UUID: %w", err)
 	}
 
 	// Update /etc/fstab
-	fstabEntry := fmt.Sprintf("UUID=%s %s ext4 defaults,nofail,x-systemd.requires=cryptsetup@%s.service 0 2\n",
-		filesystemUUID, cfg.MountPoint, cfg.MapperName)
-
-	if err := appendToFile("/etc/fstab", fstabEntry); err != nil {
+	if changed, err := setFstabEntry(fstabPath, cfg, fstabEntry(cfg, filesystemUUID)); err != nil {
 		return fmt.Errorf("failed to update /etc/fstab: %v", err)
+	} else if !changed {
+		fmt.Println("Entry already in /etc/fstab")
+	}
+
+	if cfg.Automount {
+		if !cfg.Features.Enabled(features.SystemdUnits) {
+			fmt.Printf("Warning: feature %s is disabled, install the automount drop-in manually\n", features.SystemdUnits)
+		} else if err := installAutomountDropIn(cfg); err != nil {
+			return fmt.Errorf("failed to configure automount: %w", err)
+		}
 	}
 
 	return nil
 }
 
+// fstabEntry returns the /etc/fstab line mounting the filesystem with the given UUID.
+func fstabEntry(cfg *LUKS, filesystemUUID string) string {
+	fstabOpts := "defaults,nofail"
+	if options := mountOptions(cfg); len(options) > 0 {
+		fstabOpts += "," + strings.Join(options, ",")
+	}
+	if cfg.Automount {
+		fstabOpts += "," + automountFstabOptions(cfg)
+	}
+	return fmt.Sprintf("UUID=%s %s %s %s,x-systemd.requires=cryptsetup@%s.service 0 2",
+		filesystemUUID, cfg.MountPoint, filesystemType, fstabOpts, cfg.MapperName)
+}
+
 // RemovePersistentMount removes the entries in /etc/fstab for persistent mount
 func RemovePersistentMount(cfg *LUKS) error {
 
-	isMounted, err := isLUKSMounted(cfg)
+	isMounted, err := IsLUKSMounted(cfg)
 	if err != nil {
 		return fmt.Errorf("failed to check if LUKS volume is mounted: %v", err)
 	}
@@ -514,24 +1142,41 @@ func RemovePersistentMount(cfg *LUKS) error {
 	}
 
 	// Remove the entry from /etc/fstab
-	if err := removeLineFromFile("/etc/fstab", cfg.MountPoint); err != nil {
+	if err := removeTabEntries(fstabPath, fstabMatch(cfg)); err != nil {
 		return fmt.Errorf("failed to remove entry from /etc/fstab: %v", err)
 	}
 
 	// Remove the entry from /etc/crypttab
-	if err := removeLineFromFile("/etc/crypttab", cfg.MapperName); err != nil {
+	if err := removeTabEntries(crypttabPath, crypttabMatch(cfg.MapperName)); err != nil {
 		return fmt.Errorf("failed to remove entry from /etc/crypttab: %v", err)
 	}
+	if isImageFile(cfg) {
+		if err := removeLoopUnit(cfg); err != nil {
+			return fmt.Errorf("failed to remove loop unit: %w", err)
+		}
+	}
+
+	if cfg.Automount {
+		if err := removeAutomountDropIn(cfg); err != nil {
+			return fmt.Errorf("failed to remove automount configuration: %w", err)
+		}
+	}
+	if cfg.UseTPM {
+		if err := removeKeyscriptConfig(cfg.KeyNVIndex()); err != nil {
+			return fmt.Errorf("failed to remove keyscript configuration: %w", err)
+		}
+	}
 
 	return nil
 }
 
-func getFilesystemUUID(devicePath string) (string, error) {
+func getFilesystemUUID(ctx context.Context, devicePath string) (string, error) {
 
 	// NOTE: the 'probe' option ensures we are getting the correct UUID
 	log.Printf("Getting filesystem UUID for device: %s\n", devicePath)
-	cmd := exec.Command("blkid", "-p", "-s", "UUID", "-o", "value", devicePath)
-	output, err := cmd.CombinedOutput()
+	output, err := runRetried(ctx, OpCryptsetup, func() *trace.Cmd {
+		return trace.Command("blkid", "-p", "-s", "UUID", "-o", "value", devicePath)
+	})
 	if err != nil {
 		return "", fmt.Errorf("blkid command failed: %s, output: %s", err, string(output))
 	}
@@ -542,70 +1187,19 @@ func getFilesystemUUID(devicePath string) (string, error) {
 	return uuid, nil
 }
 
-func removeLineFromFile(filePath, token string) error {
-	// Open the original file for reading
-	file, err := os.Open(filePath)
-	if err != nil {
-		return fmt.Errorf("failed to open file %s: %v", filePath, err)
-	}
-	defer file.Close()
-
-	// Create a temporary file in the same directory as the original file
-	tempFilePath := filePath + ".tmp"
-	tempFile, err := os.Create(tempFilePath)
-	if err != nil {
-		return fmt.Errorf("failed to create temporary file: %v", err)
-	}
-	defer func() {
-		tempFile.Close()
-		os.Remove(tempFilePath) // Clean up the temp file in case of an error
-	}()
-
-	scanner := bufio.NewScanner(file)
-	writer := bufio.NewWriter(tempFile)
-
-	for scanner.Scan() {
-		line := scanner.Text()
-		if !strings.Contains(line, token) {
-			if _, err := writer.WriteString(line + "\n"); err != nil {
-				return fmt.Errorf("failed to write to temporary file: %v", err)
-			}
-		}
-	}
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("error reading file %s: %v", filePath, err)
-	}
-	if err := writer.Flush(); err != nil {
-		return fmt.Errorf("failed to flush data to temporary file: %v", err)
-	}
-
-	// Close the files before renaming
-	if err := tempFile.Close(); err != nil {
-		return fmt.Errorf("failed to close temporary file: %v", err)
-	}
-	if err := file.Close(); err != nil {
-		return fmt.Errorf("failed to close original file: %v", err)
-	}
-
-	// Replace the original file with the temporary file
-	if err := os.Rename(tempFilePath, filePath); err != nil {
-		return fmt.Errorf("failed to replace original file with temporary file: %v", err)
-	}
-
-	return nil
+// allowDiscards reports whether the mapping passes discards to the backing storage, which
+// the discard mount option asks for. dm-crypt drops them otherwise, since freed blocks
+// reveal how much of the volume is in use.
+func (cfg *LUKS) allowDiscards() bool {
+	return slices.Contains(cfg.MountOptions, "discard")
 }
 
-// appendToFile appends the given content to a file.
-func appendToFile(filePath, content string) error {
-	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_WRONLY, 0644)
+// TrimFilesystem discards unused blocks of the mounted filesystem. The mapping must
+// have been opened with discards allowed for the trim to reach the backing file.
+func TrimFilesystem(cfg *LUKS) (string, error) {
+	output, err := trace.Command("fstrim", "-v", cfg.MountPoint).CombinedOutput()
 	if err != nil {
-		return err
+		return "", fmt.Errorf("fstrim failed: %s", strings.TrimSpace(string(output)))
 	}
-	defer file.Close()
-
-	if _, err := file.WriteString(content); err != nil {
-		return err
-	}
-
-	return nil
+	return strings.TrimSpace(string(output)), nil
 }
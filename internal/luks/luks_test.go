@@ -1,8 +1,11 @@
 package luks
 
 import (
+	"context"
 	"os"
 	"os/exec"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -14,7 +17,7 @@ func TestCreateLUKSVolume(t *testing.T) {
 
 	defer os.Remove(testFile)
 
-	if err := CreateLUKSVolume(testFile, password, sizeMB, useTPM); err != nil {
+	if err := CreateLUKSVolume(context.Background(), testFile, password, sizeMB, useTPM); err != nil {
 		t.Fatalf("CreateLUKSVolume() error = %v, want nil", err)
 	}
 
@@ -36,7 +39,7 @@ func TestCreateLUKSVolumeWithTPM(t *testing.T) {
 		t.Skip("Skipping test: TPM not available on this system")
 	}
 
-	if err := CreateLUKSVolume(testFile, password, sizeMB, useTPM); err != nil {
+	if err := CreateLUKSVolume(context.Background(), testFile, password, sizeMB, useTPM); err != nil {
 		t.Fatalf("Failed to create LUKS volume with TPM: %v", err)
 	}
 
@@ -55,3 +58,50 @@ func isTPMAvailable() bool {
 	}
 	return true
 }
+
+func TestGeneratePassword(t *testing.T) {
+	password, err := GeneratePassword(context.Background(), DefaultRecoveryGroups)
+	if err != nil {
+		t.Fatalf("GeneratePassword() error = %v, want nil", err)
+	}
+
+	groups := strings.Split(password, "-")
+	if len(groups) != DefaultRecoveryGroups {
+		t.Fatalf("GeneratePassword() = %q, want %d groups", password, DefaultRecoveryGroups)
+	}
+	for _, group := range groups {
+		if len(group) != 5 || strings.Trim(group, passwordAlphabet) != "" {
+			t.Fatalf("GeneratePassword() group %q is not 5 characters of the password alphabet", group)
+		}
+	}
+}
+
+func TestVolumeNVIndex(t *testing.T) {
+	wrap, _ := strconv.ParseUint(WrapNVIndex, 0, 32)
+	selfTest, _ := strconv.ParseUint(selfTestNVIndex, 0, 32)
+	for _, name := range []string{"data", "logs", "acme-data"} {
+		index, err := strconv.ParseUint(VolumeNVIndex(name), 0, 32)
+		if err != nil {
+			t.Fatalf("VolumeNVIndex(%s) = %s, not an NV index", name, VolumeNVIndex(name))
+		}
+		// The block must hold the longest key without reaching into the reserved indices
+		if index < volumeNVBase || (index-volumeNVBase)%maxNVChunks != 0 || index+maxNVChunks > volumeNVBase+volumeNVBlocks*maxNVChunks {
+			t.Errorf("VolumeNVIndex(%s) = %s, want a block of %d indices from 0x%x", name, VolumeNVIndex(name), maxNVChunks, volumeNVBase)
+		}
+		if (wrap >= index && wrap < index+maxNVChunks) || (selfTest >= index && selfTest < index+maxNVChunks) {
+			t.Errorf("VolumeNVIndex(%s) = %s, overlaps a reserved index", name, VolumeNVIndex(name))
+		}
+	}
+	if VolumeNVIndex("data") == VolumeNVIndex("logs") {
+		t.Errorf("VolumeNVIndex() of data and logs = %s, want distinct indices", VolumeNVIndex("data"))
+	}
+}
+
+func TestKeyNVIndex(t *testing.T) {
+	if got := (&LUKS{NVIndex: VolumeNVIndex("data")}).KeyNVIndex(); got != VolumeNVIndex("data") {
+		t.Errorf("KeyNVIndex() = %s, want the index of the volume", got)
+	}
+	if got := (&LUKS{}).KeyNVIndex(); got != DefaultNVIndex {
+		t.Errorf("KeyNVIndex() = %s, want %s", got, DefaultNVIndex)
+	}
+}
@@ -0,0 +1,55 @@
+package luks
+
+import (
+	"bootstrap/internal/trace"
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// LVM backs the volume with a logical volume instead of an image file.
+type LVM struct {
+	VolumeGroup string `yaml:"volumeGroup"` // Volume group to create the logical volume in
+	Name        string `yaml:"name"`        // Logical volume name, defaults to the mapper name
+}
+
+// Enabled reports whether the volume is a logical volume.
+func (l LVM) Enabled() bool {
+	return l.VolumeGroup != ""
+}
+
+// DevicePath returns the device node of the logical volume.
+func (l LVM) DevicePath() string {
+	return "/dev/" + l.VolumeGroup + "/" + l.Name
+}
+
+var lvmName = regexp.MustCompile(`^[A-Za-z0-9+_.][A-Za-z0-9+_.-]*$`)
+
+// ValidLVMName reports whether name is usable as a volume group or logical volume name.
+func ValidLVMName(name string) bool {
+	return lvmName.MatchString(name) && name != "." && name != ".."
+}
+
+// createLogicalVolume creates the logical volume with sizeMB, wiping signatures left
+// by an earlier filesystem or LUKS header.
+func createLogicalVolume(ctx context.Context, l LVM, sizeMB int) error {
+	output, err := runRetried(ctx, OpCryptsetup, func() *trace.Cmd {
+		return trace.Command("lvcreate", "--yes", "--wipesignatures", "y",
+			"--size", strconv.Itoa(sizeMB)+"m", "--name", l.Name, l.VolumeGroup)
+	})
+	if err != nil {
+		return fmt.Errorf("lvcreate failed: %s", strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// removeLogicalVolume removes the logical volume.
+func removeLogicalVolume(ctx context.Context, l LVM) error {
+	output, err := runRetried(ctx, OpCryptsetup, func() *trace.Cmd { return trace.Command("lvremove", "--yes", l.VolumeGroup+"/"+l.Name) })
+	if err != nil {
+		return fmt.Errorf("lvremove failed: %s", strings.TrimSpace(string(output)))
+	}
+	return nil
+}
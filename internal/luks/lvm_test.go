@@ -0,0 +1,19 @@
+package luks
+
+import "testing"
+
+func TestValidLVMName(t *testing.T) {
+	for name, want := range map[string]bool{
+		"vg0":        true,
+		"udm-luks":   true,
+		"data_01.lv": true,
+		"-lv":        false,
+		"..":         false,
+		"a/b":        false,
+		"":           false,
+	} {
+		if got := ValidLVMName(name); got != want {
+			t.Errorf("ValidLVMName(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
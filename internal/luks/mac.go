@@ -0,0 +1,86 @@
+package luks
+
+import (
+	"bootstrap/internal/trace"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// appArmorSpecial are the characters AppArmor profiles treat as globbing or quoting, a
+// mount point containing them cannot be named literally in a profile rule.
+const appArmorSpecial = "*?[]{}^\"'\\,# \t"
+
+// MAC labels the mounted filesystem for mandatory access control, so confined services
+// can use it: on SELinux by mounting with a fixed context or relabeling the files after
+// mounting, on AppArmor by keeping the mount point at a path profiles can match.
+type MAC struct {
+	SELinuxContext string `yaml:"selinuxContext"` // Context of all files, mount -o context=, e.g. "system_u:object_r:container_file_t:s0"
+	Restorecon     bool   `yaml:"restorecon"`     // Relabel the files per the SELinux policy after mounting
+	AppArmorPaths  bool   `yaml:"appArmorPaths"`  // Require a mount point profiles can name, without symlinks or glob characters
+}
+
+// Validate checks the SELinux settings are not combined and the mount point satisfies
+// the AppArmor path rules that can be checked without the filesystem.
+func (m MAC) Validate(mountPoint string) error {
+	if m.SELinuxContext != "" {
+		if strings.Count(m.SELinuxContext, ":") < 2 || strings.ContainsAny(m.SELinuxContext, "\" \t") {
+			return fmt.Errorf("luks.mac.selinuxContext (%s) must be a context, e.g. system_u:object_r:container_file_t:s0", m.SELinuxContext)
+		}
+		if m.Restorecon {
+			return fmt.Errorf("luks.mac.restorecon cannot relabel a filesystem mounted with luks.mac.selinuxContext")
+		}
+	}
+	if m.AppArmorPaths {
+		if strings.ContainsAny(mountPoint, appArmorSpecial) {
+			return fmt.Errorf("luks.mountPoint (%s) contains characters AppArmor profiles treat as patterns (%s)", mountPoint, appArmorSpecial)
+		}
+		if filepath.Clean(mountPoint) != mountPoint {
+			return fmt.Errorf("luks.mountPoint (%s) must be written as %s for AppArmor profiles to match it", mountPoint, filepath.Clean(mountPoint))
+		}
+	}
+	return nil
+}
+
+// mountOptions returns the options the volume is mounted with, luks.mountOptions, ro
+// with luks.readOnly and the SELinux context. Contexts with MLS categories contain commas and are quoted.
+func mountOptions(cfg *LUKS) []string {
+	options := append([]string{}, cfg.MountOptions...)
+	if cfg.ReadOnly {
+		options = append(options, "ro")
+	}
+	if context := cfg.MAC.SELinuxContext; context != "" {
+		if strings.Contains(context, ",") {
+			context = `"` + context + `"`
+		}
+		options = append(options, "context="+context)
+	}
+	return options
+}
+
+// checkAppArmorPath fails when the mount point is reached through a symlink, AppArmor
+// mediates the resolved path so profile rules naming the configured one never match.
+func checkAppArmorPath(cfg *LUKS) error {
+	if !cfg.MAC.AppArmorPaths {
+		return nil
+	}
+	resolved, err := filepath.EvalSymlinks(cfg.MountPoint)
+	if err != nil {
+		return fmt.Errorf("failed to resolve mount point: %w", err)
+	}
+	if resolved != cfg.MountPoint {
+		return fmt.Errorf("mount point %s resolves to %s, AppArmor profiles match the resolved path, set luks.mountPoint to it", cfg.MountPoint, resolved)
+	}
+	return nil
+}
+
+// relabel restores the SELinux labels of the mounted files per the policy.
+func relabel(cfg *LUKS) error {
+	if !cfg.MAC.Restorecon {
+		return nil
+	}
+	if output, err := trace.Command("restorecon", "-R", "-F", cfg.MountPoint).CombinedOutput(); err != nil {
+		return fmt.Errorf("restorecon failed: %s", strings.TrimSpace(string(output)))
+	}
+	return nil
+}
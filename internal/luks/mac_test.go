@@ -0,0 +1,38 @@
+package luks
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMACValidate(t *testing.T) {
+	tests := []struct {
+		mac        MAC
+		mountPoint string
+		wantErr    bool
+	}{
+		{MAC{SELinuxContext: "system_u:object_r:container_file_t:s0"}, "/mnt/udm", false},
+		{MAC{SELinuxContext: "container_file_t"}, "/mnt/udm", true},
+		{MAC{SELinuxContext: "system_u:object_r:container_file_t:s0", Restorecon: true}, "/mnt/udm", true},
+		{MAC{AppArmorPaths: true}, "/mnt/udm-luks", false},
+		{MAC{AppArmorPaths: true}, "/mnt/udm data", true},
+		{MAC{AppArmorPaths: true}, "/mnt/udm/", true},
+		{MAC{AppArmorPaths: true}, "/mnt/{a,b}", true},
+	}
+	for _, tt := range tests {
+		if err := tt.mac.Validate(tt.mountPoint); (err != nil) != tt.wantErr {
+			t.Errorf("Validate(%+v, %q) error = %v, wantErr %v", tt.mac, tt.mountPoint, err, tt.wantErr)
+		}
+	}
+}
+
+func TestMountOptions(t *testing.T) {
+	cfg := &LUKS{MountOptions: []string{"nodev"}, MAC: MAC{SELinuxContext: "system_u:object_r:svirt_sandbox_file_t:s0:c1,c2"}}
+	want := []string{"nodev", `context="system_u:object_r:svirt_sandbox_file_t:s0:c1,c2"`}
+	if got := mountOptions(cfg); !reflect.DeepEqual(got, want) {
+		t.Errorf("mountOptions() = %q, want %q", got, want)
+	}
+	if len(cfg.MountOptions) != 1 {
+		t.Errorf("mountOptions() modified luks.mountOptions: %q", cfg.MountOptions)
+	}
+}
@@ -0,0 +1,154 @@
+package luks
+
+import (
+	"bootstrap/internal/secrets"
+	"bootstrap/internal/trace"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	NVAuthNone     = "none"     // Readable by any local user, kept for existing volumes
+	NVAuthPassword = "password" // Auth value derived from a root-only secret file
+	NVAuthPCR      = "pcr"      // Readable only while the PCRs hold their enrollment values
+
+	// KeyscriptConfigDir tells the boot keyscript how to read the key of every volume, in
+	// a file named after the NV index crypttab passes to it.
+	KeyscriptConfigDir = "/etc/udm/keyscript.d"
+)
+
+// NVAuth protects the NV indices holding keys against reads by other local users.
+type NVAuth struct {
+	Mode       string `yaml:"mode"`       // none, password or pcr
+	SecretFile string `yaml:"secretFile"` // password: file the per-index auth values are derived from
+	PCRs       string `yaml:"pcrs"`       // pcr: PCR selection of the read policy, e.g. "sha256:7"
+}
+
+// nvAuthDir holds the files passing auth values to tpm2-tools. It is a tmpfs, the values
+// never reach a disk.
+var nvAuthDir = "/run"
+
+// authValue derives the auth value of index from the secret, so every index has its own
+// value: HMAC-SHA256(secret, index).
+func (a NVAuth) authValue(index string) ([]byte, error) {
+	secret, err := os.ReadFile(a.SecretFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read NV auth secret: %w", err)
+	}
+	defer secrets.Wipe(secret)
+	trimmed := bytes.TrimSpace(secret)
+	if len(trimmed) == 0 {
+		return nil, fmt.Errorf("NV auth secret %s is empty", a.SecretFile)
+	}
+	mac := hmac.New(sha256.New, trimmed)
+	mac.Write([]byte(index))
+	return mac.Sum(nil), nil
+}
+
+// authArg writes the auth value of index to a file only root can read and returns the
+// tpm2-tools option reading it from there. Passed on the command line, the value could be
+// read by any local user from /proc while the command runs. The returned cleanup removes
+// the file.
+func (a NVAuth) authArg(option, index string) (string, func(), error) {
+	cleanup := func() {}
+	auth, err := a.authValue(index)
+	if err != nil {
+		return "", cleanup, err
+	}
+	defer secrets.Wipe(auth)
+	dir, err := os.MkdirTemp(nvAuthDir, "udm-nvauth-")
+	if err != nil {
+		return "", cleanup, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	cleanup = func() { os.RemoveAll(dir) }
+	path := filepath.Join(dir, "auth")
+	if err := os.WriteFile(path, auth, 0600); err != nil {
+		cleanup()
+		return "", func() {}, fmt.Errorf("failed to write NV auth value: %w", err)
+	}
+	return option + "=file:" + path, cleanup, nil
+}
+
+// defineArgs returns the tpm2_nvdefine arguments protecting index. Owner read is never
+// granted to protected indices, the owner hierarchy usually has an empty auth value.
+// The returned cleanup removes temporary auth and policy files.
+func (a NVAuth) defineArgs(ctx context.Context, index string) ([]string, func(), error) {
+	cleanup := func() {}
+	switch a.Mode {
+	case NVAuthPassword:
+		auth, cleanup, err := a.authArg("--index-auth", index)
+		if err != nil {
+			return nil, cleanup, err
+		}
+		return []string{auth, "--attributes=authread|authwrite"}, cleanup, nil
+	case NVAuthPCR:
+		dir, err := os.MkdirTemp("", "nv-policy-*")
+		if err != nil {
+			return nil, cleanup, fmt.Errorf("failed to create temporary directory: %w", err)
+		}
+		cleanup = func() { os.RemoveAll(dir) }
+		policy := filepath.Join(dir, "policy.dat")
+		if output, err := runRetried(ctx, OpTPM, func() *trace.Cmd {
+			return trace.Command("tpm2_createpolicy", "--policy-pcr", "--pcr-list="+a.PCRs, "--policy="+policy)
+		}); err != nil {
+			return nil, cleanup, fmt.Errorf("failed to create PCR policy: %s", output)
+		}
+		return []string{"--policy=" + policy, "--attributes=policyread|policywrite"}, cleanup, nil
+	default:
+		return []string{"--attributes=ownerread|ownerwrite|authread|authwrite"}, cleanup, nil
+	}
+}
+
+// accessArgs returns the tpm2_nvread and tpm2_nvwrite arguments authorizing access to
+// index. The returned cleanup removes the temporary auth file.
+func (a NVAuth) accessArgs(index string) ([]string, func(), error) {
+	switch a.Mode {
+	case NVAuthPassword:
+		auth, cleanup, err := a.authArg("--auth", index)
+		if err != nil {
+			return nil, cleanup, err
+		}
+		return []string{auth}, cleanup, nil
+	case NVAuthPCR:
+		return []string{"--auth=pcr:" + a.PCRs}, func() {}, nil
+	default:
+		return nil, func() {}, nil
+	}
+}
+
+// keyscriptConfigPath returns the keyscript settings file of the volume keeping its key at
+// nvIndex.
+func keyscriptConfigPath(nvIndex string) string {
+	return filepath.Join(KeyscriptConfigDir, nvIndex+".conf")
+}
+
+// writeKeyscriptConfig records the NV auth settings and the size of the key at nvIndex for
+// the boot keyscript, which cannot read the volume configuration, and where a TPM 1.2
+// keeps the sealed key. The size spares the keyscript probing indices that may belong to
+// another volume.
+func (a NVAuth) writeKeyscriptConfig(nvIndex string, size int) error {
+	content := fmt.Sprintf("SIZE=%d\n", size)
+	if tpm1Selected() {
+		content += fmt.Sprintf("TPM_VERSION=%q\nTPM1_BLOB=%q\n", TPMVersion12, tpm1BlobPath(nvIndex))
+	} else if a.Mode != "" && a.Mode != NVAuthNone {
+		content += fmt.Sprintf("NV_AUTH_MODE=%q\nNV_AUTH_SECRET_FILE=%q\nNV_AUTH_PCRS=%q\n", a.Mode, a.SecretFile, a.PCRs)
+	}
+	if err := os.MkdirAll(KeyscriptConfigDir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", KeyscriptConfigDir, err)
+	}
+	return os.WriteFile(keyscriptConfigPath(nvIndex), []byte(content), 0600)
+}
+
+// removeKeyscriptConfig removes the keyscript settings of the volume keeping its key at
+// nvIndex.
+func removeKeyscriptConfig(nvIndex string) error {
+	if err := os.Remove(keyscriptConfigPath(nvIndex)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package luks
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNVAuthValuePerIndex(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "nv.secret")
+	if err := os.WriteFile(secret, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	auth := NVAuth{Mode: NVAuthPassword, SecretFile: secret}
+
+	first, err := auth.authValue("0x1500016")
+	if err != nil {
+		t.Fatalf("authValue() error = %v, want nil", err)
+	}
+	again, _ := auth.authValue("0x1500016")
+	other, _ := auth.authValue("0x1500017")
+	if !bytes.Equal(first, again) {
+		t.Fatalf("authValue() is not deterministic: %x != %x", first, again)
+	}
+	if bytes.Equal(first, other) {
+		t.Fatalf("authValue() is the same for different indices: %x", first)
+	}
+
+	// The auth value is passed in a file, never on the command line
+	nvAuthDir = t.TempDir()
+	defer func() { nvAuthDir = "/run" }()
+	args, cleanup, err := auth.accessArgs("0x1500016")
+	if err != nil || len(args) != 1 || !strings.HasPrefix(args[0], "--auth=file:") {
+		t.Fatalf("accessArgs() = %v, %v, want an auth file", args, err)
+	}
+	path := strings.TrimPrefix(args[0], "--auth=file:")
+	if data, err := os.ReadFile(path); err != nil || !bytes.Equal(data, first) {
+		t.Errorf("auth file holds %x, %v, want %x", data, err, first)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("auth file mode = %v, %v, want 0600", info.Mode().Perm(), err)
+	}
+	cleanup()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("auth file still exists after cleanup: %v", err)
+	}
+}
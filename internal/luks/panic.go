@@ -0,0 +1,73 @@
+package luks
+
+import (
+	"bootstrap/internal/trace"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Panic configures the wipe-on-tamper trigger of udm panic and the daemon.
+type Panic struct {
+	Signal  bool `yaml:"signal"`  // udm daemon wipes the volume on SIGUSR2
+	Discard bool `yaml:"discard"` // Also discard the blocks of the backing storage
+}
+
+// PanicErase renders the volume unrecoverable as fast as possible, for an intrusion detection
+// system reacting to tampering: the volume key is dropped from kernel memory, the
+// keyslots are erased and the key is removed from the TPM before the volume is detached.
+// Every step is attempted even if earlier ones fail, the errors are returned together.
+// Processes using the mount point are not waited for, their I/O fails from then on.
+func PanicErase(ctx context.Context, cfg *LUKS, discard bool) error {
+	var errs []error
+	device := "/dev/mapper/" + cfg.MapperName
+	if _, err := os.Stat(device); err == nil {
+		// Suspending wipes the volume key from the kernel, so a memory dump taken
+		// after this point cannot decrypt the ciphertext either
+		fmt.Println("Suspending LUKS volume ...")
+		if output, err := runOnce(ctx, OpCryptsetup, trace.Command("cryptsetup", "luksSuspend", cfg.MapperName)); err != nil {
+			errs = append(errs, fmt.Errorf("failed to suspend volume: %s", output))
+		}
+	}
+
+	if err := eraseKeyslots(ctx, cfg.VolumePath); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.UseTPM {
+		fmt.Println("Removing password from TPM ...")
+		if err := removePasswordFromTPM(ctx, cfg.KeyNVIndex(), cfg.nvKeySize()); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := ForgetCachedKey(cfg); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.Vault.Wrapped() {
+		// The KV secret is revoked centrally, the device may well be offline
+		if err := removeFromVault(cfg); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if _, err := os.Stat(device); err == nil {
+		fmt.Println("Detaching LUKS volume ...")
+		for _, b := range cfg.BindMounts {
+			runRetried(ctx, OpMount, func() *trace.Cmd { return trace.Command("umount", "--lazy", b.Target) })
+		}
+		runRetried(ctx, OpMount, func() *trace.Cmd { return trace.Command("umount", "--lazy", cfg.MountPoint) })
+		if _, err := runOnce(ctx, OpCryptsetup, trace.Command("cryptsetup", "close", cfg.MapperName)); err != nil {
+			// Still held open, replace the mapping with one failing all I/O
+			if output, err := runOnce(ctx, OpCryptsetup, trace.Command("dmsetup", "remove", "--force", cfg.MapperName)); err != nil {
+				errs = append(errs, fmt.Errorf("failed to remove mapping: %s", output))
+			}
+		}
+	}
+
+	if discard {
+		if err := discardBlocks(cfg.VolumePath); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
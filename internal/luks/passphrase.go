@@ -0,0 +1,112 @@
+package luks
+
+import (
+	"bootstrap/internal/secrets"
+	"bootstrap/internal/trace"
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// maxPassphraseAttempts bounds how often EnrollPassphrase asks again after a rejected or
+// mistyped passphrase.
+const maxPassphraseAttempts = 3
+
+// AskPassphrase prompts for a passphrase through systemd-ask-password, which also
+// reaches password agents during boot and in services. Without it the passphrase is
+// read from the terminal with echo disabled.
+func AskPassphrase(cfg *LUKS, prompt string) ([]byte, error) {
+	var data []byte
+	if path, err := exec.LookPath("systemd-ask-password"); err == nil {
+		cmd := trace.Command(path, "--id=udm:"+cfg.MapperName, "--timeout=0", prompt)
+		cmd.Stdin = os.Stdin
+		cmd.Stderr = os.Stderr
+		if data, err = cmd.Output(); err != nil {
+			return nil, fmt.Errorf("systemd-ask-password error: %w", err)
+		}
+	} else {
+		if data, err = readTerminalPassphrase(prompt); err != nil {
+			return nil, err
+		}
+	}
+	defer secrets.Wipe(data)
+
+	passphrase := bytes.TrimRight(data, "\r\n")
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("no passphrase entered")
+	}
+	buf, err := secrets.FromBytes(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// readTerminalPassphrase reads a line from the controlling terminal with echo disabled.
+func readTerminalPassphrase(prompt string) ([]byte, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("no terminal to ask for the passphrase: %w", err)
+	}
+	defer tty.Close()
+
+	stty := func(arg string) error {
+		cmd := trace.Command("stty", arg)
+		cmd.Stdin = tty
+		return cmd.Run()
+	}
+	if err := stty("-echo"); err != nil {
+		return nil, fmt.Errorf("failed to disable terminal echo: %w", err)
+	}
+	defer stty("echo")
+
+	fmt.Fprint(tty, prompt+" ")
+	line, err := bufio.NewReader(tty).ReadBytes('\n')
+	fmt.Fprintln(tty)
+	if err != nil {
+		secrets.Wipe(line)
+		return nil, fmt.Errorf("failed to read passphrase: %w", err)
+	}
+	return line, nil
+}
+
+// EnrollPassphrase asks for a passphrase twice and enrolls it in a secondary keyslot,
+// authorized by the machine key, so an operator can unlock the volume when the keyfile
+// or TPM is unavailable. The passphrase must meet the password policy.
+func EnrollPassphrase(ctx context.Context, cfg *LUKS) error {
+	prompt := fmt.Sprintf("Passphrase for %s:", cfg.MapperName)
+	for attempt := 0; attempt < maxPassphraseAttempts; attempt++ {
+		passphrase, err := AskPassphrase(cfg, prompt)
+		if err != nil {
+			return err
+		}
+		if err := CheckKeyMaterial(passphrase); err != nil {
+			fmt.Fprintf(os.Stderr, "Passphrase rejected: %v\n", err)
+			secrets.Wipe(passphrase)
+			continue
+		}
+		confirm, err := AskPassphrase(cfg, "Repeat the passphrase:")
+		if err != nil {
+			secrets.Wipe(passphrase)
+			return err
+		}
+		match := bytes.Equal(passphrase, confirm)
+		secrets.Wipe(confirm)
+		if !match {
+			fmt.Fprintln(os.Stderr, "Passphrases do not match")
+			secrets.Wipe(passphrase)
+			continue
+		}
+
+		err = AddKeyslot(ctx, cfg, passphrase, -1)
+		secrets.Wipe(passphrase)
+		if err != nil {
+			return fmt.Errorf("failed to enroll passphrase: %w", err)
+		}
+		return nil
+	}
+	return fmt.Errorf("no acceptable passphrase entered in %d attempts", maxPassphraseAttempts)
+}
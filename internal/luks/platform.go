@@ -0,0 +1,21 @@
+package luks
+
+import (
+	"bootstrap/internal/platform"
+	"os"
+)
+
+// ErrUnsupportedPlatform is returned by volume operations on systems other than Linux.
+var ErrUnsupportedPlatform = platform.ErrUnsupportedPlatform
+
+// system provides the operating system specifics of volume operations. Linux drives
+// device-mapper, loop devices and the TPM; elsewhere the stub rejects every operation
+// so the configuration types can still be used.
+type system interface {
+	// supported returns ErrUnsupportedPlatform where volumes cannot be managed.
+	supported() error
+	// deviceNumber returns the device number of a device node.
+	deviceNumber(info os.FileInfo) (uint64, bool)
+	// owner returns the owning user and group ids of a file.
+	owner(info os.FileInfo) (uid, gid uint32, ok bool)
+}
@@ -0,0 +1,30 @@
+package luks
+
+import (
+	"os"
+	"syscall"
+)
+
+var host system = linuxSystem{}
+
+type linuxSystem struct{}
+
+func (linuxSystem) supported() error {
+	return nil
+}
+
+func (linuxSystem) deviceNumber(info os.FileInfo) (uint64, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return st.Rdev, true
+}
+
+func (linuxSystem) owner(info os.FileInfo) (uint32, uint32, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return st.Uid, st.Gid, true
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package luks
+
+import "os"
+
+var host system = unsupportedSystem{}
+
+type unsupportedSystem struct{}
+
+func (unsupportedSystem) supported() error {
+	return ErrUnsupportedPlatform
+}
+
+func (unsupportedSystem) deviceNumber(info os.FileInfo) (uint64, bool) {
+	return 0, false
+}
+
+func (unsupportedSystem) owner(info os.FileInfo) (uint32, uint32, bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,153 @@
+package luks
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// MaxCharClasses is the number of character classes: lower case, upper case, digits and
+// symbols.
+const MaxCharClasses = 4
+
+// maxGenerateAttempts bounds how often a generated password rejected by the policy is
+// drawn again, e.g. for lacking a digit.
+const maxGenerateAttempts = 16
+
+// PasswordPolicy is the strength required of generated keys and of keys and passphrases
+// supplied by operators.
+type PasswordPolicy struct {
+	MinKeyEntropy        int // Minimum estimated bits of binary keys
+	MinPassphraseEntropy int // Minimum estimated bits of passphrases
+	MinCharClasses       int // Character classes a passphrase must mix
+	denied               map[string]bool
+}
+
+// KeyStrength is the measured strength of a key or passphrase.
+type KeyStrength struct {
+	Kind     string  `json:"kind"` // "key" or "passphrase"
+	Entropy  float64 `json:"entropy"`
+	Required int     `json:"required"`
+	Classes  int     `json:"classes,omitempty"`
+	Denied   bool    `json:"denied,omitempty"`
+	Problem  string  `json:"problem,omitempty"` // Why the policy rejects it, "" when accepted
+}
+
+var (
+	policyMu       sync.Mutex
+	passwordPolicy = PasswordPolicy{MinKeyEntropy: DefaultMinKeyEntropy, MinPassphraseEntropy: DefaultMinPassphraseEntropy}
+)
+
+// NewPasswordPolicy returns the policy of a validated configuration, reading its
+// deny-list file.
+func NewPasswordPolicy(cfg *LUKS) (PasswordPolicy, error) {
+	p := PasswordPolicy{
+		MinKeyEntropy:        cfg.MinKeyEntropy,
+		MinPassphraseEntropy: cfg.MinPassphraseEntropy,
+		MinCharClasses:       cfg.MinCharClasses,
+		denied:               map[string]bool{},
+	}
+	if cfg.DenyList == "" {
+		return p, nil
+	}
+
+	f, err := os.Open(cfg.DenyList)
+	if err != nil {
+		return p, fmt.Errorf("failed to read deny-list: %w", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			p.denied[normalizePassphrase(line)] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return p, fmt.Errorf("failed to read deny-list: %w", err)
+	}
+	return p, nil
+}
+
+// SetPasswordPolicy installs the policy applied by GenerateLUKSKey, GeneratePassword and
+// CheckKeyMaterial.
+func SetPasswordPolicy(p PasswordPolicy) {
+	policyMu.Lock()
+	defer policyMu.Unlock()
+	passwordPolicy = p
+}
+
+func currentPasswordPolicy() PasswordPolicy {
+	policyMu.Lock()
+	defer policyMu.Unlock()
+	return passwordPolicy
+}
+
+// normalizePassphrase folds case and common substitutions, so deny-list entries match
+// their variants.
+func normalizePassphrase(s string) string {
+	return leetReplacer.Replace(strings.ToLower(s))
+}
+
+// charClasses counts the character classes s mixes. Characters outside ASCII count as
+// symbols, spaces as none.
+func charClasses(s string) int {
+	set := classifyChars([]rune(s))
+	n := 0
+	for _, in := range []bool{set.lower, set.upper, set.digit, set.symbol || set.other} {
+		if in {
+			n++
+		}
+	}
+	return n
+}
+
+// isPassphrase reports whether key is printable text, measured as a passphrase rather
+// than as binary key material.
+func isPassphrase(key []byte) bool {
+	for _, b := range key {
+		if b < 0x20 || b > 0x7e {
+			return false
+		}
+	}
+	return len(key) > 0
+}
+
+// Measure estimates the strength of key, as a passphrase when it is printable.
+func (p PasswordPolicy) Measure(key []byte) KeyStrength {
+	if !isPassphrase(key) {
+		s := KeyStrength{Kind: "key", Entropy: EstimateKeyEntropy(key), Required: p.MinKeyEntropy}
+		if s.Entropy < float64(p.MinKeyEntropy) {
+			s.Problem = fmt.Sprintf("key has an estimated %.0f bits of entropy, policy requires %d", s.Entropy, p.MinKeyEntropy)
+		}
+		return s
+	}
+
+	passphrase := string(key)
+	s := KeyStrength{
+		Kind:     "passphrase",
+		Entropy:  EstimatePassphraseEntropy(passphrase),
+		Required: p.MinPassphraseEntropy,
+		Classes:  charClasses(passphrase),
+		Denied:   p.denied[normalizePassphrase(passphrase)],
+	}
+	switch {
+	case s.Denied:
+		s.Problem = "passphrase is on the deny-list"
+	case s.Classes < p.MinCharClasses:
+		s.Problem = fmt.Sprintf("passphrase mixes %d character classes, policy requires %d", s.Classes, p.MinCharClasses)
+	case s.Entropy < float64(p.MinPassphraseEntropy):
+		s.Problem = fmt.Sprintf("passphrase has an estimated %.0f bits of entropy, policy requires %d", s.Entropy, p.MinPassphraseEntropy)
+	}
+	return s
+}
+
+// Check rejects key material that does not meet the policy.
+func (p PasswordPolicy) Check(key []byte) error {
+	if s := p.Measure(key); s.Problem != "" {
+		return fmt.Errorf("%w: %s", ErrWeakKey, s.Problem)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package luks
+
+import (
+	"bootstrap/internal/features"
+	"bootstrap/internal/trace"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// privateDropIn is the name of the drop-in mounting the volume in the service's namespace.
+const privateDropIn = "udm-private.conf"
+
+// PrivateMount mounts the volume only in the mount namespace of one systemd service, so
+// its cleartext is not visible under the mount point to the rest of the system. mount
+// opens the volume and installs a drop-in making the service mount it when it starts.
+type PrivateMount struct {
+	Unit string `yaml:"unit"` // Service owning the mount, e.g. "postgresql.service"
+}
+
+// Enabled reports whether the volume is mounted privately.
+func (p PrivateMount) Enabled() bool {
+	return p.Unit != ""
+}
+
+// Validate checks the unit is a service, only services have a mount namespace of their own.
+func (p PrivateMount) Validate() error {
+	if p.Enabled() && !strings.HasSuffix(p.Unit, ".service") {
+		return fmt.Errorf("luks.private.unit (%s) must be a .service unit", p.Unit)
+	}
+	return nil
+}
+
+// privateDropInContent returns the drop-in of the service. PrivateMounts= gives it a mount
+// namespace, and the "!" commands run as root inside it, so the mount never reaches the
+// host. BindsTo= stops the service when the volume is closed.
+func privateDropInContent(cfg *LUKS, deviceUnit string) string {
+	device := "/dev/mapper/" + cfg.MapperName
+	mountArgs := device + " " + cfg.MountPoint
+	if options := mountOptions(cfg); len(options) > 0 {
+		mountArgs = "-o " + strings.Join(options, ",") + " " + mountArgs
+	}
+	content := fmt.Sprintf(`[Unit]
+BindsTo=%s
+After=%s
+
+[Service]
+PrivateMounts=yes
+ExecStartPre=!/bin/mkdir -p %s
+ExecStartPre=!/bin/mount %s
+ExecStartPre=!/bin/chown %s:%s %s
+`, deviceUnit, deviceUnit, cfg.MountPoint, mountArgs, cfg.User, cfg.Group, cfg.MountPoint)
+	if cfg.MAC.Restorecon {
+		content += "ExecStartPre=!/sbin/restorecon -R -F " + cfg.MountPoint + "\n"
+	}
+	return content
+}
+
+// privateDropInDir returns the drop-in directory of the service.
+func privateDropInDir(cfg *LUKS) string {
+	return filepath.Join("/etc/systemd/system", cfg.Private.Unit+".d")
+}
+
+// mountPrivate installs the drop-in of the service and restarts it when running, so it
+// mounts the opened volume in its namespace. A stopped service mounts it when started.
+func mountPrivate(cfg *LUKS) error {
+	if !cfg.Features.Enabled(features.SystemdUnits) {
+		return fmt.Errorf("private mounts require feature %s", features.SystemdUnits)
+	}
+	if cfg.User == "" || cfg.Group == "" {
+		return fmt.Errorf("user and group must be specified")
+	}
+	output, err := trace.Command("systemd-escape", "--path", "--suffix=device", "/dev/mapper/"+cfg.MapperName).Output()
+	if err != nil {
+		return fmt.Errorf("systemd-escape failed: %w", err)
+	}
+	dir := privateDropInDir(cfg)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create drop-in directory: %w", err)
+	}
+	content := privateDropInContent(cfg, strings.TrimSpace(string(output)))
+	if err := os.WriteFile(filepath.Join(dir, privateDropIn), []byte(content), 0644); err != nil {
+		return fmt.Errorf("failed to write drop-in: %w", err)
+	}
+	if err := reloadSystemd(); err != nil {
+		return err
+	}
+
+	if !unitActive(cfg.Private.Unit) {
+		fmt.Printf("Volume opened, %s mounts it on %s when started\n", cfg.Private.Unit, cfg.MountPoint)
+		return nil
+	}
+	fmt.Printf("Restarting %s to mount the volume in its namespace...\n", cfg.Private.Unit)
+	if output, err := trace.Command("systemctl", "restart", cfg.Private.Unit).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to restart %s: %s", cfg.Private.Unit, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// releasePrivate stops the service holding the private mount, which releases the volume
+// with its namespace. Without killUsers a running service is reported as using it.
+func releasePrivate(cfg *LUKS, killUsers bool) error {
+	if !unitActive(cfg.Private.Unit) {
+		return nil
+	}
+	if !killUsers {
+		return fmt.Errorf("volume is mounted privately by %s, stop it first or use --kill-users", cfg.Private.Unit)
+	}
+	fmt.Println("Stopping", cfg.Private.Unit)
+	if output, err := trace.Command("systemctl", "stop", cfg.Private.Unit).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to stop %s: %s", cfg.Private.Unit, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// removePrivateDropIn removes the drop-in installed by mountPrivate, once the volume is gone.
+func removePrivateDropIn(cfg *LUKS) error {
+	dir := privateDropInDir(cfg)
+	if err := os.Remove(filepath.Join(dir, privateDropIn)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove drop-in: %w", err)
+	}
+	os.Remove(dir) // only succeeds when no other drop-ins remain
+	return reloadSystemd()
+}
+
+// unitActive reports whether systemd runs the unit.
+func unitActive(unit string) bool {
+	return trace.Command("systemctl", "is-active", "--quiet", unit).Run() == nil
+}
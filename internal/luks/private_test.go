@@ -0,0 +1,30 @@
+package luks
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPrivateDropInContent(t *testing.T) {
+	cfg := &LUKS{MapperName: "udm-luks", MountPoint: "/srv/db", User: "postgres", Group: "postgres", MountOptions: []string{"nodev", "nosuid"}}
+	content := privateDropInContent(cfg, "dev-mapper-udm\\x2dluks.device")
+	for _, want := range []string{
+		"BindsTo=dev-mapper-udm\\x2dluks.device\n",
+		"PrivateMounts=yes\n",
+		"ExecStartPre=!/bin/mount -o nodev,nosuid /dev/mapper/udm-luks /srv/db\n",
+		"ExecStartPre=!/bin/chown postgres:postgres /srv/db\n",
+	} {
+		if !strings.Contains(content, want) {
+			t.Errorf("drop-in lacks %q:\n%s", want, content)
+		}
+	}
+}
+
+func TestPrivateMountValidate(t *testing.T) {
+	if err := (PrivateMount{Unit: "postgresql.service"}).Validate(); err != nil {
+		t.Errorf("Validate() = %v, want nil", err)
+	}
+	if err := (PrivateMount{Unit: "backup.timer"}).Validate(); err == nil {
+		t.Error("Validate() accepted a timer unit")
+	}
+}
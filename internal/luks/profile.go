@@ -0,0 +1,221 @@
+package luks
+
+import (
+	"bootstrap/internal/features"
+	"bootstrap/internal/secrets"
+	"bootstrap/internal/trace"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Profiles selecting what luks.profile provisions.
+const (
+	ProfileData = "data" // LUKS volume with a filesystem, the default
+	ProfileSwap = "swap" // Encrypted swap, plain dm-crypt with a new random key at every setup
+	ProfileTmp  = "tmp"  // Encrypted scratch filesystem, plain dm-crypt with a new random key at every setup
+)
+
+// SwapMountPoint is the fstab mount point of swap, which is not mounted anywhere.
+const SwapMountPoint = "none"
+
+// StableDeviceDirs hold the device links that keep naming the same partition when disks
+// are renumbered, required by plain volumes which have no header to be found by.
+var StableDeviceDirs = []string{"/dev/disk/by-id/", "/dev/disk/by-partuuid/", "/dev/disk/by-partlabel/"}
+
+// StableDevicePath reports whether path is a link in one of StableDeviceDirs.
+func StableDevicePath(path string) bool {
+	for _, dir := range StableDeviceDirs {
+		if strings.HasPrefix(path, dir) && len(path) > len(dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// Plain reports whether the profile maps the volume with plain dm-crypt. Without a LUKS
+// header there are no keyslots to attack or erase, the random key only lives in the
+// kernel while the mapping is open.
+func (cfg *LUKS) Plain() bool {
+	return cfg.Profile == ProfileSwap || cfg.Profile == ProfileTmp
+}
+
+// setupPlainVolume maps the volume with a random key and activates it as swap or mounts
+// a new filesystem for temporary files.
+func setupPlainVolume(ctx context.Context, cfg *LUKS) error {
+	tx := &transaction{}
+	defer tx.rollback()
+
+	if isImageFile(cfg) && !fileExists(cfg.VolumePath) {
+		if err := createSparseFile(cfg.VolumePath, cfg.Size); err != nil {
+			return err
+		}
+		tx.onRollback("remove "+cfg.VolumePath, func() error { return os.Remove(cfg.VolumePath) })
+	}
+
+	if err := progress.step(stepOpen, func() error { return openPlain(ctx, cfg) }); err != nil {
+		return fmt.Errorf("failed to open %s volume: %w", cfg.Profile, err)
+	}
+	tx.onRollback("close mapper "+cfg.MapperName, func() error {
+		return CloseLUKSVolume(ctx, cfg.MapperName)
+	})
+
+	devicePath := "/dev/mapper/" + cfg.MapperName
+	if cfg.Profile == ProfileSwap {
+		if output, err := runRetried(ctx, OpMount, func() *trace.Cmd { return trace.Command("mkswap", devicePath) }); err != nil {
+			return fmt.Errorf("mkswap failed: %s", strings.TrimSpace(string(output)))
+		}
+		if output, err := runRetried(ctx, OpMount, func() *trace.Cmd { return trace.Command("swapon", devicePath) }); err != nil {
+			return fmt.Errorf("swapon failed: %s", strings.TrimSpace(string(output)))
+		}
+		tx.commit()
+		return nil
+	}
+
+	if err := progress.step(stepFormat, func() error {
+		return FormatLUKSVolume(ctx, cfg.MapperName)
+	}); err != nil {
+		return fmt.Errorf("failed to format %s volume: %w", cfg.Profile, err)
+	}
+	if err := progress.step(stepMount, func() error {
+		return MountLUKSVolume(ctx, cfg)
+	}); err != nil {
+		return fmt.Errorf("failed to mount %s volume: %w", cfg.Profile, err)
+	}
+	// Shared by all users like /tmp, the sticky bit keeps them from removing each
+	// other's files
+	if err := os.Chmod(cfg.MountPoint, os.ModeSticky|0777); err != nil {
+		return fmt.Errorf("failed to set permissions of %s: %w", cfg.MountPoint, err)
+	}
+	tx.commit()
+	return nil
+}
+
+// openPlain maps the volume with plain dm-crypt and a random key written to cryptsetup
+// through a pipe, so the key never touches the storage.
+func openPlain(ctx context.Context, cfg *LUKS) error {
+	buf, err := secrets.New(cfg.KeySize / 8)
+	if err != nil {
+		return err
+	}
+	key := buf.Bytes()
+	defer secrets.Wipe(key)
+	random, err := GenerateLUKSKey(ctx, len(key))
+	if err != nil {
+		return fmt.Errorf("failed to generate key: %w", err)
+	}
+	copy(key, random)
+	secrets.Wipe(random)
+
+	args := []string{"open", "--type=plain", "--batch-mode", "--cipher=" + cfg.Cipher, "--key-size=" + strconv.Itoa(cfg.KeySize), "--key-file=-"}
+	if cfg.allowDiscards() {
+		args = append(args, "--allow-discards")
+	}
+	return openDevice(ctx, cfg.VolumePath, func(device string) error {
+		output, err := runRetried(ctx, OpCryptsetup, func() *trace.Cmd {
+			cmd := trace.Command("cryptsetup", append(args, device, cfg.MapperName)...)
+			cmd.Stdin = createPasswordInput(key, false)
+			return cmd
+		})
+		if err != nil {
+			return fmt.Errorf("cryptsetup open failed: %s", strings.TrimSpace(string(output)))
+		}
+		return nil
+	})
+}
+
+// deactivatePlain turns off the swap or unmounts the filesystem of a plain volume, then
+// closes the mapping, which discards the key and with it the data.
+func deactivatePlain(ctx context.Context, cfg *LUKS) error {
+	devicePath := "/dev/mapper/" + cfg.MapperName
+	if cfg.Profile == ProfileSwap {
+		fmt.Println("Turning off swap ...")
+		// Paging everything back in takes as long as swap is full, it is only killed with ctx
+		if output, err := trace.CommandContext(ctx, "swapoff", devicePath).CombinedOutput(); err != nil {
+			return fmt.Errorf("swapoff failed: %s", strings.TrimSpace(string(output)))
+		}
+	} else {
+		if err := checkInUse(cfg.MountPoint, cfg.KillUsers); err != nil {
+			return err
+		}
+		fmt.Println("Unmounting LUKS volume...")
+		if err := UnmountLUKSVolume(ctx, cfg.MountPoint); err != nil {
+			log.Printf("Failed to unmount LUKS volume: %v", err)
+		}
+	}
+	fmt.Println("Closing LUKS volume...")
+	return CloseLUKSVolume(ctx, cfg.MapperName)
+}
+
+// verifyPlain reports the health of a plain volume. It has no header and its key only
+// lives in the kernel, so only the open mapping can be checked.
+func verifyPlain(ctx context.Context, cfg *LUKS) *VerifyResult {
+	result := &VerifyResult{
+		Header:     CheckResult{Healthy: true, Detail: "skipped: plain dm-crypt has no header"},
+		Key:        CheckResult{Detail: "volume is not open, mount maps it with a new key"},
+		Filesystem: CheckResult{Detail: "skipped: volume is not open"},
+	}
+	if _, err := os.Stat("/dev/mapper/" + cfg.MapperName); err != nil {
+		return result
+	}
+	result.Key = CheckResult{Healthy: true, Detail: "random key held by the kernel"}
+	if cfg.Profile == ProfileSwap {
+		result.Filesystem = CheckResult{Healthy: true, Detail: "skipped: swap has no filesystem"}
+	} else {
+		result.Filesystem = verifyFilesystem(ctx, cfg)
+	}
+	return result
+}
+
+// plainCrypttabEntry returns the crypttab line making systemd-cryptsetup map the volume
+// with a new random key at every boot and create the swap area or filesystem on it. The
+// volume has no UUID, devices are referenced by the stable path validation requires.
+func plainCrypttabEntry(cfg *LUKS) string {
+	entry := fmt.Sprintf("%s %s /dev/urandom %s,cipher=%s,size=%d",
+		cfg.MapperName, cfg.VolumePath, cfg.Profile, cfg.Cipher, cfg.KeySize)
+	if cfg.allowDiscards() {
+		entry += ",discard"
+	}
+	return entry
+}
+
+// plainFstabEntry returns the fstab line activating the swap or mounting the filesystem.
+// The filesystem is recreated at every boot, so it is referenced by its mapper device.
+func plainFstabEntry(cfg *LUKS) string {
+	devicePath := "/dev/mapper/" + cfg.MapperName
+	if cfg.Profile == ProfileSwap {
+		return fmt.Sprintf("%s %s swap sw,nofail 0 0", devicePath, SwapMountPoint)
+	}
+	fstabOpts := "defaults,nofail"
+	if options := mountOptions(cfg); len(options) > 0 {
+		fstabOpts += "," + strings.Join(options, ",")
+	}
+	return fmt.Sprintf("%s %s %s %s 0 0", devicePath, cfg.MountPoint, filesystemType, fstabOpts)
+}
+
+// addPlainPersistentMount writes the crypttab and fstab entries of a plain volume. They
+// need no key, so unlike AddPersistentMount the volume does not have to be mounted.
+func addPlainPersistentMount(cfg *LUKS) error {
+	if changed, err := setCrypttabEntry(crypttabPath, cfg, plainCrypttabEntry(cfg)); err != nil {
+		return fmt.Errorf("failed to update /etc/crypttab: %v", err)
+	} else if !changed {
+		fmt.Println("Entry already in /etc/crypttab")
+	}
+	if isImageFile(cfg) {
+		// Orders the mapping after the filesystem holding the image is mounted
+		if !cfg.Features.Enabled(features.SystemdUnits) {
+			fmt.Printf("Warning: feature %s is disabled, the image may be mapped before its filesystem is mounted\n", features.SystemdUnits)
+		} else if err := installLoopUnit(cfg); err != nil {
+			return fmt.Errorf("failed to install loop unit: %w", err)
+		}
+	}
+	if changed, err := setFstabEntry(fstabPath, cfg, plainFstabEntry(cfg)); err != nil {
+		return fmt.Errorf("failed to update /etc/fstab: %v", err)
+	} else if !changed {
+		fmt.Println("Entry already in /etc/fstab")
+	}
+	return nil
+}
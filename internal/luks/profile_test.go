@@ -0,0 +1,57 @@
+package luks
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPlainTabEntries(t *testing.T) {
+	swap := &LUKS{Profile: ProfileSwap, MapperName: "udm-swap", VolumePath: "/dev/disk/by-partlabel/swap", MountPoint: SwapMountPoint, Cipher: "aes-xts-plain64", KeySize: 512}
+	if got, want := plainCrypttabEntry(swap), "udm-swap /dev/disk/by-partlabel/swap /dev/urandom swap,cipher=aes-xts-plain64,size=512"; got != want {
+		t.Errorf("plainCrypttabEntry(swap) = %q, want %q", got, want)
+	}
+	if got, want := plainFstabEntry(swap), "/dev/mapper/udm-swap none swap sw,nofail 0 0"; got != want {
+		t.Errorf("plainFstabEntry(swap) = %q, want %q", got, want)
+	}
+
+	tmp := &LUKS{Profile: ProfileTmp, MapperName: "udm-tmp", VolumePath: "/dev/disk/by-partlabel/tmp", MountPoint: "/tmp", MountOptions: []string{"nodev", "nosuid", "discard"},
+		Cipher: "aes-xts-plain64", KeySize: 512}
+	if got, want := plainFstabEntry(tmp), "/dev/mapper/udm-tmp /tmp ext4 defaults,nofail,nodev,nosuid,discard 0 0"; got != want {
+		t.Errorf("plainFstabEntry(tmp) = %q, want %q", got, want)
+	}
+	// dm-crypt passes the discards of the filesystem on only when told to
+	if got, want := plainCrypttabEntry(tmp), "udm-tmp /dev/disk/by-partlabel/tmp /dev/urandom tmp,cipher=aes-xts-plain64,size=512,discard"; got != want {
+		t.Errorf("plainCrypttabEntry(tmp) = %q, want %q", got, want)
+	}
+}
+
+func TestSetFstabEntrySwap(t *testing.T) {
+	fstab := filepath.Join(t.TempDir(), "fstab")
+	os.WriteFile(fstab, []byte("/swapfile none swap sw 0 0\n"), 0644)
+	cfg := &LUKS{Profile: ProfileSwap, MapperName: "udm-swap", MountPoint: SwapMountPoint}
+
+	// Swap areas share the none mount point without conflicting
+	if changed, err := setFstabEntry(fstab, cfg, plainFstabEntry(cfg)); err != nil || !changed {
+		t.Fatalf("setFstabEntry() = %v, %v, want true, nil", changed, err)
+	}
+	if updated := readFixture(t, fstab); !strings.Contains(updated, "/swapfile none swap") || !strings.Contains(updated, "/dev/mapper/udm-swap none swap") {
+		t.Errorf("fstab =\n%s\nwant both swap areas", updated)
+	}
+}
+
+func TestStableDevicePath(t *testing.T) {
+	for path, want := range map[string]bool{
+		"/dev/disk/by-id/nvme-eui.0025385b71b0a1c2-part3": true,
+		"/dev/disk/by-partuuid/8c2f3e1a-03":               true,
+		"/dev/disk/by-partlabel/swap":                     true,
+		"/dev/disk/by-partlabel/":                         false,
+		"/dev/sda3":                                       false,
+		"/dev/disk/by-path/pci-0000:00:17.0-ata-1-part3":  false,
+	} {
+		if got := StableDevicePath(path); got != want {
+			t.Errorf("StableDevicePath(%s) = %v, want %v", path, got, want)
+		}
+	}
+}
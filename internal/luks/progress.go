@@ -0,0 +1,174 @@
+package luks
+
+import (
+	"bootstrap/internal/trace"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+type ProgressMode int
+
+const (
+	ProgressText  ProgressMode = iota // Human readable progress on stdout
+	ProgressQuiet                     // No progress output
+	ProgressJSON                      // One JSON event per line on stderr
+)
+
+// Names of the progress steps of SetupLUKSVolume
+const (
+	stepCreate = "Creating LUKS volume"
+	stepOpen   = "Opening LUKS volume"
+	stepFormat = "Formatting LUKS volume"
+	stepMount  = "Mounting LUKS volume"
+)
+
+// heartbeatInterval is how often a silent step reports that it is still running.
+const heartbeatInterval = 5 * time.Second
+
+// progressEvent is emitted for every progress update in ProgressJSON mode.
+type progressEvent struct {
+	Step    string  `json:"step"`
+	Event   string  `json:"event"` // start, output, running, done or failed
+	Elapsed float64 `json:"elapsed"`
+	Message string  `json:"message,omitempty"`
+}
+
+type progressReporter struct {
+	mu   sync.Mutex
+	mode ProgressMode
+	text io.Writer
+	json io.Writer
+	hook func(step string) func(err error)
+}
+
+// text is nil by default to follow os.Stdout, which the caller may redirect.
+var progress = &progressReporter{mode: ProgressText, json: os.Stderr}
+
+// SetProgressMode selects how long-running operations report their progress.
+func SetProgressMode(mode ProgressMode) {
+	progress.mu.Lock()
+	defer progress.mu.Unlock()
+	progress.mode = mode
+}
+
+// SetStepHook installs a function called as each step starts, the function it returns
+// is called with the outcome as the step ends, e.g. to trace the steps as spans.
+func SetStepHook(hook func(step string) func(err error)) {
+	progress.mu.Lock()
+	defer progress.mu.Unlock()
+	progress.hook = hook
+}
+
+func (p *progressReporter) emit(step, event string, start time.Time, message string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	elapsed := time.Since(start).Round(100 * time.Millisecond)
+	switch p.mode {
+	case ProgressQuiet:
+		return
+	case ProgressJSON:
+		data, _ := json.Marshal(progressEvent{Step: step, Event: event, Elapsed: elapsed.Seconds(), Message: message})
+		fmt.Fprintln(p.json, string(data))
+	default:
+		text := p.text
+		if text == nil {
+			text = os.Stdout
+		}
+		switch event {
+		case "start":
+			fmt.Fprintf(text, "%s ...\n", step)
+		case "output":
+			fmt.Fprintf(text, "  [%s] %s\n", elapsed, message)
+		case "running":
+			fmt.Fprintf(text, "  [%s] still running\n", elapsed)
+		case "done":
+			fmt.Fprintf(text, "%s done (%s)\n", step, elapsed)
+		case "failed":
+			fmt.Fprintf(text, "%s failed after %s: %s\n", step, elapsed, message)
+		}
+	}
+}
+
+// step runs fn as a named progress step, reporting start, completion and elapsed time.
+func (p *progressReporter) step(name string, fn func() error) (err error) {
+	p.mu.Lock()
+	hook := p.hook
+	p.mu.Unlock()
+	if hook != nil {
+		end := hook(name)
+		defer func() { end(err) }()
+	}
+
+	start := time.Now()
+	p.emit(name, "start", start, "")
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				p.emit(name, "running", start, "")
+			}
+		}
+	}()
+
+	if err := fn(); err != nil {
+		p.emit(name, "failed", start, err.Error())
+		return err
+	}
+	p.emit(name, "done", start, "")
+	return nil
+}
+
+// runStreaming runs cmd, reporting each line of its combined output as progress for
+// the named step, and returns the collected output like CombinedOutput.
+func runStreaming(step string, cmd *trace.Cmd) ([]byte, error) {
+	start := time.Now()
+
+	pr, pw := io.Pipe()
+	var output bytes.Buffer
+	cmd.Stdout = io.MultiWriter(pw, &output)
+	cmd.Stderr = cmd.Stdout
+
+	scanned := make(chan struct{})
+	go func() {
+		defer close(scanned)
+		scanner := bufio.NewScanner(pr)
+		scanner.Split(scanProgressLines)
+		for scanner.Scan() {
+			if line := bytes.TrimSpace(scanner.Bytes()); len(line) > 0 {
+				progress.emit(step, "output", start, string(line))
+			}
+		}
+		io.Copy(io.Discard, pr)
+	}()
+
+	err := cmd.Run()
+	pw.Close()
+	<-scanned
+	return output.Bytes(), err
+}
+
+// scanProgressLines splits on both newlines and carriage returns, since cryptsetup
+// and mkfs redraw progress counters in place with '\r'.
+func scanProgressLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
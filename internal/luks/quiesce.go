@@ -0,0 +1,107 @@
+package luks
+
+import (
+	"bootstrap/internal/trace"
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const DefaultQuiesceTimeout = 30 * time.Second
+
+// Quiesce lists the applications that must release the volume before it is unmounted.
+type Quiesce struct {
+	Units   []string `yaml:"units"`   // systemd units stopped before unmount
+	Socket  string   `yaml:"socket"`  // Unix socket speaking the quiesce protocol
+	Timeout string   `yaml:"timeout"` // How long to wait for acknowledgment, e.g. "30s"
+}
+
+// Enabled reports whether any application is registered for quiescing.
+func (q Quiesce) Enabled() bool {
+	return len(q.Units) > 0 || q.Socket != ""
+}
+
+// timeout returns the configured acknowledgment timeout.
+func (q Quiesce) timeout() time.Duration {
+	if d, err := time.ParseDuration(q.Timeout); err == nil && d > 0 {
+		return d
+	}
+	return DefaultQuiesceTimeout
+}
+
+// QuiesceApplications stops the registered systemd units and asks the application on
+// the quiesce socket to release the volume, failing if either does not acknowledge in time.
+//
+// The socket protocol is line based: we send "QUIESCE <mapper> <mount point>" and the
+// application answers "OK" once it has closed its files, or anything else to refuse.
+func QuiesceApplications(cfg *LUKS) error {
+	timeout := cfg.Quiesce.timeout()
+
+	if len(cfg.Quiesce.Units) > 0 {
+		fmt.Println("Stopping units:", strings.Join(cfg.Quiesce.Units, " "))
+		args := append([]string{"stop"}, cfg.Quiesce.Units...)
+		cmd := trace.Command("systemctl", args...)
+		if err := runWithTimeout(cmd, timeout); err != nil {
+			return fmt.Errorf("failed to stop units: %w", err)
+		}
+	}
+
+	if cfg.Quiesce.Socket != "" {
+		fmt.Println("Requesting quiesce on", cfg.Quiesce.Socket)
+		conn, err := net.DialTimeout("unix", cfg.Quiesce.Socket, timeout)
+		if err != nil {
+			return fmt.Errorf("failed to connect to quiesce socket: %w", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(timeout))
+
+		if _, err := fmt.Fprintf(conn, "QUIESCE %s %s\n", cfg.MapperName, cfg.MountPoint); err != nil {
+			return fmt.Errorf("failed to send quiesce request: %w", err)
+		}
+		reply, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("no quiesce acknowledgment within %s: %w", timeout, err)
+		}
+		if reply = strings.TrimSpace(reply); reply != "OK" {
+			return fmt.Errorf("application refused to quiesce: %s", reply)
+		}
+	}
+
+	return nil
+}
+
+// runWithTimeout runs cmd and kills it if it does not finish within timeout.
+func runWithTimeout(cmd *trace.Cmd, timeout time.Duration) error {
+	var output strings.Builder
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("%s: %s", err, strings.TrimSpace(output.String()))
+		}
+		return nil
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		<-done
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+}
+
+// unmountStrict unmounts without the lazy fallback, so a volume still in use after
+// quiescing is reported instead of silently detached.
+func unmountStrict(ctx context.Context, mountPoint string) error {
+	if output, err := runRetried(ctx, OpMount, func() *trace.Cmd { return trace.Command("umount", mountPoint) }); err != nil {
+		return fmt.Errorf("failed to unmount LUKS volume: %s\n%s", err, string(output))
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+package luks
+
+import (
+	"bootstrap/internal/trace"
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/user"
+	"slices"
+	"strings"
+)
+
+// Drift is a difference between the configuration and the actual state of the system.
+type Drift struct {
+	Item    string `json:"item"`
+	Desired string `json:"desired"`
+	Actual  string `json:"actual"`
+	Safe    bool   `json:"safe"`  // Can be corrected without risking data or boot
+	Fixed   bool   `json:"fixed"` // Corrected by Reconcile
+	Error   string `json:"error,omitempty"`
+
+	fix func() error
+}
+
+// Reconcile compares the configuration against the system: filesystem, mount point,
+// ownership, fstab and crypttab entries. With apply set the safe differences are
+// corrected, the others are reported for manual action.
+func Reconcile(ctx context.Context, cfg *LUKS, apply bool) ([]Drift, error) {
+	drifts, err := detectDrift(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if !apply {
+		return drifts, nil
+	}
+	for i := range drifts {
+		if !drifts[i].Safe || drifts[i].fix == nil {
+			continue
+		}
+		if err := drifts[i].fix(); err != nil {
+			drifts[i].Error = err.Error()
+			continue
+		}
+		drifts[i].Fixed = true
+	}
+	return drifts, nil
+}
+
+func detectDrift(ctx context.Context, cfg *LUKS) ([]Drift, error) {
+	var drifts []Drift
+	device := "/dev/mapper/" + cfg.MapperName
+
+	// The filesystem and mounts can only be inspected while the volume is open
+	var filesystemUUID string
+	if _, err := os.Stat(device); err == nil {
+		output, err := outputRetried(ctx, OpCryptsetup, func() *trace.Cmd {
+			return trace.Command("blkid", "-p", "-s", "TYPE", "-o", "value", device)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to probe filesystem: %w", err)
+		}
+		desired := filesystemType
+		if cfg.Profile == ProfileSwap {
+			desired = "swap"
+		}
+		if fsType := strings.TrimSpace(string(output)); fsType != desired {
+			drifts = append(drifts, Drift{Item: "filesystem", Desired: desired, Actual: fsType})
+		}
+		if output, err := outputRetried(ctx, OpCryptsetup, func() *trace.Cmd {
+			return trace.Command("blkid", "-p", "-s", "UUID", "-o", "value", device)
+		}); err == nil {
+			filesystemUUID = strings.TrimSpace(string(output))
+		}
+
+		mountDrift, err := detectMountDrift(ctx, cfg, device)
+		if err != nil {
+			return nil, err
+		}
+		drifts = append(drifts, mountDrift...)
+	}
+
+	fstab, err := detectFstabDrift(cfg, filesystemUUID)
+	if err != nil {
+		return nil, err
+	}
+	drifts = append(drifts, fstab...)
+
+	entry, err := findCrypttabEntry(crypttabPath, cfg.MapperName)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read /etc/crypttab: %w", err)
+	}
+	if cfg.Plain() {
+		// Mapped with a new key at every boot, the entry itself is compared
+		if desired := plainCrypttabEntry(cfg); entry != "" && strings.Join(strings.Fields(entry), " ") != desired {
+			drifts = append(drifts, Drift{Item: "crypttab entry", Desired: desired, Actual: entry, Safe: true,
+				fix: func() error {
+					_, err := setCrypttabEntry(crypttabPath, cfg, desired)
+					return err
+				}})
+		}
+	} else if fields := strings.Fields(entry); len(fields) > 1 {
+		// Entries written before volumes were referenced by UUID drift until
+		// add-persistent-mount is run again
+		uuid, _ := VolumeUUID(ctx, cfg)
+		if desired := crypttabSource(cfg, uuid); fields[1] != desired {
+			drifts = append(drifts, Drift{Item: "crypttab device", Desired: desired, Actual: fields[1]})
+		}
+	}
+	return drifts, nil
+}
+
+// detectMountDrift checks where and how the open volume is mounted, and the ownership
+// of the mount point.
+func detectMountDrift(ctx context.Context, cfg *LUKS, device string) ([]Drift, error) {
+	mountPoint, options, err := findMount(device)
+	if err != nil {
+		return nil, err
+	}
+	if mountPoint == "" {
+		return nil, nil
+	}
+
+	var drifts []Drift
+	if mountPoint != cfg.MountPoint {
+		drifts = append(drifts, Drift{Item: "mount point", Desired: cfg.MountPoint, Actual: mountPoint})
+		return drifts, nil
+	}
+	actualOptions := strings.Split(options, ",")
+	if readOnly := slices.Contains(actualOptions, "ro"); readOnly && !cfg.ReadOnly {
+		// Usually remounted read-only by the kernel after filesystem errors
+		drifts = append(drifts, Drift{Item: "mount mode", Desired: "rw", Actual: "ro"})
+	} else if !readOnly && cfg.ReadOnly {
+		drifts = append(drifts, Drift{Item: "mount mode", Desired: "ro", Actual: "rw"})
+	}
+	var missing []string
+	for _, opt := range cfg.MountOptions {
+		if opt != "defaults" && !slices.Contains(actualOptions, opt) {
+			missing = append(missing, opt)
+		}
+	}
+	if len(missing) > 0 {
+		desired := strings.Join(cfg.MountOptions, ",")
+		drifts = append(drifts, Drift{Item: "mount options", Desired: desired, Actual: options, Safe: true,
+			fix: func() error {
+				if err := Remount(ctx, cfg.MountPoint, desired); err != nil {
+					return fmt.Errorf("remount failed: %v", err)
+				}
+				return nil
+			}})
+	}
+
+	desired := cfg.User + ":" + cfg.Group
+	actual, err := ownerOf(cfg.MountPoint)
+	if err != nil {
+		return nil, err
+	}
+	if actual != desired {
+		// A read-only filesystem cannot be changed
+		drifts = append(drifts, Drift{Item: "ownership", Desired: desired, Actual: actual, Safe: !cfg.ReadOnly,
+			fix: func() error {
+				if output, err := trace.Command("chown", desired, cfg.MountPoint).CombinedOutput(); err != nil {
+					return fmt.Errorf("chown failed: %s", output)
+				}
+				return nil
+			}})
+	}
+	return drifts, nil
+}
+
+// detectFstabDrift compares the fstab entry of the volume, when present, against the
+// entry add-persistent-mount would write. Without the filesystem UUID of the open
+// volume the entry of a LUKS volume cannot be checked, plain volumes are referenced by
+// their mapper device.
+func detectFstabDrift(cfg *LUKS, filesystemUUID string) ([]Drift, error) {
+	fstab, err := readTabFile(fstabPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read /etc/fstab: %w", err)
+	}
+	entries := fstab.find(fstabMatch(cfg))
+	if len(entries) == 0 || filesystemUUID == "" && !cfg.Plain() {
+		return nil, nil
+	}
+	actual := entries[0]
+
+	desired := fstabEntry(cfg, filesystemUUID)
+	if cfg.Plain() {
+		desired = plainFstabEntry(cfg)
+	}
+	if len(entries) == 1 && strings.Join(strings.Fields(actual), " ") == desired {
+		return nil, nil
+	}
+	if len(entries) > 1 {
+		actual = strings.Join(entries, " | ")
+	}
+	return []Drift{{Item: "fstab entry", Desired: desired, Actual: actual, Safe: true,
+		fix: func() error {
+			_, err := setFstabEntry(fstabPath, cfg, desired)
+			return err
+		}}}, nil
+}
+
+// findMount returns the mount point and options of device from /proc/mounts.
+func findMount(device string) (string, string, error) {
+	resolved, err := resolveDevice(device)
+	if err != nil {
+		return "", "", err
+	}
+	file, err := os.Open("/proc/mounts")
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read mounts: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		if source, err := resolveDevice(fields[0]); err == nil && source == resolved {
+			return fields[1], fields[3], nil
+		}
+	}
+	return "", "", scanner.Err()
+}
+
+// resolveDevice follows /dev/mapper symlinks to the dm device node.
+func resolveDevice(device string) (string, error) {
+	info, err := os.Stat(device)
+	if err != nil {
+		return "", err
+	}
+	if rdev, ok := host.deviceNumber(info); ok {
+		return fmt.Sprintf("%d", rdev), nil
+	}
+	return device, nil
+}
+
+// ownerOf returns "user:group" of path, numeric for unknown ids.
+func ownerOf(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+	uid, gid, ok := host.owner(info)
+	if !ok {
+		return "", fmt.Errorf("cannot determine owner of %s", path)
+	}
+	owner := fmt.Sprint(uid)
+	if u, err := user.LookupId(owner); err == nil {
+		owner = u.Username
+	}
+	group := fmt.Sprint(gid)
+	if g, err := user.LookupGroupId(group); err == nil {
+		group = g.Name
+	}
+	return owner + ":" + group, nil
+}
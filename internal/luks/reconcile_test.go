@@ -0,0 +1,19 @@
+package luks
+
+import "testing"
+
+func TestFstabEntryMountOptions(t *testing.T) {
+	cfg := &LUKS{MapperName: "udm-luks", MountPoint: "/mnt/udm-luks", MountOptions: []string{"nodev", "discard"}}
+	want := "UUID=1234 /mnt/udm-luks ext4 defaults,nofail,nodev,discard,x-systemd.requires=cryptsetup@udm-luks.service 0 2"
+	if got := fstabEntry(cfg, "1234"); got != want {
+		t.Fatalf("fstabEntry() = %q, want %q", got, want)
+	}
+}
+
+func TestFstabEntryReadOnly(t *testing.T) {
+	cfg := &LUKS{MapperName: "udm-luks", MountPoint: "/mnt/udm-luks", ReadOnly: true}
+	want := "UUID=1234 /mnt/udm-luks ext4 defaults,nofail,ro,x-systemd.requires=cryptsetup@udm-luks.service 0 2"
+	if got := fstabEntry(cfg, "1234"); got != want {
+		t.Fatalf("fstabEntry() = %q, want %q", got, want)
+	}
+}
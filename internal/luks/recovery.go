@@ -0,0 +1,39 @@
+package luks
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// DefaultRecoveryGroups gives a 40 character recovery passphrase with 200 bits of entropy.
+const DefaultRecoveryGroups = 8
+
+// Recovery configures the recovery passphrase generated during authorize.
+type Recovery struct {
+	Enabled    bool   `yaml:"enabled"`    // Generate a recovery passphrase
+	Groups     int    `yaml:"groups"`     // Number of five character groups
+	EscrowPath string `yaml:"escrowPath"` // Write the passphrase here instead of printing it
+}
+
+// AddRecoveryPassphrase generates a recovery passphrase and enrolls it in a secondary
+// keyslot, authorized by the machine key. When an escrow path is configured the
+// passphrase is written there, otherwise it is returned for the caller to show once.
+func AddRecoveryPassphrase(ctx context.Context, cfg *LUKS) (string, error) {
+	passphrase, err := GeneratePassword(ctx, cfg.Recovery.Groups)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate recovery passphrase: %w", err)
+	}
+
+	if err := AddKeyslot(ctx, cfg, []byte(passphrase), -1); err != nil {
+		return "", fmt.Errorf("failed to enroll recovery passphrase: %w", err)
+	}
+
+	if cfg.Recovery.EscrowPath != "" {
+		if err := os.WriteFile(cfg.Recovery.EscrowPath, []byte(passphrase+"\n"), 0600); err != nil {
+			return "", fmt.Errorf("failed to write recovery passphrase to escrow: %w", err)
+		}
+		return "", nil
+	}
+	return passphrase, nil
+}
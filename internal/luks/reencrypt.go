@@ -0,0 +1,116 @@
+package luks
+
+import (
+	"bootstrap/internal/trace"
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const stepReencrypt = "Re-encrypting LUKS volume"
+
+// Encryption is the data encryption of a volume as recorded in its LUKS header.
+type Encryption struct {
+	Cipher  string `json:"cipher"`
+	KeySize int    `json:"keySize"` // Volume key size in bits
+	Pending bool   `json:"pending"` // An interrupted re-encryption has to be resumed
+}
+
+var (
+	dumpCipher  = regexp.MustCompile(`^\s+cipher:\s+(\S+)`)
+	dumpKeySize = regexp.MustCompile(`^\s+Key:\s+(\d+) bits`)
+)
+
+// CurrentEncryption reads the cipher and key size of the volume from its header.
+func CurrentEncryption(ctx context.Context, cfg *LUKS) (*Encryption, error) {
+	output, err := runRetried(ctx, OpCryptsetup, func() *trace.Cmd { return trace.Command("cryptsetup", "luksDump", cfg.VolumePath) })
+	if err != nil {
+		return nil, fmt.Errorf("failed to dump LUKS header: %s", output)
+	}
+	return parseEncryption(string(output)), nil
+}
+
+// parseEncryption extracts the data segment cipher, the volume key size and whether a
+// re-encryption is in progress from LUKS2 luksDump output.
+func parseEncryption(dump string) *Encryption {
+	enc := &Encryption{}
+	section := ""
+	scanner := bufio.NewScanner(strings.NewReader(dump))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line != "" && !unicode.IsSpace(rune(line[0])) {
+			section, _, _ = strings.Cut(line, ":")
+		}
+		switch section {
+		case "Requirements":
+			enc.Pending = enc.Pending || strings.Contains(line, "online-reencrypt")
+		case "Data segments":
+			if m := dumpCipher.FindStringSubmatch(line); m != nil && enc.Cipher == "" {
+				enc.Cipher = m[1]
+			}
+		case "Keyslots":
+			if m := dumpKeySize.FindStringSubmatch(line); m != nil && enc.KeySize == 0 {
+				enc.KeySize, _ = strconv.Atoi(m[1])
+			}
+		}
+	}
+	return enc
+}
+
+// NeedsReencryption reports whether the volume differs from the configured cipher or
+// key size, or has an interrupted re-encryption.
+func (e *Encryption) NeedsReencryption(cfg *LUKS) bool {
+	return e.Pending || e.Cipher != cfg.Cipher || (cfg.KeySize > 0 && e.KeySize != cfg.KeySize)
+}
+
+// ReencryptLUKSVolume migrates the volume to the configured cipher and key size with a
+// new volume key, authorized by the machine key. An open volume is re-encrypted online
+// and stays usable. cryptsetup records its progress in the header, so an interrupted
+// run is resumed by calling ReencryptLUKSVolume again. Other keyslots, such as the
+// recovery passphrase, are prompted for on the terminal.
+func ReencryptLUKSVolume(ctx context.Context, cfg *LUKS) error {
+	if cfg.Integrity != "" {
+		return fmt.Errorf("cryptsetup cannot re-encrypt volumes with luks.integrity, migrate the data to a new volume instead")
+	}
+	current, err := CurrentEncryption(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	if err := resolveKey(ctx, cfg); err != nil {
+		return err
+	}
+
+	return withTempKeyFile(cfg.Password, func(keyFile string) error {
+		args := []string{"reencrypt", "--key-file=" + keyFile, "--progress-frequency=5"}
+		if current.Pending {
+			fmt.Println("Resuming interrupted re-encryption ...")
+			args = append(args, "--resume-only")
+		} else {
+			args = append(args, cfg.formatArgs()...)
+		}
+
+		device := cfg.VolumePath
+		if _, err := os.Stat("/dev/mapper/" + cfg.MapperName); err == nil {
+			// Online: cryptsetup reloads the active mapping as it progresses
+			args = append(args, "--active-name="+cfg.MapperName)
+			if loop := backingLoop(cfg.MapperName); loop != "" {
+				device = loop
+			}
+		}
+
+		// Not bounded by a timeout, an interrupted run is resumed from the header
+		cmd := trace.CommandContext(ctx, "cryptsetup", append(args, device)...)
+		cmd.Stdin = os.Stdin
+		return progress.step(stepReencrypt, func() error {
+			if output, err := runStreaming(stepReencrypt, cmd); err != nil {
+				return fmt.Errorf("cryptsetup reencrypt failed, rerun to resume: %s", strings.TrimSpace(string(output)))
+			}
+			return nil
+		})
+	})
+}
@@ -0,0 +1,45 @@
+package luks
+
+import "testing"
+
+const reencryptDump = `LUKS header information
+Version:       	2
+Epoch:         	9
+Metadata area: 	16384 [bytes]
+UUID:          	0d5e4c53-6c1b-4d0e-9a63-5f1a1c2a4b11
+Label:         	(no label)
+Requirements:  	online-reencrypt-v2
+
+Data segments:
+  0: crypt
+	offset: 16777216 [bytes]
+	length: 4194304 [bytes]
+	cipher: aes-cbc-essiv:sha256
+	sector: 512 [bytes]
+
+Keyslots:
+  0: luks2
+	Key:        256 bits
+	Priority:   normal
+	Cipher:     aes-cbc-essiv:sha256
+`
+
+func TestParseEncryption(t *testing.T) {
+	enc := parseEncryption(reencryptDump)
+	if enc.Cipher != "aes-cbc-essiv:sha256" || enc.KeySize != 256 || !enc.Pending {
+		t.Fatalf("unexpected encryption %+v", enc)
+	}
+
+	cfg := &LUKS{Cipher: "aes-cbc-essiv:sha256", KeySize: 256}
+	if !enc.NeedsReencryption(cfg) {
+		t.Errorf("pending re-encryption must be resumed")
+	}
+	enc.Pending = false
+	if enc.NeedsReencryption(cfg) {
+		t.Errorf("volume already matches the configuration")
+	}
+	cfg.Cipher, cfg.KeySize = "aes-xts-plain64", 512
+	if !enc.NeedsReencryption(cfg) {
+		t.Errorf("expected migration to %s", cfg.Cipher)
+	}
+}
@@ -0,0 +1,179 @@
+package luks
+
+import (
+	"bootstrap/internal/trace"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Operation classes of external commands, each with its own retry policy.
+const (
+	OpCryptsetup = "cryptsetup" // cryptsetup, losetup and other block device tools
+	OpTPM        = "tpm"        // tpm2-tools
+	OpMount      = "mount"      // mount, umount and other filesystem tools
+)
+
+const (
+	DefaultRetryAttempts = 3
+	DefaultRetryBackoff  = "200ms"
+	maxRetryBackoff      = 5 * time.Second
+)
+
+// RetryPolicy retries an external command failing transiently, doubling the backoff
+// after every attempt.
+type RetryPolicy struct {
+	Attempts int    `yaml:"attempts"` // Attempts including the first, 1 disables retries
+	Backoff  string `yaml:"backoff"`  // Wait before the first retry, e.g. "200ms"
+}
+
+// Retry configures the retry policy per operation class.
+type Retry struct {
+	Cryptsetup RetryPolicy `yaml:"cryptsetup"`
+	TPM        RetryPolicy `yaml:"tpm"`
+	Mount      RetryPolicy `yaml:"mount"`
+}
+
+type retryPolicy struct {
+	attempts int
+	backoff  time.Duration
+}
+
+var (
+	retryMu       sync.Mutex
+	retryPolicies = map[string]retryPolicy{}
+)
+
+// Validate checks the policies and fills in the defaults.
+func (r *Retry) Validate() error {
+	for class, policy := range r.policies() {
+		if policy.Attempts == 0 {
+			policy.Attempts = DefaultRetryAttempts
+		}
+		if policy.Backoff == "" {
+			policy.Backoff = DefaultRetryBackoff
+		}
+		if policy.Attempts < 1 {
+			return fmt.Errorf("retry.%s.attempts (%d) must be at least 1", class, policy.Attempts)
+		}
+		if d, err := time.ParseDuration(policy.Backoff); err != nil || d < 0 {
+			return fmt.Errorf("retry.%s.backoff (%s) must be a duration, e.g. 200ms", class, policy.Backoff)
+		}
+	}
+	return nil
+}
+
+func (r *Retry) policies() map[string]*RetryPolicy {
+	return map[string]*RetryPolicy{OpCryptsetup: &r.Cryptsetup, OpTPM: &r.TPM, OpMount: &r.Mount}
+}
+
+// SetRetry installs the retry policies of a validated configuration.
+func SetRetry(r Retry) {
+	retryMu.Lock()
+	defer retryMu.Unlock()
+	for class, policy := range r.policies() {
+		backoff, _ := time.ParseDuration(policy.Backoff)
+		retryPolicies[class] = retryPolicy{attempts: policy.Attempts, backoff: backoff}
+	}
+}
+
+func policyFor(class string) retryPolicy {
+	retryMu.Lock()
+	defer retryMu.Unlock()
+	if policy, ok := retryPolicies[class]; ok && policy.attempts > 0 {
+		return policy
+	}
+	backoff, _ := time.ParseDuration(DefaultRetryBackoff)
+	return retryPolicy{attempts: DefaultRetryAttempts, backoff: backoff}
+}
+
+// transientErrors are the messages of failures worth retrying: device-mapper and udev
+// races on busy devices, and a TPM asking to be retried.
+var transientErrors = []string{
+	"Device or resource busy",
+	"device-mapper: reload ioctl",
+	"is still in use",
+	"target is busy",
+	"TPM_RC_RETRY",
+	"TPM_RC_YIELDED",
+	"TPM_RC_TESTING",
+	"TPM_RC_NV_RATE",
+}
+
+func isTransient(output string) bool {
+	for _, message := range transientErrors {
+		if strings.Contains(output, message) {
+			return true
+		}
+	}
+	return false
+}
+
+// runRetried runs the command built by newCmd and returns its combined output,
+// retrying transient failures under the policy of class. newCmd is called for every
+// attempt since a command, and its stdin, can only be used once. Each attempt is killed
+// after the timeout of class, and killed when ctx is canceled.
+func runRetried(ctx context.Context, class string, newCmd func() *trace.Cmd) ([]byte, error) {
+	return retry(class, func() ([]byte, string, error) {
+		ctx, cancel := commandContext(ctx, class)
+		defer cancel()
+		output, err := newCmd().WithContext(ctx).CombinedOutput()
+		return output, string(output), err
+	})
+}
+
+// outputRetried is runRetried returning only stdout, stderr is used to detect
+// transient failures and is part of the returned error.
+func outputRetried(ctx context.Context, class string, newCmd func() *trace.Cmd) ([]byte, error) {
+	return retry(class, func() ([]byte, string, error) {
+		ctx, cancel := commandContext(ctx, class)
+		defer cancel()
+		cmd := newCmd().WithContext(ctx)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		output, err := cmd.Output()
+		if err != nil {
+			err = fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		return output, stderr.String(), err
+	})
+}
+
+// runOnce is runRetried without retries, for commands that must not be delayed by the
+// backoff, e.g. while panicking.
+func runOnce(ctx context.Context, class string, cmd *trace.Cmd) ([]byte, error) {
+	ctx, cancel := commandContext(ctx, class)
+	defer cancel()
+	output, err := cmd.WithContext(ctx).CombinedOutput()
+	var killed *trace.ContextError
+	if errors.As(err, &killed) {
+		return []byte(killed.Error()), err
+	}
+	return output, err
+}
+
+// retry runs attempt under the retry policy of class. A command killed on timeout is not
+// retried, its output is replaced by the timeout error since callers report the output.
+func retry(class string, attempt func() ([]byte, string, error)) ([]byte, error) {
+	policy := policyFor(class)
+	backoff := policy.backoff
+	for i := 1; ; i++ {
+		output, diagnostics, err := attempt()
+		var killed *trace.ContextError
+		if errors.As(err, &killed) {
+			return []byte(killed.Error()), err
+		}
+		if err == nil || i >= policy.attempts || !isTransient(diagnostics) {
+			return output, err
+		}
+		log.Printf("%s command failed transiently (attempt %d/%d): %s, retrying in %s",
+			class, i, policy.attempts, strings.TrimSpace(diagnostics), backoff)
+		time.Sleep(backoff)
+		backoff = min(2*backoff, maxRetryBackoff)
+	}
+}
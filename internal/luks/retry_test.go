@@ -0,0 +1,82 @@
+package luks
+
+import (
+	"bootstrap/internal/trace"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRetryTransient(t *testing.T) {
+	SetRetry(Retry{
+		Cryptsetup: RetryPolicy{Attempts: 3, Backoff: "1ms"},
+		TPM:        RetryPolicy{Attempts: 1, Backoff: "1ms"},
+		Mount:      RetryPolicy{Attempts: 3, Backoff: "1ms"},
+	})
+	defer SetRetry(Retry{})
+
+	calls := 0
+	output, err := retry(OpCryptsetup, func() ([]byte, string, error) {
+		calls++
+		if calls < 3 {
+			return nil, "Device or resource busy", errors.New("exit status 5")
+		}
+		return []byte("ok"), "", nil
+	})
+	if err != nil || string(output) != "ok" || calls != 3 {
+		t.Fatalf("expected success on the third attempt, got %q, %v after %d calls", output, err, calls)
+	}
+
+	calls = 0
+	if _, err := retry(OpMount, func() ([]byte, string, error) {
+		calls++
+		return nil, "wrong fs type", errors.New("exit status 32")
+	}); err == nil || calls != 1 {
+		t.Errorf("permanent failures must not be retried, %d calls", calls)
+	}
+
+	calls = 0
+	if _, err := retry(OpTPM, func() ([]byte, string, error) {
+		calls++
+		return nil, "TPM_RC_RETRY", errors.New("exit status 1")
+	}); err == nil || calls != 1 {
+		t.Errorf("a single attempt policy must not retry, %d calls", calls)
+	}
+}
+
+func TestRetryValidate(t *testing.T) {
+	r := Retry{Mount: RetryPolicy{Backoff: "soon"}}
+	if err := r.Validate(); err == nil {
+		t.Errorf("expected an invalid backoff to be rejected")
+	}
+	r = Retry{}
+	if err := r.Validate(); err != nil || r.TPM.Attempts != DefaultRetryAttempts {
+		t.Errorf("expected defaults, got %+v, %v", r, err)
+	}
+}
+
+func TestTimeoutsValidate(t *testing.T) {
+	to := Timeouts{TPM: "soon"}
+	if err := to.Validate(); err == nil {
+		t.Errorf("expected an invalid timeout to be rejected")
+	}
+	to = Timeouts{}
+	if err := to.Validate(); err != nil || to.Cryptsetup != DefaultCryptsetupTimeout || to.Mount != DefaultMountTimeout {
+		t.Errorf("expected defaults, got %+v, %v", to, err)
+	}
+}
+
+func TestRunOnceTimeout(t *testing.T) {
+	SetTimeouts(Timeouts{Cryptsetup: "50ms", TPM: "50ms", Mount: "50ms"})
+	defer SetTimeouts(Timeouts{Cryptsetup: DefaultCryptsetupTimeout, TPM: DefaultTPMTimeout, Mount: DefaultMountTimeout})
+
+	output, err := runOnce(context.Background(), OpCryptsetup, trace.Command("sleep", "5"))
+	var killed *trace.ContextError
+	if !errors.As(err, &killed) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("runOnce() error = %v, want a timeout", err)
+	}
+	if !strings.Contains(string(output), "timed out") {
+		t.Errorf("runOnce() output = %q, want the timeout reported", output)
+	}
+}
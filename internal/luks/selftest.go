@@ -0,0 +1,231 @@
+package luks
+
+import (
+	"bootstrap/internal/secrets"
+	"bootstrap/internal/trace"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Stages of SelfTest, in the order they run.
+const (
+	StagePrerequisites = "prerequisites"
+	StageAuthorize     = "authorize"
+	StageMount         = "mount"
+	StageWriteRead     = "write/read"
+	StageUnmount       = "unmount"
+	StageDeauthorize   = "deauthorize"
+)
+
+// SelfTestMapperName is the mapper of the throwaway volume, callers hold its lock.
+const SelfTestMapperName = "udm-selftest"
+
+// selfTestNVIndex holds the key of the throwaway volume in TPM mode, below the blocks of
+// VolumeNVIndex so it never touches the key of a real volume. An index left behind by an
+// interrupted self-test is replaced.
+const selfTestNVIndex = "0x1510000"
+
+const (
+	selfTestSizeMB      = 32 // LUKS2 header and a small ext4 filesystem
+	selfTestPatternSize = 64 << 10
+)
+
+// StageResult is the outcome of a self-test stage.
+type StageResult struct {
+	Stage    string        `json:"stage"`
+	Status   string        `json:"status"` // passed, failed or skipped
+	Detail   string        `json:"detail,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Stage statuses of StageResult.
+const (
+	StagePassed  = "passed"
+	StageFailed  = "failed"
+	StageSkipped = "skipped"
+)
+
+// SelfTest runs authorize, mount, a write/read check, unmount and deauthorize on a tiny
+// volume in dir, keeping the key in a temporary NV index with useTPM, so the host
+// prerequisites are proven before real provisioning. Stages after a failure are skipped
+// and the volume is removed whatever the outcome.
+func SelfTest(ctx context.Context, dir string, useTPM bool) []StageResult {
+	cfg := &LUKS{
+		VolumePath:      filepath.Join(dir, SelfTestMapperName+".img"),
+		MapperName:      SelfTestMapperName,
+		MountPoint:      filepath.Join(dir, "mnt"),
+		KeyBytes:        MinKeyBytes,
+		Size:            selfTestSizeMB,
+		UseTPM:          useTPM,
+		NVIndex:         selfTestNVIndex,
+		User:            "root",
+		Group:           "root",
+		Cipher:          DefaultCipher(),
+		KeySize:         DefaultKeySize(DefaultCipher(), ""),
+		PBKDF:           PBKDFArgon2id,
+		PBKDFMemory:     MinPBKDFMemory,
+		PBKDFIterations: 4, // The key is random, a slow keyslot only slows the test
+	}
+
+	stages := []struct {
+		name string
+		run  func() (string, error)
+	}{
+		{StagePrerequisites, func() (string, error) { return checkPrerequisites(ctx, useTPM) }},
+		{StageAuthorize, func() (string, error) {
+			if useTPM && checkNVIndexFree(ctx, selfTestNVIndex) != nil {
+				if err := removePasswordFromTPM(ctx, selfTestNVIndex, cfg.nvKeySize()); err != nil {
+					return "", fmt.Errorf("failed to remove NV index left by an earlier self-test: %w", err)
+				}
+			}
+			if err := SetupLUKSVolume(ctx, cfg); err != nil {
+				return "", err
+			}
+			// Closed again, so mount retrieves the key like it would after a reboot
+			if err := UnmountAndCloseLUKSVolume(ctx, cfg); err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%d MiB volume created", selfTestSizeMB), nil
+		}},
+		{StageMount, func() (string, error) {
+			if useTPM {
+				secrets.Wipe(cfg.Password)
+				cfg.Password = nil
+			}
+			if err := OpenLUKSVolume(ctx, cfg); err != nil {
+				return "", err
+			}
+			if err := MountLUKSVolume(ctx, cfg); err != nil {
+				return "", err
+			}
+			if useTPM {
+				return "key retrieved from NV index " + selfTestNVIndex, nil
+			}
+			return "", nil
+		}},
+		{StageWriteRead, func() (string, error) { return checkWriteRead(cfg) }},
+		{StageUnmount, func() (string, error) {
+			if err := UnmountAndCloseLUKSVolume(ctx, cfg); err != nil {
+				return "", err
+			}
+			if _, err := os.Stat("/dev/mapper/" + cfg.MapperName); err == nil {
+				return "", fmt.Errorf("/dev/mapper/%s still exists", cfg.MapperName)
+			}
+			return "", nil
+		}},
+		{StageDeauthorize, func() (string, error) {
+			if err := RemoveLUKSVolume(ctx, cfg); err != nil {
+				return "", err
+			}
+			if fileExists(cfg.VolumePath) {
+				return "", fmt.Errorf("%s still exists", cfg.VolumePath)
+			}
+			if useTPM && NVIndexDefined(ctx, selfTestNVIndex) {
+				return "", fmt.Errorf("NV index %s still defined", selfTestNVIndex)
+			}
+			return "", nil
+		}},
+	}
+
+	var results []StageResult
+	failed := false
+	for _, stage := range stages {
+		if failed {
+			results = append(results, StageResult{Stage: stage.name, Status: StageSkipped})
+			continue
+		}
+		start := time.Now()
+		detail, err := stage.run()
+		result := StageResult{Stage: stage.name, Status: StagePassed, Detail: detail, Duration: time.Since(start)}
+		if err != nil {
+			result.Status, result.Detail, failed = StageFailed, err.Error(), true
+		}
+		results = append(results, result)
+	}
+	if failed && results[0].Status == StagePassed {
+		// Errors were reported by the failed stage, the cleanup only logs its own
+		RemoveLUKSVolume(ctx, cfg)
+	}
+	secrets.Wipe(cfg.Password)
+	return results
+}
+
+// checkPrerequisites checks the privileges, tools and kernel modules volumes need.
+func checkPrerequisites(ctx context.Context, useTPM bool) (string, error) {
+	if err := host.supported(); err != nil {
+		return "", err
+	}
+	if os.Geteuid() != 0 {
+		return "", fmt.Errorf("root privileges are required")
+	}
+	tools := []string{"cryptsetup", "mkfs." + filesystemType, "mount", "umount", "losetup", "modprobe"}
+	if useTPM && !tpm1Selected() {
+		tools = append(tools, "tpm2_nvdefine", "tpm2_nvwrite", "tpm2_nvread", "tpm2_nvundefine", "tpm2_nvreadpublic")
+	}
+	var missing []string
+	for _, tool := range tools {
+		if _, err := exec.LookPath(tool); err != nil {
+			missing = append(missing, tool)
+		}
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("missing %s", strings.Join(missing, ", "))
+	}
+	// modprobe succeeds for built-in modules as well
+	for _, module := range []string{"dm_crypt", "loop"} {
+		if output, err := trace.Command("modprobe", module).CombinedOutput(); err != nil {
+			return "", fmt.Errorf("kernel module %s unavailable: %s", module, strings.TrimSpace(string(output)))
+		}
+	}
+	if useTPM && !TPMAvailable(ctx) {
+		return "", fmt.Errorf("TPM not available at %s", TPMDevice())
+	}
+	return strings.Join(tools, ", "), nil
+}
+
+// checkWriteRead writes a random pattern to the mounted volume, reads it back, and checks
+// it is not stored in clear in the image.
+func checkWriteRead(cfg *LUKS) (string, error) {
+	pattern := make([]byte, selfTestPatternSize)
+	if _, err := rand.Read(pattern); err != nil {
+		return "", err
+	}
+	path := filepath.Join(cfg.MountPoint, "selftest")
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(pattern)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to write %s: %w", path, err)
+	}
+
+	read, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	if !bytes.Equal(read, pattern) {
+		return "", fmt.Errorf("%s reads back different data", path)
+	}
+	image, err := os.ReadFile(cfg.VolumePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read image: %w", err)
+	}
+	if bytes.Contains(image, pattern[:4096]) {
+		return "", fmt.Errorf("data is stored unencrypted in %s", cfg.VolumePath)
+	}
+	return fmt.Sprintf("%d KiB written, read back and encrypted at rest", selfTestPatternSize>>10), nil
+}
@@ -0,0 +1,24 @@
+package luks
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckWriteRead(t *testing.T) {
+	dir := t.TempDir()
+	image := filepath.Join(dir, "udm-selftest.img")
+	os.WriteFile(image, make([]byte, 1<<20), 0600)
+	cfg := &LUKS{VolumePath: image, MountPoint: dir}
+	if _, err := checkWriteRead(cfg); err != nil {
+		t.Fatalf("checkWriteRead() error = %v", err)
+	}
+
+	// A "volume" storing the written file as is must be caught
+	cfg.VolumePath = filepath.Join(dir, "selftest")
+	if _, err := checkWriteRead(cfg); err == nil || !strings.Contains(err.Error(), "unencrypted") {
+		t.Fatalf("checkWriteRead(plaintext image) error = %v, want unencrypted data reported", err)
+	}
+}
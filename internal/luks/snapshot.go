@@ -0,0 +1,212 @@
+package luks
+
+import (
+	"bootstrap/internal/trace"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// Snapshot describes a read-only copy of the encrypted volume.
+type Snapshot struct {
+	ImagePath  string `json:"imagePath"`
+	MapperName string `json:"mapperName"`
+	MountPoint string `json:"mountPoint"`
+}
+
+// ErrSnapshotUnsupported is returned by CreateSnapshot when the volume can neither be
+// reflinked nor snapshotted by LVM, so a copy would keep the filesystem frozen for as
+// long as copying the whole volume takes.
+var ErrSnapshotUnsupported = errors.New("snapshots need an image file on a reflink-capable filesystem or an LVM volume")
+
+// snapshotOf returns where the snapshot of the volume is stored, opened and mounted. The
+// snapshot of a logical volume is an LVM snapshot next to it.
+func snapshotOf(cfg *LUKS) *Snapshot {
+	snap := &Snapshot{
+		ImagePath:  cfg.VolumePath + ".snapshot",
+		MapperName: cfg.MapperName + "-snap",
+		MountPoint: cfg.MountPoint + "-snapshot",
+	}
+	if cfg.LVM.Enabled() {
+		snap.ImagePath = snapshotLVM(cfg.LVM).DevicePath()
+	}
+	return snap
+}
+
+// snapshotLVM returns the LVM snapshot of the logical volume.
+func snapshotLVM(l LVM) LVM {
+	return LVM{VolumeGroup: l.VolumeGroup, Name: l.Name + "-snap"}
+}
+
+// FreezeFilesystem suspends writes to the mounted filesystem until ThawFilesystem.
+func FreezeFilesystem(ctx context.Context, cfg *LUKS) error {
+	if output, err := runRetried(ctx, OpMount, func() *trace.Cmd { return trace.Command("fsfreeze", "--freeze", cfg.MountPoint) }); err != nil {
+		return fmt.Errorf("failed to freeze filesystem: %s", output)
+	}
+	return nil
+}
+
+// ThawFilesystem resumes writes to a filesystem frozen by FreezeFilesystem.
+func ThawFilesystem(ctx context.Context, cfg *LUKS) error {
+	if output, err := runRetried(ctx, OpMount, func() *trace.Cmd { return trace.Command("fsfreeze", "--unfreeze", cfg.MountPoint) }); err != nil {
+		return fmt.Errorf("failed to thaw filesystem: %s", output)
+	}
+	return nil
+}
+
+// CreateSnapshot freezes the mounted filesystem only for as long as a reflink of the
+// backing image or an LVM snapshot takes, then exposes the crash-consistent copy
+// read-only while the application keeps writing to the original. Anything done before
+// a failure is undone.
+func CreateSnapshot(ctx context.Context, cfg *LUKS) (*Snapshot, error) {
+	mounted, err := IsLUKSMounted(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check if LUKS volume is mounted: %w", err)
+	}
+	if !mounted {
+		return nil, fmt.Errorf("LUKS volume is not mounted")
+	}
+	if !cfg.LVM.Enabled() && !isImageFile(cfg) {
+		return nil, ErrSnapshotUnsupported
+	}
+
+	snap := snapshotOf(cfg)
+	if _, err := os.Stat(snap.ImagePath); err == nil {
+		return nil, fmt.Errorf("snapshot %s already exists, release it first", snap.ImagePath)
+	}
+
+	if err := resolveKey(ctx, cfg); err != nil {
+		return nil, err
+	}
+
+	tx := &transaction{}
+	defer tx.rollback()
+
+	if err := progress.step("Snapshotting volume", func() error { return snapshotFrozen(ctx, cfg, snap) }); err != nil {
+		return nil, err
+	}
+	tx.onRollback("remove "+snap.ImagePath, func() error { return removeSnapshotStorage(ctx, cfg, snap) })
+
+	if err := openDevice(ctx, snap.ImagePath, func(device string) error {
+		if output, err := runRetried(ctx, OpCryptsetup, func() *trace.Cmd {
+			cmd := trace.Command("cryptsetup", "open", "--readonly", "--key-file=-", device, snap.MapperName)
+			cmd.Stdin = bytes.NewReader(cfg.Password)
+			return cmd
+		}); err != nil {
+			return fmt.Errorf("failed to open snapshot: %s", strings.TrimSpace(string(output)))
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	tx.onRollback("close mapper "+snap.MapperName, func() error { return CloseLUKSVolume(ctx, snap.MapperName) })
+
+	if err := os.MkdirAll(snap.MountPoint, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create snapshot mount point: %w", err)
+	}
+	tx.onRollback("remove "+snap.MountPoint, func() error { return os.Remove(snap.MountPoint) })
+	if output, err := runRetried(ctx, OpMount, func() *trace.Cmd {
+		return trace.Command("mount", "-o", "ro,noload", "/dev/mapper/"+snap.MapperName, snap.MountPoint)
+	}); err != nil {
+		return nil, fmt.Errorf("failed to mount snapshot: %s", output)
+	}
+
+	tx.commit()
+	return snap, nil
+}
+
+// snapshotFrozen takes the reflink or LVM snapshot while the filesystem is frozen. Both
+// only record references to the blocks, so writes pause for moments whatever the size
+// of the volume.
+func snapshotFrozen(ctx context.Context, cfg *LUKS, snap *Snapshot) error {
+	if err := FreezeFilesystem(ctx, cfg); err != nil {
+		return err
+	}
+	defer func() {
+		// Thawed even when ctx is canceled, a frozen filesystem blocks every writer
+		if err := ThawFilesystem(context.WithoutCancel(ctx), cfg); err != nil {
+			log.Printf("Failed to thaw filesystem: %v", err)
+		}
+	}()
+
+	if cfg.LVM.Enabled() {
+		output, err := runRetried(ctx, OpCryptsetup, func() *trace.Cmd {
+			return trace.Command("lvcreate", "--snapshot", "--extents", snapshotExtents, "--name", snapshotLVM(cfg.LVM).Name,
+				cfg.LVM.VolumeGroup+"/"+cfg.LVM.Name)
+		})
+		if err != nil {
+			return fmt.Errorf("lvcreate --snapshot failed: %s", strings.TrimSpace(string(output)))
+		}
+		return nil
+	}
+	output, err := runRetried(ctx, OpMount, func() *trace.Cmd {
+		return trace.Command("cp", "--reflink=always", cfg.VolumePath, snap.ImagePath)
+	})
+	if err != nil {
+		os.Remove(snap.ImagePath)
+		return fmt.Errorf("%w: %s", ErrSnapshotUnsupported, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// snapshotExtents is the copy-on-write space of LVM snapshots, relative to the volume.
+const snapshotExtents = "20%ORIGIN"
+
+// removeSnapshotStorage deletes the reflinked image or the LVM snapshot.
+func removeSnapshotStorage(ctx context.Context, cfg *LUKS, snap *Snapshot) error {
+	if cfg.LVM.Enabled() {
+		if _, err := os.Stat(snap.ImagePath); os.IsNotExist(err) {
+			return nil
+		}
+		return removeLogicalVolume(ctx, snapshotLVM(cfg.LVM))
+	}
+	if err := os.Remove(snap.ImagePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// ReleaseSnapshot unmounts, closes and deletes the snapshot of the volume.
+func ReleaseSnapshot(ctx context.Context, cfg *LUKS) error {
+	snap := snapshotOf(cfg)
+
+	if err := UnmountLUKSVolume(ctx, snap.MountPoint); err != nil {
+		log.Printf("failed to unmount snapshot: %s", err)
+	}
+	if err := CloseLUKSVolume(ctx, snap.MapperName); err != nil {
+		log.Printf("failed to close snapshot: %s", err)
+	}
+	if err := os.Remove(snap.MountPoint); err != nil && !os.IsNotExist(err) {
+		log.Printf("failed to remove snapshot mount point: %s", err)
+	}
+	if err := removeSnapshotStorage(ctx, cfg, snap); err != nil {
+		return fmt.Errorf("failed to remove snapshot: %w", err)
+	}
+	return nil
+}
+
+// resolveKey retrieves the key into cfg.Password when it is held by the TPM alone or by
+// Vault; keyfile and split keys are loaded by the caller.
+func resolveKey(ctx context.Context, cfg *LUKS) error {
+	if cfg.Vault.Enabled() {
+		password, err := retrieveFromVault(cfg)
+		if err != nil {
+			return err
+		}
+		cfg.Password = password
+		return nil
+	}
+	if !cfg.UseTPM || cfg.Split.Enabled() {
+		return nil
+	}
+	password, err := retrievePasswordFromTPM(ctx, cfg.KeyNVIndex(), cfg.KeyBytes, cfg.NVAuth)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve password from TPM: %w", err)
+	}
+	cfg.Password = password
+	return nil
+}
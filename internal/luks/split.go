@@ -0,0 +1,119 @@
+package luks
+
+import (
+	"bootstrap/internal/shamir"
+	"context"
+	"fmt"
+	"log"
+	"os"
+)
+
+// Shares are always generated for every holder role so that the x coordinate of a
+// share identifies where it belongs; only the configured holders receive theirs.
+const (
+	shareKeyfile = iota
+	shareTPM
+	shareEscrow
+	shareCount
+)
+
+// SplitKey configures split-key mode, where the LUKS key is divided into Shamir shares
+// held by the keyfile, the TPM and an operator escrow file.
+type SplitKey struct {
+	Threshold  int    `yaml:"threshold"`  // Shares required to reconstruct the key, 0 disables split mode
+	EscrowPath string `yaml:"escrowPath"` // Path the operator escrow share is written to
+}
+
+// Enabled reports whether split-key mode is configured.
+func (s SplitKey) Enabled() bool {
+	return s.Threshold > 0
+}
+
+// nvKeySize returns the number of bytes stored in the TPM NV index.
+func (cfg *LUKS) nvKeySize() int {
+	if cfg.Split.Enabled() {
+		return cfg.KeyBytes + 1 // a share carries its x coordinate
+	}
+	return cfg.KeyBytes
+}
+
+// StoreKeyShares splits cfg.Password and stores the TPM and escrow shares. The keyfile
+// share is returned for the caller to persist when withKeyfile is set.
+func StoreKeyShares(ctx context.Context, cfg *LUKS, withKeyfile bool) ([]byte, error) {
+	holders := 0
+	if withKeyfile {
+		holders++
+	}
+	if cfg.UseTPM {
+		holders++
+	}
+	if cfg.Split.EscrowPath != "" {
+		holders++
+	}
+	if holders < cfg.Split.Threshold {
+		return nil, fmt.Errorf("only %d share holders configured, threshold requires %d", holders, cfg.Split.Threshold)
+	}
+
+	shares, err := shamir.Split(cfg.Password, shareCount, cfg.Split.Threshold)
+	if err != nil {
+		return nil, fmt.Errorf("failed to split key: %w", err)
+	}
+
+	if cfg.UseTPM {
+		if err := checkNVIndexFree(ctx, cfg.KeyNVIndex()); err != nil {
+			return nil, err
+		}
+		if err := storePasswordInTPM(ctx, shares[shareTPM], cfg.KeyNVIndex(), cfg.NVAuth); err != nil {
+			return nil, fmt.Errorf("failed to store key share in TPM: %w", err)
+		}
+	}
+
+	if cfg.Split.EscrowPath != "" {
+		if err := os.WriteFile(cfg.Split.EscrowPath, shares[shareEscrow], 0600); err != nil {
+			return nil, fmt.Errorf("failed to write escrow share: %w", err)
+		}
+	}
+
+	if !withKeyfile {
+		return nil, nil
+	}
+	return shares[shareKeyfile], nil
+}
+
+// RecoverSplitKey reconstructs the LUKS key into cfg.Password from whichever shares are
+// available: the keyfile share (if not nil), the TPM and the escrow file.
+func RecoverSplitKey(ctx context.Context, cfg *LUKS, keyfileShare []byte) error {
+	var shares [][]byte
+	if keyfileShare != nil {
+		shares = append(shares, keyfileShare)
+	}
+
+	if cfg.UseTPM {
+		share, err := retrievePasswordFromTPM(ctx, cfg.KeyNVIndex(), cfg.nvKeySize(), cfg.NVAuth)
+		if err != nil {
+			log.Printf("TPM key share unavailable: %v", err)
+		} else {
+			shares = append(shares, share)
+		}
+	}
+
+	if cfg.Split.EscrowPath != "" {
+		share, err := os.ReadFile(cfg.Split.EscrowPath)
+		if err != nil {
+			log.Printf("Escrow key share unavailable: %v", err)
+		} else {
+			shares = append(shares, share)
+		}
+	}
+
+	if len(shares) < cfg.Split.Threshold {
+		return fmt.Errorf("only %d key shares available, threshold requires %d", len(shares), cfg.Split.Threshold)
+	}
+
+	key, err := shamir.Combine(shares)
+	if err != nil {
+		return fmt.Errorf("failed to combine key shares: %w", err)
+	}
+	cfg.Password = key
+	return nil
+}
@@ -0,0 +1,219 @@
+package luks
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Paths of the tables written by add-persistent-mount.
+const (
+	crypttabPath = "/etc/crypttab"
+	fstabPath    = "/etc/fstab"
+)
+
+// tabFile is a whitespace-separated table like /etc/fstab or /etc/crypttab. Entries
+// are matched on exact fields, comments, blank lines and unrelated entries are kept
+// as they are.
+type tabFile struct {
+	path  string
+	lines []string
+	mode  os.FileMode
+}
+
+// readTabFile reads a table, a missing file being empty.
+func readTabFile(path string) (*tabFile, error) {
+	f := &tabFile{path: path, mode: 0644}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(path); err == nil {
+		f.mode = info.Mode().Perm()
+	}
+	if text := strings.TrimSuffix(string(data), "\n"); text != "" {
+		f.lines = strings.Split(text, "\n")
+	}
+	return f, nil
+}
+
+// tabFields returns the fields of an entry, nil for comments and blank lines.
+func tabFields(line string) []string {
+	if trimmed := strings.TrimSpace(line); trimmed == "" || strings.HasPrefix(trimmed, "#") {
+		return nil
+	}
+	return strings.Fields(line)
+}
+
+// unescapeTabField decodes the octal escapes of fstab and crypttab fields, e.g. \040
+// for a space in a mount point.
+func unescapeTabField(field string) string {
+	var b strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+3 < len(field) && isOctal(field[i+1]) && isOctal(field[i+2]) && isOctal(field[i+3]) {
+			b.WriteByte((field[i+1]-'0')<<6 | (field[i+2]-'0')<<3 | (field[i+3] - '0'))
+			i += 3
+			continue
+		}
+		b.WriteByte(field[i])
+	}
+	return b.String()
+}
+
+func isOctal(c byte) bool {
+	return c >= '0' && c <= '7'
+}
+
+// find returns the entries for which match is true.
+func (f *tabFile) find(match func(fields []string) bool) []string {
+	var entries []string
+	for _, line := range f.lines {
+		if fields := tabFields(line); fields != nil && match(fields) {
+			entries = append(entries, strings.TrimSpace(line))
+		}
+	}
+	return entries
+}
+
+// set makes entry the only line matching match: the first matching line is replaced in
+// place, duplicates are dropped, and entry is appended when no line matched. It reports
+// whether the table changed.
+func (f *tabFile) set(match func(fields []string) bool, entry string) bool {
+	changed, found := false, false
+	lines := f.lines[:0:0]
+	for _, line := range f.lines {
+		if fields := tabFields(line); fields != nil && match(fields) {
+			if found {
+				changed = true
+				continue
+			}
+			found = true
+			if !slices.Equal(fields, strings.Fields(entry)) {
+				line, changed = entry, true
+			}
+		}
+		lines = append(lines, line)
+	}
+	if !found {
+		lines = append(lines, entry)
+		changed = true
+	}
+	f.lines = lines
+	return changed
+}
+
+// remove drops the entries for which match is true and returns how many there were.
+func (f *tabFile) remove(match func(fields []string) bool) int {
+	removed := 0
+	lines := f.lines[:0:0]
+	for _, line := range f.lines {
+		if fields := tabFields(line); fields != nil && match(fields) {
+			removed++
+			continue
+		}
+		lines = append(lines, line)
+	}
+	f.lines = lines
+	return removed
+}
+
+// save replaces the table atomically, keeping its mode.
+func (f *tabFile) save() error {
+	data := strings.Join(f.lines, "\n")
+	if data != "" {
+		data += "\n"
+	}
+	tempFilePath := f.path + ".tmp"
+	if err := os.WriteFile(tempFilePath, []byte(data), f.mode); err != nil {
+		return fmt.Errorf("failed to write temporary file: %w", err)
+	}
+	if err := os.Rename(tempFilePath, f.path); err != nil {
+		os.Remove(tempFilePath)
+		return fmt.Errorf("failed to replace %s: %w", f.path, err)
+	}
+	return nil
+}
+
+// crypttabMatch matches the crypttab entry of the mapping.
+func crypttabMatch(mapperName string) func(fields []string) bool {
+	return func(fields []string) bool {
+		return fields[0] == mapperName
+	}
+}
+
+// fstabMatch matches the fstab entries written for the volume: those requiring its
+// cryptsetup unit or mounting its mapper device.
+func fstabMatch(cfg *LUKS) func(fields []string) bool {
+	requires := fmt.Sprintf("x-systemd.requires=cryptsetup@%s.service", cfg.MapperName)
+	return func(fields []string) bool {
+		if unescapeTabField(fields[0]) == "/dev/mapper/"+cfg.MapperName {
+			return true
+		}
+		return len(fields) > 3 && slices.Contains(strings.Split(fields[3], ","), requires)
+	}
+}
+
+// setCrypttabEntry writes the crypttab entry of the volume, refusing to when another
+// mapping is already configured on the same device, by path or by the source of entry.
+func setCrypttabEntry(path string, cfg *LUKS, entry string) (bool, error) {
+	crypttab, err := readTabFile(path)
+	if err != nil {
+		return false, err
+	}
+	var source string
+	if fields := strings.Fields(entry); len(fields) > 1 {
+		source = fields[1]
+	}
+	ours := crypttabMatch(cfg.MapperName)
+	others := crypttab.find(func(fields []string) bool {
+		if ours(fields) || len(fields) < 2 {
+			return false
+		}
+		return unescapeTabField(fields[1]) == cfg.VolumePath || fields[1] == source
+	})
+	if len(others) > 0 {
+		return false, fmt.Errorf("%s already opens %s: %s", path, cfg.VolumePath, others[0])
+	}
+	if !crypttab.set(ours, entry) {
+		return false, nil
+	}
+	return true, crypttab.save()
+}
+
+// setFstabEntry writes the fstab entry of the volume, refusing to when another
+// filesystem is already mounted on the same mount point. Swap areas all share the none
+// mount point and never conflict.
+func setFstabEntry(path string, cfg *LUKS, entry string) (bool, error) {
+	fstab, err := readTabFile(path)
+	if err != nil {
+		return false, err
+	}
+	ours := fstabMatch(cfg)
+	others := fstab.find(func(fields []string) bool {
+		return !ours(fields) && len(fields) > 1 && unescapeTabField(fields[1]) == cfg.MountPoint && cfg.Profile != ProfileSwap
+	})
+	if len(others) > 0 {
+		return false, fmt.Errorf("%s already mounts %s: %s", path, cfg.MountPoint, others[0])
+	}
+	if !fstab.set(ours, entry) {
+		return false, nil
+	}
+	return true, fstab.save()
+}
+
+// removeTabEntries drops the entries matching match, leaving the file untouched when
+// there are none.
+func removeTabEntries(path string, match func(fields []string) bool) error {
+	table, err := readTabFile(path)
+	if err != nil {
+		return err
+	}
+	if table.remove(match) == 0 {
+		return nil
+	}
+	return table.save()
+}
@@ -0,0 +1,174 @@
+package luks
+
+import (
+	"bootstrap/internal/features"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// copyFixture copies a table of testdata to a temporary file.
+func copyFixture(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func readFixture(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestSetFstabEntry(t *testing.T) {
+	cfg := &LUKS{MapperName: "udm-luks", MountPoint: "/mnt/udm-luks"}
+	fstab := copyFixture(t, "fstab")
+	original := readFixture(t, fstab)
+	entry := fstabEntry(cfg, "new-uuid")
+
+	changed, err := setFstabEntry(fstab, cfg, entry)
+	if err != nil || !changed {
+		t.Fatalf("setFstabEntry() = %v, %v, want true, nil", changed, err)
+	}
+	updated := readFixture(t, fstab)
+	if strings.Count(updated, "cryptsetup@udm-luks.service") != 1 || !strings.Contains(updated, entry+"\n") {
+		t.Fatalf("stale and duplicate entries not replaced by one entry:\n%s", updated)
+	}
+	// Comments and unrelated entries, including the similar mount point, are kept in order
+	want := original[:strings.Index(original, "UUID=old-uuid")] + entry + "\n"
+	if updated != want {
+		t.Fatalf("fstab =\n%s\nwant\n%s", updated, want)
+	}
+
+	changed, err = setFstabEntry(fstab, cfg, entry)
+	if err != nil || changed {
+		t.Fatalf("second setFstabEntry() = %v, %v, want false, nil", changed, err)
+	}
+	if again := readFixture(t, fstab); again != updated {
+		t.Fatalf("second setFstabEntry() changed the file:\n%s", again)
+	}
+}
+
+func TestSetFstabEntryConflict(t *testing.T) {
+	cfg := &LUKS{MapperName: "udm-data", MountPoint: "/mnt/udm-luks-archive"}
+	fstab := copyFixture(t, "fstab")
+	original := readFixture(t, fstab)
+	if _, err := setFstabEntry(fstab, cfg, fstabEntry(cfg, "1234")); err == nil || !strings.Contains(err.Error(), "/dev/sdb1") {
+		t.Fatalf("setFstabEntry() error = %v, want the entry already mounting the mount point", err)
+	}
+	if readFixture(t, fstab) != original {
+		t.Fatal("fstab changed despite the conflict")
+	}
+}
+
+func TestSetCrypttabEntry(t *testing.T) {
+	cfg := &LUKS{MapperName: "udm-luks", VolumePath: "/var/lib/udm/udm-luks.img"}
+	crypttab := copyFixture(t, "crypttab")
+	entry := "udm-luks /var/lib/udm/udm-luks.img none luks,keyscript=/usr/local/bin/tpm-luks-keyscript.sh"
+
+	changed, err := setCrypttabEntry(crypttab, cfg, entry)
+	if err != nil || !changed {
+		t.Fatalf("setCrypttabEntry() = %v, %v, want true, nil", changed, err)
+	}
+	got, err := findCrypttabEntry(crypttab, "udm-luks")
+	if err != nil || got != entry {
+		t.Fatalf("findCrypttabEntry() = %q, %v, want %q", got, err, entry)
+	}
+	// The entry of udm-luks-2 shares a prefix but is another mapping
+	if other, _ := findCrypttabEntry(crypttab, "udm-luks-2"); other == "" {
+		t.Fatal("entry of udm-luks-2 removed")
+	}
+	if changed, err := setCrypttabEntry(crypttab, cfg, entry); err != nil || changed {
+		t.Fatalf("second setCrypttabEntry() = %v, %v, want false, nil", changed, err)
+	}
+
+	// Another mapping on the same device is a conflict
+	cfg.MapperName = "udm-copy"
+	if _, err := setCrypttabEntry(crypttab, cfg, "udm-copy /var/lib/udm/udm-luks.img none luks"); err == nil {
+		t.Fatal("setCrypttabEntry() accepted a second mapping of the device")
+	}
+
+	// So is another mapping of the same LUKS UUID
+	cfg.MapperName, cfg.VolumePath = "udm-luks", "/dev/sdb1"
+	uuidEntry := "udm-luks UUID=0b9c7f7e-2c1a-4f6b-9d7e-5f3a1c2b4d6e none luks"
+	if _, err := setCrypttabEntry(crypttab, cfg, uuidEntry); err != nil {
+		t.Fatalf("setCrypttabEntry() = %v, want UUID entry replacing the path", err)
+	}
+	cfg.MapperName, cfg.VolumePath = "udm-copy", "/dev/sdc1"
+	if _, err := setCrypttabEntry(crypttab, cfg, "udm-copy UUID=0b9c7f7e-2c1a-4f6b-9d7e-5f3a1c2b4d6e none luks"); err == nil {
+		t.Fatal("setCrypttabEntry() accepted a second mapping of the UUID")
+	}
+}
+
+func TestCrypttabSource(t *testing.T) {
+	image := filepath.Join(t.TempDir(), "udm-luks.img")
+	if err := os.WriteFile(image, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	const uuid = "0b9c7f7e-2c1a-4f6b-9d7e-5f3a1c2b4d6e"
+	tests := []struct {
+		name string
+		cfg  LUKS
+		uuid string
+		want string
+	}{
+		{"block device", LUKS{VolumePath: "/dev/sdb1"}, uuid, "UUID=" + uuid},
+		{"image with loop unit", LUKS{VolumePath: image}, uuid, "UUID=" + uuid},
+		{"image without systemd units", LUKS{VolumePath: image, Features: features.Set{features.SystemdUnits: false}}, uuid, image},
+		{"unknown UUID", LUKS{VolumePath: "/dev/sdb1"}, "", "/dev/sdb1"},
+	}
+	for _, tt := range tests {
+		if got := crypttabSource(&tt.cfg, tt.uuid); got != tt.want {
+			t.Errorf("%s: crypttabSource() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRemoveTabEntries(t *testing.T) {
+	cfg := &LUKS{MapperName: "udm-luks", MountPoint: "/mnt/udm-luks"}
+	fstab := copyFixture(t, "fstab")
+	if err := removeTabEntries(fstab, fstabMatch(cfg)); err != nil {
+		t.Fatal(err)
+	}
+	updated := readFixture(t, fstab)
+	if strings.Contains(updated, "cryptsetup@udm-luks.service") {
+		t.Fatalf("entries of udm-luks left:\n%s", updated)
+	}
+	// A substring match on the mount point would have removed the archive entry
+	for _, keep := range []string{"/mnt/udm-luks-archive", "# Written by udm", "proc"} {
+		if !strings.Contains(updated, keep) {
+			t.Errorf("%q removed:\n%s", keep, updated)
+		}
+	}
+
+	crypttab := copyFixture(t, "crypttab")
+	if err := removeTabEntries(crypttab, crypttabMatch("udm-luks")); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := findCrypttabEntry(crypttab, "udm-luks"); got != "" {
+		t.Fatalf("crypttab entry left: %q", got)
+	}
+	if got, _ := findCrypttabEntry(crypttab, "udm-luks-2"); got == "" {
+		t.Fatal("entry of udm-luks-2 removed")
+	}
+}
+
+func TestUnescapeTabField(t *testing.T) {
+	if got := unescapeTabField(`/mnt/my\040data`); got != "/mnt/my data" {
+		t.Fatalf("unescapeTabField() = %q", got)
+	}
+	if got := unescapeTabField(`/mnt/a\0`); got != `/mnt/a\0` {
+		t.Fatalf("unescapeTabField() = %q", got)
+	}
+}
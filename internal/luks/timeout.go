@@ -0,0 +1,70 @@
+package luks
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Default time limits of a single attempt of an external command per operation class.
+const (
+	DefaultCryptsetupTimeout = "2m"
+	DefaultTPMTimeout        = "30s"
+	DefaultMountTimeout      = "1m"
+)
+
+// Timeouts bounds how long an external command of each operation class may run before
+// it is killed, e.g. tpm2_nvread against a wedged TPM. Long-running commands such as
+// luksFormat and reencrypt are not bounded.
+type Timeouts struct {
+	Cryptsetup string `yaml:"cryptsetup"` // cryptsetup, losetup and other block device tools, e.g. "2m"
+	TPM        string `yaml:"tpm"`        // tpm2-tools, e.g. "30s"
+	Mount      string `yaml:"mount"`      // mount, umount and other filesystem tools, e.g. "1m"
+}
+
+var (
+	timeoutMu sync.Mutex
+	timeouts  = map[string]time.Duration{}
+)
+
+func (t *Timeouts) durations() map[string]*string {
+	return map[string]*string{OpCryptsetup: &t.Cryptsetup, OpTPM: &t.TPM, OpMount: &t.Mount}
+}
+
+// Validate checks the timeouts and fills in the defaults.
+func (t *Timeouts) Validate() error {
+	defaults := map[string]string{OpCryptsetup: DefaultCryptsetupTimeout, OpTPM: DefaultTPMTimeout, OpMount: DefaultMountTimeout}
+	for class, timeout := range t.durations() {
+		if *timeout == "" {
+			*timeout = defaults[class]
+		}
+		if d, err := time.ParseDuration(*timeout); err != nil || d <= 0 {
+			return fmt.Errorf("timeouts.%s (%s) must be a positive duration, e.g. 30s", class, *timeout)
+		}
+	}
+	return nil
+}
+
+// SetTimeouts installs the timeouts of a validated configuration.
+func SetTimeouts(t Timeouts) {
+	timeoutMu.Lock()
+	defer timeoutMu.Unlock()
+	for class, timeout := range t.durations() {
+		timeouts[class], _ = time.ParseDuration(*timeout)
+	}
+}
+
+// commandContext returns the context of one attempt of a command of class, canceled
+// with ctx, e.g. when the daemon stops.
+func commandContext(ctx context.Context, class string) (context.Context, context.CancelFunc) {
+	timeoutMu.Lock()
+	defer timeoutMu.Unlock()
+	timeout, ok := timeouts[class]
+	if !ok || timeout <= 0 {
+		defaults := Timeouts{}
+		defaults.Validate()
+		timeout, _ = time.ParseDuration(*defaults.durations()[class])
+	}
+	return context.WithTimeout(ctx, timeout)
+}
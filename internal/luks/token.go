@@ -0,0 +1,127 @@
+package luks
+
+import (
+	"bootstrap/internal/trace"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const (
+	NVTokenType      = "udm-tpm2-nv" // LUKS2 token type describing our NV index binding
+	DefaultTPMPCRs   = "7"           // PCRs the systemd-tpm2 token is bound to by default
+	tpm2CrypttabOpts = "tpm2-device=auto"
+
+	systemdTPM2TokenType = "systemd-tpm2" // Token type systemd-cryptenroll records
+)
+
+// NVToken is the LUKS2 token stored in the volume header to record where the
+// TPM-resident key lives, so unlock tooling does not depend on hardcoded defaults.
+type NVToken struct {
+	Type     string   `json:"type"`
+	Keyslots []string `json:"keyslots"`
+	NVIndex  string   `json:"nv-index"`
+	NVSize   string   `json:"nv-size"`
+}
+
+// addNVToken imports an NVToken into the LUKS2 header of the volume, bound to keyslot 0.
+func addNVToken(ctx context.Context, volumePath, nvIndex string, size int) error {
+	token := NVToken{
+		Type:     NVTokenType,
+		Keyslots: []string{"0"},
+		NVIndex:  nvIndex,
+		NVSize:   fmt.Sprintf("%d", size),
+	}
+	data, err := json.Marshal(token)
+	if err != nil {
+		return fmt.Errorf("failed to encode LUKS2 token: %w", err)
+	}
+
+	output, err := runRetried(ctx, OpCryptsetup, func() *trace.Cmd {
+		cmd := trace.Command("cryptsetup", "token", "import", "--json-file=-", volumePath)
+		cmd.Stdin = strings.NewReader(string(data))
+		return cmd
+	})
+	if err != nil {
+		return fmt.Errorf("failed to import LUKS2 token: %s, error: %w", output, err)
+	}
+	return nil
+}
+
+// readTokens returns the tokens in the LUKS2 header of the volume.
+func readTokens(ctx context.Context, volumePath string) ([]json.RawMessage, error) {
+	output, err := outputRetried(ctx, OpCryptsetup, func() *trace.Cmd {
+		return trace.Command("cryptsetup", "luksDump", "--dump-json-metadata", volumePath)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to dump LUKS2 metadata: %w", err)
+	}
+
+	var metadata struct {
+		Tokens map[string]json.RawMessage `json:"tokens"`
+	}
+	if err := json.Unmarshal(output, &metadata); err != nil {
+		return nil, fmt.Errorf("failed to parse LUKS2 metadata: %w", err)
+	}
+	tokens := make([]json.RawMessage, 0, len(metadata.Tokens))
+	for _, raw := range metadata.Tokens {
+		tokens = append(tokens, raw)
+	}
+	return tokens, nil
+}
+
+// ReadNVToken returns the NV index binding recorded in the LUKS2 header, if any.
+func ReadNVToken(ctx context.Context, volumePath string) (*NVToken, error) {
+	tokens, err := readTokens(ctx, volumePath)
+	if err != nil {
+		return nil, err
+	}
+	for _, raw := range tokens {
+		var token NVToken
+		if err := json.Unmarshal(raw, &token); err != nil {
+			continue
+		}
+		if token.Type == NVTokenType {
+			return &token, nil
+		}
+	}
+	return nil, fmt.Errorf("no %s token found in LUKS2 header", NVTokenType)
+}
+
+// hasSystemdTPM2Token reports whether the LUKS2 header holds a systemd-tpm2 token, which
+// volumes authorized before the token became the default lack.
+func hasSystemdTPM2Token(ctx context.Context, volumePath string) (bool, error) {
+	tokens, err := readTokens(ctx, volumePath)
+	if err != nil {
+		return false, err
+	}
+	for _, raw := range tokens {
+		var token struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(raw, &token); err == nil && token.Type == systemdTPM2TokenType {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// enrollSystemdTPM2 adds a keyslot sealed to the TPM together with a systemd-tpm2 token,
+// so systemd-cryptsetup can unlock the volume natively at boot.
+func enrollSystemdTPM2(ctx context.Context, cfg *LUKS) error {
+	// systemd-cryptenroll needs an existing key to add the new keyslot, read from stdin
+	output, err := runRetried(ctx, OpTPM, func() *trace.Cmd {
+		cmd := trace.Command("systemd-cryptenroll",
+			"--unlock-key-file=/dev/stdin",
+			"--tpm2-device=auto",
+			"--tpm2-pcrs="+cfg.TPMPCRs,
+			cfg.VolumePath)
+		cmd.Stdin = createPasswordInput(cfg.Password, false)
+		return cmd
+	})
+	if err != nil {
+		return fmt.Errorf("systemd-cryptenroll error: %s", string(output))
+	}
+	return nil
+}
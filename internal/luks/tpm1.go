@@ -0,0 +1,136 @@
+package luks
+
+import (
+	"bootstrap/internal/secrets"
+	"bootstrap/internal/trace"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// TPM versions of tpm.version.
+const (
+	TPMVersion20   = "2.0"  // tpm2-tools, keys in NV indices
+	TPMVersion12   = "1.2"  // TrouSerS tpm-tools, keys sealed to the SRK in blob files
+	TPMVersionAuto = "auto" // 1.2 when the kernel reports a TPM 1.2 chip, 2.0 otherwise
+)
+
+var (
+	// TPM1SealDir holds the blobs of keys sealed by a TPM 1.2. A blob can only be
+	// unsealed by the TPM that sealed it, in the PCR state of tpm.sealPCRs.
+	TPM1SealDir = "/var/lib/udm/tpm1"
+
+	// tpmVersionFile reports the major version of the first TPM on kernels since 5.6.
+	tpmVersionFile = "/sys/class/tpm/tpm0/tpm_version_major"
+)
+
+// ValidTPMVersion reports whether version is a supported tpm.version.
+func ValidTPMVersion(version string) bool {
+	switch version {
+	case TPMVersion20, TPMVersion12, TPMVersionAuto:
+		return true
+	}
+	return false
+}
+
+// detectTPMVersion resolves auto: without a resource manager and with a 1.2 chip
+// reported by the kernel, keys are sealed with tpm-tools.
+func detectTPMVersion() string {
+	data, err := os.ReadFile(tpmVersionFile)
+	if err == nil && strings.TrimSpace(string(data)) == "1" {
+		return TPMVersion12
+	}
+	return TPMVersion20
+}
+
+// tpm1Selected reports whether keys are kept by a TPM 1.2.
+func tpm1Selected() bool {
+	tpmMu.Lock()
+	defer tpmMu.Unlock()
+	return tpmVersion == TPMVersion12
+}
+
+// tpm1Present reports whether tcsd answers for a TPM 1.2.
+func tpm1Present(ctx context.Context) (bool, error) {
+	if _, err := os.Stat("/dev/tpm0"); errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if output, err := runRetried(ctx, OpTPM, func() *trace.Cmd { return trace.Command("tpm_version") }); err != nil {
+		return false, fmt.Errorf("TPM 1.2 present but tpm_version failed, is tcsd running? %s", strings.TrimSpace(string(output)))
+	}
+	return true, nil
+}
+
+// tpm1BlobPath returns the blob file standing in for the NV index of TPM 2.0.
+func tpm1BlobPath(nvIndex string) string {
+	return filepath.Join(TPM1SealDir, strings.TrimPrefix(nvIndex, "0x")+".sealed")
+}
+
+// tpm1SealArgs returns the tpm_sealdata arguments binding the blob to the PCRs.
+func tpm1SealArgs(pcrs []int) []string {
+	args := []string{"--well-known"}
+	for _, pcr := range pcrs {
+		args = append(args, "--pcr", strconv.Itoa(pcr))
+	}
+	return args
+}
+
+// sealToTPM1 seals the key to the storage root key and writes the blob for nvIndex.
+// NV auth modes protect NV indices, a sealed blob is protected by the TPM instead.
+func sealToTPM1(ctx context.Context, password []byte, nvIndex string, auth NVAuth) error {
+	if auth.Mode != "" && auth.Mode != NVAuthNone {
+		return fmt.Errorf("luks.nvAuth.mode %s requires TPM 2.0, bind TPM 1.2 keys with tpm.sealPCRs", auth.Mode)
+	}
+	if err := os.MkdirAll(TPM1SealDir, 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", TPM1SealDir, err)
+	}
+	output, err := outputRetried(ctx, OpTPM, func() *trace.Cmd {
+		cmd := trace.Command("tpm_sealdata", tpm1SealArgs(currentSealPCRs())...)
+		cmd.Stdin = createPasswordInput(password, false)
+		return cmd
+	})
+	if err != nil {
+		return fmt.Errorf("tpm_sealdata error: %w", err)
+	}
+	path := tpm1BlobPath(nvIndex)
+	if err := os.WriteFile(path+".tmp", output, 0600); err != nil {
+		return fmt.Errorf("failed to write sealed key: %w", err)
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// unsealFromTPM1 unseals the key of nvIndex, which must be size bytes long.
+func unsealFromTPM1(ctx context.Context, nvIndex string, size int) ([]byte, error) {
+	path := tpm1BlobPath(nvIndex)
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("no key sealed by the TPM 1.2: %w", err)
+	}
+	output, err := outputRetried(ctx, OpTPM, func() *trace.Cmd {
+		return trace.Command("tpm_unsealdata", "--srk-well-known", "--infile", path)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("tpm_unsealdata error for %s: %w", path, err)
+	}
+	defer secrets.Wipe(output)
+	if len(output) != size {
+		return nil, fmt.Errorf("tpm_unsealdata returned %d bytes, expected %d", len(output), size)
+	}
+	buf, err := secrets.New(size)
+	if err != nil {
+		return nil, err
+	}
+	copy(buf.Bytes(), output)
+	return buf.Bytes(), nil
+}
+
+// removeTPM1Blob removes the sealed key of nvIndex.
+func removeTPM1Blob(nvIndex string) error {
+	if err := os.Remove(tpm1BlobPath(nvIndex)); err != nil {
+		return fmt.Errorf("failed to remove sealed key: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package luks
+
+import (
+	"bootstrap/internal/trace"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// DefaultTPMDevice is the in-kernel resource manager of the TPM.
+const DefaultTPMDevice = "/dev/tpmrm0"
+
+// tctiEnv selects the TPM of tpm2-tools, inherited by every tpm2_* command.
+const tctiEnv = "TPM2TOOLS_TCTI"
+
+// TPM selects the TPM the tpm2-tools talk to, or a TPM 1.2 used through tcsd.
+type TPM struct {
+	// Device is a device node, /dev/tpmrm0 by default or /dev/tpm0 on kernels without
+	// the in-kernel resource manager, or a TCTI such as swtpm:host=localhost,port=2321.
+	Device string `yaml:"device"`
+
+	Version  string `yaml:"version"`  // 2.0 (default), 1.2 or auto
+	SealPCRs []int  `yaml:"sealPCRs"` // TPM 1.2: PCRs the sealed key is bound to, e.g. [0, 2, 4, 7]
+}
+
+var (
+	tpmMu       sync.Mutex
+	tpmDevice   = DefaultTPMDevice
+	tpmVersion  = TPMVersion20
+	tpmSealPCRs []int
+)
+
+// tctiPrefixes are the TCTIs accepted besides device nodes.
+var tctiPrefixes = []string{"device:", "swtpm", "mssim", "tabrmd"}
+
+// Validate checks the device and the version, filling in the default version.
+func (t *TPM) Validate() error {
+	if t.Version == "" {
+		t.Version = TPMVersion20
+	}
+	if !ValidTPMVersion(t.Version) {
+		return fmt.Errorf("tpm.version (%s) must be 2.0, 1.2 or auto", t.Version)
+	}
+	for _, pcr := range t.SealPCRs {
+		if pcr < 0 || pcr > 23 {
+			return fmt.Errorf("tpm.sealPCRs entry %d must be a PCR between 0 and 23", pcr)
+		}
+	}
+	if len(t.SealPCRs) > 0 && t.Version == TPMVersion20 {
+		return fmt.Errorf("tpm.sealPCRs only applies to tpm.version 1.2, bind TPM 2.0 keys with luks.nvAuth")
+	}
+	if t.Device == "" || strings.HasPrefix(t.Device, "/") {
+		return nil
+	}
+	for _, prefix := range tctiPrefixes {
+		if strings.HasPrefix(t.Device, prefix) {
+			return nil
+		}
+	}
+	return fmt.Errorf("tpm.device (%s) must be a device node like /dev/tpm0 or a TCTI like swtpm:port=2321", t.Device)
+}
+
+// tcti returns the TCTI configuration of the device.
+func (t TPM) tcti() string {
+	if strings.HasPrefix(t.Device, "/") {
+		return "device:" + t.Device
+	}
+	return t.Device
+}
+
+// SetTPM installs the TPM of a validated configuration. Without a device configured,
+// a TCTI already set in the environment is kept.
+func SetTPM(t TPM) {
+	tpmMu.Lock()
+	defer tpmMu.Unlock()
+	tpmVersion = t.Version
+	if tpmVersion == TPMVersionAuto {
+		tpmVersion = detectTPMVersion()
+	}
+	tpmSealPCRs = t.SealPCRs
+	if t.Device == "" {
+		if env := os.Getenv(tctiEnv); env != "" {
+			tpmDevice = strings.TrimPrefix(env, "device:")
+			return
+		}
+		t.Device = DefaultTPMDevice
+	}
+	tpmDevice = strings.TrimPrefix(t.Device, "device:")
+	os.Setenv(tctiEnv, t.tcti())
+}
+
+// currentSealPCRs returns the PCRs TPM 1.2 keys are sealed to.
+func currentSealPCRs() []int {
+	tpmMu.Lock()
+	defer tpmMu.Unlock()
+	return tpmSealPCRs
+}
+
+// TPMDevice returns the selected device node or TCTI.
+func TPMDevice() string {
+	tpmMu.Lock()
+	defer tpmMu.Unlock()
+	return tpmDevice
+}
+
+// tpmPresent reports whether the device is present. Device nodes are looked up,
+// simulators and brokers are asked for their properties.
+func tpmPresent(ctx context.Context, device string) (bool, error) {
+	if !strings.HasPrefix(device, "/") {
+		_, err := runRetried(ctx, OpTPM, func() *trace.Cmd { return trace.Command("tpm2_getcap", "properties-fixed") })
+		return err == nil, nil
+	}
+	if _, err := os.Stat(device); err == nil {
+		return true, nil
+	} else if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else {
+		return false, fmt.Errorf("error accessing TPM 2.0 device %s: %w", device, err)
+	}
+}
@@ -0,0 +1,65 @@
+package luks
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTPMDevice(t *testing.T) {
+	defer os.Setenv(tctiEnv, os.Getenv(tctiEnv))
+
+	for _, device := range []string{"", "/dev/tpm0", "swtpm:host=localhost,port=2321", "device:/dev/tpmrm0"} {
+		tpm := TPM{Device: device}
+		if err := tpm.Validate(); err != nil {
+			t.Errorf("Validate(%q): %v", device, err)
+		}
+	}
+	if err := (&TPM{Device: "tpm0"}).Validate(); err == nil {
+		t.Error("Validate accepted a relative device")
+	}
+
+	SetTPM(TPM{Device: "/dev/tpm0"})
+	if got := os.Getenv(tctiEnv); got != "device:/dev/tpm0" {
+		t.Errorf("%s = %q, want device:/dev/tpm0", tctiEnv, got)
+	}
+	if got := TPMDevice(); got != "/dev/tpm0" {
+		t.Errorf("TPMDevice() = %q, want /dev/tpm0", got)
+	}
+
+	os.Setenv(tctiEnv, "swtpm:port=2321")
+	SetTPM(TPM{})
+	if got := TPMDevice(); got != "swtpm:port=2321" {
+		t.Errorf("TPMDevice() = %q, want the TCTI of the environment", got)
+	}
+}
+
+func TestTPMVersion(t *testing.T) {
+	defer os.Setenv(tctiEnv, os.Getenv(tctiEnv))
+
+	tpm := TPM{}
+	if err := tpm.Validate(); err != nil || tpm.Version != TPMVersion20 {
+		t.Errorf("Validate() = %v, version %q, want the 2.0 default", err, tpm.Version)
+	}
+	for _, invalid := range []TPM{{Version: "1.1"}, {Version: TPMVersion12, SealPCRs: []int{24}}, {SealPCRs: []int{7}}} {
+		if err := invalid.Validate(); err == nil {
+			t.Errorf("Validate(%+v) accepted an invalid setting", invalid)
+		}
+	}
+
+	defer func(path string) { tpmVersionFile = path }(tpmVersionFile)
+	tpmVersionFile = filepath.Join(t.TempDir(), "tpm_version_major")
+	os.WriteFile(tpmVersionFile, []byte("1\n"), 0644)
+	defer SetTPM(TPM{Version: TPMVersion20})
+	SetTPM(TPM{Version: TPMVersionAuto, SealPCRs: []int{0, 7}})
+	if !tpm1Selected() {
+		t.Errorf("auto did not select the TPM 1.2 reported by the kernel")
+	}
+	if got := strings.Join(tpm1SealArgs(currentSealPCRs()), " "); got != "--well-known --pcr 0 --pcr 7" {
+		t.Errorf("tpm1SealArgs() = %q", got)
+	}
+	if got := tpm1BlobPath(DefaultNVIndex); got != filepath.Join(TPM1SealDir, "1500016.sealed") {
+		t.Errorf("tpm1BlobPath() = %q", got)
+	}
+}
@@ -0,0 +1,45 @@
+package luks
+
+import (
+	"fmt"
+	"log"
+)
+
+// transaction records how to undo each completed step of a multi-step operation, so a
+// failure halfway does not leave an open mapper, a stored TPM key or a half-created
+// volume behind.
+type transaction struct {
+	undo []rollbackStep
+}
+
+type rollbackStep struct {
+	name string
+	fn   func() error
+}
+
+// onRollback registers fn to undo the step that just completed.
+func (t *transaction) onRollback(name string, fn func() error) {
+	t.undo = append(t.undo, rollbackStep{name, fn})
+}
+
+// commit keeps the completed steps, making a later rollback a no-op.
+func (t *transaction) commit() {
+	t.undo = nil
+}
+
+// rollback undoes the completed steps in reverse order. Every step is attempted even
+// when an earlier one fails, the failures are logged.
+func (t *transaction) rollback() {
+	if len(t.undo) == 0 {
+		return
+	}
+	fmt.Println("Rolling back ...")
+	for i := len(t.undo) - 1; i >= 0; i-- {
+		step := t.undo[i]
+		fmt.Printf("  %s\n", step.name)
+		if err := step.fn(); err != nil {
+			log.Printf("Rollback step %q failed: %v", step.name, err)
+		}
+	}
+	t.undo = nil
+}
@@ -0,0 +1,35 @@
+package luks
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestTransactionRollback(t *testing.T) {
+	var undone []string
+	tx := &transaction{}
+	for _, name := range []string{"create", "store", "open"} {
+		tx.onRollback(name, func() error {
+			undone = append(undone, name)
+			if name == "store" {
+				return errors.New("failed")
+			}
+			return nil
+		})
+	}
+
+	tx.rollback()
+	if want := []string{"open", "store", "create"}; !reflect.DeepEqual(undone, want) {
+		t.Fatalf("rollback() undid %v, want %v", undone, want)
+	}
+
+	// Nothing is undone after commit, nor twice
+	undone = nil
+	tx.onRollback("mount", func() error { undone = append(undone, "mount"); return nil })
+	tx.commit()
+	tx.rollback()
+	if len(undone) != 0 {
+		t.Fatalf("rollback() after commit undid %v", undone)
+	}
+}
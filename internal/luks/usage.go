@@ -0,0 +1,131 @@
+package luks
+
+import (
+	"bootstrap/internal/trace"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Default filesystem usage thresholds in percent.
+const (
+	DefaultUsageWarn     = 90.0
+	DefaultUsageCritical = 98.0
+)
+
+// Usage levels of the mounted filesystem.
+const (
+	UsageOK       = "ok"
+	UsageWarn     = "warn"
+	UsageCritical = "critical"
+)
+
+// ErrMaxSize is returned by GrowLUKSVolume once the volume reached luks.usage.maxSize.
+var ErrMaxSize = errors.New("volume reached luks.usage.maxSize")
+
+// Usage configures the filesystem usage alerts of udm daemon, status and healthcheck,
+// and growing the volume before it fills up.
+type Usage struct {
+	Warn     float64 `yaml:"warn"`     // Percent full raising an alert, the volume is degraded
+	Critical float64 `yaml:"critical"` // Percent full at which the volume has failed
+	GrowBy   int     `yaml:"growBy"`   // MB the daemon adds once warn is crossed, 0 never grows
+	MaxSize  int     `yaml:"maxSize"`  // Size in MB the volume is not grown beyond, 0 for no limit
+}
+
+// Level returns the usage level of a filesystem used percent full.
+func (u Usage) Level(percent float64) string {
+	switch {
+	case percent >= u.Critical:
+		return UsageCritical
+	case percent >= u.Warn:
+		return UsageWarn
+	}
+	return UsageOK
+}
+
+// VolumeSizeMB returns the size of the backing image file or logical volume.
+func VolumeSizeMB(ctx context.Context, cfg *LUKS) (int, error) {
+	if !cfg.LVM.Enabled() {
+		info, err := os.Stat(cfg.VolumePath)
+		if err != nil {
+			return 0, err
+		}
+		return int(info.Size() >> 20), nil
+	}
+	output, err := outputRetried(ctx, OpCryptsetup, func() *trace.Cmd { return trace.Command("blockdev", "--getsize64", cfg.LVM.DevicePath()) })
+	if err != nil {
+		return 0, fmt.Errorf("failed to read logical volume size: %w", err)
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(string(output)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid logical volume size %q", strings.TrimSpace(string(output)))
+	}
+	return int(size >> 20), nil
+}
+
+// GrowLUKSVolume grows the backing storage by usage.growBy, up to usage.maxSize, then the
+// open mapping and the mounted filesystem, all online. It returns the new size in MB.
+func GrowLUKSVolume(ctx context.Context, cfg *LUKS) (int, error) {
+	if err := host.supported(); err != nil {
+		return 0, err
+	}
+	if cfg.Integrity != "" {
+		return 0, fmt.Errorf("volumes with luks.integrity cannot be grown online")
+	}
+	size, err := VolumeSizeMB(ctx, cfg)
+	if err != nil {
+		return 0, err
+	}
+	target := size + cfg.Usage.GrowBy
+	if cfg.Usage.MaxSize > 0 {
+		target = min(target, cfg.Usage.MaxSize)
+	}
+	if target <= size {
+		return size, fmt.Errorf("%w (%d MB)", ErrMaxSize, cfg.Usage.MaxSize)
+	}
+
+	if cfg.LVM.Enabled() {
+		output, err := runRetried(ctx, OpCryptsetup, func() *trace.Cmd {
+			return trace.Command("lvextend", "--size", strconv.Itoa(target)+"m", cfg.LVM.VolumeGroup+"/"+cfg.LVM.Name)
+		})
+		if err != nil {
+			return size, fmt.Errorf("lvextend failed: %s", strings.TrimSpace(string(output)))
+		}
+	} else {
+		if err := os.Truncate(cfg.VolumePath, int64(target)<<20); err != nil {
+			return size, fmt.Errorf("failed to grow image file: %w", err)
+		}
+		if loop := backingLoop(cfg.MapperName); loop != "" {
+			if output, err := runRetried(ctx, OpCryptsetup, func() *trace.Cmd { return trace.Command("losetup", "--set-capacity", loop) }); err != nil {
+				return size, fmt.Errorf("losetup --set-capacity failed: %s", strings.TrimSpace(string(output)))
+			}
+		}
+	}
+
+	// LUKS2 mappings with the volume key in the kernel keyring need a key to resize
+	if err := resolveKey(ctx, cfg); err != nil {
+		return size, err
+	}
+	args := []string{"resize", cfg.MapperName}
+	if len(cfg.Password) > 0 {
+		args = []string{"resize", "--key-file=-", cfg.MapperName}
+	}
+	output, err := runRetried(ctx, OpCryptsetup, func() *trace.Cmd {
+		cmd := trace.Command("cryptsetup", args...)
+		if len(cfg.Password) > 0 {
+			cmd.Stdin = createPasswordInput(cfg.Password, false)
+		}
+		return cmd
+	})
+	if err != nil {
+		return size, fmt.Errorf("cryptsetup resize failed: %s", strings.TrimSpace(string(output)))
+	}
+	// Growing takes as long as the added space is large, it is only killed with ctx
+	if output, err := trace.CommandContext(ctx, "resize2fs", "/dev/mapper/"+cfg.MapperName).CombinedOutput(); err != nil {
+		return size, fmt.Errorf("resize2fs failed: %s", strings.TrimSpace(string(output)))
+	}
+	return target, nil
+}
@@ -0,0 +1,23 @@
+package luks
+
+import "testing"
+
+func TestUsageLevel(t *testing.T) {
+	u := Usage{Warn: DefaultUsageWarn, Critical: DefaultUsageCritical}
+	tests := []struct {
+		percent float64
+		want    string
+	}{
+		{0, UsageOK},
+		{89.9, UsageOK},
+		{90, UsageWarn},
+		{97.5, UsageWarn},
+		{98, UsageCritical},
+		{100, UsageCritical},
+	}
+	for _, tt := range tests {
+		if got := u.Level(tt.percent); got != tt.want {
+			t.Errorf("Level(%.1f) = %s, want %s", tt.percent, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package luks
+
+import (
+	"bootstrap/internal/trace"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultUSBKeyTimeout = 30 * time.Second
+	usbKeyPollInterval   = 500 * time.Millisecond
+)
+
+// USBKey keeps the keyfile on a removable stick, identified by the label or UUID of its
+// filesystem, instead of on the host. mount waits for the stick and reads the key from
+// it without --keyfile, so the volume can only be unlocked with the stick present.
+type USBKey struct {
+	Label         string `yaml:"label"`         // Filesystem label of the stick
+	UUID          string `yaml:"uuid"`          // Filesystem UUID of the stick, instead of the label
+	Path          string `yaml:"path"`          // Keyfile relative to the root of the stick, <mapperName>.key by default
+	Timeout       string `yaml:"timeout"`       // How long mount waits for the stick, e.g. "30s"
+	LockOnRemoval bool   `yaml:"lockOnRemoval"` // udm daemon unmounts and closes the volume when the stick is withdrawn
+}
+
+// Enabled reports whether the keyfile is read from a stick.
+func (u USBKey) Enabled() bool {
+	return u.Label != "" || u.UUID != ""
+}
+
+// Validate checks the stick is identified once, the keyfile path and the timeout.
+func (u USBKey) Validate() error {
+	if u.Label != "" && u.UUID != "" {
+		return fmt.Errorf("luks.usbKey.label and uuid cannot be combined")
+	}
+	if !u.Enabled() {
+		if u.Path != "" || u.Timeout != "" || u.LockOnRemoval {
+			return fmt.Errorf("luks.usbKey requires a label or uuid")
+		}
+		return nil
+	}
+	if filepath.IsAbs(u.Path) || strings.HasPrefix(filepath.Clean(u.Path), "..") {
+		return fmt.Errorf("luks.usbKey.path (%s) must be relative to the root of the stick", u.Path)
+	}
+	if u.Timeout != "" {
+		if d, err := time.ParseDuration(u.Timeout); err != nil || d <= 0 {
+			return fmt.Errorf("luks.usbKey.timeout (%s) must be a positive duration, e.g. \"30s\"", u.Timeout)
+		}
+	}
+	return nil
+}
+
+// timeout returns how long mount waits for the stick.
+func (u USBKey) timeout() time.Duration {
+	if d, err := time.ParseDuration(u.Timeout); err == nil && d > 0 {
+		return d
+	}
+	return DefaultUSBKeyTimeout
+}
+
+// describe names the stick in messages.
+func (u USBKey) describe() string {
+	if u.UUID != "" {
+		return "UUID=" + u.UUID
+	}
+	return "LABEL=" + u.Label
+}
+
+// USBKeyDevice returns the block device of the stick, "" when it is not plugged in.
+func USBKeyDevice(u USBKey) string {
+	flag, value := "-L", u.Label
+	if u.UUID != "" {
+		flag, value = "-U", u.UUID
+	}
+	output, err := trace.Command("blkid", flag, value).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// usbKeyMountOptions returns the options mounting the stick. Filesystems without Unix
+// permissions get a umask, so the keyfile passes the keyfile mode check.
+func usbKeyMountOptions(fsType string) string {
+	options := "ro,nosuid,nodev,noexec"
+	switch fsType {
+	case "vfat", "exfat", "ntfs", "ntfs3":
+		options += ",umask=0077"
+	}
+	return options
+}
+
+// WithUSBKey waits up to usbKey.timeout for the stick, mounts it read-only on a private
+// directory and runs fn with the path of the keyfile on it. The stick is unmounted again
+// when fn returns, so it can be pulled at any time.
+func WithUSBKey(ctx context.Context, cfg *LUKS, fn func(keyfile string) error) error {
+	u := cfg.USBKey
+	deadline := time.Now().Add(u.timeout())
+	device := USBKeyDevice(u)
+	if device == "" {
+		fmt.Printf("Waiting up to %s for the USB key %s...\n", u.timeout(), u.describe())
+	}
+	for device == "" {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("USB key %s not present after %s", u.describe(), u.timeout())
+		}
+		time.Sleep(usbKeyPollInterval)
+		device = USBKeyDevice(u)
+	}
+
+	dir, err := os.MkdirTemp("/run", "udm-usbkey-")
+	if err != nil {
+		return fmt.Errorf("failed to create USB key mount point: %w", err)
+	}
+	defer os.Remove(dir)
+	fsType, _ := outputRetried(ctx, OpCryptsetup, func() *trace.Cmd { return trace.Command("blkid", "-s", "TYPE", "-o", "value", device) })
+	options := usbKeyMountOptions(strings.TrimSpace(string(fsType)))
+	if output, err := runRetried(ctx, OpMount, func() *trace.Cmd { return trace.Command("mount", "-o", options, device, dir) }); err != nil {
+		return fmt.Errorf("failed to mount USB key %s: %s", device, strings.TrimSpace(string(output)))
+	}
+	defer func() {
+		if output, err := runRetried(ctx, OpMount, func() *trace.Cmd { return trace.Command("umount", dir) }); err != nil {
+			log.Printf("Failed to unmount USB key %s: %s", device, strings.TrimSpace(string(output)))
+		}
+	}()
+
+	path := u.Path
+	if path == "" {
+		path = cfg.MapperName + ".key"
+	}
+	return fn(filepath.Join(dir, path))
+}
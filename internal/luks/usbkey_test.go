@@ -0,0 +1,37 @@
+package luks
+
+import "testing"
+
+func TestUSBKeyValidate(t *testing.T) {
+	valid := []USBKey{
+		{},
+		{Label: "UDMKEY"},
+		{UUID: "1234-ABCD", Path: "keys/udm-luks.key", Timeout: "1m", LockOnRemoval: true},
+	}
+	for _, u := range valid {
+		if err := u.Validate(); err != nil {
+			t.Errorf("Validate(%+v) = %v, want nil", u, err)
+		}
+	}
+	invalid := []USBKey{
+		{Label: "UDMKEY", UUID: "1234-ABCD"},
+		{LockOnRemoval: true},
+		{Label: "UDMKEY", Path: "/udm-luks.key"},
+		{Label: "UDMKEY", Path: "../udm-luks.key"},
+		{Label: "UDMKEY", Timeout: "soon"},
+	}
+	for _, u := range invalid {
+		if err := u.Validate(); err == nil {
+			t.Errorf("Validate(%+v) = nil, want an error", u)
+		}
+	}
+}
+
+func TestUSBKeyMountOptions(t *testing.T) {
+	if got := usbKeyMountOptions("vfat"); got != "ro,nosuid,nodev,noexec,umask=0077" {
+		t.Errorf("usbKeyMountOptions(vfat) = %q", got)
+	}
+	if got := usbKeyMountOptions("ext4"); got != "ro,nosuid,nodev,noexec" {
+		t.Errorf("usbKeyMountOptions(ext4) = %q", got)
+	}
+}
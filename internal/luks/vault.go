@@ -0,0 +1,78 @@
+package luks
+
+import (
+	"bootstrap/internal/vault"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// VaultDir holds the keys wrapped by a Vault transit key. A wrapped key can only be
+// unwrapped by Vault, so it is kept on the device like a sealed TPM 1.2 blob.
+var VaultDir = "/var/lib/udm/vault"
+
+// vaultWrappedPath returns the file holding the wrapped key of the volume.
+func vaultWrappedPath(cfg *LUKS) string {
+	return filepath.Join(VaultDir, cfg.MapperName+".wrapped")
+}
+
+// storeInVault stores the key in the KV secret, or wraps it with the transit key and
+// writes the ciphertext.
+func storeInVault(cfg *LUKS, password []byte) error {
+	client, err := vault.Login(cfg.Vault)
+	if err != nil {
+		return err
+	}
+	if !cfg.Vault.Wrapped() {
+		return client.WriteKey(password)
+	}
+	ciphertext, err := client.Wrap(password)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(VaultDir, 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", VaultDir, err)
+	}
+	path := vaultWrappedPath(cfg)
+	if err := os.WriteFile(path+".tmp", []byte(ciphertext+"\n"), 0600); err != nil {
+		return fmt.Errorf("failed to write wrapped key: %w", err)
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// retrieveFromVault reads the key from the KV secret, or unwraps the stored ciphertext.
+func retrieveFromVault(cfg *LUKS) ([]byte, error) {
+	var ciphertext string
+	if cfg.Vault.Wrapped() {
+		data, err := os.ReadFile(vaultWrappedPath(cfg))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read wrapped key: %w", err)
+		}
+		ciphertext = strings.TrimSpace(string(data))
+	}
+	client, err := vault.Login(cfg.Vault)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Vault.Wrapped() {
+		return client.Unwrap(ciphertext)
+	}
+	return client.ReadKey()
+}
+
+// removeFromVault deletes the KV secret, or the wrapped key. The transit key is shared
+// by the fleet and stays in Vault.
+func removeFromVault(cfg *LUKS) error {
+	if cfg.Vault.Wrapped() {
+		if err := os.Remove(vaultWrappedPath(cfg)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove wrapped key: %w", err)
+		}
+		return nil
+	}
+	client, err := vault.Login(cfg.Vault)
+	if err != nil {
+		return err
+	}
+	return client.DeleteKey()
+}
@@ -0,0 +1,140 @@
+package luks
+
+import (
+	"bootstrap/internal/trace"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// CheckResult is the outcome of a single verification check.
+type CheckResult struct {
+	Healthy bool   `json:"healthy"`
+	Detail  string `json:"detail"`
+}
+
+// VerifyResult reports the health of the key, header and filesystem of a LUKS volume.
+type VerifyResult struct {
+	Header     CheckResult `json:"header"`
+	Key        CheckResult `json:"key"`
+	Filesystem CheckResult `json:"filesystem"`
+}
+
+// Healthy reports whether every check passed.
+func (r *VerifyResult) Healthy() bool {
+	return r.Header.Healthy && r.Key.Healthy && r.Filesystem.Healthy
+}
+
+// VerifyLUKSVolume test-opens the LUKS volume read-only with the stored key and runs a
+// non-destructive filesystem check. A failed check is reported in the result, an error
+// is only returned when verification could not run at all.
+func VerifyLUKSVolume(ctx context.Context, cfg *LUKS) (*VerifyResult, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("LUKS configuration is nil")
+	}
+
+	if cfg.Plain() {
+		return verifyPlain(ctx, cfg), nil
+	}
+
+	result := &VerifyResult{
+		Key:        CheckResult{Detail: "skipped: header check failed"},
+		Filesystem: CheckResult{Detail: "skipped: key check failed"},
+	}
+
+	// Header
+	if output, err := runRetried(ctx, OpCryptsetup, func() *trace.Cmd { return trace.Command("cryptsetup", "isLuks", cfg.VolumePath) }); err != nil {
+		result.Header.Detail = fmt.Sprintf("not a valid LUKS header: %s %s", err, strings.TrimSpace(string(output)))
+		return result, nil
+	}
+	result.Header = CheckResult{Healthy: true, Detail: "valid LUKS header"}
+
+	// Key
+	if err := resolveKey(ctx, cfg); err != nil {
+		result.Key.Detail = err.Error()
+		return result, nil
+	}
+	if output, err := runRetried(ctx, OpCryptsetup, func() *trace.Cmd {
+		cmd := trace.Command("cryptsetup", "open", "--test-passphrase", "--key-file=-", cfg.VolumePath)
+		cmd.Stdin = bytes.NewReader(cfg.Password)
+		return cmd
+	}); err != nil {
+		result.Key.Detail = fmt.Sprintf("key does not unlock any keyslot: %s", strings.TrimSpace(string(output)))
+		return result, nil
+	}
+	result.Key = CheckResult{Healthy: true, Detail: "key unlocks the volume"}
+
+	// Filesystem
+	result.Filesystem = verifyFilesystem(ctx, cfg)
+	return result, nil
+}
+
+// verifyFilesystem runs a read-only filesystem check, opening a temporary read-only
+// mapping when the volume is not already open.
+func verifyFilesystem(ctx context.Context, cfg *LUKS) CheckResult {
+	devicePath := "/dev/mapper/" + cfg.MapperName
+
+	if _, err := os.Stat(devicePath); err == nil {
+		mounted, err := IsLUKSMounted(cfg)
+		if err != nil {
+			return CheckResult{Detail: fmt.Sprintf("failed to check mount state: %s", err)}
+		}
+		if mounted {
+			return CheckResult{Healthy: true, Detail: "skipped: filesystem is mounted"}
+		}
+	} else {
+		verifyName := cfg.MapperName + "-verify"
+		if err := openDevice(ctx, cfg.VolumePath, func(device string) error {
+			if output, err := runRetried(ctx, OpCryptsetup, func() *trace.Cmd {
+				cmd := trace.Command("cryptsetup", "open", "--readonly", "--key-file=-", device, verifyName)
+				cmd.Stdin = bytes.NewReader(cfg.Password)
+				return cmd
+			}); err != nil {
+				return fmt.Errorf("failed to open volume read-only: %s", strings.TrimSpace(string(output)))
+			}
+			return nil
+		}); err != nil {
+			return CheckResult{Detail: err.Error()}
+		}
+		defer func() {
+			if err := CloseLUKSVolume(ctx, verifyName); err != nil {
+				fmt.Printf("Failed to close verification mapping: %v\n", err)
+			}
+		}()
+		devicePath = "/dev/mapper/" + verifyName
+	}
+
+	fsType, err := getFilesystemType(ctx, devicePath)
+	if err != nil {
+		return CheckResult{Detail: err.Error()}
+	}
+
+	// The check takes as long as the filesystem is large, it is only killed with ctx
+	var cmd *trace.Cmd
+	if fsType == "xfs" {
+		cmd = trace.CommandContext(ctx, "xfs_repair", "-n", devicePath)
+	} else {
+		cmd = trace.CommandContext(ctx, "fsck", "-n", "-t", fsType, devicePath)
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return CheckResult{Detail: fmt.Sprintf("%s filesystem check reported problems: %s", fsType, strings.TrimSpace(string(output)))}
+	}
+	return CheckResult{Healthy: true, Detail: fmt.Sprintf("%s filesystem is clean", fsType)}
+}
+
+// getFilesystemType returns the filesystem type found on the device.
+func getFilesystemType(ctx context.Context, devicePath string) (string, error) {
+	output, err := runRetried(ctx, OpCryptsetup, func() *trace.Cmd {
+		return trace.Command("blkid", "-p", "-s", "TYPE", "-o", "value", devicePath)
+	})
+	if err != nil {
+		return "", fmt.Errorf("blkid command failed: %s, output: %s", err, string(output))
+	}
+	fsType := strings.TrimSpace(string(output))
+	if fsType == "" {
+		return "", fmt.Errorf("no filesystem found on device: %s", devicePath)
+	}
+	return fsType, nil
+}
@@ -0,0 +1,227 @@
+package luks
+
+import (
+	"bootstrap/internal/secrets"
+	"bootstrap/internal/trace"
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// UnlockStep is one protector in the chain used to obtain the volume key.
+type UnlockStep struct {
+	Protector string `json:"protector"`
+	Source    string `json:"source"`
+	Status    string `json:"status"`
+}
+
+// UnlockPath explains how the volume would be opened, without unlocking it.
+type UnlockPath struct {
+	Steps         []UnlockStep `json:"steps"`
+	HeaderBinding string       `json:"headerBinding"`
+	CrypttabEntry string       `json:"crypttabEntry"`
+	BootUnlock    string       `json:"bootUnlock"`
+}
+
+// ExplainUnlockPath describes the protector chain, the TPM binding recorded in the LUKS2
+// header and the crypttab entry for the volume, to debug mismatches between config,
+// state and system files.
+func ExplainUnlockPath(ctx context.Context, cfg *LUKS, keyfile string) *UnlockPath {
+	path := &UnlockPath{}
+	nvSource := fmt.Sprintf("NV index %s, %d bytes", cfg.KeyNVIndex(), cfg.nvKeySize())
+
+	switch {
+	case cfg.Split.Enabled():
+		path.Steps = append(path.Steps, UnlockStep{
+			Protector: "split-key",
+			Source:    fmt.Sprintf("any %d of the following shares", cfg.Split.Threshold),
+			Status:    "combined by mount",
+		})
+		if keyfile != "" {
+			path.Steps = append(path.Steps, UnlockStep{"keyfile share", keyfile, fileStatus(keyfile)})
+		}
+		if cfg.UseTPM {
+			path.Steps = append(path.Steps, UnlockStep{"tpm2-nv share", nvSource, nvIndexStatus(ctx, cfg.KeyNVIndex())})
+		}
+		if cfg.Split.EscrowPath != "" {
+			path.Steps = append(path.Steps, UnlockStep{"escrow share", cfg.Split.EscrowPath, fileStatus(cfg.Split.EscrowPath)})
+		}
+	case cfg.UseTPM:
+		path.Steps = append(path.Steps, UnlockStep{"tpm2-nv", nvSource, nvIndexStatus(ctx, cfg.KeyNVIndex())})
+		if cfg.TPMToken {
+			path.Steps = append(path.Steps, UnlockStep{"systemd-tpm2 token", "PCRs " + cfg.TPMPCRs, "used at boot by systemd-cryptsetup"})
+		}
+	case cfg.Vault.Enabled():
+		if cfg.Vault.Wrapped() {
+			wrapped := vaultWrappedPath(cfg)
+			path.Steps = append(path.Steps, UnlockStep{"vault-transit", fmt.Sprintf("%s, unwrapped by %s at %s", wrapped, cfg.Vault.Transit, cfg.Vault.Address), fileStatus(wrapped)})
+		} else {
+			path.Steps = append(path.Steps, UnlockStep{"vault-kv", fmt.Sprintf("%s at %s", cfg.Vault.KV, cfg.Vault.Address), "read by mount"})
+		}
+	case cfg.FIDO2.Enabled && keyfile == "":
+		// Unlocked by the token alone, listed below
+	case cfg.USBKey.Enabled() && keyfile == "":
+		status := "not present"
+		if device := USBKeyDevice(cfg.USBKey); device != "" {
+			status = "present at " + device
+		}
+		path.Steps = append(path.Steps, UnlockStep{"usb keyfile", cfg.USBKey.describe(), status})
+	default:
+		path.Steps = append(path.Steps, UnlockStep{"keyfile", keyfile, fileStatus(keyfile)})
+	}
+	if cfg.HardwareBinding.Enabled() {
+		status := "available"
+		if secret, err := deviceSecret(ctx, cfg.HardwareBinding.Source); err != nil {
+			status = err.Error()
+		} else {
+			secrets.Wipe(secret)
+		}
+		path.Steps = append(path.Steps, UnlockStep{"hardware binding", cfg.HardwareBinding.Source + " secret mixed into the keyfile", status})
+	}
+	if cfg.KeyCache.Enabled() {
+		status := "not cached"
+		if trace.Command("keyctl", "search", cfg.KeyCache.keyring(), "user", keyDescription(cfg)).Run() == nil {
+			status = "cached"
+		}
+		// Prepended, mount tries the cached key first
+		path.Steps = append([]UnlockStep{{"kernel keyring", fmt.Sprintf("%s keyring, key %s for %s", cfg.KeyCache.Keyring, keyDescription(cfg), cfg.KeyCache.Timeout), status}}, path.Steps...)
+	}
+	if cfg.FIDO2.Enabled {
+		path.Steps = append(path.Steps, UnlockStep{"systemd-fido2 token", "device " + cfg.FIDO2.Device, fido2Status(cfg)})
+	}
+	if cfg.AllowPassphrase {
+		path.Steps = append(path.Steps, UnlockStep{"passphrase", "systemd-ask-password or terminal", "asked when the key is unavailable"})
+	}
+
+	// TPM binding recorded in the header
+	if token, err := ReadNVToken(ctx, cfg.VolumePath); err != nil {
+		path.HeaderBinding = fmt.Sprintf("none (%s)", err)
+	} else {
+		path.HeaderBinding = fmt.Sprintf("NV index %s, %s bytes", token.NVIndex, token.NVSize)
+		if token.NVIndex != cfg.KeyNVIndex() || token.NVSize != fmt.Sprintf("%d", cfg.nvKeySize()) {
+			path.HeaderBinding += " (does not match config)"
+		}
+	}
+
+	// Boot-time unlock from crypttab
+	entry, err := findCrypttabEntry(crypttabPath, cfg.MapperName)
+	switch {
+	case err != nil:
+		path.CrypttabEntry = fmt.Sprintf("unreadable (%s)", err)
+		path.BootUnlock = "unknown"
+	case entry == "":
+		path.CrypttabEntry = "none"
+		path.BootUnlock = "not unlocked at boot"
+	default:
+		path.CrypttabEntry = entry
+		path.BootUnlock = describeCrypttabUnlock(entry)
+	}
+
+	return path
+}
+
+// CrypttabEntry returns the /etc/crypttab line of the volume, empty when it has no
+// persistent mount.
+func CrypttabEntry(cfg *LUKS) (string, error) {
+	entry, err := findCrypttabEntry(crypttabPath, cfg.MapperName)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return entry, err
+}
+
+// FstabEntry returns the /etc/fstab line mounting the volume, empty when there is none.
+func FstabEntry(cfg *LUKS) (string, error) {
+	fstab, err := readTabFile(fstabPath)
+	if err != nil {
+		return "", err
+	}
+	if entries := fstab.find(fstabMatch(cfg)); len(entries) > 0 {
+		return entries[0], nil
+	}
+	return "", nil
+}
+
+// findCrypttabEntry returns the crypttab line whose name field matches mapperName.
+func findCrypttabEntry(crypttab, mapperName string) (string, error) {
+	file, err := os.Open(crypttab)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 0 && fields[0] == mapperName {
+			return strings.TrimSpace(scanner.Text()), nil
+		}
+	}
+	return "", scanner.Err()
+}
+
+// describeCrypttabUnlock explains how systemd-cryptsetup obtains the key for a crypttab line.
+func describeCrypttabUnlock(entry string) string {
+	fields := strings.Fields(entry)
+	options := ""
+	if len(fields) > 3 {
+		options = fields[3]
+	}
+
+	for _, opt := range strings.Split(options, ",") {
+		switch {
+		case strings.HasPrefix(opt, "keyscript="):
+			return "keyscript " + strings.TrimPrefix(opt, "keyscript=")
+		case strings.HasPrefix(opt, "tpm2-device="):
+			return "systemd-tpm2 token (" + opt + ")"
+		case strings.HasPrefix(opt, "fido2-device="):
+			return "systemd-fido2 token (" + opt + ")"
+		}
+	}
+	if len(fields) > 2 && fields[2] != "none" && fields[2] != "-" {
+		return "keyfile " + fields[2]
+	}
+	return "interactive passphrase prompt"
+}
+
+// fileStatus reports whether a key file exists, without reading it.
+func fileStatus(path string) string {
+	if path == "" {
+		return "not configured"
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "missing"
+	}
+	return fmt.Sprintf("present (%d bytes, mode %s)", info.Size(), info.Mode().Perm())
+}
+
+// fido2Status reports whether a systemd-fido2 token is recorded in the header and
+// whether a FIDO2 device is plugged in, without touching the token.
+func fido2Status(cfg *LUKS) string {
+	output, err := trace.Command("cryptsetup", "luksDump", cfg.VolumePath).Output()
+	if err != nil || !strings.Contains(string(output), FIDO2TokenType) {
+		return "not enrolled"
+	}
+	list, err := trace.Command("systemd-cryptenroll", "--fido2-device=list").Output()
+	if err != nil || len(strings.TrimSpace(string(list))) == 0 {
+		return "enrolled, no device present"
+	}
+	return "enrolled, device present"
+}
+
+// nvIndexStatus reports whether an NV index is defined, without reading it.
+func nvIndexStatus(ctx context.Context, nvIndex string) string {
+	if !NVIndexDefined(ctx, nvIndex) {
+		return "not defined"
+	}
+	return "defined"
+}
+
+// NVIndexDefined reports whether an NV index is defined in the TPM.
+func NVIndexDefined(ctx context.Context, nvIndex string) bool {
+	_, err := runRetried(ctx, OpTPM, func() *trace.Cmd { return trace.Command("tpm2_nvreadpublic", nvIndex) })
+	return err == nil
+}
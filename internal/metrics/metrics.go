@@ -0,0 +1,99 @@
+// Package metrics exposes gauges and counters in the Prometheus text exposition format.
+// Values are collected when scraped, so they always reflect the current system state.
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	Gauge   = "gauge"
+	Counter = "counter"
+)
+
+// Config enables the metrics endpoint of the daemon.
+type Config struct {
+	Listen string `yaml:"listen"` // Address serving /metrics, e.g. "127.0.0.1:9745", disabled when empty
+}
+
+// Metric is one sample.
+type Metric struct {
+	Name   string
+	Help   string
+	Type   string // Gauge or Counter
+	Labels map[string]string
+	Value  float64
+}
+
+// Write renders metrics in the text exposition format, samples of the same name grouped
+// under one HELP and TYPE header.
+func Write(w io.Writer, metrics []Metric) error {
+	described := make(map[string]bool)
+	for _, m := range metrics {
+		if !described[m.Name] {
+			described[m.Name] = true
+			if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.Name, m.Help, m.Name, m.Type); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", m.Name, formatLabels(m.Labels), strconv.FormatFloat(m.Value, 'g', -1, 64)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[name])
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, value))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Server serves /metrics until closed.
+type Server struct {
+	http *http.Server
+}
+
+// Serve starts serving the metrics returned by collect on listen.
+func Serve(listen string, collect func() []Metric) (*Server, error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		Write(w, collect())
+	})
+
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", listen, err)
+	}
+	s := &Server{http: &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}}
+	go s.http.Serve(listener)
+	return s, nil
+}
+
+// Close stops the server, waiting briefly for scrapes in progress.
+func (s *Server) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.http.Shutdown(ctx)
+}
@@ -0,0 +1,30 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	var out strings.Builder
+	err := Write(&out, []Metric{
+		{Name: "udm_volume_mounted", Help: "Whether the volume is mounted.", Type: Gauge, Labels: map[string]string{"mapper": "udm-luks"}, Value: 1},
+		{Name: "udm_volume_mounted", Help: "Whether the volume is mounted.", Type: Gauge, Labels: map[string]string{"mapper": `a"b`}, Value: 0},
+		{Name: "udm_unlock_failures_total", Help: "Failed unlock attempts.", Type: Counter, Value: 3},
+	})
+	if err != nil {
+		t.Fatalf("Write() error = %v, want nil", err)
+	}
+
+	want := `# HELP udm_volume_mounted Whether the volume is mounted.
+# TYPE udm_volume_mounted gauge
+udm_volume_mounted{mapper="udm-luks"} 1
+udm_volume_mounted{mapper="a\"b"} 0
+# HELP udm_unlock_failures_total Failed unlock attempts.
+# TYPE udm_unlock_failures_total counter
+udm_unlock_failures_total 3
+`
+	if out.String() != want {
+		t.Fatalf("Write() =\n%s\nwant\n%s", out.String(), want)
+	}
+}
@@ -0,0 +1,403 @@
+// Package nbd serves a block device read-only over the NBD protocol. Clients must
+// upgrade the connection with NBD_OPT_STARTTLS and present a certificate signed by the
+// configured CA before the export is visible.
+package nbd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Protocol constants from the NBD protocol specification.
+const (
+	nbdMagic         = 0x4e42444d41474943 // "NBDMAGIC"
+	optMagic         = 0x49484156454f5054 // "IHAVEOPT"
+	optReplyMagic    = 0x0003e889045565a9
+	requestMagic     = 0x25609513
+	simpleReplyMagic = 0x67446698
+
+	flagFixedNewstyle = 1 << 0
+	flagNoZeroes      = 1 << 1
+
+	optExportName = 1
+	optAbort      = 2
+	optList       = 3
+	optStartTLS   = 5
+	optInfo       = 6
+	optGo         = 7
+
+	repAck       = 1
+	repServer    = 2
+	repInfo      = 3
+	repErrUnsup  = 1<<31 + 1
+	repErrPolicy = 1<<31 + 2
+	repErrTLSReq = 1<<31 + 5
+
+	infoExport = 0
+
+	transmitHasFlags = 1 << 0
+	transmitReadOnly = 1 << 1
+	transmitFlush    = 1 << 2
+
+	cmdRead  = 0
+	cmdWrite = 1
+	cmdDisc  = 2
+	cmdFlush = 3
+
+	errPerm  = 1
+	errIO    = 5
+	errInval = 22
+
+	// maxRead bounds a single read request, as recommended by the specification.
+	maxRead = 32 << 20
+)
+
+// Server exports one device read-only to authenticated TLS clients.
+type Server struct {
+	Device string      // Block device to export
+	Export string      // Export name announced to clients
+	TLS    *tls.Config // Must require and verify client certificates
+	Logf   func(format string, args ...any)
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+// Serve accepts clients on l until the deadline passes, then closes every session.
+func (s *Server) Serve(l net.Listener, deadline time.Time) error {
+	s.conns = make(map[net.Conn]struct{})
+	timer := time.AfterFunc(time.Until(deadline), func() {
+		s.Logf("serving time limit reached, closing all sessions")
+		l.Close()
+		s.closeAll()
+	})
+	defer timer.Stop()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		conn.SetDeadline(deadline)
+		s.track(conn, true)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer s.track(conn, false)
+			s.session(conn)
+		}()
+	}
+}
+
+func (s *Server) track(conn net.Conn, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		s.conns[conn] = struct{}{}
+	} else {
+		delete(s.conns, conn)
+		conn.Close()
+	}
+}
+
+func (s *Server) closeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// session runs the handshake and transmission phases of one client and audits them.
+func (s *Server) session(raw net.Conn) {
+	start := time.Now()
+	peer := raw.RemoteAddr().String()
+	s.Logf("session %s: connected", peer)
+
+	conn, identity, err := s.handshake(raw)
+	if err != nil {
+		s.Logf("session %s: handshake failed: %v", peer, err)
+		return
+	}
+	if conn == nil {
+		s.Logf("session %s: closed during negotiation", peer)
+		return
+	}
+	s.Logf("session %s: client %q opened export %q", peer, identity, s.Export)
+
+	reads, bytesRead, err := s.transmit(conn)
+	result := "disconnected"
+	if err != nil {
+		result = err.Error()
+	}
+	s.Logf("session %s: client %q %s after %s, %d reads, %d bytes", peer, identity, result,
+		time.Since(start).Round(time.Second), reads, bytesRead)
+}
+
+// handshake negotiates fixed newstyle options, requiring STARTTLS before anything else.
+// It returns the TLS connection once the client selected the export, or nil if the
+// client aborted.
+func (s *Server) handshake(raw net.Conn) (net.Conn, string, error) {
+	var conn net.Conn = raw
+	identity := ""
+
+	hello := make([]byte, 18)
+	binary.BigEndian.PutUint64(hello[0:], nbdMagic)
+	binary.BigEndian.PutUint64(hello[8:], optMagic)
+	binary.BigEndian.PutUint16(hello[16:], flagFixedNewstyle|flagNoZeroes)
+	if _, err := conn.Write(hello); err != nil {
+		return nil, "", err
+	}
+
+	var clientFlags uint32
+	if err := binary.Read(conn, binary.BigEndian, &clientFlags); err != nil {
+		return nil, "", err
+	}
+	if clientFlags&flagFixedNewstyle == 0 {
+		return nil, "", fmt.Errorf("client does not support fixed newstyle negotiation")
+	}
+	noZeroes := clientFlags&flagNoZeroes != 0
+
+	for {
+		var header struct {
+			Magic  uint64
+			Option uint32
+			Length uint32
+		}
+		if err := binary.Read(conn, binary.BigEndian, &header); err != nil {
+			return nil, "", err
+		}
+		if header.Magic != optMagic {
+			return nil, "", fmt.Errorf("bad option magic %#x", header.Magic)
+		}
+		if header.Length > 4096 {
+			return nil, "", fmt.Errorf("option %d too long", header.Option)
+		}
+		data := make([]byte, header.Length)
+		if _, err := io.ReadFull(conn, data); err != nil {
+			return nil, "", err
+		}
+
+		tlsConn, secure := conn.(*tls.Conn)
+		switch {
+		case header.Option == optAbort:
+			optReply(conn, header.Option, repAck, nil)
+			return nil, identity, nil
+		case header.Option == optStartTLS && !secure:
+			if err := optReply(conn, header.Option, repAck, nil); err != nil {
+				return nil, "", err
+			}
+			tlsConn = tls.Server(raw, s.TLS)
+			if err := tlsConn.Handshake(); err != nil {
+				return nil, "", fmt.Errorf("TLS handshake: %w", err)
+			}
+			certs := tlsConn.ConnectionState().PeerCertificates
+			if len(certs) == 0 {
+				return nil, "", fmt.Errorf("client presented no certificate")
+			}
+			identity = certs[0].Subject.CommonName
+			conn = tlsConn
+		case !secure:
+			if header.Option == optExportName {
+				return nil, "", fmt.Errorf("client requested export without TLS")
+			}
+			if err := optReply(conn, header.Option, repErrTLSReq, []byte("TLS required")); err != nil {
+				return nil, "", err
+			}
+		case header.Option == optList:
+			name := []byte(s.Export)
+			payload := binary.BigEndian.AppendUint32(nil, uint32(len(name)))
+			optReply(conn, header.Option, repServer, append(payload, name...))
+			if err := optReply(conn, header.Option, repAck, nil); err != nil {
+				return nil, "", err
+			}
+		case header.Option == optExportName:
+			if !s.matches(string(data)) {
+				return nil, "", fmt.Errorf("unknown export %q", data)
+			}
+			size, err := s.size()
+			if err != nil {
+				return nil, "", err
+			}
+			reply := binary.BigEndian.AppendUint64(nil, size)
+			reply = binary.BigEndian.AppendUint16(reply, transmitHasFlags|transmitReadOnly|transmitFlush)
+			if !noZeroes {
+				reply = append(reply, make([]byte, 124)...)
+			}
+			if _, err := conn.Write(reply); err != nil {
+				return nil, "", err
+			}
+			return conn, identity, nil
+		case header.Option == optInfo || header.Option == optGo:
+			if !s.matches(requestedExport(data)) {
+				if err := optReply(conn, header.Option, repErrPolicy, []byte("unknown export")); err != nil {
+					return nil, "", err
+				}
+				continue
+			}
+			size, err := s.size()
+			if err != nil {
+				return nil, "", err
+			}
+			info := binary.BigEndian.AppendUint16(nil, infoExport)
+			info = binary.BigEndian.AppendUint64(info, size)
+			info = binary.BigEndian.AppendUint16(info, transmitHasFlags|transmitReadOnly|transmitFlush)
+			optReply(conn, header.Option, repInfo, info)
+			if err := optReply(conn, header.Option, repAck, nil); err != nil {
+				return nil, "", err
+			}
+			if header.Option == optGo {
+				return conn, identity, nil
+			}
+		default:
+			if err := optReply(conn, header.Option, repErrUnsup, nil); err != nil {
+				return nil, "", err
+			}
+		}
+	}
+}
+
+// requestedExport returns the export name of an NBD_OPT_INFO or NBD_OPT_GO request.
+func requestedExport(data []byte) string {
+	if len(data) < 4 {
+		return ""
+	}
+	n := int(binary.BigEndian.Uint32(data))
+	if n > len(data)-4 {
+		n = len(data) - 4
+	}
+	return string(data[4 : 4+n])
+}
+
+// matches reports whether name selects our export, the empty name being the default.
+func (s *Server) matches(name string) bool {
+	return name == "" || name == s.Export
+}
+
+func optReply(conn net.Conn, option, reply uint32, data []byte) error {
+	buf := binary.BigEndian.AppendUint64(nil, optReplyMagic)
+	buf = binary.BigEndian.AppendUint32(buf, option)
+	buf = binary.BigEndian.AppendUint32(buf, reply)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(data)))
+	_, err := conn.Write(append(buf, data...))
+	return err
+}
+
+// size returns the size of the exported device in bytes.
+func (s *Server) size() (uint64, error) {
+	dev, err := os.Open(s.Device)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open device: %w", err)
+	}
+	defer dev.Close()
+	size, err := dev.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, fmt.Errorf("failed to size device: %w", err)
+	}
+	return uint64(size), nil
+}
+
+// transmit serves read requests until the client disconnects. Writes are refused.
+func (s *Server) transmit(conn net.Conn) (reads int, bytesRead uint64, err error) {
+	dev, err := os.Open(s.Device)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to open device: %w", err)
+	}
+	defer dev.Close()
+
+	for {
+		var req struct {
+			Magic  uint32
+			Flags  uint16
+			Type   uint16
+			Handle uint64
+			Offset uint64
+			Length uint32
+		}
+		if err := binary.Read(conn, binary.BigEndian, &req); err != nil {
+			if errors.Is(err, io.EOF) {
+				return reads, bytesRead, nil
+			}
+			return reads, bytesRead, err
+		}
+		if req.Magic != requestMagic {
+			return reads, bytesRead, fmt.Errorf("bad request magic %#x", req.Magic)
+		}
+
+		switch req.Type {
+		case cmdDisc:
+			return reads, bytesRead, nil
+		case cmdFlush:
+			err = reply(conn, req.Handle, 0, nil)
+		case cmdWrite:
+			// The payload must still be drained to stay in sync with the client
+			if _, err := io.CopyN(io.Discard, conn, int64(req.Length)); err != nil {
+				return reads, bytesRead, err
+			}
+			err = reply(conn, req.Handle, errPerm, nil)
+		case cmdRead:
+			if req.Length > maxRead {
+				err = reply(conn, req.Handle, errInval, nil)
+				break
+			}
+			buf := make([]byte, req.Length)
+			if _, rerr := dev.ReadAt(buf, int64(req.Offset)); rerr != nil {
+				err = reply(conn, req.Handle, errIO, nil)
+				break
+			}
+			reads++
+			bytesRead += uint64(req.Length)
+			err = reply(conn, req.Handle, 0, buf)
+		default:
+			err = reply(conn, req.Handle, errInval, nil)
+		}
+		if err != nil {
+			return reads, bytesRead, err
+		}
+	}
+}
+
+func reply(conn net.Conn, handle uint64, code uint32, data []byte) error {
+	buf := binary.BigEndian.AppendUint32(nil, simpleReplyMagic)
+	buf = binary.BigEndian.AppendUint32(buf, code)
+	buf = binary.BigEndian.AppendUint64(buf, handle)
+	_, err := conn.Write(append(buf, data...))
+	return err
+}
+
+// LoadTLSConfig returns a server TLS configuration that requires client certificates
+// signed by the CA in caFile.
+func LoadTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load server certificate: %w", err)
+	}
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
@@ -0,0 +1,52 @@
+package nbd
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestExportRequiresTLS(t *testing.T) {
+	server, client := net.Pipe()
+	s := &Server{Device: "/dev/null", Export: "udm", Logf: t.Logf, conns: map[net.Conn]struct{}{}}
+	done := make(chan struct{})
+	go func() {
+		s.session(server)
+		server.Close()
+		close(done)
+	}()
+
+	hello := make([]byte, 18)
+	if _, err := io.ReadFull(client, hello); err != nil {
+		t.Fatalf("reading greeting: %v", err)
+	}
+	if binary.BigEndian.Uint64(hello) != nbdMagic {
+		t.Fatalf("greeting magic = %#x, want NBDMAGIC", binary.BigEndian.Uint64(hello))
+	}
+	binary.Write(client, binary.BigEndian, uint32(flagFixedNewstyle|flagNoZeroes))
+
+	// NBD_OPT_GO for the default export without STARTTLS first
+	opt := binary.BigEndian.AppendUint64(nil, optMagic)
+	opt = binary.BigEndian.AppendUint32(opt, optGo)
+	opt = binary.BigEndian.AppendUint32(opt, 6)
+	opt = append(opt, 0, 0, 0, 0, 0, 0)
+	client.Write(opt)
+
+	reply := make([]byte, 20)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatalf("reading option reply: %v", err)
+	}
+	if got := binary.BigEndian.Uint32(reply[12:]); got != repErrTLSReq {
+		t.Fatalf("NBD_OPT_GO without TLS reply = %#x, want NBD_REP_ERR_TLS_REQD", got)
+	}
+	io.ReadFull(client, make([]byte, binary.BigEndian.Uint32(reply[16:])))
+
+	opt = binary.BigEndian.AppendUint64(nil, optMagic)
+	opt = binary.BigEndian.AppendUint32(opt, optAbort)
+	opt = binary.BigEndian.AppendUint32(opt, 0)
+	client.Write(opt)
+	io.ReadFull(client, make([]byte, 20))
+	client.Close()
+	<-done
+}
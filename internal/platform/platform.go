@@ -0,0 +1,18 @@
+// Package platform reports operating systems udm cannot manage volumes on. Packages
+// split their system specific code with GOOS build tags and return
+// ErrUnsupportedPlatform from the stubs, so configuration and token handling still
+// build and test on developer machines.
+package platform
+
+import (
+	"errors"
+	"runtime"
+)
+
+// ErrUnsupportedPlatform is returned by operations that need Linux.
+var ErrUnsupportedPlatform = errors.New("not supported on " + runtime.GOOS + ", udm volumes require Linux")
+
+// Supported reports whether volumes can be managed on this operating system.
+func Supported() bool {
+	return runtime.GOOS == "linux"
+}
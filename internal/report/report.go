@@ -0,0 +1,165 @@
+// Package report produces the signed provisioning report written after authorize, so
+// central inventory knows exactly what was provisioned on each device.
+package report
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Signature algorithms of a signed report.
+const (
+	AlgorithmEd25519     = "ed25519"
+	AlgorithmECDSASHA256 = "ecdsa-sha256"
+)
+
+// Config configures where the provisioning report goes.
+type Config struct {
+	Path       string `yaml:"path"`       // File the report is written to
+	URL        string `yaml:"url"`        // Endpoint the report is POSTed to
+	SigningKey string `yaml:"signingKey"` // PEM Ed25519 or ECDSA private key signing the report
+}
+
+// Enabled reports whether a report is requested.
+func (c Config) Enabled() bool {
+	return c.Path != "" || c.URL != ""
+}
+
+// Report describes a provisioned volume.
+type Report struct {
+	TokenID      string    `json:"tokenId"`
+	VolumePath   string    `json:"volumePath"`
+	MapperName   string    `json:"mapperName"`
+	VolumeUUID   string    `json:"volumeUuid"`
+	HeaderDigest string    `json:"headerDigest"` // SHA-256 of the LUKS header metadata
+	KeyBackend   string    `json:"keyBackend"`   // tpm, keyfile, split or fido2
+	Cipher       string    `json:"cipher"`
+	Provisioned  time.Time `json:"provisioned"`
+	Host         Host      `json:"host"`
+}
+
+// Host identifies the provisioned device.
+type Host struct {
+	Hostname          string `json:"hostname"`
+	MachineID         string `json:"machineId,omitempty"`
+	DeviceCertificate string `json:"deviceCertificate,omitempty"` // Subject of the enrolled identity
+}
+
+// Signed is a report with the signature over its exact JSON bytes.
+type Signed struct {
+	Report    json.RawMessage `json:"report"`
+	Algorithm string          `json:"algorithm"`
+	Signature []byte          `json:"signature"`
+}
+
+// Sign signs the JSON encoding of r with the PEM private key at keyPath.
+func Sign(r *Report, keyPath string) (*Signed, error) {
+	data, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %w", err)
+	}
+	key, err := parsePrivateKey(data)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+
+	signed := &Signed{Report: body}
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		signed.Algorithm = AlgorithmEd25519
+		signed.Signature = ed25519.Sign(k, body)
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256(body)
+		signed.Algorithm = AlgorithmECDSASHA256
+		if signed.Signature, err = ecdsa.SignASN1(rand.Reader, k, digest[:]); err != nil {
+			return nil, fmt.Errorf("failed to sign report: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("signing key must be Ed25519 or ECDSA, got %T", key)
+	}
+	return signed, nil
+}
+
+// Verify checks the signature of s against public key.
+func (s *Signed) Verify(public crypto.PublicKey) error {
+	switch k := public.(type) {
+	case ed25519.PublicKey:
+		if s.Algorithm == AlgorithmEd25519 && ed25519.Verify(k, s.Report, s.Signature) {
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(s.Report)
+		if s.Algorithm == AlgorithmECDSASHA256 && ecdsa.VerifyASN1(k, digest[:], s.Signature) {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid %s report signature", s.Algorithm)
+}
+
+func parsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("signing key is not PEM encoded")
+	}
+	if block.Type == "EC PRIVATE KEY" {
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key: %w", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported signing key %T", key)
+	}
+	return signer, nil
+}
+
+// Publish writes the signed report to the configured path and POSTs it to the
+// configured endpoint.
+func Publish(cfg Config, signed *Signed) error {
+	// Compact, indenting would change the signed report bytes
+	data, err := json.Marshal(signed)
+	if err != nil {
+		return err
+	}
+	if cfg.Path != "" {
+		if err := os.MkdirAll(filepath.Dir(cfg.Path), 0755); err != nil {
+			return fmt.Errorf("failed to create report directory: %w", err)
+		}
+		if err := os.WriteFile(cfg.Path, append(data, '\n'), 0644); err != nil {
+			return fmt.Errorf("failed to write report: %w", err)
+		}
+	}
+	if cfg.URL != "" {
+		client := &http.Client{Timeout: 30 * time.Second}
+		resp, err := client.Post(cfg.URL, "application/json", bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("failed to post report: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+			return fmt.Errorf("report endpoint returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+		}
+	}
+	return nil
+}
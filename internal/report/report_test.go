@@ -0,0 +1,61 @@
+package report
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSignAndPublish(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(private)
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "report.key")
+	os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+
+	r := &Report{TokenID: "abcd1234", VolumeUUID: "0d5e4c53", KeyBackend: "tpm", Provisioned: time.Now().UTC()}
+	signed, err := Sign(r, keyPath)
+	if err != nil {
+		t.Fatalf("Sign failed: %v", err)
+	}
+
+	var posted Signed
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		json.Unmarshal(body, &posted)
+	}))
+	defer server.Close()
+
+	cfg := Config{Path: filepath.Join(dir, "reports", "report.json"), URL: server.URL}
+	if err := Publish(cfg, signed); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+
+	data, err := os.ReadFile(cfg.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written Signed
+	if err := json.Unmarshal(data, &written); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []Signed{written, posted} {
+		if err := s.Verify(public); err != nil {
+			t.Errorf("published report does not verify: %v", err)
+		}
+	}
+
+	written.Report = []byte(`{"tokenId":"forged"}`)
+	if err := written.Verify(public); err == nil {
+		t.Errorf("expected a modified report to fail verification")
+	}
+}
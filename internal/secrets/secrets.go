@@ -0,0 +1,121 @@
+// Package secrets holds key material outside the garbage collected heap: in memory that
+// is locked against swapping, bounded by inaccessible guard pages and checked against a
+// canary for underflows. Buffers are zeroized when destroyed, and DestroyAll wipes every
+// live buffer on exit paths that skip deferred calls.
+package secrets
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"sync"
+)
+
+const canarySize = 16
+
+var (
+	mu   sync.Mutex
+	live = make(map[*Buffer]struct{})
+
+	// canary is the process-wide value written in front of every buffer.
+	canary = func() []byte {
+		c := make([]byte, canarySize)
+		if _, err := rand.Read(c); err != nil {
+			panic(fmt.Sprintf("secrets: failed to generate canary: %v", err))
+		}
+		return c
+	}()
+)
+
+// Buffer is a fixed-size secret. The data ends at a guard page, so overflows fault, and
+// is preceded by the canary, checked on Destroy.
+type Buffer struct {
+	region []byte // Whole mapping: guard page, data pages, guard page
+	inner  []byte // Data pages
+	data   []byte
+}
+
+// New allocates a zeroed buffer of size bytes.
+func New(size int) (*Buffer, error) {
+	if size < 1 {
+		return nil, fmt.Errorf("secret size must be positive, got %d", size)
+	}
+	page := os.Getpagesize()
+	innerSize := roundUp(size+canarySize, page)
+	region, err := allocate(innerSize, page)
+	if err != nil {
+		return nil, err
+	}
+	b := &Buffer{region: region, inner: region[page : page+innerSize]}
+
+	start := innerSize - size
+	copy(b.inner[start-canarySize:start], canary)
+	b.data = b.inner[start:innerSize:innerSize]
+
+	mu.Lock()
+	live[b] = struct{}{}
+	mu.Unlock()
+	return b, nil
+}
+
+// FromBytes moves src into a new buffer, wiping src.
+func FromBytes(src []byte) (*Buffer, error) {
+	defer Wipe(src)
+	b, err := New(len(src))
+	if err != nil {
+		return nil, err
+	}
+	copy(b.data, src)
+	return b, nil
+}
+
+// Bytes returns the secret. The slice is only valid until Destroy and its capacity ends
+// with the data, so appending copies instead of writing past the buffer.
+func (b *Buffer) Bytes() []byte {
+	return b.data
+}
+
+// Destroy zeroizes and releases the buffer. It panics when the canary was overwritten,
+// since the memory in front of the secret was corrupted.
+func (b *Buffer) Destroy() {
+	mu.Lock()
+	_, ok := live[b]
+	delete(live, b)
+	mu.Unlock()
+	if !ok {
+		return
+	}
+
+	start := len(b.inner) - len(b.data)
+	intact := bytes.Equal(b.inner[start-canarySize:start], canary)
+	Wipe(b.inner)
+	release(b)
+	if !intact {
+		panic("secrets: canary overwritten, secret memory corrupted")
+	}
+}
+
+// DestroyAll destroys every live buffer, for exit paths that skip deferred calls.
+func DestroyAll() {
+	mu.Lock()
+	buffers := make([]*Buffer, 0, len(live))
+	for b := range live {
+		buffers = append(buffers, b)
+	}
+	mu.Unlock()
+	for _, b := range buffers {
+		b.Destroy()
+	}
+}
+
+// Wipe zeroizes b.
+func Wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+func roundUp(n, multiple int) int {
+	return (n + multiple - 1) / multiple * multiple
+}
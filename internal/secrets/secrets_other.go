@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+
+package secrets
+
+import "bootstrap/internal/platform"
+
+func allocate(innerSize, page int) ([]byte, error) {
+	return nil, platform.ErrUnsupportedPlatform
+}
+
+func release(b *Buffer) {}
@@ -0,0 +1,44 @@
+package secrets
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBuffer(t *testing.T) {
+	src := []byte("correct horse battery staple")
+	want := bytes.Clone(src)
+
+	b, err := FromBytes(src)
+	if err != nil {
+		t.Fatalf("FromBytes() error = %v, want nil", err)
+	}
+	if !bytes.Equal(b.Bytes(), want) {
+		t.Fatalf("Bytes() = %q, want %q", b.Bytes(), want)
+	}
+	if !bytes.Equal(src, make([]byte, len(src))) {
+		t.Fatalf("FromBytes() did not wipe the source: %q", src)
+	}
+	if cap(b.Bytes()) != len(want) {
+		t.Fatalf("cap(Bytes()) = %d, want %d so appends do not write past the secret", cap(b.Bytes()), len(want))
+	}
+
+	DestroyAll()
+	b.Destroy() // destroying twice is harmless
+}
+
+func TestCanary(t *testing.T) {
+	b, err := New(8)
+	if err != nil {
+		t.Fatalf("New() error = %v, want nil", err)
+	}
+	start := len(b.inner) - len(b.data)
+	b.inner[start-1] ^= 0xff
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Destroy() did not panic on an overwritten canary")
+		}
+	}()
+	b.Destroy()
+}
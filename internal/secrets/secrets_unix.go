@@ -0,0 +1,37 @@
+//go:build linux || darwin
+
+package secrets
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"syscall"
+)
+
+var warnUnlocked sync.Once
+
+// allocate maps innerSize bytes of locked memory between two guard pages.
+func allocate(innerSize, page int) ([]byte, error) {
+	region, err := syscall.Mmap(-1, 0, innerSize+2*page, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to allocate secret memory: %w", err)
+	}
+	for _, guard := range [][]byte{region[:page], region[page+innerSize:]} {
+		if err := syscall.Mprotect(guard, syscall.PROT_NONE); err != nil {
+			syscall.Munmap(region)
+			return nil, fmt.Errorf("failed to protect guard page: %w", err)
+		}
+	}
+	if err := syscall.Mlock(region[page : page+innerSize]); err != nil {
+		// RLIMIT_MEMLOCK is small for unprivileged users, keys are still wiped
+		warnUnlocked.Do(func() { log.Printf("Warning: cannot lock secret memory, it may be swapped: %v", err) })
+	}
+	return region, nil
+}
+
+// release unlocks and unmaps the memory of a wiped buffer.
+func release(b *Buffer) {
+	syscall.Munlock(b.inner)
+	syscall.Munmap(b.region)
+}
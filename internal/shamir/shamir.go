@@ -0,0 +1,130 @@
+// Package shamir implements Shamir's secret sharing over GF(2^8).
+//
+// Each share is the x coordinate (1..255) followed by one polynomial evaluation per
+// secret byte, so a share is always one byte longer than the secret.
+package shamir
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+var expTable, logTable [256]byte
+
+func init() {
+	// Build log/exp tables for GF(2^8) with the AES polynomial and generator 3
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		expTable[i] = x
+		logTable[x] = byte(i)
+		x ^= mulNoTable(x, 2)
+	}
+	expTable[255] = expTable[0]
+}
+
+// mulNoTable multiplies in GF(2^8) without lookup tables; used to build them.
+func mulNoTable(a, b byte) byte {
+	var p byte
+	for b > 0 {
+		if b&1 == 1 {
+			p ^= a
+		}
+		hi := a & 0x80
+		a <<= 1
+		if hi != 0 {
+			a ^= 0x1b
+		}
+		b >>= 1
+	}
+	return p
+}
+
+func mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return expTable[(int(logTable[a])+int(logTable[b]))%255]
+}
+
+func div(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return expTable[(int(logTable[a])-int(logTable[b])+255)%255]
+}
+
+// Split divides secret into n shares, any threshold of which reconstruct it.
+func Split(secret []byte, n, threshold int) ([][]byte, error) {
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("secret is empty")
+	}
+	if threshold < 2 || threshold > n {
+		return nil, fmt.Errorf("threshold (%d) must be between 2 and the number of shares (%d)", threshold, n)
+	}
+	if n > 255 {
+		return nil, fmt.Errorf("number of shares (%d) must be at most 255", n)
+	}
+
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][0] = byte(i + 1)
+	}
+
+	coeffs := make([]byte, threshold)
+	for j, s := range secret {
+		// Random polynomial of degree threshold-1 with the secret byte as constant term
+		coeffs[0] = s
+		if _, err := rand.Read(coeffs[1:]); err != nil {
+			return nil, fmt.Errorf("failed to generate polynomial coefficients: %w", err)
+		}
+		for i := range shares {
+			x := shares[i][0]
+			var y byte
+			for k := threshold - 1; k >= 0; k-- {
+				y = mul(y, x) ^ coeffs[k]
+			}
+			shares[i][j+1] = y
+		}
+	}
+	clear(coeffs)
+
+	return shares, nil
+}
+
+// Combine reconstructs the secret from at least threshold distinct shares.
+func Combine(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, fmt.Errorf("at least 2 shares are required, got %d", len(shares))
+	}
+
+	length := len(shares[0])
+	seen := make(map[byte]bool)
+	for _, share := range shares {
+		if len(share) != length || length < 2 {
+			return nil, fmt.Errorf("shares have inconsistent or invalid lengths")
+		}
+		if share[0] == 0 || seen[share[0]] {
+			return nil, fmt.Errorf("shares have invalid or duplicate x coordinates")
+		}
+		seen[share[0]] = true
+	}
+
+	secret := make([]byte, length-1)
+	for j := range secret {
+		// Lagrange interpolation at x = 0
+		var value byte
+		for i, si := range shares {
+			basis := byte(1)
+			for k, sk := range shares {
+				if i == k {
+					continue
+				}
+				basis = mul(basis, div(sk[0], sk[0]^si[0]))
+			}
+			value ^= mul(si[j+1], basis)
+		}
+		secret[j] = value
+	}
+	return secret, nil
+}
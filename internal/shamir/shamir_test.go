@@ -0,0 +1,42 @@
+package shamir
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSplitCombine(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+
+	shares, err := Split(secret, 3, 2)
+	if err != nil {
+		t.Fatalf("Split() error = %v, want nil", err)
+	}
+
+	// Every pair of shares must reconstruct the secret
+	for i := 0; i < len(shares); i++ {
+		for j := i + 1; j < len(shares); j++ {
+			got, err := Combine([][]byte{shares[i], shares[j]})
+			if err != nil {
+				t.Fatalf("Combine(%d, %d) error = %v, want nil", i, j, err)
+			}
+			if !bytes.Equal(got, secret) {
+				t.Fatalf("Combine(%d, %d) = %x, want %x", i, j, got, secret)
+			}
+		}
+	}
+
+	got, err := Combine(shares)
+	if err != nil || !bytes.Equal(got, secret) {
+		t.Fatalf("Combine(all) = %x, %v, want %x", got, err, secret)
+	}
+}
+
+func TestSplitInvalidThreshold(t *testing.T) {
+	if _, err := Split([]byte("secret"), 3, 4); err == nil {
+		t.Fatalf("Split() with threshold > n error = nil, want error")
+	}
+	if _, err := Split([]byte("secret"), 3, 1); err == nil {
+		t.Fatalf("Split() with threshold 1 error = nil, want error")
+	}
+}
@@ -0,0 +1,85 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// ledgerFile holds the consumed bootstrap tokens of the device.
+const ledgerFile = "tokens.json"
+
+// TokenUse records the authorize that consumed a bootstrap token.
+type TokenUse struct {
+	Consumed time.Time `json:"consumed"`
+	Volumes  []string  `json:"volumes"` // Volumes authorized with the token
+}
+
+// Ledger records the bootstrap tokens consumed on this device, so a token authorizes
+// only once. Callers serialize access with a lock.
+type Ledger struct {
+	path   string
+	Tokens map[string]*TokenUse `json:"tokens"`
+}
+
+// LoadLedger reads the ledger, returning an empty one if no token was consumed yet.
+func LoadLedger() (*Ledger, error) {
+	l := &Ledger{path: filepath.Join(Dir, ledgerFile), Tokens: map[string]*TokenUse{}}
+	data, err := os.ReadFile(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token ledger: %w", err)
+	}
+	if err := json.Unmarshal(data, l); err != nil {
+		return nil, fmt.Errorf("failed to parse token ledger %s: %w", l.path, err)
+	}
+	if l.Tokens == nil {
+		l.Tokens = map[string]*TokenUse{}
+	}
+	return l, nil
+}
+
+// Used returns the recorded use of a token.
+func (l *Ledger) Used(tokenID string) (*TokenUse, bool) {
+	use, ok := l.Tokens[tokenID]
+	return use, ok
+}
+
+// Consume records that the token authorized volume. It reports false if the volume was
+// recorded already.
+func (l *Ledger) Consume(tokenID, volume string, at time.Time) bool {
+	use, ok := l.Tokens[tokenID]
+	if !ok {
+		use = &TokenUse{Consumed: at}
+		l.Tokens[tokenID] = use
+	}
+	if slices.Contains(use.Volumes, volume) {
+		return false
+	}
+	use.Volumes = append(use.Volumes, volume)
+	return true
+}
+
+// Release undoes Consume for an authorize that failed, forgetting the token once no
+// volume was authorized with it.
+func (l *Ledger) Release(tokenID, volume string) {
+	use, ok := l.Tokens[tokenID]
+	if !ok {
+		return
+	}
+	use.Volumes = slices.DeleteFunc(use.Volumes, func(v string) bool { return v == volume })
+	if len(use.Volumes) == 0 {
+		delete(l.Tokens, tokenID)
+	}
+}
+
+// Save atomically writes the ledger back.
+func (l *Ledger) Save() error {
+	return writeJSON(l.path, l)
+}
@@ -0,0 +1,42 @@
+package state
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLedger(t *testing.T) {
+	Dir = t.TempDir()
+	defer func() { Dir = DefaultDir }()
+
+	ledger, err := LoadLedger()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, used := ledger.Used("abc"); used {
+		t.Fatal("fresh ledger reports the token as used")
+	}
+	if !ledger.Consume("abc", "data", time.Now()) {
+		t.Fatal("Consume() of a fresh token = false, want true")
+	}
+	if ledger.Consume("abc", "data", time.Now()) {
+		t.Fatal("Consume() of a recorded volume = true, want false")
+	}
+	if err := ledger.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := LoadLedger()
+	if err != nil {
+		t.Fatal(err)
+	}
+	use, used := reloaded.Used("abc")
+	if !used || len(use.Volumes) != 1 || use.Volumes[0] != "data" {
+		t.Errorf("Used(abc) = %+v, %v, want consumed by data", use, used)
+	}
+
+	reloaded.Release("abc", "data")
+	if _, used := reloaded.Used("abc"); used {
+		t.Error("Used(abc) after releasing its only volume = true, want false")
+	}
+}
@@ -0,0 +1,102 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// registryFile lists the volumes provisioned on the device.
+const registryFile = "state.json"
+
+// RegistryDir is the directory of the registry. Unlike Dir it is shared by all tenants,
+// so list shows every volume of the device.
+var RegistryDir = DefaultDir
+
+// Backends of managed volumes.
+const (
+	BackendImage  = "image"  // Image file attached through a loop device
+	BackendLVM    = "lvm"    // Logical volume created by udm
+	BackendDevice = "device" // Existing block device
+)
+
+// Managed is a volume provisioned by udm.
+type Managed struct {
+	MapperName  string    `json:"mapperName"`
+	Tenant      string    `json:"tenant,omitempty"`
+	Config      string    `json:"config"` // Configuration the volume was authorized with
+	VolumePath  string    `json:"volumePath"`
+	MountPoint  string    `json:"mountPoint"`
+	UUID        string    `json:"uuid,omitempty"` // LUKS UUID
+	Backend     string    `json:"backend"`        // BackendImage, BackendLVM or BackendDevice
+	KeyBackend  string    `json:"keyBackend"`     // Where the key is kept, e.g. tpm or keyfile
+	Persistent  bool      `json:"persistent"`     // Mounted at boot through crypttab and fstab
+	Provisioned time.Time `json:"provisioned"`
+	Updated     time.Time `json:"updated"`
+}
+
+// Registry records the volumes provisioned on the device. Callers serialize access with
+// a lock.
+type Registry struct {
+	path    string
+	Volumes map[string]*Managed `json:"volumes"` // By mapper name
+}
+
+// LoadRegistry reads the registry, returning an empty one if no volume was provisioned.
+func LoadRegistry() (*Registry, error) {
+	r := &Registry{path: filepath.Join(RegistryDir, registryFile), Volumes: map[string]*Managed{}}
+	data, err := os.ReadFile(r.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read volume registry: %w", err)
+	}
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, fmt.Errorf("failed to parse volume registry %s: %w", r.path, err)
+	}
+	if r.Volumes == nil {
+		r.Volumes = map[string]*Managed{}
+	}
+	return r, nil
+}
+
+// Put records a provisioned volume, keeping when it was first provisioned.
+func (r *Registry) Put(v *Managed, at time.Time) {
+	v.Provisioned = at
+	if old, ok := r.Volumes[v.MapperName]; ok {
+		v.Provisioned = old.Provisioned
+	}
+	v.Updated = at
+	r.Volumes[v.MapperName] = v
+}
+
+// Get returns the record of a volume.
+func (r *Registry) Get(mapperName string) (*Managed, bool) {
+	v, ok := r.Volumes[mapperName]
+	return v, ok
+}
+
+// Delete forgets a removed volume.
+func (r *Registry) Delete(mapperName string) {
+	delete(r.Volumes, mapperName)
+}
+
+// List returns the volumes ordered by mapper name.
+func (r *Registry) List() []*Managed {
+	volumes := make([]*Managed, 0, len(r.Volumes))
+	for _, v := range r.Volumes {
+		volumes = append(volumes, v)
+	}
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].MapperName < volumes[j].MapperName })
+	return volumes
+}
+
+// Save atomically writes the registry back.
+func (r *Registry) Save() error {
+	return writeJSON(r.path, r)
+}
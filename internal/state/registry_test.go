@@ -0,0 +1,36 @@
+package state
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRegistry(t *testing.T) {
+	RegistryDir = t.TempDir()
+	defer func() { RegistryDir = DefaultDir }()
+
+	registry, err := LoadRegistry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	registry.Put(&Managed{MapperName: "data", Backend: BackendImage}, first)
+	registry.Put(&Managed{MapperName: "cache", Backend: BackendLVM}, first)
+	registry.Put(&Managed{MapperName: "data", Backend: BackendImage, Persistent: true}, first.Add(time.Hour))
+	registry.Delete("cache")
+	if err := registry.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := LoadRegistry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumes := reloaded.List()
+	if len(volumes) != 1 || volumes[0].MapperName != "data" || !volumes[0].Persistent {
+		t.Fatalf("List() = %+v, want the persistent data volume", volumes)
+	}
+	if !volumes[0].Provisioned.Equal(first) || !volumes[0].Updated.Equal(first.Add(time.Hour)) {
+		t.Errorf("Put() must keep the provisioning time, got %+v", volumes[0])
+	}
+}
@@ -0,0 +1,87 @@
+// Package state persists per-volume records that must survive reboots, unlike the
+// runtime files kept next to the volume locks.
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const DefaultDir = "/var/lib/udm"
+
+// Dir is the directory state files are kept in.
+var Dir = DefaultDir
+
+// Volume is the persistent state of one volume. Callers serialize access with the
+// volume lock.
+type Volume struct {
+	path string
+
+	// First TPM NV index holding the key, assigned at authorize. Volumes authorized before
+	// indices were assigned per volume have none and keep the index of their configuration.
+	NVIndex string `json:"nvIndex,omitempty"`
+
+	// Header fingerprint recorded after the last change made by udm
+	HeaderHash     string    `json:"headerHash,omitempty"`
+	HeaderDump     string    `json:"headerDump,omitempty"`
+	HeaderRecorded time.Time `json:"headerRecorded,omitempty"`
+	HeaderAlerted  string    `json:"headerAlerted,omitempty"` // Hash of the last unexpected header alerted on
+
+	// Lifecycle of the volume, exported as metrics by the daemon
+	KeyCreated     time.Time `json:"keyCreated,omitempty"`     // When the machine key was last generated
+	LastMounted    time.Time `json:"lastMounted,omitempty"`    // Last successful mount
+	UnlockFailures int       `json:"unlockFailures,omitempty"` // Failed unlock attempts since authorize
+
+	// Consecutive failed unlocks since the last success, rate limited by luks.lockout
+	FailedUnlocks     int       `json:"failedUnlocks,omitempty"`
+	LastUnlockFailure time.Time `json:"lastUnlockFailure,omitempty"`
+}
+
+// Load reads the state of the named volume, returning empty state if none was recorded.
+func Load(name string) (*Volume, error) {
+	v := &Volume{path: filepath.Join(Dir, name+".json")}
+	data, err := os.ReadFile(v.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return v, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return nil, fmt.Errorf("failed to parse state file %s: %w", v.path, err)
+	}
+	return v, nil
+}
+
+// Save atomically writes the state back.
+func (v *Volume) Save() error {
+	return writeJSON(v.path, v)
+}
+
+// writeJSON atomically replaces path with the JSON encoding of v.
+func writeJSON(path string, v any) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// Remove deletes the state of a volume that no longer exists.
+func (v *Volume) Remove() error {
+	if err := os.Remove(v.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove state file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+// Package support collects diagnostics into a tarball for support tickets. Secrets are
+// masked before anything is written: configuration values under secret-looking keys,
+// dm-crypt keys and secret assignments in logs.
+package support
+
+import (
+	"archive/tar"
+	"bootstrap/internal/audit"
+	"bootstrap/internal/config"
+	"bootstrap/internal/features"
+	"bootstrap/internal/lock"
+	"bootstrap/internal/state"
+	"bootstrap/internal/trace"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const masked = "********"
+
+// maxLogLines bounds how much of each log is included.
+const maxLogLines = 1000
+
+var (
+	secretKey        = regexp.MustCompile(`(?i)(password|passphrase|secret|privatekey|pin)`)
+	secretAssignment = regexp.MustCompile(`(?i)\b(password|passphrase|secret|pin)(\s*[=:]\s*)\S+`)
+	cryptTableKey    = regexp.MustCompile(`^(\S+: \d+ \d+ crypt \S+ )\S+`)
+)
+
+// bundle writes collected files into a tar stream.
+type bundle struct {
+	tw   *tar.Writer
+	root string
+	now  time.Time
+}
+
+// WriteBundle writes a gzipped tarball of diagnostics for the volume of cfg.
+func WriteBundle(w io.Writer, cfg *config.AppConfig) error {
+	gz := gzip.NewWriter(w)
+	b := &bundle{tw: tar.NewWriter(gz), root: "udm-support", now: time.Now()}
+
+	for _, path := range cfg.Cmd.ConfigFiles {
+		// Layers keep their path, a single configuration is config.yml
+		name := "config.yml"
+		if len(cfg.Cmd.ConfigFiles) > 1 {
+			name = filepath.Join("config", path)
+		}
+		configData, err := os.ReadFile(path)
+		if err != nil {
+			b.addError(name, err)
+		} else if maskedConfig, err := MaskConfig(configData); err != nil {
+			b.addError(name, err)
+		} else {
+			b.add(name, maskedConfig)
+		}
+	}
+
+	b.addFile("state.json", filepath.Join(state.Dir, cfg.LUKS.MapperName+".json"), false)
+	b.addFile("holders.json", filepath.Join(lock.Dir, cfg.LUKS.MapperName+".holders"), false)
+	auditPath := cfg.Audit.Path
+	if auditPath == "" {
+		auditPath = audit.DefaultPath
+	}
+	b.addFile("audit.log", auditPath, true)
+	if data, err := json.MarshalIndent(map[string]any{
+		"version":  features.Version,
+		"features": cfg.Features.Effective(),
+	}, "", "  "); err == nil {
+		b.add("features.json", append(data, '\n'))
+	}
+	b.addFile("crypttab", "/etc/crypttab", false)
+	b.addFile("fstab", "/etc/fstab", false)
+	b.addFile("mounts", "/proc/mounts", false)
+
+	b.addCommand("luksDump.txt", "cryptsetup", "luksDump", cfg.LUKS.VolumePath)
+	b.addCommand("cryptsetup-status.txt", "cryptsetup", "status", cfg.LUKS.MapperName)
+	b.addCommand("cryptsetup-version.txt", "cryptsetup", "--version")
+	b.addCommand("tpm-properties.txt", "tpm2_getcap", "properties-fixed")
+	b.addCommand("tpm-nv-indices.txt", "tpm2_getcap", "handles-nv-index")
+	b.addCommand("dmsetup-table.txt", "dmsetup", "table")
+	b.addCommand("dmsetup-info.txt", "dmsetup", "info", "-c")
+	b.addCommand("lsblk.txt", "lsblk", "-f")
+	b.addCommand("journal.txt", "journalctl", "--no-pager", "--since=-24h", "-n", fmt.Sprint(maxLogLines),
+		"--grep=udm|cryptsetup|tpm2|systemd-cryptsetup")
+	b.addCommand("uname.txt", "uname", "-a")
+
+	if err := b.tw.Close(); err != nil {
+		return fmt.Errorf("failed to finish tarball: %w", err)
+	}
+	return gz.Close()
+}
+
+// MaskConfig replaces string values under secret-looking keys in a YAML document.
+func MaskConfig(data []byte) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse configuration: %w", err)
+	}
+	maskNode(&doc)
+	return yaml.Marshal(&doc)
+}
+
+func maskNode(node *yaml.Node) {
+	if node.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if secretKey.MatchString(key.Value) && value.Kind == yaml.ScalarNode && value.Tag == "!!str" {
+				value.Value = masked
+				continue
+			}
+			maskNode(value)
+		}
+		return
+	}
+	for _, child := range node.Content {
+		maskNode(child)
+	}
+}
+
+// Redact masks secret assignments and dm-crypt keys in text output.
+func Redact(text string) string {
+	var out strings.Builder
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := cryptTableKey.ReplaceAllString(scanner.Text(), "${1}"+masked)
+		line = secretAssignment.ReplaceAllString(line, "${1}${2}"+masked)
+		out.WriteString(line)
+		out.WriteByte('\n')
+	}
+	return out.String()
+}
+
+func (b *bundle) add(name string, data []byte) {
+	b.tw.WriteHeader(&tar.Header{
+		Name:    b.root + "/" + name,
+		Mode:    0600,
+		Size:    int64(len(data)),
+		ModTime: b.now,
+	})
+	b.tw.Write(data)
+}
+
+func (b *bundle) addError(name string, err error) {
+	b.add(name+".err", []byte(err.Error()+"\n"))
+}
+
+// addFile adds a redacted copy of path, only its last lines when tail is set.
+func (b *bundle) addFile(name, path string, tail bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		b.addError(name, err)
+		return
+	}
+	if tail {
+		lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+		if len(lines) > maxLogLines {
+			data = []byte(strings.Join(lines[len(lines)-maxLogLines:], "\n") + "\n")
+		}
+	}
+	b.add(name, []byte(Redact(string(data))))
+}
+
+// addCommand adds the redacted output of a diagnostic command, or why it failed.
+func (b *bundle) addCommand(name, command string, args ...string) {
+	var out bytes.Buffer
+	cmd := trace.Command(command, args...)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		fmt.Fprintf(&out, "\n%s: %v\n", command, err)
+	}
+	b.add(name, []byte(Redact(out.String())))
+}
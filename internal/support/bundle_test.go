@@ -0,0 +1,32 @@
+package support
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMaskConfig(t *testing.T) {
+	data := []byte("luks:\n  mapperName: udm-luks\n  tpmToken: true\nvault:\n  secretId: s.abc123\n  password: hunter2\n")
+	got, err := MaskConfig(data)
+	if err != nil {
+		t.Fatalf("MaskConfig() error = %v, want nil", err)
+	}
+	out := string(got)
+	if strings.Contains(out, "s.abc123") || strings.Contains(out, "hunter2") {
+		t.Fatalf("MaskConfig() leaked a secret:\n%s", out)
+	}
+	if !strings.Contains(out, "udm-luks") || !strings.Contains(out, "tpmToken: true") {
+		t.Fatalf("MaskConfig() masked non-secret values:\n%s", out)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	in := "udm-luks: 0 61440 crypt aes-xts-plain64 6f1c2a7b9e 0 7:0 32768\nlogin password=hunter2 ok\n"
+	got := Redact(in)
+	if strings.Contains(got, "6f1c2a7b9e") || strings.Contains(got, "hunter2") {
+		t.Fatalf("Redact() leaked a secret:\n%s", got)
+	}
+	if !strings.Contains(got, "crypt aes-xts-plain64 "+masked+" 0 7:0") {
+		t.Fatalf("Redact() mangled the crypt table:\n%s", got)
+	}
+}
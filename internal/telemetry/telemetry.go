@@ -0,0 +1,340 @@
+// Package telemetry records the provisioning flows of udm as OpenTelemetry spans and
+// exports them to an OTLP/HTTP collector in the JSON encoding, so the time spent in each
+// phase and external command can be compared across a fleet.
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tracesPath is the OTLP/HTTP path of trace exports.
+const tracesPath = "/v1/traces"
+
+// defaultServiceName is the service.name of exported spans.
+const defaultServiceName = "udm"
+
+// exportTimeout bounds the export, a missing collector must not delay provisioning.
+const exportTimeout = 5 * time.Second
+
+// Config selects the OTLP collector spans are exported to.
+type Config struct {
+	Endpoint    string            `yaml:"endpoint"`    // OTLP/HTTP endpoint, e.g. "https://otel.example.com:4318", disabled when empty
+	ServiceName string            `yaml:"serviceName"` // service.name resource attribute, default "udm"
+	Headers     map[string]string `yaml:"headers"`     // Sent with each export, e.g. an authorization header
+}
+
+// Enabled reports whether spans are exported.
+func (c Config) Enabled() bool {
+	return c.Endpoint != ""
+}
+
+// Validate checks the endpoint is an http(s) URL.
+func (c Config) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	u, err := url.Parse(c.Endpoint)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("telemetry.endpoint (%s) must be an http(s) URL", c.Endpoint)
+	}
+	return nil
+}
+
+// tracesURL returns the URL spans are posted to, the endpoint itself when it already
+// names the traces path.
+func (c Config) tracesURL() string {
+	endpoint := strings.TrimSuffix(c.Endpoint, "/")
+	if strings.HasSuffix(endpoint, tracesPath) {
+		return endpoint
+	}
+	return endpoint + tracesPath
+}
+
+// Attr is a span or resource attribute.
+type Attr struct {
+	Key   string
+	Value any // string, bool, int or int64
+}
+
+// String returns a string attribute.
+func String(key, value string) Attr {
+	return Attr{Key: key, Value: value}
+}
+
+// Int returns an integer attribute.
+func Int(key string, value int) Attr {
+	return Attr{Key: key, Value: value}
+}
+
+// Span is an operation of the trace, ended once.
+type Span struct {
+	tracer *Tracer
+	id     [8]byte
+	parent [8]byte
+	name   string
+	start  time.Time
+	end    time.Time
+	attrs  []Attr
+	err    error
+}
+
+// Tracer collects the spans of one udm process until they are exported. Spans started
+// with Start nest: each is the parent of the spans started or recorded before it ends.
+type Tracer struct {
+	cfg      Config
+	resource []Attr
+	traceID  [16]byte
+	parent   [8]byte // Span of the calling process, from TRACEPARENT
+
+	mu    sync.Mutex
+	open  []*Span
+	ended []*Span
+}
+
+// New returns a tracer exporting to cfg. The trace continues the one of the W3C
+// traceparent in $TRACEPARENT, so a provisioning script can group the udm commands it
+// runs, and starts a new trace otherwise.
+func New(cfg Config, resource ...Attr) *Tracer {
+	if cfg.ServiceName == "" {
+		cfg.ServiceName = defaultServiceName
+	}
+	t := &Tracer{cfg: cfg, resource: append([]Attr{String("service.name", cfg.ServiceName)}, resource...)}
+	if traceID, parent, ok := parseTraceparent(os.Getenv("TRACEPARENT")); ok {
+		t.traceID, t.parent = traceID, parent
+	} else {
+		rand.Read(t.traceID[:])
+	}
+	return t
+}
+
+// parseTraceparent parses a version 00 W3C traceparent header.
+func parseTraceparent(header string) (traceID [16]byte, parent [8]byte, ok bool) {
+	fields := strings.Split(header, "-")
+	if len(fields) != 4 || fields[0] != "00" {
+		return traceID, parent, false
+	}
+	if n, err := hex.Decode(traceID[:], []byte(fields[1])); err != nil || n != len(traceID) || traceID == [16]byte{} {
+		return traceID, parent, false
+	}
+	if n, err := hex.Decode(parent[:], []byte(fields[2])); err != nil || n != len(parent) || parent == [8]byte{} {
+		return traceID, parent, false
+	}
+	return traceID, parent, true
+}
+
+// Traceparent returns the W3C traceparent of the innermost open span, to pass to child
+// processes.
+func (t *Tracer) Traceparent() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return fmt.Sprintf("00-%x-%x-01", t.traceID, t.current())
+}
+
+// current returns the id of the innermost open span, or the caller's span.
+func (t *Tracer) current() [8]byte {
+	if len(t.open) > 0 {
+		return t.open[len(t.open)-1].id
+	}
+	return t.parent
+}
+
+// Start opens a span nested in the innermost open span.
+func (t *Tracer) Start(name string, attrs ...Attr) *Span {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := &Span{tracer: t, parent: t.current(), name: name, start: time.Now(), attrs: attrs}
+	rand.Read(s.id[:])
+	t.open = append(t.open, s)
+	return s
+}
+
+// End ends the span, failed when err is not nil.
+func (s *Span) End(err error) {
+	t := s.tracer
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !s.end.IsZero() {
+		return
+	}
+	s.end, s.err = time.Now(), err
+	for i := len(t.open) - 1; i >= 0; i-- {
+		if t.open[i] == s {
+			t.open = append(t.open[:i], t.open[i+1:]...)
+			break
+		}
+	}
+	t.ended = append(t.ended, s)
+}
+
+// EndAll ends the open spans innermost first, e.g. when the command exits on a failure.
+func (t *Tracer) EndAll(err error) {
+	for {
+		t.mu.Lock()
+		if len(t.open) == 0 {
+			t.mu.Unlock()
+			return
+		}
+		s := t.open[len(t.open)-1]
+		t.mu.Unlock()
+		s.End(err)
+	}
+}
+
+// Record adds a completed span nested in the innermost open span, such as an external
+// command observed after it exited.
+func (t *Tracer) Record(name string, start, end time.Time, err error, attrs ...Attr) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := &Span{tracer: t, parent: t.current(), name: name, start: start, end: end, attrs: attrs, err: err}
+	rand.Read(s.id[:])
+	t.ended = append(t.ended, s)
+}
+
+// Flush exports the ended spans. Spans still open are not exported.
+func (t *Tracer) Flush() error {
+	t.mu.Lock()
+	spans := t.ended
+	t.ended = nil
+	body, err := json.Marshal(t.export(spans))
+	t.mu.Unlock()
+	if err != nil || len(spans) == 0 {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.cfg.tracesURL(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range t.cfg.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to export spans: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("failed to export spans: collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+// OTLP/JSON encoding of ExportTraceServiceRequest.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttr `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID      string     `json:"traceId"`
+		SpanID       string     `json:"spanId"`
+		ParentSpanID string     `json:"parentSpanId,omitempty"`
+		Name         string     `json:"name"`
+		Kind         int        `json:"kind"`
+		Start        string     `json:"startTimeUnixNano"`
+		End          string     `json:"endTimeUnixNano"`
+		Attributes   []otlpAttr `json:"attributes,omitempty"`
+		Status       otlpStatus `json:"status"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+	otlpAttr struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		String *string `json:"stringValue,omitempty"`
+		Bool   *bool   `json:"boolValue,omitempty"`
+		Int    *string `json:"intValue,omitempty"` // int64 is a string in OTLP/JSON
+	}
+)
+
+const (
+	spanKindInternal = 1
+	statusOK         = 1
+	statusError      = 2
+)
+
+// export encodes the spans with the resource of the tracer.
+func (t *Tracer) export(spans []*Span) otlpRequest {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		span := otlpSpan{
+			TraceID:    hex.EncodeToString(t.traceID[:]),
+			SpanID:     hex.EncodeToString(s.id[:]),
+			Name:       s.name,
+			Kind:       spanKindInternal,
+			Start:      strconv.FormatInt(s.start.UnixNano(), 10),
+			End:        strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes: encodeAttrs(s.attrs),
+			Status:     otlpStatus{Code: statusOK},
+		}
+		if s.parent != [8]byte{} {
+			span.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		if s.err != nil {
+			span.Status = otlpStatus{Code: statusError, Message: s.err.Error()}
+		}
+		encoded = append(encoded, span)
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: encodeAttrs(t.resource)},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: defaultServiceName}, Spans: encoded}},
+	}}}
+}
+
+func encodeAttrs(attrs []Attr) []otlpAttr {
+	encoded := make([]otlpAttr, 0, len(attrs))
+	for _, a := range attrs {
+		var v otlpValue
+		switch value := a.Value.(type) {
+		case string:
+			v.String = &value
+		case bool:
+			v.Bool = &value
+		case int:
+			s := strconv.Itoa(value)
+			v.Int = &s
+		case int64:
+			s := strconv.FormatInt(value, 10)
+			v.Int = &s
+		default:
+			s := fmt.Sprint(value)
+			v.String = &s
+		}
+		encoded = append(encoded, otlpAttr{Key: a.Key, Value: v})
+	}
+	return encoded
+}
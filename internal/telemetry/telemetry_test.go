@@ -0,0 +1,75 @@
+package telemetry
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFlushExportsNestedSpans(t *testing.T) {
+	var got otlpRequest
+	var path, auth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, auth = r.URL.Path, r.Header.Get("Authorization")
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("collector received invalid JSON: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	t.Setenv("TRACEPARENT", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	tracer := New(Config{Endpoint: server.URL, Headers: map[string]string{"Authorization": "Bearer x"}}, String("host.name", "edge-7"))
+	root := tracer.Start("udm mount")
+	open := tracer.Start("open")
+	now := time.Now()
+	tracer.Record("cryptsetup", now, now.Add(time.Second), errors.New("exit status 2"), Int("process.exit_code", 2))
+	open.End(nil)
+	root.End(nil)
+	if err := tracer.Flush(); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+
+	if path != "/v1/traces" || auth != "Bearer x" {
+		t.Fatalf("export posted to %s with Authorization %q, want /v1/traces with the header", path, auth)
+	}
+	spans := got.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 3 {
+		t.Fatalf("exported %d spans, want 3", len(spans))
+	}
+	byName := map[string]otlpSpan{}
+	for _, s := range spans {
+		if s.TraceID != "0af7651916cd43dd8448eb211c80319c" {
+			t.Errorf("span %s trace id = %s, want the one of TRACEPARENT", s.Name, s.TraceID)
+		}
+		byName[s.Name] = s
+	}
+	if byName["udm mount"].ParentSpanID != "b7ad6b7169203331" {
+		t.Errorf("root parent = %s, want the span of TRACEPARENT", byName["udm mount"].ParentSpanID)
+	}
+	if byName["open"].ParentSpanID != byName["udm mount"].SpanID || byName["cryptsetup"].ParentSpanID != byName["open"].SpanID {
+		t.Errorf("spans not nested: %+v", spans)
+	}
+	if status := byName["cryptsetup"].Status; status.Code != statusError || status.Message != "exit status 2" {
+		t.Errorf("command status = %+v, want error", status)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	for endpoint, wantErr := range map[string]bool{
+		"":                                false,
+		"https://otel.example.com:4318":   false,
+		"http://127.0.0.1:4318/v1/traces": false,
+		"otel.example.com:4318":           true,
+		"grpc://otel.example.com:4317":    true,
+	} {
+		if err := (Config{Endpoint: endpoint}).Validate(); (err != nil) != wantErr {
+			t.Errorf("Validate(%q) error = %v, wantErr %v", endpoint, err, wantErr)
+		}
+	}
+	if url := (Config{Endpoint: "http://127.0.0.1:4318/v1/traces"}).tracesURL(); url != "http://127.0.0.1:4318/v1/traces" {
+		t.Errorf("tracesURL() = %s, want the endpoint unchanged", url)
+	}
+}
@@ -0,0 +1,130 @@
+// Package tenant scopes volumes to tenants on hosts shared by several customers. The
+// tenant policy file is root-owned, so a tenant's operator cannot widen their own scope
+// by editing a volume configuration.
+package tenant
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+)
+
+const DefaultPolicyPath = "/etc/udm/tenants.yml"
+
+// PolicyPath is the tenant policy file.
+var PolicyPath = DefaultPolicyPath
+
+// Key protectors a tenant policy can allow.
+const (
+	ProtectorKeyfile  = "keyfile"
+	ProtectorTPM      = "tpm"
+	ProtectorSplit    = "split"
+	ProtectorRecovery = "recovery"
+	ProtectorFIDO2    = "fido2"
+	ProtectorVault    = "vault"
+)
+
+// Policy is the policy of one tenant.
+type Policy struct {
+	Users      []string `yaml:"users"`      // Operators allowed to act on the tenant's volumes
+	Groups     []string `yaml:"groups"`     // Groups whose members are operators
+	Volumes    []string `yaml:"volumes"`    // Glob patterns of the volume paths owned by the tenant
+	Protectors []string `yaml:"protectors"` // Allowed key protectors, any when empty
+}
+
+// Policies maps tenant names to their policy.
+type Policies struct {
+	Tenants map[string]Policy `yaml:"tenants"`
+}
+
+// Load reads the tenant policy file, returning no policies if it does not exist.
+func Load() (*Policies, error) {
+	data, err := os.ReadFile(PolicyPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return &Policies{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tenant policy: %w", err)
+	}
+	var p Policies
+	if err := yaml.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse tenant policy %s: %w", PolicyPath, err)
+	}
+	return &p, nil
+}
+
+// Owner returns the tenant owning volumePath, or "" if no tenant claims it.
+func (p *Policies) Owner(volumePath string) string {
+	for name, policy := range p.Tenants {
+		for _, pattern := range policy.Volumes {
+			if ok, _ := filepath.Match(pattern, volumePath); ok {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// Check verifies that a volume configured for tenant is owned by it, uses only allowed
+// protectors, and that operator may act on it.
+func (p *Policies) Check(tenant, volumePath string, protectors []string, operator *user.User) error {
+	owner := p.Owner(volumePath)
+	if tenant == "" {
+		if owner != "" {
+			return fmt.Errorf("volume %s belongs to tenant %s, set luks.tenant", volumePath, owner)
+		}
+		return nil
+	}
+
+	policy, ok := p.Tenants[tenant]
+	if !ok {
+		return fmt.Errorf("tenant %s is not defined in %s", tenant, PolicyPath)
+	}
+	if owner != tenant {
+		return fmt.Errorf("volume %s is not owned by tenant %s", volumePath, tenant)
+	}
+	if len(policy.Protectors) > 0 {
+		for _, protector := range protectors {
+			if !slices.Contains(policy.Protectors, protector) {
+				return fmt.Errorf("key protector %s is not allowed for tenant %s", protector, tenant)
+			}
+		}
+	}
+	if operator != nil && !policy.allows(operator) {
+		return fmt.Errorf("%s is not an operator of tenant %s", operator.Username, tenant)
+	}
+	return nil
+}
+
+func (policy Policy) allows(operator *user.User) bool {
+	if slices.Contains(policy.Users, operator.Username) {
+		return true
+	}
+	groups, err := operator.GroupIds()
+	if err != nil {
+		return false
+	}
+	for _, gid := range groups {
+		if g, err := user.LookupGroupId(gid); err == nil && slices.Contains(policy.Groups, g.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Operator returns the operator acting through udm: the sudo caller, or the invoking
+// user unless that is root. Root acting directly administers all tenants and yields nil.
+func Operator() (*user.User, error) {
+	if name := os.Getenv("SUDO_USER"); name != "" && name != "root" {
+		return user.Lookup(name)
+	}
+	if os.Getuid() == 0 {
+		return nil, nil
+	}
+	return user.Current()
+}
@@ -0,0 +1,38 @@
+package tenant
+
+import (
+	"os/user"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	p := &Policies{Tenants: map[string]Policy{
+		"acme":   {Users: []string{"alice"}, Volumes: []string{"/var/luks/acme-*.img"}, Protectors: []string{ProtectorTPM}},
+		"globex": {Users: []string{"bob"}, Volumes: []string{"/var/luks/globex-*.img"}},
+	}}
+	alice := &user.User{Username: "alice", Uid: "-1"}
+
+	tests := []struct {
+		name       string
+		tenant     string
+		volume     string
+		protectors []string
+		operator   *user.User
+		wantErr    bool
+	}{
+		{"own volume", "acme", "/var/luks/acme-db.img", []string{ProtectorTPM}, alice, false},
+		{"root administers", "acme", "/var/luks/acme-db.img", []string{ProtectorTPM}, nil, false},
+		{"other tenant's volume", "acme", "/var/luks/globex-db.img", []string{ProtectorTPM}, alice, true},
+		{"tenant omitted", "", "/var/luks/acme-db.img", []string{ProtectorTPM}, alice, true},
+		{"protector not allowed", "acme", "/var/luks/acme-db.img", []string{ProtectorKeyfile}, alice, true},
+		{"not an operator", "globex", "/var/luks/globex-db.img", nil, alice, true},
+		{"unknown tenant", "initech", "/var/luks/initech.img", nil, nil, true},
+		{"untenanted volume", "", "/var/luks/shared.img", []string{ProtectorKeyfile}, alice, false},
+	}
+	for _, tt := range tests {
+		err := p.Check(tt.tenant, tt.volume, tt.protectors, tt.operator)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: Check() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package trace
+
+import (
+	"os"
+	"os/exec"
+)
+
+// setProcessGroup is a no-op without Unix process groups.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills only p without Unix process groups.
+func killProcessGroup(p *os.Process) {
+	p.Kill()
+}
@@ -0,0 +1,229 @@
+// Package trace logs the external commands udm runs, with their duration and exit
+// code, to debug provisioning failures in the field. Secrets passed as arguments are
+// redacted; key material passed on stdin or in files is never logged.
+package trace
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Redacted replaces secret argument values in the log.
+const Redacted = "<redacted>"
+
+var enabled atomic.Bool
+
+// Enable turns logging of external commands on or off.
+func Enable(on bool) {
+	enabled.Store(on)
+}
+
+// Enabled reports whether external commands are logged.
+func Enabled() bool {
+	return enabled.Load()
+}
+
+// Observer is told about each external command once it completed, whether or not
+// logging is enabled, e.g. to export it as a tracing span.
+type Observer func(args []string, start, end time.Time, err error)
+
+var observer atomic.Pointer[Observer]
+
+// SetObserver installs the observer of completed commands, nil removes it.
+func SetObserver(o Observer) {
+	if o == nil {
+		observer.Store(nil)
+		return
+	}
+	observer.Store(&o)
+}
+
+// Cmd is an exec.Cmd logged when it completes while tracing is enabled.
+type Cmd struct {
+	*exec.Cmd
+	start  time.Time
+	ctx    context.Context
+	stop   func() bool // Stops watching ctx once the command exited
+	killed atomic.Bool
+}
+
+// ContextError reports a command killed because its context ended: its timeout expired
+// or the operation was canceled.
+type ContextError struct {
+	Args    []string
+	Elapsed time.Duration
+	Err     error // context.DeadlineExceeded or context.Canceled
+}
+
+func (e *ContextError) Error() string {
+	if errors.Is(e.Err, context.DeadlineExceeded) {
+		return fmt.Sprintf("%s timed out after %s and was killed", FormatArgs(e.Args), e.Elapsed.Round(time.Millisecond))
+	}
+	return fmt.Sprintf("%s canceled after %s and was killed", FormatArgs(e.Args), e.Elapsed.Round(time.Millisecond))
+}
+
+func (e *ContextError) Unwrap() error {
+	return e.Err
+}
+
+// Command returns the Cmd to execute the named program with the given arguments.
+func Command(name string, arg ...string) *Cmd {
+	return &Cmd{Cmd: exec.Command(name, arg...)}
+}
+
+// CommandContext is Command killed when ctx is done, see WithContext.
+func CommandContext(ctx context.Context, name string, arg ...string) *Cmd {
+	return Command(name, arg...).WithContext(ctx)
+}
+
+// WithContext makes the command run in a process group of its own, killed as a whole
+// when ctx is done, so helpers it spawned cannot keep it hanging. Waiting then returns
+// a *ContextError. It must be called before the command starts.
+func (c *Cmd) WithContext(ctx context.Context) *Cmd {
+	c.ctx = ctx
+	return c
+}
+
+func (c *Cmd) Start() error {
+	c.start = time.Now()
+	if c.ctx != nil {
+		if err := c.ctx.Err(); err != nil {
+			err = &ContextError{Args: c.Args, Err: err}
+			c.log(err)
+			return err
+		}
+		setProcessGroup(c.Cmd)
+		if c.WaitDelay == 0 {
+			c.WaitDelay = time.Second
+		}
+	}
+	err := c.Cmd.Start()
+	if err != nil {
+		c.log(err)
+		return err
+	}
+	if c.ctx != nil {
+		c.stop = context.AfterFunc(c.ctx, func() {
+			c.killed.Store(true)
+			killProcessGroup(c.Process)
+		})
+	}
+	return nil
+}
+
+func (c *Cmd) Wait() error {
+	err := c.Cmd.Wait()
+	if c.stop != nil {
+		c.stop()
+	}
+	if c.killed.Load() {
+		err = &ContextError{Args: c.Args, Elapsed: time.Since(c.start), Err: c.ctx.Err()}
+	}
+	c.log(err)
+	return err
+}
+
+func (c *Cmd) Run() error {
+	if err := c.Start(); err != nil {
+		return err
+	}
+	return c.Wait()
+}
+
+func (c *Cmd) Output() ([]byte, error) {
+	if c.Stdout != nil {
+		return nil, errors.New("exec: Stdout already set")
+	}
+	var stdout, stderr bytes.Buffer
+	c.Stdout = &stdout
+	captureErr := c.Stderr == nil
+	if captureErr {
+		c.Stderr = &stderr
+	}
+	err := c.Run()
+	var exitErr *exec.ExitError
+	if captureErr && errors.As(err, &exitErr) {
+		exitErr.Stderr = stderr.Bytes()
+	}
+	return stdout.Bytes(), err
+}
+
+func (c *Cmd) CombinedOutput() ([]byte, error) {
+	if c.Stdout != nil || c.Stderr != nil {
+		return nil, errors.New("exec: Stdout or Stderr already set")
+	}
+	var output bytes.Buffer
+	c.Stdout = &output
+	c.Stderr = &output
+	err := c.Run()
+	return output.Bytes(), err
+}
+
+func (c *Cmd) log(err error) {
+	if o := observer.Load(); o != nil {
+		(*o)(c.Args, c.start, time.Now(), err)
+	}
+	if !Enabled() {
+		return
+	}
+	status := "exit 0"
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(err, &exitErr):
+		status = fmt.Sprintf("exit %d", exitErr.ExitCode())
+	case err != nil:
+		status = "error: " + err.Error()
+	}
+	log.Printf("exec: %s (%s, %s)", FormatArgs(c.Args), status, time.Since(c.start).Round(time.Millisecond))
+}
+
+// FormatArgs formats a command line for the log, quoting arguments with spaces and
+// redacting secrets.
+func FormatArgs(args []string) string {
+	formatted := make([]string, len(args))
+	for i, arg := range args {
+		arg = redact(arg)
+		if arg == "" || strings.ContainsAny(arg, " \t\"'") {
+			arg = strconv.Quote(arg)
+		}
+		formatted[i] = arg
+	}
+	return strings.Join(formatted, " ")
+}
+
+// secretFlags are the parts of option names whose values are secrets, e.g.
+// --index-auth=hex:... of tpm2_nvdefine.
+var secretFlags = []string{"auth", "pass", "secret", "pin", "token-value"}
+
+// publicValues are prefixes of values of secret options that only name where the secret
+// is, e.g. a PCR policy or a file.
+var publicValues = []string{"pcr:", "session:", "file:"}
+
+// redact replaces the value of an option carrying a secret.
+func redact(arg string) string {
+	name, value, found := strings.Cut(arg, "=")
+	if !found || !strings.HasPrefix(name, "-") {
+		return arg
+	}
+	lower := strings.ToLower(name)
+	for _, flag := range secretFlags {
+		if !strings.Contains(lower, flag) {
+			continue
+		}
+		for _, prefix := range publicValues {
+			if strings.HasPrefix(value, prefix) {
+				return arg
+			}
+		}
+		return name + "=" + Redacted
+	}
+	return arg
+}
@@ -0,0 +1,41 @@
+package trace
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestFormatArgs(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"cryptsetup", "luksOpen", "/dev/loop0", "udm-luks"}, "cryptsetup luksOpen /dev/loop0 udm-luks"},
+		{[]string{"tpm2_nvread", "0x1500016", "--auth=hex:00ff"}, "tpm2_nvread 0x1500016 --auth=<redacted>"},
+		{[]string{"tpm2_nvread", "0x1500016", "--auth=pcr:sha256:7"}, "tpm2_nvread 0x1500016 --auth=pcr:sha256:7"},
+		{[]string{"tpm2_nvdefine", "--index-auth=hex:00ff"}, "tpm2_nvdefine --index-auth=<redacted>"},
+		{[]string{"systemd-ask-password", "Passphrase for udm:"}, `systemd-ask-password "Passphrase for udm:"`},
+		{[]string{"cryptsetup", "--key-file=/tmp/luks-password-1"}, "cryptsetup --key-file=/tmp/luks-password-1"},
+	}
+	for _, tt := range tests {
+		if got := FormatArgs(tt.args); got != tt.want {
+			t.Errorf("FormatArgs(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestCommandContextKills(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := CommandContext(ctx, "sh", "-c", "sleep 10; :").Run()
+	var killed *ContextError
+	if !errors.As(err, &killed) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a timeout error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("command ran %s after the timeout", elapsed)
+	}
+}
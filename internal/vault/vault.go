@@ -0,0 +1,331 @@
+// Package vault keeps volume keys in HashiCorp Vault, so keys of connected devices are
+// rotated, audited and revoked centrally: either the key itself is stored in a KV v2
+// secret, or it is wrapped by a transit key and only the ciphertext is kept on the
+// device. The device logs in with AppRole or a TLS client certificate.
+package vault
+
+import (
+	"bootstrap/internal/secrets"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Authentication methods of the device.
+const (
+	AuthAppRole = "approle" // Role ID and a secret ID read from a file
+	AuthCert    = "cert"    // TLS client certificate
+)
+
+// Config selects the Vault server and where the key is kept.
+type Config struct {
+	Address   string `yaml:"address"`   // Vault server, e.g. https://vault.example.com:8200, disabled when empty
+	Namespace string `yaml:"namespace"` // Vault Enterprise namespace
+	CACert    string `yaml:"caCert"`    // CA bundle verifying the server, system roots when empty
+	KV        string `yaml:"kv"`        // KV v2 secret storing the key, "<mount>/<path>", e.g. "secret/udm/${machine-id}"
+	Transit   string `yaml:"transit"`   // Transit key wrapping the key instead, "<mount>/<key>", e.g. "transit/udm"
+	Auth      Auth   `yaml:"auth"`      // Login of the device
+}
+
+// Auth configures the login of the device.
+type Auth struct {
+	Method       string `yaml:"method"`       // approle or cert
+	Mount        string `yaml:"mount"`        // Path of the auth method, the method name by default
+	RoleID       string `yaml:"roleID"`       // AppRole role ID
+	SecretIDFile string `yaml:"secretIDFile"` // File holding the AppRole secret ID
+	ClientCert   string `yaml:"clientCert"`   // PEM client certificate of the cert method
+	ClientKey    string `yaml:"clientKey"`    // PEM private key of the client certificate
+	Role         string `yaml:"role"`         // Cert role to log in with, any matching role when empty
+}
+
+// Enabled reports whether the key is kept in Vault.
+func (c Config) Enabled() bool {
+	return c.Address != ""
+}
+
+// Wrapped reports whether the key is wrapped by a transit key rather than stored.
+func (c Config) Wrapped() bool {
+	return c.Transit != ""
+}
+
+// Validate checks the server, the key location and the login.
+func (c Config) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	if !strings.HasPrefix(c.Address, "https://") {
+		return fmt.Errorf("luks.vault.address (%s) must be an https URL", c.Address)
+	}
+	if (c.KV == "") == (c.Transit == "") {
+		return fmt.Errorf("luks.vault requires exactly one of kv or transit")
+	}
+	if c.KV != "" {
+		if _, _, err := splitPath(c.KV); err != nil {
+			return fmt.Errorf("luks.vault.kv (%s) %v", c.KV, err)
+		}
+	}
+	if c.Transit != "" {
+		if _, key, err := splitPath(c.Transit); err != nil || strings.Contains(key, "/") {
+			return fmt.Errorf("luks.vault.transit (%s) must be \"<mount>/<key>\"", c.Transit)
+		}
+	}
+	switch c.Auth.Method {
+	case AuthAppRole:
+		if c.Auth.RoleID == "" || c.Auth.SecretIDFile == "" {
+			return fmt.Errorf("luks.vault.auth method approle requires roleID and secretIDFile")
+		}
+	case AuthCert:
+		if c.Auth.ClientCert == "" || c.Auth.ClientKey == "" {
+			return fmt.Errorf("luks.vault.auth method cert requires clientCert and clientKey")
+		}
+	default:
+		return fmt.Errorf("luks.vault.auth.method (%s) must be %s or %s", c.Auth.Method, AuthAppRole, AuthCert)
+	}
+	return nil
+}
+
+// mount returns the path of the auth method.
+func (a Auth) mount() string {
+	if a.Mount == "" {
+		return a.Method
+	}
+	return strings.Trim(a.Mount, "/")
+}
+
+// splitPath splits "<mount>/<path>" at the first slash.
+func splitPath(s string) (mount, path string, err error) {
+	mount, path, _ = strings.Cut(strings.Trim(s, "/"), "/")
+	if mount == "" || path == "" {
+		return "", "", fmt.Errorf("must be \"<mount>/<path>\"")
+	}
+	return mount, path, nil
+}
+
+// Client is a Vault session of the device.
+type Client struct {
+	cfg   Config
+	http  *http.Client
+	base  string
+	token string
+}
+
+// Login authenticates the device with the configured method.
+func Login(cfg Config) (*Client, error) {
+	httpClient, err := newClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{cfg: cfg, http: httpClient, base: strings.TrimRight(cfg.Address, "/") + "/v1/"}
+
+	login := map[string]string{}
+	switch cfg.Auth.Method {
+	case AuthAppRole:
+		secretID, err := os.ReadFile(cfg.Auth.SecretIDFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Vault secret ID: %w", err)
+		}
+		login["role_id"] = cfg.Auth.RoleID
+		login["secret_id"] = strings.TrimSpace(string(secretID))
+	case AuthCert:
+		if cfg.Auth.Role != "" {
+			login["name"] = cfg.Auth.Role
+		}
+	}
+	var resp struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	if err := c.do(http.MethodPost, "auth/"+cfg.Auth.mount()+"/login", login, &resp); err != nil {
+		return nil, fmt.Errorf("Vault login failed: %w", err)
+	}
+	if resp.Auth.ClientToken == "" {
+		return nil, fmt.Errorf("Vault login failed: no client token returned")
+	}
+	c.token = resp.Auth.ClientToken
+	return c, nil
+}
+
+// kvPaths returns the data and metadata paths of the KV v2 secret.
+func (c *Client) kvPaths() (data, metadata string) {
+	mount, path, _ := splitPath(c.cfg.KV)
+	return mount + "/data/" + path, mount + "/metadata/" + path
+}
+
+// WriteKey stores key in the KV secret, replacing the previous version.
+func (c *Client) WriteKey(key []byte) error {
+	data, _ := c.kvPaths()
+	request := map[string]any{"data": map[string]string{"key": base64.StdEncoding.EncodeToString(key)}}
+	if err := c.do(http.MethodPost, data, request, nil); err != nil {
+		return fmt.Errorf("failed to store key in Vault: %w", err)
+	}
+	return nil
+}
+
+// ReadKey reads the key from the KV secret.
+func (c *Client) ReadKey() ([]byte, error) {
+	data, _ := c.kvPaths()
+	var resp struct {
+		Data struct {
+			Data struct {
+				Key string `json:"key"`
+			} `json:"data"`
+		} `json:"data"`
+	}
+	if err := c.do(http.MethodGet, data, nil, &resp); err != nil {
+		return nil, fmt.Errorf("failed to read key from Vault: %w", err)
+	}
+	key, err := decodeKey(resp.Data.Data.Key)
+	if err != nil {
+		return nil, fmt.Errorf("Vault secret %s holds no key", c.cfg.KV)
+	}
+	return key, nil
+}
+
+// DeleteKey deletes all versions of the KV secret.
+func (c *Client) DeleteKey() error {
+	_, metadata := c.kvPaths()
+	if err := c.do(http.MethodDelete, metadata, nil, nil); err != nil {
+		return fmt.Errorf("failed to delete key from Vault: %w", err)
+	}
+	return nil
+}
+
+// Wrap encrypts key with the transit key, returning the Vault ciphertext.
+func (c *Client) Wrap(key []byte) (string, error) {
+	mount, name, _ := splitPath(c.cfg.Transit)
+	var resp struct {
+		Data struct {
+			Ciphertext string `json:"ciphertext"`
+		} `json:"data"`
+	}
+	request := map[string]string{"plaintext": base64.StdEncoding.EncodeToString(key)}
+	if err := c.do(http.MethodPost, mount+"/encrypt/"+name, request, &resp); err != nil {
+		return "", fmt.Errorf("failed to wrap key with Vault: %w", err)
+	}
+	if !strings.HasPrefix(resp.Data.Ciphertext, "vault:") {
+		return "", fmt.Errorf("failed to wrap key with Vault: unexpected ciphertext %q", resp.Data.Ciphertext)
+	}
+	return resp.Data.Ciphertext, nil
+}
+
+// Unwrap decrypts a ciphertext returned by Wrap.
+func (c *Client) Unwrap(ciphertext string) ([]byte, error) {
+	mount, name, _ := splitPath(c.cfg.Transit)
+	var resp struct {
+		Data struct {
+			Plaintext string `json:"plaintext"`
+		} `json:"data"`
+	}
+	request := map[string]string{"ciphertext": ciphertext}
+	if err := c.do(http.MethodPost, mount+"/decrypt/"+name, request, &resp); err != nil {
+		return nil, fmt.Errorf("failed to unwrap key with Vault: %w", err)
+	}
+	key, err := decodeKey(resp.Data.Plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap key with Vault: no plaintext returned")
+	}
+	return key, nil
+}
+
+// decodeKey decodes the base64 key returned by Vault into locked memory, the caller
+// wipes it.
+func decodeKey(encoded string) ([]byte, error) {
+	if encoded == "" {
+		return nil, fmt.Errorf("empty key")
+	}
+	buf, err := secrets.New(base64.StdEncoding.DecodedLen(len(encoded)))
+	if err != nil {
+		return nil, err
+	}
+	n, err := base64.StdEncoding.Decode(buf.Bytes(), []byte(encoded))
+	if err != nil || n == 0 {
+		buf.Destroy()
+		return nil, fmt.Errorf("invalid key encoding")
+	}
+	return buf.Bytes()[:n], nil
+}
+
+// do sends request as JSON to the API path and decodes the JSON response into response.
+func (c *Client) do(method, path string, request, response any) error {
+	var body io.Reader
+	if request != nil {
+		data, err := json.Marshal(request)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.base+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		req.Header.Set("X-Vault-Token", c.token)
+	}
+	if c.cfg.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.cfg.Namespace)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("failed to read Vault response: %w", err)
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Vault returned %s: %s", resp.Status, vaultErrors(data))
+	}
+	if response == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	if err := json.Unmarshal(data, response); err != nil {
+		return fmt.Errorf("failed to decode Vault response: %w", err)
+	}
+	return nil
+}
+
+// vaultErrors returns the errors of a Vault error response, or its body.
+func vaultErrors(data []byte) string {
+	var resp struct {
+		Errors []string `json:"errors"`
+	}
+	if json.Unmarshal(data, &resp) == nil && len(resp.Errors) > 0 {
+		return strings.Join(resp.Errors, "; ")
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func newClient(cfg Config) (*http.Client, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.CACert != "" {
+		data, err := os.ReadFile(cfg.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Vault CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates in %s", cfg.CACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.Auth.Method == AuthCert {
+		cert, err := tls.LoadX509KeyPair(cfg.Auth.ClientCert, cfg.Auth.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load Vault client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Client{Timeout: 30 * time.Second, Transport: &http.Transport{TLSClientConfig: tlsConfig}}, nil
+}
@@ -0,0 +1,162 @@
+package vault
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeVault serves the AppRole login, KV v2 and transit endpoints used by the client.
+func fakeVault(t *testing.T) (Config, map[string]string) {
+	t.Helper()
+	secrets := map[string]string{}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		if r.URL.Path != "/v1/auth/approle/login" && r.Header.Get("X-Vault-Token") != "s.device" {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]any{"errors": []string{"permission denied"}})
+			return
+		}
+		switch {
+		case r.URL.Path == "/v1/auth/approle/login":
+			if body["role_id"] != "role" || body["secret_id"] != "secret" {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]any{"errors": []string{"invalid role or secret ID"}})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]any{"auth": map[string]any{"client_token": "s.device"}})
+		case r.URL.Path == "/v1/secret/data/udm/device-1" && r.Method == http.MethodPost:
+			secrets["udm/device-1"] = body["data"].(map[string]any)["key"].(string)
+			json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"version": 1}})
+		case r.URL.Path == "/v1/secret/data/udm/device-1" && r.Method == http.MethodGet:
+			key, ok := secrets["udm/device-1"]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(map[string]any{"errors": []string{}})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"data": map[string]any{"key": key}}})
+		case r.URL.Path == "/v1/secret/metadata/udm/device-1" && r.Method == http.MethodDelete:
+			delete(secrets, "udm/device-1")
+			w.WriteHeader(http.StatusNoContent)
+		case r.URL.Path == "/v1/transit/encrypt/udm":
+			json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"ciphertext": "vault:v1:" + body["plaintext"].(string)}})
+		case r.URL.Path == "/v1/transit/decrypt/udm":
+			plaintext := strings.TrimPrefix(body["ciphertext"].(string), "vault:v1:")
+			json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"plaintext": plaintext}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	dir := t.TempDir()
+	caCert := filepath.Join(dir, "ca.pem")
+	os.WriteFile(caCert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600)
+	secretID := filepath.Join(dir, "secret-id")
+	os.WriteFile(secretID, []byte("secret\n"), 0600)
+
+	cfg := Config{
+		Address: server.URL,
+		CACert:  caCert,
+		Auth:    Auth{Method: AuthAppRole, RoleID: "role", SecretIDFile: secretID},
+	}
+	return cfg, secrets
+}
+
+func TestKV(t *testing.T) {
+	cfg, secrets := fakeVault(t)
+	cfg.KV = "secret/udm/device-1"
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+	client, err := Login(cfg)
+	if err != nil {
+		t.Fatalf("Login() error = %v", err)
+	}
+
+	key := []byte("0123456789abcdef0123456789abcdef")
+	if err := client.WriteKey(key); err != nil {
+		t.Fatalf("WriteKey() error = %v", err)
+	}
+	if secrets["udm/device-1"] != base64.StdEncoding.EncodeToString(key) {
+		t.Errorf("stored secret = %q", secrets["udm/device-1"])
+	}
+	got, err := client.ReadKey()
+	if err != nil || !bytes.Equal(got, key) {
+		t.Fatalf("ReadKey() = %q, %v, want %q", got, err, key)
+	}
+	if err := client.DeleteKey(); err != nil {
+		t.Fatalf("DeleteKey() error = %v", err)
+	}
+	if _, err := client.ReadKey(); err == nil {
+		t.Fatal("ReadKey() after DeleteKey() succeeded")
+	}
+}
+
+func TestTransit(t *testing.T) {
+	cfg, _ := fakeVault(t)
+	cfg.Transit = "transit/udm"
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+	client, err := Login(cfg)
+	if err != nil {
+		t.Fatalf("Login() error = %v", err)
+	}
+
+	key := []byte("0123456789abcdef0123456789abcdef")
+	ciphertext, err := client.Wrap(key)
+	if err != nil {
+		t.Fatalf("Wrap() error = %v", err)
+	}
+	got, err := client.Unwrap(ciphertext)
+	if err != nil || !bytes.Equal(got, key) {
+		t.Fatalf("Unwrap() = %q, %v, want %q", got, err, key)
+	}
+}
+
+func TestLoginRejected(t *testing.T) {
+	cfg, _ := fakeVault(t)
+	cfg.KV = "secret/udm/device-1"
+	os.WriteFile(cfg.Auth.SecretIDFile, []byte("wrong"), 0600)
+	if _, err := Login(cfg); err == nil || !strings.Contains(err.Error(), "invalid role or secret ID") {
+		t.Fatalf("Login() error = %v, want the Vault error", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	approle := Auth{Method: AuthAppRole, RoleID: "role", SecretIDFile: "/etc/udm/vault-secret-id"}
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{"disabled", Config{}, false},
+		{"kv", Config{Address: "https://vault:8200", KV: "secret/udm/dev", Auth: approle}, false},
+		{"transit", Config{Address: "https://vault:8200", Transit: "transit/udm", Auth: approle}, false},
+		{"cert", Config{Address: "https://vault:8200", KV: "secret/udm", Auth: Auth{Method: AuthCert, ClientCert: "c.pem", ClientKey: "c.key"}}, false},
+		{"http", Config{Address: "http://vault:8200", KV: "secret/udm", Auth: approle}, true},
+		{"kv and transit", Config{Address: "https://vault:8200", KV: "secret/udm", Transit: "transit/udm", Auth: approle}, true},
+		{"neither", Config{Address: "https://vault:8200", Auth: approle}, true},
+		{"kv without path", Config{Address: "https://vault:8200", KV: "secret", Auth: approle}, true},
+		{"nested transit key", Config{Address: "https://vault:8200", Transit: "transit/udm/key", Auth: approle}, true},
+		{"approle without secret", Config{Address: "https://vault:8200", KV: "secret/udm", Auth: Auth{Method: AuthAppRole, RoleID: "role"}}, true},
+		{"unknown method", Config{Address: "https://vault:8200", KV: "secret/udm", Auth: Auth{Method: "token"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cfg.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,289 @@
+// Package webhook notifies HTTP endpoints of volume lifecycle events, so a fleet backend
+// learns about state changes of device volumes in near-real time. Each delivery is
+// signed with HMAC-SHA256. A command makes a single short attempt, deliveries that fail
+// are kept in an outbox which the daemon flushes in the background.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Lifecycle events sent to webhooks.
+const (
+	EventAuthorize   = "authorize"    // Volume provisioned, or provisioning failed
+	EventMount       = "mount"        // Volume mounted by a command
+	EventUnmount     = "unmount"      // Volume unmounted by a command or by the daemon
+	EventKeyRotation = "key-rotation" // Keyslots or the volume key changed
+	EventPanic       = "panic"        // Keys destroyed by udm panic or a tamper signal
+)
+
+// Outcomes of an Event.
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// Headers of a delivery. The signature is "sha256=" and the hex HMAC-SHA256 of the body.
+const (
+	SignatureHeader = "X-UDM-Signature"
+	EventHeader     = "X-UDM-Event"
+	DeliveryHeader  = "X-UDM-Delivery"
+)
+
+// notifyTimeout bounds the one attempt of Notify, an unreachable endpoint must not stall
+// a command. Flush, which runs in the background, waits up to deliveryTimeout.
+const (
+	notifyTimeout   = 2 * time.Second
+	deliveryTimeout = 5 * time.Second
+)
+
+// maxOutbox is the number of undelivered events kept, the oldest are dropped first.
+const maxOutbox = 100
+
+// Config is an endpoint notified of lifecycle events.
+type Config struct {
+	URL        string   `yaml:"url"`        // http(s) endpoint events are POSTed to
+	SecretFile string   `yaml:"secretFile"` // File holding the HMAC-SHA256 secret deliveries are signed with
+	Events     []string `yaml:"events"`     // Events sent to the endpoint, all when empty
+}
+
+// Validate checks the endpoint, secret and events of the webhook at index i.
+func (c Config) Validate(i int) error {
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("webhooks[%d].url (%s) must be an http(s) URL", i, c.URL)
+	}
+	if c.SecretFile == "" {
+		return fmt.Errorf("webhooks[%d].secretFile is required to sign deliveries", i)
+	}
+	for _, event := range c.Events {
+		switch event {
+		case EventAuthorize, EventMount, EventUnmount, EventKeyRotation, EventPanic:
+		default:
+			return fmt.Errorf("webhooks[%d].events entry %q must be %s, %s, %s, %s or %s", i, event,
+				EventAuthorize, EventMount, EventUnmount, EventKeyRotation, EventPanic)
+		}
+	}
+	return nil
+}
+
+// wants reports whether the endpoint is sent the event.
+func (c Config) wants(event string) bool {
+	return len(c.Events) == 0 || slices.Contains(c.Events, event)
+}
+
+// Event is the JSON body of a delivery. Receivers drop duplicates by ID, an event may be
+// delivered again when the outbox is retried concurrently.
+type Event struct {
+	ID         string    `json:"id"`
+	Event      string    `json:"event"`
+	Outcome    string    `json:"outcome"`
+	Time       time.Time `json:"time"`
+	Host       string    `json:"host"`
+	MapperName string    `json:"mapperName"`
+	VolumePath string    `json:"volumePath"`
+	Tenant     string    `json:"tenant,omitempty"`
+	Detail     string    `json:"detail,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// NewEvent returns a successful event of the volume, stamped with a random ID, the
+// current time and the hostname.
+func NewEvent(event, volumePath, mapperName string) *Event {
+	id := make([]byte, 16)
+	rand.Read(id)
+	hostname, _ := os.Hostname()
+	return &Event{
+		ID:         hex.EncodeToString(id),
+		Event:      event,
+		Outcome:    OutcomeSuccess,
+		Time:       time.Now().UTC(),
+		Host:       hostname,
+		MapperName: mapperName,
+		VolumePath: volumePath,
+	}
+}
+
+// delivery is an undelivered event in the outbox. It names the secret file rather than
+// holding the secret, so the outbox reveals nothing to sign with.
+type delivery struct {
+	URL        string          `json:"url"`
+	SecretFile string          `json:"secretFile"`
+	Event      string          `json:"event"`
+	ID         string          `json:"id"`
+	Body       json.RawMessage `json:"body"`
+}
+
+// Notifier sends events to the configured webhooks.
+type Notifier struct {
+	hooks  []Config
+	outbox string
+}
+
+// New returns a notifier of hooks keeping undelivered events in the outbox directory.
+func New(hooks []Config, outbox string) *Notifier {
+	return &Notifier{hooks: hooks, outbox: outbox}
+}
+
+// Notify makes one short attempt to send the event to the webhooks that want it and
+// queues the deliveries that fail. While the outbox holds events it only queues, so
+// events arrive in order once Flush drains it.
+func (n *Notifier) Notify(e *Event) error {
+	names, err := n.queued()
+	if err != nil {
+		return err
+	}
+	return n.deliver(e, len(names) == 0)
+}
+
+// Queue adds the event for the webhooks that want it to the outbox without sending it,
+// for callers that must not wait on an endpoint.
+func (n *Notifier) Queue(e *Event) error {
+	return n.deliver(e, false)
+}
+
+// deliver sends the event once when send is set and queues the deliveries not sent.
+func (n *Notifier) deliver(e *Event, send bool) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, hook := range n.hooks {
+		if !hook.wants(e.Event) {
+			continue
+		}
+		d := delivery{URL: hook.URL, SecretFile: hook.SecretFile, Event: e.Event, ID: e.ID, Body: body}
+		if send {
+			if err = d.send(notifyTimeout); err == nil {
+				continue
+			}
+		}
+		if queueErr := n.queue(d); queueErr != nil {
+			errs = append(errs, fmt.Errorf("failed to queue %s event for %s: %v", d.Event, d.URL, queueErr))
+		} else if send {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Flush sends the queued events once each, oldest first, removing the delivered ones.
+// It returns the number still queued.
+func (n *Notifier) Flush() (int, error) {
+	names, err := n.queued()
+	if err != nil {
+		return 0, err
+	}
+	pending := 0
+	for _, name := range names {
+		path := filepath.Join(n.outbox, name)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue // Delivered by a concurrent flush
+		}
+		var d delivery
+		if err := json.Unmarshal(data, &d); err != nil {
+			os.Remove(path) // Unreadable, it would block the outbox forever
+			continue
+		}
+		if err := d.send(deliveryTimeout); err != nil {
+			pending++
+			continue
+		}
+		os.Remove(path)
+	}
+	return pending, nil
+}
+
+// queued returns the outbox entries, oldest first.
+func (n *Notifier) queued() ([]string, error) {
+	entries, err := os.ReadDir(n.outbox)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read outbox: %w", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".json") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// queue writes the delivery to the outbox, dropping the oldest entries beyond maxOutbox.
+func (n *Notifier) queue(d delivery) error {
+	if err := os.MkdirAll(n.outbox, 0700); err != nil {
+		return fmt.Errorf("failed to create outbox: %w", err)
+	}
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	// Zero-padded nanoseconds sort in queue order
+	name := fmt.Sprintf("%020d-%s.json", time.Now().UnixNano(), d.ID)
+	if err := os.WriteFile(filepath.Join(n.outbox, name), data, 0600); err != nil {
+		return fmt.Errorf("failed to write outbox entry: %w", err)
+	}
+	names, err := n.queued()
+	if err != nil {
+		return err
+	}
+	for len(names) > maxOutbox {
+		os.Remove(filepath.Join(n.outbox, names[0]))
+		names = names[1:]
+	}
+	return nil
+}
+
+// send POSTs the body signed with the secret of the webhook, waiting up to timeout.
+func (d delivery) send(timeout time.Duration) error {
+	secret, err := os.ReadFile(d.SecretFile)
+	if err != nil {
+		return fmt.Errorf("failed to read webhook secret: %w", err)
+	}
+	mac := hmac.New(sha256.New, bytes.TrimSpace(secret))
+	mac.Write(d.Body)
+
+	req, err := http.NewRequest(http.MethodPost, d.URL, bytes.NewReader(d.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	req.Header.Set(EventHeader, d.Event)
+	req.Header.Set(DeliveryHeader, d.ID)
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post %s event to %s: %w", d.Event, d.URL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("webhook %s returned %s: %s", d.URL, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
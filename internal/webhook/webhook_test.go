@@ -0,0 +1,115 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNotifySignsDelivery(t *testing.T) {
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	os.WriteFile(secretFile, []byte("s3cret\n"), 0600)
+
+	var got Event
+	var signature, event string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("s3cret"))
+		mac.Write(body)
+		signature, event = r.Header.Get(SignatureHeader), r.Header.Get(EventHeader)
+		if signature != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			t.Errorf("%s = %s, want the HMAC-SHA256 of the body", SignatureHeader, signature)
+		}
+		json.Unmarshal(body, &got)
+	}))
+	defer server.Close()
+
+	n := New([]Config{
+		{URL: server.URL, SecretFile: secretFile},
+		{URL: server.URL + "/panic-only", SecretFile: secretFile, Events: []string{EventPanic}},
+	}, t.TempDir())
+	e := NewEvent(EventMount, "/var/luks/data.img", "data")
+	if err := n.Notify(e); err != nil {
+		t.Fatalf("Notify() error = %v", err)
+	}
+	if event != EventMount || got.ID != e.ID || got.MapperName != "data" || got.Outcome != OutcomeSuccess {
+		t.Errorf("delivered %s event %+v, want the mount event of data", event, got)
+	}
+}
+
+func TestNotifyQueuesUndelivered(t *testing.T) {
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	os.WriteFile(secretFile, []byte("s3cret"), 0600)
+	up := false
+	var received []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up {
+			http.Error(w, "maintenance", http.StatusServiceUnavailable)
+			return
+		}
+		received = append(received, r.Header.Get(DeliveryHeader))
+	}))
+	defer server.Close()
+
+	n := New([]Config{{URL: server.URL, SecretFile: secretFile}}, t.TempDir())
+	first := NewEvent(EventAuthorize, "/var/luks/data.img", "data")
+	if err := n.Notify(first); err == nil {
+		t.Fatalf("Notify() to an unavailable endpoint error = nil, want an error")
+	}
+	if names, _ := n.queued(); len(names) != 1 {
+		t.Fatalf("outbox holds %d events, want 1", len(names))
+	}
+
+	// Behind the queued event the next one is only queued, Flush sends both in order
+	up = true
+	second := NewEvent(EventUnmount, "/var/luks/data.img", "data")
+	if err := n.Notify(second); err != nil {
+		t.Fatalf("Notify() error = %v", err)
+	}
+	if len(received) != 0 {
+		t.Fatalf("received %v before Flush(), want nothing", received)
+	}
+	if pending, err := n.Flush(); err != nil || pending != 0 {
+		t.Fatalf("Flush() = %d, %v, want 0, nil", pending, err)
+	}
+	if len(received) != 2 || received[0] != first.ID || received[1] != second.ID {
+		t.Errorf("received %v, want %s then %s", received, first.ID, second.ID)
+	}
+	if names, _ := n.queued(); len(names) != 0 {
+		t.Errorf("outbox holds %d events after delivery, want 0", len(names))
+	}
+}
+
+func TestQueueDropsOldest(t *testing.T) {
+	n := New(nil, t.TempDir())
+	for i := 0; i < maxOutbox+5; i++ {
+		if err := n.queue(delivery{ID: NewEvent(EventMount, "", "").ID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if names, _ := n.queued(); len(names) != maxOutbox {
+		t.Errorf("outbox holds %d events, want %d", len(names), maxOutbox)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, c := range []Config{
+		{URL: "ftp://fleet.example.com", SecretFile: "/etc/udm/webhook.secret"},
+		{URL: "https://fleet.example.com"},
+		{URL: "https://fleet.example.com", SecretFile: "/etc/udm/webhook.secret", Events: []string{"mounted"}},
+	} {
+		if err := c.Validate(0); err == nil {
+			t.Errorf("Validate(%+v) = nil, want an error", c)
+		}
+	}
+	if err := (Config{URL: "https://fleet.example.com", SecretFile: "/etc/udm/webhook.secret", Events: []string{EventPanic}}).Validate(0); err != nil {
+		t.Errorf("Validate() = %v, want nil", err)
+	}
+}
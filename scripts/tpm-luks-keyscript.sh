@@ -2,17 +2,106 @@
 
 # Path to TPM tools
 TPM2_NVREAD="/usr/bin/tpm2_nvread"
+TPM2_NVREADPUBLIC="/usr/bin/tpm2_nvreadpublic"
+
+# Keys longer than 64 bytes span consecutive NV indices
+CHUNK_SIZE=64
+
+# add-persistent-mount passes the NV index of the volume as the key field of crypttab and
+# records its key size and NV auth settings (NV_AUTH_MODE none, password or pcr) in a file
+# named after it
+if [[ "$1" =~ ^0x[0-9a-f]+$ ]]; then
+    NV_INDEX="$1"
+    [[ -r "/etc/udm/keyscript.d/$1.conf" ]] && . "/etc/udm/keyscript.d/$1.conf"
+fi
+
+# A TPM 1.2 keeps the key sealed in a blob file instead of NV indices, unsealed through tcsd
+if [[ "$TPM_VERSION" == "1.2" ]]; then
+    if ! /usr/sbin/tpm_unsealdata --srk-well-known --infile "$TPM1_BLOB" 2>/dev/null; then
+        echo "Error: Failed to unseal key from $TPM1_BLOB with the TPM 1.2" >&2
+        exit 1
+    fi
+    exit 0
+fi
 
 # Default NV Index and size
 NV_INDEX="${NV_INDEX:-0x1500016}" # Read from env or fallback
-SIZE="${SIZE:-20}"                # Read from env or fallback
 
-# Read the key from TPM NV Index
-OUTPUT=$($TPM2_NVREAD --size "$SIZE" "$NV_INDEX" 2>/dev/null)
-if [[ $? -ne 0 ]]; then
-    echo "Error: Failed to read key from TPM NV Index $NV_INDEX" >&2
+# hex_bytes prints the bytes of a hex string
+hex_bytes() {
+    local out="" i
+    for ((i = 0; i < ${#1}; i += 2)); do
+        out+="\\x${1:i:2}"
+    done
+    printf "$out"
+}
+
+# hmac_sha256 prints HMAC-SHA256(key, message) as raw bytes. The key and the result only
+# pass through builtins and pipes, never the command line of a process other users could
+# read in /proc.
+hmac_sha256() {
+    local key ipad="" opad="" i byte
+    key=$(printf '%s' "$1" | od -An -v -tx1 | tr -d ' \n')
+    # Keys longer than the block size are hashed first
+    if [[ ${#key} -gt 128 ]]; then
+        key=$(printf '%s' "$1" | sha256sum | cut -d' ' -f1)
+    fi
+    while [[ ${#key} -lt 128 ]]; do
+        key+="00"
+    done
+    for ((i = 0; i < 128; i += 2)); do
+        byte=$((16#${key:i:2}))
+        printf -v ipad '%s%02x' "$ipad" $((byte ^ 0x36))
+        printf -v opad '%s%02x' "$opad" $((byte ^ 0x5c))
+    done
+    local inner
+    inner=$({ hex_bytes "$ipad"; printf '%s' "$2"; } | sha256sum | cut -d' ' -f1)
+    hex_bytes "$({ hex_bytes "$opad"; hex_bytes "$inner"; } | sha256sum | cut -d' ' -f1)"
+}
+
+# nv_read reads SIZE bytes of an NV index, authorized like udm does: with the auth value
+# HMAC-SHA256(secret, index) on stdin in password mode, a PCR policy session in pcr mode
+nv_read() {
+    case "$NV_AUTH_MODE" in
+    password)
+        # Leading and trailing whitespace is trimmed like udm does
+        local secret
+        secret=$(<"$NV_AUTH_SECRET_FILE") || return 1
+        secret="${secret#"${secret%%[![:space:]]*}"}"
+        secret="${secret%"${secret##*[![:space:]]}"}"
+        hmac_sha256 "$secret" "$1" | $TPM2_NVREAD --size "$2" --auth=file:- "$1"
+        ;;
+    pcr)
+        $TPM2_NVREAD --size "$2" --auth="pcr:$NV_AUTH_PCRS" "$1"
+        ;;
+    *)
+        $TPM2_NVREAD --size "$2" "$1"
+        ;;
+    esac
+}
+
+# Size recorded by add-persistent-mount, entries written before it recorded one hold a
+# key of a single index. Following indices are never probed, they may belong to another
+# volume.
+if [[ -z "$SIZE" ]]; then
+    SIZE=$($TPM2_NVREADPUBLIC "$NV_INDEX" 2>/dev/null | awk '/size:/ {print $2; exit}')
+    SIZE="${SIZE:-0}"
+fi
+
+if [[ $SIZE -eq 0 ]]; then
+    echo "Error: Failed to determine key size for TPM NV Index $NV_INDEX" >&2
     exit 1
 fi
 
-# Output the key
-echo -n "$OUTPUT"
+# Read the key from the TPM NV Index (or indices) and output it
+INDEX=$NV_INDEX
+REMAINING=$SIZE
+while [[ $REMAINING -gt 0 ]]; do
+    READ=$((REMAINING < CHUNK_SIZE ? REMAINING : CHUNK_SIZE))
+    if ! nv_read "$INDEX" "$READ" 2>/dev/null; then
+        echo "Error: Failed to read key from TPM NV Index $INDEX" >&2
+        exit 1
+    fi
+    REMAINING=$((REMAINING - READ))
+    INDEX=$(printf '0x%x' $((INDEX + 1)))
+done
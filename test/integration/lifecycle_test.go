@@ -0,0 +1,228 @@
+//go:build integration
+
+// Package integration runs udm end to end against loop-backed volumes, and against
+// swtpm for the TPM paths. It needs root, cryptsetup and e2fsprogs, and modifies
+// /etc/crypttab and /etc/fstab, so it only runs in disposable machines or containers:
+//
+//	sudo go test -tags integration ./test/integration/
+package integration
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// udm is the binary under test, built once by TestMain.
+var udm string
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "udm-integration-*")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	udm = filepath.Join(dir, "udm")
+	if output, err := exec.Command("go", "build", "-o", udm, "bootstrap/cmd/udm").CombinedOutput(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to build udm: %s\n", output)
+		os.Exit(1)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// requireTools skips the test unless it runs as root with the given tools installed.
+func requireTools(t *testing.T, tools ...string) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("integration tests need root")
+	}
+	for _, tool := range append([]string{"cryptsetup", "losetup", "mkfs.ext4"}, tools...) {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not installed", tool)
+		}
+	}
+}
+
+// volume is a test volume with its config and bootstrap token in a temporary directory.
+type volume struct {
+	t       *testing.T
+	dir     string
+	config  string
+	image   string
+	keyfile string
+	env     []string
+}
+
+func newVolume(t *testing.T, name string, useTPM bool) *volume {
+	dir := t.TempDir()
+	v := &volume{t: t, dir: dir, config: filepath.Join(dir, "config.yml"), image: filepath.Join(dir, name+".img"),
+		keyfile: filepath.Join(dir, "key.bin")}
+	config := fmt.Sprintf(`luks:
+  volumePath: %q
+  mapperName: %q
+  mountPoint: %q
+  keyBytes: 32
+  size: 32
+  useTPM: %t
+  user: "root"
+  group: "root"
+  pbkdfMemory: 65536
+`, v.image, name, filepath.Join(dir, "mnt"), useTPM)
+	if err := os.WriteFile(v.config, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Tokens authorize once per device, so every volume gets its own
+	token := fmt.Sprintf("bootstrap:\n  token-id: %q\n  version: \"1.0\"\n", "integration-"+filepath.Base(dir))
+	if err := os.WriteFile(filepath.Join(dir, "bootstrap.yml"), []byte(token), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// run runs a udm command against the volume and returns its JSON result.
+func (v *volume) run(command string, args ...string) (bool, string) {
+	v.t.Helper()
+	args = append([]string{command, "--config=" + v.config, "--output=json"}, args...)
+	cmd := exec.Command(udm, args...)
+	cmd.Env = append(os.Environ(), v.env...)
+	output, _ := cmd.Output()
+
+	var result struct {
+		Success bool   `json:"success"`
+		Message string `json:"message"`
+		Error   string `json:"error"`
+	}
+	if err := json.Unmarshal(output, &result); err != nil {
+		v.t.Fatalf("udm %s printed no result: %s", command, output)
+	}
+	if !result.Success {
+		return false, result.Error
+	}
+	return true, result.Message
+}
+
+// must runs a udm command that has to succeed.
+func (v *volume) must(command string, args ...string) {
+	v.t.Helper()
+	if ok, message := v.run(command, args...); !ok {
+		v.t.Fatalf("udm %s failed: %s", command, message)
+	}
+}
+
+func (v *volume) mounted() bool {
+	data, err := os.ReadFile("/proc/mounts")
+	if err != nil {
+		v.t.Fatal(err)
+	}
+	return strings.Contains(string(data), " "+filepath.Join(v.dir, "mnt")+" ")
+}
+
+// lifecycle runs authorize, mount, persist, unmount and deauthorize on the volume.
+func lifecycle(t *testing.T, v *volume, keyArgs ...string) {
+	bootstrap := "--bootstrap=" + filepath.Join(v.dir, "bootstrap.yml")
+	v.must("authorize", append([]string{bootstrap}, keyArgs...)...)
+	t.Cleanup(func() { v.run("deauthorize") })
+	if !v.mounted() {
+		t.Fatalf("volume not mounted after authorize")
+	}
+
+	marker := filepath.Join(v.dir, "mnt", "marker")
+	if err := os.WriteFile(marker, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	v.must("unmount")
+	if v.mounted() {
+		t.Fatalf("volume still mounted after unmount")
+	}
+
+	v.must("mount", keyArgs...)
+	if data, err := os.ReadFile(marker); err != nil || string(data) != "data" {
+		t.Fatalf("data lost across unmount and mount: %v", err)
+	}
+	v.must("verify", keyArgs...)
+
+	v.must("add-persistent-mount", keyArgs...)
+	v.must("remove-persistent-mount")
+
+	v.must("unmount")
+	v.must("deauthorize")
+	if _, err := os.Stat(v.image); err == nil {
+		t.Fatalf("volume file left behind by deauthorize")
+	}
+}
+
+func TestKeyfileLifecycle(t *testing.T) {
+	requireTools(t)
+	v := newVolume(t, "udm-it-keyfile", false)
+	lifecycle(t, v, "--keyfile="+v.keyfile)
+
+	if _, err := os.Stat(v.keyfile); err != nil {
+		t.Errorf("keyfile not written by authorize: %v", err)
+	}
+}
+
+func TestTPMLifecycle(t *testing.T) {
+	requireTools(t, "swtpm", "tpm2_nvdefine")
+	v := newVolume(t, "udm-it-tpm", true)
+	v.env = startSWTPM(t)
+	lifecycle(t, v)
+}
+
+// startSWTPM starts a TPM 2.0 simulator for the test and returns the environment
+// pointing tpm2-tools at it.
+func startSWTPM(t *testing.T) []string {
+	t.Helper()
+	port := freePort(t)
+	cmd := exec.Command("swtpm", "socket", "--tpm2",
+		"--tpmstate", "dir="+t.TempDir(),
+		"--server", fmt.Sprintf("type=tcp,port=%d", port),
+		"--ctrl", fmt.Sprintf("type=tcp,port=%d", port+1),
+		"--flags", "not-need-init,startup-clear")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start swtpm: %v", err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("swtpm did not start: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return []string{fmt.Sprintf("TPM2TOOLS_TCTI=swtpm:host=127.0.0.1,port=%d", port)}
+}
+
+// freePort returns a port whose successor is free too, for the swtpm control channel.
+func freePort(t *testing.T) int {
+	t.Helper()
+	for i := 0; i < 10; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := l.Addr().(*net.TCPAddr).Port
+		l.Close()
+		if ctrl, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port+1)); err == nil {
+			ctrl.Close()
+			return port
+		}
+	}
+	t.Fatal("no free port pair for swtpm")
+	return 0
+}